@@ -0,0 +1,53 @@
+// Persistent state for scripts run with singleload.
+//
+//     const state = require("singleload-state");
+//     const config = state.load("config.json", { runs: 0 });
+//     config.runs += 1;
+//     state.save("config.json", config);
+//
+// Outside singleload the state lives in ~/.local/state/<script name>.
+
+"use strict";
+
+const fs = require("fs");
+const os = require("os");
+const path = require("path");
+
+/** The script's state directory, created if it is missing */
+function dir() {
+  let state = process.env.SINGLELOAD_STATE_DIR;
+  if (!state) {
+    const base = process.env.XDG_STATE_HOME || path.join(os.homedir(), ".local", "state");
+    const script = process.argv[1] || "node";
+    state = path.join(base, path.basename(script, path.extname(script)));
+  }
+  fs.mkdirSync(state, { recursive: true, mode: 0o700 });
+  return state;
+}
+
+/** Path of a file in the state directory */
+function file(name) {
+  return path.join(dir(), name);
+}
+
+/** The JSON value saved under name, or fallback if there is none */
+function load(name, fallback = undefined) {
+  try {
+    return JSON.parse(fs.readFileSync(file(name), "utf8"));
+  } catch (error) {
+    if (error.code === "ENOENT") {
+      return fallback;
+    }
+    throw error;
+  }
+}
+
+/** Saves value as JSON under name; a crash never leaves half a file */
+function save(name, value) {
+  const target = file(name);
+  const temp = path.join(path.dirname(target), `.tmp-${process.pid}-${path.basename(target)}`);
+  fs.writeFileSync(temp, JSON.stringify(value));
+  fs.renameSync(temp, target);
+}
+
+module.exports = { dir, path: file, load, save };
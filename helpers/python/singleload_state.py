@@ -0,0 +1,54 @@
+"""Persistent state for scripts run with singleload.
+
+    import singleload_state
+    config = singleload_state.load("config.json", {"runs": 0})
+    config["runs"] += 1
+    singleload_state.save("config.json", config)
+
+Outside singleload the state lives in ~/.local/state/<script name>.
+"""
+
+import json
+import os
+import sys
+import tempfile
+
+__all__ = ["dir", "path", "load", "save"]
+
+
+def dir():
+    """The script's state directory, created if it is missing"""
+    state = os.environ.get("SINGLELOAD_STATE_DIR")
+    if not state:
+        base = os.environ.get("XDG_STATE_HOME") or os.path.join(os.path.expanduser("~"), ".local", "state")
+        name = os.path.splitext(os.path.basename(sys.argv[0] or "python"))[0]
+        state = os.path.join(base, name)
+    os.makedirs(state, mode=0o700, exist_ok=True)
+    return state
+
+
+def path(name):
+    """Path of a file in the state directory"""
+    return os.path.join(dir(), name)
+
+
+def load(name, default=None):
+    """The JSON value saved under name, or default if there is none"""
+    try:
+        with open(path(name)) as file:
+            return json.load(file)
+    except FileNotFoundError:
+        return default
+
+
+def save(name, value):
+    """Saves value as JSON under name; a crash never leaves half a file"""
+    target = path(name)
+    fd, temp = tempfile.mkstemp(dir=os.path.dirname(target), prefix=".tmp-")
+    try:
+        with os.fdopen(fd, "w") as file:
+            json.dump(value, file)
+        os.replace(temp, target)
+    except BaseException:
+        os.unlink(temp)
+        raise
@@ -0,0 +1,220 @@
+use crate::directives::split_words;
+use crate::errors::SingleloadError;
+
+/// Prefix of the environment variables parsed arguments are passed in
+pub const ARG_VAR_PREFIX: &str = "ARG_";
+
+/// Type of a declared argument, checked before the script starts
+#[derive(Debug, Clone, PartialEq)]
+pub enum ArgKind {
+    String,
+    Int,
+    Float,
+    /// A switch: `--verbose` alone sets it, `--verbose=false` clears it
+    Bool,
+    /// One of a fixed set of values, declared as `choice(fast|slow)`
+    Choice(Vec<String>),
+}
+
+impl ArgKind {
+    fn parse(word: &str) -> Option<Self> {
+        match word {
+            "string" | "str" => Some(Self::String),
+            "int" => Some(Self::Int),
+            "float" => Some(Self::Float),
+            "bool" => Some(Self::Bool),
+            _ => {
+                let values = word.strip_prefix("choice(")?.strip_suffix(')')?;
+                let values: Vec<String> = values.split('|').filter(|v| !v.is_empty()).map(String::from).collect();
+                (!values.is_empty()).then_some(Self::Choice(values))
+            }
+        }
+    }
+
+    /// The value as the script sees it, or why it is not one of this type
+    fn check(&self, value: &str) -> Result<String, String> {
+        match self {
+            Self::String => Ok(value.to_string()),
+            Self::Int => value
+                .parse::<i64>()
+                .map(|v| v.to_string())
+                .map_err(|_| "expected an integer".to_string()),
+            Self::Float => match value.parse::<f64>() {
+                Ok(v) if v.is_finite() => Ok(value.to_string()),
+                _ => Err("expected a number".to_string()),
+            },
+            Self::Bool => match value.to_ascii_lowercase().as_str() {
+                "true" | "yes" | "1" => Ok("true".to_string()),
+                "false" | "no" | "0" => Ok("false".to_string()),
+                _ => Err("expected true or false".to_string()),
+            },
+            Self::Choice(values) => match values.iter().any(|v| v == value) {
+                true => Ok(value.to_string()),
+                false => Err(format!("expected one of {}", values.join(", "))),
+            },
+        }
+    }
+}
+
+impl std::fmt::Display for ArgKind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::String => f.write_str("string"),
+            Self::Int => f.write_str("int"),
+            Self::Float => f.write_str("float"),
+            Self::Bool => f.write_str("bool"),
+            Self::Choice(values) => write!(f, "{}", values.join("|")),
+        }
+    }
+}
+
+/// A command-line option declared with an `arg` directive:
+/// `arg --count int default=1 help="How many times"`
+#[derive(Debug, Clone, PartialEq)]
+pub struct ArgSpec {
+    /// Option name without the leading dashes
+    pub name: String,
+    pub kind: ArgKind,
+    pub default: Option<String>,
+    pub required: bool,
+    pub help: Option<String>,
+    /// Line of the directive
+    pub line: usize,
+}
+
+impl ArgSpec {
+    /// Parses the value of an `arg` directive on `line`
+    pub fn parse(line: usize, value: &str) -> Result<Self, SingleloadError> {
+        let invalid = |message: String| SingleloadError::InvalidInput(format!("line {}: {}", line, message));
+        let words = split_words(value).ok_or_else(|| invalid("unterminated quote in 'arg' directive".to_string()))?;
+        let mut words = words.into_iter();
+
+        let option = words.next().unwrap_or_default();
+        let name = option
+            .strip_prefix("--")
+            .filter(|n| !n.is_empty() && n.chars().all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_'))
+            .ok_or_else(|| invalid(format!("expected 'arg --<name> <type>', found '{}'", option)))?
+            .to_string();
+        let kind_word = words.next().unwrap_or_default();
+        let kind = ArgKind::parse(&kind_word).ok_or_else(|| {
+            invalid(format!(
+                "unknown argument type '{}' (expected string, int, float, bool or choice(a|b))",
+                kind_word
+            ))
+        })?;
+
+        let mut spec = Self {
+            name,
+            kind,
+            default: None,
+            required: false,
+            help: None,
+            line,
+        };
+        for word in words {
+            if word == "required" {
+                spec.required = true;
+            } else if let Some(default) = word.strip_prefix("default=") {
+                let default = spec
+                    .kind
+                    .check(default)
+                    .map_err(|e| invalid(format!("default of --{}: {}", spec.name, e)))?;
+                spec.default = Some(default);
+            } else if let Some(help) = word.strip_prefix("help=") {
+                spec.help = Some(help.to_string());
+            } else {
+                return Err(invalid(format!("unknown 'arg' attribute '{}'", word)));
+            }
+        }
+        if spec.required && spec.default.is_some() {
+            return Err(invalid(format!("--{} cannot be both required and defaulted", spec.name)));
+        }
+        Ok(spec)
+    }
+
+    /// `ARG_<NAME>`, upper case with dashes as underscores
+    pub fn var(&self) -> String {
+        format!("{}{}", ARG_VAR_PREFIX, self.name.to_ascii_uppercase().replace('-', "_"))
+    }
+}
+
+/// Checks the arguments a script is run with against its declared options
+/// and returns the environment variables carrying their values. Words that
+/// do not start with `--`, and everything after a bare `--`, are left to
+/// the script. Switches not given are `false`; other options not given get
+/// their default, or no variable.
+pub fn parse(specs: &[ArgSpec], args: &[String]) -> Result<Vec<(String, String)>, SingleloadError> {
+    let mut values: Vec<Option<String>> = specs.iter().map(|spec| spec.default.clone()).collect();
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        if arg == "--" {
+            break;
+        }
+        let Some(option) = arg.strip_prefix("--") else {
+            continue;
+        };
+        let (name, inline) = match option.split_once('=') {
+            Some((name, value)) => (name, Some(value.to_string())),
+            None => (option, None),
+        };
+        let idx = specs
+            .iter()
+            .position(|spec| spec.name == name)
+            .ok_or_else(|| invalid_arg(specs, format!("unknown option --{}", name)))?;
+        let spec = &specs[idx];
+        let value = match (inline, &spec.kind) {
+            (Some(value), _) => value,
+            (None, ArgKind::Bool) => "true".to_string(),
+            (None, _) => args
+                .next()
+                .cloned()
+                .ok_or_else(|| invalid_arg(specs, format!("--{} needs a {} value", name, spec.kind)))?,
+        };
+        let value = spec
+            .kind
+            .check(&value)
+            .map_err(|e| invalid_arg(specs, format!("invalid value '{}' for --{}: {}", value, name, e)))?;
+        values[idx] = Some(value);
+    }
+
+    let mut env = Vec::new();
+    for (spec, value) in specs.iter().zip(values) {
+        let value = match (value, &spec.kind) {
+            (Some(value), _) => value,
+            (None, ArgKind::Bool) => "false".to_string(),
+            (None, _) if spec.required => {
+                return Err(invalid_arg(specs, format!("missing required option --{}", spec.name)))
+            }
+            (None, _) => continue,
+        };
+        env.push((spec.var(), value));
+    }
+    Ok(env)
+}
+
+/// One line per declared option, for error messages
+pub fn usage(specs: &[ArgSpec]) -> String {
+    specs
+        .iter()
+        .map(|spec| {
+            let mut line = format!("  --{}", spec.name);
+            if spec.kind != ArgKind::Bool {
+                line.push_str(&format!(" <{}>", spec.kind));
+            }
+            if let Some(help) = &spec.help {
+                line.push_str(&format!("  {}", help));
+            }
+            if let Some(default) = &spec.default {
+                line.push_str(&format!(" (default: {})", default));
+            } else if spec.required {
+                line.push_str(" (required)");
+            }
+            line
+        })
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+fn invalid_arg(specs: &[ArgSpec], message: String) -> SingleloadError {
+    SingleloadError::InvalidInput(format!("{}\nOptions of this script:\n{}", message, usage(specs)))
+}
@@ -0,0 +1,112 @@
+use crate::errors::SingleloadError;
+use crate::runner::BuildTarget;
+use std::path::{Path, PathBuf};
+
+/// Placeholders of `build -o` templates
+pub const PLACEHOLDERS: &[&str] = &["name", "goos", "goarch", "target", "ext"];
+
+/// Returns true if `output` names its artifact with placeholders
+pub fn is_template(output: &Path) -> bool {
+    output.to_string_lossy().contains('{')
+}
+
+/// Every target of a multi-target build: each GOOS with each GOARCH, and
+/// each target triple. A single None builds for the container's platform.
+pub fn targets(goos: &[String], goarch: &[String], triples: &[String]) -> Vec<Option<BuildTarget>> {
+    let each = |values: &[String]| -> Vec<Option<String>> {
+        match values.is_empty() {
+            true => vec![None],
+            false => values.iter().cloned().map(Some).collect(),
+        }
+    };
+    let mut targets = Vec::new();
+    for os in each(goos) {
+        for arch in each(goarch) {
+            for triple in each(triples) {
+                let target = BuildTarget::from_flags(os.clone(), arch.clone(), triple);
+                if !targets.contains(&target) {
+                    targets.push(target);
+                }
+            }
+        }
+    }
+    targets
+}
+
+/// Fills in an output template for the build of `script` for `target`:
+///
+/// - `{name}` - the script's file name without its extension
+/// - `{goos}`, `{goarch}` - the Go platform, or the container's (`linux`
+///   and the host's architecture) when the build has none
+/// - `{target}` - the target as in default names, e.g. `linux-arm64` or
+///   `aarch64-unknown-linux-musl`
+/// - `{ext}` - `.exe` for Windows, `.wasm` for WebAssembly, otherwise empty
+///
+/// `{{` and `}}` stand for literal braces.
+pub fn expand(template: &str, script: &Path, target: Option<&BuildTarget>) -> Result<PathBuf, SingleloadError> {
+    let name = script
+        .file_stem()
+        .map(|s| s.to_string_lossy().to_string())
+        .unwrap_or_else(|| "app".to_string());
+    let goos = target.and_then(|t| t.goos.clone()).unwrap_or_else(|| "linux".to_string());
+    let goarch = target.and_then(|t| t.goarch.clone()).unwrap_or_else(|| host_goarch().to_string());
+    let target_name = match target.map(|t| t.to_string().replace('/', "-")) {
+        Some(name) if !name.is_empty() => name,
+        _ => format!("{}-{}", goos, goarch),
+    };
+    let ext = match target {
+        Some(t) if t.is_wasm() => ".wasm",
+        Some(t) if t.is_windows() => ".exe",
+        _ => "",
+    };
+
+    let mut output = String::with_capacity(template.len());
+    let mut rest = template;
+    while let Some(idx) = rest.find(['{', '}']) {
+        output.push_str(&rest[..idx]);
+        let tail = &rest[idx..];
+        if let Some(tail) = tail.strip_prefix("{{") {
+            output.push('{');
+            rest = tail;
+            continue;
+        }
+        if let Some(tail) = tail.strip_prefix("}}") {
+            output.push('}');
+            rest = tail;
+            continue;
+        }
+        let invalid = |reason: String| SingleloadError::InvalidInput(format!("Invalid output template '{}': {}", template, reason));
+        let end = match tail.starts_with('{') {
+            true => tail.find('}').ok_or_else(|| invalid("unclosed {".to_string()))?,
+            false => return Err(invalid("unmatched }".to_string())),
+        };
+        let value = match &tail[1..end] {
+            "name" => name.as_str(),
+            "goos" => goos.as_str(),
+            "goarch" => goarch.as_str(),
+            "target" => target_name.as_str(),
+            "ext" => ext,
+            other => {
+                return Err(invalid(format!(
+                    "unknown placeholder {{{}}} (expected one of {})",
+                    other,
+                    PLACEHOLDERS.iter().map(|p| format!("{{{}}}", p)).collect::<Vec<_>>().join(", ")
+                )))
+            }
+        };
+        output.push_str(value);
+        rest = &tail[end + 1..];
+    }
+    output.push_str(rest);
+    Ok(PathBuf::from(output))
+}
+
+/// GOARCH of the host, which containers share
+pub fn host_goarch() -> &'static str {
+    match std::env::consts::ARCH {
+        "x86_64" => "amd64",
+        "aarch64" => "arm64",
+        "x86" => "386",
+        other => other,
+    }
+}
@@ -0,0 +1,104 @@
+use crate::batch::expand_patterns;
+use crate::errors::SingleloadError;
+use std::path::{Component, Path, PathBuf};
+
+/// Upper bound on the combined size of a script's embedded assets
+pub const MAX_EMBED_SIZE: u64 = 50 * 1024 * 1024; // 50MB
+
+/// A file declared with `// singleload: embed <pattern>`, staged next to
+/// the script under its path relative to the script's directory
+#[derive(Debug, Clone, PartialEq)]
+pub struct Asset {
+    /// Path relative to the script directory, with `/` separators
+    pub name: String,
+    /// Location on the host
+    pub source: PathBuf,
+}
+
+/// Resolves embed patterns against `base` (the script's directory).
+///
+/// Patterns are relative globs (`templates/*.html`) or paths; a directory
+/// embeds every file below it. Files must stay inside `base`, even through
+/// symlinks, and every pattern must match at least one file.
+pub fn resolve(base: &Path, patterns: &[String]) -> Result<Vec<Asset>, SingleloadError> {
+    if patterns.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    let root = base_dir(base).canonicalize()?;
+    let mut assets = Vec::new();
+    let mut total = 0;
+
+    for pattern in patterns {
+        let relative = validate_pattern(pattern)?;
+        let full = base.join(&relative);
+        let glob = if full.is_dir() {
+            format!("{}/**", full.display())
+        } else {
+            full.display().to_string()
+        };
+
+        for path in expand_patterns(&[glob]).map_err(|_| {
+            SingleloadError::InvalidInput(format!("embed '{}' matches no files", pattern))
+        })? {
+            let canonical = path.canonicalize()?;
+            let name = canonical
+                .strip_prefix(&root)
+                .map_err(|_| {
+                    SingleloadError::SecurityViolation(format!(
+                        "embedded file {} is outside the script directory",
+                        path.display()
+                    ))
+                })?
+                .components()
+                .map(|c| c.as_os_str().to_string_lossy())
+                .collect::<Vec<_>>()
+                .join("/");
+
+            total += std::fs::metadata(&canonical)?.len();
+            if total > MAX_EMBED_SIZE {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "Embedded assets exceed {} bytes",
+                    MAX_EMBED_SIZE
+                )));
+            }
+
+            assets.push(Asset { name, source: canonical });
+        }
+    }
+
+    assets.sort_by(|a, b| a.name.cmp(&b.name));
+    assets.dedup_by(|a, b| a.name == b.name);
+    Ok(assets)
+}
+
+/// Only relative patterns without `..` are accepted, so a script cannot
+/// pull in files from elsewhere on the host
+fn validate_pattern(pattern: &str) -> Result<PathBuf, SingleloadError> {
+    let path = Path::new(pattern.trim());
+    let mut relative = PathBuf::new();
+    for component in path.components() {
+        match component {
+            Component::CurDir => {}
+            Component::Normal(part) => relative.push(part),
+            _ => {
+                return Err(SingleloadError::SecurityViolation(format!(
+                    "embed '{}' must be a path inside the script directory",
+                    pattern
+                )))
+            }
+        }
+    }
+    if relative.as_os_str().is_empty() {
+        return Err(SingleloadError::InvalidInput("embed needs a file or pattern".to_string()));
+    }
+    Ok(relative)
+}
+
+fn base_dir(base: &Path) -> &Path {
+    if base.as_os_str().is_empty() {
+        Path::new(".")
+    } else {
+        base
+    }
+}
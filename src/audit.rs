@@ -0,0 +1,385 @@
+use crate::config::ProxyConfig;
+use crate::directives::PackageManager;
+use crate::errors::SingleloadError;
+use crate::sbom::{is_exact_version, Component};
+use clap::ValueEnum;
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use std::collections::HashMap;
+use std::time::Duration;
+use tracing::debug;
+
+/// Public OSV database, used unless `osv_url` points elsewhere
+pub const OSV_URL: &str = "https://api.osv.dev";
+
+const QUERY_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// What `run --audit` does about vulnerable dependencies
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize, ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum AuditMode {
+    /// Do not scan
+    #[default]
+    Off,
+    /// Log the vulnerabilities found and run anyway
+    Warn,
+    /// Refuse to run scripts with critical vulnerabilities
+    Deny,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Serialize, ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum Severity {
+    /// No CVSS v3 score or severity label in the advisory
+    Unknown,
+    Low,
+    Medium,
+    High,
+    Critical,
+}
+
+impl Severity {
+    /// CVSS qualitative rating of a base score
+    pub fn from_score(score: f64) -> Self {
+        match score {
+            s if s >= 9.0 => Self::Critical,
+            s if s >= 7.0 => Self::High,
+            s if s >= 4.0 => Self::Medium,
+            _ => Self::Low,
+        }
+    }
+
+    /// Severity label of GitHub and PyPA advisories
+    fn from_label(label: &str) -> Self {
+        match label.to_ascii_uppercase().as_str() {
+            "CRITICAL" => Self::Critical,
+            "HIGH" => Self::High,
+            "MODERATE" | "MEDIUM" => Self::Medium,
+            "LOW" => Self::Low,
+            _ => Self::Unknown,
+        }
+    }
+}
+
+impl std::fmt::Display for Severity {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let name = match self {
+            Self::Unknown => "unknown",
+            Self::Low => "low",
+            Self::Medium => "medium",
+            Self::High => "high",
+            Self::Critical => "critical",
+        };
+        f.write_str(name)
+    }
+}
+
+/// A known vulnerability affecting one package version
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Vulnerability {
+    /// OSV id, e.g. `GO-2024-2687` or `GHSA-...`
+    pub id: String,
+    /// Other ids of the same issue, CVEs among them
+    pub aliases: Vec<String>,
+    pub summary: String,
+    pub severity: Severity,
+    /// CVSS v3 base score, when the advisory has a vector
+    pub score: Option<f64>,
+    /// Versions the package is fixed in
+    pub fixed: Vec<String>,
+}
+
+impl Vulnerability {
+    /// Reads an OSV vulnerability record for `package`
+    pub fn from_osv(record: &Value, package: &str) -> Option<Self> {
+        let id = record["id"].as_str()?.to_string();
+        let strings = |value: &Value| -> Vec<String> {
+            value
+                .as_array()
+                .map(|items| items.iter().filter_map(|v| v.as_str().map(String::from)).collect())
+                .unwrap_or_default()
+        };
+
+        let score = record["severity"]
+            .as_array()
+            .into_iter()
+            .flatten()
+            .filter(|s| matches!(s["type"].as_str(), Some("CVSS_V3")))
+            .filter_map(|s| s["score"].as_str().and_then(cvss3_base_score))
+            .fold(None, |max: Option<f64>, score| Some(max.map_or(score, |m| m.max(score))));
+        let severity = match (score, record["database_specific"]["severity"].as_str()) {
+            (Some(score), _) => Severity::from_score(score),
+            (None, Some(label)) => Severity::from_label(label),
+            (None, None) => Severity::Unknown,
+        };
+
+        let mut fixed = Vec::new();
+        for affected in record["affected"].as_array().into_iter().flatten() {
+            if let Some(name) = affected["package"]["name"].as_str() {
+                if !name.eq_ignore_ascii_case(package) {
+                    continue;
+                }
+            }
+            for range in affected["ranges"].as_array().into_iter().flatten() {
+                for event in range["events"].as_array().into_iter().flatten() {
+                    if let Some(version) = event["fixed"].as_str() {
+                        if !fixed.iter().any(|f| f == version) {
+                            fixed.push(version.to_string());
+                        }
+                    }
+                }
+            }
+        }
+
+        Some(Self {
+            id,
+            aliases: strings(&record["aliases"]),
+            summary: record["summary"].as_str().unwrap_or_default().to_string(),
+            severity,
+            score,
+            fixed,
+        })
+    }
+}
+
+/// Vulnerabilities found in one package
+#[derive(Debug, Clone, Serialize)]
+pub struct Finding {
+    pub name: String,
+    pub version: String,
+    pub vulnerabilities: Vec<Vulnerability>,
+}
+
+impl Finding {
+    pub fn worst(&self) -> Severity {
+        self.vulnerabilities
+            .iter()
+            .map(|v| v.severity)
+            .max()
+            .unwrap_or(Severity::Unknown)
+    }
+}
+
+/// Result of [`crate::executor::Executor::audit_script`]
+#[derive(Debug, Clone, Serialize)]
+pub struct AuditReport {
+    pub language: String,
+    /// Packages with an exact version, the ones that were looked up
+    pub scanned: usize,
+    /// Declared dependencies without an exact version, which cannot be looked up
+    pub unpinned: Vec<String>,
+    pub findings: Vec<Finding>,
+    pub duration_ms: u64,
+}
+
+impl AuditReport {
+    /// Findings with at least one vulnerability of `severity` or worse
+    pub fn at_least(&self, severity: Severity) -> impl Iterator<Item = &Finding> {
+        self.findings.iter().filter(move |f| f.worst() >= severity)
+    }
+
+    /// Why `--audit=deny` refuses the run, if it does: critical
+    /// vulnerabilities, or dependencies that could not be looked up
+    pub fn denied(&self) -> Option<String> {
+        let critical: Vec<String> = self
+            .at_least(Severity::Critical)
+            .map(|f| format!("{} {}", f.name, f.version))
+            .collect();
+        if !critical.is_empty() {
+            return Some(format!(
+                "Dependencies with critical vulnerabilities: {} (see 'singleload audit')",
+                critical.join(", ")
+            ));
+        }
+        if !self.unpinned.is_empty() {
+            return Some(format!(
+                "Dependencies without an exact version cannot be audited: {}; pin them or write a lockfile",
+                self.unpinned.join(", ")
+            ));
+        }
+        None
+    }
+}
+
+/// OSV ecosystem the packages of `manager` are published in
+pub fn ecosystem(manager: PackageManager) -> &'static str {
+    match manager {
+        PackageManager::Go => "Go",
+        PackageManager::Pip => "PyPI",
+        PackageManager::Npm => "npm",
+        PackageManager::Maven => "Maven",
+    }
+}
+
+/// Client of the OSV API (<https://osv.dev>)
+pub struct OsvClient {
+    url: String,
+    client: reqwest::Client,
+}
+
+impl OsvClient {
+    pub fn new(url: &str, proxy: &ProxyConfig) -> Result<Self, SingleloadError> {
+        let client_error = |e: reqwest::Error| SingleloadError::Container(format!("Failed to create HTTP client: {}", e));
+        let mut builder = reqwest::Client::builder().timeout(QUERY_TIMEOUT);
+        if let Some(https) = &proxy.https {
+            let no_proxy = proxy.no_proxy.as_deref().and_then(reqwest::NoProxy::from_string);
+            builder = builder.proxy(reqwest::Proxy::https(https).map_err(client_error)?.no_proxy(no_proxy));
+        }
+        Ok(Self {
+            url: url.trim_end_matches('/').to_string(),
+            client: builder.build().map_err(client_error)?,
+        })
+    }
+
+    /// Looks up every component with a manager and an exact version; the
+    /// others are left out. Returns the components with vulnerabilities.
+    pub async fn scan(&self, components: &[Component]) -> Result<Vec<Finding>, SingleloadError> {
+        let packages: Vec<(&Component, PackageManager, &str)> = components
+            .iter()
+            .filter_map(|c| Some((c, c.manager?, c.version.as_deref().filter(|v| is_exact_version(v))?)))
+            .collect();
+        if packages.is_empty() {
+            return Ok(Vec::new());
+        }
+
+        let queries: Vec<Value> = packages
+            .iter()
+            .map(|(component, manager, version)| {
+                json!({
+                    "package": { "name": component.name, "ecosystem": ecosystem(*manager) },
+                    "version": version.trim_start_matches("=="),
+                })
+            })
+            .collect();
+        let response = self.post("/v1/querybatch", &json!({ "queries": queries })).await?;
+        let results = response["results"].as_array().cloned().unwrap_or_default();
+
+        // The batch endpoint only returns ids; records are fetched once each
+        let mut records: HashMap<String, Value> = HashMap::new();
+        let mut findings = Vec::new();
+        for ((component, _, version), result) in packages.iter().zip(results) {
+            let mut vulnerabilities = Vec::new();
+            for id in result["vulns"].as_array().into_iter().flatten().filter_map(|v| v["id"].as_str()) {
+                if !records.contains_key(id) {
+                    let record = self.get(&format!("/v1/vulns/{}", id)).await?;
+                    records.insert(id.to_string(), record);
+                }
+                if let Some(vulnerability) = Vulnerability::from_osv(&records[id], &component.name) {
+                    vulnerabilities.push(vulnerability);
+                }
+            }
+            if !vulnerabilities.is_empty() {
+                vulnerabilities.sort_by(|a, b| b.severity.cmp(&a.severity).then_with(|| a.id.cmp(&b.id)));
+                findings.push(Finding {
+                    name: component.name.clone(),
+                    version: version.trim_start_matches("==").to_string(),
+                    vulnerabilities,
+                });
+            }
+        }
+        debug!("Looked up {} packages in {}", packages.len(), self.url);
+        Ok(findings)
+    }
+
+    async fn post(&self, path: &str, body: &Value) -> Result<Value, SingleloadError> {
+        let request = self
+            .client
+            .post(format!("{}{}", self.url, path))
+            .header("Content-Type", "application/json")
+            .body(serde_json::to_vec(body)?);
+        self.send(request).await
+    }
+
+    async fn get(&self, path: &str) -> Result<Value, SingleloadError> {
+        self.send(self.client.get(format!("{}{}", self.url, path))).await
+    }
+
+    async fn send(&self, request: reqwest::RequestBuilder) -> Result<Value, SingleloadError> {
+        let query_error = |e: reqwest::Error| SingleloadError::Container(format!("OSV query to {} failed: {}", self.url, e));
+        let body = request
+            .send()
+            .await
+            .and_then(|r| r.error_for_status())
+            .map_err(query_error)?
+            .bytes()
+            .await
+            .map_err(query_error)?;
+        Ok(serde_json::from_slice(&body)?)
+    }
+}
+
+/// Base score of a CVSS v3.0 or v3.1 vector such as
+/// `CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H`
+pub fn cvss3_base_score(vector: &str) -> Option<f64> {
+    let mut metrics = vector.split('/');
+    if !metrics.next()?.starts_with("CVSS:3") {
+        return None;
+    }
+    let metrics: HashMap<&str, &str> = metrics.filter_map(|m| m.split_once(':')).collect();
+    let metric = |name: &str| metrics.get(name).copied();
+
+    let changed = match metric("S")? {
+        "U" => false,
+        "C" => true,
+        _ => return None,
+    };
+    let av = match metric("AV")? {
+        "N" => 0.85,
+        "A" => 0.62,
+        "L" => 0.55,
+        "P" => 0.2,
+        _ => return None,
+    };
+    let ac = match metric("AC")? {
+        "L" => 0.77,
+        "H" => 0.44,
+        _ => return None,
+    };
+    let pr = match (metric("PR")?, changed) {
+        ("N", _) => 0.85,
+        ("L", false) => 0.62,
+        ("L", true) => 0.68,
+        ("H", false) => 0.27,
+        ("H", true) => 0.5,
+        _ => return None,
+    };
+    let ui = match metric("UI")? {
+        "N" => 0.85,
+        "R" => 0.62,
+        _ => return None,
+    };
+    let cia = |name: &str| match metric(name)? {
+        "H" => Some(0.56),
+        "L" => Some(0.22),
+        "N" => Some(0.0),
+        _ => None,
+    };
+
+    let iss = 1.0 - (1.0 - cia("C")?) * (1.0 - cia("I")?) * (1.0 - cia("A")?);
+    let impact = if changed {
+        7.52 * (iss - 0.029) - 3.25 * (iss - 0.02f64).powi(15)
+    } else {
+        6.42 * iss
+    };
+    if impact <= 0.0 {
+        return Some(0.0);
+    }
+    let exploitability = 8.22 * av * ac * pr * ui;
+    let score = if changed {
+        1.08 * (impact + exploitability)
+    } else {
+        impact + exploitability
+    };
+    Some(round_up(score.min(10.0)))
+}
+
+/// Rounds up to one decimal the way the CVSS v3.1 specification does, so
+/// floating point noise does not bump a score
+fn round_up(value: f64) -> f64 {
+    let scaled = (value * 100_000.0).round() as i64;
+    if scaled % 10_000 == 0 {
+        scaled as f64 / 100_000.0
+    } else {
+        ((scaled / 10_000) + 1) as f64 / 10.0
+    }
+}
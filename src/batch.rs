@@ -0,0 +1,140 @@
+use crate::errors::SingleloadError;
+use crate::executor::Executor;
+use crate::types::ExecutionResult;
+use futures::StreamExt;
+use globset::{Glob, GlobMatcher};
+use serde::Serialize;
+use std::path::{Component, Path, PathBuf};
+use std::time::Instant;
+
+/// Outcome of one script in a batch
+#[derive(Debug, Serialize)]
+pub struct BatchItem {
+    pub script: PathBuf,
+    #[serde(flatten)]
+    pub result: ExecutionResult,
+}
+
+impl BatchItem {
+    pub fn passed(&self) -> bool {
+        self.result.exit_code == 0 && self.result.error.is_none()
+    }
+}
+
+#[derive(Debug, Serialize)]
+pub struct BatchSummary {
+    pub total: usize,
+    pub passed: usize,
+    pub failed: usize,
+    pub duration_ms: u64,
+    /// In the order the scripts were given
+    pub results: Vec<BatchItem>,
+}
+
+/// Expands glob patterns (`examples/**/*.go`) into the matching files,
+/// sorted and without duplicates. Existing paths are taken as they are.
+pub fn expand_patterns(patterns: &[String]) -> Result<Vec<PathBuf>, SingleloadError> {
+    let mut scripts = Vec::new();
+    for pattern in patterns {
+        let path = Path::new(pattern);
+        if path.exists() {
+            scripts.push(path.to_path_buf());
+            continue;
+        }
+
+        // Walked paths are matched without the `./` the walk may start from
+        let matcher = Glob::new(pattern.trim_start_matches("./"))
+            .map_err(|e| SingleloadError::InvalidInput(format!("Invalid pattern '{}': {}", pattern, e)))?
+            .compile_matcher();
+        let before = scripts.len();
+        walk(&literal_prefix(path), &matcher, &mut scripts)?;
+        if scripts.len() == before {
+            return Err(SingleloadError::InvalidInput(format!("No files match '{}'", pattern)));
+        }
+    }
+
+    scripts.sort();
+    scripts.dedup();
+    Ok(scripts)
+}
+
+/// Leading components of the pattern without glob syntax, where the walk starts
+fn literal_prefix(pattern: &Path) -> PathBuf {
+    let mut prefix = PathBuf::new();
+    for component in pattern.components() {
+        if let Component::Normal(part) = component {
+            if part.to_string_lossy().contains(['*', '?', '[', '{']) {
+                break;
+            }
+        }
+        prefix.push(component);
+    }
+    if prefix.as_os_str().is_empty() {
+        prefix.push(".");
+    }
+    prefix
+}
+
+fn walk(dir: &Path, matcher: &GlobMatcher, out: &mut Vec<PathBuf>) -> Result<(), SingleloadError> {
+    let entries = match std::fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(_) => return Ok(()),
+    };
+    for entry in entries {
+        let entry = entry?;
+        let path = entry.path();
+        let hidden = path.file_name().map_or(false, |n| n.to_string_lossy().starts_with('.'));
+        if hidden {
+            continue;
+        }
+        // Symlinked directories are not followed, so a link back up the
+        // tree cannot loop the walk
+        let file_type = entry.file_type()?;
+        if file_type.is_dir() {
+            walk(&path, matcher, out)?;
+        } else if file_type.is_symlink() && path.is_dir() {
+            continue;
+        } else if matcher.is_match(path.strip_prefix("./").unwrap_or(&path)) {
+            out.push(path);
+        }
+    }
+    Ok(())
+}
+
+/// Runs every script with at most `jobs` containers at a time.
+/// `on_result` is called as each script finishes, in completion order.
+pub async fn run_all(
+    executor: &Executor,
+    lang: Option<&str>,
+    scripts: Vec<PathBuf>,
+    jobs: usize,
+    mut on_result: impl FnMut(&BatchItem),
+) -> BatchSummary {
+    let start_time = Instant::now();
+
+    let mut results: Vec<(usize, BatchItem)> = futures::stream::iter(scripts.into_iter().enumerate())
+        .map(|(idx, script)| async move {
+            let started = Instant::now();
+            let result = executor
+                .run_script(lang, &script, false)
+                .await
+                .unwrap_or_else(|e| ExecutionResult::error(e.to_string(), started.elapsed().as_millis() as u64));
+            (idx, BatchItem { script, result })
+        })
+        .buffer_unordered(jobs.max(1))
+        .inspect(|(_, item)| on_result(item))
+        .collect()
+        .await;
+
+    results.sort_by_key(|(idx, _)| *idx);
+    let results: Vec<BatchItem> = results.into_iter().map(|(_, item)| item).collect();
+    let passed = results.iter().filter(|item| item.passed()).count();
+
+    BatchSummary {
+        total: results.len(),
+        passed,
+        failed: results.len() - passed,
+        duration_ms: start_time.elapsed().as_millis() as u64,
+        results,
+    }
+}
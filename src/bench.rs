@@ -0,0 +1,145 @@
+use crate::executor::Executor;
+use anyhow::Result;
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+/// One measured run
+#[derive(Debug, Serialize)]
+pub struct BenchRun {
+    pub exit_code: u32,
+    /// Wall time of the script inside the container
+    pub time_ms: f64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub peak_rss_bytes: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+impl BenchRun {
+    pub fn passed(&self) -> bool {
+        self.exit_code == 0 && self.error.is_none()
+    }
+}
+
+/// Summary statistics over a series of samples
+#[derive(Debug, Clone, Copy, PartialEq, Serialize)]
+pub struct Stats {
+    pub min: f64,
+    pub max: f64,
+    pub mean: f64,
+    pub median: f64,
+    /// Sample standard deviation; 0 for a single sample
+    pub stddev: f64,
+    pub p95: f64,
+}
+
+impl Stats {
+    /// None without samples
+    pub fn from_samples(samples: &[f64]) -> Option<Self> {
+        if samples.is_empty() {
+            return None;
+        }
+        let mut sorted = samples.to_vec();
+        sorted.sort_by(f64::total_cmp);
+
+        let n = sorted.len();
+        let mean = sorted.iter().sum::<f64>() / n as f64;
+        let variance = if n > 1 {
+            sorted.iter().map(|x| (x - mean).powi(2)).sum::<f64>() / (n - 1) as f64
+        } else {
+            0.0
+        };
+
+        Some(Self {
+            min: sorted[0],
+            max: sorted[n - 1],
+            mean,
+            median: percentile(&sorted, 50.0),
+            stddev: variance.sqrt(),
+            p95: percentile(&sorted, 95.0),
+        })
+    }
+}
+
+/// Linear interpolation between the closest ranks of sorted samples
+fn percentile(sorted: &[f64], pct: f64) -> f64 {
+    let rank = pct / 100.0 * (sorted.len() - 1) as f64;
+    let (low, high) = (rank.floor() as usize, rank.ceil() as usize);
+    sorted[low] + (sorted[high] - sorted[low]) * (rank - low as f64)
+}
+
+#[derive(Debug, Serialize)]
+pub struct BenchSummary {
+    pub script: PathBuf,
+    pub language: String,
+    pub runs: usize,
+    pub warmup: usize,
+    pub passed: usize,
+    pub failed: usize,
+    /// How many runs ended with each exit code
+    pub exit_codes: BTreeMap<u32, usize>,
+    /// Over the runs that completed; None if none did
+    pub time_ms: Option<Stats>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub peak_rss_bytes: Option<Stats>,
+    pub results: Vec<BenchRun>,
+}
+
+/// Builds `script` into the cache, runs it `warmup` times without
+/// measuring, then measures `runs` executions, so no sample includes the
+/// build even without warmup runs. `on_run` is called with the index of each
+/// measured run as it finishes.
+pub async fn bench(
+    executor: &Executor,
+    lang: Option<&str>,
+    script: &Path,
+    runs: usize,
+    warmup: usize,
+    mut on_run: impl FnMut(usize, &BenchRun),
+) -> Result<BenchSummary> {
+    executor.prebuild_script(lang, script).await?;
+    for _ in 0..warmup {
+        executor.run_script(lang, script, false).await?;
+    }
+
+    let mut language = String::new();
+    let mut results = Vec::with_capacity(runs);
+    for idx in 0..runs {
+        let (result, measurement) = executor.measure_script(lang, script).await?;
+        let run = BenchRun {
+            exit_code: result.exit_code,
+            time_ms: measurement.elapsed_ms.unwrap_or(result.duration_ms as f64),
+            peak_rss_bytes: measurement.peak_rss_bytes,
+            error: result.error,
+        };
+        on_run(idx, &run);
+        language = measurement.language;
+        results.push(run);
+    }
+
+    // Runs that errored out (timeouts, container failures) say nothing
+    // about the script's own speed
+    let completed: Vec<&BenchRun> = results.iter().filter(|run| run.error.is_none()).collect();
+    let times: Vec<f64> = completed.iter().map(|run| run.time_ms).collect();
+    let peaks: Vec<f64> = completed.iter().filter_map(|run| run.peak_rss_bytes).map(|b| b as f64).collect();
+
+    let mut exit_codes = BTreeMap::new();
+    for run in &results {
+        *exit_codes.entry(run.exit_code).or_insert(0) += 1;
+    }
+    let passed = results.iter().filter(|run| run.passed()).count();
+
+    Ok(BenchSummary {
+        script: script.to_path_buf(),
+        language,
+        runs,
+        warmup,
+        passed,
+        failed: runs - passed,
+        exit_codes,
+        time_ms: Stats::from_samples(&times),
+        peak_rss_bytes: Stats::from_samples(&peaks),
+        results,
+    })
+}
@@ -0,0 +1,138 @@
+use crate::errors::SingleloadError;
+use crate::runner::shell_quote;
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use regex::Regex;
+use sha2::{Digest, Sha256};
+use std::path::Path;
+
+/// Placeholder for the unpack directory in the paths a bundle runs with
+pub const BUNDLE_ROOT: &str = "/__singleload_bundle__";
+
+/// Line separating the launcher from the compressed payload
+const PAYLOAD_MARKER: &str = "__SINGLELOAD_PAYLOAD__";
+
+/// What the launcher runs once the payload is unpacked
+#[derive(Debug, Clone)]
+pub struct Launch {
+    pub language: String,
+    /// Command that runs the script, with paths under [`BUNDLE_ROOT`]
+    pub command: Vec<String>,
+    pub env: Vec<(String, String)>,
+    /// `major.minor` version of the interpreter dependencies were installed
+    /// for; the launcher refuses other versions
+    pub runtime_version: Option<String>,
+}
+
+/// Packs the staged workspace and the resolved dependencies into a
+/// gzipped tarball with `workspace/` and `deps/` at the top
+pub fn payload(workspace: &Path, deps: Option<&Path>) -> Result<Vec<u8>, SingleloadError> {
+    let mut archive = tar::Builder::new(GzEncoder::new(Vec::new(), Compression::best()));
+    archive.follow_symlinks(false);
+    archive.append_dir_all("workspace", workspace)?;
+    if let Some(deps) = deps {
+        archive.append_dir_all("deps", deps)?;
+    }
+    Ok(archive.into_inner()?.finish()?)
+}
+
+/// Shell launcher that unpacks the payload into the user's cache once
+/// (keyed by its checksum) and then runs the script with the host runtime
+pub fn launcher(launch: &Launch, payload: &[u8]) -> String {
+    let mut script = format!(
+        r#"#!/bin/sh
+# {language} program bundled by singleload
+set -e
+dir="${{XDG_CACHE_HOME:-$HOME/.cache}}/singleload/bundles/{hash}"
+if [ ! -d "$dir" ]; then
+  tmp="$dir.$$"
+  mkdir -p "$tmp"
+  line=$(awk '/^{marker}$/ {{ print NR + 1; exit }}' "$0")
+  tail -n +"$line" "$0" | tar -xzf - -C "$tmp"
+  mv "$tmp" "$dir" 2>/dev/null || rm -rf "$tmp"
+fi
+"#,
+        language = launch.language,
+        hash = hex::encode(Sha256::digest(payload)),
+        marker = PAYLOAD_MARKER,
+    );
+    script.push_str(&launch_commands(launch));
+    script.push_str(PAYLOAD_MARKER);
+    script.push('\n');
+    script
+}
+
+/// Launcher for a bundle left unpacked, with `workspace/` and `deps/` next
+/// to it, the way remote runs upload one so unchanged files are not sent
+/// again
+pub fn unpacked_launcher(launch: &Launch) -> String {
+    let mut script = format!(
+        "#!/bin/sh\n# {} program bundled by singleload\nset -e\ndir=$(cd \"$(dirname \"$0\")\" && pwd)\n",
+        launch.language
+    );
+    script.push_str(&launch_commands(launch));
+    script
+}
+
+/// Checks the runtime, then runs the script from `$dir`
+fn launch_commands(launch: &Launch) -> String {
+    let interpreter = launch.command.first().map(String::as_str).unwrap_or_default();
+    let mut script = format!(
+        r#"if ! command -v {interpreter} >/dev/null 2>&1; then
+  echo "{interpreter} is required to run this program" >&2
+  exit 127
+fi
+"#,
+        interpreter = shell_quote(interpreter),
+    );
+
+    if let Some(version) = &launch.runtime_version {
+        script.push_str(&format!(
+            r#"case "$({interpreter} --version 2>&1)" in
+  *{version}.*) ;;
+  *) echo "this program needs {interpreter} {version}" >&2; exit 127 ;;
+esac
+"#,
+            interpreter = shell_quote(interpreter),
+            version = shell_quote(version),
+        ));
+    }
+
+    for (key, value) in &launch.env {
+        script.push_str(&format!("export {}={}\n", key, bundle_word(value)));
+    }
+    let command: Vec<String> = launch.command.iter().map(|arg| bundle_word(arg)).collect();
+    script.push_str(&format!("exec {} \"$@\"\n", command.join(" ")));
+    script
+}
+
+/// Writes the launcher followed by the payload as an executable file
+pub fn write(output: &Path, launcher: &str, payload: &[u8]) -> Result<(), SingleloadError> {
+    let mut bundle = launcher.as_bytes().to_vec();
+    bundle.extend_from_slice(payload);
+    std::fs::write(output, bundle)?;
+
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(output, std::fs::Permissions::from_mode(0o755))?;
+    }
+    Ok(())
+}
+
+/// First `major.minor` version number in an interpreter's `--version` output
+pub fn major_minor(version_output: &str) -> Option<String> {
+    let re = Regex::new(r"(\d+)\.(\d+)").unwrap();
+    re.captures(version_output).map(|c| format!("{}.{}", &c[1], &c[2]))
+}
+
+/// Shell-quotes `arg`, expanding [`BUNDLE_ROOT`] to the unpack directory
+fn bundle_word(arg: &str) -> String {
+    arg.split(BUNDLE_ROOT)
+        .enumerate()
+        .map(|(i, part)| {
+            let quoted = if part.is_empty() { String::new() } else { shell_quote(part) };
+            if i == 0 { quoted } else { format!("\"$dir\"{}", quoted) }
+        })
+        .collect()
+}
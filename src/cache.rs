@@ -0,0 +1,865 @@
+use crate::errors::SingleloadError;
+use crate::platform;
+use chrono::{DateTime, Duration as ChronoDuration, Utc};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::BTreeMap;
+use std::fs::{File, OpenOptions, TryLockError};
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
+use tracing::{debug, info, warn};
+
+const META_FILE: &str = "meta.json";
+const ARTIFACT_DIR: &str = "artifact";
+pub(crate) const COMPLETE_MARKER: &str = ".singleload-complete";
+
+/// Lock files of entries being built, under the cache root
+const LOCKS_DIR: &str = ".locks";
+
+/// Entries being built, moved into the cache root once complete
+const STAGING_DIR: &str = ".staging";
+
+/// Artifact files shared by entries, as `<sha256[..2]>/<sha256>-<mode>`
+const BLOBS_DIR: &str = ".blobs";
+
+/// Objects of C and C++ builds, in a directory per script
+const OBJECTS_DIR: &str = ".objects";
+
+/// Hit and miss counters per language, under the cache root
+const STATS_FILE: &str = ".stats.json";
+
+const LOCK_POLL_INTERVAL: Duration = Duration::from_millis(100);
+
+/// Container path the artifact directory of a build cache entry is mounted at
+pub const CONTAINER_CACHE_DIR: &str = "/cache";
+
+/// Container path a script's object directory is mounted at in its build containers
+pub const CONTAINER_OBJECTS_DIR: &str = "/objects";
+
+/// Container path resolved inline dependencies are mounted at
+pub const CONTAINER_DEPS_DIR: &str = "/deps";
+
+/// Content-addressed store for compiled build artifacts
+#[derive(Debug, Clone)]
+pub struct BuildCache {
+    root: PathBuf,
+    budget: CacheBudget,
+    dedupe: bool,
+}
+
+/// Limits enforced after every write, from the `cache` config table
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct CacheBudget {
+    /// Total size of complete entries; the least recently used go first
+    pub max_bytes: Option<u64>,
+    /// Entries unused for longer are removed
+    pub max_age: Option<ChronoDuration>,
+}
+
+impl CacheBudget {
+    pub fn is_limited(&self) -> bool {
+        self.max_bytes.is_some() || self.max_age.is_some()
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CacheMeta {
+    pub language: String,
+    pub source: String,
+    pub created_at: DateTime<Utc>,
+    pub last_used_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct CacheEntry {
+    pub key: String,
+    pub language: String,
+    pub source: String,
+    pub size_bytes: u64,
+    pub complete: bool,
+    pub created_at: Option<DateTime<Utc>>,
+    pub last_used_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Default, Serialize)]
+pub struct GcReport {
+    pub removed: usize,
+    pub freed_bytes: u64,
+}
+
+/// Result of [`BuildCache::stats`]
+#[derive(Debug, Serialize)]
+pub struct CacheStats {
+    pub root: PathBuf,
+    pub entries: usize,
+    pub size_bytes: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub max_bytes: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub max_age_secs: Option<i64>,
+    /// Bytes not taking up disk space twice because entries share artifact
+    /// files; `size_bytes` counts them once per entry
+    pub shared_bytes: u64,
+    /// Since when hits and misses have been counted
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub since: Option<DateTime<Utc>>,
+    pub hits: u64,
+    pub misses: u64,
+    /// Hits out of all lookups, if there were any
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub hit_rate: Option<f64>,
+    /// By language, largest first
+    pub languages: Vec<LanguageUsage>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct LanguageUsage {
+    pub language: String,
+    pub entries: usize,
+    pub size_bytes: u64,
+    pub hits: u64,
+    pub misses: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub hit_rate: Option<f64>,
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct Counters {
+    since: Option<DateTime<Utc>>,
+    languages: BTreeMap<String, LookupCounts>,
+}
+
+#[derive(Debug, Clone, Copy, Default, Serialize, Deserialize)]
+struct LookupCounts {
+    hits: u64,
+    misses: u64,
+}
+
+/// The right to build one cache entry, held until dropped. It is an OS file
+/// lock, so a crashed builder never leaves it behind.
+#[derive(Debug)]
+pub struct CacheLock {
+    _file: File,
+}
+
+/// An entry being built outside the cache root. [`Staging::publish`] moves
+/// it into place with a single rename, so readers only ever see complete
+/// entries; a staged entry that is never published is removed when dropped.
+#[derive(Debug)]
+pub struct Staging {
+    cache: BuildCache,
+    key: String,
+    dir: PathBuf,
+}
+
+impl BuildCache {
+    pub fn new(root: PathBuf) -> Self {
+        Self {
+            root,
+            budget: CacheBudget::default(),
+            dedupe: true,
+        }
+    }
+
+    /// Whether published entries hard-link identical artifact files to one
+    /// copy in the blob store
+    pub fn with_dedupe(mut self, dedupe: bool) -> Self {
+        self.dedupe = dedupe;
+        self
+    }
+
+    /// Trims the cache to `budget` after every entry published to it
+    pub fn with_budget(mut self, budget: CacheBudget) -> Self {
+        self.budget = budget;
+        self
+    }
+
+    pub fn budget(&self) -> CacheBudget {
+        self.budget
+    }
+
+    /// Default cache location, honoring XDG_CACHE_HOME (see [`platform::cache_dir`])
+    pub fn default_root() -> PathBuf {
+        platform::cache_dir()
+    }
+
+    pub fn root(&self) -> &Path {
+        &self.root
+    }
+
+    /// Computes the cache key from the runner's source key, the toolchain
+    /// identifier and the build flags.
+    pub fn key(source_key: &str, toolchain: &str, flags: &[String]) -> String {
+        let mut hasher = Sha256::new();
+        hasher.update(source_key.as_bytes());
+        hasher.update([0u8]);
+        hasher.update(toolchain.as_bytes());
+        for flag in flags {
+            hasher.update([0u8]);
+            hasher.update(flag.as_bytes());
+        }
+        hex::encode(hasher.finalize())
+    }
+
+    pub fn entry_dir(&self, key: &str) -> PathBuf {
+        self.root.join(key)
+    }
+
+    /// Host directory holding the artifacts of an entry
+    pub fn artifact_dir(&self, key: &str) -> PathBuf {
+        self.entry_dir(key).join(ARTIFACT_DIR)
+    }
+
+    /// Returns true if a previous build of this key finished successfully
+    pub fn is_complete(&self, key: &str) -> bool {
+        self.artifact_dir(key).join(COMPLETE_MARKER).exists()
+    }
+
+    /// Shell command that marks the entry mounted at `container_dir` as
+    /// complete, run inside the container after a successful build
+    pub fn complete_command(container_dir: &str) -> String {
+        format!("touch {}/{}", container_dir, COMPLETE_MARKER)
+    }
+
+    /// Creates the entry directory in place so it can be mounted into a
+    /// build container. Concurrent builders should use [`BuildCache::stage`].
+    pub fn prepare(&self, key: &str, language: &str, source: &str) -> Result<PathBuf, SingleloadError> {
+        let artifact_dir = self.init_entry(&self.entry_dir(key), language, source)?;
+        debug!("Prepared cache entry {}", key);
+        Ok(artifact_dir)
+    }
+
+    /// Creates a private entry for building `key`, to be published once complete
+    pub fn stage(&self, key: &str, language: &str, source: &str) -> Result<Staging, SingleloadError> {
+        let staging = Staging {
+            cache: self.clone(),
+            key: key.to_string(),
+            dir: self
+                .root
+                .join(STAGING_DIR)
+                .join(format!("{}-{}", key, uuid::Uuid::new_v4().simple())),
+        };
+        self.init_entry(&staging.dir, language, source)?;
+        debug!("Staged cache entry {} in {}", key, staging.dir.display());
+        Ok(staging)
+    }
+
+    fn init_entry(&self, dir: &Path, language: &str, source: &str) -> Result<PathBuf, SingleloadError> {
+        let artifact_dir = dir.join(ARTIFACT_DIR);
+        std::fs::create_dir_all(&artifact_dir)?;
+
+        // The build container's user is mapped to the owner of the cache, so
+        // only the owner may write the build output. The directories above
+        // it only need to be traversable.
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            for ancestor in dir.ancestors().take_while(|a| a.starts_with(&self.root)) {
+                std::fs::set_permissions(ancestor, std::fs::Permissions::from_mode(0o711))?;
+            }
+            std::fs::set_permissions(&artifact_dir, std::fs::Permissions::from_mode(0o755))?;
+        }
+
+        let now = Utc::now();
+        let meta = CacheMeta {
+            language: language.to_string(),
+            source: source.to_string(),
+            created_at: now,
+            last_used_at: now,
+        };
+        write_meta(&dir.join(META_FILE), &meta)?;
+        Ok(artifact_dir)
+    }
+
+    /// Host directory of the objects of `script`'s C or C++ builds. Each
+    /// script has its own, so a build can only leave objects for later
+    /// builds of the same script.
+    pub fn objects_dir(&self, script: &str) -> Result<PathBuf, SingleloadError> {
+        let dir = self
+            .root
+            .join(OBJECTS_DIR)
+            .join(&hex::encode(Sha256::digest(script.as_bytes()))[..16]);
+        std::fs::create_dir_all(&dir)?;
+        // Written by the build container's user, the owner, like entries
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(self.root.join(OBJECTS_DIR), std::fs::Permissions::from_mode(0o711))?;
+            std::fs::set_permissions(&dir, std::fs::Permissions::from_mode(0o700))?;
+        }
+        Ok(dir)
+    }
+
+    /// Removes the objects in `dir` other than `keep`, given as container
+    /// paths, so a script keeps only the objects of its latest build
+    pub fn prune_objects(dir: &Path, keep: &[String]) -> Result<(), SingleloadError> {
+        let keep: Vec<&str> = keep.iter().filter_map(|path| path.rsplit('/').next()).collect();
+        for entry in std::fs::read_dir(dir)? {
+            let entry = entry?;
+            let name = entry.file_name().to_string_lossy().to_string();
+            if !keep.contains(&name.trim_end_matches(".ok")) {
+                std::fs::remove_file(entry.path())?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Waits up to `wait` for the build lock of `key`. Returns None if
+    /// another builder still holds it by then; the caller builds anyway and
+    /// whichever build publishes first wins.
+    pub async fn lock(&self, key: &str, wait: Duration) -> Result<Option<CacheLock>, SingleloadError> {
+        let dir = self.root.join(LOCKS_DIR);
+        std::fs::create_dir_all(&dir)?;
+        let file = OpenOptions::new()
+            .create(true)
+            .write(true)
+            .truncate(false)
+            .open(dir.join(format!("{}.lock", key)))?;
+
+        let deadline = Instant::now() + wait;
+        let mut waiting = false;
+        loop {
+            match file.try_lock() {
+                Ok(()) => return Ok(Some(CacheLock { _file: file })),
+                Err(TryLockError::WouldBlock) => {}
+                Err(TryLockError::Error(e)) => return Err(e.into()),
+            }
+            if !waiting {
+                info!("Waiting for another build of {}", key);
+                waiting = true;
+            }
+            if Instant::now() >= deadline {
+                warn!("{} is still being built after {}s, building it again", key, wait.as_secs());
+                return Ok(None);
+            }
+            tokio::time::sleep(LOCK_POLL_INTERVAL).await;
+        }
+    }
+
+    /// Records a cache hit
+    pub fn touch(&self, key: &str) -> Result<(), SingleloadError> {
+        if let Some(mut meta) = self.read_meta(key) {
+            meta.last_used_at = Utc::now();
+            self.write_meta(key, &meta)?;
+            self.count(&meta.language, true);
+        }
+        Ok(())
+    }
+
+    /// Records a lookup of a `language` entry that has to be built
+    pub fn record_miss(&self, language: &str) {
+        self.count(language, false);
+    }
+
+    /// Counters are statistics, a failure to update them is not worth failing a build over
+    fn count(&self, language: &str, hit: bool) {
+        let updated = self.update_counters(|counters| {
+            let counts = counters.languages.entry(language.to_string()).or_default();
+            if hit {
+                counts.hits += 1;
+            } else {
+                counts.misses += 1;
+            }
+        });
+        if let Err(e) = updated {
+            debug!("Failed to update cache statistics: {}", e);
+        }
+    }
+
+    fn update_counters(&self, update: impl FnOnce(&mut Counters)) -> Result<(), SingleloadError> {
+        let dir = self.root.join(LOCKS_DIR);
+        std::fs::create_dir_all(&dir)?;
+        let lock = OpenOptions::new()
+            .create(true)
+            .write(true)
+            .truncate(false)
+            .open(dir.join("stats.lock"))?;
+        lock.lock()?;
+
+        let path = self.root.join(STATS_FILE);
+        let mut counters = self.read_counters();
+        counters.since.get_or_insert_with(Utc::now);
+        update(&mut counters);
+        let mut name = path.file_name().unwrap_or_default().to_os_string();
+        name.push(format!(".{}.tmp", uuid::Uuid::new_v4().simple()));
+        let tmp = path.with_file_name(name);
+        std::fs::write(&tmp, serde_json::to_vec_pretty(&counters)?)?;
+        std::fs::rename(&tmp, &path)?;
+        Ok(())
+    }
+
+    fn read_counters(&self) -> Counters {
+        std::fs::read(self.root.join(STATS_FILE))
+            .ok()
+            .and_then(|content| serde_json::from_slice(&content).ok())
+            .unwrap_or_default()
+    }
+
+    /// Usage and hit rates, overall and per language
+    pub fn stats(&self) -> Result<CacheStats, SingleloadError> {
+        let counters = self.read_counters();
+        let mut languages: BTreeMap<String, LanguageUsage> = BTreeMap::new();
+        let usage = |language: &str| LanguageUsage {
+            language: language.to_string(),
+            entries: 0,
+            size_bytes: 0,
+            hits: 0,
+            misses: 0,
+            hit_rate: None,
+        };
+
+        let entries = self.list()?;
+        for entry in &entries {
+            let language = if entry.language.is_empty() { "unknown" } else { &entry.language };
+            let usage = languages.entry(language.to_string()).or_insert_with(|| usage(language));
+            usage.entries += 1;
+            usage.size_bytes += entry.size_bytes;
+        }
+        for (language, counts) in &counters.languages {
+            let usage = languages.entry(language.clone()).or_insert_with(|| usage(language));
+            usage.hits = counts.hits;
+            usage.misses = counts.misses;
+        }
+
+        let mut languages: Vec<LanguageUsage> = languages.into_values().collect();
+        for usage in &mut languages {
+            usage.hit_rate = hit_rate(usage.hits, usage.misses);
+        }
+        languages.sort_by(|a, b| b.size_bytes.cmp(&a.size_bytes).then_with(|| a.language.cmp(&b.language)));
+
+        let hits = languages.iter().map(|u| u.hits).sum();
+        let misses = languages.iter().map(|u| u.misses).sum();
+        Ok(CacheStats {
+            root: self.root.clone(),
+            entries: entries.len(),
+            size_bytes: entries.iter().map(|e| e.size_bytes).sum(),
+            max_bytes: self.budget.max_bytes,
+            max_age_secs: self.budget.max_age.map(|age| age.num_seconds()),
+            shared_bytes: self.blobs().map(|(_, len, links)| len * links.saturating_sub(2)).sum(),
+            since: counters.since,
+            hits,
+            misses,
+            hit_rate: hit_rate(hits, misses),
+            languages,
+        })
+    }
+
+    /// Starts counting hits and misses from zero
+    pub fn reset_stats(&self) -> Result<(), SingleloadError> {
+        self.update_counters(|counters| *counters = Counters { since: Some(Utc::now()), ..Default::default() })
+    }
+
+    pub fn list(&self) -> Result<Vec<CacheEntry>, SingleloadError> {
+        let mut entries = vec![];
+        if !self.root.exists() {
+            return Ok(entries);
+        }
+
+        for dir_entry in std::fs::read_dir(&self.root)? {
+            let dir_entry = dir_entry?;
+            let key = dir_entry.file_name().to_string_lossy().to_string();
+            // Skips lock files and the staging area
+            if !dir_entry.file_type()?.is_dir() || key.starts_with('.') {
+                continue;
+            }
+            let meta = self.read_meta(&key);
+            entries.push(CacheEntry {
+                complete: self.is_complete(&key),
+                size_bytes: dir_size(&dir_entry.path()),
+                language: meta.as_ref().map(|m| m.language.clone()).unwrap_or_default(),
+                source: meta.as_ref().map(|m| m.source.clone()).unwrap_or_default(),
+                created_at: meta.as_ref().map(|m| m.created_at),
+                last_used_at: meta.as_ref().map(|m| m.last_used_at),
+                key,
+            });
+        }
+
+        entries.sort_by(|a, b| b.last_used_at.cmp(&a.last_used_at));
+        Ok(entries)
+    }
+
+    /// Removes incomplete entries, entries unused for longer than `max_age`
+    /// and staged entries left behind by builders that crashed a day ago or more
+    pub fn gc(&self, max_age: ChronoDuration) -> Result<GcReport, SingleloadError> {
+        let cutoff = Utc::now() - max_age;
+        let mut report = GcReport::default();
+
+        let staged = std::fs::read_dir(self.root.join(STAGING_DIR)).into_iter().flatten().flatten();
+        for dir_entry in staged {
+            let abandoned = dir_entry
+                .metadata()
+                .and_then(|m| m.modified())
+                .map(|modified| modified.elapsed().unwrap_or_default() > Duration::from_secs(24 * 60 * 60))
+                .unwrap_or(false);
+            if abandoned {
+                info!("Removing abandoned build {}", dir_entry.path().display());
+                report.freed_bytes += dir_size(&dir_entry.path());
+                std::fs::remove_dir_all(dir_entry.path())?;
+                report.removed += 1;
+            }
+        }
+
+        for entry in self.list()? {
+            let stale = entry.last_used_at.map(|t| t < cutoff).unwrap_or(true);
+            if !entry.complete || stale {
+                info!("Removing cache entry {}", entry.key);
+                self.remove(&entry.key)?;
+                report.removed += 1;
+                report.freed_bytes += entry.size_bytes;
+            }
+        }
+
+        self.prune_blobs(&mut report)?;
+        Ok(report)
+    }
+
+    /// Trims the cache to its budget: entries unused for longer than
+    /// `max_age` go, then the least recently used ones until the rest fit
+    /// in `max_bytes`. `keep`, the entry just written, is never removed.
+    /// Does nothing if another process is trimming the cache already.
+    pub fn evict(&self, keep: Option<&str>) -> Result<GcReport, SingleloadError> {
+        let mut report = GcReport::default();
+        if !self.budget.is_limited() {
+            return Ok(report);
+        }
+        let dir = self.root.join(LOCKS_DIR);
+        std::fs::create_dir_all(&dir)?;
+        let lock = OpenOptions::new()
+            .create(true)
+            .write(true)
+            .truncate(false)
+            .open(dir.join("evict.lock"))?;
+        match lock.try_lock() {
+            Ok(()) => {}
+            Err(TryLockError::WouldBlock) => return Ok(report),
+            Err(TryLockError::Error(e)) => return Err(e.into()),
+        }
+
+        // Incomplete entries may still be built in place
+        let cutoff = self.budget.max_age.map(|age| Utc::now() - age);
+        let mut used = 0;
+        for entry in self.list()?.into_iter().filter(|e| e.complete) {
+            let kept = keep == Some(entry.key.as_str());
+            let stale = match (cutoff, entry.last_used_at) {
+                (Some(cutoff), Some(last_used)) => last_used < cutoff,
+                (Some(_), None) => true,
+                (None, _) => false,
+            };
+            let over = self.budget.max_bytes.is_some_and(|max| used + entry.size_bytes > max);
+            if !kept && (stale || over) {
+                info!("Evicting cache entry {} ({})", entry.key, entry.source);
+                self.remove(&entry.key)?;
+                report.removed += 1;
+                report.freed_bytes += entry.size_bytes;
+            } else {
+                used += entry.size_bytes;
+            }
+        }
+        Ok(report)
+    }
+
+    /// Runs [`BuildCache::evict`] on a thread of its own so the write that
+    /// triggered it is not held up
+    fn evict_in_background(&self, keep: &str) {
+        if !self.budget.is_limited() {
+            return;
+        }
+        let cache = self.clone();
+        let keep = keep.to_string();
+        std::thread::spawn(move || match cache.evict(Some(&keep)) {
+            Ok(report) if report.removed > 0 => {
+                debug!("Evicted {} cache entries ({} bytes)", report.removed, report.freed_bytes)
+            }
+            Ok(_) => {}
+            Err(e) => warn!("Failed to trim the build cache: {}", e),
+        });
+    }
+
+    pub fn clear(&self) -> Result<GcReport, SingleloadError> {
+        let mut report = GcReport::default();
+        for entry in self.list()? {
+            self.remove(&entry.key)?;
+            report.removed += 1;
+            report.freed_bytes += entry.size_bytes;
+        }
+        let objects = self.root.join(OBJECTS_DIR);
+        if objects.exists() {
+            report.freed_bytes += dir_size(&objects);
+            std::fs::remove_dir_all(objects)?;
+        }
+        self.prune_blobs(&mut report)?;
+        Ok(report)
+    }
+
+    pub fn remove(&self, key: &str) -> Result<(), SingleloadError> {
+        let dir = self.entry_dir(key);
+        if dir.exists() {
+            std::fs::remove_dir_all(dir)?;
+        }
+        Ok(())
+    }
+
+    /// Replaces every artifact file of a published entry with a hard link to
+    /// the blob of the same content and mode, adding blobs for new ones.
+    /// Entries are mounted read-only, so the links are never written to.
+    /// Returns the bytes now shared with other entries.
+    fn share_artifacts(&self, key: &str) -> std::io::Result<u64> {
+        let blobs = self.root.join(BLOBS_DIR);
+        let mut shared = 0;
+        let mut pending = vec![self.artifact_dir(key)];
+        while let Some(dir) = pending.pop() {
+            for dir_entry in std::fs::read_dir(&dir)? {
+                let dir_entry = dir_entry?;
+                let file_type = dir_entry.file_type()?;
+                if file_type.is_dir() {
+                    pending.push(dir_entry.path());
+                } else if file_type.is_file() && dir_entry.file_name() != COMPLETE_MARKER {
+                    shared += share_file(&blobs, &dir_entry.path())?;
+                }
+            }
+        }
+        Ok(shared)
+    }
+
+    /// Blobs in the store with their size and number of links
+    fn blobs(&self) -> impl Iterator<Item = (PathBuf, u64, u64)> {
+        let prefixes = std::fs::read_dir(self.root.join(BLOBS_DIR)).into_iter().flatten().flatten();
+        prefixes
+            .flat_map(|prefix| std::fs::read_dir(prefix.path()).into_iter().flatten().flatten())
+            .filter_map(|blob| {
+                let meta = blob.metadata().ok()?;
+                Some((blob.path(), meta.len(), link_count(&meta)))
+            })
+    }
+
+    /// Removes blobs no entry links to any more
+    fn prune_blobs(&self, report: &mut GcReport) -> Result<(), SingleloadError> {
+        for (path, len, links) in self.blobs() {
+            if links <= 1 {
+                debug!("Removing unused blob {}", path.display());
+                std::fs::remove_file(&path)?;
+                report.freed_bytes += len;
+            }
+        }
+        Ok(())
+    }
+
+    fn read_meta(&self, key: &str) -> Option<CacheMeta> {
+        let content = std::fs::read(self.entry_dir(key).join(META_FILE)).ok()?;
+        serde_json::from_slice(&content).ok()
+    }
+
+    fn write_meta(&self, key: &str, meta: &CacheMeta) -> Result<(), SingleloadError> {
+        write_meta(&self.entry_dir(key).join(META_FILE), meta)
+    }
+}
+
+impl Staging {
+    pub fn key(&self) -> &str {
+        &self.key
+    }
+
+    /// Host directory to mount as the build output
+    pub fn artifact_dir(&self) -> PathBuf {
+        self.dir.join(ARTIFACT_DIR)
+    }
+
+    pub fn is_complete(&self) -> bool {
+        self.artifact_dir().join(COMPLETE_MARKER).exists()
+    }
+
+    /// Moves the staged entry into the cache if the build completed. Returns
+    /// true if the cache holds a complete entry for the key afterwards,
+    /// whether this one or one a concurrent build published first.
+    pub fn publish(self) -> Result<bool, SingleloadError> {
+        if !self.is_complete() {
+            return Ok(false);
+        }
+        let installed = install(&self.cache, &self.key, &self.dir)?;
+        if installed {
+            self.cache.evict_in_background(&self.key);
+        }
+        Ok(installed)
+    }
+
+    /// Like [`Staging::publish`], for an entry a running container still
+    /// has mounted: a copy is moved into place and this one is left alone
+    pub fn publish_copy(&self) -> Result<bool, SingleloadError> {
+        if !self.is_complete() {
+            return Ok(false);
+        }
+        let mut name = self.dir.file_name().unwrap_or_default().to_os_string();
+        name.push(".copy");
+        let copy = self.dir.with_file_name(name);
+        let installed = copy_dir(&self.dir, &copy).and_then(|()| install(&self.cache, &self.key, &copy));
+        if copy.exists() {
+            let _ = std::fs::remove_dir_all(&copy);
+        }
+        if matches!(installed, Ok(true)) {
+            self.cache.evict_in_background(&self.key);
+        }
+        installed
+    }
+}
+
+impl Drop for Staging {
+    fn drop(&mut self) {
+        if self.dir.exists() {
+            if let Err(e) = std::fs::remove_dir_all(&self.dir) {
+                warn!("Failed to remove {}: {}", self.dir.display(), e);
+            }
+        }
+    }
+}
+
+/// Renames a complete staged entry to `<root>/<key>`
+fn install(cache: &BuildCache, key: &str, staged: &Path) -> Result<bool, SingleloadError> {
+    let target = cache.entry_dir(key);
+    let complete = |dir: &Path| dir.join(ARTIFACT_DIR).join(COMPLETE_MARKER).exists();
+    if complete(&target) {
+        debug!("{} was published by another build", key);
+        return Ok(true);
+    }
+    // Left over from a build that crashed before staging existed
+    if target.exists() {
+        std::fs::remove_dir_all(&target)?;
+    }
+    match std::fs::rename(staged, &target) {
+        Ok(()) => {
+            debug!("Published cache entry {}", key);
+            // Blobs are only kept where links can be counted, see link_count.
+            // A copy is as good as a link, only larger.
+            if cache.dedupe && cfg!(unix) {
+                match cache.share_artifacts(key) {
+                    Ok(0) => {}
+                    Ok(shared) => debug!("{} shares {} bytes with other entries", key, shared),
+                    Err(e) => debug!("Failed to deduplicate {}: {}", key, e),
+                }
+            }
+            Ok(true)
+        }
+        // Renaming onto a directory fails if a concurrent build got there first
+        Err(_) if complete(&target) => Ok(true),
+        Err(e) => Err(e.into()),
+    }
+}
+
+/// Links `path` to the blob of its content and mode, moving it into the
+/// store if there is none yet. Returns the bytes shared with another entry.
+fn share_file(blobs: &Path, path: &Path) -> std::io::Result<u64> {
+    let meta = std::fs::metadata(path)?;
+    let mut hasher = Sha256::new();
+    std::io::copy(&mut File::open(path)?, &mut hasher)?;
+    let hash = hex::encode(hasher.finalize());
+    let blob = blobs.join(&hash[..2]).join(format!("{}-{:o}", hash, file_mode(&meta)));
+
+    if !blob.exists() {
+        std::fs::create_dir_all(blob.parent().unwrap_or(blobs))?;
+        // Shared files must not be changed through any of their links
+        let mut permissions = meta.permissions();
+        permissions.set_readonly(true);
+        std::fs::set_permissions(path, permissions)?;
+        return match std::fs::hard_link(path, &blob) {
+            Ok(()) => Ok(0),
+            // Another entry with the same file was published meanwhile
+            Err(e) if e.kind() == std::io::ErrorKind::AlreadyExists => share_file(blobs, path),
+            Err(e) => Err(e),
+        };
+    }
+
+    // Linked under a temporary name first so the file is never missing
+    let mut name = path.file_name().unwrap_or_default().to_os_string();
+    name.push(format!(".{}.link", uuid::Uuid::new_v4().simple()));
+    let link = path.with_file_name(name);
+    std::fs::hard_link(&blob, &link)?;
+    if let Err(e) = std::fs::rename(&link, path) {
+        let _ = std::fs::remove_file(&link);
+        return Err(e);
+    }
+    Ok(meta.len())
+}
+
+#[cfg(unix)]
+fn file_mode(meta: &std::fs::Metadata) -> u32 {
+    use std::os::unix::fs::PermissionsExt;
+    meta.permissions().mode() & 0o777 & !0o222
+}
+
+#[cfg(not(unix))]
+fn file_mode(_meta: &std::fs::Metadata) -> u32 {
+    0o444
+}
+
+#[cfg(unix)]
+fn link_count(meta: &std::fs::Metadata) -> u64 {
+    use std::os::unix::fs::MetadataExt;
+    meta.nlink()
+}
+
+#[cfg(not(unix))]
+fn link_count(_meta: &std::fs::Metadata) -> u64 {
+    2
+}
+
+/// Copies an artifact out of the cache. Shared artifacts are read-only; the
+/// copy is writable by its owner again.
+pub fn copy_artifact(from: &Path, to: &Path) -> Result<(), SingleloadError> {
+    std::fs::copy(from, to)?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        let mode = std::fs::metadata(to)?.permissions().mode();
+        std::fs::set_permissions(to, std::fs::Permissions::from_mode(mode | 0o200))?;
+    }
+    Ok(())
+}
+
+fn hit_rate(hits: u64, misses: u64) -> Option<f64> {
+    let lookups = hits + misses;
+    (lookups > 0).then(|| hits as f64 / lookups as f64)
+}
+
+fn copy_dir(from: &Path, to: &Path) -> Result<(), SingleloadError> {
+    std::fs::create_dir_all(to)?;
+    std::fs::set_permissions(to, std::fs::metadata(from)?.permissions())?;
+    for entry in std::fs::read_dir(from)? {
+        let entry = entry?;
+        let target = to.join(entry.file_name());
+        let file_type = entry.file_type()?;
+        if file_type.is_dir() {
+            copy_dir(&entry.path(), &target)?;
+        } else if file_type.is_symlink() {
+            #[cfg(unix)]
+            std::os::unix::fs::symlink(std::fs::read_link(entry.path())?, &target)?;
+            #[cfg(not(unix))]
+            std::fs::copy(entry.path(), &target)?;
+        } else {
+            std::fs::copy(entry.path(), &target)?;
+        }
+    }
+    Ok(())
+}
+
+/// Writes through a temporary file so a concurrent reader never sees half a file
+fn write_meta(path: &Path, meta: &CacheMeta) -> Result<(), SingleloadError> {
+    let mut name = path.file_name().unwrap_or_default().to_os_string();
+    name.push(format!(".{}.tmp", uuid::Uuid::new_v4().simple()));
+    let tmp = path.with_file_name(name);
+    std::fs::write(&tmp, serde_json::to_vec_pretty(meta)?)?;
+    std::fs::rename(&tmp, path)?;
+    Ok(())
+}
+
+pub(crate) fn dir_size(path: &Path) -> u64 {
+    let mut size = 0;
+    if let Ok(entries) = std::fs::read_dir(path) {
+        for entry in entries.flatten() {
+            match entry.file_type() {
+                Ok(ft) if ft.is_dir() => size += dir_size(&entry.path()),
+                Ok(_) => size += entry.metadata().map(|m| m.len()).unwrap_or(0),
+                Err(_) => {}
+            }
+        }
+    }
+    size
+}
@@ -0,0 +1,215 @@
+use crate::chooser;
+use crate::directives::Directives;
+use crate::errors::SingleloadError;
+use crate::platform;
+use crate::runner::Registry;
+use serde::{Deserialize, Serialize};
+use std::fs::{File, OpenOptions};
+use std::io::{Read, Seek, Write};
+use std::path::{Path, PathBuf};
+use tracing::warn;
+
+/// What a script says about itself in its directive header:
+///
+/// ```text
+/// // singleload: description Back up a Postgres database to S3
+/// // singleload: author Ada Lovelace <ada@example.com>
+/// // singleload: version 1.4.0
+/// // singleload: tags backup postgres s3
+/// ```
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ScriptInfo {
+    /// Canonical path of the script
+    pub path: PathBuf,
+    pub language: Option<String>,
+    /// `description` directives, joined in order
+    pub description: Option<String>,
+    pub authors: Vec<String>,
+    pub version: Option<String>,
+    pub tags: Vec<String>,
+    /// Text of the `deprecated` directive
+    pub deprecated: Option<String>,
+    /// Names of the entrypoints declared with `entry`
+    pub entries: Vec<String>,
+    /// Options declared with `arg`, without their dashes
+    pub options: Vec<String>,
+}
+
+impl ScriptInfo {
+    pub fn read(path: &Path, registry: &Registry) -> Result<Self, SingleloadError> {
+        let content = std::fs::read(path).map_err(|e| match e.kind() {
+            std::io::ErrorKind::NotFound => SingleloadError::ScriptNotFound(path.display().to_string()),
+            _ => e.into(),
+        })?;
+        let directives = Directives::parse(&content);
+        let description: Vec<&str> = directives.all("description").map(|d| d.value.as_str()).collect();
+        let mut tags: Vec<String> = Vec::new();
+        for tag in directives.all("tags").flat_map(|d| d.value.split([' ', '\t', ','])) {
+            let tag = tag.to_lowercase();
+            if !tag.is_empty() && !tags.contains(&tag) {
+                tags.push(tag);
+            }
+        }
+        Ok(Self {
+            path: path.canonicalize()?,
+            language: registry.detect(path, &content).map(|runner| runner.name().to_string()),
+            description: (!description.is_empty()).then(|| description.join(" ")),
+            authors: directives.all("author").map(|d| d.value.clone()).collect(),
+            version: directives.first("version").map(|d| d.value.clone()),
+            tags,
+            deprecated: directives.deprecation().map(|d| d.value.clone()),
+            entries: directives.entries()?.into_iter().map(|entry| entry.name).collect(),
+            options: directives.arg_specs()?.into_iter().map(|spec| spec.name).collect(),
+        })
+    }
+
+    pub fn name(&self) -> String {
+        self.path.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default()
+    }
+
+    /// How well the script matches every one of `terms`, which are
+    /// lowercase; None when one of them is nowhere in its name, tags,
+    /// description, authors or language
+    pub fn score(&self, terms: &[String]) -> Option<u32> {
+        let name = self.name().to_lowercase();
+        let description = self.description.as_deref().unwrap_or_default().to_lowercase();
+        let authors = self.authors.join(" ").to_lowercase();
+        let mut score = 0;
+        for term in terms {
+            score += if name.contains(term.as_str()) {
+                4
+            } else if self.tags.contains(term) {
+                3
+            } else if description.contains(term.as_str()) {
+                2
+            } else if authors.contains(term.as_str()) || self.language.as_deref() == Some(term.as_str()) {
+                1
+            } else {
+                return None;
+            };
+        }
+        Some(score)
+    }
+}
+
+/// Catalog of the scripts found by `singleload index`, searched by
+/// `singleload search`. Every access locks the file, so indexing two
+/// trees at once keeps both.
+#[derive(Debug, Clone)]
+pub struct Catalog {
+    path: PathBuf,
+}
+
+impl Catalog {
+    pub fn new(path: PathBuf) -> Self {
+        Self { path }
+    }
+
+    /// Default location, `~/.singleload/index.json` (`%LOCALAPPDATA%\singleload\index.json` on Windows)
+    pub fn default_path() -> PathBuf {
+        platform::data_dir().join("index.json")
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Indexes the scripts in `dir` and its subdirectories, replacing what
+    /// an earlier index of it found, and returns them. Hidden directories
+    /// are skipped, and scripts whose directives do not parse are left out
+    /// with a warning.
+    pub fn index(&self, dir: &Path, registry: &Registry) -> Result<Vec<ScriptInfo>, SingleloadError> {
+        let dir = dir.canonicalize()?;
+        if !dir.is_dir() {
+            return Err(SingleloadError::InvalidInput(format!("{} is not a directory", dir.display())));
+        }
+        let mut found = Vec::new();
+        scan(&dir, registry, &mut found)?;
+        self.update(|scripts| {
+            scripts.retain(|script| !script.path.starts_with(&dir));
+            scripts.extend(found.iter().cloned());
+        })?;
+        Ok(found)
+    }
+
+    /// Indexed scripts, sorted by path
+    pub fn list(&self) -> Result<Vec<ScriptInfo>, SingleloadError> {
+        match File::open(&self.path) {
+            Ok(mut file) => {
+                file.lock_shared()?;
+                read_scripts(&mut file)
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(Vec::new()),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    /// Indexed scripts that still exist and match every word of `query`,
+    /// best match first
+    pub fn search(&self, query: &str) -> Result<Vec<ScriptInfo>, SingleloadError> {
+        let terms: Vec<String> = query.split_whitespace().map(|term| term.to_lowercase()).collect();
+        let mut matches: Vec<(u32, ScriptInfo)> = self
+            .list()?
+            .into_iter()
+            .filter(|script| script.path.is_file())
+            .filter_map(|script| script.score(&terms).map(|score| (score, script)))
+            .collect();
+        // Sorted by path already, which breaks ties
+        matches.sort_by(|a, b| b.0.cmp(&a.0));
+        Ok(matches.into_iter().map(|(_, script)| script).collect())
+    }
+
+    fn update(&self, change: impl FnOnce(&mut Vec<ScriptInfo>)) -> Result<(), SingleloadError> {
+        if let Some(parent) = self.path.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        let mut file = OpenOptions::new()
+            .read(true)
+            .write(true)
+            .create(true)
+            .truncate(false)
+            .open(&self.path)?;
+        file.lock()?;
+
+        let mut scripts = read_scripts(&mut file)?;
+        change(&mut scripts);
+        scripts.sort_by(|a, b| a.path.cmp(&b.path));
+        let data = serde_json::to_vec_pretty(&scripts)?;
+        file.set_len(0)?;
+        file.rewind()?;
+        file.write_all(&data)?;
+        Ok(())
+    }
+}
+
+fn scan(dir: &Path, registry: &Registry, out: &mut Vec<ScriptInfo>) -> Result<(), SingleloadError> {
+    for path in chooser::candidates(dir, registry)? {
+        match ScriptInfo::read(&path, registry) {
+            Ok(info) => out.push(info),
+            Err(e) => warn!("Not indexing {}: {}", path.display(), e),
+        }
+    }
+    let mut subdirs = Vec::new();
+    for entry in std::fs::read_dir(dir)? {
+        let path = entry?.path();
+        let hidden = path.file_name().map_or(false, |n| n.to_string_lossy().starts_with('.'));
+        // Symlinked directories could lead back up the tree
+        if !hidden && path.is_dir() && !path.is_symlink() {
+            subdirs.push(path);
+        }
+    }
+    subdirs.sort();
+    for subdir in subdirs {
+        scan(&subdir, registry, out)?;
+    }
+    Ok(())
+}
+
+fn read_scripts(file: &mut File) -> Result<Vec<ScriptInfo>, SingleloadError> {
+    let mut data = String::new();
+    file.read_to_string(&mut data)?;
+    if data.trim().is_empty() {
+        return Ok(Vec::new());
+    }
+    serde_json::from_str(&data).map_err(|e| SingleloadError::InvalidInput(format!("Invalid script index: {}", e)))
+}
@@ -0,0 +1,198 @@
+use crate::errors::SingleloadError;
+use crate::state::STATE_DIR_VAR;
+
+/// Marker starting a cell, as used by Jupytext, VS Code and Spyder
+const CELL_MARKER: &str = "# %%";
+
+/// File in the state directory holding the variables cells leave behind
+const CELL_STATE_FILE: &str = "cells.pickle";
+
+/// A `# %%` section of a script
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Cell {
+    /// 1-based, in file order
+    pub index: usize,
+    /// Text after the marker, e.g. `Load data` for `# %% Load data`
+    pub title: String,
+    /// 1-based line of the marker
+    pub start_line: usize,
+    /// Last line of the cell, inclusive
+    pub end_line: usize,
+}
+
+/// Splits a script at its cell markers. Lines before the first marker are
+/// not a cell; they run with every selection.
+pub fn split(content: &str) -> Vec<Cell> {
+    let lines: Vec<&str> = content.lines().collect();
+    let mut cells: Vec<Cell> = Vec::new();
+    for (idx, line) in lines.iter().enumerate() {
+        let Some(title) = line.trim_start().strip_prefix(CELL_MARKER) else {
+            continue;
+        };
+        if let Some(previous) = cells.last_mut() {
+            previous.end_line = idx;
+        }
+        cells.push(Cell {
+            index: cells.len() + 1,
+            title: title.trim().to_string(),
+            start_line: idx + 1,
+            end_line: lines.len(),
+        });
+    }
+    cells
+}
+
+/// Cells chosen with `--cell 3` or `--cells 1-4,6`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct CellSelection {
+    /// Inclusive ranges, in the order given
+    ranges: Vec<(usize, usize)>,
+}
+
+impl CellSelection {
+    pub fn single(index: usize) -> Self {
+        Self { ranges: vec![(index, index)] }
+    }
+
+    /// Parses a list of cell numbers and ranges: `2`, `1-4`, `1-3,5`
+    pub fn parse(value: &str) -> Result<Self, String> {
+        let mut ranges = Vec::new();
+        for part in value.split(',').map(str::trim) {
+            let number = |n: &str| {
+                n.trim()
+                    .parse::<usize>()
+                    .ok()
+                    .filter(|n| *n > 0)
+                    .ok_or_else(|| format!("'{}' is not a cell number", n.trim()))
+            };
+            let range = match part.split_once('-') {
+                Some((first, last)) => (number(first)?, number(last)?),
+                None => {
+                    let n = number(part)?;
+                    (n, n)
+                }
+            };
+            if range.0 > range.1 {
+                return Err(format!("cell range '{}' ends before it starts", part));
+            }
+            ranges.push(range);
+        }
+        Ok(Self { ranges })
+    }
+
+    pub fn contains(&self, index: usize) -> bool {
+        self.ranges.iter().any(|(first, last)| (*first..=*last).contains(&index))
+    }
+
+    /// Highest cell number selected
+    fn last(&self) -> usize {
+        self.ranges.iter().map(|(_, last)| *last).max().unwrap_or(0)
+    }
+}
+
+/// Builds the Python program that runs the selected cells of `content`:
+/// the lines before the first marker, then each selected cell in file
+/// order. Variables are restored from the script's state directory before
+/// and saved after, so a cell can use what earlier runs of other cells
+/// defined, like in a notebook kernel. Tracebacks keep the script's line
+/// numbers.
+pub fn python_program(content: &str, selection: &CellSelection) -> Result<String, SingleloadError> {
+    let cells = split(content);
+    if cells.is_empty() {
+        return Err(SingleloadError::InvalidInput(format!(
+            "the script has no '{}' cell markers",
+            CELL_MARKER
+        )));
+    }
+    if selection.last() > cells.len() {
+        return Err(SingleloadError::InvalidInput(format!(
+            "cell {} does not exist; the script has {} cells",
+            selection.last(),
+            cells.len()
+        )));
+    }
+
+    let lines: Vec<&str> = content.lines().collect();
+    let mut chunks = vec![(1, lines[..cells[0].start_line - 1].join("\n"))];
+    for cell in cells.iter().filter(|cell| selection.contains(cell.index)) {
+        chunks.push((cell.start_line, lines[cell.start_line - 1..cell.end_line].join("\n")));
+    }
+    let chunks = chunks
+        .iter()
+        .filter(|(_, source)| !source.trim().is_empty())
+        .map(|(line, source)| format!("({}, {})", line, serde_json::Value::from(source.as_str())))
+        .collect::<Vec<_>>()
+        .join(", ");
+
+    // A JSON string is a valid Python string literal
+    Ok(format!(
+        r#"import inspect as _sl_inspect, linecache as _sl_linecache, os as _sl_os, pickle as _sl_pickle, sys as _sl_sys, traceback as _sl_traceback, types as _sl_types
+_sl_source = {source}
+# Tracebacks show the script's lines rather than this program's, without its own frame
+_sl_linecache.cache[__file__] = (len(_sl_source), None, _sl_source.splitlines(True), __file__)
+_sl_sys.excepthook = lambda kind, error, tb: _sl_traceback.print_exception(kind, error, tb.tb_next if tb else tb)
+_sl_dir = _sl_os.environ.get({state_var})
+_sl_path = _sl_os.path.join(_sl_dir, {state_file}) if _sl_dir else None
+# Unpickling runs code, so only a file nobody but this user could have written is loaded
+_sl_saved = {{}}
+if _sl_path and _sl_os.path.exists(_sl_path):
+    with open(_sl_path, "rb") as _sl_file:
+        _sl_stat = _sl_os.fstat(_sl_file.fileno())
+        if _sl_stat.st_uid != _sl_os.getuid() or _sl_stat.st_mode & 0o022:
+            print("singleload: not restoring cell state, another user could have written", _sl_path, file=_sl_sys.stderr)
+        else:
+            _sl_saved = _sl_pickle.load(_sl_file)
+    for _sl_name, _sl_module in _sl_saved.pop("__modules__", {{}}).items():
+        try:
+            globals()[_sl_name] = __import__(_sl_module, fromlist=["_"])
+        except ImportError:
+            pass
+    for _sl_name, (_sl_line, _sl_definition) in _sl_saved.pop("__definitions__", {{}}).items():
+        try:
+            exec(compile("\n" * (_sl_line - 1) + _sl_definition, __file__, "exec"), globals())
+        except Exception as _sl_error:
+            print("singleload: not restoring", _sl_name + ":", _sl_error, file=_sl_sys.stderr)
+    for _sl_name, _sl_value in _sl_saved.items():
+        try:
+            globals()[_sl_name] = _sl_pickle.loads(_sl_value)
+        except Exception as _sl_error:
+            print("singleload: not restoring", _sl_name + ":", _sl_error, file=_sl_sys.stderr)
+def _sl_save():
+    saved, modules, definitions = {{}}, {{}}, {{}}
+    for name, value in list(globals().items()):
+        if name.startswith("_"):
+            continue
+        if isinstance(value, _sl_types.ModuleType):
+            modules[name] = value.__name__
+            continue
+        # Functions and classes of the script cannot be pickled; their
+        # source is kept and run again instead
+        if isinstance(value, (_sl_types.FunctionType, type)) and value.__module__ == "__main__":
+            try:
+                lines, line = _sl_inspect.getsourcelines(value)
+                definitions[name] = (max(line, 1), "".join(lines))
+            except (OSError, TypeError):
+                pass
+            continue
+        try:
+            saved[name] = _sl_pickle.dumps(value)
+        except Exception:
+            continue
+    saved["__modules__"] = modules
+    saved["__definitions__"] = definitions
+    with open(_sl_os.open(_sl_path, _sl_os.O_WRONLY | _sl_os.O_CREAT | _sl_os.O_TRUNC, 0o600), "wb") as file:
+        _sl_os.fchmod(file.fileno(), 0o600)
+        _sl_pickle.dump(saved, file)
+try:
+    for _sl_line, _sl_cell in [{chunks}]:
+        exec(compile("\n" * (_sl_line - 1) + _sl_cell, __file__, "exec"), globals())
+finally:
+    if _sl_path:
+        _sl_save()
+"#,
+        source = serde_json::Value::from(content),
+        state_var = serde_json::Value::from(STATE_DIR_VAR),
+        state_file = serde_json::Value::from(CELL_STATE_FILE),
+        chunks = chunks,
+    ))
+}
@@ -0,0 +1,153 @@
+use crate::errors::SingleloadError;
+use crate::runner::Registry;
+use std::io::{BufRead, IsTerminal, Read, Write};
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+/// Bytes read from a file without a known extension to find its shebang
+const SHEBANG_PROBE: u64 = 256;
+
+/// Runnable single files directly inside `dir`: those with the extension
+/// of a registered language, and executables whose shebang names one.
+/// Hidden files and editor backups are left out.
+pub fn candidates(dir: &Path, registry: &Registry) -> Result<Vec<PathBuf>, SingleloadError> {
+    let mut found = Vec::new();
+    for entry in std::fs::read_dir(dir)? {
+        let path = entry?.path();
+        let Some(name) = path.file_name().and_then(|n| n.to_str()) else {
+            continue;
+        };
+        if name.starts_with('.') || name.ends_with('~') || !path.is_file() {
+            continue;
+        }
+        if registry.detect(&path, b"").is_some() {
+            found.push(path);
+            continue;
+        }
+        let mut head = Vec::new();
+        std::fs::File::open(&path)?.take(SHEBANG_PROBE).read_to_end(&mut head)?;
+        if head.starts_with(b"#!") && registry.detect(&path, &head).is_some() {
+            found.push(path);
+        }
+    }
+    found.sort();
+    Ok(found)
+}
+
+/// Orders candidates as `--non-interactive` picks them: `main.<ext>`
+/// first, then a file named after the directory, then the most recently
+/// modified, with ties broken by name
+pub fn order(dir: &Path, candidates: &mut [PathBuf]) {
+    let dir_name = dir
+        .canonicalize()
+        .ok()
+        .and_then(|d| d.file_name().map(|n| n.to_string_lossy().to_lowercase()));
+    let rank = |path: &Path| {
+        let stem = path.file_stem().map(|s| s.to_string_lossy().to_lowercase()).unwrap_or_default();
+        if stem == "main" {
+            0
+        } else if dir_name.as_deref() == Some(stem.as_str()) {
+            1
+        } else {
+            2
+        }
+    };
+    let modified = |path: &Path| {
+        std::fs::metadata(path)
+            .and_then(|m| m.modified())
+            .unwrap_or(SystemTime::UNIX_EPOCH)
+    };
+    candidates.sort_by(|a, b| {
+        rank(a)
+            .cmp(&rank(b))
+            .then_with(|| modified(b).cmp(&modified(a)))
+            .then_with(|| a.cmp(b))
+    });
+}
+
+/// Scores `text` against a fuzzy `query`: every query character has to
+/// appear in order, case-insensitively. Runs of adjacent matches and
+/// matches at the start of a word score higher; None when it does not match.
+pub fn fuzzy_score(query: &str, text: &str) -> Option<i64> {
+    let text: Vec<char> = text.to_lowercase().chars().collect();
+    let mut score = 0;
+    let mut position = 0;
+    let mut previous: Option<usize> = None;
+    for wanted in query.to_lowercase().chars().filter(|c| !c.is_whitespace()) {
+        let found = (position..text.len()).find(|&i| text[i] == wanted)?;
+        score += 1;
+        if previous.is_some_and(|p| p + 1 == found) {
+            score += 5;
+        }
+        if found == 0 || !text[found - 1].is_alphanumeric() {
+            score += 3;
+        }
+        // Matches far into the name count a little less
+        score -= (found - position).min(3) as i64;
+        previous = Some(found);
+        position = found + 1;
+    }
+    Some(score)
+}
+
+/// The candidates matching `query`, best first; candidates that score the
+/// same keep their order
+pub fn filter<'a>(query: &str, candidates: &'a [PathBuf]) -> Vec<&'a PathBuf> {
+    let mut scored: Vec<(i64, &PathBuf)> = candidates
+        .iter()
+        .filter_map(|path| {
+            let name = path.file_name()?.to_string_lossy();
+            fuzzy_score(query, &name).map(|score| (score, path))
+        })
+        .collect();
+    scored.sort_by(|a, b| b.0.cmp(&a.0));
+    scored.into_iter().map(|(_, path)| path).collect()
+}
+
+/// Whether [`choose`] can ask on the terminal
+pub fn is_interactive() -> bool {
+    std::io::stdin().is_terminal() && std::io::stderr().is_terminal()
+}
+
+/// Asks on the terminal which of `candidates` to run. Typing text narrows
+/// the list with a fuzzy match, a number picks that entry and an empty
+/// answer picks the first one listed.
+pub fn choose(dir: &Path, candidates: &[PathBuf]) -> Result<PathBuf, SingleloadError> {
+    if candidates.is_empty() {
+        return Err(SingleloadError::ScriptNotFound(dir.display().to_string()));
+    }
+    let mut stderr = std::io::stderr();
+    let mut shown: Vec<&PathBuf> = candidates.iter().collect();
+    writeln!(stderr, "Several scripts in {}:", dir.display())?;
+    loop {
+        for (idx, path) in shown.iter().enumerate() {
+            let name = path.file_name().map(|n| n.to_string_lossy()).unwrap_or_default();
+            writeln!(stderr, "  {:>2}) {}", idx + 1, name)?;
+        }
+        write!(stderr, "Script to run (number, or text to search): ")?;
+        stderr.flush()?;
+
+        let mut answer = String::new();
+        if std::io::stdin().lock().read_line(&mut answer)? == 0 {
+            return Err(SingleloadError::InvalidInput("no script chosen".to_string()));
+        }
+        let answer = answer.trim();
+        if answer.is_empty() {
+            return Ok(shown[0].clone());
+        }
+        if let Ok(number) = answer.parse::<usize>() {
+            if let Some(path) = number.checked_sub(1).and_then(|idx| shown.get(idx)) {
+                return Ok((*path).clone());
+            }
+        }
+        let matches = filter(answer, candidates);
+        match matches.as_slice() {
+            [only] => return Ok((*only).clone()),
+            [] => {
+                writeln!(stderr, "No script matches '{}'", answer)?;
+                shown = candidates.iter().collect();
+            }
+            _ => shown = matches,
+        }
+    }
+}
@@ -0,0 +1,302 @@
+use crate::plugins;
+use crate::runner::Registry;
+use crate::tools::ToolStore;
+use clap::{Arg, ArgAction, Command, ValueEnum, ValueHint};
+use std::io::Read;
+use std::path::Path;
+
+/// Hidden subcommand the completion scripts call on every Tab press
+pub const COMPLETE_COMMAND: &str = "__complete";
+
+/// Bytes of a file read to tell its language by its shebang
+const DETECT_BYTES: u64 = 512;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum Shell {
+    Bash,
+    Zsh,
+    Fish,
+    Powershell,
+}
+
+/// One suggestion; directories end with a `/` and are not followed by a space
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Candidate {
+    pub value: String,
+    pub help: String,
+}
+
+impl Candidate {
+    fn new(value: impl Into<String>, help: impl Into<String>) -> Self {
+        Self {
+            value: value.into(),
+            help: help.into(),
+        }
+    }
+
+    /// `value<TAB>help`, the line the completion scripts read
+    pub fn line(&self) -> String {
+        match self.help.is_empty() {
+            true => self.value.clone(),
+            false => format!("{}\t{}", self.value, self.help.lines().next().unwrap_or_default()),
+        }
+    }
+}
+
+/// Where suggestions come from besides the command line definition
+pub struct Sources<'a> {
+    pub registry: &'a Registry,
+    pub tools: &'a ToolStore,
+    /// `singleload-<name>` plugins on PATH, offered as subcommands
+    pub plugins: bool,
+}
+
+/// The completion script for `shell`, registered for `singleload`; every
+/// suggestion comes from [`COMPLETE_COMMAND`], so the script stays the same
+/// across upgrades
+pub fn script(shell: Shell) -> String {
+    let script = match shell {
+        Shell::Bash => BASH,
+        Shell::Zsh => ZSH,
+        Shell::Fish => FISH,
+        Shell::Powershell => POWERSHELL,
+    };
+    script.replace("__COMPLETE__", COMPLETE_COMMAND)
+}
+
+/// Suggestions for the last of `words`, the words after `singleload` up
+/// to the cursor; the last one may be empty
+pub fn complete(root: &Command, words: &[String], sources: &Sources) -> Vec<Candidate> {
+    let (current, before) = match words.split_last() {
+        Some((current, before)) => (current.as_str(), before),
+        None => ("", &[][..]),
+    };
+    let globals: Vec<&Arg> = root.get_arguments().filter(|arg| arg.is_global_set()).collect();
+
+    // Follows the subcommands given so far, skipping flags and their values
+    let mut path = vec![root];
+    let mut positionals = 0;
+    let mut pending: Option<&Arg> = None;
+    let mut options_done = false;
+    for word in before {
+        let cmd = *path.last().unwrap_or(&root);
+        if pending.take().is_some() {
+            continue;
+        }
+        if !options_done && word == "--" {
+            options_done = true;
+        } else if !options_done && word.starts_with('-') && word.len() > 1 {
+            pending = find_flag(cmd, &globals, word).filter(|arg| takes_value(arg) && !word.contains('='));
+        } else if let Some(sub) = cmd.find_subcommand(word).filter(|_| positionals == 0) {
+            path.push(sub);
+        } else {
+            positionals += 1;
+        }
+    }
+    let cmd = *path.last().unwrap_or(&root);
+
+    let mut candidates = if let Some(arg) = pending {
+        values(cmd, arg, current, sources)
+    } else if let Some((flag, value)) = current.split_once('=').filter(|_| current.starts_with("--")) {
+        match find_flag(cmd, &globals, flag) {
+            Some(arg) => values(cmd, arg, value, sources)
+                .into_iter()
+                .map(|c| Candidate::new(format!("{}={}", flag, c.value), c.help))
+                .collect(),
+            None => vec![],
+        }
+    } else if current.starts_with('-') && !options_done {
+        flags(cmd, &globals)
+    } else {
+        let mut candidates = vec![];
+        if positionals == 0 && cmd.has_subcommands() {
+            candidates.extend(subcommands(cmd, sources.plugins && path.len() == 1));
+        }
+        let arg = cmd
+            .get_positionals()
+            .filter(|arg| !arg.is_hide_set())
+            .nth(positionals)
+            .or_else(|| cmd.get_positionals().last().filter(|arg| matches!(arg.get_action(), ArgAction::Append)));
+        match arg {
+            Some(arg) => candidates.extend(values(cmd, arg, current, sources)),
+            // `singleload tool.py` runs the script
+            None if path.len() == 1 && positionals == 0 => candidates.extend(runnable_files(current, sources.registry)),
+            None => {}
+        }
+        candidates
+    };
+    candidates.retain(|c| c.value.starts_with(current));
+    candidates.dedup_by(|a, b| a.value == b.value);
+    candidates
+}
+
+fn find_flag<'a>(cmd: &'a Command, globals: &[&'a Arg], word: &str) -> Option<&'a Arg> {
+    let word = word.split('=').next().unwrap_or(word);
+    let matches = |arg: &&Arg| match word.strip_prefix("--") {
+        Some(long) => arg.get_long_and_visible_aliases().is_some_and(|names| names.contains(&long)),
+        None => word.chars().nth(1).is_some_and(|c| arg.get_short() == Some(c)),
+    };
+    cmd.get_arguments().find(matches).or_else(|| globals.iter().copied().find(matches))
+}
+
+fn takes_value(arg: &Arg) -> bool {
+    arg.get_action().takes_values() && arg.get_num_args().map_or(true, |n| n.max_values() > 0)
+}
+
+fn subcommands(cmd: &Command, plugins: bool) -> Vec<Candidate> {
+    let mut candidates: Vec<Candidate> = cmd
+        .get_subcommands()
+        .filter(|sub| !sub.is_hide_set())
+        .map(|sub| Candidate::new(sub.get_name(), sub.get_about().map(|a| a.to_string()).unwrap_or_default()))
+        .collect();
+    if plugins {
+        for plugin in plugins::discover().into_iter().filter(|p| !p.is_language()) {
+            candidates.push(Candidate::new(plugin.name, "plugin"));
+        }
+    }
+    candidates
+}
+
+fn flags(cmd: &Command, globals: &[&Arg]) -> Vec<Candidate> {
+    let own = cmd.get_arguments().filter(|arg| !arg.is_global_set());
+    let mut candidates = vec![];
+    for arg in own.chain(globals.iter().copied()).filter(|arg| !arg.is_hide_set()) {
+        let help = arg.get_help().map(|h| h.to_string()).unwrap_or_default();
+        for long in arg.get_long_and_visible_aliases().unwrap_or_default() {
+            candidates.push(Candidate::new(format!("--{}", long), help.clone()));
+        }
+    }
+    candidates.push(Candidate::new("--help", "Print help"));
+    candidates
+}
+
+/// Values for `arg`: its possible values, languages, runnable scripts,
+/// installed commands or files, by what the argument holds
+fn values(cmd: &Command, arg: &Arg, current: &str, sources: &Sources) -> Vec<Candidate> {
+    let possible = arg.get_possible_values();
+    if !possible.is_empty() {
+        return possible
+            .iter()
+            .filter(|value| !value.is_hide_set())
+            .map(|value| Candidate::new(value.get_name(), value.get_help().map(|h| h.to_string()).unwrap_or_default()))
+            .collect();
+    }
+    match (cmd.get_name(), arg.get_id().as_str()) {
+        (_, "lang" | "language") => sources.registry.names().into_iter().map(|name| Candidate::new(name, "")).collect(),
+        (_, "script" | "scripts") => runnable_files(current, sources.registry),
+        ("uninstall", "name") => installed_commands(sources.tools),
+        _ => match arg.get_value_hint() {
+            ValueHint::AnyPath | ValueHint::FilePath | ValueHint::ExecutablePath => files(current, |_| Some(String::new())),
+            ValueHint::DirPath => files(current, |_| None),
+            _ => vec![],
+        },
+    }
+}
+
+/// Files in the directory `current` points into that are scripts in a
+/// supported language, by extension or shebang, and the directories there
+pub fn runnable_files(current: &str, registry: &Registry) -> Vec<Candidate> {
+    files(current, |path| {
+        let mut head = Vec::new();
+        let file = std::fs::File::open(path).ok()?;
+        file.take(DETECT_BYTES).read_to_end(&mut head).ok()?;
+        registry.detect(path, &head).map(|runner| runner.name().to_string())
+    })
+}
+
+/// Entries of the directory `current` points into whose names start with
+/// the rest of it; `describe` keeps a file, with its description, or drops it
+fn files(current: &str, describe: impl Fn(&Path) -> Option<String>) -> Vec<Candidate> {
+    let (dir, prefix) = match current.rfind('/') {
+        Some(slash) => current.split_at(slash + 1),
+        None => ("", current),
+    };
+    let Ok(entries) = std::fs::read_dir(if dir.is_empty() { "." } else { dir }) else {
+        return vec![];
+    };
+    let mut candidates = vec![];
+    for entry in entries.flatten() {
+        let name = entry.file_name().to_string_lossy().to_string();
+        if !name.starts_with(prefix) || (name.starts_with('.') && !prefix.starts_with('.')) {
+            continue;
+        }
+        let path = entry.path();
+        if path.is_dir() {
+            candidates.push(Candidate::new(format!("{}{}/", dir, name), ""));
+        } else if let Some(help) = describe(&path) {
+            candidates.push(Candidate::new(format!("{}{}", dir, name), help));
+        }
+    }
+    candidates.sort_by(|a, b| a.value.cmp(&b.value));
+    candidates
+}
+
+fn installed_commands(tools: &ToolStore) -> Vec<Candidate> {
+    let installed = tools.list().unwrap_or_default();
+    installed
+        .into_iter()
+        .map(|tool| Candidate::new(tool.name, tool.script.display().to_string()))
+        .collect()
+}
+
+const BASH: &str = r#"# singleload completion for bash; add to ~/.bashrc:
+#   source <(singleload completion bash)
+_singleload() {
+    local line value
+    COMPREPLY=()
+    while IFS= read -r line; do
+        value="${line%%$'\t'*}"
+        COMPREPLY+=("$value")
+    done < <(singleload __COMPLETE__ -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)
+    if [[ ${#COMPREPLY[@]} -eq 1 && "${COMPREPLY[0]}" == */ ]]; then
+        compopt -o nospace
+    fi
+}
+complete -o default -F _singleload singleload
+"#;
+
+const ZSH: &str = r#"#compdef singleload
+# singleload completion for zsh; add to ~/.zshrc:
+#   source <(singleload completion zsh)
+_singleload() {
+    local line value help
+    local -a described dirs
+    for line in "${(@f)$(singleload __COMPLETE__ -- "${(@)words[2,CURRENT]}" 2>/dev/null)}"; do
+        [[ -z "$line" ]] && continue
+        value="${line%%$'\t'*}"
+        help="${line#*$'\t'}"
+        if [[ "$value" == */ ]]; then
+            dirs+=("$value")
+        elif [[ "$line" == *$'\t'* ]]; then
+            described+=("${value//:/\\:}:$help")
+        else
+            described+=("${value//:/\\:}")
+        fi
+    done
+    (( ${#dirs} )) && compadd -S '' -- "${dirs[@]}"
+    (( ${#described} )) && _describe 'singleload' described
+}
+if (( $+functions[compdef] )); then
+    compdef _singleload singleload
+fi
+"#;
+
+const FISH: &str = r#"# singleload completion for fish; save as
+# ~/.config/fish/completions/singleload.fish:
+#   singleload completion fish > ~/.config/fish/completions/singleload.fish
+complete -c singleload -f -a '(singleload __COMPLETE__ -- (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)'
+"#;
+
+const POWERSHELL: &str = r#"# singleload completion for PowerShell; add to $PROFILE:
+#   singleload completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName singleload -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | Select-Object -Skip 1 | ForEach-Object { $_.ToString() })
+    if ($wordToComplete -eq '') { $words += '' }
+    singleload __COMPLETE__ -- @words 2>$null | ForEach-Object {
+        $value, $help = $_ -split "`t", 2
+        if (-not $help) { $help = $value }
+        [System.Management.Automation.CompletionResult]::new($value, $value, 'ParameterValue', $help)
+    }
+}
+"#;
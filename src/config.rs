@@ -1,37 +1,441 @@
+use crate::audit::OSV_URL;
+use crate::cache::{BuildCache, CacheBudget};
+use crate::catalog::Catalog;
+use crate::download;
+use crate::export::ImportStore;
+use crate::flake::{self, NixStore};
+use crate::gpu::DEFAULT_GPU_DEVICES;
+use crate::history::HistoryStore;
+use crate::hooks::HooksConfig;
+use crate::images;
+use crate::limits;
+use crate::platform;
+use crate::policy::Policy;
+use crate::preprocess::{PreprocessorSpec, Preprocessors};
+use crate::profile::BuildProfile;
+use crate::sandbox::SandboxProfile;
+use crate::scaffold::Templates;
+use crate::service::ServiceStore;
+use crate::signing;
+use crate::snapshot::SnapshotStore;
+use crate::state::StateStore;
+use crate::tofu::KnownScripts;
+use crate::toolchain::ToolchainStore;
+use crate::tools::ToolStore;
+use crate::types::Language;
 use anyhow::Result;
 use serde::{Deserialize, Serialize};
-use std::path::PathBuf;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
 
+/// Per-user configuration file, under `~/.config/singleload`
+pub const USER_CONFIG_FILE: &str = "config.toml";
+
+/// Per-project configuration file, looked up from the current directory upwards
+pub const PROJECT_CONFIG_FILE: &str = ".singleload.toml";
+
+/// Keys a project file may set: toolchain pins, language binaries and limits
+/// it can only lower. Anything else could loosen the sandbox or send caches,
+/// proxies and hooks elsewhere for whoever runs a cloned repository.
+const PROJECT_KEYS: &[&str] = &[
+    "project_pins",
+    "interpreter_images",
+    "languages",
+    "allowed_languages",
+    "default_timeout_secs",
+    "default_memory_mb",
+    "default_cpu_limit",
+    "default_output_limit_kb",
+    "max_concurrent_containers",
+    "language_concurrency",
+];
+
+/// Keys holding paths; relative values are taken relative to the file setting them
+const PATH_KEYS: &[&str] = &[
+    "workspace_dir",
+    "cache_dir",
+    "toolchains_dir",
+    "state_dir",
+    "bin_dir",
+    "templates_dir",
+    "services_dir",
+    "imports_dir",
+    "snapshots_dir",
+    "nix_dir",
+    "history_file",
+    "known_scripts_file",
+    "index_file",
+    "daemon_socket",
+    "seccomp_profile",
+    "cuda_dir",
+];
+
+/// Settings loaded from the built-in defaults, then `~/.config/singleload/config.toml`,
+/// then the nearest `.singleload.toml`, then `SINGLELOAD_*` environment variables
 #[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
 pub struct Config {
     pub base_image_name: String,
     pub podman_socket: String,
     pub container_prefix: String,
     pub workspace_dir: PathBuf,
+    pub cache_dir: PathBuf,
+    /// Size and age limits of the build cache
+    pub cache: CacheConfig,
+    pub toolchains_dir: PathBuf,
+    pub state_dir: PathBuf,
+    /// Where `install --as` puts tools
+    pub bin_dir: PathBuf,
+    /// User templates for `new`, as `<language>/<template>.<ext>`
+    pub templates_dir: PathBuf,
+    /// Binaries and logs of `service add` services
+    pub services_dir: PathBuf,
+    /// Programs unpacked by `import`
+    pub imports_dir: PathBuf,
+    /// Installed environments of locked Python and JavaScript scripts
+    pub snapshots_dir: PathBuf,
+    /// Log of past runs read by `history` and `rerun`
+    pub history_file: PathBuf,
+    /// Record every `run` in `history_file`
+    pub record_history: bool,
+    /// Checksums of the remote and shared scripts run before
+    pub known_scripts_file: PathBuf,
+    /// Refuse to run a known script whose content changed instead of asking
+    pub strict_tofu: bool,
+    /// Catalog of scripts built by `index` and read by `search`
+    pub index_file: PathBuf,
+    /// Refuse to run scripts marked `deprecated` instead of warning
+    pub deny_deprecated: bool,
+    /// Commands run in the container before and after every script
+    pub hooks: HooksConfig,
+    pub daemon_socket: PathBuf,
     pub max_concurrent_containers: usize,
+    /// Lower limits of concurrent daemon requests per language, e.g. `rust = 1`
+    pub language_concurrency: HashMap<String, usize>,
     pub default_timeout_secs: u64,
     pub default_memory_mb: u64,
     pub default_cpu_limit: f32,
     pub default_output_limit_kb: u64,
+    /// Sandbox profile `run` uses without `--sandbox`
+    pub default_sandbox: String,
+    /// Languages scripts may be written in; empty allows every registered one
+    pub allowed_languages: Vec<String>,
+    pub proxy: ProxyConfig,
+    /// Retries, mirrors and parallel ranges of downloads
+    pub download: DownloadConfig,
+    /// Where `self-update` looks for releases and the key they are signed with
+    pub update: UpdateConfig,
+    /// Shared artifact cache consulted when the local build cache misses
+    pub remote_cache: Option<RemoteCacheConfig>,
     pub allowed_script_extensions: Vec<String>,
     pub seccomp_profile: Option<PathBuf>,
+    /// User-defined sandbox profiles, looked up before the built-in ones
+    pub sandbox_profiles: HashMap<String, SandboxProfile>,
+    /// User-defined build profiles, looked up before the built-in ones
+    pub build_profiles: HashMap<String, BuildProfile>,
+    /// Source transformations per language, run in order before a build
+    pub preprocessors: HashMap<String, Vec<PreprocessorSpec>>,
+    /// Interpreters and compilers the built-in languages use instead of
+    /// their default binaries, e.g. `[languages.python] interpreter = "python3.12"`
+    pub languages: HashMap<String, LanguageConfig>,
+    /// OSV API that `audit` and `run --audit` look dependencies up in
+    pub osv_url: String,
+    /// Load language backends from `singleload-lang-*` plugins on PATH
+    pub plugins: bool,
+    /// Use the toolchain versions pinned in go.mod, .python-version and
+    /// rust-toolchain.toml for scripts that do not pin one themselves
+    pub project_pins: bool,
+    /// Key builds on the sources byte for byte, so that editing a comment
+    /// or a run-time directive rebuilds too
+    pub strict_hash: bool,
+    /// Save a postmortem bundle in the state entry of a script that crashes
+    pub postmortems: bool,
+    /// Host CUDA toolkit mounted for CUDA scripts; found from `CUDA_HOME`,
+    /// `CUDA_PATH` or /usr/local/cuda when unset
+    pub cuda_dir: Option<PathBuf>,
+    /// Devices CUDA and OpenCL programs run with, as paths or CDI names
+    pub gpu_devices: Vec<String>,
+    /// Images `run --containerized` uses instead of the built-in ones, by
+    /// language, e.g. a mirror or an image pinned by digest
+    pub interpreter_images: HashMap<String, String>,
+    /// Nix store and resolved environments of `run --nix`
+    pub nix_dir: PathBuf,
+    /// Flake reference of the nixpkgs `run --nix` environments come from
+    pub nixpkgs: String,
+    /// Organization policy from the system configuration directory, which
+    /// no user configuration file can set or loosen
+    #[serde(skip)]
+    pub policy: Policy,
+}
+
+/// Outbound proxy for everything that reaches the network: dependency and
+/// toolchain installs, sandboxes with network access and remote scripts
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct ProxyConfig {
+    pub http: Option<String>,
+    pub https: Option<String>,
+    /// Comma-separated hosts that bypass the proxy
+    pub no_proxy: Option<String>,
+}
+
+/// How Singleload downloads remote scripts, policies and toolchain
+/// releases, and which package indexes the package managers in containers
+/// fetch dependencies from
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct DownloadConfig {
+    /// Attempts after a failed one; the first waits `backoff`, each later
+    /// one twice as long as the one before
+    pub retries: u32,
+    pub backoff: String,
+    /// Parallel range requests large files are fetched with
+    pub chunks: usize,
+    /// Files larger than this are fetched in `chunks` ranges, e.g. `16MB`
+    pub parallel_above: String,
+    /// URL prefixes served by mirrors, tried in order before the original
+    pub mirrors: Vec<Mirror>,
+    /// Package indexes by ecosystem: pypi, npm, go, maven or rustup
+    pub registries: HashMap<String, String>,
+}
+
+impl Default for DownloadConfig {
+    fn default() -> Self {
+        Self {
+            retries: 3,
+            backoff: "1s".to_string(),
+            chunks: 4,
+            parallel_above: "16MB".to_string(),
+            mirrors: Vec::new(),
+            registries: HashMap::new(),
+        }
+    }
+}
+
+/// Serves everything under `prefix` from `url` instead, e.g.
+/// `prefix = "https://github.com/"`, `url = "https://mirror.example.com/github/"`
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct Mirror {
+    pub prefix: String,
+    pub url: String,
+}
+
+impl DownloadConfig {
+    fn validate(&self) -> Result<()> {
+        limits::parse_duration(&self.backoff).map_err(|e| anyhow::anyhow!("download.backoff: {}", e))?;
+        limits::parse_memory(&self.parallel_above).map_err(|e| anyhow::anyhow!("download.parallel_above: {}", e))?;
+        if self.chunks == 0 {
+            anyhow::bail!("download.chunks must be greater than 0");
+        }
+        for mirror in &self.mirrors {
+            if !mirror.prefix.starts_with("https://") {
+                anyhow::bail!("download.mirrors: prefix '{}' is not an https URL", mirror.prefix);
+            }
+            if !mirror.url.starts_with("https://") {
+                anyhow::bail!("download.mirrors: url '{}' is not an https URL", mirror.url);
+            }
+        }
+        for name in self.registries.keys() {
+            if !download::REGISTRIES.iter().any(|(registry, _)| registry == name) {
+                let names: Vec<&str> = download::REGISTRIES.iter().map(|(registry, _)| *registry).collect();
+                anyhow::bail!("download.registries.{}: expected one of {}", name, names.join(", "));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Release endpoint of `singleload self-update`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct UpdateConfig {
+    /// Base of the release downloads; the stable manifest is at
+    /// `<url>/latest/download/release.json`, the nightly one at
+    /// `<url>/download/nightly/release.json`
+    pub url: String,
+    /// PEM ed25519 public key release binaries are signed with, for builds
+    /// without one compiled in
+    pub public_key: Option<String>,
+}
+
+impl Default for UpdateConfig {
+    fn default() -> Self {
+        Self {
+            url: "https://github.com/Singleload/Singleload/releases".to_string(),
+            public_key: None,
+        }
+    }
+}
+
+impl UpdateConfig {
+    fn validate(&self) -> Result<()> {
+        if !self.url.starts_with("https://") {
+            anyhow::bail!("update.url '{}' is not an https URL", self.url);
+        }
+        if let Some(key) = &self.public_key {
+            signing::parse_verifying_key(key).map_err(|e| anyhow::anyhow!("update.public_key: {}", e))?;
+        }
+        Ok(())
+    }
+}
+
+/// Limits the build cache in `cache_dir` is trimmed to whenever an entry is
+/// written, least recently used entries first
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct CacheConfig {
+    /// Total size, e.g. `5GB`
+    pub max_size: Option<String>,
+    /// Entries unused for longer are removed, e.g. `30d`
+    pub max_age: Option<String>,
+    /// Entries with identical files share one copy on disk
+    pub dedupe: bool,
+}
+
+impl Default for CacheConfig {
+    fn default() -> Self {
+        Self {
+            max_size: None,
+            max_age: None,
+            dedupe: true,
+        }
+    }
+}
+
+impl CacheConfig {
+    pub fn budget(&self) -> Result<CacheBudget> {
+        let max_bytes = match &self.max_size {
+            Some(size) => Some(
+                limits::parse_memory(size).map_err(|e| anyhow::anyhow!("cache.max_size: {}", e))? * 1024 * 1024,
+            ),
+            None => None,
+        };
+        let max_age = match &self.max_age {
+            Some(age) => {
+                let secs = limits::parse_age(age).map_err(|e| anyhow::anyhow!("cache.max_age: {}", e))?;
+                let parsed = i64::try_from(secs).ok().and_then(chrono::Duration::try_seconds);
+                Some(parsed.ok_or_else(|| anyhow::anyhow!("cache.max_age: '{}' is too long", age))?)
+            }
+            None => None,
+        };
+        Ok(CacheBudget { max_bytes, max_age })
+    }
+}
+
+/// Binaries a built-in language runs scripts and builds programs with,
+/// names looked up on the container's PATH or absolute paths in it
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct LanguageConfig {
+    /// Runs scripts, e.g. `python3.12`; for .NET, runs the built assembly
+    pub interpreter: Option<String>,
+    /// Builds programs, e.g. `/opt/go/bin/go` or `clang-18`
+    pub compiler: Option<String>,
+}
+
+/// Languages whose scripts run in an interpreter
+const INTERPRETED_LANGUAGES: &[Language] = &[Language::Python, Language::Javascript, Language::Php, Language::Bash];
+
+/// Languages compiled for a virtual machine or runtime, which take both
+/// binaries
+const VM_LANGUAGES: &[Language] = &[Language::DotNet, Language::Java, Language::Kotlin, Language::TypeScript];
+
+impl LanguageConfig {
+    fn validate(&self, language: &str) -> Result<()> {
+        let Some(builtin) = Language::all().iter().find(|l| l.name() == language) else {
+            anyhow::bail!("languages.{}: only built-in languages can be configured", language);
+        };
+        for (key, value) in [("interpreter", &self.interpreter), ("compiler", &self.compiler)] {
+            let Some(value) = value else { continue };
+            if value.is_empty() || value.contains(char::is_whitespace) {
+                anyhow::bail!("languages.{}.{} '{}' is not a binary name or path", language, key, value);
+            }
+        }
+        if VM_LANGUAGES.contains(builtin) {
+            return Ok(());
+        }
+        let interpreted = INTERPRETED_LANGUAGES.contains(builtin);
+        if self.interpreter.is_some() && !interpreted {
+            anyhow::bail!("languages.{}.interpreter: {} programs are compiled, set compiler", language, language);
+        }
+        if self.compiler.is_some() && interpreted {
+            anyhow::bail!("languages.{}.compiler: {} scripts are interpreted, set interpreter", language, language);
+        }
+        Ok(())
+    }
+}
+
+/// Where `remote_cache` lives. Anything fetched from it is run as if built
+/// locally, so artifacts are only taken when signed with the builders' key.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct RemoteCacheConfig {
+    /// `https://host/path`, `s3://bucket/prefix` or a shared directory
+    pub url: String,
+    /// Fetch artifacts but never upload them
+    pub read_only: bool,
+    /// S3 region, defaulting to `AWS_REGION` and then `us-east-1`
+    pub region: Option<String>,
+    /// S3-compatible endpoint such as `https://minio:9000`
+    pub endpoint: Option<String>,
+    /// ed25519 public key fetched artifacts must be signed with, inline PEM
+    pub public_key: Option<String>,
+    /// ed25519 private key file builders sign uploads with; without one
+    /// nothing is uploaded
+    pub signing_key: Option<PathBuf>,
+}
+
+impl ProxyConfig {
+    /// Environment variables for containers, in both spellings tools look for
+    pub fn env(&self) -> Vec<(String, String)> {
+        let mut env = Vec::new();
+        for (name, value) in [("HTTP_PROXY", &self.http), ("HTTPS_PROXY", &self.https), ("NO_PROXY", &self.no_proxy)] {
+            if let Some(value) = value {
+                env.push((name.to_string(), value.clone()));
+                env.push((name.to_lowercase(), value.clone()));
+            }
+        }
+        env
+    }
 }
 
 impl Default for Config {
     fn default() -> Self {
         Self {
             base_image_name: "localhost/singleload-runner:latest".to_string(),
-            podman_socket: format!(
-                "unix:///run/user/{}/podman/podman.sock",
-                std::env::var("UID").unwrap_or_else(|_| "1000".to_string())
-            ),
+            podman_socket: platform::default_podman_socket(),
             container_prefix: "singleload".to_string(),
-            workspace_dir: PathBuf::from("/tmp/singleload"),
+            workspace_dir: platform::temp_dir(),
+            cache_dir: BuildCache::default_root(),
+            cache: CacheConfig::default(),
+            toolchains_dir: ToolchainStore::default_root(),
+            state_dir: StateStore::default_root(),
+            bin_dir: ToolStore::default_root(),
+            templates_dir: Templates::default_root(),
+            services_dir: ServiceStore::default_root(),
+            imports_dir: ImportStore::default_root(),
+            snapshots_dir: SnapshotStore::default_root(),
+            history_file: HistoryStore::default_path(),
+            record_history: true,
+            known_scripts_file: KnownScripts::default_path(),
+            strict_tofu: false,
+            index_file: Catalog::default_path(),
+            deny_deprecated: false,
+            hooks: HooksConfig::default(),
+            daemon_socket: platform::default_daemon_socket(),
             max_concurrent_containers: 10,
+            language_concurrency: HashMap::new(),
             default_timeout_secs: 30,
             default_memory_mb: 512,
             default_cpu_limit: 1.0,
             default_output_limit_kb: 1024,
+            default_sandbox: "default".to_string(),
+            allowed_languages: Vec::new(),
+            proxy: ProxyConfig::default(),
+            download: DownloadConfig::default(),
+            update: UpdateConfig::default(),
+            remote_cache: None,
             allowed_script_extensions: vec![
                 ".py".to_string(),
                 ".js".to_string(),
@@ -40,17 +444,40 @@ impl Default for Config {
                 ".rs".to_string(),
                 ".sh".to_string(),
                 ".cs".to_string(),
+                ".c".to_string(),
+                ".cpp".to_string(),
+                ".cc".to_string(),
+                ".cxx".to_string(),
+                ".cu".to_string(),
+                ".java".to_string(),
+                ".kt".to_string(),
+                ".ts".to_string(),
             ],
             seccomp_profile: None,
+            sandbox_profiles: HashMap::new(),
+            build_profiles: HashMap::new(),
+            preprocessors: HashMap::new(),
+            languages: HashMap::new(),
+            osv_url: OSV_URL.to_string(),
+            plugins: true,
+            project_pins: true,
+            strict_hash: false,
+            postmortems: true,
+            cuda_dir: None,
+            gpu_devices: DEFAULT_GPU_DEVICES.iter().map(|d| d.to_string()).collect(),
+            interpreter_images: HashMap::new(),
+            nix_dir: NixStore::default_root(),
+            nixpkgs: flake::DEFAULT_NIXPKGS.to_string(),
+            policy: Policy::default(),
         }
     }
 }
 
 impl Config {
     pub fn load() -> Result<Self> {
-        // Try to load from environment variables or config file
-        // For now, just use defaults
-        let mut config = Self::default();
+        let mut files = vec![Self::user_path()];
+        files.extend(Self::project_path(&std::env::current_dir()?));
+        let mut config = Self::from_files(&files)?;
 
         // Override with environment variables if present
         if let Ok(socket) = std::env::var("SINGLELOAD_PODMAN_SOCKET") {
@@ -61,17 +488,200 @@ impl Config {
             config.base_image_name = image;
         }
 
+        if let Ok(dir) = std::env::var("SINGLELOAD_CACHE_DIR") {
+            config.cache_dir = PathBuf::from(dir);
+        }
+
+        if let Ok(dir) = std::env::var("SINGLELOAD_TOOLCHAINS_DIR") {
+            config.toolchains_dir = PathBuf::from(dir);
+        }
+
+        if let Ok(dir) = std::env::var("SINGLELOAD_STATE_ROOT") {
+            config.state_dir = PathBuf::from(dir);
+        }
+
+        if let Ok(url) = std::env::var("SINGLELOAD_REMOTE_CACHE") {
+            let remote = config.remote_cache.get_or_insert_with(RemoteCacheConfig::default);
+            remote.url = url;
+        }
+
+        // SINGLELOAD_PYTHON_INTERPRETER, SINGLELOAD_GO_COMPILER and so on
+        for language in Language::all() {
+            let prefix = format!("SINGLELOAD_{}", language.name().to_uppercase());
+            if let Ok(interpreter) = std::env::var(format!("{}_INTERPRETER", prefix)) {
+                config.languages.entry(language.name().to_string()).or_default().interpreter = Some(interpreter);
+            }
+            if let Ok(compiler) = std::env::var(format!("{}_COMPILER", prefix)) {
+                config.languages.entry(language.name().to_string()).or_default().compiler = Some(compiler);
+            }
+        }
+
+        if let Ok(socket) = std::env::var("SINGLELOAD_DAEMON_SOCKET") {
+            config.daemon_socket = PathBuf::from(socket);
+        } else if let Ok(runtime_dir) = std::env::var("XDG_RUNTIME_DIR") {
+            config.daemon_socket = PathBuf::from(runtime_dir).join("singleload").join("daemon.sock");
+        }
+
+        config.validate()?;
+
         // Ensure workspace directory exists
         std::fs::create_dir_all(&config.workspace_dir)?;
 
         Ok(config)
     }
 
+    /// `$XDG_CONFIG_HOME/singleload/config.toml`, defaulting to `~/.config`
+    /// (`%APPDATA%\singleload` on Windows)
+    pub fn user_path() -> PathBuf {
+        platform::config_dir().join(USER_CONFIG_FILE)
+    }
+
+    /// The nearest `.singleload.toml` in `dir` or one of its parents
+    pub fn project_path(dir: &Path) -> Option<PathBuf> {
+        dir.ancestors()
+            .map(|d| d.join(PROJECT_CONFIG_FILE))
+            .find(|p| p.is_file())
+    }
+
+    /// Defaults overridden by each existing file in turn; later files win,
+    /// key by key. A project file may only set [`PROJECT_KEYS`], and its
+    /// limits may not be above those of the files before it.
+    pub fn from_files(paths: &[PathBuf]) -> Result<Self> {
+        let layers: Vec<_> = paths.iter().map(|path| (path.clone(), is_project_file(path))).collect();
+        Self::from_layers(&layers)
+    }
+
+    /// Like [`Config::from_files`], with each file marked as a project file or not
+    fn from_layers(layers: &[(PathBuf, bool)]) -> Result<Self> {
+        let mut merged = toml::Table::new();
+        for (path, project) in layers.iter().filter(|(p, _)| p.is_file()) {
+            let table = read_table(path)?;
+            if *project {
+                let below = Self::from_table(merged.clone())?;
+                let mut overlaid = merged.clone();
+                merge(&mut overlaid, table.clone());
+                check_project(path, &table, &below, &Self::from_table(overlaid)?)?;
+            }
+            merge(&mut merged, table);
+        }
+        Self::from_table(merged)
+    }
+
+    fn from_table(table: toml::Table) -> Result<Self> {
+        toml::Value::Table(table)
+            .try_into()
+            .map_err(|e| anyhow::anyhow!("Invalid configuration: {}", e))
+    }
+
+    /// Effective value of a dotted key such as `proxy.https`
+    pub fn get(&self, key: &str) -> Result<toml::Value> {
+        let value = toml::Value::try_from(self)?;
+        key.split('.')
+            .try_fold(&value, |value, part| value.get(part))
+            .cloned()
+            .ok_or_else(|| anyhow::anyhow!("Config key '{}' is not set", key))
+    }
+
+    /// Sets a dotted key in the config file at `path`, creating it if needed.
+    /// `value` is parsed as TOML (`60`, `true`, `["go"]`) and taken as a
+    /// string otherwise. The result must still load together with `layers`,
+    /// the files `path` is merged with.
+    pub fn set(path: &Path, key: &str, value: &str, layers: &[PathBuf]) -> Result<()> {
+        let mut table = if path.is_file() {
+            let content = std::fs::read_to_string(path)?;
+            content.parse::<toml::Table>()
+                .map_err(|e| anyhow::anyhow!("{}: {}", path.display(), e))?
+        } else {
+            toml::Table::new()
+        };
+
+        let value = format!("value = {}", value)
+            .parse::<toml::Table>()
+            .ok()
+            .and_then(|mut t| t.remove("value"))
+            .unwrap_or_else(|| toml::Value::String(value.to_string()));
+
+        let (parents, name) = match key.rsplit_once('.') {
+            Some((parents, name)) => (parents.split('.').collect::<Vec<_>>(), name),
+            None => (Vec::new(), key),
+        };
+        let mut target = &mut table;
+        for part in parents {
+            target = target
+                .entry(part)
+                .or_insert_with(|| toml::Value::Table(toml::Table::new()))
+                .as_table_mut()
+                .ok_or_else(|| anyhow::anyhow!("Config key '{}' is not a table", part))?;
+        }
+        target.insert(name.to_string(), value);
+
+        // Check the new file before replacing the old one
+        let dir = match path.parent() {
+            Some(parent) if !parent.as_os_str().is_empty() => parent,
+            _ => Path::new("."),
+        };
+        std::fs::create_dir_all(dir)?;
+        let staged = tempfile::NamedTempFile::new_in(dir)?;
+        std::fs::write(staged.path(), toml::to_string_pretty(&table)?)?;
+        // The staged copy is restricted like the file it replaces
+        let files: Vec<(PathBuf, bool)> = layers
+            .iter()
+            .map(|layer| {
+                let file = if layer == path { staged.path().to_path_buf() } else { layer.clone() };
+                (file, is_project_file(layer))
+            })
+            .collect();
+        Self::from_layers(&files)?.validate()?;
+
+        staged.persist(path).map_err(|e| e.error)?;
+        Ok(())
+    }
+
     pub fn validate(&self) -> Result<()> {
+        if SandboxProfile::resolve(&self.default_sandbox, &self.sandbox_profiles).is_err() {
+            anyhow::bail!("default_sandbox '{}' is not a sandbox profile", self.default_sandbox);
+        }
+
+        Preprocessors::from_config(&self.preprocessors)?;
+
+        images::validate_overrides(&self.interpreter_images)?;
+
+        for (language, binaries) in &self.languages {
+            binaries.validate(language)?;
+        }
+
+        // The reference ends up in a generated flake
+        if self.nixpkgs.is_empty() || self.nixpkgs.contains(['"', '\\', '$']) {
+            anyhow::bail!("nixpkgs '{}' is not a flake reference", self.nixpkgs);
+        }
+
+        self.cache.budget()?;
+
+        self.download.validate()?;
+
+        self.update.validate()?;
+
+        if let Some(remote) = &self.remote_cache {
+            if remote.url.is_empty() {
+                anyhow::bail!("remote_cache.url must be set");
+            }
+            let plain = |url: &str| url.starts_with("http://");
+            if plain(&remote.url) || remote.endpoint.as_deref().is_some_and(plain) {
+                anyhow::bail!("remote_cache must be reached over https");
+            }
+            if let Some(key) = &remote.public_key {
+                signing::parse_verifying_key(key).map_err(|e| anyhow::anyhow!("remote_cache.public_key: {}", e))?;
+            }
+        }
+
         if self.max_concurrent_containers == 0 {
             anyhow::bail!("max_concurrent_containers must be greater than 0");
         }
 
+        if let Some((language, _)) = self.language_concurrency.iter().find(|(_, limit)| **limit == 0) {
+            anyhow::bail!("language_concurrency.{} must be greater than 0", language);
+        }
+
         if self.default_timeout_secs == 0 || self.default_timeout_secs > 3600 {
             anyhow::bail!("default_timeout_secs must be between 1 and 3600");
         }
@@ -86,4 +696,83 @@ impl Config {
 
         Ok(())
     }
-}
\ No newline at end of file
+}
+fn is_project_file(path: &Path) -> bool {
+    path.file_name().is_some_and(|name| name == PROJECT_CONFIG_FILE)
+}
+
+/// Refuses a project file that sets other keys than [`PROJECT_KEYS`], or
+/// raises a limit of `below`, the configuration it is layered on
+fn check_project(path: &Path, table: &toml::Table, below: &Config, project: &Config) -> Result<()> {
+    if let Some(key) = table.keys().find(|key| !PROJECT_KEYS.contains(&key.as_str())) {
+        anyhow::bail!(
+            "{}: '{}' can only be set in the user configuration; project files may set {}",
+            path.display(),
+            key,
+            PROJECT_KEYS.join(", ")
+        );
+    }
+
+    let raised = [
+        ("default_timeout_secs", project.default_timeout_secs > below.default_timeout_secs),
+        ("default_memory_mb", project.default_memory_mb > below.default_memory_mb),
+        ("default_cpu_limit", project.default_cpu_limit > below.default_cpu_limit),
+        ("default_output_limit_kb", project.default_output_limit_kb > below.default_output_limit_kb),
+        ("max_concurrent_containers", project.max_concurrent_containers > below.max_concurrent_containers),
+    ];
+    if let Some((key, _)) = raised.iter().find(|(_, raised)| *raised) {
+        anyhow::bail!("{}: a project file can lower {} but not raise it", path.display(), key);
+    }
+    for (language, limit) in &project.language_concurrency {
+        let current = below.language_concurrency.get(language).copied().unwrap_or(below.max_concurrent_containers);
+        if *limit > current {
+            anyhow::bail!(
+                "{}: a project file can lower language_concurrency.{} but not raise it",
+                path.display(),
+                language
+            );
+        }
+    }
+    // An empty list allows every language
+    let widened = !below.allowed_languages.is_empty()
+        && (project.allowed_languages.is_empty()
+            || project.allowed_languages.iter().any(|l| !below.allowed_languages.contains(l)));
+    if widened {
+        anyhow::bail!(
+            "{}: allowed_languages can only be narrowed to some of {}",
+            path.display(),
+            below.allowed_languages.join(", ")
+        );
+    }
+    Ok(())
+}
+
+/// Parses a config file, resolving relative paths against its directory
+fn read_table(path: &Path) -> Result<toml::Table> {
+    let content = std::fs::read_to_string(path)?;
+    let mut table = content
+        .parse::<toml::Table>()
+        .map_err(|e| anyhow::anyhow!("{}: {}", path.display(), e))?;
+
+    let dir = path.parent().unwrap_or(Path::new("."));
+    for key in PATH_KEYS {
+        if let Some(toml::Value::String(value)) = table.get_mut(*key) {
+            if Path::new(value.as_str()).is_relative() {
+                *value = dir.join(value.as_str()).to_string_lossy().to_string();
+            }
+        }
+    }
+    Ok(table)
+}
+
+/// Merges `overlay` into `base`; nested tables are merged key by key
+fn merge(base: &mut toml::Table, overlay: toml::Table) {
+    for (key, value) in overlay {
+        match (base.get_mut(&key), value) {
+            (Some(toml::Value::Table(existing)), toml::Value::Table(value)) => merge(existing, value),
+            (_, value) => {
+                base.insert(key, value);
+            }
+        }
+    }
+}
@@ -1,21 +1,36 @@
 use crate::config::Config;
+use crate::download;
 use crate::errors::SingleloadError;
+use crate::logs::{OutputStream, RunLog};
+use crate::platform;
 use crate::security::{PathSanitizer, SeccompProfile};
 use crate::types::{ContainerConfig, Mount};
 use anyhow::Result;
-use futures::StreamExt;
-use podman_api::models::{ContainerCreateResponse, SpecGenerator};
-use podman_api::opts::{ContainerCreateOpts, ContainerListOpts, ImageBuildOpts};
+use futures::{AsyncWriteExt as _, StreamExt};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use podman_api::models::{ContainerCreateResponse, LinuxDevice, PortMapping, PosixRlimit, SpecGenerator};
+use podman_api::conn::TtyChunk;
+use podman_api::opts::{ContainerAttachOpts, ContainerCreateOpts, ContainerListOpts, ImageBuildOpts, ImagePushOpts, PullOpts};
 use podman_api::{api::Container as PodmanContainer, Podman};
 use std::collections::HashMap;
 use std::path::{Path, PathBuf};
+use std::sync::Arc;
 use tempfile::TempDir;
+use tokio::sync::OnceCell;
 use tracing::{debug, info, warn};
 
+/// CFS scheduling period the CPU quota is expressed in
+const CPU_PERIOD_US: i64 = 100_000;
+
+/// Open file limit inside every container
+const MAX_OPEN_FILES: u64 = 1024;
+
+#[derive(Clone)]
 pub struct ContainerManager {
     podman: Podman,
     pub(crate) config: Config,
     seccomp_profile: SeccompProfile,
+    image_id: Arc<OnceCell<String>>,
 }
 
 impl ContainerManager {
@@ -30,6 +45,7 @@ impl ContainerManager {
             podman,
             config,
             seccomp_profile: SeccompProfile::default(),
+            image_id: Arc::new(OnceCell::new()),
         })
     }
 
@@ -50,10 +66,18 @@ impl ContainerManager {
         let dest_containerfile = context_dir.join("Containerfile");
         std::fs::copy(&containerfile, &dest_containerfile)?;
 
-        // Build the image
+        self.build_image(context_dir, &self.config.base_image_name, Vec::new()).await?;
+
+        info!("Base image built successfully: {}", self.config.base_image_name);
+        Ok(())
+    }
+
+    /// Builds the Containerfile in `context_dir` into an image tagged `tag`
+    pub async fn build_image(&self, context_dir: &Path, tag: &str, labels: Vec<(String, String)>) -> Result<()> {
         let build_opts = ImageBuildOpts::builder()
             .dockerfile("Containerfile".to_string())
-            .t(vec![self.config.base_image_name.clone()])
+            .t(vec![tag.to_string()])
+            .labels(labels)
             .pull(true)
             .rm(true)
             .forcerm(true)
@@ -77,8 +101,15 @@ impl ContainerManager {
                 }
             }
         }
+        Ok(())
+    }
 
-        info!("Base image built successfully: {}", self.config.base_image_name);
+    /// Pushes a local image to the registry named in its tag, with the
+    /// credentials of the podman service (`podman login`)
+    pub async fn push_image(&self, tag: &str) -> Result<()> {
+        let opts = ImagePushOpts::builder().destination(tag.to_string()).build();
+        self.podman.images().get(tag).push(&opts).await
+            .map_err(|e| SingleloadError::Container(format!("Push of {} failed: {}", tag, e)))?;
         Ok(())
     }
 
@@ -91,52 +122,176 @@ impl ContainerManager {
         }
     }
 
+    /// Identifier of `image`, pulled from its registry first when podman does
+    /// not have it. Pulls go through the podman service, so they use its
+    /// registry configuration and credentials.
+    pub async fn pull_image(&self, image: &str) -> Result<String> {
+        if let Some(id) = self.image_id(image).await? {
+            return Ok(id);
+        }
+
+        info!("Pulling {}", image);
+        let opts = PullOpts::builder().reference(image.to_string()).quiet(true).build();
+        let images = self.podman.images();
+        let mut pull_stream = images.pull(&opts);
+        while let Some(report) = pull_stream.next().await {
+            let report = report.map_err(|e| SingleloadError::Container(format!("Pull of {} failed: {}", image, e)))?;
+            if let Some(error) = report.error {
+                return Err(SingleloadError::Container(format!("Pull of {} failed: {}", image, error)).into());
+            }
+            if let Some(id) = report.id {
+                return Ok(id);
+            }
+        }
+        Err(SingleloadError::Container(format!("Pull of {} reported no image", image)).into())
+    }
+
+    /// Identifier of `image`, None when podman does not have it
+    pub async fn image_id(&self, image: &str) -> Result<Option<String>> {
+        match self.podman.images().get(image).inspect().await {
+            Ok(inspect) => Ok(Some(inspect.id.unwrap_or_else(|| image.to_string()))),
+            Err(podman_api::Error::NotFound(_)) => Ok(None),
+            Err(e) => Err(SingleloadError::PodmanApi(e).into()),
+        }
+    }
+
+    /// Registry digest of `image`, None when podman does not have it or it
+    /// was built locally
+    pub async fn image_digest(&self, image: &str) -> Result<Option<String>> {
+        match self.podman.images().get(image).inspect().await {
+            Ok(inspect) => Ok(inspect.digest.filter(|digest| digest.starts_with("sha256:"))),
+            Err(podman_api::Error::NotFound(_)) => Ok(None),
+            Err(e) => Err(SingleloadError::PodmanApi(e).into()),
+        }
+    }
+
+    /// Identifier of the installed base image, used to key build caches.
+    /// Looked up once per manager; clones share the result.
+    pub async fn base_image_id(&self) -> Result<String> {
+        let id = self
+            .image_id
+            .get_or_try_init(|| async {
+                let images = self.podman.images();
+                let inspect = images.get(&self.config.base_image_name).inspect().await
+                    .map_err(SingleloadError::PodmanApi)?;
+                Ok::<_, SingleloadError>(inspect.id.unwrap_or_else(|| self.config.base_image_name.clone()))
+            })
+            .await?;
+        Ok(id.clone())
+    }
+
     pub async fn create_container(&self, config: ContainerConfig) -> Result<String> {
         // Create seccomp profile file
-        let seccomp_file = self.write_seccomp_profile().await?;
+        let seccomp_file = self.write_seccomp_profile(&config.allowed_syscalls).await?;
 
         // Build container spec
         let mut spec = SpecGenerator {
             image: Some(config.image),
             name: Some(config.name.clone()),
+            userns: Some(userns(&config.user)),
             user: Some(config.user),
-            userns: Some("host".to_string()),
-            network: Some("none".to_string()),
+            network: match &config.network_mode {
+                Some(mode) => Some(mode.clone()),
+                None if config.network_disabled => Some("none".to_string()),
+                None => None,
+            },
             read_only_filesystem: Some(config.read_only),
-            remove: Some(!config.debug), // Auto-remove unless debugging
+            remove: Some(false), // Removed explicitly once logs have been collected
             ..Default::default()
         };
 
-        // Resource limits
+        if !config.command.is_empty() {
+            spec.command = Some(config.command);
+        }
+        spec.work_dir = config.working_dir;
+        if !config.published_ports.is_empty() {
+            spec.portmappings = Some(
+                config
+                    .published_ports
+                    .iter()
+                    .map(|addr| PortMapping {
+                        container_port: Some(addr.port()),
+                        host_ip: Some(addr.ip().to_string()),
+                        host_port: Some(addr.port()),
+                        protocol: Some("tcp".to_string()),
+                        ..Default::default()
+                    })
+                    .collect(),
+            );
+        }
+        if !config.devices.is_empty() {
+            spec.devices = Some(
+                config
+                    .devices
+                    .into_iter()
+                    .map(|path| LinuxDevice {
+                        path: Some(path),
+                        ..Default::default()
+                    })
+                    .collect(),
+            );
+        }
+
+        // Keep stdin open for interactive sessions
+        if config.interactive {
+            spec.stdin = Some(true);
+        }
+
+        // Resource limits; the CPU quota caps usage at `cpu_limit` cores
+        // even when the host is idle
         spec.resource_limits = Some(HashMap::from([
             ("memory".to_string(), serde_json::json!(config.memory_limit)),
             ("cpu-shares".to_string(), serde_json::json!((config.cpu_limit * 1024.0) as i64)),
-            ("pids".to_string(), serde_json::json!(100)), // Limit process creation
+            ("cpu-period".to_string(), serde_json::json!(CPU_PERIOD_US)),
+            ("cpu-quota".to_string(), serde_json::json!((config.cpu_limit as f64 * CPU_PERIOD_US as f64) as i64)),
+            ("pids".to_string(), serde_json::json!(config.pids_limit)), // Limit process creation
         ]));
 
+        // Backstop for the timeout: the kernel kills processes that use more
+        // CPU time than the run could have had, even if stopping the
+        // container fails
+        let cpu_secs = (config.timeout.as_secs_f32() * config.cpu_limit.max(1.0)).ceil() as u64 + 1;
+        spec.r_limits = Some(vec![
+            PosixRlimit {
+                type_: Some("RLIMIT_CPU".to_string()),
+                soft: Some(cpu_secs),
+                hard: Some(cpu_secs + 1),
+            },
+            PosixRlimit {
+                type_: Some("RLIMIT_NOFILE".to_string()),
+                soft: Some(MAX_OPEN_FILES),
+                hard: Some(MAX_OPEN_FILES),
+            },
+        ]);
+
         // Security options
         spec.security_opt = Some(vec![
             "no-new-privileges".to_string(),
-            format!("seccomp={}", seccomp_file.path().display()),
+            format!("seccomp={}", platform::podman_path(seccomp_file.path())),
         ]);
 
         // Capabilities - drop all
         spec.cap_drop = Some(vec!["ALL".to_string()]);
         spec.cap_add = None;
 
-        // Environment variables
+        // Environment variables; containers that reach the network go
+        // through the configured proxy and package index mirrors
         let mut env = HashMap::new();
+        if !config.network_disabled {
+            env.extend(self.config.proxy.env());
+            env.extend(download::registry_env(&self.config.download.registries));
+        }
         for (k, v) in config.env {
             env.insert(k, v);
         }
         spec.env = Some(env);
 
-        // Mounts
+        // Mounts; sources are host paths as the Podman service sees them
         let mut mounts = vec![];
         for mount in config.mounts {
             mounts.push(HashMap::from([
                 ("type".to_string(), serde_json::json!("bind")),
-                ("source".to_string(), serde_json::json!(mount.source)),
+                ("source".to_string(), serde_json::json!(platform::podman_path(Path::new(&mount.source)))),
                 ("destination".to_string(), serde_json::json!(mount.target)),
                 ("readonly".to_string(), serde_json::json!(mount.read_only)),
                 ("propagation".to_string(), serde_json::json!("rprivate")),
@@ -147,7 +302,7 @@ impl ContainerManager {
         mounts.push(HashMap::from([
             ("type".to_string(), serde_json::json!("tmpfs")),
             ("destination".to_string(), serde_json::json!("/tmp")),
-            ("tmpfs-size".to_string(), serde_json::json!("100m")),
+            ("tmpfs-size".to_string(), serde_json::json!(format!("{}m", config.tmpfs_size_mb))),
         ]));
         
         spec.mounts = Some(mounts);
@@ -166,6 +321,20 @@ impl ContainerManager {
         Ok(response.id)
     }
 
+    /// Sets up a container's namespaces and process without running its
+    /// command, returning the host pid of that process
+    pub async fn init_container(&self, container_id: &str) -> Result<u32> {
+        let container = self.podman.containers().get(container_id);
+        container.init().await
+            .map_err(|e| SingleloadError::Container(format!("Failed to initialize container: {}", e)))?;
+        let inspect = container.inspect().await
+            .map_err(|e| SingleloadError::Container(format!("Failed to inspect container: {}", e)))?;
+        inspect.state.and_then(|state| state.pid)
+            .and_then(|pid| u32::try_from(pid).ok())
+            .filter(|pid| *pid > 0)
+            .ok_or_else(|| SingleloadError::Container("Initialized container has no process".to_string()).into())
+    }
+
     pub async fn start_container(&self, container_id: &str) -> Result<()> {
         let container = self.podman.containers().get(container_id);
         container.start(None).await
@@ -188,6 +357,122 @@ impl ContainerManager {
         }
     }
 
+    /// Starts the container with the terminal's stdin attached and streams
+    /// its output until it exits. Returns the exit code.
+    pub async fn run_interactive(&self, container_id: &str, timeout: std::time::Duration) -> Result<i32> {
+        let container = self.podman.containers().get(container_id);
+
+        // Attach before starting so no early output is lost
+        let attach_opts = ContainerAttachOpts::builder()
+            .stdin(true)
+            .stdout(true)
+            .stderr(true)
+            .stream(true)
+            .build();
+        let multiplexer = container.attach(&attach_opts).await
+            .map_err(|e| SingleloadError::Container(format!("Failed to attach to container: {}", e)))?;
+        let (mut output, mut input) = multiplexer.split();
+
+        self.start_container(container_id).await?;
+
+        let forward_stdin = tokio::spawn(async move {
+            let mut stdin = tokio::io::stdin();
+            let mut buf = [0u8; 4096];
+            loop {
+                match stdin.read(&mut buf).await {
+                    Ok(0) | Err(_) => break,
+                    Ok(n) => {
+                        if input.write_all(&buf[..n]).await.is_err() {
+                            break;
+                        }
+                        let _ = input.flush().await;
+                    }
+                }
+            }
+            // EOF (Ctrl-D) ends the session
+            let _ = input.close().await;
+        });
+
+        let mut stdout = tokio::io::stdout();
+        let mut stderr = tokio::io::stderr();
+        while let Some(chunk) = output.next().await {
+            match chunk {
+                Ok(TtyChunk::StdOut(data)) => {
+                    stdout.write_all(&data).await?;
+                    stdout.flush().await?;
+                }
+                Ok(TtyChunk::StdErr(data)) => {
+                    stderr.write_all(&data).await?;
+                    stderr.flush().await?;
+                }
+                Ok(TtyChunk::StdIn(_)) => {}
+                Err(e) => {
+                    debug!("Attach stream ended: {}", e);
+                    break;
+                }
+            }
+        }
+        forward_stdin.abort();
+
+        self.wait_container(container_id, timeout).await
+    }
+
+    /// Starts the container with its output attached, handing every chunk
+    /// to `log` as it arrives. The container's logs still hold the whole
+    /// output afterwards. The returned task ends when the output does.
+    pub async fn start_logged(&self, container_id: &str, mut log: RunLog) -> Result<tokio::task::JoinHandle<RunLog>> {
+        let container = self.podman.containers().get(container_id);
+
+        // Attach before starting so no early output is lost
+        let attach_opts = ContainerAttachOpts::builder()
+            .stdout(true)
+            .stderr(true)
+            .stream(true)
+            .build();
+        let multiplexer = container.attach(&attach_opts).await
+            .map_err(|e| SingleloadError::Container(format!("Failed to attach to container: {}", e)))?;
+        let (mut output, _input) = multiplexer.split();
+
+        let follow = tokio::spawn(async move {
+            while let Some(chunk) = output.next().await {
+                match chunk {
+                    Ok(TtyChunk::StdOut(data)) => log.write(OutputStream::Stdout, &data),
+                    Ok(TtyChunk::StdErr(data)) => log.write(OutputStream::Stderr, &data),
+                    Ok(TtyChunk::StdIn(_)) => {}
+                    Err(e) => {
+                        debug!("Attach stream ended: {}", e);
+                        break;
+                    }
+                }
+            }
+            log.finish();
+            log
+        });
+
+        if let Err(e) = self.start_container(container_id).await {
+            follow.abort();
+            return Err(e);
+        }
+        Ok(follow)
+    }
+
+    /// Stops a running container; failures are logged since the container
+    /// is removed afterwards anyway
+    pub async fn stop_container(&self, container_id: &str) {
+        let container = self.podman.containers().get(container_id);
+        if let Err(e) = container.stop(None).await {
+            warn!("Failed to stop container {}: {}", container_id, e);
+        }
+    }
+
+    /// Sends `signal` (e.g. `SIGTERM`) to the container's main process
+    pub async fn signal_container(&self, container_id: &str, signal: &str) {
+        let container = self.podman.containers().get(container_id);
+        if let Err(e) = container.send_signal(signal).await {
+            warn!("Failed to send {} to container {}: {}", signal, container_id, e);
+        }
+    }
+
     pub async fn get_container_logs(&self, container_id: &str) -> Result<(String, String)> {
         let container = self.podman.containers().get(container_id);
         
@@ -243,11 +528,15 @@ impl ContainerManager {
         Ok(())
     }
 
-    async fn write_seccomp_profile(&self) -> Result<TempDir> {
+    async fn write_seccomp_profile(&self, allowed: &[String]) -> Result<TempDir> {
         let temp_dir = TempDir::new()?;
         let profile_path = temp_dir.path().join("seccomp.json");
         
-        std::fs::write(&profile_path, &self.seccomp_profile.content)?;
+        let content = match allowed.is_empty() {
+            true => self.seccomp_profile.content.clone(),
+            false => self.seccomp_profile.allowing(allowed)?,
+        };
+        std::fs::write(&profile_path, content)?;
         
         Ok(temp_dir)
     }
@@ -274,4 +563,48 @@ impl ContainerManager {
 
         (stdout.trim_end().to_string(), stderr.trim_end().to_string())
     }
-}
\ No newline at end of file
+}
+
+/// Lets a container running as `user` write to `dir`, which singleload
+/// created for it and which stays closed to other users. Rootless, the host
+/// user already is the container's (see [`userns`]); as root, the tree is
+/// handed to `user` instead.
+pub fn grant(dir: &Path, user: &str) -> std::io::Result<()> {
+    #[cfg(unix)]
+    if nix::unistd::geteuid().is_root() {
+        if let Some((uid, gid)) = user.split_once(':').and_then(|(u, g)| Some((u.parse().ok()?, g.parse().ok()?))) {
+            chown_tree(dir, uid, gid)?;
+        }
+    }
+    #[cfg(not(unix))]
+    let _ = (dir, user);
+    Ok(())
+}
+
+#[cfg(unix)]
+fn chown_tree(path: &Path, uid: u32, gid: u32) -> std::io::Result<()> {
+    std::os::unix::fs::lchown(path, Some(uid), Some(gid))?;
+    if std::fs::symlink_metadata(path)?.is_dir() {
+        for entry in std::fs::read_dir(path)? {
+            chown_tree(&entry?.path(), uid, gid)?;
+        }
+    }
+    Ok(())
+}
+
+/// User namespace of a container running as `user`. Rootless, the host user
+/// is mapped to `user`, so directories the container writes to can belong
+/// to whoever runs singleload and stay closed to everyone else. Rootful
+/// Podman has no such mapping and keeps the host's namespace.
+fn userns(user: &str) -> String {
+    #[cfg(unix)]
+    if nix::unistd::geteuid().is_root() {
+        return "host".to_string();
+    }
+    match user.split_once(':') {
+        Some((uid, gid)) if [uid, gid].iter().all(|id| id.parse::<u32>().is_ok()) => {
+            format!("keep-id:uid={},gid={}", uid, gid)
+        }
+        _ => "host".to_string(),
+    }
+}
@@ -0,0 +1,421 @@
+use crate::audit::AuditMode;
+use crate::container::ContainerManager;
+use crate::errors::SingleloadError;
+use crate::events::EventSink;
+use crate::executor::{CancelReceiver, Executor};
+use crate::grpc::GrpcServer;
+use crate::metrics::{self, Metrics};
+use crate::plugins;
+use crate::queue::{BuildQueue, Job, Priority};
+use crate::runner::{BuildTarget, Registry};
+use crate::sandbox::SandboxProfile;
+use crate::toolchain::ToolchainStore;
+use crate::types::ExecutionResult;
+use anyhow::Result;
+use ed25519_dalek::VerifyingKey;
+use serde::{Deserialize, Serialize};
+use std::net::SocketAddr;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::io::{AsyncBufReadExt, AsyncRead, AsyncWrite, AsyncWriteExt, BufReader};
+use tokio::net::TcpListener;
+#[cfg(unix)]
+use tokio::net::{UnixListener, UnixStream};
+use tracing::{debug, error, info, warn};
+
+/// Run request sent from the CLI to the daemon, one JSON object per line
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RunRequest {
+    pub lang: Option<String>,
+    /// Absolute path of the script on the shared host filesystem
+    pub script: PathBuf,
+    pub timeout_secs: u64,
+    pub memory_mb: u64,
+    pub cpu: f32,
+    pub max_output_kb: u64,
+    pub keep_container: bool,
+    pub no_cache: bool,
+    /// Resolved by the client so profiles from its config apply
+    #[serde(default)]
+    pub sandbox: SandboxProfile,
+    #[serde(default)]
+    pub target: Option<BuildTarget>,
+    #[serde(default)]
+    pub frozen: bool,
+    /// Variables from `--env` and `--env-file`, already resolved by the client
+    #[serde(default)]
+    pub env: Vec<(String, String)>,
+    #[serde(default)]
+    pub no_state: bool,
+    /// Hex-encoded ed25519 public key the script's signature must match
+    #[serde(default)]
+    pub verify_key: Option<String>,
+    #[serde(default)]
+    pub profile: Option<String>,
+    #[serde(default)]
+    pub build_args: Vec<String>,
+    #[serde(default)]
+    pub run_args: Vec<String>,
+    #[serde(default)]
+    pub audit: AuditMode,
+    #[serde(default)]
+    pub priority: Priority,
+    /// Cancel earlier requests for the same script, queued or running
+    #[serde(default)]
+    pub supersede: bool,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DaemonResponse {
+    Result(ExecutionResult),
+    Error(String),
+}
+
+/// Long-running server that keeps the Podman connection and base image
+/// metadata warm, so runs skip the per-invocation setup cost.
+pub struct Daemon {
+    container_manager: ContainerManager,
+    socket_path: PathBuf,
+    queue: Arc<BuildQueue>,
+    registry: Arc<Registry>,
+    metrics: Metrics,
+    metrics_addr: Option<SocketAddr>,
+    /// Address and bearer token of the gRPC API
+    grpc: Option<(SocketAddr, String)>,
+    /// Whether gRPC calls may name scripts by their path on this host
+    grpc_paths: bool,
+}
+
+impl Daemon {
+    pub fn new(container_manager: ContainerManager, socket_path: PathBuf) -> Self {
+        let queue = BuildQueue::new(
+            container_manager.config.max_concurrent_containers,
+            container_manager.config.language_concurrency.clone(),
+        );
+        let registry = Arc::new(plugins::registry(&container_manager.config));
+        Self {
+            container_manager,
+            socket_path,
+            queue,
+            registry,
+            metrics: Metrics::new(),
+            metrics_addr: None,
+            grpc: None,
+            grpc_paths: false,
+        }
+    }
+
+    /// Serves Prometheus metrics over HTTP at `addr` alongside the socket
+    pub fn with_metrics(mut self, addr: Option<SocketAddr>) -> Self {
+        self.metrics_addr = addr;
+        self
+    }
+
+    /// Serves the gRPC control API at the address alongside the socket,
+    /// for clients that want typed messages; every call needs the token. See
+    /// `proto/singleload/v1`
+    pub fn with_grpc(mut self, grpc: Option<(SocketAddr, String)>) -> Self {
+        self.grpc = grpc;
+        self
+    }
+
+    /// Lets gRPC calls name scripts by their path on this host instead of
+    /// sending their source
+    pub fn with_grpc_paths(mut self, allowed: bool) -> Self {
+        self.grpc_paths = allowed;
+        self
+    }
+
+    /// Reads the installed toolchains into the page cache in the
+    /// background; requests are accepted meanwhile
+    fn warm_toolchains(&self) {
+        let store = ToolchainStore::new(self.container_manager.config.toolchains_dir.clone());
+        tokio::task::spawn_blocking(move || match store.warm() {
+            Ok(count) => debug!("Warmed {} toolchains in {}", count, store.root().display()),
+            Err(e) => warn!("Could not warm toolchains: {}", e),
+        });
+    }
+
+    /// Binds the metrics and gRPC endpoints, if they were asked for, before
+    /// any request is accepted so a taken port fails the daemon at startup
+    async fn start_listeners(&self) -> Result<()> {
+        if let Some(addr) = self.metrics_addr {
+            let listener = TcpListener::bind(addr).await.map_err(|e| {
+                SingleloadError::InvalidInput(format!("Cannot serve metrics on {}: {}", addr, e))
+            })?;
+            tokio::spawn(metrics::serve(listener, self.metrics.clone()));
+        }
+        if let Some((addr, token)) = &self.grpc {
+            let addr = *addr;
+            let listener = TcpListener::bind(addr).await.map_err(|e| {
+                SingleloadError::InvalidInput(format!("Cannot serve the gRPC API on {}: {}", addr, e))
+            })?;
+            let server = GrpcServer::new(
+                self.container_manager.clone(),
+                self.queue.clone(),
+                self.registry.clone(),
+                self.metrics.clone(),
+                token.clone(),
+            )
+            .with_local_paths(self.grpc_paths);
+            tokio::spawn(server.serve(listener));
+        }
+        Ok(())
+    }
+
+    #[cfg(unix)]
+    pub async fn serve(self) -> Result<()> {
+        if let Some(parent) = self.socket_path.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        if self.socket_path.exists() {
+            if UnixStream::connect(&self.socket_path).await.is_ok() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "A daemon is already listening on {}",
+                    self.socket_path.display()
+                ))
+                .into());
+            }
+            // Stale socket from a daemon that did not shut down cleanly
+            std::fs::remove_file(&self.socket_path)?;
+        }
+
+        // Warm up: resolve the base image once before accepting requests
+        self.container_manager.base_image_id().await?;
+        self.warm_toolchains();
+        self.start_listeners().await?;
+
+        let listener = UnixListener::bind(&self.socket_path)?;
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&self.socket_path, std::fs::Permissions::from_mode(0o600))?;
+        }
+
+        info!("Daemon listening on {}", self.socket_path.display());
+
+        loop {
+            tokio::select! {
+                accepted = listener.accept() => {
+                    let (stream, _) = accepted?;
+                    self.spawn_connection(stream);
+                }
+                _ = tokio::signal::ctrl_c() => {
+                    info!("Daemon shutting down");
+                    break;
+                }
+            }
+        }
+
+        let _ = std::fs::remove_file(&self.socket_path);
+        Ok(())
+    }
+
+    /// On Windows the daemon listens on a named pipe (`\\.\pipe\...`)
+    /// instead of a unix socket; a fresh pipe instance is created for each
+    /// client that connects.
+    #[cfg(windows)]
+    pub async fn serve(self) -> Result<()> {
+        use tokio::net::windows::named_pipe::ServerOptions;
+
+        let mut server = ServerOptions::new()
+            .first_pipe_instance(true)
+            .create(&self.socket_path)
+            .map_err(|_| {
+                SingleloadError::InvalidInput(format!(
+                    "A daemon is already listening on {}",
+                    self.socket_path.display()
+                ))
+            })?;
+
+        self.container_manager.base_image_id().await?;
+        self.warm_toolchains();
+        self.start_listeners().await?;
+        info!("Daemon listening on {}", self.socket_path.display());
+
+        loop {
+            tokio::select! {
+                connected = server.connect() => {
+                    connected?;
+                    let next = ServerOptions::new().create(&self.socket_path)?;
+                    self.spawn_connection(std::mem::replace(&mut server, next));
+                }
+                _ = tokio::signal::ctrl_c() => {
+                    info!("Daemon shutting down");
+                    break;
+                }
+            }
+        }
+
+        Ok(())
+    }
+
+    fn spawn_connection<S>(&self, stream: S)
+    where
+        S: AsyncRead + AsyncWrite + Send + 'static,
+    {
+        let manager = self.container_manager.clone();
+        let queue = self.queue.clone();
+        let registry = self.registry.clone();
+        let metrics = self.metrics.clone();
+        tokio::spawn(async move {
+            if let Err(e) = handle_connection(stream, manager, queue, registry, metrics).await {
+                warn!("Daemon connection failed: {}", e);
+            }
+        });
+    }
+}
+
+async fn handle_connection<S>(
+    stream: S,
+    container_manager: ContainerManager,
+    queue: Arc<BuildQueue>,
+    registry: Arc<Registry>,
+    metrics: Metrics,
+) -> Result<()>
+where
+    S: AsyncRead + AsyncWrite,
+{
+    let (reader, mut writer) = tokio::io::split(stream);
+    let mut lines = BufReader::new(reader).lines();
+
+    while let Some(line) = lines.next_line().await? {
+        let response = match serde_json::from_str::<RunRequest>(&line) {
+            Ok(request) => {
+                let queued = metrics.queued();
+                let ticket = queue.acquire(job(&registry, &request)).await;
+                drop(queued);
+                match ticket {
+                    None => DaemonResponse::Error(format!(
+                        "Superseded by a newer request for {}",
+                        request.script.display()
+                    )),
+                    Some(ticket) => {
+                        let _active = metrics.active();
+                        debug!("Daemon running {}", request.script.display());
+                        match run_request(&container_manager, request, metrics.sink(), ticket.cancel()).await {
+                            Ok(result) => {
+                                metrics.record_run(Some(&result));
+                                DaemonResponse::Result(result)
+                            }
+                            Err(e) => {
+                                error!("Daemon run failed: {}", e);
+                                metrics.record_run(None);
+                                DaemonResponse::Error(e.to_string())
+                            }
+                        }
+                    }
+                }
+            }
+            Err(e) => DaemonResponse::Error(format!("Invalid request: {}", e)),
+        };
+
+        let mut payload = serde_json::to_vec(&response)?;
+        payload.push(b'\n');
+        writer.write_all(&payload).await?;
+    }
+
+    Ok(())
+}
+
+/// Where `request` goes in the queue, with the script's language told the
+/// way the run will tell it
+fn job(registry: &Registry, request: &RunRequest) -> Job {
+    let language = request.lang.clone().or_else(|| {
+        let content = std::fs::read(&request.script).ok()?;
+        registry.detect(&request.script, &content).map(|runner| runner.name().to_string())
+    });
+    Job {
+        script: request.script.canonicalize().unwrap_or_else(|_| request.script.clone()),
+        language,
+        priority: request.priority,
+        supersede: request.supersede,
+    }
+}
+
+async fn run_request(
+    container_manager: &ContainerManager,
+    request: RunRequest,
+    events: EventSink,
+    cancel: CancelReceiver,
+) -> Result<ExecutionResult> {
+    let verifying_key = match &request.verify_key {
+        Some(encoded) => Some(decode_verifying_key(encoded)?),
+        None => None,
+    };
+
+    let mut executor = Executor::new(
+        container_manager.clone(),
+        Duration::from_secs(request.timeout_secs),
+        request.memory_mb * 1024 * 1024,
+        request.cpu,
+        request.max_output_kb * 1024,
+    )
+    .with_sandbox(request.sandbox)
+    .with_target(request.target)
+    .with_env(request.env)
+    .with_verifying_key(verifying_key)
+    .with_profile(request.profile)
+    .with_build_args(request.build_args)
+    .with_run_args(request.run_args)
+    .with_audit(request.audit)
+    .with_events(events);
+    if request.no_cache {
+        executor = executor.without_cache();
+    }
+    if request.frozen {
+        executor = executor.frozen();
+    }
+    if request.no_state {
+        executor = executor.without_state();
+    }
+
+    executor
+        .run_script_cancellable(request.lang.as_deref(), &request.script, request.keep_container, cancel)
+        .await
+}
+
+fn decode_verifying_key(encoded: &str) -> Result<VerifyingKey, SingleloadError> {
+    let invalid = || SingleloadError::InvalidInput("Invalid verify_key in request".to_string());
+    let bytes: [u8; 32] = hex::decode(encoded)
+        .map_err(|_| invalid())?
+        .try_into()
+        .map_err(|_| invalid())?;
+    VerifyingKey::from_bytes(&bytes).map_err(|_| invalid())
+}
+
+/// Sends a run request to a daemon listening on `socket_path`.
+///
+/// Returns None when no daemon is reachable so the caller can run the
+/// script itself.
+pub async fn try_proxy(socket_path: &Path, request: &RunRequest) -> Option<Result<ExecutionResult>> {
+    #[cfg(unix)]
+    let stream = UnixStream::connect(socket_path).await.ok()?;
+    #[cfg(windows)]
+    let stream = tokio::net::windows::named_pipe::ClientOptions::new().open(socket_path).ok()?;
+    debug!("Proxying run to daemon at {}", socket_path.display());
+    Some(proxy(stream, request).await)
+}
+
+async fn proxy<S>(stream: S, request: &RunRequest) -> Result<ExecutionResult>
+where
+    S: AsyncRead + AsyncWrite,
+{
+    let (reader, mut writer) = tokio::io::split(stream);
+
+    let mut payload = serde_json::to_vec(request)?;
+    payload.push(b'\n');
+    writer.write_all(&payload).await?;
+
+    let mut lines = BufReader::new(reader).lines();
+    let line = lines.next_line().await?.ok_or_else(|| {
+        SingleloadError::Container("Daemon closed the connection without a response".to_string())
+    })?;
+
+    match serde_json::from_str(&line)? {
+        DaemonResponse::Result(result) => Ok(result),
+        DaemonResponse::Error(e) => Err(SingleloadError::Container(e).into()),
+    }
+}
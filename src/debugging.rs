@@ -0,0 +1,125 @@
+use crate::errors::SingleloadError;
+use std::net::{IpAddr, Ipv4Addr, SocketAddr};
+
+/// Where the debugpy package sits in the base image; it runs from its
+/// directory, so nothing is added to the script's import path
+const DEBUGPY_PATH: &str = "/usr/local/lib/debugpy/debugpy";
+
+/// Languages built into native programs, which lldb debugs
+const NATIVE_LANGUAGES: &[&str] = &["c", "cpp", "rust"];
+
+/// What `singleload debug` asked for
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Debugging {
+    /// Host address of a headless debug adapter server for editors to
+    /// attach to; the debugger runs on the terminal when not given
+    pub dap: Option<SocketAddr>,
+}
+
+/// Parses `--dap`: `:4711` listens on the host's loopback only, since
+/// whoever reaches the port can run code in the container; give an
+/// address like `0.0.0.0:4711` to listen on others
+pub fn parse_dap(value: &str) -> Result<SocketAddr, String> {
+    if let Some(port) = value.strip_prefix(':') {
+        let port: u16 = port.parse().map_err(|_| format!("'{}' is not a port", port))?;
+        return Ok(SocketAddr::new(IpAddr::V4(Ipv4Addr::LOCALHOST), port));
+    }
+    value
+        .parse()
+        .map_err(|_| format!("'{}' is not an address such as :4711 or 127.0.0.1:4711", value))
+}
+
+/// The debugger of a language's backend
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Debugger {
+    Delve,
+    /// pdb on the terminal, debugpy for editors
+    Pdb,
+    Lldb,
+}
+
+impl Debugger {
+    pub fn for_language(language: &str) -> Result<Self, SingleloadError> {
+        match language {
+            "go" => Ok(Self::Delve),
+            "python" => Ok(Self::Pdb),
+            other if NATIVE_LANGUAGES.contains(&other) => Ok(Self::Lldb),
+            other => Err(SingleloadError::InvalidInput(format!(
+                "debugging is supported for go, python, {} scripts, not {}",
+                NATIVE_LANGUAGES.join(", "),
+                other
+            ))),
+        }
+    }
+
+    pub fn name(&self, dap: bool) -> &'static str {
+        match (self, dap) {
+            (Self::Delve, _) => "delve",
+            (Self::Pdb, false) => "pdb",
+            (Self::Pdb, true) => "debugpy",
+            (Self::Lldb, false) => "lldb",
+            (Self::Lldb, true) => "lldb-vscode",
+        }
+    }
+
+    /// Compiler flags keeping the symbols and variables a debugger shows;
+    /// they are part of the build's cache key, so debug builds do not
+    /// replace the optimized ones
+    pub fn build_flags(&self, language: &str) -> Vec<String> {
+        let flags: &[&str] = match (self, language) {
+            (Self::Delve, _) => &["-gcflags=all=-N -l"],
+            (Self::Lldb, "rust") => &["-C", "debuginfo=2", "-C", "opt-level=0"],
+            (Self::Lldb, _) => &["-g", "-O0"],
+            (Self::Pdb, _) => &[],
+        };
+        flags.iter().map(|f| f.to_string()).collect()
+    }
+
+    /// Wraps `command`, the one running the program without its build, so
+    /// the debugger starts it, on the terminal or serving debug adapter
+    /// clients on `port` inside the container
+    pub fn wrap(&self, command: &[String], port: Option<u16>) -> Vec<String> {
+        let Some((program, args)) = command.split_first() else {
+            return command.to_vec();
+        };
+        let listen = |port: u16| format!("0.0.0.0:{}", port);
+        let mut wrapped: Vec<String> = match (self, port) {
+            (Self::Delve, None) => vec!["dlv".into(), "exec".into(), program.clone(), "--".into()],
+            // Headless delve serves DAP clients as well as its own
+            (Self::Delve, Some(port)) => vec![
+                "dlv".into(),
+                "exec".into(),
+                "--headless".into(),
+                "--accept-multiclient".into(),
+                "--api-version=2".into(),
+                format!("--listen={}", listen(port)),
+                program.clone(),
+                "--".into(),
+            ],
+            // The interpreter stays, the script is what pdb runs
+            (Self::Pdb, None) => vec![program.clone(), "-m".into(), "pdb".into()],
+            (Self::Pdb, Some(port)) => vec![
+                program.clone(),
+                DEBUGPY_PATH.into(),
+                "--listen".into(),
+                listen(port),
+                "--wait-for-client".into(),
+            ],
+            (Self::Lldb, None) => vec!["lldb".into(), "--".into(), program.clone()],
+            // The editor's launch request names the program and its arguments
+            (Self::Lldb, Some(port)) => return vec!["lldb-vscode".into(), "--port".into(), port.to_string()],
+        };
+        wrapped.extend(args.iter().cloned());
+        wrapped
+    }
+
+    /// Calls the default seccomp profile blocks that the debugger makes:
+    /// tracing the program, reading its memory and turning off address
+    /// randomization so breakpoints stay put
+    pub fn syscalls(&self) -> &'static [&'static str] {
+        match self {
+            Self::Delve | Self::Lldb => &["ptrace", "personality", "process_vm_readv", "process_vm_writev"],
+            Self::Pdb => &[],
+        }
+    }
+}
@@ -0,0 +1,303 @@
+use crate::errors::SingleloadError;
+use crate::runner::shell_quote;
+use sha2::{Digest, Sha256};
+use std::collections::{HashMap, HashSet};
+use std::fs::File;
+use std::io::{Read, Seek, SeekFrom};
+use std::path::{Path, PathBuf};
+
+/// Store on the host that chunks of earlier uploads are kept in
+pub const REMOTE_STORE: &str = "${XDG_CACHE_HOME:-$HOME/.cache}/singleload/chunks";
+
+/// Chunks end where the rolling hash has these bits clear, about every
+/// 8 KiB of content
+const CHUNK_MASK: u64 = (1 << 13) - 1;
+
+const MIN_CHUNK: usize = 2 * 1024;
+
+const MAX_CHUNK: usize = 64 * 1024;
+
+/// Chunks per `cat` or `touch` line of the assemble script, which keeps
+/// lines well below the argument limits of small hosts
+const CHUNKS_PER_LINE: usize = 256;
+
+/// Days a chunk no upload used stays in the host's store
+const STORE_DAYS: u32 = 30;
+
+/// Script the upload archive carries next to its chunks
+pub const ASSEMBLE_SCRIPT: &str = "assemble.sh";
+
+/// Random values the rolling hash adds per byte, fixed so the same content
+/// is cut the same way by every singleload build
+const GEAR: [u64; 256] = gear_table();
+
+const fn gear_table() -> [u64; 256] {
+    let mut table = [0u64; 256];
+    let mut state: u64 = 0;
+    let mut i = 0;
+    while i < table.len() {
+        // splitmix64
+        state = state.wrapping_add(0x9e37_79b9_7f4a_7c15);
+        let mut z = state;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+        table[i] = z ^ (z >> 31);
+        i += 1;
+    }
+    table
+}
+
+/// Lengths of the chunks `data` is cut into. Cuts depend only on the 64
+/// bytes before them, as in rsync's rolling checksum, so an edit changes
+/// the chunks around it and leaves the ones before and after it alone,
+/// even when it inserts or removes bytes.
+pub fn chunk_lengths(data: &[u8]) -> Vec<usize> {
+    let mut lengths = Vec::new();
+    let mut start = 0;
+    while start < data.len() {
+        let rest = &data[start..];
+        let mut hash: u64 = 0;
+        let mut len = rest.len().min(MAX_CHUNK);
+        for (i, byte) in rest.iter().enumerate().take(MAX_CHUNK) {
+            hash = (hash << 1).wrapping_add(GEAR[*byte as usize]);
+            if i + 1 >= MIN_CHUNK && hash & CHUNK_MASK == 0 {
+                len = i + 1;
+                break;
+            }
+        }
+        lengths.push(len);
+        start += len;
+    }
+    lengths
+}
+
+/// What is at a path of an upload
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Entry {
+    Dir,
+    /// The SHA-256 of each chunk, in order, and of the whole file
+    File {
+        chunks: Vec<String>,
+        sha256: String,
+        executable: bool,
+    },
+    Link(String),
+}
+
+/// Where the bytes of a chunk are on this machine
+#[derive(Debug, Clone)]
+struct Source {
+    path: PathBuf,
+    offset: u64,
+    len: usize,
+}
+
+/// The files of an upload split into chunks. The host keeps the chunks it
+/// was sent, so uploading a changed tree again only sends the chunks it
+/// has not seen.
+#[derive(Debug, Default)]
+pub struct Manifest {
+    /// Paths relative to the upload directory, parents before children
+    pub entries: Vec<(String, Entry)>,
+    sources: HashMap<String, Source>,
+    size: u64,
+}
+
+/// How much of an upload went over the wire
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct SyncStats {
+    pub files: usize,
+    pub bytes: u64,
+    /// Bytes of the chunks the host did not have
+    pub sent_bytes: u64,
+}
+
+impl Manifest {
+    /// Chunks each file or directory in `roots`, putting it at the relative
+    /// path it is paired with
+    pub fn scan(roots: &[(&str, &Path)]) -> Result<Self, SingleloadError> {
+        let mut manifest = Self::default();
+        for (name, path) in roots {
+            manifest.add(name.to_string(), path)?;
+        }
+        Ok(manifest)
+    }
+
+    fn add(&mut self, name: String, path: &Path) -> Result<(), SingleloadError> {
+        let metadata = std::fs::symlink_metadata(path)?;
+        if metadata.file_type().is_symlink() {
+            let target = std::fs::read_link(path)?.to_string_lossy().replace('\\', "/");
+            self.entries.push((name, Entry::Link(target)));
+            return Ok(());
+        }
+        if metadata.is_dir() {
+            self.entries.push((name.clone(), Entry::Dir));
+            let mut children: Vec<_> = std::fs::read_dir(path)?.collect::<Result<_, _>>()?;
+            children.sort_by_key(|entry| entry.file_name());
+            for child in children {
+                let child_name = format!("{}/{}", name, child.file_name().to_string_lossy());
+                self.add(child_name, &child.path())?;
+            }
+            return Ok(());
+        }
+
+        let data = std::fs::read(path)?;
+        let mut chunks = Vec::new();
+        let mut offset = 0;
+        for len in chunk_lengths(&data) {
+            let hash = hex::encode(Sha256::digest(&data[offset..offset + len]));
+            self.sources.entry(hash.clone()).or_insert_with(|| Source {
+                path: path.to_path_buf(),
+                offset: offset as u64,
+                len,
+            });
+            chunks.push(hash);
+            offset += len;
+        }
+        self.size += data.len() as u64;
+        self.entries.push((
+            name,
+            Entry::File {
+                chunks,
+                sha256: hex::encode(Sha256::digest(&data)),
+                executable: is_executable(&metadata),
+            },
+        ));
+        Ok(())
+    }
+
+    /// Bytes of all files
+    pub fn size(&self) -> u64 {
+        self.size
+    }
+
+    pub fn files(&self) -> usize {
+        self.entries.iter().filter(|(_, entry)| matches!(entry, Entry::File { .. })).count()
+    }
+
+    /// Every distinct chunk, in the order the files use them
+    pub fn chunks(&self) -> Vec<&str> {
+        let mut seen = HashSet::new();
+        self.entries
+            .iter()
+            .filter_map(|(_, entry)| match entry {
+                Entry::File { chunks, .. } => Some(chunks),
+                _ => None,
+            })
+            .flatten()
+            .filter(|hash| seen.insert(hash.as_str()))
+            .map(String::as_str)
+            .collect()
+    }
+
+    /// Bytes of the given chunks
+    pub fn chunk_size(&self, hashes: &[String]) -> u64 {
+        hashes.iter().filter_map(|hash| self.sources.get(hash)).map(|source| source.len as u64).sum()
+    }
+
+    /// Tar archive of the `missing` chunks, named `chunks/<sha256>`, and
+    /// the script that assembles the upload from them
+    pub fn pack(&self, missing: &[String]) -> Result<Vec<u8>, SingleloadError> {
+        let now = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .map_or(0, |d| d.as_secs());
+        let mut archive = tar::Builder::new(Vec::new());
+        let mut append = |name: String, data: &[u8]| -> std::io::Result<()> {
+            let mut header = tar::Header::new_gnu();
+            header.set_size(data.len() as u64);
+            header.set_mode(0o644);
+            // The host prunes chunks by age
+            header.set_mtime(now);
+            header.set_cksum();
+            archive.append_data(&mut header, name, data)
+        };
+        for hash in missing {
+            let source = self.sources.get(hash).ok_or_else(|| {
+                SingleloadError::Remote(format!("the host asked for chunk {}, which is not part of the upload", hash))
+            })?;
+            let mut file = File::open(&source.path)?;
+            file.seek(SeekFrom::Start(source.offset))?;
+            let mut data = vec![0; source.len];
+            file.read_exact(&mut data)?;
+            append(format!("chunks/{}", hash), &data)?;
+        }
+        append(ASSEMBLE_SCRIPT.to_string(), self.assemble_script().as_bytes())?;
+        Ok(archive.into_inner()?)
+    }
+
+    /// Shell script that writes the upload into the current directory from
+    /// the `chunks` directory next to it, which holds the chunks sent and
+    /// hard links to the ones the store given as `$1` already had, so a
+    /// concurrent prune cannot take them away. Every file is checked against
+    /// its SHA-256; when one does not match, the chunks that do not match
+    /// their names are removed, from the store too, and the script fails.
+    /// Otherwise the chunks join the store, marked used, and the ones no
+    /// upload used for [`STORE_DAYS`] are pruned.
+    pub fn assemble_script(&self) -> String {
+        let mut script = String::from(concat!(
+            "set -e\ns=$1\nc=$(dirname \"$0\")/chunks\nbad=\n",
+            "if command -v sha256sum >/dev/null 2>&1; then sum() { sha256sum; }; else sum() { shasum -a 256; }; fi\n",
+            "check() { [ \"$(sum < \"$1\" | cut -d ' ' -f 1)\" = \"$2\" ]; }\n",
+        ));
+        for (name, entry) in &self.entries {
+            let path = shell_quote(name);
+            match entry {
+                Entry::Dir => script.push_str(&format!("mkdir -p {}\n", path)),
+                Entry::Link(target) => script.push_str(&format!("ln -s {} {}\n", shell_quote(target), path)),
+                Entry::File {
+                    chunks,
+                    sha256,
+                    executable,
+                } => {
+                    if chunks.is_empty() {
+                        script.push_str(&format!(": > {}\n", path));
+                    }
+                    for (i, line) in chunks.chunks(CHUNKS_PER_LINE).enumerate() {
+                        let redirect = if i == 0 { ">" } else { ">>" };
+                        let files: String = line.iter().map(|hash| format!(" \"$c/{}\"", hash)).collect();
+                        script.push_str(&format!("cat{} {} {}\n", files, redirect, path));
+                    }
+                    script.push_str(&format!("check {} {} || bad=1\n", path, sha256));
+                    if *executable {
+                        script.push_str(&format!("chmod +x {}\n", path));
+                    }
+                }
+            }
+        }
+        script.push_str(concat!(
+            "if [ -n \"$bad\" ]; then\n",
+            "for chunk in \"$c\"/*; do check \"$chunk\" \"${chunk##*/}\" || rm -f \"$chunk\" \"$s/${chunk##*/}\"; done\n",
+            "echo \"singleload: the upload did not assemble; corrupt chunks were removed and are sent again next time\" >&2\n",
+            "exit 1\nfi\n",
+            // The links to the store's own copies stay where they are
+            "for chunk in \"$c\"/*; do if [ -f \"$chunk\" ] && [ ! -e \"$s/${chunk##*/}\" ]; then mv -f \"$chunk\" \"$s/\"; fi; done\n",
+        ));
+        for line in self.chunks().chunks(CHUNKS_PER_LINE) {
+            script.push_str(&format!("(cd \"$s\" && touch -c {})\n", line.join(" ")));
+        }
+        // Uploads in progress hold their chunks in .incoming.*, which are
+        // only removed once interrupted uploads left them behind for a day
+        script.push_str(&format!(
+            "find \"$s\" -name '.incoming.*' -prune -o -type f -mtime +{} -exec rm -f {{}} + 2>/dev/null || true\nfind \"$s\" -name '.incoming.*' -type d -mtime +1 -prune -exec rm -rf {{}} + 2>/dev/null || true\n",
+            STORE_DAYS
+        ));
+        script
+    }
+}
+
+/// True for the 64 lowercase hex digits chunks are named by, which is all
+/// the host's answers may name
+pub fn is_chunk_name(name: &str) -> bool {
+    name.len() == 64 && name.chars().all(|c| c.is_ascii_digit() || ('a'..='f').contains(&c))
+}
+
+#[cfg(unix)]
+fn is_executable(metadata: &std::fs::Metadata) -> bool {
+    use std::os::unix::fs::PermissionsExt;
+    metadata.permissions().mode() & 0o111 != 0
+}
+
+#[cfg(not(unix))]
+fn is_executable(_metadata: &std::fs::Metadata) -> bool {
+    false
+}
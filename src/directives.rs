@@ -0,0 +1,602 @@
+use crate::args::ArgSpec;
+use crate::entries::Entry;
+use crate::errors::SingleloadError;
+use crate::gpu;
+use crate::verify::Normalizer;
+use serde::Serialize;
+use std::path::{Component, Path};
+
+const DIRECTIVE_MARKER: &str = "singleload:";
+const COMMENT_PREFIXES: &[&str] = &["//", "#"];
+
+/// A `singleload:` directive found in the comment header of a script, e.g.
+/// `// singleload: require github.com/spf13/cobra v1.8.0`
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Directive {
+    /// 1-based line number in the original script
+    pub line: usize,
+    pub name: String,
+    pub value: String,
+}
+
+/// All directives declared in a script's header
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct Directives {
+    items: Vec<Directive>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum PackageManager {
+    Go,
+    Pip,
+    Npm,
+    Maven,
+}
+
+impl PackageManager {
+    fn from_directive(name: &str) -> Option<Self> {
+        match name {
+            "require" => Some(PackageManager::Go),
+            "pip" => Some(PackageManager::Pip),
+            "npm" => Some(PackageManager::Npm),
+            "maven" => Some(PackageManager::Maven),
+            _ => None,
+        }
+    }
+
+    pub fn directive(&self) -> &'static str {
+        match self {
+            PackageManager::Go => "require",
+            PackageManager::Pip => "pip",
+            PackageManager::Npm => "npm",
+            PackageManager::Maven => "maven",
+        }
+    }
+}
+
+/// A third-party dependency declared inline in a script
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Dependency {
+    pub manager: PackageManager,
+    pub name: String,
+    pub version: Option<String>,
+}
+
+impl Dependency {
+    fn parse(manager: PackageManager, value: &str) -> Option<Self> {
+        let value = value.trim();
+        if value.is_empty() {
+            return None;
+        }
+
+        let (name, version) = match manager {
+            // require github.com/spf13/cobra v1.8.0
+            PackageManager::Go => {
+                let mut parts = value.split_whitespace();
+                let name = parts.next()?.to_string();
+                (name, parts.next().map(|v| v.to_string()))
+            }
+            // pip requests==2.31
+            PackageManager::Pip => match value.find(|c: char| "=<>!~[".contains(c)) {
+                Some(idx) => (value[..idx].to_string(), Some(value[idx..].to_string())),
+                None => (value.to_string(), None),
+            },
+            // npm lodash@4, npm @types/node@20
+            PackageManager::Npm => {
+                // The @ of a scope is part of the name
+                let unscoped = value.strip_prefix('@').unwrap_or(value);
+                match unscoped.rfind('@') {
+                    Some(idx) => {
+                        let at = value.len() - unscoped.len() + idx;
+                        (value[..at].to_string(), Some(value[at + 1..].to_string()))
+                    }
+                    None => (value.to_string(), None),
+                }
+            }
+            // maven org.slf4j:slf4j-api:2.0.9, the newest release without a version
+            PackageManager::Maven => {
+                let mut parts = value.splitn(3, ':');
+                let (group, artifact) = (parts.next()?, parts.next()?);
+                if group.is_empty() || artifact.is_empty() {
+                    return None;
+                }
+                (format!("{}:{}", group, artifact), parts.next().map(|v| v.to_string()))
+            }
+        };
+
+        Some(Self { manager, name, version })
+    }
+
+    /// Dependency on exactly `version`, as recorded in a lockfile
+    pub fn pinned(manager: PackageManager, name: &str, version: &str) -> Self {
+        let version = match manager {
+            PackageManager::Pip => format!("=={}", version),
+            PackageManager::Go | PackageManager::Npm | PackageManager::Maven => version.to_string(),
+        };
+        Self {
+            manager,
+            name: name.to_string(),
+            version: Some(version),
+        }
+    }
+
+    /// Specification in the form the package manager accepts on its command line
+    pub fn spec(&self) -> String {
+        match (self.manager, &self.version) {
+            (PackageManager::Go, Some(v)) => format!("{}@{}", self.name, v),
+            (PackageManager::Pip, Some(v)) => format!("{}{}", self.name, v),
+            (PackageManager::Npm, Some(v)) => format!("{}@{}", self.name, v),
+            (PackageManager::Maven, Some(v)) => format!("{}:{}", self.name, v),
+            (PackageManager::Maven, None) => format!("{}:latest.release", self.name),
+            (_, None) => self.name.clone(),
+        }
+    }
+}
+
+/// An endpoint a script may connect to, declared with
+/// `singleload: net allow api.example.com:443`
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct NetRule {
+    /// Host name or address, or `*.example.com` for any of its subdomains
+    pub host: String,
+    pub port: u16,
+}
+
+impl NetRule {
+    /// Parses `host:port`; IPv6 addresses are written `[::1]:443`
+    pub fn parse(value: &str) -> Option<Self> {
+        let (host, port) = split_host_port(value)?;
+        let valid = !host.is_empty()
+            && host
+                .trim_start_matches("*.")
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || "-.:".contains(c));
+        valid.then(|| Self {
+            host: host.to_ascii_lowercase(),
+            port,
+        })
+    }
+
+    pub fn matches(&self, host: &str, port: u16) -> bool {
+        if port != self.port {
+            return false;
+        }
+        let host = host.trim_end_matches('.').to_ascii_lowercase();
+        match self.host.strip_prefix("*.") {
+            Some(domain) => host.len() > domain.len() && host.ends_with(&format!(".{}", domain)),
+            None => host == self.host,
+        }
+    }
+}
+
+impl std::fmt::Display for NetRule {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        if self.host.contains(':') {
+            write!(f, "[{}]:{}", self.host, self.port)
+        } else {
+            write!(f, "{}:{}", self.host, self.port)
+        }
+    }
+}
+
+/// Singleload versions a script runs under, declared with
+/// `singleload: requires >=0.9`. A bare version means that one or later;
+/// missing components count as zero.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VersionRequirement {
+    pub op: &'static str,
+    pub version: String,
+}
+
+impl VersionRequirement {
+    /// Parses `>=0.9`, `>0.9`, `=0.9.2`, `<2`, `<=1.4` or `0.9`
+    pub fn parse(value: &str) -> Option<Self> {
+        let (op, version) = [">=", "<=", ">", "<", "="]
+            .iter()
+            .find_map(|op| value.strip_prefix(op).map(|rest| (*op, rest.trim())))
+            .unwrap_or((">=", value));
+        let version = version.strip_prefix('v').unwrap_or(version);
+        release(version)?;
+        Some(Self {
+            op,
+            version: version.to_string(),
+        })
+    }
+
+    pub fn matches(&self, version: &str) -> bool {
+        let (Some(mut have), Some(mut wanted)) = (release(version), release(&self.version)) else {
+            return false;
+        };
+        let len = have.len().max(wanted.len());
+        have.resize(len, 0);
+        wanted.resize(len, 0);
+        match self.op {
+            ">" => have > wanted,
+            "<" => have < wanted,
+            "<=" => have <= wanted,
+            "=" => have == wanted,
+            _ => have >= wanted,
+        }
+    }
+}
+
+impl std::fmt::Display for VersionRequirement {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}{}", self.op, self.version)
+    }
+}
+
+/// Numeric components of a release, ignoring pre-release and build suffixes
+fn release(version: &str) -> Option<Vec<u64>> {
+    let core = version.split(['-', '+']).next()?;
+    core.split('.').map(|part| part.parse().ok()).collect()
+}
+
+/// Splits `host:port` or `[v6]:port`
+pub fn split_host_port(value: &str) -> Option<(&str, u16)> {
+    let (host, port) = match value.strip_prefix('[') {
+        Some(rest) => {
+            let (host, port) = rest.split_once("]:")?;
+            (host, port)
+        }
+        None => value.rsplit_once(':')?,
+    };
+    Some((host, port.parse().ok()?))
+}
+
+/// Splits on whitespace outside single or double quotes, removing the
+/// quotes; a backslash escapes the next character outside single quotes.
+/// None if a quote is left open.
+pub fn split_words(value: &str) -> Option<Vec<String>> {
+    let mut words = vec![];
+    let mut word = String::new();
+    let mut in_word = false;
+    let mut quote = None;
+    let mut chars = value.chars();
+
+    while let Some(c) = chars.next() {
+        match (quote, c) {
+            (Some(q), c) if c == q => quote = None,
+            (Some('"') | None, '\\') => {
+                word.extend(chars.next());
+                in_word = true;
+            }
+            (Some(_), c) => word.push(c),
+            (None, '\'' | '"') => {
+                quote = Some(c);
+                in_word = true;
+            }
+            (None, c) if c.is_whitespace() => {
+                if in_word {
+                    words.push(std::mem::take(&mut word));
+                    in_word = false;
+                }
+            }
+            (None, c) => {
+                word.push(c);
+                in_word = true;
+            }
+        }
+    }
+
+    if quote.is_some() {
+        return None;
+    }
+    if in_word {
+        words.push(word);
+    }
+    Some(words)
+}
+
+impl Directives {
+    /// Parses the directive header: the leading run of blank and comment
+    /// lines, after an optional shebang or `<?php` opener.
+    pub fn parse(content: &[u8]) -> Self {
+        let text = String::from_utf8_lossy(content);
+        let mut items = vec![];
+
+        for (idx, line) in text.lines().enumerate() {
+            let trimmed = line.trim();
+            if idx == 0 && (trimmed.starts_with("#!") || trimmed.starts_with("<?php")) {
+                continue;
+            }
+            if trimmed.is_empty() {
+                continue;
+            }
+
+            let comment = match COMMENT_PREFIXES.iter().find(|p| trimmed.starts_with(*p)) {
+                Some(prefix) => trimmed[prefix.len()..].trim_start(),
+                None => break,
+            };
+
+            if let Some(rest) = comment.strip_prefix(DIRECTIVE_MARKER) {
+                let rest = rest.trim();
+                let (name, value) = match rest.split_once(char::is_whitespace) {
+                    Some((name, value)) => (name, value.trim()),
+                    None => (rest, ""),
+                };
+                // Modeline form: `singleload: lang=go`
+                let (name, value) = match name.split_once('=') {
+                    Some((name, assigned)) if value.is_empty() => (name, assigned),
+                    _ => (name, value),
+                };
+                if !name.is_empty() {
+                    items.push(Directive {
+                        line: idx + 1,
+                        name: name.to_ascii_lowercase(),
+                        value: value.to_string(),
+                    });
+                }
+            }
+        }
+
+        Self { items }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.items.is_empty()
+    }
+
+    pub fn iter(&self) -> impl Iterator<Item = &Directive> {
+        self.items.iter()
+    }
+
+    /// All directives with the given name, in declaration order
+    pub fn all<'a>(&'a self, name: &'a str) -> impl Iterator<Item = &'a Directive> + 'a {
+        self.items.iter().filter(move |d| d.name == name)
+    }
+
+    /// The first directive with the given name
+    pub fn first(&self, name: &str) -> Option<&Directive> {
+        self.items.iter().find(|d| d.name == name)
+    }
+
+    /// Asset patterns declared with `embed`, in declaration order; one
+    /// directive may list several
+    pub fn embeds(&self) -> Result<Vec<String>, SingleloadError> {
+        let mut patterns = vec![];
+        for directive in self.all("embed") {
+            if directive.value.is_empty() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: 'embed' directive needs a file or pattern",
+                    directive.line
+                )));
+            }
+            patterns.extend(directive.value.split_whitespace().map(String::from));
+        }
+        Ok(patterns)
+    }
+
+    /// Local files declared with `uses`, with the line declaring each. Paths
+    /// are relative; one directive may list several.
+    pub fn uses(&self) -> Result<Vec<(usize, String)>, SingleloadError> {
+        let mut paths = vec![];
+        for directive in self.all("uses") {
+            if directive.value.is_empty() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: 'uses' directive needs a file",
+                    directive.line
+                )));
+            }
+            for path in directive.value.split_whitespace() {
+                let outside = Path::new(path)
+                    .components()
+                    .any(|part| !matches!(part, Component::Normal(_) | Component::CurDir));
+                if outside {
+                    return Err(SingleloadError::InvalidInput(format!(
+                        "line {}: uses '{}' must be inside the script's directory, without '..'",
+                        directive.line, path
+                    )));
+                }
+                paths.push((directive.line, path.to_string()));
+            }
+        }
+        Ok(paths)
+    }
+
+    /// Environment variables the script declares with `env` as required,
+    /// with the line declaring each
+    pub fn required_env(&self) -> Vec<(usize, String)> {
+        self.all("env")
+            .flat_map(|d| d.value.split_whitespace().map(move |name| (d.line, name.to_string())))
+            .collect()
+    }
+
+    /// Singleload versions the script declares with `requires`, with the
+    /// line declaring each; one directive may list several, which all have
+    /// to hold, e.g. `requires >=0.9 <2`
+    pub fn version_requirements(&self) -> Result<Vec<(usize, VersionRequirement)>, SingleloadError> {
+        let mut requirements = vec![];
+        for directive in self.all("requires") {
+            if directive.value.is_empty() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: 'requires' directive needs a version such as >=0.9",
+                    directive.line
+                )));
+            }
+            // `>= 0.9` is read as `>=0.9`
+            let mut op = String::new();
+            for word in directive.value.split([' ', '\t', ',']).filter(|w| !w.is_empty()) {
+                if word.chars().all(|c| "<>=".contains(c)) {
+                    op.push_str(word);
+                    continue;
+                }
+                let word = std::mem::take(&mut op) + word;
+                let requirement = VersionRequirement::parse(&word).ok_or_else(|| {
+                    SingleloadError::InvalidInput(format!(
+                        "line {}: '{}' is not a version requirement such as >=0.9",
+                        directive.line, word
+                    ))
+                })?;
+                requirements.push((directive.line, requirement));
+            }
+            if !op.is_empty() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: '{}' needs a version",
+                    directive.line, op
+                )));
+            }
+        }
+        Ok(requirements)
+    }
+
+    /// The `deprecated` directive, whose value tells what to use instead
+    pub fn deprecation(&self) -> Option<&Directive> {
+        self.first("deprecated")
+    }
+
+    /// Command-line options the script declares with `arg`
+    pub fn arg_specs(&self) -> Result<Vec<ArgSpec>, SingleloadError> {
+        let mut specs: Vec<ArgSpec> = vec![];
+        for directive in self.all("arg") {
+            let spec = ArgSpec::parse(directive.line, &directive.value)?;
+            if let Some(earlier) = specs.iter().find(|s| s.name == spec.name) {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: --{} is already declared on line {}",
+                    directive.line, spec.name, earlier.line
+                )));
+            }
+            specs.push(spec);
+        }
+        Ok(specs)
+    }
+
+    /// Entrypoints the script declares with `entry`, in order
+    pub fn entries(&self) -> Result<Vec<Entry>, SingleloadError> {
+        let mut entries: Vec<Entry> = vec![];
+        for directive in self.all("entry") {
+            let entry = Entry::parse(directive.line, &directive.value)?;
+            if let Some(earlier) = entries.iter().find(|e| e.name == entry.name) {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: entry '{}' is already declared on line {}",
+                    directive.line, entry.name, earlier.line
+                )));
+            }
+            entries.push(entry);
+        }
+        Ok(entries)
+    }
+
+    /// Rules the script's `normalize` directives apply to its stdout and
+    /// golden file in `verify`, in order
+    pub fn normalizers(&self) -> Result<Vec<Normalizer>, SingleloadError> {
+        let mut rules = vec![];
+        for directive in self.all("normalize") {
+            rules.extend(Normalizer::parse(directive.line, &directive.value)?);
+        }
+        Ok(rules)
+    }
+
+    /// Endpoints the script declares with `net allow`; one directive may
+    /// list several
+    pub fn net_rules(&self) -> Result<Vec<NetRule>, SingleloadError> {
+        let mut rules = vec![];
+        for directive in self.all("net") {
+            let mut words = directive.value.split_whitespace();
+            if words.next() != Some("allow") {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: expected 'net allow <host>:<port>'",
+                    directive.line
+                )));
+            }
+            let endpoints: Vec<&str> = words.collect();
+            if endpoints.is_empty() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: 'net allow' directive needs a host:port",
+                    directive.line
+                )));
+            }
+            for endpoint in endpoints {
+                let rule = NetRule::parse(endpoint).ok_or_else(|| {
+                    SingleloadError::InvalidInput(format!(
+                        "line {}: '{}' is not a host:port",
+                        directive.line, endpoint
+                    ))
+                })?;
+                rules.push(rule);
+            }
+        }
+        Ok(rules)
+    }
+
+    /// Compiler flags declared with `buildflags`, in declaration order. Each
+    /// directive is split into words like a shell would, so a flag with
+    /// spaces is written `"-ldflags=-s -w"`; the words are not interpreted.
+    pub fn build_flags(&self) -> Result<Vec<String>, SingleloadError> {
+        let mut flags = vec![];
+        for directive in self.all("buildflags") {
+            let words = split_words(&directive.value).ok_or_else(|| {
+                SingleloadError::InvalidInput(format!("line {}: unterminated quote in 'buildflags'", directive.line))
+            })?;
+            flags.extend(words);
+        }
+        Ok(flags)
+    }
+
+    /// GPU architectures CUDA builds target, declared with `cuda-arch`;
+    /// one directive may list several
+    pub fn cuda_archs(&self) -> Result<Vec<String>, SingleloadError> {
+        let mut archs: Vec<String> = vec![];
+        for directive in self.all("cuda-arch") {
+            if directive.value.is_empty() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: 'cuda-arch' directive needs an architecture such as sm_80",
+                    directive.line
+                )));
+            }
+            for arch in directive.value.split_whitespace() {
+                gpu::validate_arch(arch)
+                    .map_err(|e| SingleloadError::InvalidInput(format!("line {}: {}", directive.line, e)))?;
+                if !archs.iter().any(|a| a == arch) {
+                    archs.push(arch.to_string());
+                }
+            }
+        }
+        Ok(archs)
+    }
+
+    /// System libraries declared with `pkg-config`, whose compiler and
+    /// linker flags C and C++ builds take from pkg-config; one directive
+    /// may list several
+    pub fn pkg_config(&self) -> Result<Vec<String>, SingleloadError> {
+        let mut packages: Vec<String> = vec![];
+        for directive in self.all("pkg-config") {
+            if directive.value.is_empty() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: 'pkg-config' directive needs a package name",
+                    directive.line
+                )));
+            }
+            for name in directive.value.split_whitespace() {
+                if !name.chars().all(|c| c.is_ascii_alphanumeric() || "._+-".contains(c)) {
+                    return Err(SingleloadError::InvalidInput(format!(
+                        "line {}: '{}' is not a pkg-config package name",
+                        directive.line, name
+                    )));
+                }
+                if !packages.iter().any(|p| p == name) {
+                    packages.push(name.to_string());
+                }
+            }
+        }
+        Ok(packages)
+    }
+
+    /// Declared third-party dependencies
+    pub fn dependencies(&self) -> Result<Vec<Dependency>, SingleloadError> {
+        let mut deps = vec![];
+        for directive in &self.items {
+            if let Some(manager) = PackageManager::from_directive(&directive.name) {
+                let dep = Dependency::parse(manager, &directive.value).ok_or_else(|| {
+                    SingleloadError::InvalidInput(format!(
+                        "line {}: '{}' directive needs a package name",
+                        directive.line, directive.name
+                    ))
+                })?;
+                deps.push(dep);
+            }
+        }
+        Ok(deps)
+    }
+}
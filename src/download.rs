@@ -0,0 +1,373 @@
+use crate::config::{DownloadConfig, Mirror, ProxyConfig};
+use crate::errors::SingleloadError;
+use crate::limits;
+use crate::retry::RetryPolicy;
+use futures::future::try_join_all;
+use reqwest::{header, StatusCode};
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+use std::future::Future;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+use tokio::io::AsyncWriteExt;
+use tracing::{debug, warn};
+
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(15);
+
+/// Longest a download may go without receiving anything; large files are
+/// never cut off while they make progress
+const READ_TIMEOUT: Duration = Duration::from_secs(30);
+
+const MAX_REDIRECTS: usize = 10;
+
+/// Package indexes `download.registries` can point elsewhere, with the
+/// variables the package managers in containers read them from
+pub const REGISTRIES: &[(&str, &[&str])] = &[
+    ("pypi", &["PIP_INDEX_URL"]),
+    ("npm", &["npm_config_registry"]),
+    ("go", &["GOPROXY"]),
+    ("maven", &["COURSIER_REPOSITORIES"]),
+    ("rustup", &["RUSTUP_DIST_SERVER"]),
+];
+
+/// Every download Singleload makes itself goes through here: requests go
+/// through the configured proxy, try the mirrors of their URL first and are
+/// retried with backoff. Files are resumed where an earlier attempt
+/// stopped, fetched in parallel ranges when large, and checked against
+/// their checksum before they are moved into place.
+#[derive(Clone)]
+pub struct DownloadManager {
+    client: reqwest::Client,
+    retry: RetryPolicy,
+    chunks: usize,
+    parallel_above: u64,
+    mirrors: Vec<Mirror>,
+}
+
+/// A failed attempt, and whether trying again could help
+struct Failure {
+    error: SingleloadError,
+    retry: bool,
+}
+
+impl Failure {
+    fn transient(url: &str, e: impl std::fmt::Display) -> Self {
+        Self {
+            error: SingleloadError::InvalidInput(format!("Failed to download {}: {}", url, e)),
+            retry: true,
+        }
+    }
+
+    fn permanent(error: SingleloadError) -> Self {
+        Self { error, retry: false }
+    }
+}
+
+impl From<std::io::Error> for Failure {
+    fn from(e: std::io::Error) -> Self {
+        Self::permanent(e.into())
+    }
+}
+
+impl DownloadManager {
+    pub fn new(config: &DownloadConfig, proxy: &ProxyConfig) -> Result<Self, SingleloadError> {
+        let client_error = |e: reqwest::Error| SingleloadError::Container(format!("Failed to create HTTP client: {}", e));
+        let mut builder = reqwest::Client::builder()
+            .user_agent(concat!("singleload/", env!("CARGO_PKG_VERSION")))
+            .connect_timeout(CONNECT_TIMEOUT)
+            .read_timeout(READ_TIMEOUT)
+            .redirect(no_downgrade());
+        let no_proxy = || proxy.no_proxy.as_deref().and_then(reqwest::NoProxy::from_string);
+        if let Some(https) = &proxy.https {
+            builder = builder.proxy(reqwest::Proxy::https(https).map_err(client_error)?.no_proxy(no_proxy()));
+        }
+        if let Some(http) = &proxy.http {
+            builder = builder.proxy(reqwest::Proxy::http(http).map_err(client_error)?.no_proxy(no_proxy()));
+        }
+        let backoff = limits::parse_duration(&config.backoff)
+            .map_err(|e| SingleloadError::InvalidInput(format!("download.backoff: {}", e)))?;
+        let parallel_above = limits::parse_memory(&config.parallel_above)
+            .map_err(|e| SingleloadError::InvalidInput(format!("download.parallel_above: {}", e)))?;
+        Ok(Self {
+            client: builder.build().map_err(client_error)?,
+            retry: RetryPolicy::new(config.retries, backoff, vec![]),
+            chunks: config.chunks.max(1),
+            parallel_above: parallel_above * 1024 * 1024,
+            mirrors: config.mirrors.clone(),
+        })
+    }
+
+    /// Where `url` is tried, in order: its mirrors, then the URL itself
+    pub fn candidates(&self, url: &str) -> Vec<String> {
+        let mut urls: Vec<String> = self
+            .mirrors
+            .iter()
+            .filter_map(|mirror| url.strip_prefix(mirror.prefix.as_str()).map(|rest| format!("{}{}", mirror.url, rest)))
+            .collect();
+        urls.push(url.to_string());
+        urls
+    }
+
+    /// Fetches `url` over https into memory, refusing more than `limit` bytes
+    pub async fn fetch(&self, url: &str, limit: u64) -> Result<Vec<u8>, SingleloadError> {
+        self.attempt(url, |candidate| async move {
+            let mut response = self.get(&candidate, None).await?;
+            let mut data = Vec::new();
+            while let Some(chunk) = response.chunk().await.map_err(|e| Failure::transient(&candidate, e))? {
+                data.extend_from_slice(&chunk);
+                if data.len() as u64 > limit {
+                    return Err(Failure::permanent(SingleloadError::SecurityViolation(format!(
+                        "{} is larger than {} bytes",
+                        url, limit
+                    ))));
+                }
+            }
+            Ok(data)
+        })
+        .await
+    }
+
+    /// Fetches `url` like [`Self::fetch`] but only from its origin, never a
+    /// mirror: for checksum files and release indexes, which say what a
+    /// mirrored file has to be
+    pub async fn fetch_origin(&self, url: &str, limit: u64) -> Result<Vec<u8>, SingleloadError> {
+        let origin = Self {
+            mirrors: Vec::new(),
+            ..self.clone()
+        };
+        origin.fetch(url, limit).await
+    }
+
+    /// Downloads `url` over https to `dest` and returns its size. Bytes an
+    /// interrupted download left in `<dest>.part` are not fetched again;
+    /// with `sha256` the file only replaces `dest` if its checksum matches.
+    pub async fn download(&self, url: &str, dest: &Path, sha256: Option<&str>) -> Result<u64, SingleloadError> {
+        let part = sibling(dest, "part");
+        let expected = sha256.map(|s| s.trim().to_lowercase());
+        self.attempt(url, |candidate| {
+            let (part, expected) = (&part, &expected);
+            async move {
+                let ranged = match part.exists() {
+                    true => None,
+                    false => self.ranged_length(&candidate).await,
+                };
+                match ranged {
+                    Some(len) => self.fetch_chunks(&candidate, dest, part, len).await?,
+                    None => self.fetch_resumed(&candidate, part).await?,
+                }
+
+                let actual = sha256_file(part)?;
+                if let Some(expected) = expected {
+                    if actual != *expected {
+                        // Whatever it was, resuming it will not help
+                        std::fs::remove_file(part)?;
+                        return Err(Failure::permanent(SingleloadError::SecurityViolation(format!(
+                            "Checksum mismatch for {}: expected {}, got {}",
+                            candidate, expected, actual
+                        ))));
+                    }
+                }
+                std::fs::rename(part, dest)?;
+                debug!("Downloaded {} (sha256 {})", candidate, actual);
+                Ok(std::fs::metadata(dest)?.len())
+            }
+        })
+        .await
+    }
+
+    /// Runs `op` on every candidate of `url` until one succeeds, then again
+    /// after a backoff while the failures may be temporary
+    async fn attempt<T, F, Fut>(&self, url: &str, mut op: F) -> Result<T, SingleloadError>
+    where
+        F: FnMut(String) -> Fut,
+        Fut: Future<Output = Result<T, Failure>>,
+    {
+        if !url.starts_with("https://") {
+            return Err(SingleloadError::SecurityViolation(format!("{} is not an https URL", url)));
+        }
+        let candidates = self.candidates(url);
+        let mut attempt = 1;
+        loop {
+            let mut retry = false;
+            let mut last = None;
+            for candidate in &candidates {
+                match op(candidate.clone()).await {
+                    Ok(value) => return Ok(value),
+                    Err(failure) => {
+                        debug!("Failed to download {}: {}", candidate, failure.error);
+                        retry |= failure.retry;
+                        last = Some(failure.error);
+                    }
+                }
+            }
+            let error = last.expect("the URL itself is always a candidate");
+            if !retry || attempt > self.retry.retries {
+                return Err(error);
+            }
+            let delay = self.retry.delay(attempt);
+            warn!("{}, trying again in {:?}", error, delay);
+            tokio::time::sleep(delay).await;
+            attempt += 1;
+        }
+    }
+
+    async fn get(&self, url: &str, range: Option<String>) -> Result<reqwest::Response, Failure> {
+        let mut request = self.client.get(url);
+        if let Some(range) = range {
+            request = request.header(header::RANGE, range);
+        }
+        let response = request.send().await.map_err(|e| Failure::transient(url, e))?;
+        let status = response.status();
+        if status.is_success() || status == StatusCode::RANGE_NOT_SATISFIABLE {
+            return Ok(response);
+        }
+        let retry = status.is_server_error() || matches!(status, StatusCode::REQUEST_TIMEOUT | StatusCode::TOO_MANY_REQUESTS);
+        Err(Failure {
+            error: SingleloadError::InvalidInput(format!("Failed to download {}: {}", url, status)),
+            retry,
+        })
+    }
+
+    /// The size of `url` when it is worth fetching in parallel ranges and
+    /// the server serves them
+    async fn ranged_length(&self, url: &str) -> Option<u64> {
+        if self.chunks < 2 {
+            return None;
+        }
+        let response = self.client.head(url).send().await.ok()?.error_for_status().ok()?;
+        let ranges = response.headers().get(header::ACCEPT_RANGES)?.to_str().ok()?;
+        let len: u64 = response.headers().get(header::CONTENT_LENGTH)?.to_str().ok()?.parse().ok()?;
+        (ranges.trim() == "bytes" && len > self.parallel_above && len >= self.chunks as u64).then_some(len)
+    }
+
+    /// Fetches the `len` bytes of `url` as ranges into files next to
+    /// `dest`, each resumed on its own, then joins them into `part`
+    async fn fetch_chunks(&self, url: &str, dest: &Path, part: &Path, len: u64) -> Result<(), Failure> {
+        let ranges = chunk_ranges(len, self.chunks);
+        let paths: Vec<PathBuf> = ranges
+            .iter()
+            .map(|(start, end)| sibling(dest, &format!("part.{}-{}", start, end)))
+            .collect();
+        try_join_all(
+            ranges
+                .iter()
+                .zip(&paths)
+                .map(|(&(start, end), path)| self.fetch_range(url, path, start, end)),
+        )
+        .await?;
+
+        let joined = sibling(dest, "part.joined");
+        let mut out = std::fs::File::create(&joined)?;
+        for path in &paths {
+            std::io::copy(&mut std::fs::File::open(path)?, &mut out)?;
+        }
+        out.sync_all()?;
+        std::fs::rename(&joined, part)?;
+        for path in &paths {
+            let _ = std::fs::remove_file(path);
+        }
+        Ok(())
+    }
+
+    /// Fetches bytes `start..=end` of `url` into `path`, after what it holds
+    async fn fetch_range(&self, url: &str, path: &Path, start: u64, end: u64) -> Result<(), Failure> {
+        let want = end - start + 1;
+        let have = std::fs::metadata(path).map(|m| m.len()).unwrap_or(0);
+        if have == want {
+            return Ok(());
+        }
+        let have = if have > want { 0 } else { have };
+        let mut response = self.get(url, Some(format!("bytes={}-{}", start + have, end))).await?;
+        if response.status() != StatusCode::PARTIAL_CONTENT {
+            return Err(Failure::transient(url, "the server ignored the range request"));
+        }
+        let mut file = open(path, have > 0).await?;
+        while let Some(chunk) = response.chunk().await.map_err(|e| Failure::transient(url, e))? {
+            file.write_all(&chunk).await?;
+        }
+        file.flush().await?;
+        let got = std::fs::metadata(path)?.len();
+        if got != want {
+            return Err(Failure::transient(url, format!("got {} of bytes {}-{}", got, start, end)));
+        }
+        Ok(())
+    }
+
+    /// Fetches the rest of `url` into `part`, from the start when the
+    /// server does not serve ranges
+    async fn fetch_resumed(&self, url: &str, part: &Path) -> Result<(), Failure> {
+        let have = std::fs::metadata(part).map(|m| m.len()).unwrap_or(0);
+        let range = (have > 0).then(|| format!("bytes={}-", have));
+        let mut response = self.get(url, range).await?;
+        let append = match response.status() {
+            // Already complete
+            StatusCode::RANGE_NOT_SATISFIABLE if have > 0 => return Ok(()),
+            StatusCode::RANGE_NOT_SATISFIABLE => return Err(Failure::transient(url, StatusCode::RANGE_NOT_SATISFIABLE)),
+            StatusCode::PARTIAL_CONTENT => {
+                debug!("Resuming {} at byte {}", url, have);
+                true
+            }
+            _ => false,
+        };
+        let mut file = open(part, append).await?;
+        while let Some(chunk) = response.chunk().await.map_err(|e| Failure::transient(url, e))? {
+            file.write_all(&chunk).await?;
+        }
+        file.flush().await?;
+        Ok(())
+    }
+}
+
+/// Refuses redirects from https to plain http
+fn no_downgrade() -> reqwest::redirect::Policy {
+    reqwest::redirect::Policy::custom(|attempt| {
+        let downgrade = attempt.url().scheme() == "http" && attempt.previous().iter().any(|url| url.scheme() == "https");
+        if downgrade {
+            let refused = format!("refusing the redirect to {}", attempt.url());
+            attempt.error(refused)
+        } else if attempt.previous().len() >= MAX_REDIRECTS {
+            attempt.error("too many redirects")
+        } else {
+            attempt.follow()
+        }
+    })
+}
+
+/// Splits `len` bytes into `chunks` inclusive ranges of about the same size
+fn chunk_ranges(len: u64, chunks: usize) -> Vec<(u64, u64)> {
+    let size = len.div_ceil(chunks as u64).max(1);
+    (0..len).step_by(size as usize).map(|start| (start, (start + size).min(len) - 1)).collect()
+}
+
+async fn open(path: &Path, append: bool) -> std::io::Result<tokio::fs::File> {
+    let mut options = tokio::fs::OpenOptions::new();
+    match append {
+        true => options.create(true).append(true),
+        false => options.create(true).write(true).truncate(true),
+    };
+    options.open(path).await
+}
+
+/// `dest` with `.suffix` added to its file name
+fn sibling(dest: &Path, suffix: &str) -> PathBuf {
+    let mut name = dest.file_name().unwrap_or_default().to_os_string();
+    name.push(format!(".{}", suffix));
+    dest.with_file_name(name)
+}
+
+fn sha256_file(path: &Path) -> std::io::Result<String> {
+    let mut hasher = Sha256::new();
+    std::io::copy(&mut std::fs::File::open(path)?, &mut hasher)?;
+    Ok(hex::encode(hasher.finalize()))
+}
+
+/// Variables pointing the package managers in containers at `registries`
+pub fn registry_env(registries: &HashMap<String, String>) -> Vec<(String, String)> {
+    let mut env = Vec::new();
+    for (registry, variables) in REGISTRIES {
+        if let Some(url) = registries.get(*registry) {
+            env.extend(variables.iter().map(|variable| (variable.to_string(), url.clone())));
+        }
+    }
+    env
+}
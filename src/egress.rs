@@ -0,0 +1,292 @@
+use crate::directives::{split_host_port, NetRule};
+use crate::events::{Event, EventSink};
+use std::io;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tempfile::TempDir;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream};
+#[cfg(unix)]
+use tokio::net::{UnixListener, UnixStream};
+use tokio::task::JoinHandle;
+use tracing::{debug, warn};
+
+/// Port the relay listens on inside a confined container, on the loopback
+/// interface of its otherwise empty network namespace
+pub const RELAY_PORT: u16 = 3128;
+
+/// Name of the proxy's socket in its directory
+const SOCKET_NAME: &str = "proxy.sock";
+
+/// How long the relay may take to start listening in a container
+const RELAY_START_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Largest request head accepted from a client
+const MAX_HEAD_BYTES: usize = 16 * 1024;
+
+/// HTTP proxy that only lets a script reach the endpoints its `net allow`
+/// rules name. Each decision is logged and emitted as an [`Event::Network`].
+/// Stops when dropped.
+///
+/// The proxy listens on a unix socket in a directory only the user can
+/// open. Confined containers have no network of their own: a relay started
+/// in their network namespace with [`EgressProxy::relay_into`] passes
+/// connections to their loopback port on to the socket, so the proxy is the
+/// only way out of them.
+pub struct EgressProxy {
+    dir: TempDir,
+    task: JoinHandle<()>,
+}
+
+impl EgressProxy {
+    #[cfg(not(unix))]
+    pub async fn start(_rules: Vec<NetRule>, _events: EventSink) -> io::Result<Self> {
+        Err(io::Error::new(io::ErrorKind::Unsupported, "the egress proxy needs unix sockets"))
+    }
+
+    #[cfg(unix)]
+    pub async fn start(rules: Vec<NetRule>, events: EventSink) -> io::Result<Self> {
+        let dir = TempDir::new()?;
+        let listener = UnixListener::bind(dir.path().join(SOCKET_NAME))?;
+        let rules = Arc::new(rules);
+
+        let task = tokio::spawn(async move {
+            loop {
+                let (client, _) = match listener.accept().await {
+                    Ok(conn) => conn,
+                    Err(e) => {
+                        warn!("Egress proxy stopped accepting connections: {}", e);
+                        return;
+                    }
+                };
+                let rules = rules.clone();
+                let events = events.clone();
+                tokio::spawn(async move {
+                    if let Err(e) = handle_connection(client, &rules, &events).await {
+                        debug!("Egress proxy connection failed: {}", e);
+                    }
+                });
+            }
+        });
+
+        Ok(Self { dir, task })
+    }
+
+    /// The socket the proxy listens on
+    pub fn socket(&self) -> PathBuf {
+        self.dir.path().join(SOCKET_NAME)
+    }
+
+    /// Proxy variables pointing a container at the relay, in both spellings
+    /// tools look for. Programs that ignore them reach nothing.
+    pub fn env(&self) -> Vec<(String, String)> {
+        let url = format!("http://127.0.0.1:{}", RELAY_PORT);
+        let mut env = Vec::new();
+        for (name, value) in [("HTTP_PROXY", url.as_str()), ("HTTPS_PROXY", url.as_str()), ("NO_PROXY", "")] {
+            env.push((name.to_string(), value.to_string()));
+            env.push((name.to_lowercase(), value.to_string()));
+        }
+        env
+    }
+}
+
+impl Drop for EgressProxy {
+    fn drop(&mut self) {
+        self.task.abort();
+    }
+}
+
+/// A relay started in a container's network namespace; killed when dropped
+pub struct Relay {
+    _child: tokio::process::Child,
+}
+
+impl EgressProxy {
+    #[cfg(not(target_os = "linux"))]
+    pub async fn relay_into(&self, _pid: u32) -> io::Result<Relay> {
+        Err(io::Error::new(io::ErrorKind::Unsupported, "the egress relay joins Linux namespaces"))
+    }
+
+    /// Starts a relay in the network namespace of a container's process
+    /// `pid`, joining its user namespace too when it has one of its own.
+    /// The container is meant to be initialized but not started, so the
+    /// relay listens before the script runs.
+    #[cfg(target_os = "linux")]
+    pub async fn relay_into(&self, pid: u32) -> io::Result<Relay> {
+        use nix::sched::{setns, CloneFlags};
+        use std::os::unix::fs::MetadataExt;
+        use tokio::io::AsyncBufReadExt;
+
+        let user = std::fs::File::open(format!("/proc/{}/ns/user", pid))?;
+        let net = std::fs::File::open(format!("/proc/{}/ns/net", pid))?;
+        // Rootful containers share our user namespace, which cannot be joined
+        let join_user = user.metadata()?.ino() != std::fs::metadata("/proc/self/ns/user")?.ino();
+
+        let mut command = tokio::process::Command::new(std::env::current_exe()?);
+        command
+            .arg("__egress-relay")
+            .arg(self.socket())
+            .arg(RELAY_PORT.to_string())
+            .stdin(std::process::Stdio::null())
+            .stdout(std::process::Stdio::piped())
+            .kill_on_drop(true);
+        // SAFETY: setns is async-signal-safe and only touches the child
+        unsafe {
+            command.pre_exec(move || {
+                if join_user {
+                    setns(&user, CloneFlags::CLONE_NEWUSER)?;
+                }
+                setns(&net, CloneFlags::CLONE_NEWNET)?;
+                Ok(())
+            });
+        }
+        let mut child = command.spawn()?;
+
+        let stdout = child.stdout.take().expect("relay stdout is piped");
+        let mut line = String::new();
+        let ready = tokio::time::timeout(RELAY_START_TIMEOUT, tokio::io::BufReader::new(stdout).read_line(&mut line)).await;
+        match ready {
+            Ok(Ok(_)) if line.trim() == "ready" => Ok(Relay { _child: child }),
+            _ => Err(io::Error::other("the egress relay did not start in the container")),
+        }
+    }
+}
+
+/// Listens on `port` of the loopback interface and passes every connection
+/// on to the proxy's `socket`, printing `ready` once listening. Run as
+/// `singleload __egress-relay` in a confined container's network namespace.
+#[cfg(unix)]
+pub async fn relay(socket: &Path, port: u16) -> io::Result<()> {
+    let listener = TcpListener::bind(("127.0.0.1", port)).await?;
+    println!("ready");
+    loop {
+        let (mut client, _) = listener.accept().await?;
+        let socket = socket.to_path_buf();
+        tokio::spawn(async move {
+            match UnixStream::connect(&socket).await {
+                Ok(mut proxy) => {
+                    let _ = tokio::io::copy_bidirectional(&mut client, &mut proxy).await;
+                }
+                Err(e) => debug!("Egress relay could not reach the proxy: {}", e),
+            }
+        });
+    }
+}
+
+/// What a client asked the proxy for
+#[derive(Debug, PartialEq)]
+pub struct ProxyRequest {
+    pub host: String,
+    pub port: u16,
+    /// None for `CONNECT`; otherwise the request head to send upstream,
+    /// rewritten to origin form
+    pub forward: Option<Vec<u8>>,
+}
+
+impl ProxyRequest {
+    /// Parses a request head: `CONNECT host:port` or a plain HTTP request
+    /// for an absolute `http://` URL
+    pub fn parse(head: &str) -> Option<Self> {
+        let mut lines = head.split("\r\n");
+        let mut request_line = lines.next()?.split(' ');
+        let (method, target, version) = (request_line.next()?, request_line.next()?, request_line.next()?);
+
+        if method.eq_ignore_ascii_case("CONNECT") {
+            let (host, port) = split_host_port(target)?;
+            return Some(Self {
+                host: host.to_string(),
+                port,
+                forward: None,
+            });
+        }
+
+        let rest = target.strip_prefix("http://")?;
+        let (authority, path) = match rest.find('/') {
+            Some(idx) => rest.split_at(idx),
+            None => (rest, "/"),
+        };
+        let (host, port) = split_host_port(authority).unwrap_or((authority.trim_matches(['[', ']']), 80));
+
+        // Every request on the upstream connection goes to the same host,
+        // but it is closed after one response to keep clients from reusing it
+        let mut forward = format!("{} {} {}\r\n", method, path, version);
+        for line in lines.filter(|line| !line.is_empty()) {
+            let name = line.split(':').next().unwrap_or("").trim().to_ascii_lowercase();
+            if !matches!(name.as_str(), "connection" | "keep-alive" | "proxy-connection" | "proxy-authorization") {
+                forward.push_str(line);
+                forward.push_str("\r\n");
+            }
+        }
+        forward.push_str("Connection: close\r\n\r\n");
+
+        Some(Self {
+            host: host.to_string(),
+            port,
+            forward: Some(forward.into_bytes()),
+        })
+    }
+}
+
+async fn handle_connection<S: AsyncRead + AsyncWrite + Unpin>(mut client: S, rules: &[NetRule], events: &EventSink) -> io::Result<()> {
+    let (head, rest) = read_head(&mut client).await?;
+    let Some(request) = ProxyRequest::parse(&String::from_utf8_lossy(&head)) else {
+        return respond(&mut client, "400 Bad Request").await;
+    };
+
+    let allowed = rules.iter().any(|rule| rule.matches(&request.host, request.port));
+    events.emit(Event::Network {
+        host: request.host.clone(),
+        port: request.port,
+        allowed,
+    });
+    if !allowed {
+        warn!(
+            "Blocked connection to {}:{}, which no 'net allow' directive permits",
+            request.host, request.port
+        );
+        return respond(&mut client, "403 Forbidden").await;
+    }
+    debug!("Allowed connection to {}:{}", request.host, request.port);
+
+    let mut upstream = match TcpStream::connect((request.host.as_str(), request.port)).await {
+        Ok(upstream) => upstream,
+        Err(e) => {
+            debug!("Connection to {}:{} failed: {}", request.host, request.port, e);
+            return respond(&mut client, "502 Bad Gateway").await;
+        }
+    };
+    match &request.forward {
+        Some(head) => upstream.write_all(head).await?,
+        None => client.write_all(b"HTTP/1.1 200 Connection Established\r\n\r\n").await?,
+    }
+    upstream.write_all(&rest).await?;
+    tokio::io::copy_bidirectional(&mut client, &mut upstream).await?;
+    Ok(())
+}
+
+/// Reads up to the end of the request head, returning the head and any
+/// bytes the client already sent after it
+async fn read_head<S: AsyncRead + Unpin>(client: &mut S) -> io::Result<(Vec<u8>, Vec<u8>)> {
+    let mut buf = Vec::new();
+    let mut chunk = [0u8; 4096];
+    loop {
+        if let Some(end) = buf.windows(4).position(|w| w == b"\r\n\r\n") {
+            let rest = buf.split_off(end + 4);
+            return Ok((buf, rest));
+        }
+        if buf.len() > MAX_HEAD_BYTES {
+            return Err(io::Error::new(io::ErrorKind::InvalidData, "request head too large"));
+        }
+        let n = client.read(&mut chunk).await?;
+        if n == 0 {
+            return Err(io::ErrorKind::UnexpectedEof.into());
+        }
+        buf.extend_from_slice(&chunk[..n]);
+    }
+}
+
+async fn respond<S: AsyncWrite + Unpin>(client: &mut S, status: &str) -> io::Result<()> {
+    let response = format!("HTTP/1.1 {}\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status);
+    client.write_all(response.as_bytes()).await
+}
@@ -0,0 +1,129 @@
+use crate::errors::SingleloadError;
+use regex::Regex;
+use std::path::{Path, PathBuf};
+
+/// Languages `run file:entry` can dispatch to a function of
+pub const ENTRY_LANGUAGES: &[&str] = &["bash", "c", "cpp", "go", "javascript", "php", "python", "rust"];
+
+/// A named entrypoint declared with
+/// `singleload: entry backup func=RunBackup`; without `func=` the function
+/// has the entry's name
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Entry {
+    /// 1-based line of the directive
+    pub line: usize,
+    pub name: String,
+    pub func: String,
+}
+
+impl Entry {
+    pub fn parse(line: usize, value: &str) -> Result<Self, SingleloadError> {
+        let invalid = |reason: String| SingleloadError::InvalidInput(format!("line {}: {}", line, reason));
+        let mut words = value.split_whitespace();
+        let name = words
+            .next()
+            .ok_or_else(|| invalid("'entry' directive needs a name, e.g. entry backup func=RunBackup".to_string()))?;
+        if !is_name(name) {
+            return Err(invalid(format!(
+                "'{}' is not an entry name; use letters, digits, - and _",
+                name
+            )));
+        }
+        let mut func = name.to_string();
+        for word in words {
+            match word.strip_prefix("func=") {
+                Some(value) => func = value.to_string(),
+                None => return Err(invalid(format!("unknown entry option '{}'; expected func=<function>", word))),
+            }
+        }
+        if !is_identifier(&func) {
+            return Err(invalid(format!("'{}' is not a function name", func)));
+        }
+        Ok(Self {
+            line,
+            name: name.to_string(),
+            func,
+        })
+    }
+}
+
+/// Splits `tool.go:backup` into the script and the entry, if `path` is not a
+/// file itself and the part before the colon is
+pub fn split_target(path: &Path) -> Option<(PathBuf, String)> {
+    if path.exists() {
+        return None;
+    }
+    let text = path.to_str()?;
+    let (script, name) = text.rsplit_once(':')?;
+    let script = PathBuf::from(script);
+    (is_name(name) && script.is_file()).then(|| (script, name.to_string()))
+}
+
+/// Rewrites a script so it starts in `func` instead of its usual entrypoint.
+/// The script's own `main` (or `__main__` block) is kept but not called,
+/// and a shim calling `func` is appended, leaving line numbers alone.
+/// What the function returns becomes the exit status where the language
+/// has a way to say so.
+pub fn dispatch(language: &str, content: &[u8], func: &str) -> Result<Vec<u8>, SingleloadError> {
+    let source = String::from_utf8_lossy(content);
+    let replace = |pattern: &str, with: &str| {
+        Regex::new(pattern).expect("valid pattern").replace_all(&source, with).into_owned()
+    };
+    let dispatched = match language {
+        "go" => format!(
+            "{}\nfunc main() {{ {}() }}\n",
+            replace(r"(?m)^func\s+main\s*\(\s*\)", "func singleloadMain()"),
+            func
+        ),
+        "rust" => format!(
+            "{}\nfn main() -> impl std::process::Termination {{\n    {}()\n}}\n",
+            replace(r"(?m)^(\s*)(?:pub\s+)?fn\s+main\s*\(\s*\)", "${1}#[allow(dead_code)] fn singleload_main()"),
+            func
+        ),
+        "c" | "cpp" => format!(
+            "{}\nint main(void) {{ return {}(); }}\n",
+            replace(r"(?m)^(\s*)(int|void)\s+main\s*\(", "${1}${2} singleload_main("),
+            func
+        ),
+        "python" => format!(
+            "{}\n\nif __name__ == \"__main__\":\n    \
+             import asyncio as _sl_asyncio, inspect as _sl_inspect, sys as _sl_sys\n    \
+             _sl_result = {}()\n    \
+             if _sl_inspect.iscoroutine(_sl_result):\n        \
+             _sl_result = _sl_asyncio.run(_sl_result)\n    \
+             _sl_sys.exit(_sl_result)\n",
+            replace(r#"__name__\s*==\s*(?:"__main__"|'__main__')"#, "False"),
+            func
+        ),
+        "javascript" => format!(
+            "{}\n;Promise.resolve().then(() => {}()).then(\n  (code) => {{ if (typeof code === \"number\") process.exitCode = code; }},\n  \
+             (err) => {{ console.error(err); process.exitCode = 1; }},\n);\n",
+            replace(r"require\.main\s*===?\s*module", "false"),
+            func
+        ),
+        "php" => {
+            // A file ending outside PHP mode needs the tag again
+            let open = if source.trim_end().ends_with("?>") { "<?php " } else { "" };
+            format!("{}\n{}exit({}() ?? 0);\n", source, open, func)
+        }
+        "bash" => format!("{}\n{} \"$@\"\n", source, func),
+        other => {
+            return Err(SingleloadError::InvalidInput(format!(
+                "entries are supported for {} scripts, not {}",
+                ENTRY_LANGUAGES.join(", "),
+                other
+            )))
+        }
+    };
+    Ok(dispatched.into_bytes())
+}
+
+fn is_name(name: &str) -> bool {
+    name.chars().next().is_some_and(|c| c.is_ascii_alphanumeric())
+        && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_')
+}
+
+fn is_identifier(name: &str) -> bool {
+    name.chars().next().is_some_and(|c| c.is_ascii_alphabetic() || c == '_')
+        && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '_')
+}
@@ -0,0 +1,86 @@
+use crate::errors::SingleloadError;
+use std::path::Path;
+
+/// Variables the sandbox sets itself; scripts cannot override them
+const RESERVED_VARS: &[&str] = &["PATH", "HOME", "USER", "LD_PRELOAD", "LD_LIBRARY_PATH"];
+
+/// Parses the variables of a dotenv file: `KEY=VALUE` lines, optionally
+/// prefixed with `export`, with single- or double-quoted values. Blank
+/// lines and `#` comments are ignored.
+pub fn parse_env_file(path: &Path) -> Result<Vec<(String, String)>, SingleloadError> {
+    let text = std::fs::read_to_string(path)?;
+    let mut vars = Vec::new();
+    for (idx, line) in text.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let line = line.strip_prefix("export ").unwrap_or(line);
+        let (key, value) = line.split_once('=').ok_or_else(|| {
+            SingleloadError::InvalidInput(format!("{}:{}: expected KEY=VALUE", path.display(), idx + 1))
+        })?;
+        let key = key.trim();
+        validate_name(key).map_err(|e| {
+            SingleloadError::InvalidInput(format!("{}:{}: {}", path.display(), idx + 1, e))
+        })?;
+        vars.push((key.to_string(), unquote(value.trim()).to_string()));
+    }
+    Ok(vars)
+}
+
+/// Parses `--env KEY=VALUE`; a bare `KEY` is taken from the host environment
+pub fn parse_assignment(arg: &str) -> Result<(String, String), SingleloadError> {
+    let (key, value) = match arg.split_once('=') {
+        Some((key, value)) => (key, value.to_string()),
+        None => {
+            let value = std::env::var(arg).map_err(|_| {
+                SingleloadError::InvalidInput(format!("--env {}: not set in this environment", arg))
+            })?;
+            (arg, value)
+        }
+    };
+    validate_name(key)?;
+    Ok((key.to_string(), value))
+}
+
+/// Collects the variables passed to a run: env files first, then `--env`
+/// flags, later definitions overriding earlier ones
+pub fn collect(env_files: &[impl AsRef<Path>], assignments: &[String]) -> Result<Vec<(String, String)>, SingleloadError> {
+    let mut vars: Vec<(String, String)> = Vec::new();
+    let mut set = |key: String, value: String| match vars.iter_mut().find(|(k, _)| *k == key) {
+        Some(existing) => existing.1 = value,
+        None => vars.push((key, value)),
+    };
+    for file in env_files {
+        for (key, value) in parse_env_file(file.as_ref())? {
+            set(key, value);
+        }
+    }
+    for arg in assignments {
+        let (key, value) = parse_assignment(arg)?;
+        set(key, value);
+    }
+    Ok(vars)
+}
+
+fn validate_name(key: &str) -> Result<(), SingleloadError> {
+    let mut chars = key.chars();
+    let valid = chars.next().map_or(false, |c| c.is_ascii_alphabetic() || c == '_')
+        && chars.all(|c| c.is_ascii_alphanumeric() || c == '_');
+    if !valid {
+        return Err(SingleloadError::InvalidInput(format!("Invalid variable name '{}'", key)));
+    }
+    if RESERVED_VARS.contains(&key) {
+        return Err(SingleloadError::SecurityViolation(format!("{} cannot be set for scripts", key)));
+    }
+    Ok(())
+}
+
+fn unquote(value: &str) -> &str {
+    for quote in ['"', '\''] {
+        if value.len() >= 2 && value.starts_with(quote) && value.ends_with(quote) {
+            return &value[1..value.len() - 1];
+        }
+    }
+    value
+}
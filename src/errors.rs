@@ -8,6 +8,9 @@ pub enum SingleloadError {
     #[error("Execution timeout exceeded")]
     Timeout,
 
+    #[error("Execution cancelled")]
+    Cancelled,
+
     #[error("Output size limit exceeded")]
     OutputLimitExceeded,
 
@@ -41,6 +44,15 @@ pub enum SingleloadError {
     #[error("Container escape attempt detected")]
     ContainerEscape,
 
+    #[error("Service manager error: {0}")]
+    ServiceManager(String),
+
+    #[error("Build is not reproducible: {0}")]
+    NotReproducible(String),
+
+    #[error("Remote host error: {0}")]
+    Remote(String),
+
     #[error("Other error: {0}")]
     Other(#[from] anyhow::Error),
 }
\ No newline at end of file
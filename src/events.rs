@@ -0,0 +1,228 @@
+use serde::Serialize;
+use std::io::Write;
+use std::path::Path;
+use std::sync::Arc;
+
+/// Progress of a run or build, for tools driving Singleload
+#[derive(Debug, Clone, Serialize)]
+#[serde(tag = "event", rename_all = "snake_case")]
+pub enum Event {
+    Started { language: String, script: String },
+    ToolchainInstall { language: String, version: String },
+    DependencyInstall { count: usize },
+    BuildStarted { language: String },
+    BuildCached { language: String },
+    /// A build that runs as the first step of the run container completed
+    BuildFinished { language: String },
+    ContainerCreated { id: String },
+    /// A connection the script asked the egress proxy for, under `net allow` rules
+    Network { host: String, port: u16, allowed: bool },
+    Diagnostic(Diagnostic),
+    Finished { exit_code: i32, duration_ms: u64 },
+    /// Attempt `attempt` of a `run --retries` failed on `condition` and is
+    /// run again after `delay_ms`
+    Retry {
+        attempt: u32,
+        retries: u32,
+        exit_code: i32,
+        condition: String,
+        delay_ms: u64,
+    },
+}
+
+/// A compiler or interpreter message pointing into the script
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Diagnostic {
+    pub file: String,
+    pub line: u32,
+    pub column: Option<u32>,
+    pub message: String,
+}
+
+pub type EventHandler = Arc<dyn Fn(&Event) + Send + Sync>;
+
+/// Receives [`Event`]s; the default sink drops them
+#[derive(Clone, Default)]
+pub struct EventSink {
+    handler: Option<EventHandler>,
+}
+
+impl std::fmt::Debug for EventSink {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("EventSink")
+            .field("enabled", &self.handler.is_some())
+            .finish()
+    }
+}
+
+impl EventSink {
+    pub fn new(handler: impl Fn(&Event) + Send + Sync + 'static) -> Self {
+        Self {
+            handler: Some(Arc::new(handler)),
+        }
+    }
+
+    /// Writes every event as a JSON line to stderr, keeping stdout for the result
+    pub fn json_lines() -> Self {
+        Self::new(|event| {
+            if let Ok(line) = serde_json::to_string(event) {
+                let _ = writeln!(std::io::stderr().lock(), "{}", line);
+            }
+        })
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        self.handler.is_some()
+    }
+
+    pub fn emit(&self, event: Event) {
+        if let Some(handler) = &self.handler {
+            handler(&event);
+        }
+    }
+}
+
+/// Extracts diagnostics that refer to `container_path` and reports them
+/// against `source`: `file:line[:column]: message` lines as printed by Go
+/// and most compilers, MSBuild's `file(line,column): message`, rustc's
+/// `--> file:line:column` locations, PHP's `message in file on line N` and
+/// Bash's `file: line N: message`. Python's `File "file", line N` and
+/// node's bare `file:line` take their message from the `SomeError: ...`
+/// line that follows.
+pub fn parse_diagnostics(stderr: &str, container_path: &str, source: &Path) -> Vec<Diagnostic> {
+    let file_name = Path::new(container_path)
+        .file_name()
+        .and_then(|n| n.to_str())
+        .unwrap_or(container_path);
+    let source = source.display().to_string();
+
+    let mut diagnostics = Vec::new();
+    let mut previous = "";
+    let mut pending = None;
+    for line in stderr.lines() {
+        let trimmed = line.trim_start();
+        if let Some((file, line_no)) = split_python_location(trimmed) {
+            if refers_to(file, container_path, file_name) {
+                pending = Some((line_no, None));
+            }
+        } else if let Some((file, line_no, message)) =
+            split_php_location(trimmed).or_else(|| split_bash_location(trimmed))
+        {
+            if refers_to(file, container_path, file_name) && !message.is_empty() {
+                diagnostics.push(Diagnostic {
+                    file: source.clone(),
+                    line: line_no,
+                    column: None,
+                    message,
+                });
+            }
+        } else if let Some(location) = trimmed.strip_prefix("--> ") {
+            // rustc prints the message on the line before the location
+            if let Some((file, line_no, column, _)) = split_location(location) {
+                if refers_to(file, container_path, file_name) {
+                    diagnostics.push(Diagnostic {
+                        file: source.clone(),
+                        line: line_no,
+                        column,
+                        message: previous.trim().to_string(),
+                    });
+                }
+            }
+        } else if let Some((file, line_no, column, message)) =
+            split_msbuild_location(trimmed).or_else(|| split_location(trimmed))
+        {
+            if refers_to(file, container_path, file_name) {
+                if message.is_empty() {
+                    pending = Some((line_no, column));
+                } else {
+                    diagnostics.push(Diagnostic {
+                        file: source.clone(),
+                        line: line_no,
+                        column,
+                        message: message.to_string(),
+                    });
+                }
+            }
+        } else if let Some((line_no, column)) = pending {
+            if is_exception(trimmed) {
+                diagnostics.push(Diagnostic {
+                    file: source.clone(),
+                    line: line_no,
+                    column,
+                    message: trimmed.trim_end().to_string(),
+                });
+                pending = None;
+            }
+        }
+        previous = line;
+    }
+    diagnostics
+}
+
+/// `SyntaxError: ...`, `ValueError` and the like, ending a traceback
+fn is_exception(text: &str) -> bool {
+    let name = text.split(':').next().unwrap_or(text).trim_end();
+    (name.ends_with("Error") || name.ends_with("Exception"))
+        && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '_' || c == '.')
+}
+
+/// Splits `File "file", line N[, in function]` from a Python traceback
+fn split_python_location(text: &str) -> Option<(&str, u32)> {
+    let rest = text.strip_prefix("File \"")?;
+    let (file, rest) = rest.split_once("\", line ")?;
+    let digits = rest.split(|c: char| !c.is_ascii_digit()).next()?;
+    Some((file, digits.parse().ok()?))
+}
+
+/// Splits `PHP Parse error:  message in file on line N`
+fn split_php_location(text: &str) -> Option<(&str, u32, String)> {
+    let (rest, line) = text.trim_end().rsplit_once(" on line ")?;
+    let (message, file) = rest.rsplit_once(" in ")?;
+    let message = message.strip_prefix("PHP ").unwrap_or(message);
+    Some((file, line.parse().ok()?, message.split_whitespace().collect::<Vec<_>>().join(" ")))
+}
+
+/// Splits `file: line N: message` as printed by Bash
+fn split_bash_location(text: &str) -> Option<(&str, u32, String)> {
+    let (file, rest) = text.split_once(": line ")?;
+    let (line, message) = rest.split_once(": ")?;
+    Some((file, line.parse().ok()?, message.trim().to_string()))
+}
+
+fn refers_to(file: &str, container_path: &str, file_name: &str) -> bool {
+    file == container_path || file.trim_start_matches("./") == file_name
+}
+
+/// Splits `file(line,column): message` as printed by the .NET compiler
+fn split_msbuild_location(text: &str) -> Option<(&str, u32, Option<u32>, &str)> {
+    let open = text.find('(')?;
+    let close = open + text[open..].find(')')?;
+    let (line, column) = text[open + 1..close].split_once(',')?;
+    let message = text[close + 1..].strip_prefix(':')?;
+    Some((
+        &text[..open],
+        line.trim().parse().ok()?,
+        Some(column.trim().parse().ok()?),
+        message.trim(),
+    ))
+}
+
+/// Splits `file:line[:column][: message]`
+fn split_location(text: &str) -> Option<(&str, u32, Option<u32>, &str)> {
+    let mut parts = text.splitn(4, ':');
+    let file = parts.next()?;
+    let line = parts.next()?.trim().parse().ok()?;
+    let rest: Vec<&str> = parts.collect();
+    match rest.as_slice() {
+        [] => Some((file, line, None, "")),
+        [column, message] if column.trim().parse::<u32>().is_ok() => {
+            Some((file, line, column.trim().parse().ok(), message.trim()))
+        }
+        [column] if column.trim().parse::<u32>().is_ok() => Some((file, line, column.trim().parse().ok(), "")),
+        _ => {
+            // No column: everything after the line number is the message
+            let message = text.splitn(3, ':').nth(2).unwrap_or("").trim();
+            Some((file, line, None, message))
+        }
+    }
+}
@@ -1,13 +1,93 @@
-use crate::container::ContainerManager;
+use crate::args;
+use crate::artifacts;
+use crate::assets;
+use crate::audit::{AuditMode, AuditReport, OsvClient};
+use crate::bundle;
+use crate::cache::{copy_artifact, BuildCache, CONTAINER_CACHE_DIR, CONTAINER_DEPS_DIR, CONTAINER_OBJECTS_DIR};
+use crate::cells::{self, CellSelection};
+use crate::container::{self, ContainerManager};
+use crate::debugging::{Debugger, Debugging};
+use crate::delta::Manifest;
+use crate::directives::{Dependency, Directives, PackageManager};
+use crate::download::DownloadManager;
+use crate::egress::{EgressProxy, Relay};
+use crate::entries;
 use crate::errors::SingleloadError;
+use crate::events::{parse_diagnostics, Diagnostic, Event, EventSink};
+use crate::export::{self, ExportManifest, Imported};
+use crate::flake::{self, NixShell, NixStore, CONTAINER_NIX_DIR, CONTAINER_NIX_ENV_DIR};
+use crate::gpu::{self, GpuApi};
+use crate::hooks::{Hooks, HOOKS_DIR};
+use crate::images::{self, DigestPins};
+use crate::lockfile::{LockedPackage, Lockfile};
+use crate::logs::{LogCapture, OutputTap, OutputTaps, RunLog};
+use crate::metadata::BuildMetadata;
+use crate::normalize;
+use crate::package;
+use crate::pins;
+use crate::platform;
+use crate::plugins;
+use crate::postmortem::{self, Crash, PostmortemStore, CONTAINER_POSTMORTEM_DIR};
+use crate::preprocess::{Preprocessor, Preprocessors, ValuesTemplate};
+use crate::profile::{BuildProfile, DEFAULT_PROFILE};
+use crate::profiling::{self, Profiler, Profiling, CONTAINER_PROFILE_DIR};
+use crate::project::Project;
+use crate::remote_cache::RemoteCache;
+use crate::reproducible;
+use crate::runner::{shell_join, shell_quote, supervise, BuildContext, BuildTarget, Registry, Runner};
+use crate::sandbox::SandboxProfile;
+use crate::sbom::{is_exact_version, Component, Provenance};
 use crate::security::{PathSanitizer, SecurityValidator};
-use crate::types::{ContainerConfig, ExecutionResult, Language, Mount};
+use crate::signals::SignalProxy;
+use crate::signing;
+use crate::snapshot::SnapshotStore;
+use crate::source::strip_shebang;
+use crate::sourcemap::SourceMap;
+use crate::ssh::{self, SshTarget};
+use crate::state::{StateStore, CONTAINER_HELPERS_DIR, CONTAINER_STATE_DIR, STATE_DIR_VAR};
+use crate::tofu::KnownCheck;
+use crate::toolchain::{ToolchainStore, CONTAINER_ARCHIVE, CONTAINER_TOOLCHAIN_DIR};
+use crate::tools::{Tool, ToolKind, ToolStore};
+use crate::trace::{self, FileTrace, CONTAINER_TRACE_DIR};
+use crate::types::{ContainerConfig, ExecutionResult, Mount};
+use crate::uses;
+use crate::vet::{self, FailOn, VetOutput};
+use crate::workdir::CONTAINER_WORK_DIR;
 use anyhow::Result;
-use std::path::Path;
+use ed25519_dalek::VerifyingKey;
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+use std::borrow::Cow;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
 use std::time::{Duration, Instant};
 use tempfile::TempDir;
+use tokio::sync::{broadcast, watch};
 use tracing::{debug, info, warn};
 
+/// Receiving end of a cancellation signal; the script is stopped once `true`
+/// is sent. Dropping the sender never cancels.
+pub type CancelReceiver = watch::Receiver<bool>;
+
+/// Dependency installs download packages, so they get more time than the script itself
+const FETCH_TIMEOUT: Duration = Duration::from_secs(600);
+
+/// Where test containers write coverage reports
+const CONTAINER_COVERAGE_DIR: &str = "/coverage";
+
+/// Where the input of a script fed through `stdin` is mounted
+const CONTAINER_INPUT_DIR: &str = "/input";
+
+/// Passes a measured run's token to its wrapper, which takes it out of the
+/// environment before the script starts
+const MEASURE_TOKEN_ENV: &str = "SINGLELOAD_MEASURE_TOKEN";
+
+/// How long logged output may keep arriving after the container exited
+const LOG_DRAIN_TIMEOUT: Duration = Duration::from_secs(5);
+
+const DEFAULT_PATH: &str = "/usr/local/bin:/usr/bin:/bin";
+
 pub struct Executor {
     container_manager: ContainerManager,
     timeout: Duration,
@@ -15,6 +95,335 @@ pub struct Executor {
     cpu_limit: f32,
     output_limit: u64,
     security_validator: SecurityValidator,
+    registry: Registry,
+    preprocessors: Preprocessors,
+    /// `--set` and values file placeholders, filled in before the preprocessors run
+    template: Option<Arc<ValuesTemplate>>,
+    cache: Option<BuildCache>,
+    remote_cache: Option<RemoteCache>,
+    /// Installed environments of locked Python and JavaScript scripts
+    snapshots: Option<SnapshotStore>,
+    sandbox: SandboxProfile,
+    target: Option<BuildTarget>,
+    frozen: bool,
+    /// Key builds on the sources byte for byte, comments included
+    strict_hash: bool,
+    /// Build with deterministic flags and check that a second build matches
+    reproducible: bool,
+    /// Run interpreted scripts in upstream interpreter images, not the base image
+    containerized: bool,
+    /// Interpret compiled scripts whose build is not cached, where the runner can
+    interp: bool,
+    /// Take toolchains and Python packages from a generated Nix flake
+    nix: bool,
+    nix_store: NixStore,
+    toolchains: ToolchainStore,
+    events: EventSink,
+    env: Vec<(String, String)>,
+    state: Option<StateStore>,
+    verifying_key: Option<VerifyingKey>,
+    known: Option<KnownCheck>,
+    profile: Option<String>,
+    /// Compiler flags from `--build-arg`, after those of the profile and directives
+    build_args: Vec<String>,
+    /// Arguments passed to the script from `--run-arg`
+    run_args: Vec<String>,
+    audit: AuditMode,
+    /// Where `run --log-dir` keeps the output of scripts
+    logs: Option<LogCapture>,
+    /// Receives the output of runs as it arrives
+    output: Option<OutputTap>,
+    /// Taps of the runs of `run-all`, one per script, instead of `output`
+    output_taps: Option<OutputTaps>,
+    /// Where `run --trace-files` writes the files runs touched
+    trace_file: Option<PathBuf>,
+    /// What `run --profile-cpu` or `--profile-heap` profiles
+    profiling: Option<Profiling>,
+    /// How `debug` starts the debugger
+    debugging: Option<Debugging>,
+    /// Host directory `run --isolate-cwd` runs scripts in
+    work_dir: Option<PathBuf>,
+    /// Toolchain version used instead of the one pinned by the script
+    toolchain_version: Option<String>,
+    /// Take toolchain versions from go.mod, .python-version and
+    /// rust-toolchain.toml when scripts do not pin one
+    project_pins: bool,
+    /// Signals of the wrapper, passed on to running containers
+    signals: Option<SignalProxy>,
+    /// `# %%` cells to run instead of the whole script
+    cells: Option<CellSelection>,
+    /// Entry declared with `singleload: entry` to start the script in
+    entry: Option<String>,
+}
+
+/// Result of [`Executor::build_script`]
+#[derive(Debug, Serialize)]
+pub struct BuildOutput {
+    pub language: String,
+    /// Host path of the built artifact
+    pub artifact: PathBuf,
+    pub cached: bool,
+    /// A second build produced the same bytes
+    pub reproducible: bool,
+    pub duration_ms: u64,
+    /// Inputs of the build, for `--sbom`
+    #[serde(skip)]
+    pub provenance: Provenance,
+    /// Command and environment running the artifact from
+    /// [`CONTAINER_CACHE_DIR`], for `export`
+    #[serde(skip)]
+    pub run: Vec<String>,
+    #[serde(skip)]
+    pub env: Vec<(String, String)>,
+}
+
+/// Result of [`Executor::export_script`]
+#[derive(Debug, Serialize)]
+pub struct ExportOutput {
+    pub name: String,
+    pub language: String,
+    pub archive: PathBuf,
+    /// True if the artifact came from the build cache
+    pub cached: bool,
+    /// Number of artifact files in the archive
+    pub files: usize,
+    pub duration_ms: u64,
+}
+
+/// Result of [`Executor::package_script`]
+#[derive(Debug, Serialize)]
+pub struct PackageOutput {
+    pub language: String,
+    /// Tag of the built image
+    pub image: String,
+    /// Base image the binary was copied onto
+    pub base: String,
+    /// True if the binary came from the build cache
+    pub cached: bool,
+    pub pushed: bool,
+    pub duration_ms: u64,
+}
+
+/// Result of [`Executor::bundle_script`]
+#[derive(Debug, Serialize)]
+pub struct BundleOutput {
+    pub language: String,
+    /// Host path of the bundle
+    pub bundle: PathBuf,
+    /// Interpreter version the bundle requires
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub runtime: Option<String>,
+    pub dependencies: usize,
+    pub size_bytes: u64,
+    pub duration_ms: u64,
+}
+
+/// Result of [`Executor::fetch_script`]
+#[derive(Debug, Serialize)]
+pub struct FetchOutput {
+    pub language: String,
+    /// Resolved dependency specs, pinned by the lockfile when there is one
+    pub dependencies: Vec<String>,
+    /// Pinned toolchain version, if any
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub toolchain: Option<String>,
+    pub duration_ms: u64,
+}
+
+/// Result of [`Executor::explain_script`]: what running a script would do
+#[derive(Debug, Serialize)]
+pub struct Explanation {
+    pub script: PathBuf,
+    pub language: String,
+    /// What chose the language: `--lang`, a `lang` directive, the file name, ...
+    pub detected_by: String,
+    /// Pinned toolchain version; None runs on the base image's
+    pub toolchain: Option<String>,
+    /// The directive, project file or flag the version came from
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub toolchain_pinned_by: Option<String>,
+    /// Whether the pinned toolchain is installed already
+    pub toolchain_installed: bool,
+    /// Resolved dependency specs, pinned by the lockfile when there is one
+    pub dependencies: Vec<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub lockfile: Option<PathBuf>,
+    /// Cache entry the dependencies are installed into, and whether it exists
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub dependencies_key: Option<String>,
+    pub dependencies_cached: bool,
+    /// Build profile, directive and `--build-arg` flags, in order
+    pub build_flags: Vec<String>,
+    /// Build cache entry of compiled languages, and whether it exists
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub cache_key: Option<String>,
+    pub cached: bool,
+    /// Shell command building the script, None for interpreted languages
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub build_command: Option<String>,
+    pub run_command: Vec<String>,
+    pub timeout_secs: u64,
+    pub memory_mb: u64,
+    pub cpu_limit: f32,
+    pub network: bool,
+}
+
+/// What [`Executor::measure_script`] observed inside the container
+#[derive(Debug, Clone, Serialize)]
+pub struct Measurement {
+    pub language: String,
+    /// Wall time of the script itself, without container setup; None when
+    /// the run was killed before it could be recorded
+    pub elapsed_ms: Option<f64>,
+    /// User and system CPU time of the script's processes, as the wrapper
+    /// shell's `wait4` reported them
+    pub user_cpu_ms: Option<f64>,
+    pub system_cpu_ms: Option<f64>,
+    /// High-water mark of the container's memory cgroup, which is the
+    /// script's peak RSS plus a little for the wrapper shell. None when the
+    /// kernel does not expose it.
+    pub peak_rss_bytes: Option<u64>,
+    /// Block I/O of the container's cgroup while the script ran; None
+    /// without cgroup v2. Writes still in the page cache when the script
+    /// exits are not counted.
+    pub io: Option<IoCounters>,
+}
+
+/// Bytes and operations that reached block devices
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct IoCounters {
+    pub read_bytes: u64,
+    pub write_bytes: u64,
+    pub read_ops: u64,
+    pub write_ops: u64,
+}
+
+impl Measurement {
+    /// Parses the records the wrapper of a measured run wrote after the
+    /// script (see [`measure_command`]), one per line and each starting with
+    /// the run's token; other lines are ignored. Whatever is missing, because
+    /// the run was killed or the kernel does not expose it, is None.
+    pub fn parse(language: &str, token: &str, records: &str) -> Self {
+        let mut recorded = HashMap::new();
+        for line in records.lines() {
+            let record = line.strip_prefix(token).and_then(|rest| rest.strip_prefix(' '));
+            if let Some((name, value)) = record.and_then(|record| record.split_once(' ')) {
+                recorded.insert(name, value);
+            }
+        }
+        let (elapsed_ms, peak_rss_bytes) = parse_measurement(recorded.get("run").copied().unwrap_or_default());
+        let (user_cpu_ms, system_cpu_ms) = recorded.get("cpu").map_or((None, None), |cpu| parse_cpu(cpu));
+        let io = match (recorded.get("before"), recorded.get("after")) {
+            (Some(before), Some(after)) => {
+                // The lines of `io.stat` are joined with `;`
+                let (before, after) = (parse_io_stat(&before.replace(';', "\n")), parse_io_stat(&after.replace(';', "\n")));
+                Some(IoCounters {
+                    read_bytes: after.read_bytes.saturating_sub(before.read_bytes),
+                    write_bytes: after.write_bytes.saturating_sub(before.write_bytes),
+                    read_ops: after.read_ops.saturating_sub(before.read_ops),
+                    write_ops: after.write_ops.saturating_sub(before.write_ops),
+                })
+            }
+            _ => None,
+        };
+        Self {
+            language: language.to_string(),
+            elapsed_ms,
+            user_cpu_ms,
+            system_cpu_ms,
+            peak_rss_bytes,
+            io,
+        }
+    }
+}
+
+/// Result of [`Executor::test_script`]
+#[derive(Debug, Serialize)]
+pub struct TestOutput {
+    #[serde(flatten)]
+    pub result: ExecutionResult,
+    /// Host path of the coverage report, when one was requested and written
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub coverage: Option<PathBuf>,
+}
+
+/// Result of [`Executor::check_script`]
+#[derive(Debug, Serialize)]
+pub struct CheckOutput {
+    pub language: String,
+    pub passed: bool,
+    /// The script and, for directory projects, the other sources checked
+    pub files: Vec<PathBuf>,
+    pub diagnostics: Vec<Diagnostic>,
+    /// Compiler output, for failures no diagnostic could be parsed from
+    pub output: String,
+    pub duration_ms: u64,
+}
+
+/// A validated script staged in a temporary workspace, with its
+/// dependencies resolved
+struct PreparedScript {
+    runner: Arc<dyn Runner>,
+    /// What chose the runner: `--lang`, a directive, the file name, ...
+    detected_by: String,
+    /// Script content, followed by the other sources of a directory project
+    content: Vec<u8>,
+    /// What build cache keys are computed from: the content with comments
+    /// normalized away and the directives that affect the build
+    cache_source: Vec<u8>,
+    directives: Directives,
+    dependencies: Vec<Dependency>,
+    /// Lockfile the dependencies were pinned by
+    lockfile: Option<PathBuf>,
+    /// Packages installed for the dependencies, empty without any
+    packages: Vec<LockedPackage>,
+    toolchain: String,
+    /// Version of the pinned toolchain, None for the base image's
+    toolchain_version: Option<String>,
+    /// Where the version was pinned
+    toolchain_origin: Option<String>,
+    /// Interpreter image of a containerized run, None for the base image
+    image: Option<String>,
+    /// Host path of the environment script of a `--nix` run
+    nix_env: Option<PathBuf>,
+    container_path: String,
+    sources: Vec<String>,
+    /// Embedded assets, relative to /workspace
+    assets: Vec<String>,
+    /// `pre` and `post` commands run around the script
+    hooks: Hooks,
+    workspace: TempDir,
+    deps_mount: Option<Mount>,
+    toolchain_mount: Option<Mount>,
+    /// Compiler flags of the selected build profile
+    build_flags: Vec<String>,
+    /// Libraries declared with `pkg-config`
+    libraries: Vec<String>,
+    /// GPU architectures declared with `cuda-arch`
+    gpu_archs: Vec<String>,
+    /// Source hash, build time and version exposed to the program
+    metadata: BuildMetadata,
+    /// Maps output about the staged files back to the user's files
+    source_map: SourceMap,
+    _deps_scratch: Option<TempDir>,
+}
+
+impl PreparedScript {
+    fn context<'a>(&'a self, out_dir: &'a str, target: Option<&'a BuildTarget>) -> BuildContext<'a> {
+        BuildContext {
+            script_path: &self.container_path,
+            sources: &self.sources,
+            assets: &self.assets,
+            out_dir,
+            deps_dir: CONTAINER_DEPS_DIR,
+            dependencies: &self.dependencies,
+            target,
+            build_flags: &self.build_flags,
+            libraries: &self.libraries,
+            gpu_archs: &self.gpu_archs,
+            objects: &[],
+        }
+    }
 }
 
 impl Executor {
@@ -25,15 +434,29 @@ impl Executor {
         cpu_limit: f32,
         output_limit: u64,
     ) -> Self {
-        let allowed_extensions = vec![
-            ".py".to_string(),
-            ".js".to_string(),
-            ".php".to_string(),
-            ".go".to_string(),
-            ".rs".to_string(),
-            ".sh".to_string(),
-            ".cs".to_string(),
-        ];
+        let registry = plugins::registry(&container_manager.config);
+        let (timeout, memory_limit, cpu_limit) = container_manager.config.policy.clamp(timeout, memory_limit, cpu_limit);
+        // Config::validate rejects a malformed budget before we get here
+        let budget = container_manager.config.cache.budget().unwrap_or_default();
+        let cache = BuildCache::new(container_manager.config.cache_dir.clone())
+            .with_budget(budget)
+            .with_dedupe(container_manager.config.cache.dedupe);
+        let toolchains = ToolchainStore::new(container_manager.config.toolchains_dir.clone());
+        let nix_store = NixStore::new(container_manager.config.nix_dir.clone());
+        let state = StateStore::new(container_manager.config.state_dir.clone());
+        let project_pins = container_manager.config.project_pins;
+        let strict_hash = container_manager.config.strict_hash;
+        let snapshots = SnapshotStore::new(container_manager.config.snapshots_dir.clone());
+        let remote_cache = container_manager.config.remote_cache.as_ref().and_then(|remote| {
+            RemoteCache::from_config(remote)
+                .map_err(|e| warn!("Remote cache disabled: {}", e))
+                .ok()
+        });
+        // Config::validate rejects unknown preprocessors before we get here
+        let preprocessors = Preprocessors::from_config(&container_manager.config.preprocessors).unwrap_or_else(|e| {
+            warn!("Preprocessors disabled: {}", e);
+            Preprocessors::new()
+        });
 
         Self {
             container_manager,
@@ -41,198 +464,3223 @@ impl Executor {
             memory_limit,
             cpu_limit,
             output_limit,
-            security_validator: SecurityValidator::new(allowed_extensions),
+            security_validator: SecurityValidator::new(),
+            registry,
+            preprocessors,
+            template: None,
+            cache: Some(cache),
+            remote_cache,
+            snapshots: Some(snapshots),
+            sandbox: SandboxProfile::default(),
+            target: None,
+            frozen: false,
+            strict_hash,
+            reproducible: false,
+            containerized: false,
+            interp: false,
+            nix: false,
+            nix_store,
+            toolchains,
+            events: EventSink::default(),
+            env: Vec::new(),
+            state: Some(state),
+            verifying_key: None,
+            known: None,
+            profile: None,
+            build_args: Vec::new(),
+            work_dir: None,
+            run_args: Vec::new(),
+            audit: AuditMode::Off,
+            logs: None,
+            output: None,
+            output_taps: None,
+            trace_file: None,
+            profiling: None,
+            debugging: None,
+            toolchain_version: None,
+            project_pins,
+            signals: None,
+            cells: None,
+            entry: None,
         }
     }
 
+    /// Reports progress (build started, diagnostics, exit code) to `events`
+    pub fn with_events(mut self, events: EventSink) -> Self {
+        self.events = events;
+        self
+    }
+
+    /// Sets environment variables for the script, e.g. from `--env-file`.
+    /// They are only passed to run containers, never to builds.
+    pub fn with_env(mut self, env: Vec<(String, String)>) -> Self {
+        self.env = env;
+        self
+    }
+
+    /// Only accept scripts (and project sources) with a detached `.sig`
+    /// signature made by this key
+    pub fn with_verifying_key(mut self, key: Option<VerifyingKey>) -> Self {
+        self.verifying_key = key;
+        self
+    }
+
+    /// Checks the files each run stages against the content trusted for the
+    /// script before, asking or refusing when it changed
+    pub fn with_known_check(mut self, known: Option<KnownCheck>) -> Self {
+        self.known = known;
+        self
+    }
+
+    /// Builds with the named profile instead of the script's `profile`
+    /// directive (or `debug`)
+    pub fn with_profile(mut self, profile: Option<String>) -> Self {
+        self.profile = profile;
+        self
+    }
+
+    /// Appends `args` to the compiler command line as they are, after the
+    /// flags of the build profile and the script's `buildflags` directives
+    pub fn with_build_args(mut self, args: Vec<String>) -> Self {
+        self.build_args = args;
+        self
+    }
+
+    /// Passes `args` to the script (or compiled binary) when it runs
+    pub fn with_run_args(mut self, args: Vec<String>) -> Self {
+        self.run_args = args;
+        self
+    }
+
+    /// Looks the script's dependencies up in the OSV database before running
+    /// it; with [`AuditMode::Deny`], critical vulnerabilities stop the run
+    pub fn with_audit(mut self, audit: AuditMode) -> Self {
+        self.audit = audit;
+        self
+    }
+
+    /// Writes the output of runs to rotated log files in the capture's
+    /// directory while they run
+    pub fn with_logs(mut self, logs: Option<LogCapture>) -> Self {
+        self.logs = logs;
+        self
+    }
+
+    /// Runs scripts under strace and writes the files they touched to
+    /// `path` as a [`FileTrace`] manifest
+    pub fn with_trace_file(mut self, path: Option<PathBuf>) -> Self {
+        self.trace_file = path;
+        self
+    }
+
+    /// Runs scripts under the native profiler of their language and writes
+    /// what it recorded next to the script, or where `profiling` says
+    pub fn with_profiling(mut self, profiling: Option<Profiling>) -> Self {
+        self.profiling = profiling;
+        self
+    }
+
+    /// Builds scripts for [`Executor::debug`] and starts them under the
+    /// debugger of their language
+    pub fn with_debugging(mut self, debugging: Option<Debugging>) -> Self {
+        self.debugging = debugging;
+        self
+    }
+
+    /// Passes the output of runs to `tap` while they run
+    pub fn with_output(mut self, tap: Option<OutputTap>) -> Self {
+        self.output = tap;
+        self
+    }
+
+    /// Passes the output of each script's runs to a tap of its own
+    pub fn with_output_taps(mut self, taps: Option<OutputTaps>) -> Self {
+        self.output_taps = taps;
+        self
+    }
+
+    /// Runs scripts with `dir` mounted writable as their working directory,
+    /// at [`CONTAINER_WORK_DIR`]
+    pub fn with_work_dir(mut self, dir: Option<PathBuf>) -> Self {
+        self.work_dir = dir;
+        self
+    }
+
+    /// Builds and runs scripts with this toolchain version, whatever the
+    /// script header pins, e.g. for `singleload matrix`
+    pub fn with_toolchain_version(mut self, version: Option<String>) -> Self {
+        self.toolchain_version = version;
+        self
+    }
+
+    /// Forwards the signals `signals` catches to whichever container is
+    /// running, killing it if it outlives the proxy's kill timeout
+    pub fn with_signals(mut self, signals: Option<SignalProxy>) -> Self {
+        self.signals = signals;
+        self
+    }
+
+    /// Runs only the selected `# %%` cells of Python scripts, keeping their
+    /// variables in the script's state directory between runs
+    pub fn with_cells(mut self, cells: Option<CellSelection>) -> Self {
+        self.cells = cells;
+        self
+    }
+
+    /// Starts scripts in the function of one of their `singleload: entry`
+    /// directives instead of their main
+    pub fn with_entry(mut self, entry: Option<String>) -> Self {
+        self.entry = entry;
+        self
+    }
+
+    /// Runs scripts without their persistent state directory
+    pub fn without_state(mut self) -> Self {
+        self.state = None;
+        self
+    }
+
+    /// Refuse to run scripts whose dependency lockfile is missing or stale
+    pub fn frozen(mut self) -> Self {
+        self.frozen = true;
+        self
+    }
+
+    /// Rebuild whenever a source changes at all. By default edits to
+    /// comments and run-time directives alone reuse the cached build.
+    pub fn strict_hash(mut self) -> Self {
+        self.strict_hash = true;
+        self
+    }
+
+    /// Builds with the flags and environment of [`reproducible`], and fails
+    /// `build_script` when building twice gives different artifacts
+    pub fn reproducible(mut self) -> Self {
+        self.reproducible = true;
+        self
+    }
+
+    /// Runs interpreted scripts in a pinned upstream image of their
+    /// interpreter (see [`images`]), pulled when podman does not have it, so
+    /// neither the base image nor a toolchain install is needed. Compiled
+    /// languages are refused.
+    pub fn containerized(mut self) -> Self {
+        self.containerized = true;
+        self
+    }
+
+    /// Runs small Go scripts with the yaegi interpreter instead of compiling
+    /// them when their build is not cached (see [`Runner::interpret`]).
+    /// Scripts the interpreter cannot handle, and scripts pinning a Go
+    /// version, are compiled as usual.
+    pub fn interpreted(mut self) -> Self {
+        self.interp = true;
+        self
+    }
+
+    /// Builds and runs scripts in the development shell of a flake generated
+    /// from their toolchain pin, `pip` dependencies and `pkg-config`
+    /// libraries (see [`NixShell`]), locked next to the script. The shell is
+    /// resolved once into a Nix store kept on the host; runs read it
+    /// without network access.
+    pub fn nix(mut self) -> Self {
+        self.nix = true;
+        self
+    }
+
+    /// Builds and runs compiled languages for `target`, e.g. WASI modules
+    /// executed with wasmtime
+    pub fn with_target(mut self, target: Option<BuildTarget>) -> Self {
+        self.target = target;
+        self
+    }
+
+    /// Applies a sandbox profile to run and build containers
+    pub fn with_sandbox(mut self, sandbox: SandboxProfile) -> Self {
+        self.sandbox = sandbox;
+        self
+    }
+
+    /// Always rebuild compiled languages instead of using the build cache
+    pub fn without_cache(mut self) -> Self {
+        self.cache = None;
+        self.remote_cache = None;
+        self.snapshots = None;
+        self
+    }
+
+    /// Shares builds through `remote` instead of the configured remote cache
+    pub fn with_remote_cache(mut self, remote: Option<RemoteCache>) -> Self {
+        self.remote_cache = remote;
+        self
+    }
+
+    /// Replaces the language registry, e.g. to add third-party runners
+    pub fn with_registry(mut self, registry: Registry) -> Self {
+        self.registry = registry;
+        self
+    }
+
+    /// Appends `preprocessor` to the configured ones of `language`
+    pub fn with_preprocessor(mut self, language: &str, preprocessor: Arc<dyn Preprocessor>) -> Self {
+        self.preprocessors.register(language, preprocessor);
+        self
+    }
+
+    /// Fills `{{.Name}}` placeholders of every source before it is built
+    pub fn with_template(mut self, template: Option<ValuesTemplate>) -> Self {
+        self.template = template.map(Arc::new);
+        self
+    }
+
+    pub fn registry(&self) -> &Registry {
+        &self.registry
+    }
+
+    /// Returns true if a daemon can run scripts the way this executor
+    /// would. A [`RunRequest`](crate::daemon::RunRequest) carries the
+    /// limits, sandbox, target, environment and build options; everything
+    /// checked here only takes effect in a local run.
+    pub fn daemon_compatible(&self) -> bool {
+        self.logs.is_none()
+            && self.output.is_none()
+            && self.output_taps.is_none()
+            && self.work_dir.is_none()
+            && self.known.is_none()
+            && self.trace_file.is_none()
+            && self.profiling.is_none()
+            && self.debugging.is_none()
+            && self.cells.is_none()
+            && self.entry.is_none()
+            && self.template.is_none()
+            && self.signals.is_none()
+            && self.toolchain_version.is_none()
+            && !self.strict_hash
+            && !self.reproducible
+            && !self.containerized
+            && !self.interp
+            && !self.nix
+    }
+
+    /// Runs a script, using the named language or detecting it when `lang` is None
     pub async fn run_script(
         &self,
-        language: Language,
+        lang: Option<&str>,
         script_path: &Path,
         keep_container: bool,
     ) -> Result<ExecutionResult> {
-        let start_time = Instant::now();
+        self.run_script_cancellable(lang, script_path, keep_container, never_cancelled())
+            .await
+    }
 
-        // Validate script path
-        self.security_validator.validate_script_path(script_path)?;
+    /// Like [`Executor::run_script`], but stops the container when `cancel` fires
+    pub async fn run_script_cancellable(
+        &self,
+        lang: Option<&str>,
+        script_path: &Path,
+        keep_container: bool,
+        cancel: CancelReceiver,
+    ) -> Result<ExecutionResult> {
+        self.run_script_with_input(lang, script_path, keep_container, cancel, None)
+            .await
+    }
 
-        // Read and validate script content
-        let script_content = std::fs::read(script_path)?;
-        self.security_validator.validate_script_content(&script_content)?;
+    /// Like [`Executor::run_script_cancellable`], feeding `input` to the
+    /// script's stdin. Without input, stdin is empty.
+    pub async fn run_script_with_input(
+        &self,
+        lang: Option<&str>,
+        script_path: &Path,
+        keep_container: bool,
+        cancel: CancelReceiver,
+        input: Option<&[u8]>,
+    ) -> Result<ExecutionResult> {
+        let (result, _) = self
+            .execute_script(lang, script_path, keep_container, cancel, input, false)
+            .await?;
+        Ok(result)
+    }
 
-        // Create temporary directory for script
-        let temp_dir = TempDir::new()?;
-        let container_script_name = format!("script{}", language.file_extension());
-        let temp_script_path = temp_dir.path().join(&container_script_name);
-        std::fs::write(&temp_script_path, &script_content)?;
+    /// Runs a script once and reports how long it took and how much memory
+    /// it used, for `singleload bench`
+    pub async fn measure_script(&self, lang: Option<&str>, script_path: &Path) -> Result<(ExecutionResult, Measurement)> {
+        self.run_script_measured(lang, script_path, false).await
+    }
 
-        // Prepare container configuration
-        let container_name = PathSanitizer::generate_safe_container_name("singleload");
-        let mut config = ContainerConfig {
-            self.container_manager.config.base_image_name.clone(),
-            name: container_name.clone(),
-            memory_limit: self.memory_limit,
-            cpu_limit: self.cpu_limit,
-            timeout: self.timeout,
-            ..Default::default()
-        };
+    /// Like [`Executor::run_script`], also reporting the resources the
+    /// script used, for `run --stats`
+    pub async fn run_script_measured(
+        &self,
+        lang: Option<&str>,
+        script_path: &Path,
+        keep_container: bool,
+    ) -> Result<(ExecutionResult, Measurement)> {
+        let (result, measurement) = self
+            .execute_script(lang, script_path, keep_container, never_cancelled(), None, true)
+            .await?;
+        Ok((result, measurement.expect("measured runs always report")))
+    }
 
-        // Mount the script directory
-        config.mounts.push(Mount {
-            source: temp_dir.path().to_string_lossy().to_string(),
-            target: "/workspace".to_string(),
-            read_only: true,
+    async fn execute_script(
+        &self,
+        lang: Option<&str>,
+        script_path: &Path,
+        keep_container: bool,
+        cancel: CancelReceiver,
+        input: Option<&[u8]>,
+        measure: bool,
+    ) -> Result<(ExecutionResult, Option<Measurement>)> {
+        let start_time = Instant::now();
+
+        let prepared = self.prepare_script(lang, script_path).await?;
+        let runner = prepared.runner.clone();
+        if let Some(target) = &self.target {
+            check_target(runner.as_ref(), target)?;
+        }
+        self.check_required_env(&prepared.directives)?;
+        let arg_env = self.parse_script_args(&prepared.directives)?;
+        self.enforce_audit(&prepared).await?;
+        let ctx = prepared.context(CONTAINER_CACHE_DIR, self.target.as_ref());
+        self.events.emit(Event::Started {
+            language: runner.name().to_string(),
+            script: script_path.display().to_string(),
         });
 
-        // Set environment variables
-        config.env.push(("HOME".to_string(), "/tmp".to_string()));
-        config.env.push(("USER".to_string(), "nonroot".to_string()));
-        config.env.push(("PATH".to_string(), "/usr/local/bin:/usr/bin:/bin".to_string()));
+        // A measured run is built in a container of its own, even without
+        // the cache, so the build is never part of what it measures
+        let scratch = match (&self.cache, measure) {
+            (None, true) => Some(TempDir::new()?),
+            _ => None,
+        };
+        let scratch_cache = scratch.as_ref().map(|dir| BuildCache::new(dir.path().to_path_buf()));
 
-        // For languages that need specific environment variables
-        match language {
-            Language::Python => {
-                config.env.push(("PYTHONUNBUFFERED".to_string(), "1".to_string()));
-                config.env.push(("PYTHONDONTWRITEBYTECODE".to_string(), "1".to_string()));
+        // Prepare execution command
+        let (mut exec_command, cache_mount) = self
+            .plan_command(
+                &prepared,
+                &ctx,
+                self.cache.as_ref().or(scratch_cache.as_ref()),
+                script_path,
+                // yaegi only knows the base image's Go, and cannot profile it
+                self.interp && prepared.toolchain_version.is_none() && self.profiling.is_none(),
+                start_time,
+            )
+            .await?;
+
+        // A crash that dumps core leaves it where the postmortem collects it
+        let postmortems = self.postmortems();
+        let postmortem_dir = match &postmortems {
+            Some(_) => {
+                let dir = TempDir::new()?;
+                exec_command = postmortem::wrap(&exec_command);
+                Some(dir)
             }
-            Language::Go => {
-                config.env.push(("GOCACHE".to_string(), "/tmp/gocache".to_string()));
-                config.env.push(("GOPATH".to_string(), "/tmp/gopath".to_string()));
+            None => None,
+        };
+
+        // strace starts the script itself, inside the input redirection and
+        // the measurement
+        let trace_dir = match &self.trace_file {
+            Some(_) => {
+                let dir = TempDir::new()?;
+                exec_command = trace::trace_command(&exec_command);
+                Some(dir)
             }
-            Language::DotNet => {
-                config.env.push(("DOTNET_CLI_HOME".to_string(), "/tmp".to_string()));
-                config.env.push(("DOTNET_CLI_TELEMETRY_OPTOUT".to_string(), "1".to_string()));
+            None => None,
+        };
+        let profile_dir = match self.profiler(runner.as_ref()) {
+            Some(_) => {
+                let dir = TempDir::new()?;
+                Some(dir)
             }
-            _ => {}
+            None => None,
+        };
+        if !prepared.hooks.is_empty() {
+            exec_command = prepared.hooks.wrap(&exec_command);
+        }
+
+        // Containers have no stdin of their own, so input is staged as a file
+        let input_dir = match input {
+            Some(data) => {
+                let dir = TempDir::new()?;
+                std::fs::write(dir.path().join("stdin"), data)?;
+                make_world_readable(dir.path())?;
+                exec_command = bash_command(format!(
+                    "exec {} < {}/stdin",
+                    shell_join(&exec_command),
+                    CONTAINER_INPUT_DIR
+                ));
+                Some(dir)
+            }
+            None => None,
+        };
+
+        let measure_token = measure.then(|| uuid::Uuid::new_v4().simple().to_string());
+        if measure_token.is_some() {
+            exec_command = bash_command(measure_command(&exec_command));
+        }
+
+        // Prepare container configuration
+        let container_name = PathSanitizer::generate_safe_container_name("singleload");
+        let mut config = self.script_container_config(&prepared, &ctx, container_name.clone(), exec_command);
+
+        // Mount the build cache entry for compiled languages
+        if let Some(mount) = cache_mount {
+            config.mounts.push(mount);
+        }
+        if let Some(dir) = &input_dir {
+            config.mounts.push(Mount {
+                source: dir.path().to_string_lossy().to_string(),
+                target: CONTAINER_INPUT_DIR.to_string(),
+                read_only: true,
+            });
+        }
+        if let Some(dir) = &trace_dir {
+            container::grant(dir.path(), &config.user)?;
+            config.mounts.push(Mount {
+                source: dir.path().to_string_lossy().to_string(),
+                target: CONTAINER_TRACE_DIR.to_string(),
+                read_only: false,
+            });
+            config.allowed_syscalls.extend(trace::SYSCALLS.iter().map(|s| s.to_string()));
+        }
+        if let (Some(dir), Some(profiler), Some(profiling)) =
+            (&profile_dir, self.profiler(runner.as_ref()), &self.profiling)
+        {
+            container::grant(dir.path(), &config.user)?;
+            config.mounts.push(Mount {
+                source: dir.path().to_string_lossy().to_string(),
+                target: CONTAINER_PROFILE_DIR.to_string(),
+                read_only: false,
+            });
+            config.env.extend(profiler.env(profiling.kind));
+            config.allowed_syscalls.extend(profiler.syscalls().iter().map(|s| s.to_string()));
+        }
+        if let Some(dir) = &postmortem_dir {
+            container::grant(dir.path(), &config.user)?;
+            config.mounts.push(Mount {
+                source: dir.path().to_string_lossy().to_string(),
+                target: CONTAINER_POSTMORTEM_DIR.to_string(),
+                read_only: false,
+            });
+            // Ahead of everything else, so the script's own values win
+            let crash_env = postmortem::CRASH_ENV.iter().map(|(k, v)| (k.to_string(), v.to_string()));
+            config.env.splice(0..0, crash_env);
+        }
+
+        config.env.extend(self.env.iter().cloned());
+        config.env.extend(arg_env);
+        if let Some(token) = &measure_token {
+            config.env.push((MEASURE_TOKEN_ENV.to_string(), token.clone()));
+        }
+        self.mount_state(&mut config, script_path)?;
+        self.mount_work_dir(&mut config)?;
+        let cwd = config.working_dir.clone().unwrap_or_else(|| "/workspace".to_string());
+        if runner.gpu().is_some() {
+            config.devices = self.container_manager.config.gpu_devices.clone();
         }
+        let egress = self.confine_network(&prepared.directives, &mut config).await?;
 
         // Keep container for debugging if requested
-        config.read_only = !keep_container;
+        config.read_only = self.sandbox.read_only && !keep_container;
 
-        info!("Creating container {} for {} script", container_name, language.command());
+        info!("Creating container {} for {} script", container_name, runner.name());
 
         // Create and start container
         let container_id = self.container_manager.create_container(config).await?;
+        let _relay = self.relay_egress(&container_id, egress.as_ref()).await?;
         
         debug!("Container created: {}", container_id);
+        self.events.emit(Event::ContainerCreated { id: container_id.clone() });
 
-        // Prepare execution command
-        let script_path_in_container = format!("/workspace/{}", container_script_name);
-        let exec_command = self.build_exec_command(language, &script_path_in_container);
+        let tap = match &self.output_taps {
+            Some(taps) => Some(taps(script_path)),
+            None => self.output.clone(),
+        };
+        let log = match &self.logs {
+            Some(capture) => Some(RunLog::open(capture, &log_name(script_path))?.with_tap(tap)),
+            None => tap.map(RunLog::tapped),
+        };
+        let log = match &measure_token {
+            Some(token) => log.map(|log| log.hiding(&format!("\n{}", token))),
+            None => log,
+        };
 
         // Execute the command in the container
-        let exec_result = self.execute_in_container(&container_id, exec_command, keep_container).await;
+        let exec_result = self
+            .execute_in_container_logged(&container_id, self.timeout, keep_container, cancel, log, measure_token.as_deref())
+            .await;
 
         // Calculate duration
         let duration_ms = start_time.elapsed().as_millis() as u64;
 
+        let mut records = None;
+        let exec_result = exec_result.map(|(exit_code, stdout, stderr, truncated, recorded)| {
+            records = recorded;
+            let map = &prepared.source_map;
+            (exit_code, map.translate(&stdout), map.translate(&stderr), truncated)
+        });
+
+        if let (Some(store), Ok((exit_code, _, stderr, _))) = (&postmortems, &exec_result) {
+            if let Some(crash) = Crash::detect(*exit_code as u32, stderr) {
+                let capture = postmortem_dir.as_ref().map(TempDir::path);
+                let map = &prepared.source_map;
+                match store.record(script_path, runner.name(), *exit_code as u32, &crash, capture, map) {
+                    Ok(saved) => warn!(
+                        "{} crashed ({}), see 'singleload postmortem show {}'",
+                        script_path.display(),
+                        crash.summary,
+                        saved.id
+                    ),
+                    Err(e) => warn!("Failed to save the postmortem of {}: {}", script_path.display(), e),
+                }
+            }
+        }
+
+        if let Ok((exit_code, _, stderr, _)) = &exec_result {
+            if *exit_code != 0 {
+                self.emit_diagnostics(stderr, &prepared.source_map);
+            }
+            self.events.emit(Event::Finished { exit_code: *exit_code, duration_ms });
+        }
+
         // Clean up temporary directory
-        drop(temp_dir);
+        drop(prepared);
 
-        match exec_result {
-            Ok((exit_code, stdout, stderr, truncated)) => {
-                Ok(ExecutionResult::success(
-                    exit_code as u32,
-                    stdout,
-                    stderr,
-                    duration_ms,
-                    truncated,
-                ))
+        let measurement = measure_token
+            .map(|token| Measurement::parse(runner.name(), &token, records.as_deref().unwrap_or_default()));
+        if let (Some(dir), Some(path)) = (&trace_dir, &self.trace_file) {
+            match write_file_trace(path, script_path, runner.name(), dir.path(), &cwd) {
+                Ok(trace) => info!("Recorded {} paths in {}", trace.len(), path.display()),
+                Err(e) => warn!("Failed to write file trace: {}", e),
+            }
+        }
+        if let (Some(dir), Some(profiler), Some(profiling)) =
+            (&profile_dir, self.profiler(runner.as_ref()), &self.profiling)
+        {
+            let path = profiling.output_path(script_path, profiler);
+            match profiling::collect(dir.path(), &path, profiler) {
+                Ok(size) => info!(
+                    "Wrote the {} profile of {} ({}, {} bytes) to {}; view it with '{}'",
+                    profiling.kind,
+                    script_path.display(),
+                    profiler.name(),
+                    size,
+                    path.display(),
+                    profiler.viewer(&path)
+                ),
+                Err(e) => warn!("Failed to write the {} profile: {}", profiling.kind, e),
             }
+        }
+
+        match exec_result {
+            Ok((exit_code, stdout, stderr, truncated)) => Ok((
+                ExecutionResult::success(exit_code as u32, stdout, stderr, duration_ms, truncated),
+                measurement,
+            )),
             Err(e) => {
                 // Ensure container is removed on error
                 if !keep_container {
                     let _ = self.container_manager.remove_container(&container_id).await;
                 }
-                Ok(ExecutionResult::error(e.to_string(), duration_ms))
+                Ok((ExecutionResult::error(e.to_string(), duration_ms), measurement))
             }
         }
     }
 
-    async fn execute_in_container(
+    /// Runs the tests defined in a script. With `coverage`, the report is
+    /// written next to the script (see [`coverage_path`]).
+    pub async fn test_script(
         &self,
-        container_id: &str,
-        command: Vec<String>,
-        keep_container: bool,
-    ) -> Result<(i32, String, String, bool)> {
-        // Start the container with the command
-        self.container_manager.start_container(container_id).await?;
-
-        // Wait for container to finish
-        let exit_code = match self.container_manager.wait_container(container_id, self.timeout).await {
-            Ok(code) => code,
-            Err(e) => {
-                warn!("Container execution failed: {}", e);
-                if !keep_container {
-                    let _ = self.container_manager.remove_container(container_id).await;
-                }
-                return Err(e);
-            }
-        };
+        lang: Option<&str>,
+        script_path: &Path,
+        coverage: bool,
+    ) -> Result<TestOutput> {
+        let start_time = Instant::now();
 
-        // Get logs
-        let (stdout, stderr) = self.container_manager.get_container_logs(container_id).await?;
+        let prepared = self.prepare_script(lang, script_path).await?;
+        let runner = prepared.runner.clone();
+        self.check_required_env(&prepared.directives)?;
+        let ctx = prepared.context(CONTAINER_CACHE_DIR, None);
+        let report = format!("{}/coverage", CONTAINER_COVERAGE_DIR);
+        let command = runner
+            .test(&ctx, coverage.then_some(report.as_str()))
+            .ok_or_else(|| {
+                SingleloadError::InvalidInput(format!("{} scripts have no test runner", runner.name()))
+            })?;
+        self.events.emit(Event::Started {
+            language: runner.name().to_string(),
+            script: script_path.display().to_string(),
+        });
 
-        // Apply output limits
-        let (stdout, stderr, truncated) = self.apply_output_limits(stdout, stderr);
+        let container_name = PathSanitizer::generate_safe_container_name("singleload-test");
+        let mut config =
+            self.script_container_config(&prepared, &ctx, container_name.clone(), bash_command(command));
+        config.env.extend(self.env.iter().cloned());
+        let egress = self.confine_network(&prepared.directives, &mut config).await?;
 
-        // Clean up container unless debugging
-        if !keep_container {
-            self.container_manager.remove_container(container_id).await?;
+        // Coverage is written to a scratch directory and copied out afterwards
+        let coverage_dir = if coverage {
+            let dir = TempDir::new()?;
+            container::grant(dir.path(), &config.user)?;
+            config.mounts.push(Mount {
+                source: dir.path().to_string_lossy().to_string(),
+                target: CONTAINER_COVERAGE_DIR.to_string(),
+                read_only: false,
+            });
+            Some(dir)
         } else {
-            info!("Container {} kept for debugging", container_id);
-        }
+            None
+        };
 
-        Ok((exit_code, stdout, stderr, truncated))
-    }
+        info!("Testing {} script in container {}", runner.name(), container_name);
+        let container_id = self.container_manager.create_container(config).await?;
+        let _relay = self.relay_egress(&container_id, egress.as_ref()).await?;
+        self.events.emit(Event::ContainerCreated { id: container_id.clone() });
 
-    fn build_exec_command(&self, language: Language, script_path: &str) -> Vec<String> {
-        match language {
-            Language::Rust => {
-                // For Rust, we need to compile first
-                vec![
-                    "/bin/bash".to_string(),
-                    "-c".to_string(),
-                    format!(
-                        "cd /tmp && rustc {} -o rust_binary && ./rust_binary",
-                        script_path
-                    ),
-                ]
-            }
-            Language::Go => {
-                vec![
-                    language.command().to_string(),
-                    "run".to_string(),
-                    script_path.to_string(),
-                ]
-            }
-            Language::DotNet => {
-                // For .NET, we need to create a project structure
-                vec![
-                    "/bin/bash".to_string(),
-                    "-c".to_string(),
-                    format!(
-                        "cd /tmp && dotnet new console -o app && cp {} /tmp/app/Program.cs && cd app && dotnet run",
-                        script_path
-                    ),
-                ]
+        let exec_result = self
+            .execute_in_container(&container_id, self.timeout, false, never_cancelled())
+            .await;
+        let duration_ms = start_time.elapsed().as_millis() as u64;
+
+        let (exit_code, stdout, stderr, truncated) = match exec_result {
+            Ok(output) => output,
+            Err(e) => {
+                return Ok(TestOutput {
+                    result: ExecutionResult::error(e.to_string(), duration_ms),
+                    coverage: None,
+                })
             }
-            _ => {
-                // For interpreted languages, just run directly
-                vec![
-                    language.command().to_string(),
-                    script_path.to_string(),
-                ]
+        };
+        let stdout = prepared.source_map.translate(&stdout);
+        let stderr = prepared.source_map.translate(&stderr);
+        if exit_code != 0 {
+            self.emit_diagnostics(&stderr, &prepared.source_map);
+        }
+        self.events.emit(Event::Finished { exit_code, duration_ms });
+
+        let mut report_path = None;
+        if let Some(dir) = &coverage_dir {
+            let written = dir.path().join("coverage");
+            if written.exists() {
+                let target = coverage_path(script_path);
+                std::fs::copy(&written, &target)?;
+                report_path = Some(target);
+            } else {
+                warn!("{} tests did not produce a coverage report", runner.name());
             }
         }
+
+        Ok(TestOutput {
+            result: ExecutionResult::success(exit_code as u32, stdout, stderr, duration_ms, truncated),
+            coverage: report_path,
+        })
     }
 
-    fn apply_output_limits(&self, stdout: String, stderr: String) -> (String, String, bool) {
-        let mut truncated = false;
-        let limit = self.output_limit as usize;
+    /// Looks for errors in a script without running it: compiled languages
+    /// are built (without touching the build cache), interpreted ones parsed
+    pub async fn check_script(&self, lang: Option<&str>, script_path: &Path) -> Result<CheckOutput> {
+        let start_time = Instant::now();
 
-        let stdout_limited = if stdout.len() > limit {
-            truncated = true;
+        let prepared = self.prepare_script(lang, script_path).await?;
+        let runner = prepared.runner.clone();
+        let ctx = prepared.context("/tmp", self.target.as_ref());
+        let command = runner.check(&ctx).ok_or_else(|| {
+            SingleloadError::InvalidInput(format!("{} scripts cannot be checked", runner.name()))
+        })?;
+        self.events.emit(Event::Started {
+            language: runner.name().to_string(),
+            script: script_path.display().to_string(),
+        });
+
+        let container_name = PathSanitizer::generate_safe_container_name("singleload-check");
+        let mut config =
+            self.script_container_config(&prepared, &ctx, container_name.clone(), bash_command(command));
+        config.env.extend(self.env.iter().cloned());
+
+        info!("Checking {} script in container {}", runner.name(), container_name);
+        let container_id = self.container_manager.create_container(config).await?;
+        self.events.emit(Event::ContainerCreated { id: container_id.clone() });
+
+        let (exit_code, stdout, stderr, _) = self
+            .execute_in_container(&container_id, self.timeout, false, never_cancelled())
+            .await?;
+        let duration_ms = start_time.elapsed().as_millis() as u64;
+
+        // php -l reports on stdout, everything else on stderr
+        let output = prepared.source_map.translate(&format!("{}{}", stdout, stderr));
+        let diagnostics = if exit_code != 0 {
+            self.emit_diagnostics(&output, &prepared.source_map);
+            collect_diagnostics(&output, &prepared.source_map)
+        } else {
+            Vec::new()
+        };
+        self.events.emit(Event::Finished { exit_code, duration_ms });
+
+        Ok(CheckOutput {
+            language: runner.name().to_string(),
+            passed: exit_code == 0,
+            files: prepared.source_map.originals().map(Path::to_path_buf).collect(),
+            diagnostics,
+            output,
+            duration_ms,
+        })
+    }
+
+    /// Runs the language's linters on a script, without building or running
+    /// it, and collects what they report. It passes unless a finding is at
+    /// least as severe as `fail_on`.
+    pub async fn vet_script(&self, lang: Option<&str>, script_path: &Path, fail_on: FailOn) -> Result<VetOutput> {
+        let start_time = Instant::now();
+
+        let prepared = self.prepare_script(lang, script_path).await?;
+        let runner = prepared.runner.clone();
+        let ctx = prepared.context("/tmp", self.target.as_ref());
+        let linters = runner.linters(&ctx);
+        if linters.is_empty() {
+            return Err(SingleloadError::InvalidInput(format!("there are no linters for {} scripts", runner.name())).into());
+        }
+        self.events.emit(Event::Started {
+            language: runner.name().to_string(),
+            script: script_path.display().to_string(),
+        });
+
+        let container_name = PathSanitizer::generate_safe_container_name("singleload-vet");
+        let mut config =
+            self.script_container_config(&prepared, &ctx, container_name.clone(), bash_command(vet::script(&linters)));
+        config.env.extend(self.env.iter().cloned());
+
+        info!("Vetting {} script in container {}", runner.name(), container_name);
+        let container_id = self.container_manager.create_container(config).await?;
+        self.events.emit(Event::ContainerCreated { id: container_id.clone() });
+
+        let (_, stdout, _, _) = self
+            .execute_in_container(&container_id, self.timeout, false, never_cancelled())
+            .await?;
+        let files: Vec<PathBuf> = prepared.source_map.originals().map(Path::to_path_buf).collect();
+        let mut tools = vet::parse(&stdout);
+        let mut findings = Vec::new();
+        for tool in &mut tools {
+            tool.output = prepared.source_map.translate(&tool.output);
+            let diagnostics = collect_diagnostics(&tool.output, &prepared.source_map);
+            findings.extend(vet::findings(tool, diagnostics, &files));
+        }
+        for finding in &findings {
+            self.events.emit(Event::Diagnostic(finding.diagnostic.clone()));
+        }
+        let passed = !findings.iter().any(|finding| fail_on.fails(finding.severity));
+        let duration_ms = start_time.elapsed().as_millis() as u64;
+        self.events.emit(Event::Finished {
+            exit_code: if passed { 0 } else { 1 },
+            duration_ms,
+        });
+
+        Ok(VetOutput {
+            language: runner.name().to_string(),
+            passed,
+            files,
+            tools,
+            findings,
+            duration_ms,
+        })
+    }
+
+    /// Starts an interactive session attached to the terminal and returns
+    /// its exit code. With a script, its directives (dependencies, toolchain
+    /// pin) apply and it is loaded before the prompt appears.
+    pub async fn repl(&self, lang: Option<&str>, script: Option<&Path>) -> Result<i32> {
+        // Without a script, stage an empty one so dependency and toolchain
+        // handling stays the same as for runs
+        let stub;
+        let path = match script {
+            Some(path) => path.to_path_buf(),
+            None => {
+                let name = lang.ok_or_else(|| {
+                    SingleloadError::InvalidInput("--lang is required without --script".to_string())
+                })?;
+                let (runner, _) = self.resolve_runner(Some(name), Path::new(""), &[])?;
+                stub = TempDir::new()?;
+                let path = stub.path().join(format!("repl{}", runner.file_extension()));
+                std::fs::write(&path, b"")?;
+                path
+            }
+        };
+
+        let prepared = self.prepare_script(lang, &path).await?;
+        let runner = prepared.runner.clone();
+        self.check_required_env(&prepared.directives)?;
+        let preload = script.map(|_| prepared.container_path.as_str());
+        let command = runner.repl(preload).ok_or_else(|| {
+            SingleloadError::InvalidInput(format!("{} has no interactive mode", runner.name()))
+        })?;
+
+        let ctx = prepared.context(CONTAINER_CACHE_DIR, None);
+        let container_name = PathSanitizer::generate_safe_container_name("singleload-repl");
+        let mut config = self.script_container_config(&prepared, &ctx, container_name.clone(), command);
+        config.interactive = true;
+        config.env.extend(self.env.iter().cloned());
+        if let Some(script) = script {
+            self.mount_state(&mut config, script)?;
+        }
+
+        info!("Starting {} session in container {}", runner.name(), container_name);
+        let container_id = self.container_manager.create_container(config).await?;
+        let result = self.container_manager.run_interactive(&container_id, self.timeout).await;
+        let _ = self.container_manager.remove_container(&container_id).await;
+
+        result
+    }
+
+    /// Builds a script with debug symbols and runs it under its language's
+    /// debugger, attached to the terminal or, with `--dap`, serving debug
+    /// adapter clients on the host; returns the session's exit code
+    pub async fn debug(&self, lang: Option<&str>, script_path: &Path) -> Result<i32> {
+        let dap = match &self.debugging {
+            Some(debugging) => debugging.dap,
+            None => return Err(SingleloadError::InvalidInput("no debugger was selected".to_string()).into()),
+        };
+        let prepared = self.prepare_script(lang, script_path).await?;
+        let runner = prepared.runner.clone();
+        let debugger = Debugger::for_language(runner.name())?;
+        self.check_required_env(&prepared.directives)?;
+        let arg_env = self.parse_script_args(&prepared.directives)?;
+        let ctx = prepared.context(CONTAINER_CACHE_DIR, None);
+
+        // yaegi has no debugger, so Go is always compiled
+        let (command, cache_mount) = self
+            .plan_command(&prepared, &ctx, self.cache.as_ref(), script_path, false, Instant::now())
+            .await?;
+
+        let container_name = PathSanitizer::generate_safe_container_name("singleload-debug");
+        let mut config = self.script_container_config(&prepared, &ctx, container_name.clone(), command);
+        config.interactive = true;
+        config.mounts.extend(cache_mount);
+        config.allowed_syscalls.extend(debugger.syscalls().iter().map(|s| s.to_string()));
+        config.env.extend(self.env.iter().cloned());
+        config.env.extend(arg_env);
+        self.mount_state(&mut config, script_path)?;
+        self.mount_work_dir(&mut config)?;
+        let egress = self.confine_network(&prepared.directives, &mut config).await?;
+        if let Some(addr) = dap {
+            if egress.is_some() {
+                return Err(SingleloadError::InvalidInput(
+                    "--dap cannot serve from a container confined by 'net allow' directives".to_string(),
+                )
+                .into());
+            }
+            // Ports are only published into a network namespace with a route
+            // out, which a sandbox without network must not get
+            if config.network_disabled && config.network_mode.is_none() {
+                return Err(SingleloadError::InvalidInput(
+                    "--dap needs a sandbox with network access; use --sandbox network or debug in the terminal".to_string(),
+                )
+                .into());
+            }
+            config.published_ports.push(addr);
+            info!(
+                "{} serves debug adapter clients on {}; attach your editor there{}",
+                debugger.name(true),
+                addr,
+                match debugger {
+                    Debugger::Lldb => format!(" and launch {}", shell_join(&runner.run(&ctx))),
+                    _ => String::new(),
+                }
+            );
+        }
+
+        info!("Starting {} for {} in container {}", debugger.name(dap.is_some()), script_path.display(), container_name);
+        let container_id = self.container_manager.create_container(config).await?;
+        let _relay = self.relay_egress(&container_id, egress.as_ref()).await?;
+        let result = self.container_manager.run_interactive(&container_id, self.timeout).await;
+        let _ = self.container_manager.remove_container(&container_id).await;
+
+        result
+    }
+
+    /// Compiles a script without running it and copies the produced
+    /// artifact to `output`
+    pub async fn build_script(
+        &self,
+        lang: Option<&str>,
+        script_path: &Path,
+        target: Option<&BuildTarget>,
+        output: &Path,
+    ) -> Result<BuildOutput> {
+        let start_time = Instant::now();
+        let started_at = chrono::Utc::now();
+
+        let prepared = self.prepare_script(lang, script_path).await?;
+        let runner = prepared.runner.clone();
+        if let Some(target) = target {
+            check_target(runner.as_ref(), target)?;
+        }
+        let ctx = prepared.context(CONTAINER_CACHE_DIR, target);
+
+        let build = runner.build(&ctx).ok_or_else(|| {
+            SingleloadError::InvalidInput(format!("{} scripts have no build step", runner.name()))
+        })?;
+        let artifact = runner.artifact(&ctx).ok_or_else(|| {
+            SingleloadError::InvalidInput(format!(
+                "{} builds do not produce a standalone binary",
+                runner.name()
+            ))
+        })?;
+
+        // Builds always go through a cache so the artifact can be read on the host
+        let scratch;
+        let cache = match &self.cache {
+            Some(cache) => cache.clone(),
+            None => {
+                scratch = TempDir::new()?;
+                BuildCache::new(scratch.path().to_path_buf())
+            }
+        };
+
+        let key = build_key(runner.as_ref(), &build, &ctx, &prepared.cache_source, &prepared.toolchain);
+        // The metadata is left out of the key; a cached build keeps its own
+        let stamped = stamped_build(runner.as_ref(), &ctx, &prepared.metadata).unwrap_or_else(|| build.clone());
+        // A concurrent build of the same key is waited for rather than repeated
+        let mut cached = cache.is_complete(&key);
+        let lock = match cached {
+            true => None,
+            false => cache.lock(&key, self.timeout).await?,
+        };
+        cached = cached || cache.is_complete(&key) || self.fetch_remote(&cache, &key, runner.name(), script_path).await;
+
+        self.events.emit(Event::Started {
+            language: runner.name().to_string(),
+            script: script_path.display().to_string(),
+        });
+
+        if cached {
+            debug!("Build cache hit for {}", key);
+            cache.touch(&key)?;
+            self.events.emit(Event::BuildCached { language: runner.name().to_string() });
+        } else {
+            self.events.emit(Event::BuildStarted { language: runner.name().to_string() });
+            cache.record_miss(runner.name());
+            let staging = cache.stage(&key, runner.name(), &script_path.display().to_string())?;
+            let (exit_code, stderr) = self
+                .build_in_container(&prepared, &ctx, &stamped, &staging.artifact_dir(), None)
+                .await?;
+            if exit_code != 0 || !staging.publish()? {
+                return Err(self.build_failed(&prepared, exit_code, &stderr, start_time));
+            }
+            drop(lock);
+            if let Some(remote) = &self.remote_cache {
+                remote.publish(&cache, &key).await;
+            }
+        }
+
+        let built = cache.artifact_dir(&key).join(&artifact);
+        if self.reproducible {
+            // Another build from scratch, in a fresh container, has to give
+            // the same bytes as the cached one
+            info!("Rebuilding {} to check that the build is reproducible", script_path.display());
+            let rebuild = TempDir::new()?;
+            let (exit_code, stderr) = self.build_in_container(&prepared, &ctx, &stamped, rebuild.path(), None).await?;
+            if exit_code != 0 {
+                return Err(self.build_failed(&prepared, exit_code, &stderr, start_time));
+            }
+            if let Err(e) = reproducible::compare(&built, &rebuild.path().join(&artifact)) {
+                // Neither build can be trusted to be the one others would get
+                cache.remove(&key)?;
+                self.events.emit(Event::Finished {
+                    exit_code: 1,
+                    duration_ms: start_time.elapsed().as_millis() as u64,
+                });
+                return Err(e.into());
+            }
+        }
+
+        copy_artifact(&built, output)?;
+        if self.reproducible {
+            reproducible::stamp(output)?;
+        }
+
+        let duration_ms = start_time.elapsed().as_millis() as u64;
+        self.events.emit(Event::Finished { exit_code: 0, duration_ms });
+
+        let provenance = Provenance {
+            language: runner.name().to_string(),
+            script: script_path.to_path_buf(),
+            source_sha256: hex::encode(Sha256::digest(&prepared.content)),
+            artifact: output.to_path_buf(),
+            artifact_sha256: hex::encode(Sha256::digest(std::fs::read(output)?)),
+            toolchain: prepared.toolchain.clone(),
+            build_command: build,
+            build_flags: prepared.build_flags.clone(),
+            target: target.map(|t| t.to_string()),
+            cache_key: key,
+            cached,
+            components: components(runner.as_ref(), &prepared),
+            started_at,
+            finished_at: chrono::Utc::now(),
+        };
+
+        Ok(BuildOutput {
+            language: runner.name().to_string(),
+            artifact: output.to_path_buf(),
+            cached,
+            reproducible: self.reproducible,
+            duration_ms,
+            provenance,
+            run: runner.run(&ctx),
+            env: runner.env(&ctx),
+        })
+    }
+
+    /// Runs `build` in a new container with `artifact_dir` as the cache
+    /// directory and `objects_dir`, if any, as the object directory, and
+    /// returns its exit code and stderr
+    async fn build_in_container(
+        &self,
+        prepared: &PreparedScript,
+        ctx: &BuildContext<'_>,
+        build: &str,
+        artifact_dir: &Path,
+        objects_dir: Option<&Path>,
+    ) -> Result<(i32, String)> {
+        let command = bash_command(format!(
+            "{} && {}",
+            build,
+            BuildCache::complete_command(CONTAINER_CACHE_DIR)
+        ));
+
+        let container_name = PathSanitizer::generate_safe_container_name("singleload-build");
+        let mut config = self.script_container_config(prepared, ctx, container_name.clone(), command);
+        config.mounts.push(Mount {
+            source: artifact_dir.to_string_lossy().to_string(),
+            target: CONTAINER_CACHE_DIR.to_string(),
+            read_only: false,
+        });
+        if let Some(dir) = objects_dir {
+            config.mounts.push(Mount {
+                source: dir.to_string_lossy().to_string(),
+                target: CONTAINER_OBJECTS_DIR.to_string(),
+                read_only: false,
+            });
+        }
+
+        info!("Building {} script in container {}", prepared.runner.name(), container_name);
+        let container_id = self.container_manager.create_container(config).await?;
+        let (exit_code, _stdout, stderr, _) = self
+            .execute_in_container(&container_id, self.timeout, false, never_cancelled())
+            .await?;
+        Ok((exit_code, stderr))
+    }
+
+    /// Where a C or C++ build keeps its objects, so the sources that did not
+    /// change since the script was last built are not compiled again: the
+    /// script's own object directory and the container path of the object
+    /// of each source. An object is named after the command compiling one
+    /// source, the toolchain, the source and every other file staged with
+    /// the script, such as its headers. None for other languages and for
+    /// cross builds.
+    fn object_cache(
+        &self,
+        prepared: &PreparedScript,
+        ctx: &BuildContext<'_>,
+        cache: &BuildCache,
+        source: &Path,
+    ) -> Result<Option<(PathBuf, Vec<String>)>> {
+        let runner = prepared.runner.as_ref();
+        if !matches!(runner.name(), "c" | "cpp") || ctx.target.is_some() {
+            return Ok(None);
+        }
+        let compile = runner
+            .build(&BuildContext { script_path: "", sources: &[], out_dir: "", ..ctx.clone() })
+            .unwrap_or_default();
+        let units: Vec<&str> = std::iter::once(ctx.script_path).chain(ctx.sources.iter().map(|s| s.as_str())).collect();
+
+        let mut staged = Vec::new();
+        collect_staged(prepared.workspace.path(), &mut staged)?;
+        staged.sort();
+        let mut others = Sha256::new();
+        for file in &staged {
+            let relative = file.strip_prefix(prepared.workspace.path()).unwrap_or(file);
+            let container = format!("/workspace/{}", relative.to_string_lossy());
+            if !units.contains(&container.as_str()) {
+                others.update(container.as_bytes());
+                others.update([0]);
+                others.update(Sha256::digest(std::fs::read(file)?));
+            }
+        }
+        let others = others.finalize();
+
+        let mut paths = Vec::new();
+        for unit in &units {
+            let host = prepared.workspace.path().join(unit.trim_start_matches("/workspace/"));
+            let mut hasher = Sha256::new();
+            for part in [compile.as_str(), prepared.toolchain.as_str(), prepared.image.as_deref().unwrap_or(""), unit] {
+                hasher.update(part.as_bytes());
+                hasher.update([0]);
+            }
+            hasher.update(others);
+            hasher.update(std::fs::read(host)?);
+            paths.push(format!("{}/{}.o", CONTAINER_OBJECTS_DIR, &hex::encode(hasher.finalize())[..32]));
+        }
+        Ok(Some((cache.objects_dir(&source.display().to_string())?, paths)))
+    }
+
+    /// Reports a failed build with the compiler's diagnostics
+    fn build_failed(&self, prepared: &PreparedScript, exit_code: i32, stderr: &str, start_time: Instant) -> anyhow::Error {
+        let stderr = prepared.source_map.translate(stderr);
+        self.emit_diagnostics(&stderr, &prepared.source_map);
+        self.events.emit(Event::Finished {
+            exit_code,
+            duration_ms: start_time.elapsed().as_millis() as u64,
+        });
+        SingleloadError::Container(format!("Build failed (exit code {}): {}", exit_code, stderr)).into()
+    }
+
+    /// Builds a compiled script into a binary that runs natively on this
+    /// host, cross-compiling where the container's platform differs
+    pub async fn build_for_host(&self, lang: Option<&str>, script_path: &Path, output: &Path) -> Result<BuildOutput> {
+        let language = self.prepare_script(lang, script_path).await?.runner.name().to_string();
+        let target = platform::host_target(&language).ok_or_else(|| {
+            SingleloadError::InvalidInput(format!(
+                "{} scripts cannot be built into a native {} binary",
+                language,
+                std::env::consts::OS
+            ))
+        })?;
+        self.build_script(lang, script_path, target.as_ref(), output).await
+    }
+
+    /// Builds a compiled script and writes it to `output` as an export
+    /// archive that [`Self::run_imported`] runs without the toolchain, the
+    /// dependencies or the network
+    pub async fn export_script(
+        &self,
+        lang: Option<&str>,
+        script_path: &Path,
+        target: Option<&BuildTarget>,
+        output: &Path,
+    ) -> Result<ExportOutput> {
+        let start_time = Instant::now();
+        // The whole cache entry is exported, not only the main artifact
+        let cache = self.cache.clone().ok_or_else(|| {
+            SingleloadError::InvalidInput("Exports are built through the build cache".to_string())
+        })?;
+        let built = TempDir::new()?;
+        let build = self
+            .build_script(lang, script_path, target, &built.path().join("artifact"))
+            .await
+            .map_err(|e| match e.downcast_ref::<SingleloadError>() {
+                Some(SingleloadError::InvalidInput(_)) => anyhow::anyhow!(
+                    "{} (interpreted scripts can be shared with `bundle` instead)",
+                    e
+                ),
+                _ => e,
+            })?;
+        let provenance = &build.provenance;
+
+        let name = script_path
+            .file_stem()
+            .map(|s| s.to_string_lossy().to_string())
+            .unwrap_or_else(|| "program".to_string());
+        let script = script_path
+            .file_name()
+            .map(|s| s.to_string_lossy().to_string())
+            .unwrap_or_else(|| name.clone());
+        let lockfile = Lockfile::path_for(script_path);
+        let has_lockfile = lockfile.is_file();
+
+        let manifest = export::write(
+            export::Export {
+                manifest: ExportManifest {
+                    format: export::FORMAT_VERSION,
+                    name: name.clone(),
+                    language: build.language.clone(),
+                    run: build.run.clone(),
+                    env: build.env.clone(),
+                    lockfile: has_lockfile.then(|| format!("{}.lock", script)),
+                    script,
+                    source_sha256: provenance.source_sha256.clone(),
+                    toolchain: provenance.toolchain.clone(),
+                    target: provenance.target.clone(),
+                    cache_key: provenance.cache_key.clone(),
+                    files: Default::default(),
+                    created_at: chrono::Utc::now(),
+                    singleload_version: env!("CARGO_PKG_VERSION").to_string(),
+                },
+                artifact_dir: &cache.artifact_dir(&provenance.cache_key),
+                script: script_path,
+                lockfile: has_lockfile.then_some(lockfile.as_path()),
+                provenance: serde_json::to_value(provenance)?,
+            },
+            output,
+        )?;
+
+        Ok(ExportOutput {
+            name,
+            language: build.language,
+            archive: output.to_path_buf(),
+            cached: build.cached,
+            files: manifest.files.len(),
+            duration_ms: start_time.elapsed().as_millis() as u64,
+        })
+    }
+
+    /// Runs a program from an export archive. Nothing is built or resolved:
+    /// the exported artifact directory is mounted where the build cache
+    /// entry was, so only the base image is needed.
+    pub async fn run_imported(&self, program: &Imported, keep_container: bool) -> Result<ExecutionResult> {
+        let start_time = Instant::now();
+        let manifest = &program.manifest;
+        self.events.emit(Event::Started {
+            language: manifest.language.clone(),
+            script: program.source().display().to_string(),
+        });
+
+        let mut command = manifest.run.clone();
+        command.extend(self.run_args.iter().cloned());
+        let container_name = PathSanitizer::generate_safe_container_name("singleload");
+        let mut config = self.container_config(container_name.clone(), command);
+        config.mounts.push(Mount {
+            source: program.artifact_dir().to_string_lossy().to_string(),
+            target: CONTAINER_CACHE_DIR.to_string(),
+            read_only: true,
+        });
+        config.env.push(("PATH".to_string(), search_path(None)));
+        config.env.extend(manifest.env.iter().cloned());
+        config.env.extend(self.env.iter().cloned());
+        self.mount_work_dir(&mut config)?;
+        if self.registry.get(&manifest.language).is_some_and(|runner| runner.gpu().is_some()) {
+            config.devices = self.container_manager.config.gpu_devices.clone();
+        }
+        config.read_only = self.sandbox.read_only && !keep_container;
+
+        info!("Creating container {} for exported {} program", container_name, manifest.name);
+        let container_id = self.container_manager.create_container(config).await?;
+        self.events.emit(Event::ContainerCreated { id: container_id.clone() });
+
+        let exec_result = self
+            .execute_in_container(&container_id, self.timeout, keep_container, never_cancelled())
+            .await;
+        let duration_ms = start_time.elapsed().as_millis() as u64;
+        match exec_result {
+            Ok((exit_code, stdout, stderr, truncated)) => {
+                self.events.emit(Event::Finished { exit_code, duration_ms });
+                Ok(ExecutionResult::success(exit_code as u32, stdout, stderr, duration_ms, truncated))
+            }
+            Err(e) => {
+                if !keep_container {
+                    let _ = self.container_manager.remove_container(&container_id).await;
+                }
+                Ok(ExecutionResult::error(e.to_string(), duration_ms))
+            }
+        }
+    }
+
+    /// Installs the script as the command `name`. Compiled languages are
+    /// built into a binary; other languages, or every language with `wrap`,
+    /// get a launcher that runs the script in the sandbox.
+    pub async fn install_script(
+        &self,
+        lang: Option<&str>,
+        script_path: &Path,
+        tools: &ToolStore,
+        name: &str,
+        wrap: bool,
+    ) -> Result<Tool> {
+        let prepared = self.prepare_script(lang, script_path).await?;
+        let runner = prepared.runner.clone();
+        let ctx = prepared.context(CONTAINER_CACHE_DIR, None);
+        let compiled = runner.build(&ctx).is_some() && runner.artifact(&ctx).is_some();
+        drop(prepared);
+
+        // Binaries only make sense where they run natively; elsewhere the
+        // script is installed behind a launcher instead
+        let target = platform::host_target(runner.name()).filter(|_| compiled && !wrap);
+
+        let script = script_path.canonicalize()?;
+        let kind = if let Some(target) = target {
+            self.build_script(lang, script_path, target.as_ref(), &tools.path(name)).await?;
+            ToolKind::Binary
+        } else {
+            tools.write_launcher(name, &std::env::current_exe()?, &script)?;
+            ToolKind::Launcher
+        };
+
+        let tool = Tool {
+            name: name.to_string(),
+            script,
+            language: runner.name().to_string(),
+            kind,
+            installed_at: chrono::Utc::now(),
+        };
+        tools.record(&tool)?;
+        Ok(tool)
+    }
+
+    /// Builds the script for linux on this machine's architecture, which
+    /// podman builds the image and pulls its base for, and wraps the binary
+    /// in a minimal OCI image tagged `tag`, pushing it to the tag's registry
+    /// when `push` is set
+    pub async fn package_script(
+        &self,
+        lang: Option<&str>,
+        script_path: &Path,
+        tag: &str,
+        push: bool,
+    ) -> Result<PackageOutput> {
+        let start_time = Instant::now();
+
+        // Other compilers already build for the container's platform
+        let language = self.prepare_script(lang, script_path).await?.runner.name().to_string();
+        let target = (language == "go").then(|| BuildTarget {
+            goos: Some("linux".to_string()),
+            goarch: Some(artifacts::host_goarch().to_string()),
+            triple: None,
+        });
+
+        let context = TempDir::new()?;
+        let build = self
+            .build_script(lang, script_path, target.as_ref(), &context.path().join(package::IMAGE_BINARY))
+            .await?;
+
+        let base = self
+            .registry
+            .get(&build.language)
+            .and_then(|runner| runner.image_base().map(str::to_string))
+            .ok_or_else(|| {
+                SingleloadError::InvalidInput(format!("{} programs cannot be packaged as images", build.language))
+            })?;
+        std::fs::write(context.path().join("Containerfile"), package::containerfile(&base))?;
+
+        let labels = vec![
+            ("singleload.language".to_string(), build.language.clone()),
+            (
+                "org.opencontainers.image.title".to_string(),
+                script_path.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default(),
+            ),
+        ];
+        info!("Packaging {} as {}", script_path.display(), tag);
+        self.container_manager.build_image(context.path(), tag, labels).await?;
+
+        if push {
+            info!("Pushing {}", tag);
+            self.container_manager.push_image(tag).await?;
+        }
+
+        Ok(PackageOutput {
+            language: build.language,
+            image: tag.to_string(),
+            base,
+            cached: build.cached,
+            pushed: push,
+            duration_ms: start_time.elapsed().as_millis() as u64,
+        })
+    }
+
+    /// Packs an interpreted script, its assets and its resolved dependencies
+    /// into a self-extracting executable at `output`
+    pub async fn bundle_script(&self, lang: Option<&str>, script_path: &Path, output: &Path) -> Result<BundleOutput> {
+        let start_time = Instant::now();
+        let (prepared, launch) = self.bundle_launch(lang, script_path).await?;
+        let deps = prepared.deps_mount.as_ref().map(|mount| PathBuf::from(&mount.source));
+        let payload = bundle::payload(prepared.workspace.path(), deps.as_deref())?;
+        bundle::write(output, &bundle::launcher(&launch, &payload), &payload)?;
+
+        Ok(BundleOutput {
+            language: launch.language,
+            bundle: output.to_path_buf(),
+            runtime: launch.runtime_version,
+            dependencies: prepared.dependencies.len(),
+            size_bytes: std::fs::metadata(output)?.len(),
+            duration_ms: start_time.elapsed().as_millis() as u64,
+        })
+    }
+
+    /// Stages an interpreted script with its dependencies and works out how
+    /// a bundle runs it with the host runtime
+    async fn bundle_launch(&self, lang: Option<&str>, script_path: &Path) -> Result<(PreparedScript, bundle::Launch)> {
+        let prepared = self.prepare_script(lang, script_path).await?;
+        let runner = prepared.runner.clone();
+
+        // The bundle runs the script from its unpack directory with the host runtime
+        let container_path = prepared.container_path.replacen("/workspace", &format!("{}/workspace", bundle::BUNDLE_ROOT), 1);
+        let sources: Vec<String> = prepared
+            .sources
+            .iter()
+            .map(|s| s.replacen("/workspace", &format!("{}/workspace", bundle::BUNDLE_ROOT), 1))
+            .collect();
+        let deps_dir = format!("{}/deps", bundle::BUNDLE_ROOT);
+        let ctx = BuildContext {
+            script_path: &container_path,
+            sources: &sources,
+            assets: &prepared.assets,
+            out_dir: CONTAINER_CACHE_DIR,
+            deps_dir: &deps_dir,
+            dependencies: &prepared.dependencies,
+            target: None,
+            build_flags: &prepared.build_flags,
+            libraries: &prepared.libraries,
+            gpu_archs: &prepared.gpu_archs,
+            objects: &[],
+        };
+        if runner.build(&ctx).is_some() {
+            return Err(SingleloadError::InvalidInput(format!(
+                "{} scripts are compiled; use 'singleload build' for a standalone binary",
+                runner.name()
+            ))
+            .into());
+        }
+
+        let command = runner.run(&ctx);
+        let runtime_version = self.runtime_version(&command[0]).await?;
+        let launch = bundle::Launch {
+            language: runner.name().to_string(),
+            env: runner.env(&ctx),
+            command,
+            runtime_version,
+        };
+        Ok((prepared, launch))
+    }
+
+    /// Runs the script on another machine over SSH instead of in a
+    /// container: compiled scripts are built for the host's platform,
+    /// interpreted ones are bundled with their dependencies for the host's
+    /// interpreter. The program is copied over, run with the terminal's
+    /// stdio and removed afterwards. Returns its exit code.
+    ///
+    /// Uploads are delta synced: the host keeps the chunks of what it was
+    /// sent before, and interpreted scripts go over unpacked rather than
+    /// as one compressed bundle, so an edit to the script or an asset
+    /// sends the changed chunks only.
+    pub async fn run_on_host(&self, lang: Option<&str>, script_path: &Path, host: &SshTarget) -> Result<i32> {
+        let platform = host.platform().await?;
+        let (language, compiled, arg_env) = {
+            let prepared = self.prepare_script(lang, script_path).await?;
+            let compiled = prepared.runner.build(&prepared.context(CONTAINER_CACHE_DIR, None)).is_some();
+            let arg_env = self.parse_script_args(&prepared.directives)?;
+            (prepared.runner.name().to_string(), compiled, arg_env)
+        };
+
+        let staging = TempDir::new()?;
+        let program = staging.path().join(ssh::REMOTE_PROGRAM);
+        let manifest = if compiled {
+            info!("Building {} for {}", script_path.display(), platform);
+            self.build_script(lang, script_path, platform.build_target(&language).as_ref(), &program)
+                .await?;
+            Manifest::scan(&[(ssh::REMOTE_PROGRAM, &program)])?
+        } else {
+            let (prepared, launch) = self.bundle_launch(lang, script_path).await?;
+            std::fs::write(&program, bundle::unpacked_launcher(&launch))?;
+            let mut roots = vec![(ssh::REMOTE_PROGRAM, program.as_path()), ("workspace", prepared.workspace.path())];
+            let deps = prepared.deps_mount.as_ref().map(|mount| PathBuf::from(&mount.source));
+            if let Some(deps) = &deps {
+                roots.push(("deps", deps.as_path()));
+            }
+            Manifest::scan(&roots)?
+        };
+
+        info!("Running {} script on {}", language, host.destination);
+        let (dir, stats) = host.sync(&manifest).await?;
+        info!(
+            "Sent {} of {} bytes in {} files to {}",
+            stats.sent_bytes, stats.bytes, stats.files, host.destination
+        );
+        let env: Vec<(String, String)> = self.env.iter().cloned().chain(arg_env).collect();
+        let exit_code = host.run_program(&dir, &self.run_args, &env).await?;
+        Ok(exit_code)
+    }
+
+    /// Resolves the script's inline dependencies and looks the installed
+    /// versions up in the OSV database
+    pub async fn audit_script(&self, lang: Option<&str>, script_path: &Path) -> Result<AuditReport> {
+        let start_time = Instant::now();
+        let prepared = self.prepare_script(lang, script_path).await?;
+        self.audit_prepared(&prepared, start_time).await
+    }
+
+    async fn audit_prepared(&self, prepared: &PreparedScript, start_time: Instant) -> Result<AuditReport> {
+        let components = components(prepared.runner.as_ref(), prepared);
+        let unpinned: Vec<String> = components
+            .iter()
+            .filter(|c| c.manager.is_none() || !c.version.as_deref().map_or(false, is_exact_version))
+            .map(|c| c.name.clone())
+            .collect();
+        let config = &self.container_manager.config;
+        let findings = OsvClient::new(&config.osv_url, &config.proxy)?.scan(&components).await?;
+
+        Ok(AuditReport {
+            language: prepared.runner.name().to_string(),
+            scanned: components.len() - unpinned.len(),
+            unpinned,
+            findings,
+            duration_ms: start_time.elapsed().as_millis() as u64,
+        })
+    }
+
+    /// Applies `--audit` to a prepared script. A scan that cannot complete
+    /// stops a denying run rather than letting it through unchecked.
+    async fn enforce_audit(&self, prepared: &PreparedScript) -> Result<()> {
+        if self.audit == AuditMode::Off || prepared.dependencies.is_empty() {
+            return Ok(());
+        }
+        let report = match self.audit_prepared(prepared, Instant::now()).await {
+            Ok(report) => report,
+            Err(e) if self.audit == AuditMode::Warn => {
+                warn!("Dependency audit failed: {}", e);
+                return Ok(());
+            }
+            Err(e) => return Err(e),
+        };
+
+        for finding in &report.findings {
+            for vulnerability in &finding.vulnerabilities {
+                warn!(
+                    "{} {}: {} ({}) {}",
+                    finding.name, finding.version, vulnerability.id, vulnerability.severity, vulnerability.summary
+                );
+            }
+        }
+        if self.audit == AuditMode::Deny {
+            if let Some(reason) = report.denied() {
+                return Err(SingleloadError::SecurityViolation(reason).into());
+            }
+        } else if !report.unpinned.is_empty() {
+            warn!("Not audited, no exact version: {}", report.unpinned.join(", "));
+        }
+        Ok(())
+    }
+
+    /// Installs the script's pinned toolchain and inline dependencies into
+    /// the caches without building or running it. Anything already cached is
+    /// kept, so later runs work without network access.
+    pub async fn fetch_script(&self, lang: Option<&str>, script_path: &Path) -> Result<FetchOutput> {
+        let start_time = Instant::now();
+
+        let prepared = self.prepare_script(lang, script_path).await?;
+        Ok(FetchOutput {
+            language: prepared.runner.name().to_string(),
+            dependencies: prepared.dependencies.iter().map(|d| d.spec()).collect(),
+            toolchain: prepared.toolchain_version.clone(),
+            duration_ms: start_time.elapsed().as_millis() as u64,
+        })
+    }
+
+    /// Builds a compiled script into the build cache without running it, so
+    /// the runs that follow start from the cached build. Without the cache
+    /// every run builds for itself, and there is nothing to do.
+    pub async fn prebuild_script(&self, lang: Option<&str>, script_path: &Path) -> Result<()> {
+        if self.cache.is_none() {
+            return Ok(());
+        }
+        let prepared = self.prepare_script(lang, script_path).await?;
+        if let Some(target) = &self.target {
+            check_target(prepared.runner.as_ref(), target)?;
+        }
+        let ctx = prepared.context(CONTAINER_CACHE_DIR, self.target.as_ref());
+        self.plan_command(&prepared, &ctx, self.cache.as_ref(), script_path, false, Instant::now())
+            .await?;
+        Ok(())
+    }
+
+    /// Resolves a script the way a run would, without installing or running
+    /// anything, and reports each decision along the way
+    pub async fn explain_script(&self, lang: Option<&str>, script_path: &Path) -> Result<Explanation> {
+        let prepared = self.prepare(lang, script_path, true).await?;
+        let runner = prepared.runner.as_ref();
+        if let Some(target) = &self.target {
+            check_target(runner, target)?;
+        }
+        let ctx = prepared.context(CONTAINER_CACHE_DIR, self.target.as_ref());
+
+        let (cache_key, cached, build_command) = match (&self.cache, runner.build(&ctx)) {
+            (Some(cache), Some(build)) => {
+                let key = build_key(runner, &build, &ctx, &prepared.cache_source, &prepared.toolchain);
+                let cached = cache.is_complete(&key);
+                (Some(key), cached, stamped_build(runner, &ctx, &prepared.metadata))
+            }
+            // Without the cache the build goes to the container's scratch space
+            (None, Some(_)) => {
+                let ctx = BuildContext { out_dir: "/tmp/build", ..ctx.clone() };
+                (None, false, stamped_build(runner, &ctx, &prepared.metadata))
+            }
+            (_, None) => (None, false, None),
+        };
+        let run_command = match &self.cache {
+            Some(_) => self.run_command(runner, &ctx),
+            None => self.run_command(runner, &BuildContext { out_dir: "/tmp/build", ..ctx.clone() }),
+        };
+
+        let (dependencies_key, dependencies_cached) = match (&self.cache, prepared.dependencies.is_empty()) {
+            (Some(cache), false) => {
+                let key = dependencies_key(runner, &prepared.toolchain, &prepared.dependencies, &prepared.content);
+                let cached = cache.is_complete(&key);
+                (Some(key), cached)
+            }
+            _ => (None, false),
+        };
+
+        Ok(Explanation {
+            script: script_path.to_path_buf(),
+            language: runner.name().to_string(),
+            detected_by: prepared.detected_by.clone(),
+            toolchain_installed: prepared
+                .toolchain_version
+                .as_ref()
+                .is_some_and(|version| self.toolchains.is_installed(runner.name(), version)),
+            toolchain: prepared.toolchain_version.clone(),
+            toolchain_pinned_by: prepared.toolchain_origin.clone(),
+            dependencies: prepared.dependencies.iter().map(|d| d.spec()).collect(),
+            lockfile: prepared.lockfile.clone(),
+            dependencies_key,
+            dependencies_cached,
+            build_flags: prepared.build_flags.clone(),
+            cache_key,
+            cached,
+            build_command,
+            run_command,
+            timeout_secs: self.timeout.as_secs(),
+            memory_mb: self.memory_limit / (1024 * 1024),
+            cpu_limit: self.cpu_limit,
+            network: self.sandbox.network,
+        })
+    }
+
+    /// Major and minor version of `interpreter` in the base image, which
+    /// bundled dependencies were installed for
+    async fn runtime_version(&self, interpreter: &str) -> Result<Option<String>> {
+        let config = ContainerConfig {
+            image: self.container_manager.config.base_image_name.clone(),
+            name: PathSanitizer::generate_safe_container_name("singleload-version"),
+            command: vec![interpreter.to_string(), "--version".to_string()],
+            memory_limit: self.memory_limit,
+            cpu_limit: self.cpu_limit,
+            timeout: self.timeout,
+            network_disabled: true,
+            ..Default::default()
+        };
+        let container_id = self.container_manager.create_container(config).await?;
+        let (_, stdout, stderr, _) = self
+            .execute_in_container(&container_id, self.timeout, false, never_cancelled())
+            .await?;
+        Ok(bundle::major_minor(&format!("{}{}", stdout, stderr)))
+    }
+
+    /// Validates the script, stages it in a temporary workspace and resolves
+    /// its inline dependencies
+    async fn prepare_script(&self, lang: Option<&str>, path: &Path) -> Result<PreparedScript> {
+        self.prepare(lang, path, false).await
+    }
+
+    /// Stages a script for building. A dry run resolves everything the same
+    /// way but installs neither the toolchain nor the dependencies.
+    async fn prepare(&self, lang: Option<&str>, path: &Path, dry_run: bool) -> Result<PreparedScript> {
+        // Directories with a singleload.toml are built as one program from their main file
+        let project = if Project::is_project(path) {
+            Some(Project::load(path, &self.registry)?)
+        } else {
+            None
+        };
+        let script_path = project.as_ref().map_or(path, |p| p.main.as_path());
+        let lang_given = lang.is_some();
+        let lang = lang.or(project.as_ref().and_then(|p| p.lang.as_deref()));
+
+        // Validate script path
+        self.security_validator.validate_script_path(script_path)?;
+
+        // Read and validate script content
+        let script_content = std::fs::read(script_path)?;
+        self.security_validator.validate_script_content(&script_content)?;
+        if let Some(key) = &self.verifying_key {
+            signing::verify_file(script_path, &script_content, key)?;
+        }
+        self.container_manager.config.policy.verify(script_path, &script_content)?;
+        // Everything staged from the host, as read, for the trust check
+        let mut trusted = Sha256::new();
+        trusted_input(&mut trusted, "", &script_content);
+
+        // The shebang takes part in detection before it is blanked
+        let (runner, mut detected_by) = self.resolve_runner(lang, script_path, &script_content)?;
+        if lang.is_some() && !lang_given {
+            detected_by = format!("lang in {}", crate::project::MANIFEST_FILE);
+        }
+
+        // Scripts may be executable with `#!/usr/bin/env singleload`
+        let script_content = strip_shebang(&script_content).into_owned();
+        // Directives are read from the source as written; only what gets
+        // compiled and cached goes through the preprocessors
+        let mut staged_content = self.preprocess(runner.name(), script_content.clone())?;
+        if let Some(selection) = &self.cells {
+            if runner.name() != "python" {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "cells are only supported for Python scripts, not {}",
+                    runner.name()
+                ))
+                .into());
+            }
+            staged_content = cells::python_program(&String::from_utf8_lossy(&staged_content), selection)?.into_bytes();
+        }
+        if let Some(name) = &self.entry {
+            let declared = Directives::parse(&script_content).entries()?;
+            let Some(entry) = declared.iter().find(|e| &e.name == name) else {
+                let names: Vec<&str> = declared.iter().map(|e| e.name.as_str()).collect();
+                return Err(SingleloadError::InvalidInput(if names.is_empty() {
+                    format!("{} declares no entries", script_path.display())
+                } else {
+                    format!("{} has no entry '{}'; it declares {}", script_path.display(), name, names.join(", "))
+                })
+                .into());
+            };
+            staged_content = entries::dispatch(runner.name(), &staged_content, &entry.func)?;
+        }
+        if let Some(profiling) = &self.profiling {
+            Profiler::for_language(runner.name(), profiling.kind)?;
+            staged_content = profiling::instrument(runner.name(), &staged_content);
+        }
+        if self.debugging.is_some() {
+            Debugger::for_language(runner.name())?;
+        }
+
+        // Create temporary directory for script; project files keep their
+        // names so they can refer to each other
+        let temp_dir = TempDir::new()?;
+        let container_script_name = match &project {
+            Some(_) => file_name(script_path)?,
+            None => runner.script_name(&staged_content),
+        };
+        let temp_script_path = temp_dir.path().join(&container_script_name);
+        std::fs::write(&temp_script_path, &staged_content)?;
+
+        // Files pulled in with `uses` are built with the script, like the
+        // sources of a directory project
+        let used = uses::resolve(script_path)?;
+        let mut originals: Vec<PathBuf> = project.iter().flat_map(|p| p.sources.iter().cloned()).collect();
+        for file in &used {
+            // Only source files of the script's language; uses::resolve
+            // already keeps them inside the script's directory
+            let same_language = file.name.ends_with(runner.file_extension())
+                || (script_path.extension().is_some() && file.source.extension() == script_path.extension());
+            if !same_language {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "uses {}: only {} files can be used by a {} script",
+                    file.source.display(),
+                    runner.file_extension(),
+                    runner.name()
+                ))
+                .into());
+            }
+            if file.name == container_script_name {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "uses {}: the file would replace the script",
+                    file.source.display()
+                ))
+                .into());
+            }
+            if !originals.iter().any(|o| o.canonicalize().is_ok_and(|o| o == file.source)) {
+                originals.push(file.source.clone());
+            }
+        }
+
+        let mut cache_source = self.hashed(runner.name(), &staged_content).into_owned();
+        let mut content = staged_content;
+        let mut sources = Vec::new();
+        for source in &originals {
+            self.security_validator.validate_script_path(source)?;
+            let data = std::fs::read(source)?;
+            self.security_validator.validate_script_content(&data)?;
+            if let Some(key) = &self.verifying_key {
+                signing::verify_file(source, &data, key)?;
+            }
+            self.container_manager.config.policy.verify(source, &data)?;
+            let name = file_name(source)?;
+            trusted_input(&mut trusted, &name, &data);
+            let data = self.preprocess(runner.name(), data)?;
+
+            std::fs::write(temp_dir.path().join(&name), &data)?;
+            sources.push(format!("/workspace/{}", name));
+
+            // Every source is part of the build cache key
+            let hashed = self.hashed(runner.name(), &data);
+            for (blob, data) in [(&mut cache_source, &*hashed), (&mut content, data.as_slice())] {
+                blob.push(0);
+                blob.extend_from_slice(name.as_bytes());
+                blob.push(0);
+                blob.extend_from_slice(&data);
+            }
+        }
+
+        // Stage embedded assets under their paths relative to the script
+        let directives = Directives::parse(&script_content);
+        self.check_lifecycle(script_path, &directives)?;
+        let policy = &self.container_manager.config.policy;
+        policy.check_network(self.sandbox.network, &directives.net_rules()?)?;
+        let script_dir = script_path.parent().unwrap_or(Path::new(""));
+        let mut assets = Vec::new();
+        for asset in assets::resolve(script_dir, &directives.embeds()?)? {
+            if asset.name == container_script_name || sources.contains(&format!("/workspace/{}", asset.name)) {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "embed '{}' would replace a source file",
+                    asset.name
+                ))
+                .into());
+            }
+            let data = std::fs::read(&asset.source)?;
+            trusted_input(&mut trusted, &asset.name, &data);
+            let staged = temp_dir.path().join(&asset.name);
+            if let Some(parent) = staged.parent() {
+                std::fs::create_dir_all(parent)?;
+            }
+            std::fs::write(&staged, &data)?;
+
+            // Compiled languages embed the assets, so they are part of the cache key too
+            for blob in [&mut cache_source, &mut content] {
+                blob.push(0);
+                blob.extend_from_slice(asset.name.as_bytes());
+                blob.push(0);
+                blob.extend_from_slice(&data);
+            }
+            assets.push(asset.name);
+        }
+        // Directives no longer show in normalized sources; those that can
+        // change the build are keyed on directly
+        if !self.strict_hash {
+            cache_source.push(0);
+            cache_source.extend_from_slice(&normalize::build_directives(&directives));
+        }
+        let hooks = Hooks::resolve(&self.container_manager.config.hooks, &directives, script_dir, temp_dir.path())?;
+        if let Some(known) = self.known.as_ref().filter(|_| !dry_run) {
+            let hooks_dir = temp_dir.path().join(HOOKS_DIR);
+            let mut staged: Vec<_> = match std::fs::read_dir(&hooks_dir) {
+                Ok(entries) => entries.map(|entry| entry.map(|e| e.file_name())).collect::<std::io::Result<_>>()?,
+                Err(_) => Vec::new(),
+            };
+            staged.sort();
+            for name in staged {
+                let data = std::fs::read(hooks_dir.join(&name))?;
+                trusted_input(&mut trusted, &format!("{}/{}", HOOKS_DIR, name.to_string_lossy()), &data);
+            }
+            known.confirm(&hex::encode(trusted.finalize()))?;
+        }
+
+        // Resolve inline dependencies declared in the script header
+        let container_path = format!("/workspace/{}", container_script_name);
+        let declared = directives.dependencies()?;
+        let lock_path = Lockfile::path_for(script_path);
+        let lock = self.fresh_lockfile(runner.as_ref(), &lock_path, &declared)?;
+        let dependencies = match &lock {
+            Some(lock) => lock.pinned(&declared),
+            None => declared.clone(),
+        };
+
+        let pin = self.pinned_version(runner.as_ref(), &directives, script_dir);
+        // Containerized runs take the pinned version from the interpreter
+        // image instead of installing it
+        let image = match self.containerized {
+            true => {
+                let image = self.interpreter_image(runner.name(), pin.as_ref().map(|(version, _)| version.as_str()))?;
+                Some(self.pin_image_digest(image, dry_run).await?)
+            }
+            false => None,
+        };
+        // Nix runs take it, the Python packages and the libraries from nixpkgs
+        let nix_shell = match self.nix {
+            true => Some(NixShell::resolve(
+                runner.name(),
+                pin.as_ref().map(|(version, _)| version.as_str()),
+                &dependencies,
+                &directives.pkg_config()?,
+                &self.container_manager.config.nixpkgs,
+            )?),
+            false => None,
+        };
+
+        // Builds are keyed on the toolchain: the base image, plus a pinned version if any
+        let mut toolchain = match &image {
+            Some(image) if dry_run => self.container_manager.image_id(image).await?.unwrap_or_else(|| image.clone()),
+            Some(image) => self.container_manager.pull_image(image).await?,
+            None => self.container_manager.base_image_id().await?,
+        };
+        let nix_env = match &nix_shell {
+            Some(shell) => {
+                let (key, env) = self.resolve_nix_shell(shell, script_path, dry_run).await?;
+                toolchain = format!("{} nix {}", toolchain, key);
+                env
+            }
+            None => None,
+        };
+        let toolchain_mount = match &pin {
+            Some(_) if image.is_some() || nix_shell.is_some() => None,
+            Some((version, _)) => {
+                toolchain = format!("{} {} {}", toolchain, runner.name(), version);
+                match dry_run {
+                    true => {
+                        ToolchainStore::validate_version(version)?;
+                        None
+                    }
+                    false => Some(self.install_toolchain(runner.as_ref(), version).await?),
+                }
+            }
+            None => None,
+        };
+        let (toolchain_version, toolchain_origin) = pin.unzip();
+
+        let (deps_mount, deps_scratch) = match dry_run {
+            true => (None, None),
+            false => {
+                // Python packages of Nix runs are part of the shell
+                let resolved: Vec<Dependency> = match nix_shell.is_some() {
+                    true => dependencies.iter().filter(|d| d.manager != PackageManager::Pip).cloned().collect(),
+                    false => dependencies.clone(),
+                };
+                self.resolve_dependencies(
+                    runner.as_ref(),
+                    &resolved,
+                    &container_path,
+                    &sources,
+                    &content,
+                    temp_dir.path(),
+                    &toolchain,
+                    toolchain_mount.as_ref(),
+                    image.as_deref(),
+                    lock.as_ref(),
+                )
+                .await?
+            }
+        };
+
+        let mut packages = Vec::new();
+        if let Some(mount) = &deps_mount {
+            let installed = runner.installed_packages(Path::new(&mount.source));
+            match &lock {
+                Some(lock) => {
+                    if let Some(pkg) = lock.mismatch(&installed) {
+                        return Err(SingleloadError::SecurityViolation(format!(
+                            "{} {} does not match {}",
+                            pkg.name,
+                            pkg.version,
+                            lock_path.display()
+                        ))
+                        .into());
+                    }
+                    self.save_snapshot(runner.name(), &toolchain, lock, Path::new(&mount.source));
+                }
+                None if !installed.is_empty() => {
+                    let lock = Lockfile::new(runner.name(), &declared, installed.clone());
+                    match lock.save(&lock_path) {
+                        Ok(()) => info!("Wrote {}", lock_path.display()),
+                        Err(e) => warn!("Failed to write {}: {}", lock_path.display(), e),
+                    }
+                    self.save_snapshot(runner.name(), &toolchain, &lock, Path::new(&mount.source));
+                }
+                None => {}
+            }
+            packages = installed;
+        }
+
+        // --profile wins over the script's own profile directive
+        let profile_name = match (&self.profile, directives.first("profile")) {
+            (Some(name), _) => name.clone(),
+            (None, Some(directive)) => directive.value.trim().to_string(),
+            (None, None) => DEFAULT_PROFILE.to_string(),
+        };
+        let profile = BuildProfile::resolve(&profile_name, &self.container_manager.config.build_profiles)?;
+        let mut build_flags = profile.flags_for(runner.name()).to_vec();
+        if self.reproducible {
+            build_flags.extend(reproducible::flags(runner.name()));
+        }
+        if let Some(debugger) = self.debugger(runner.as_ref()) {
+            build_flags.extend(debugger.build_flags(runner.name()));
+        }
+        build_flags.extend(directives.build_flags()?);
+        build_flags.extend(self.build_args.iter().cloned());
+        let libraries = directives.pkg_config()?;
+        let gpu_archs = directives.cuda_archs()?;
+        let metadata = BuildMetadata::new(&content, self.reproducible);
+
+        let mut source_map = SourceMap::new();
+        source_map.add(&container_path, script_path);
+        for (staged, original) in sources.iter().zip(&originals) {
+            source_map.add(staged, original);
+        }
+        let ctx = BuildContext {
+            script_path: &container_path,
+            sources: &sources,
+            assets: &assets,
+            out_dir: CONTAINER_CACHE_DIR,
+            deps_dir: CONTAINER_DEPS_DIR,
+            dependencies: &dependencies,
+            target: None,
+            build_flags: &[],
+            libraries: &[],
+            gpu_archs: &[],
+            objects: &[],
+        };
+        for (staged, copy) in runner.relocations(&ctx) {
+            source_map.alias(&staged, &copy);
+        }
+
+        Ok(PreparedScript {
+            runner,
+            detected_by,
+            content,
+            cache_source,
+            directives,
+            dependencies,
+            lockfile: lock.map(|_| lock_path),
+            packages,
+            toolchain,
+            toolchain_version,
+            toolchain_origin,
+            image,
+            nix_env,
+            container_path,
+            sources,
+            assets,
+            hooks,
+            workspace: temp_dir,
+            deps_mount,
+            toolchain_mount,
+            build_flags,
+            libraries,
+            gpu_archs,
+            metadata,
+            source_map,
+            _deps_scratch: deps_scratch,
+        })
+    }
+
+    /// Scripts with `net allow` directives reach the network only through
+    /// an egress proxy that permits the declared endpoints. Their container
+    /// has no network; [`Self::relay_egress`] connects it to the proxy once
+    /// created. The proxy runs until the returned handle is dropped.
+    async fn confine_network(&self, directives: &Directives, config: &mut ContainerConfig) -> Result<Option<EgressProxy>> {
+        let rules = directives.net_rules()?;
+        if rules.is_empty() {
+            return Ok(None);
+        }
+        if !self.sandbox.network {
+            return Err(SingleloadError::SecurityViolation(format!(
+                "'net allow {}' needs a sandbox with network access, such as --sandbox network",
+                rules[0]
+            ))
+            .into());
+        }
+        if !cfg!(target_os = "linux") {
+            return Err(SingleloadError::InvalidInput(
+                "'net allow' directives need Podman running on this Linux host".to_string(),
+            )
+            .into());
+        }
+        info!(
+            "Network limited to {}",
+            rules.iter().map(|rule| rule.to_string()).collect::<Vec<_>>().join(", ")
+        );
+
+        let proxy = EgressProxy::start(rules, self.events.clone()).await?;
+        config.network_disabled = true;
+        config.network_mode = None;
+        config.env.extend(proxy.env());
+        Ok(Some(proxy))
+    }
+
+    /// Initializes a created container behind an egress proxy and starts the
+    /// relay to the proxy in it, removing the container if that fails
+    async fn relay_egress(&self, container_id: &str, egress: Option<&EgressProxy>) -> Result<Option<Relay>> {
+        let Some(proxy) = egress else {
+            return Ok(None);
+        };
+        let relay = match self.container_manager.init_container(container_id).await {
+            Ok(pid) => proxy.relay_into(pid).await.map_err(|e| {
+                SingleloadError::Container(format!("Failed to connect the container to the egress proxy: {}", e)).into()
+            }),
+            Err(e) => Err(e),
+        };
+        if relay.is_err() {
+            let _ = self.container_manager.remove_container(container_id).await;
+        }
+        relay.map(Some)
+    }
+
+    /// A source as the build cache key sees it
+    fn hashed<'a>(&self, language: &str, source: &'a [u8]) -> Cow<'a, [u8]> {
+        match self.strict_hash {
+            true => Cow::Borrowed(source),
+            false => normalize::normalize_source(language, source),
+        }
+    }
+
+    /// Runs the preprocessors of `language` over a source file. Their output
+    /// is validated again since a command preprocessor can produce anything.
+    fn preprocess(&self, language: &str, src: Vec<u8>) -> Result<Vec<u8>> {
+        let src = match &self.template {
+            Some(template) => template.preprocess(&src)?,
+            None if self.preprocessors.is_empty(language) => return Ok(src),
+            None => src,
+        };
+        let output = self.preprocessors.apply(language, src)?;
+        self.security_validator.validate_script_content(&output)?;
+        Ok(output)
+    }
+
+    /// Container settings shared by build and run containers of a script
+    fn script_container_config(
+        &self,
+        prepared: &PreparedScript,
+        ctx: &BuildContext<'_>,
+        name: String,
+        command: Vec<String>,
+    ) -> ContainerConfig {
+        let command = match &prepared.nix_env {
+            Some(_) => flake::shell_command(&format!("{}/env.sh", CONTAINER_NIX_ENV_DIR), &command),
+            None => command,
+        };
+        let mut config = self.container_config(name, command);
+        if let Some(image) = &prepared.image {
+            config.image = image.clone();
+        }
+
+        // Mount the script directory
+        config.mounts.push(Mount {
+            source: prepared.workspace.path().to_string_lossy().to_string(),
+            target: "/workspace".to_string(),
+            read_only: true,
+        });
+
+        // Mount resolved dependencies
+        if let Some(mount) = &prepared.deps_mount {
+            config.mounts.push(mount.clone());
+        }
+
+        // Mount the pinned toolchain
+        if let Some(mount) = &prepared.toolchain_mount {
+            config.mounts.push(mount.clone());
+        }
+
+        // CUDA builds use the host's toolkit, which is too large for the image
+        if prepared.runner.gpu() == Some(GpuApi::Cuda) {
+            if let Some(dir) = gpu::cuda_dir(self.container_manager.config.cuda_dir.as_deref()) {
+                config.mounts.push(Mount {
+                    source: dir.to_string_lossy().to_string(),
+                    target: gpu::CONTAINER_CUDA_DIR.to_string(),
+                    read_only: true,
+                });
+                config.env.push(("CUDA_HOME".to_string(), gpu::CONTAINER_CUDA_DIR.to_string()));
+            }
+        }
+
+        // Nix owns its store, which the run only reads; the shell's own
+        // PATH comes first once its environment is loaded
+        match &prepared.nix_env {
+            Some(env) => {
+                config.image = flake::NIX_IMAGE.to_string();
+                config.user = "0:0".to_string();
+                config.mounts.push(Mount {
+                    source: self.nix_store.store_dir().to_string_lossy().to_string(),
+                    target: CONTAINER_NIX_DIR.to_string(),
+                    read_only: true,
+                });
+                config.mounts.push(Mount {
+                    source: env.to_string_lossy().to_string(),
+                    target: format!("{}/env.sh", CONTAINER_NIX_ENV_DIR),
+                    read_only: true,
+                });
+                config.env.push(("PATH".to_string(), flake::NIX_PATH.to_string()));
+            }
+            None => config.env.push(("PATH".to_string(), search_path(prepared.toolchain_mount.as_ref()))),
+        }
+
+        // For languages that need specific environment variables
+        config.env.extend(prepared.runner.env(ctx));
+        config.env.extend(prepared.metadata.env());
+        if self.reproducible {
+            config.env.extend(reproducible::env());
+        }
+
+        config
+    }
+
+    /// Container settings of the base image within the sandbox's limits
+    fn container_config(&self, name: String, command: Vec<String>) -> ContainerConfig {
+        let mut config = ContainerConfig {
+            image: self.container_manager.config.base_image_name.clone(),
+            name,
+            command,
+            memory_limit: self.sandbox.clamp_memory(self.memory_limit),
+            cpu_limit: self.sandbox.clamp_cpu(self.cpu_limit),
+            timeout: self.timeout,
+            network_disabled: !self.sandbox.network,
+            read_only: self.sandbox.read_only,
+            tmpfs_size_mb: self.sandbox.tmpfs_size_mb,
+            pids_limit: self.sandbox.pids_limit,
+            ..Default::default()
+        };
+
+        // Set environment variables
+        config.env.push(("HOME".to_string(), "/tmp".to_string()));
+        config.env.push(("USER".to_string(), "nonroot".to_string()));
+        config
+    }
+
+    /// The interpreter image of a containerized run of `language`
+    fn interpreter_image(&self, language: &str, version: Option<&str>) -> Result<String, SingleloadError> {
+        // The version ends up in an image reference
+        if let Some(version) = version {
+            ToolchainStore::validate_version(version)?;
+            images::validate_version(language, version)?;
+        }
+        images::interpreter_image(language, version, &self.container_manager.config.interpreter_images).ok_or_else(|| {
+            SingleloadError::InvalidInput(format!(
+                "containerized runs support {} scripts, not {}",
+                images::languages().join(", "),
+                language
+            ))
+        })
+    }
+
+    /// `image` at the digest it was first pulled at, see [`DigestPins`]; a
+    /// reference that names a digest already is used as it is. A dry run
+    /// does not pull an image it has no digest for.
+    async fn pin_image_digest(&self, image: String, dry_run: bool) -> Result<String> {
+        if image.contains('@') {
+            return Ok(image);
+        }
+        let pins = DigestPins::new(DigestPins::default_path());
+        if let Some(digest) = pins.get(&image)? {
+            return Ok(images::pinned(&image, &digest));
+        }
+        if dry_run {
+            return Ok(image);
+        }
+        if self.frozen {
+            return Err(SingleloadError::InvalidInput(format!(
+                "{} has no recorded digest in {}; run without --frozen to pull and pin it",
+                image,
+                pins.path().display()
+            ))
+            .into());
+        }
+        self.container_manager.pull_image(&image).await?;
+        let digest = self
+            .container_manager
+            .image_digest(&image)
+            .await?
+            .ok_or_else(|| SingleloadError::Container(format!("Podman reported no digest for {}", image)))?;
+        info!("Pinned {} at {}", image, digest);
+        pins.record(&image, &digest)?;
+        Ok(images::pinned(&image, &digest))
+    }
+
+    /// The runner for a script, and what chose it
+    fn resolve_runner(
+        &self,
+        lang: Option<&str>,
+        script_path: &Path,
+        content: &[u8],
+    ) -> Result<(Arc<dyn Runner>, String), SingleloadError> {
+        let (runner, reason) = match lang {
+            Some(name) => self
+                .registry
+                .get(name)
+                .map(|runner| (runner, "--lang".to_string()))
+                .ok_or_else(|| {
+                    SingleloadError::UnsupportedLanguage(format!(
+                        "{} (available: {})",
+                        name,
+                        self.registry.names().join(", ")
+                    ))
+                }),
+            None => self.registry.detect_with_reason(script_path, content).ok_or_else(|| {
+                SingleloadError::UnsupportedLanguage(format!(
+                    "could not detect language for {}, use --lang",
+                    script_path.display()
+                ))
+            }),
+        }?;
+
+        let allowed = &self.container_manager.config.allowed_languages;
+        if !allowed.is_empty() && !allowed.iter().any(|l| l.eq_ignore_ascii_case(runner.name())) {
+            return Err(SingleloadError::SecurityViolation(format!(
+                "{} scripts are not allowed by the configuration (allowed_languages: {})",
+                runner.name(),
+                allowed.join(", ")
+            )));
+        }
+        self.container_manager.config.policy.check_language(runner.name())?;
+        Ok((runner, reason))
+    }
+
+    async fn execute_in_container(
+        &self,
+        container_id: &str,
+        timeout: Duration,
+        keep_container: bool,
+        cancel: CancelReceiver,
+    ) -> Result<(i32, String, String, bool)> {
+        let (exit_code, stdout, stderr, truncated, _) = self
+            .execute_in_container_logged(container_id, timeout, keep_container, cancel, None, None)
+            .await?;
+        Ok((exit_code, stdout, stderr, truncated))
+    }
+
+    /// Like [`Self::execute_in_container`], writing the output to `log` as
+    /// it arrives
+    async fn execute_in_container_logged(
+        &self,
+        container_id: &str,
+        timeout: Duration,
+        keep_container: bool,
+        cancel: CancelReceiver,
+        log: Option<RunLog>,
+        measure_token: Option<&str>,
+    ) -> Result<(i32, String, String, bool, Option<String>)> {
+        // Start the container with the command
+        let follow = match log {
+            Some(log) => Some(self.container_manager.start_logged(container_id, log).await?),
+            None => {
+                self.container_manager.start_container(container_id).await?;
+                None
+            }
+        };
+
+        // Wait for container to finish, unless the run is cancelled first
+        let wait = tokio::select! {
+            result = self.wait_forwarding_signals(container_id, timeout) => result,
+            _ = wait_for_cancel(cancel) => {
+                info!("Cancelling container {}", container_id);
+                self.container_manager.stop_container(container_id).await;
+                Err(SingleloadError::Cancelled.into())
+            }
+        };
+
+        let exit_code = match wait {
+            Ok(code) => code,
+            Err(e) => {
+                warn!("Container execution failed: {}", e);
+                if !keep_container {
+                    let _ = self.container_manager.remove_container(container_id).await;
+                }
+                return Err(e);
+            }
+        };
+
+        // The attached output ends with the container, give it a moment to drain
+        if let Some(follow) = follow {
+            match tokio::time::timeout(LOG_DRAIN_TIMEOUT, follow).await {
+                Ok(Ok(log)) => {
+                    for path in log.paths() {
+                        info!("Output logged to {}", path.display());
+                    }
+                }
+                Ok(Err(e)) => warn!("Log capture failed: {}", e),
+                Err(_) => warn!("Log capture did not finish after the container exited"),
+            }
+        }
+
+        // Get logs
+        let (stdout, stderr) = self.container_manager.get_container_logs(container_id).await?;
+        // The records of a measured run end its stderr, and are split off
+        // before the limits
+        let (stderr, records) = match measure_token {
+            Some(token) => split_records(stderr, token),
+            None => (stderr, None),
+        };
+
+        // Apply output limits
+        let (stdout, stderr, truncated) = self.apply_output_limits(stdout, stderr);
+
+        // Clean up container unless debugging
+        if !keep_container {
+            self.container_manager.remove_container(container_id).await?;
+        } else {
+            info!("Container {} kept for debugging", container_id);
+        }
+
+        Ok((exit_code, stdout, stderr, truncated, records))
+    }
+
+    /// Waits for the container to exit, passing on the signals the wrapper
+    /// receives meanwhile. A container still running `kill_timeout` after
+    /// the first one is killed.
+    async fn wait_forwarding_signals(&self, container_id: &str, timeout: Duration) -> Result<i32> {
+        let Some(proxy) = &self.signals else {
+            return self.container_manager.wait_container(container_id, timeout).await;
+        };
+        let mut signals = proxy.subscribe();
+        let wait = self.container_manager.wait_container(container_id, timeout);
+        tokio::pin!(wait);
+
+        let mut kill_at = None;
+        let mut listening = true;
+        loop {
+            let kill = async {
+                match kill_at {
+                    Some(deadline) => tokio::time::sleep_until(deadline).await,
+                    None => std::future::pending().await,
+                }
+            };
+            tokio::select! {
+                result = &mut wait => return result,
+                received = signals.recv(), if listening => match received {
+                    Ok(signal) => {
+                        info!("Forwarding {} to container {}", signal.name(), container_id);
+                        self.container_manager.signal_container(container_id, signal.name()).await;
+                        kill_at.get_or_insert(tokio::time::Instant::now() + proxy.kill_timeout());
+                    }
+                    Err(broadcast::error::RecvError::Lagged(_)) => {}
+                    Err(broadcast::error::RecvError::Closed) => listening = false,
+                },
+                _ = kill => {
+                    warn!(
+                        "Container {} still running {}s after the signal, killing it",
+                        container_id,
+                        proxy.kill_timeout().as_secs()
+                    );
+                    self.container_manager.signal_container(container_id, "SIGKILL").await;
+                    kill_at = None;
+                }
+            }
+        }
+    }
+
+    /// Mounts the script's persistent state directory and points
+    /// SINGLELOAD_STATE_DIR at it, with the helper modules for it on the
+    /// Python and Node.js search paths
+    fn mount_state(&self, config: &mut ContainerConfig, script_path: &Path) -> Result<(), SingleloadError> {
+        let store = match &self.state {
+            Some(store) => store,
+            None => return Ok(()),
+        };
+        let dir = store.prepare(script_path)?;
+        config.mounts.push(Mount {
+            source: dir.to_string_lossy().to_string(),
+            target: CONTAINER_STATE_DIR.to_string(),
+            read_only: false,
+        });
+        config.mounts.push(Mount {
+            source: store.helpers()?.to_string_lossy().to_string(),
+            target: CONTAINER_HELPERS_DIR.to_string(),
+            read_only: true,
+        });
+        config.env.push((STATE_DIR_VAR.to_string(), CONTAINER_STATE_DIR.to_string()));
+        for var in ["PYTHONPATH", "NODE_PATH"] {
+            // After the dependencies or the user's own paths, if there are any
+            let value = match config.env.iter().rev().find(|(name, _)| name == var) {
+                Some((_, paths)) => format!("{}:{}", paths, CONTAINER_HELPERS_DIR),
+                None => CONTAINER_HELPERS_DIR.to_string(),
+            };
+            config.env.push((var.to_string(), value));
+        }
+        Ok(())
+    }
+
+    /// Where crashes of scripts are recorded, if they are: postmortems live
+    /// in the state entries, so runs without state keep none
+    fn postmortems(&self) -> Option<PostmortemStore> {
+        let state = self.state.as_ref().filter(|_| self.container_manager.config.postmortems)?;
+        Some(PostmortemStore::new(state.root().to_path_buf()))
+    }
+
+    fn mount_work_dir(&self, config: &mut ContainerConfig) -> std::io::Result<()> {
+        if let Some(dir) = &self.work_dir {
+            container::grant(dir, &config.user)?;
+            config.mounts.push(Mount {
+                source: dir.to_string_lossy().to_string(),
+                target: CONTAINER_WORK_DIR.to_string(),
+                read_only: false,
+            });
+            config.working_dir = Some(CONTAINER_WORK_DIR.to_string());
+        }
+        Ok(())
+    }
+
+    /// Fails before anything runs if a variable the script declares with
+    /// `env` was not passed
+    fn check_required_env(&self, directives: &Directives) -> Result<(), SingleloadError> {
+        let missing: Vec<String> = directives
+            .required_env()
+            .into_iter()
+            .filter(|(_, name)| !self.env.iter().any(|(key, _)| key == name))
+            .map(|(line, name)| format!("{} (line {})", name, line))
+            .collect();
+        if missing.is_empty() {
+            return Ok(());
+        }
+        Err(SingleloadError::InvalidInput(format!(
+            "Missing required environment variable{}: {}; pass it with --env or --env-file",
+            if missing.len() == 1 { "" } else { "s" },
+            missing.join(", ")
+        )))
+    }
+
+    /// Fails if the script needs another Singleload version than this one,
+    /// and warns about scripts marked `deprecated`, or refuses them with
+    /// `deny_deprecated`
+    fn check_lifecycle(&self, script_path: &Path, directives: &Directives) -> Result<(), SingleloadError> {
+        let version = env!("CARGO_PKG_VERSION");
+        let unmet: Vec<String> = directives
+            .version_requirements()?
+            .into_iter()
+            .filter(|(_, requirement)| !requirement.matches(version))
+            .map(|(line, requirement)| format!("{} (line {})", requirement, line))
+            .collect();
+        if !unmet.is_empty() {
+            return Err(SingleloadError::InvalidInput(format!(
+                "{} requires singleload {}, but this is {}",
+                script_path.display(),
+                unmet.join(", "),
+                version
+            )));
+        }
+        let Some(deprecation) = directives.deprecation() else {
+            return Ok(());
+        };
+        let message = match deprecation.value.is_empty() {
+            true => format!("{} is deprecated", script_path.display()),
+            false => format!("{} is deprecated: {}", script_path.display(), deprecation.value),
+        };
+        if self.container_manager.config.deny_deprecated {
+            return Err(SingleloadError::InvalidInput(format!(
+                "{} (line {}); deny_deprecated is set",
+                message, deprecation.line
+            )));
+        }
+        warn!("{}", message);
+        Ok(())
+    }
+
+    /// Values of the options the script declares with `arg`, parsed from
+    /// the `--run-arg` arguments, as environment variables
+    fn parse_script_args(&self, directives: &Directives) -> Result<Vec<(String, String)>, SingleloadError> {
+        let specs = directives.arg_specs()?;
+        if specs.is_empty() {
+            return Ok(Vec::new());
+        }
+        args::parse(&specs, &self.run_args)
+    }
+
+    /// Returns the script's lockfile if it matches the declared dependencies
+    fn fresh_lockfile(
+        &self,
+        runner: &dyn Runner,
+        lock_path: &Path,
+        declared: &[Dependency],
+    ) -> Result<Option<Lockfile>, SingleloadError> {
+        if declared.is_empty() {
+            return Ok(None);
+        }
+
+        let lock = match Lockfile::load(lock_path) {
+            Ok(lock) => lock,
+            Err(e) if !self.frozen => {
+                warn!("Ignoring unreadable {}: {}", lock_path.display(), e);
+                None
+            }
+            Err(e) => return Err(e),
+        };
+
+        match lock {
+            Some(lock) if lock.is_fresh(runner.name(), declared) => Ok(Some(lock)),
+            _ if self.frozen => Err(SingleloadError::InvalidInput(format!(
+                "{} is missing or out of date; run without --frozen to update it",
+                lock_path.display()
+            ))),
+            _ => Ok(None),
+        }
+    }
+
+    /// Installs inline dependencies in a network-enabled container and
+    /// returns the mount exposing them to the run container
+    async fn resolve_dependencies(
+        &self,
+        runner: &dyn Runner,
+        dependencies: &[Dependency],
+        script_path: &str,
+        sources: &[String],
+        content: &[u8],
+        script_dir: &Path,
+        toolchain: &str,
+        toolchain_mount: Option<&Mount>,
+        image: Option<&str>,
+        lockfile: Option<&Lockfile>,
+    ) -> Result<(Option<Mount>, Option<TempDir>)> {
+        if dependencies.is_empty() {
+            return Ok((None, None));
+        }
+
+        for dep in dependencies {
+            if !runner.package_managers().contains(&dep.manager) {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "'{}' dependencies are not supported for {} scripts",
+                    dep.manager.directive(),
+                    runner.name()
+                ))
+                .into());
+            }
+        }
+
+        // Without the cache, dependencies are resolved into a throwaway directory
+        let (cache, scratch) = match &self.cache {
+            Some(cache) => (cache.clone(), None),
+            None => {
+                let scratch = TempDir::new()?;
+                (BuildCache::new(scratch.path().to_path_buf()), Some(scratch))
+            }
+        };
+
+        let specs: Vec<String> = dependencies.iter().map(|d| d.spec()).collect();
+        let key = dependencies_key(runner, toolchain, dependencies, content);
+        let deps_dir = cache.artifact_dir(&key);
+
+        let lock = match cache.is_complete(&key) {
+            true => None,
+            false => cache.lock(&key, FETCH_TIMEOUT).await?,
+        };
+        if cache.is_complete(&key) {
+            debug!("Dependency cache hit for {}", key);
+            cache.touch(&key)?;
+        } else if self.restore_snapshot(runner.name(), toolchain, lockfile, &cache, &key, &specs.join(" ")) {
+            info!("Restored {} dependencies for {} script from a snapshot", dependencies.len(), runner.name());
+        } else {
+            cache.record_miss(runner.name());
+            let staging = cache.stage(&key, runner.name(), &specs.join(" "))?;
+
+            let ctx = BuildContext {
+                script_path,
+                sources,
+                assets: &[],
+                out_dir: CONTAINER_CACHE_DIR,
+                deps_dir: CONTAINER_DEPS_DIR,
+                dependencies,
+                target: None,
+                build_flags: &[],
+                libraries: &[],
+                gpu_archs: &[],
+                objects: &[],
+            };
+            let fetch = runner.fetch(&ctx).ok_or_else(|| {
+                SingleloadError::InvalidInput(format!(
+                    "{} runner cannot install inline dependencies",
+                    runner.name()
+                ))
+            })?;
+
+            info!("Installing {} dependencies for {} script", dependencies.len(), runner.name());
+            self.events.emit(Event::DependencyInstall { count: dependencies.len() });
+
+            let mut config = ContainerConfig {
+                image: image.unwrap_or(&self.container_manager.config.base_image_name).to_string(),
+                name: PathSanitizer::generate_safe_container_name("singleload-fetch"),
+                command: bash_command(format!(
+                    "{} && {}",
+                    fetch,
+                    BuildCache::complete_command(CONTAINER_DEPS_DIR)
+                )),
+                memory_limit: self.memory_limit,
+                cpu_limit: self.cpu_limit,
+                timeout: FETCH_TIMEOUT,
+                network_disabled: false,
+                ..Default::default()
+            };
+            config.mounts.push(Mount {
+                source: script_dir.to_string_lossy().to_string(),
+                target: "/workspace".to_string(),
+                read_only: true,
+            });
+            config.mounts.push(Mount {
+                source: staging.artifact_dir().to_string_lossy().to_string(),
+                target: CONTAINER_DEPS_DIR.to_string(),
+                read_only: false,
+            });
+            if let Some(mount) = toolchain_mount {
+                config.mounts.push(mount.clone());
+            }
+            config.env.push(("HOME".to_string(), "/tmp".to_string()));
+            config.env.push(("PATH".to_string(), search_path(toolchain_mount)));
+            config.env.extend(runner.env(&ctx));
+
+            let container_id = self.container_manager.create_container(config).await?;
+            let (exit_code, _stdout, stderr, _) = self
+                .execute_in_container(&container_id, FETCH_TIMEOUT, false, never_cancelled())
+                .await?;
+
+            if exit_code != 0 || !staging.publish()? {
+                return Err(SingleloadError::Container(format!(
+                    "Dependency installation failed (exit code {}): {}",
+                    exit_code, stderr
+                ))
+                .into());
+            }
+        }
+        drop(lock);
+
+        let mount = Mount {
+            source: deps_dir.to_string_lossy().to_string(),
+            target: CONTAINER_DEPS_DIR.to_string(),
+            read_only: true,
+        };
+        Ok((Some(mount), scratch))
+    }
+
+    /// Fills the dependency cache entry `key` from the snapshot of the
+    /// environment `lockfile` pins, if one was saved. Returns true when the
+    /// entry is complete afterwards.
+    fn restore_snapshot(
+        &self,
+        language: &str,
+        toolchain: &str,
+        lockfile: Option<&Lockfile>,
+        cache: &BuildCache,
+        key: &str,
+        source: &str,
+    ) -> bool {
+        let (Some(snapshots), Some(lockfile)) = (&self.snapshots, lockfile) else {
+            return false;
+        };
+        if !SnapshotStore::supports(language) || lockfile.packages.is_empty() {
+            return false;
+        }
+        let snapshot = SnapshotStore::key(language, toolchain, lockfile);
+        let restored = cache.stage(key, language, source).and_then(|staging| {
+            match snapshots.restore(language, &snapshot, &staging.artifact_dir())? {
+                true => staging.publish(),
+                false => Ok(false),
+            }
+        });
+        restored.unwrap_or_else(|e| {
+            warn!("Could not restore {} environment snapshot: {}", language, e);
+            false
+        })
+    }
+
+    /// Keeps the environment installed in `dir` as a snapshot for `lockfile`
+    fn save_snapshot(&self, language: &str, toolchain: &str, lockfile: &Lockfile, dir: &Path) {
+        let Some(snapshots) = &self.snapshots else {
+            return;
+        };
+        if !SnapshotStore::supports(language) || lockfile.packages.is_empty() {
+            return;
+        }
+        let snapshot = SnapshotStore::key(language, toolchain, lockfile);
+        if let Err(e) = snapshots.save(language, &snapshot, dir) {
+            warn!("Could not save {} environment snapshot: {}", language, e);
+        }
+    }
+
+    /// Installs a toolchain version pinned by the script header, once per
+    /// language and version, and returns its read-only mount
+    /// The toolchain version to use and where it was pinned: the version
+    /// given to the executor, then the script's own pin, then the one of
+    /// the project the script is in
+    fn pinned_version(&self, runner: &dyn Runner, directives: &Directives, script_dir: &Path) -> Option<(String, String)> {
+        if let Some(version) = &self.toolchain_version {
+            return Some((version.clone(), "command line".to_string()));
+        }
+        if let Some(pin) = directives.first(runner.toolchain()) {
+            return Some((pin.value.trim().to_string(), format!("{} directive", runner.toolchain())));
+        }
+        if !self.project_pins {
+            return None;
+        }
+        let dir = std::env::current_dir().ok()?.join(script_dir);
+        let pin = pins::find(runner.toolchain(), &dir)?;
+        info!("Using {} {} pinned in {}", runner.toolchain(), pin.version, pin.file.display());
+        Some((pin.version, pin.file.display().to_string()))
+    }
+
+    /// Resolves the shell of a `--nix` run into the host's Nix store, once
+    /// per flake and lock, and returns its key and environment script. The
+    /// flake lock is written next to the script the first time. A dry run
+    /// only computes the key.
+    async fn resolve_nix_shell(
+        &self,
+        shell: &NixShell,
+        script_path: &Path,
+        dry_run: bool,
+    ) -> Result<(String, Option<PathBuf>)> {
+        for unpinned in &shell.unpinned {
+            warn!("nixpkgs decides the version of {} in --nix runs", unpinned);
+        }
+        let lock_path = flake::lock_path(script_path);
+        let lock = match std::fs::read_to_string(&lock_path) {
+            Ok(lock) => Some(lock),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => None,
+            Err(e) => return Err(e.into()),
+        };
+        match &lock {
+            Some(lock) => {
+                let key = shell.key(lock);
+                let env = self.nix_store.env_path(&key);
+                if env.exists() {
+                    debug!("Using resolved Nix shell {}", key);
+                    return Ok((key, Some(env)));
+                }
+                if dry_run {
+                    return Ok((key, None));
+                }
+            }
+            None if self.frozen => {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "{} is missing; run without --frozen to create it",
+                    lock_path.display()
+                ))
+                .into());
+            }
+            None if dry_run => return Ok((shell.key(""), None)),
+            None => {}
+        }
+
+        self.bootstrap_nix_store().await?;
+        let dir = tempfile::Builder::new().prefix(".resolve").tempdir_in(self.nix_store.root())?;
+        std::fs::write(dir.path().join("flake.nix"), shell.flake())?;
+        if let Some(lock) = &lock {
+            std::fs::write(dir.path().join("flake.lock"), lock)?;
+        }
+
+        info!("Resolving Nix shell for {}", script_path.display());
+        let mut config = ContainerConfig {
+            image: flake::NIX_IMAGE.to_string(),
+            name: PathSanitizer::generate_safe_container_name("singleload-nix"),
+            command: flake::resolve_command(),
+            memory_limit: self.memory_limit,
+            cpu_limit: self.cpu_limit,
+            timeout: FETCH_TIMEOUT,
+            network_disabled: false,
+            user: "0:0".to_string(),
+            ..Default::default()
+        };
+        config.mounts.push(Mount {
+            source: self.nix_store.store_dir().to_string_lossy().to_string(),
+            target: CONTAINER_NIX_DIR.to_string(),
+            read_only: false,
+        });
+        config.mounts.push(Mount {
+            source: dir.path().to_string_lossy().to_string(),
+            target: CONTAINER_NIX_ENV_DIR.to_string(),
+            read_only: false,
+        });
+        config.env.push(("HOME".to_string(), "/tmp".to_string()));
+        config.env.push(("PATH".to_string(), flake::NIX_PATH.to_string()));
+
+        let container_id = self.container_manager.create_container(config).await?;
+        let (exit_code, _stdout, stderr, _) = self
+            .execute_in_container(&container_id, FETCH_TIMEOUT, false, never_cancelled())
+            .await?;
+        if exit_code != 0 {
+            return Err(SingleloadError::Container(format!(
+                "Resolving the Nix shell failed (exit code {}): {}",
+                exit_code, stderr
+            ))
+            .into());
+        }
+
+        // Nix locks a new flake, and relocks one whose nixpkgs changed
+        let resolved = std::fs::read_to_string(dir.path().join("flake.lock"))?;
+        if lock.as_deref() != Some(resolved.as_str()) {
+            if self.frozen {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "{} is out of date; run without --frozen to update it",
+                    lock_path.display()
+                ))
+                .into());
+            }
+            std::fs::write(&lock_path, &resolved)?;
+            info!("Wrote {}", lock_path.display());
+        }
+        let key = shell.key(&resolved);
+        let env = self.nix_store.env_path(&key);
+        if let Some(parent) = env.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        std::fs::rename(dir.path().join("env.sh"), &env)?;
+        Ok((key, Some(env)))
+    }
+
+    /// Seeds the host's Nix store from the Nix image's, so resolved
+    /// shells outlive their containers
+    async fn bootstrap_nix_store(&self) -> Result<()> {
+        if self.nix_store.is_bootstrapped() {
+            return Ok(());
+        }
+        self.container_manager.pull_image(flake::NIX_IMAGE).await?;
+        std::fs::create_dir_all(self.nix_store.root())?;
+        let seed = tempfile::Builder::new().prefix(".seed").tempdir_in(self.nix_store.root())?;
+
+        info!("Seeding the Nix store in {}", self.nix_store.root().display());
+        let mut config = ContainerConfig {
+            image: flake::NIX_IMAGE.to_string(),
+            name: PathSanitizer::generate_safe_container_name("singleload-nix"),
+            command: flake::bootstrap_command("/seed"),
+            memory_limit: self.memory_limit,
+            cpu_limit: self.cpu_limit,
+            timeout: FETCH_TIMEOUT,
+            user: "0:0".to_string(),
+            ..Default::default()
+        };
+        config.mounts.push(Mount {
+            source: seed.path().to_string_lossy().to_string(),
+            target: "/seed".to_string(),
+            read_only: false,
+        });
+
+        let container_id = self.container_manager.create_container(config).await?;
+        let (exit_code, _stdout, stderr, _) = self
+            .execute_in_container(&container_id, FETCH_TIMEOUT, false, never_cancelled())
+            .await?;
+        if exit_code != 0 {
+            return Err(SingleloadError::Container(format!(
+                "Seeding the Nix store failed (exit code {}): {}",
+                exit_code, stderr
+            ))
+            .into());
+        }
+        // Seeded by another process in the meantime
+        if !self.nix_store.is_bootstrapped() {
+            std::fs::rename(seed.keep(), self.nix_store.store_dir())?;
+        }
+        Ok(())
+    }
+
+    async fn install_toolchain(&self, runner: &dyn Runner, version: &str) -> Result<Mount> {
+        ToolchainStore::validate_version(version)?;
+        let dir = self.toolchains.dir(runner.name(), version);
+        let mount = Mount {
+            source: dir.to_string_lossy().to_string(),
+            target: CONTAINER_TOOLCHAIN_DIR.to_string(),
+            read_only: true,
+        };
+
+        if self.toolchains.is_installed(runner.name(), version) {
+            debug!("Using installed {} toolchain {}", runner.name(), version);
+            return Ok(mount);
+        }
+        let _lock = self.toolchains.lock(runner.name(), version, FETCH_TIMEOUT).await?;
+        // Installed by the process that held the lock before us
+        if self.toolchains.is_installed(runner.name(), version) {
+            debug!("Using {} toolchain {} installed by another process", runner.name(), version);
+            return Ok(mount);
+        }
+
+        let install = runner.install_toolchain(version, CONTAINER_TOOLCHAIN_DIR).ok_or_else(|| {
+            SingleloadError::InvalidInput(format!(
+                "Pinning the toolchain version is not supported for {} scripts",
+                runner.name()
+            ))
+        })?;
+
+        info!("Installing {} toolchain {}", runner.name(), version);
+        self.events.emit(Event::ToolchainInstall {
+            language: runner.name().to_string(),
+            version: version.to_string(),
+        });
+        let archive = match runner.toolchain_release() {
+            Some(release) => {
+                let config = &self.container_manager.config;
+                let downloads = DownloadManager::new(&config.download, &config.proxy)?;
+                Some(self.toolchains.download_release(&downloads, &release, version).await?)
+            }
+            None => None,
+        };
+        self.toolchains.prepare(runner.name(), version)?;
+
+        let mut config = ContainerConfig {
+            image: self.container_manager.config.base_image_name.clone(),
+            name: PathSanitizer::generate_safe_container_name("singleload-toolchain"),
+            command: bash_command(format!(
+                "{} && {}",
+                install,
+                BuildCache::complete_command(CONTAINER_TOOLCHAIN_DIR)
+            )),
+            memory_limit: self.memory_limit,
+            cpu_limit: self.cpu_limit,
+            timeout: FETCH_TIMEOUT,
+            network_disabled: false,
+            ..Default::default()
+        };
+        config.mounts.push(Mount {
+            read_only: false,
+            ..mount.clone()
+        });
+        if let Some(path) = &archive {
+            config.mounts.push(Mount {
+                source: path.to_string_lossy().to_string(),
+                target: CONTAINER_ARCHIVE.to_string(),
+                read_only: true,
+            });
+        }
+        config.env.push(("HOME".to_string(), "/tmp".to_string()));
+        config.env.push(("PATH".to_string(), DEFAULT_PATH.to_string()));
+
+        let container_id = self.container_manager.create_container(config).await?;
+        let (exit_code, _stdout, stderr, _) = self
+            .execute_in_container(&container_id, FETCH_TIMEOUT, false, never_cancelled())
+            .await?;
+
+        if exit_code != 0 || !self.toolchains.is_installed(runner.name(), version) {
+            self.toolchains.remove(runner.name(), version)?;
+            return Err(SingleloadError::Container(format!(
+                "Installing {} toolchain {} failed (exit code {}): {}",
+                runner.name(),
+                version,
+                exit_code,
+                stderr
+            ))
+            .into());
+        }
+        if let Err(e) = self.toolchains.write_manifest(runner.name(), version) {
+            self.toolchains.remove(runner.name(), version)?;
+            return Err(e.into());
+        }
+        if let Some(path) = &archive {
+            self.toolchains.remove_download(path);
+        }
+
+        Ok(mount)
+    }
+
+    /// Builds the container command, reusing a cached build when one exists.
+    /// A missing build is made in a container of its own and published
+    /// before the program runs, so the program only ever sees the cache
+    /// entry read-only and cannot change what later runs get.
+    async fn plan_command(
+        &self,
+        prepared: &PreparedScript,
+        ctx: &BuildContext<'_>,
+        cache: Option<&BuildCache>,
+        source: &Path,
+        interp: bool,
+        start_time: Instant,
+    ) -> Result<(Vec<String>, Option<Mount>)> {
+        let runner = prepared.runner.as_ref();
+        let (content, toolchain) = (&prepared.content, &prepared.toolchain);
+        let cached = |key: &str| cache.is_some_and(|cache| cache.is_complete(key));
+        if let Some(build) = runner.build(ctx).filter(|_| interp) {
+            if !cached(&build_key(runner, &build, ctx, &prepared.cache_source, toolchain)) {
+                match runner.interpret(ctx, content) {
+                    Ok(mut command) => {
+                        debug!("Interpreting {} script instead of building it", runner.name());
+                        command.extend(self.run_args.iter().cloned());
+                        return Ok((command, None));
+                    }
+                    Err(reason) => info!("Compiling {}: {}", source.display(), reason),
+                }
+            }
+        }
+
+        let cache = match cache {
+            Some(cache) => cache,
+            None => {
+                // Build into the container's scratch space on every run
+                let ctx = BuildContext { out_dir: "/tmp/build", ..ctx.clone() };
+                let run = self.run_command(runner, &ctx);
+                return Ok(match stamped_build(runner, &ctx, &prepared.metadata) {
+                    Some(build) => {
+                        self.events.emit(Event::BuildStarted { language: runner.name().to_string() });
+                        let command = format!("mkdir -p {} && {} && exec {}", ctx.out_dir, build, shell_join(&run));
+                        (bash_command(command), None)
+                    }
+                    None => (run, None),
+                });
+            }
+        };
+
+        let build = match runner.build(ctx) {
+            Some(build) => build,
+            None => return Ok((self.run_command(runner, ctx), None)),
+        };
+
+        let key = build_key(runner, &build, ctx, &prepared.cache_source, toolchain);
+
+        let lock = match cache.is_complete(&key) {
+            true => None,
+            false => cache.lock(&key, self.timeout).await?,
+        };
+        if cache.is_complete(&key) || self.fetch_remote(cache, &key, runner.name(), source).await {
+            debug!("Build cache hit for {}", key);
+            cache.touch(&key)?;
+            self.events.emit(Event::BuildCached { language: runner.name().to_string() });
+        } else {
+            debug!("Build cache miss for {}", key);
+            self.events.emit(Event::BuildStarted { language: runner.name().to_string() });
+            cache.record_miss(runner.name());
+            let staging = cache.stage(&key, runner.name(), &source.display().to_string())?;
+            let objects = self.object_cache(prepared, ctx, cache, source)?;
+            let ctx = &BuildContext {
+                objects: objects.as_ref().map_or(&[], |(_, paths)| paths.as_slice()),
+                ..ctx.clone()
+            };
+            let build = stamped_build(runner, ctx, &prepared.metadata).unwrap_or(build);
+            let objects_dir = objects.as_ref().map(|(dir, _)| dir.as_path());
+            let (exit_code, stderr) = self
+                .build_in_container(prepared, ctx, &build, &staging.artifact_dir(), objects_dir)
+                .await?;
+            if exit_code != 0 || !staging.publish()? {
+                return Err(self.build_failed(prepared, exit_code, &stderr, start_time));
+            }
+            if let Some((dir, paths)) = &objects {
+                BuildCache::prune_objects(dir, paths)?;
+            }
+            // Waiters find the published entry
+            drop(lock);
+            self.events.emit(Event::BuildFinished { language: runner.name().to_string() });
+            if let Some(remote) = &self.remote_cache {
+                remote.publish(cache, &key).await;
+            }
+        }
+
+        let mount = Mount {
+            source: cache.artifact_dir(&key).to_string_lossy().to_string(),
+            target: CONTAINER_CACHE_DIR.to_string(),
+            read_only: true,
+        };
+        Ok((self.run_command(runner, ctx), Some(mount)))
+    }
+
+    /// The runner's command followed by the `--run-arg` arguments
+    fn run_command(&self, runner: &dyn Runner, ctx: &BuildContext) -> Vec<String> {
+        let mut command = runner.run(ctx);
+        command.extend(self.run_args.iter().cloned());
+        // Only the program is profiled or debugged, not its build
+        if let Some(debugger) = self.debugger(runner) {
+            let port = self.debugging.as_ref().and_then(|d| d.dap).map(|addr| addr.port());
+            return debugger.wrap(&command, port);
+        }
+        match self.profiler(runner) {
+            Some(profiler) => profiler.wrap(&command),
+            None => command,
+        }
+    }
+
+    fn debugger(&self, runner: &dyn Runner) -> Option<Debugger> {
+        self.debugging.as_ref()?;
+        Debugger::for_language(runner.name()).ok()
+    }
+
+    fn profiler(&self, runner: &dyn Runner) -> Option<Profiler> {
+        let profiling = self.profiling.as_ref()?;
+        Profiler::for_language(runner.name(), profiling.kind).ok()
+    }
+
+    /// Tries the remote cache after a local miss
+    async fn fetch_remote(&self, cache: &BuildCache, key: &str, language: &str, source: &Path) -> bool {
+        match &self.remote_cache {
+            Some(remote) => remote.fetch(cache, key, language, &source.display().to_string()).await,
+            None => false,
+        }
+    }
+
+    /// Reports diagnostics in already translated output for every file of the script
+    fn emit_diagnostics(&self, stderr: &str, source_map: &SourceMap) {
+        if !self.events.is_enabled() {
+            return;
+        }
+        for diagnostic in collect_diagnostics(stderr, source_map) {
+            self.events.emit(Event::Diagnostic(diagnostic));
+        }
+    }
+
+    fn apply_output_limits(&self, stdout: String, stderr: String) -> (String, String, bool) {
+        let mut truncated = false;
+        let limit = self.output_limit as usize;
+
+        let stdout_limited = if stdout.len() > limit {
+            truncated = true;
             format!("{}... [truncated]", &stdout[..limit])
         } else {
             stdout
@@ -247,4 +3695,264 @@ impl Executor {
 
         (stdout_limited, stderr_limited, truncated)
     }
-}
\ No newline at end of file
+}
+
+/// Where `singleload test --coverage` writes the report for a script:
+/// `file_test.go` -> `file_test.go.coverage`, or `coverage` inside a
+/// directory project
+pub fn coverage_path(script_path: &Path) -> PathBuf {
+    if script_path.is_dir() {
+        return script_path.join("coverage");
+    }
+    let mut name = script_path.file_name().unwrap_or_default().to_os_string();
+    name.push(".coverage");
+    script_path.with_file_name(name)
+}
+
+/// Lets the container's mapped uid read the files in `dir`
+fn make_world_readable(dir: &Path) -> std::io::Result<()> {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(dir, std::fs::Permissions::from_mode(0o755))?;
+        for entry in std::fs::read_dir(dir)? {
+            std::fs::set_permissions(entry?.path(), std::fs::Permissions::from_mode(0o644))?;
+        }
+    }
+    Ok(())
+}
+
+/// Every regular file under `dir`, at any depth
+fn collect_staged(dir: &Path, files: &mut Vec<PathBuf>) -> std::io::Result<()> {
+    for entry in std::fs::read_dir(dir)? {
+        let entry = entry?;
+        let file_type = entry.file_type()?;
+        if file_type.is_dir() {
+            collect_staged(&entry.path(), files)?;
+        } else if file_type.is_file() {
+            files.push(entry.path());
+        }
+    }
+    Ok(())
+}
+
+/// Adds a file staged from the host under `name` to the trust check's checksum
+fn trusted_input(hasher: &mut Sha256, name: &str, data: &[u8]) {
+    hasher.update(name.as_bytes());
+    hasher.update([0]);
+    hasher.update(Sha256::digest(data));
+}
+
+/// Collects the strace logs a traced run left in `dir` into the manifest at `path`
+fn write_file_trace(path: &Path, script: &Path, language: &str, dir: &Path, cwd: &str) -> Result<FileTrace> {
+    let trace = FileTrace::read(&script.display().to_string(), language, dir, cwd)?;
+    std::fs::write(path, serde_json::to_string_pretty(&trace)?)?;
+    Ok(trace)
+}
+
+fn file_name(path: &Path) -> Result<String, SingleloadError> {
+    path.file_name()
+        .map(|n| n.to_string_lossy().to_string())
+        .ok_or_else(|| SingleloadError::InvalidInput(format!("Invalid script path {}", path.display())))
+}
+
+/// PATH inside the container, preferring a pinned toolchain's binaries
+fn search_path(toolchain_mount: Option<&Mount>) -> String {
+    match toolchain_mount {
+        Some(mount) => format!("{}/bin:{}", mount.target, DEFAULT_PATH),
+        None => DEFAULT_PATH.to_string(),
+    }
+}
+
+/// Diagnostics in translated output for every source the map points to
+fn collect_diagnostics(output: &str, source_map: &SourceMap) -> Vec<Diagnostic> {
+    source_map
+        .originals()
+        .flat_map(|source| parse_diagnostics(output, &source.display().to_string(), source))
+        .collect()
+}
+
+/// Log files of `tool.py` are named after `tool`, those of a directory
+/// project after the directory
+fn log_name(script_path: &Path) -> String {
+    let name = match script_path.is_dir() {
+        true => script_path.file_name(),
+        false => script_path.file_stem(),
+    };
+    name.map(|n| n.to_string_lossy().to_string())
+        .filter(|n| !n.is_empty())
+        .unwrap_or_else(|| "script".to_string())
+}
+
+/// Third-party packages of a build: what was installed, or what the script
+/// declares when the runner cannot list installed packages
+fn components(runner: &dyn Runner, prepared: &PreparedScript) -> Vec<Component> {
+    if prepared.packages.is_empty() {
+        return prepared
+            .dependencies
+            .iter()
+            .map(|dep| Component {
+                manager: Some(dep.manager),
+                name: dep.name.clone(),
+                version: dep.version.clone(),
+                hash: None,
+            })
+            .collect();
+    }
+    let manager = runner.package_managers().first().copied();
+    prepared
+        .packages
+        .iter()
+        .map(|pkg| Component {
+            manager,
+            name: pkg.name.clone(),
+            version: Some(pkg.version.clone()),
+            hash: pkg.hash.clone(),
+        })
+        .collect()
+}
+
+/// Wraps a command so it records its wall time (bash's `EPOCHREALTIME`),
+/// the CPU time of its processes (`time`, which reports what `wait4`
+/// returned for them), the memory cgroup's high-water mark, cgroup v2 first,
+/// and the I/O cgroup's counters before and after. The records are written
+/// to stderr once the command exits, each line starting with the run's
+/// token, which the wrapper takes from [`MEASURE_TOKEN_ENV`] and keeps in a
+/// shell variable of a fresh bash, out of the environment and command line
+/// the script can read. Without it the script cannot forge the records or
+/// end its output early. Nothing the script can write is mounted for this.
+/// The image has no coreutils, so this sticks to bash builtins.
+fn measure_command(command: &[String]) -> String {
+    let measure = format!(
+        "read -r token <&3; exec 3<&-; io=/sys/fs/cgroup/io.stat; before=; [ -r $io ] && before=$(< $io); \
+         TIMEFORMAT=$'\\n'\"$token cpu %3U %3S\"; start=$EPOCHREALTIME; time {{ {run}; }}; end=$EPOCHREALTIME; \
+         after=; [ -r $io ] && after=$(< $io); peak=; \
+         for f in /sys/fs/cgroup/memory.peak /sys/fs/cgroup/memory/memory.max_usage_in_bytes; do \
+         [ -r \"$f\" ] && read -r peak < \"$f\" && break; done; \
+         {{ printf '%s run %s %s %s\\n' \"$token\" \"$start\" \"$end\" \"$peak\"; \
+         [ -n \"$before\" ] && printf '%s before %s\\n' \"$token\" \"${{before//$'\\n'/;}}\"; \
+         [ -n \"$after\" ] && printf '%s after %s\\n' \"$token\" \"${{after//$'\\n'/;}}\"; }} >&2; exit $status",
+        run = supervise(&shell_join(command)),
+    );
+    format!(
+        "exec 3<<< \"${env}\"; unset {env}; exec /bin/bash -c {measure} measure",
+        env = MEASURE_TOKEN_ENV,
+        measure = shell_quote(&measure),
+    )
+}
+
+/// Splits the records of a measured run off the end of its stderr: they
+/// start at the first line with the token, which only the wrapper knows
+fn split_records(mut stderr: String, token: &str) -> (String, Option<String>) {
+    let Some(at) = stderr.find(token) else {
+        return (stderr, None);
+    };
+    let records = stderr.split_off(at);
+    stderr.truncate(stderr.trim_end().len());
+    (stderr, Some(records))
+}
+
+/// Parses the `run` record of [`measure_command`]: start and end as
+/// seconds with a fraction, then the peak in bytes
+fn parse_measurement(recorded: &str) -> (Option<f64>, Option<u64>) {
+    // EPOCHREALTIME follows the locale's decimal separator
+    let seconds = |value: &str| value.replace(',', ".").parse::<f64>().ok();
+    let mut fields = recorded.split_whitespace();
+    let elapsed_ms = match (fields.next().and_then(seconds), fields.next().and_then(seconds)) {
+        (Some(start), Some(end)) if end >= start => Some((end - start) * 1000.0),
+        _ => None,
+    };
+    let peak_rss_bytes = fields.next().and_then(|peak| peak.parse().ok());
+    (elapsed_ms, peak_rss_bytes)
+}
+
+/// User and system time from the `cpu` record, in seconds as in
+/// `1.250 0.030`
+fn parse_cpu(recorded: &str) -> (Option<f64>, Option<f64>) {
+    let millis = |value: &str| value.replace(',', ".").parse::<f64>().ok().map(|seconds| seconds * 1000.0);
+    let mut fields = recorded.split_whitespace();
+    (fields.next().and_then(millis), fields.next().and_then(millis))
+}
+
+/// Sums the counters of every device in a cgroup v2 `io.stat`, whose lines
+/// look like `8:0 rbytes=4096 wbytes=0 rios=1 wios=0 dbytes=0 dios=0`
+fn parse_io_stat(recorded: &str) -> IoCounters {
+    let mut counters = IoCounters::default();
+    for field in recorded.lines().flat_map(|line| line.split_whitespace().skip(1)) {
+        let Some((name, value)) = field.split_once('=') else {
+            continue;
+        };
+        let value: u64 = value.parse().unwrap_or(0);
+        match name {
+            "rbytes" => counters.read_bytes += value,
+            "wbytes" => counters.write_bytes += value,
+            "rios" => counters.read_ops += value,
+            "wios" => counters.write_ops += value,
+            _ => {}
+        }
+    }
+    counters
+}
+
+/// Cache key of a build: the source, the toolchain, and the build command
+/// without metadata, so builds of the same source share an entry
+fn build_key(runner: &dyn Runner, build: &str, ctx: &BuildContext<'_>, content: &[u8], toolchain: &str) -> String {
+    let mut flags = vec![build.to_string()];
+    if let Some(target) = ctx.target {
+        flags.push(target.to_string());
+    }
+    BuildCache::key(&runner.cache_key(content), toolchain, &flags)
+}
+
+/// Key of the dependencies installed for a script, which also depend on
+/// what the script's sources use of them (see [`Runner::fetch_inputs`])
+fn dependencies_key(runner: &dyn Runner, toolchain: &str, dependencies: &[Dependency], content: &[u8]) -> String {
+    let mut specs: Vec<String> = dependencies.iter().map(|d| d.spec()).collect();
+    let inputs = runner.fetch_inputs(content);
+    if !inputs.is_empty() {
+        specs.push(format!("inputs:{}", inputs.join(" ")));
+    }
+    BuildCache::key(&format!("deps:{}", runner.name()), toolchain, &specs)
+}
+
+/// The runner's build command with `metadata` added to its compiler flags
+fn stamped_build(runner: &dyn Runner, ctx: &BuildContext<'_>, metadata: &BuildMetadata) -> Option<String> {
+    let flags = metadata.stamp_flags(runner.name(), ctx.build_flags);
+    runner.build(&BuildContext { build_flags: &flags, ..ctx.clone() })
+}
+
+fn bash_command(command: String) -> Vec<String> {
+    vec!["/bin/bash".to_string(), "-c".to_string(), command]
+}
+
+fn never_cancelled() -> CancelReceiver {
+    watch::channel(false).1
+}
+
+async fn wait_for_cancel(mut cancel: CancelReceiver) {
+    loop {
+        if *cancel.borrow_and_update() {
+            return;
+        }
+        if cancel.changed().await.is_err() {
+            std::future::pending::<()>().await;
+        }
+    }
+}
+
+fn check_target(runner: &dyn Runner, target: &BuildTarget) -> Result<(), SingleloadError> {
+    if runner.supports_target(target) {
+        Ok(())
+    } else if target.go_platform() && runner.name() != "go" {
+        Err(SingleloadError::InvalidInput(format!(
+            "--goos and --goarch only apply to Go builds; use --target for {} scripts",
+            runner.name()
+        )))
+    } else {
+        Err(SingleloadError::InvalidInput(format!(
+            "{} scripts cannot be built for {}",
+            runner.name(),
+            target
+        )))
+    }
+}
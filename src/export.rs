@@ -0,0 +1,286 @@
+use crate::errors::SingleloadError;
+use crate::platform;
+use crate::remote_cache;
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use tempfile::TempDir;
+
+/// Extension of exported programs
+pub const EXTENSION: &str = "slp";
+
+/// Version of the archive layout; imports refuse newer ones
+pub const FORMAT_VERSION: u32 = 1;
+
+const MANIFEST_FILE: &str = "manifest.json";
+const PROVENANCE_FILE: &str = "provenance.json";
+const ARTIFACT_DIR: &str = "artifact";
+const SOURCE_DIR: &str = "source";
+
+/// What an exported program is and how to run it, stored as
+/// `manifest.json` at the top of the archive
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ExportManifest {
+    pub format: u32,
+    /// Name the program is imported under, the script name without extension
+    pub name: String,
+    pub language: String,
+    /// Command running the program, with `artifact/` at
+    /// [`crate::cache::CONTAINER_CACHE_DIR`]
+    pub run: Vec<String>,
+    #[serde(default)]
+    pub env: Vec<(String, String)>,
+    /// File name of the script under `source/`
+    pub script: String,
+    /// File name of the dependency lockfile under `source/`, if the script had one
+    #[serde(default)]
+    pub lockfile: Option<String>,
+    pub source_sha256: String,
+    /// Base image and pinned toolchain the artifact was built with
+    pub toolchain: String,
+    pub target: Option<String>,
+    pub cache_key: String,
+    /// SHA-256 of every file under `artifact/`, by path relative to it
+    pub files: BTreeMap<String, String>,
+    pub created_at: DateTime<Utc>,
+    pub singleload_version: String,
+}
+
+/// Inputs of [`write`]
+pub struct Export<'a> {
+    pub manifest: ExportManifest,
+    /// Complete artifact directory of the build cache entry
+    pub artifact_dir: &'a Path,
+    pub script: &'a Path,
+    pub lockfile: Option<&'a Path>,
+    /// Serialized [`crate::sbom::Provenance`] of the build
+    pub provenance: serde_json::Value,
+}
+
+/// Writes the archive: the manifest, the build's provenance, the artifact
+/// directory and the script with its lockfile. `manifest.files` is filled in here.
+pub fn write(export: Export, output: &Path) -> Result<ExportManifest, SingleloadError> {
+    let staging = TempDir::new()?;
+    let mut manifest = export.manifest;
+
+    let artifact_dir = staging.path().join(ARTIFACT_DIR);
+    copy_dir(export.artifact_dir, &artifact_dir)?;
+    manifest.files = checksums(&artifact_dir)?;
+
+    let source_dir = staging.path().join(SOURCE_DIR);
+    std::fs::create_dir_all(&source_dir)?;
+    std::fs::copy(export.script, source_dir.join(&manifest.script))?;
+    if let (Some(lockfile), Some(name)) = (export.lockfile, &manifest.lockfile) {
+        std::fs::copy(lockfile, source_dir.join(name))?;
+    }
+
+    std::fs::write(staging.path().join(MANIFEST_FILE), serde_json::to_vec_pretty(&manifest)?)?;
+    std::fs::write(
+        staging.path().join(PROVENANCE_FILE),
+        serde_json::to_vec_pretty(&export.provenance)?,
+    )?;
+
+    std::fs::write(output, remote_cache::pack(staging.path())?)?;
+    Ok(manifest)
+}
+
+/// An exported program unpacked by [`ImportStore::import`]
+#[derive(Debug, Clone)]
+pub struct Imported {
+    pub dir: PathBuf,
+    pub manifest: ExportManifest,
+}
+
+impl Imported {
+    /// Directory mounted at [`crate::cache::CONTAINER_CACHE_DIR`] for runs
+    pub fn artifact_dir(&self) -> PathBuf {
+        self.dir.join(ARTIFACT_DIR)
+    }
+
+    pub fn source(&self) -> PathBuf {
+        self.dir.join(SOURCE_DIR).join(&self.manifest.script)
+    }
+}
+
+/// Programs imported from `.slp` archives, one directory per name
+#[derive(Debug, Clone)]
+pub struct ImportStore {
+    root: PathBuf,
+}
+
+impl ImportStore {
+    pub fn new(root: PathBuf) -> Self {
+        Self { root }
+    }
+
+    /// Default location, `~/.singleload/imports` (`%LOCALAPPDATA%\singleload\imports` on Windows)
+    pub fn default_root() -> PathBuf {
+        platform::data_dir().join("imports")
+    }
+
+    /// Unpacks and verifies an archive. An import of the same name is
+    /// replaced when `force` is set or when it holds the same build.
+    pub fn import(&self, archive: &Path, force: bool) -> Result<Imported, SingleloadError> {
+        std::fs::create_dir_all(&self.root)?;
+        let unpacked = tempfile::Builder::new().prefix(".import").tempdir_in(&self.root)?;
+        let manifest = unpack_verified(archive, unpacked.path())?;
+
+        let dir = self.root.join(&manifest.name);
+        if let Some(existing) = self.get(&manifest.name)? {
+            if !force && existing.manifest.cache_key != manifest.cache_key {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "{} is already imported from another build; use --force to replace it",
+                    manifest.name
+                )));
+            }
+            std::fs::remove_dir_all(&dir)?;
+        }
+        std::fs::rename(unpacked.keep(), &dir)?;
+        Ok(Imported { dir, manifest })
+    }
+
+    pub fn get(&self, name: &str) -> Result<Option<Imported>, SingleloadError> {
+        if !is_safe_name(name) {
+            return Ok(None);
+        }
+        let dir = self.root.join(name);
+        let manifest = match std::fs::read(dir.join(MANIFEST_FILE)) {
+            Ok(data) => serde_json::from_slice(&data)?,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+            Err(e) => return Err(e.into()),
+        };
+        Ok(Some(Imported { dir, manifest }))
+    }
+
+    /// Imported programs, by name
+    pub fn list(&self) -> Result<Vec<Imported>, SingleloadError> {
+        let entries = match std::fs::read_dir(&self.root) {
+            Ok(entries) => entries,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(e) => return Err(e.into()),
+        };
+        let mut imported = Vec::new();
+        for entry in entries {
+            let name = entry?.file_name().to_string_lossy().to_string();
+            if name.starts_with('.') {
+                continue;
+            }
+            if let Some(program) = self.get(&name)? {
+                imported.push(program);
+            }
+        }
+        imported.sort_by(|a, b| a.manifest.name.cmp(&b.manifest.name));
+        Ok(imported)
+    }
+
+    pub fn remove(&self, name: &str) -> Result<bool, SingleloadError> {
+        if self.get(name)?.is_none() {
+            return Ok(false);
+        }
+        std::fs::remove_dir_all(self.root.join(name))?;
+        Ok(true)
+    }
+}
+
+/// Unpacks and verifies an archive into a temporary directory, for
+/// `run bundle.slp` without importing it
+pub fn open(archive: &Path) -> Result<(TempDir, Imported), SingleloadError> {
+    let dir = TempDir::new()?;
+    let manifest = unpack_verified(archive, dir.path())?;
+    let imported = Imported {
+        dir: dir.path().to_path_buf(),
+        manifest,
+    };
+    Ok((dir, imported))
+}
+
+/// Whether `path` names an export archive rather than a script
+pub fn is_archive(path: &Path) -> bool {
+    path.extension().is_some_and(|ext| ext == EXTENSION)
+}
+
+fn unpack_verified(archive: &Path, dir: &Path) -> Result<ExportManifest, SingleloadError> {
+    remote_cache::unpack(&std::fs::read(archive)?, dir)?;
+    verify(dir).map_err(|e| SingleloadError::InvalidInput(format!("{} is not a valid export: {}", archive.display(), e)))
+}
+
+/// Checks an unpacked archive: a manifest this version understands, a
+/// safe name, and an artifact directory holding exactly the listed files
+/// with their checksums
+fn verify(dir: &Path) -> Result<ExportManifest, SingleloadError> {
+    let manifest: ExportManifest = serde_json::from_slice(&std::fs::read(dir.join(MANIFEST_FILE))?)?;
+    if manifest.format > FORMAT_VERSION {
+        return Err(SingleloadError::InvalidInput(format!(
+            "format {} needs a newer singleload (this one reads up to {})",
+            manifest.format, FORMAT_VERSION
+        )));
+    }
+    if !is_safe_name(&manifest.name)
+        || !is_safe_name(&manifest.script)
+        || manifest.lockfile.as_deref().is_some_and(|l| !is_safe_name(l))
+    {
+        return Err(SingleloadError::InvalidInput("invalid file name in the manifest".to_string()));
+    }
+    if manifest.run.is_empty() {
+        return Err(SingleloadError::InvalidInput("the manifest has no run command".to_string()));
+    }
+    let files = checksums(&dir.join(ARTIFACT_DIR))?;
+    if files != manifest.files {
+        let changed = files
+            .keys()
+            .chain(manifest.files.keys())
+            .find(|path| files.get(*path) != manifest.files.get(*path))
+            .cloned()
+            .unwrap_or_default();
+        return Err(SingleloadError::InvalidInput(format!("checksum mismatch for {}", changed)));
+    }
+    Ok(manifest)
+}
+
+/// A plain file name: no separators, no leading dot
+fn is_safe_name(name: &str) -> bool {
+    !name.is_empty() && !name.starts_with('.') && name.chars().all(|c| c.is_ascii_alphanumeric() || "._-".contains(c))
+}
+
+/// SHA-256 of every regular file under `dir`, by `/`-separated relative path
+fn checksums(dir: &Path) -> Result<BTreeMap<String, String>, SingleloadError> {
+    let mut files = BTreeMap::new();
+    let mut pending = vec![dir.to_path_buf()];
+    while let Some(current) = pending.pop() {
+        for entry in std::fs::read_dir(&current)? {
+            let entry = entry?;
+            let path = entry.path();
+            let file_type = entry.file_type()?;
+            if file_type.is_dir() {
+                pending.push(path);
+            } else if file_type.is_file() {
+                let relative = path
+                    .strip_prefix(dir)
+                    .expect("walked from dir")
+                    .components()
+                    .map(|c| c.as_os_str().to_string_lossy())
+                    .collect::<Vec<_>>()
+                    .join("/");
+                files.insert(relative, hex::encode(Sha256::digest(std::fs::read(&path)?)));
+            }
+        }
+    }
+    Ok(files)
+}
+
+fn copy_dir(from: &Path, to: &Path) -> Result<(), SingleloadError> {
+    std::fs::create_dir_all(to)?;
+    for entry in std::fs::read_dir(from)? {
+        let entry = entry?;
+        let target = to.join(entry.file_name());
+        let file_type = entry.file_type()?;
+        if file_type.is_dir() {
+            copy_dir(&entry.path(), &target)?;
+        } else if file_type.is_file() {
+            std::fs::copy(entry.path(), &target)?;
+        }
+    }
+    Ok(())
+}
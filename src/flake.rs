@@ -0,0 +1,279 @@
+use crate::directives::{Dependency, PackageManager};
+use crate::errors::SingleloadError;
+use crate::platform;
+use sha2::{Digest, Sha256};
+use std::path::{Path, PathBuf};
+
+/// Image Nix environments are resolved and scripts run in with `--nix`; its
+/// store seeds the one kept on the host
+pub const NIX_IMAGE: &str = "docker.io/nixos/nix:2.24.10";
+
+/// nixpkgs the generated flakes follow unless `nixpkgs` is configured; the
+/// flake lock written next to the script pins the exact revision
+pub const DEFAULT_NIXPKGS: &str = "github:NixOS/nixpkgs/nixos-24.05";
+
+/// Where the host's Nix store is mounted
+pub const CONTAINER_NIX_DIR: &str = "/nix";
+
+/// Where the generated flake is resolved, and its environment is read from
+pub const CONTAINER_NIX_ENV_DIR: &str = "/nix-env";
+
+/// The tools of the image's default profile: nix itself, bash and coreutils
+pub const NIX_PATH: &str = "/nix/var/nix/profiles/default/bin";
+
+const NIX_BASH: &str = "/nix/var/nix/profiles/default/bin/bash";
+
+/// Builds run without Nix's sandbox, which needs namespaces the container
+/// does not have, and as the container's only user
+const NIX_OPTIONS: &str = "--extra-experimental-features 'nix-command flakes' \
+     --option sandbox false --option build-users-group ''";
+
+const LANGUAGES: &[&str] = &["bash", "c", "cpp", "go", "javascript", "php", "python", "rust"];
+
+/// pkg-config names whose nixpkgs attribute differs
+const LIBRARY_ATTRIBUTES: &[(&str, &str)] = &[
+    ("libcurl", "curl"),
+    ("libssl", "openssl"),
+    ("libcrypto", "openssl"),
+    ("sqlite3", "sqlite"),
+    ("libxml-2.0", "libxml2"),
+    ("libzstd", "zstd"),
+    ("liblzma", "xz"),
+    ("libpq", "postgresql"),
+];
+
+/// The development shell of a script run with `--nix`: its toolchain, its
+/// Python packages and the system libraries it links against, all from one
+/// nixpkgs
+#[derive(Debug, Clone, PartialEq)]
+pub struct NixShell {
+    pub nixpkgs: String,
+    /// nixpkgs expressions of the packages, e.g. `pkgs.go_1_22`
+    pub packages: Vec<String>,
+    /// Declared versions nixpkgs decides instead, as `name version`
+    pub unpinned: Vec<String>,
+}
+
+impl NixShell {
+    /// Maps a script's toolchain pin, `pip` dependencies and `pkg-config`
+    /// libraries onto nixpkgs. Other dependencies are fetched as usual and
+    /// left out.
+    pub fn resolve(
+        language: &str,
+        version: Option<&str>,
+        dependencies: &[Dependency],
+        libraries: &[String],
+        nixpkgs: &str,
+    ) -> Result<Self, SingleloadError> {
+        if !LANGUAGES.contains(&language) {
+            return Err(SingleloadError::InvalidInput(format!(
+                "--nix supports {} scripts, not {}",
+                LANGUAGES.join(", "),
+                language
+            )));
+        }
+        let toolchain = toolchain_attribute(language, version)?;
+        let mut unpinned = Vec::new();
+        let python: Vec<&Dependency> = dependencies.iter().filter(|d| d.manager == PackageManager::Pip).collect();
+        let mut packages = match (language, python.is_empty()) {
+            ("python", false) => {
+                let mut names = Vec::new();
+                for dep in python {
+                    names.push(format!("ps.\"{}\"", python_attribute(&dep.name)?));
+                    if let Some(version) = &dep.version {
+                        unpinned.push(format!("{} {}", dep.name, version));
+                    }
+                }
+                vec![format!("(pkgs.{}.withPackages (ps: [ {} ]))", toolchain[0], names.join(" "))]
+            }
+            _ => toolchain.iter().map(|attr| format!("pkgs.{}", attr)).collect(),
+        };
+        if !libraries.is_empty() && !packages.iter().any(|p| p == "pkgs.pkg-config") {
+            packages.push("pkgs.pkg-config".to_string());
+        }
+        for library in libraries {
+            let attr = LIBRARY_ATTRIBUTES
+                .iter()
+                .find(|(name, _)| name == library)
+                .map_or(library.as_str(), |(_, attr)| attr);
+            packages.push(format!("pkgs.\"{}\"", attr));
+        }
+        Ok(Self {
+            nixpkgs: nixpkgs.to_string(),
+            packages,
+            unpinned,
+        })
+    }
+
+    /// The flake whose default development shell has the packages
+    pub fn flake(&self) -> String {
+        let system = system();
+        format!(
+            "# Generated by singleload for --nix runs\n\
+             {{\n  \
+               inputs.nixpkgs.url = \"{nixpkgs}\";\n  \
+               outputs = {{ nixpkgs, ... }}:\n    \
+                 let pkgs = nixpkgs.legacyPackages.{system}; in {{\n      \
+                   devShells.{system}.default = pkgs.mkShell {{\n        \
+                     packages = [\n{packages}        ];\n      \
+                   }};\n    \
+                 }};\n\
+             }}\n",
+            nixpkgs = self.nixpkgs,
+            system = system,
+            packages = self.packages.iter().map(|p| format!("          {}\n", p)).collect::<String>(),
+        )
+    }
+
+    /// Key of the environment the flake resolves to with `lock`, the flake
+    /// lock's content
+    pub fn key(&self, lock: &str) -> String {
+        let mut hasher = Sha256::new();
+        hasher.update(self.flake().as_bytes());
+        hasher.update([0u8]);
+        hasher.update(lock.as_bytes());
+        hex::encode(hasher.finalize())
+    }
+}
+
+/// The host's Nix store and the environments resolved into it, under
+/// `nix_dir`
+#[derive(Debug, Clone)]
+pub struct NixStore {
+    root: PathBuf,
+}
+
+impl NixStore {
+    pub fn new(root: PathBuf) -> Self {
+        Self { root }
+    }
+
+    /// Default location, `~/.singleload/nix` (`%LOCALAPPDATA%\singleload\nix` on Windows)
+    pub fn default_root() -> PathBuf {
+        platform::data_dir().join("nix")
+    }
+
+    pub fn root(&self) -> &Path {
+        &self.root
+    }
+
+    /// The directory mounted at `/nix`
+    pub fn store_dir(&self) -> PathBuf {
+        self.root.join("store")
+    }
+
+    /// Returns true once the store has been seeded from the Nix image
+    pub fn is_bootstrapped(&self) -> bool {
+        self.store_dir().join("var").exists()
+    }
+
+    /// The environment script of a resolved shell, as `nix print-dev-env`
+    /// wrote it
+    pub fn env_path(&self, key: &str) -> PathBuf {
+        self.root.join("envs").join(format!("{}.sh", key))
+    }
+}
+
+/// Where the flake lock of `script` is kept: `tool.py.flake.lock` next to `tool.py`
+pub fn lock_path(script: &Path) -> PathBuf {
+    let mut name = script.file_name().unwrap_or_default().to_os_string();
+    name.push(".flake.lock");
+    script.with_file_name(name)
+}
+
+/// Copies the image's store into the host directory mounted at `target`
+pub fn bootstrap_command(target: &str) -> Vec<String> {
+    vec![
+        NIX_BASH.to_string(),
+        "-c".to_string(),
+        format!("cp -a {}/. {}/", CONTAINER_NIX_DIR, target),
+    ]
+}
+
+/// Resolves the flake in [`CONTAINER_NIX_ENV_DIR`], locking it if it has no
+/// lock yet, and writes its development environment to `env.sh` there
+pub fn resolve_command() -> Vec<String> {
+    vec![
+        NIX_BASH.to_string(),
+        "-c".to_string(),
+        format!(
+            "nix {options} print-dev-env path:{dir} > {dir}/env.sh",
+            options = NIX_OPTIONS,
+            dir = CONTAINER_NIX_ENV_DIR
+        ),
+    ]
+}
+
+/// Runs `command` in the environment `nix develop` would give it, from the
+/// environment script mounted at `env_path`
+pub fn shell_command(env_path: &str, command: &[String]) -> Vec<String> {
+    let mut wrapped = vec![
+        NIX_BASH.to_string(),
+        "-c".to_string(),
+        // The shell's own HOME and TMPDIR point at the build sandbox
+        format!("source {} && export HOME=/tmp TMPDIR=/tmp && exec \"$@\"", env_path),
+        "nix-develop".to_string(),
+    ];
+    wrapped.extend(command.iter().cloned());
+    wrapped
+}
+
+/// Nix's name for the platform containers run on
+pub fn system() -> &'static str {
+    match std::env::consts::ARCH {
+        "aarch64" => "aarch64-linux",
+        _ => "x86_64-linux",
+    }
+}
+
+/// The nixpkgs toolchain of `language`, at the `major.minor` of a pin.
+/// nixpkgs carries one version per minor release (for Node.js, per major
+/// release), so the patch level comes from the locked revision.
+fn toolchain_attribute<'a>(language: &str, version: Option<&'a str>) -> Result<Vec<String>, SingleloadError> {
+    let Some(version) = version else {
+        let attrs: &[&str] = match language {
+            "python" => &["python3"],
+            "javascript" => &["nodejs"],
+            "go" => &["go"],
+            "php" => &["php"],
+            "rust" => &["rustc", "cargo"],
+            "bash" => &["bash"],
+            _ => &["gcc"],
+        };
+        return Ok(attrs.iter().map(|a| a.to_string()).collect());
+    };
+    let mut parts = version.trim_start_matches('v').split('.');
+    let number = |part: Option<&'a str>| part.filter(|p| !p.is_empty() && p.chars().all(|c| c.is_ascii_digit()));
+    let (major, minor) = (number(parts.next()), number(parts.next()));
+    let attr = match (language, major, minor) {
+        ("python", Some(major), Some(minor)) => format!("python{}{}", major, minor),
+        ("javascript", Some(major), _) => format!("nodejs_{}", major),
+        ("go", Some(major), Some(minor)) => format!("go_{}_{}", major, minor),
+        ("php", Some(major), Some(minor)) => format!("php{}{}", major, minor),
+        ("python" | "javascript" | "go" | "php", _, _) => {
+            return Err(SingleloadError::InvalidInput(format!(
+                "cannot map {} {} onto nixpkgs; pin a version such as 1.22",
+                language, version
+            )))
+        }
+        _ => {
+            return Err(SingleloadError::InvalidInput(format!(
+                "nixpkgs has a single {} toolchain; drop the {} pin to run with --nix",
+                language, version
+            )))
+        }
+    };
+    Ok(vec![attr])
+}
+
+/// nixpkgs' name for a Python package: lowercase, with `-` for `_` and `.`
+fn python_attribute(name: &str) -> Result<String, SingleloadError> {
+    let name = name.trim();
+    if name.is_empty() || !name.chars().all(|c| c.is_ascii_alphanumeric() || "-_.".contains(c)) {
+        return Err(SingleloadError::InvalidInput(format!(
+            "'{}' is not a Python package name nixpkgs can have",
+            name
+        )));
+    }
+    Ok(name.to_ascii_lowercase().replace(['_', '.'], "-"))
+}
@@ -0,0 +1,70 @@
+use std::path::{Path, PathBuf};
+
+/// Where the host's CUDA toolkit is mounted in build and run containers
+pub const CONTAINER_CUDA_DIR: &str = "/usr/local/cuda";
+
+/// Devices passed to GPU programs by default: every NVIDIA GPU, through
+/// the Container Device Interface spec the NVIDIA container toolkit writes
+pub const DEFAULT_GPU_DEVICES: &[&str] = &["nvidia.com/gpu=all"];
+
+/// GPU programming interface a runner's programs use
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum GpuApi {
+    Cuda,
+    OpenCl,
+}
+
+/// The host's CUDA toolkit: the configured `cuda_dir`, then `CUDA_HOME`,
+/// `CUDA_PATH` and `/usr/local/cuda`, when the directory holds `bin/nvcc`
+pub fn cuda_dir(configured: Option<&Path>) -> Option<PathBuf> {
+    if let Some(dir) = configured {
+        return Some(dir.to_path_buf());
+    }
+    ["CUDA_HOME", "CUDA_PATH"]
+        .iter()
+        .filter_map(|var| std::env::var_os(var).map(PathBuf::from))
+        .chain(std::iter::once(PathBuf::from(CONTAINER_CUDA_DIR)))
+        .find(|dir| dir.join("bin").join("nvcc").is_file())
+}
+
+/// Checks a `cuda-arch` value: a real architecture like `sm_80` or
+/// `sm_90a`, a virtual one like `compute_80`, or `native` for the GPUs of
+/// the machine building it
+pub fn validate_arch(arch: &str) -> Result<(), String> {
+    if arch == "native" {
+        return Ok(());
+    }
+    let number = arch
+        .strip_prefix("sm_")
+        .or_else(|| arch.strip_prefix("compute_"))
+        .ok_or_else(|| format!("'{}' is not a GPU architecture like sm_80, compute_80 or native", arch))?;
+    let digits = number.trim_end_matches(['a', 'f']);
+    if digits.len() < 2 || !digits.chars().all(|c| c.is_ascii_digit()) || number.len() > digits.len() + 1 {
+        return Err(format!("'{}' is not a GPU architecture like sm_80, compute_80 or native", arch));
+    }
+    Ok(())
+}
+
+/// nvcc flags building for `archs`: machine code for each `sm_` entry and
+/// PTX for each `compute_` entry, which the driver compiles for newer GPUs
+pub fn nvcc_arch_flags(archs: &[String]) -> Vec<String> {
+    archs
+        .iter()
+        .map(|arch| match (arch.strip_prefix("sm_"), arch.strip_prefix("compute_")) {
+            (Some(number), _) => format!("-gencode=arch=compute_{n},code=sm_{n}", n = number),
+            (_, Some(number)) => format!("-gencode=arch=compute_{n},code=compute_{n}", n = number),
+            _ => format!("-arch={}", arch),
+        })
+        .collect()
+}
+
+/// clang's equivalent of [`nvcc_arch_flags`]; clang embeds PTX next to
+/// the machine code of every architecture
+pub fn clang_arch_flags(archs: &[String]) -> Vec<String> {
+    let mut flags: Vec<String> = archs
+        .iter()
+        .map(|arch| format!("--cuda-gpu-arch={}", arch.replacen("compute_", "sm_", 1)))
+        .collect();
+    flags.dedup();
+    flags
+}
@@ -0,0 +1,991 @@
+use crate::cache::{BuildCache, CacheEntry, CacheStats};
+use crate::container::ContainerManager;
+use crate::errors::SingleloadError;
+use crate::events::{Event, EventSink};
+use crate::executor::Executor;
+use crate::http2::{self, Responder, Start};
+use crate::logs::{OutputStream, OutputTap};
+use crate::metrics::Metrics;
+use crate::queue::{BuildQueue, Job, Priority};
+use crate::runner::{BuildTarget, Registry};
+use crate::sandbox::SandboxProfile;
+use crate::server::{self, HttpRequest, Submission};
+use crate::types::ExecutionResult;
+use anyhow::Result;
+use serde_json::json;
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tempfile::TempDir;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream};
+use tokio::sync::{mpsc, watch};
+use tracing::{debug, info};
+
+/// Fully qualified name of the service in `proto/singleload/v1/daemon.proto`
+pub const SERVICE: &str = "singleload.v1.Daemon";
+
+/// Content type of gRPC-Web requests and responses; other gRPC-Web content
+/// types are refused
+pub const CONTENT_TYPE: &str = "application/grpc-web+proto";
+
+/// Content type of gRPC requests and responses over HTTP/2
+pub const GRPC_CONTENT_TYPE: &str = "application/grpc";
+
+/// Flag of a frame holding the trailers rather than a message
+const TRAILERS_FLAG: u8 = 0x80;
+
+const VARINT: u8 = 0;
+const FIXED64: u8 = 1;
+const LEN: u8 = 2;
+const FIXED32: u8 = 5;
+
+/// Writes messages in the protobuf wire format. Scalars at their default
+/// value are left out, as proto3 does.
+#[derive(Debug, Default)]
+pub struct Encoder {
+    buf: Vec<u8>,
+}
+
+impl Encoder {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn uint64(mut self, field: u32, value: u64) -> Self {
+        if value != 0 {
+            self.key(field, VARINT);
+            self.varint(value);
+        }
+        self
+    }
+
+    pub fn int64(self, field: u32, value: i64) -> Self {
+        self.uint64(field, value as u64)
+    }
+
+    pub fn bool(self, field: u32, value: bool) -> Self {
+        self.uint64(field, value as u64)
+    }
+
+    pub fn bytes(mut self, field: u32, value: &[u8]) -> Self {
+        if !value.is_empty() {
+            self.len_delimited(field, value);
+        }
+        self
+    }
+
+    pub fn string(self, field: u32, value: &str) -> Self {
+        self.bytes(field, value.as_bytes())
+    }
+
+    /// Every element is written, empty ones included
+    pub fn strings(mut self, field: u32, values: &[String]) -> Self {
+        for value in values {
+            self.len_delimited(field, value.as_bytes());
+        }
+        self
+    }
+
+    /// A `map<string, string>`, as entries with the key in field 1 and the
+    /// value in field 2
+    pub fn map(mut self, field: u32, entries: &BTreeMap<String, String>) -> Self {
+        for (key, value) in entries {
+            let entry = Encoder::new().string(1, key).string(2, value).finish();
+            self.len_delimited(field, &entry);
+        }
+        self
+    }
+
+    /// An embedded message, written even when empty so a oneof or repeated
+    /// field keeps it
+    pub fn message(mut self, field: u32, encoded: &[u8]) -> Self {
+        self.len_delimited(field, encoded);
+        self
+    }
+
+    pub fn finish(self) -> Vec<u8> {
+        self.buf
+    }
+
+    fn key(&mut self, field: u32, wire_type: u8) {
+        self.varint(u64::from(field) << 3 | u64::from(wire_type));
+    }
+
+    fn len_delimited(&mut self, field: u32, value: &[u8]) {
+        self.key(field, LEN);
+        self.varint(value.len() as u64);
+        self.buf.extend_from_slice(value);
+    }
+
+    fn varint(&mut self, mut value: u64) {
+        while value >= 0x80 {
+            self.buf.push(value as u8 | 0x80);
+            value >>= 7;
+        }
+        self.buf.push(value as u8);
+    }
+}
+
+/// A field value as it is on the wire
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Value<'a> {
+    Varint(u64),
+    Bytes(&'a [u8]),
+    /// fixed32, fixed64 and their signed and floating point kinds, which
+    /// no message here uses
+    Fixed(u64),
+}
+
+impl<'a> Value<'a> {
+    pub fn uint64(&self) -> Result<u64, SingleloadError> {
+        match self {
+            Value::Varint(value) => Ok(*value),
+            _ => Err(malformed("expected a varint")),
+        }
+    }
+
+    pub fn bool(&self) -> Result<bool, SingleloadError> {
+        self.uint64().map(|value| value != 0)
+    }
+
+    pub fn bytes(&self) -> Result<&'a [u8], SingleloadError> {
+        match self {
+            Value::Bytes(value) => Ok(value),
+            _ => Err(malformed("expected a length-delimited field")),
+        }
+    }
+
+    pub fn string(&self) -> Result<String, SingleloadError> {
+        String::from_utf8(self.bytes()?.to_vec()).map_err(|_| malformed("a string field is not UTF-8"))
+    }
+}
+
+/// Splits a message into its fields in wire order. Unknown fields are
+/// returned like known ones; decoders skip them so newer clients work.
+pub fn fields(mut data: &[u8]) -> Result<Vec<(u32, Value<'_>)>, SingleloadError> {
+    let mut fields = vec![];
+    while !data.is_empty() {
+        let key = read_varint(&mut data)?;
+        let field = u32::try_from(key >> 3).map_err(|_| malformed("field number out of range"))?;
+        let value = match (key & 0x7) as u8 {
+            VARINT => Value::Varint(read_varint(&mut data)?),
+            LEN => {
+                let len = usize::try_from(read_varint(&mut data)?).unwrap_or(usize::MAX);
+                if len > data.len() {
+                    return Err(malformed("truncated field"));
+                }
+                let (value, rest) = data.split_at(len);
+                data = rest;
+                Value::Bytes(value)
+            }
+            wire_type @ (FIXED64 | FIXED32) => {
+                let len = if wire_type == FIXED64 { 8 } else { 4 };
+                if len > data.len() {
+                    return Err(malformed("truncated field"));
+                }
+                let (value, rest) = data.split_at(len);
+                data = rest;
+                let mut bytes = [0u8; 8];
+                bytes[..len].copy_from_slice(value);
+                Value::Fixed(u64::from_le_bytes(bytes))
+            }
+            wire_type => return Err(malformed(&format!("unsupported wire type {}", wire_type))),
+        };
+        fields.push((field, value));
+    }
+    Ok(fields)
+}
+
+fn read_varint(data: &mut &[u8]) -> Result<u64, SingleloadError> {
+    let mut value = 0u64;
+    for shift in (0..64).step_by(7) {
+        let (&byte, rest) = data.split_first().ok_or_else(|| malformed("truncated varint"))?;
+        *data = rest;
+        value |= u64::from(byte & 0x7f) << shift;
+        if byte < 0x80 {
+            return Ok(value);
+        }
+    }
+    Err(malformed("varint is too long"))
+}
+
+fn malformed(reason: &str) -> SingleloadError {
+    SingleloadError::InvalidInput(format!("Malformed protobuf message: {}", reason))
+}
+
+fn non_empty(value: &str) -> Option<String> {
+    (!value.is_empty()).then(|| value.to_string())
+}
+
+/// `Script`: a path on the daemon's host, or the source itself
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct Script {
+    pub path: String,
+    pub source: String,
+    pub filename: String,
+    pub language: String,
+}
+
+impl Script {
+    pub fn encode(&self) -> Vec<u8> {
+        Encoder::new()
+            .string(1, &self.path)
+            .string(2, &self.source)
+            .string(3, &self.filename)
+            .string(4, &self.language)
+            .finish()
+    }
+
+    pub fn decode(data: &[u8]) -> Result<Self, SingleloadError> {
+        let mut script = Self::default();
+        for (field, value) in fields(data)? {
+            match field {
+                1 => script.path = value.string()?,
+                2 => script.source = value.string()?,
+                3 => script.filename = value.string()?,
+                4 => script.language = value.string()?,
+                _ => {}
+            }
+        }
+        Ok(script)
+    }
+
+    /// The script's path on the host: `path` as given, if `local_paths`
+    /// allows it, or the source saved in `workspace`
+    fn resolve(&self, workspace: &Path, registry: &Registry, local_paths: bool) -> Result<PathBuf, SingleloadError> {
+        if !self.path.is_empty() {
+            if !local_paths {
+                return Err(SingleloadError::SecurityViolation(
+                    "Scripts are sent as source; the daemon was not started with --grpc-allow-paths".to_string(),
+                ));
+            }
+            let path = PathBuf::from(&self.path);
+            if !path.is_absolute() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "Script path '{}' must be absolute",
+                    self.path
+                )));
+            }
+            return Ok(path);
+        }
+        let submission = Submission {
+            language: non_empty(&self.language),
+            source: self.source.clone(),
+            filename: non_empty(&self.filename),
+            ..Default::default()
+        };
+        submission.stage(workspace, registry)
+    }
+}
+
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct SubmitBuildRequest {
+    pub script: Script,
+    pub goos: String,
+    pub goarch: String,
+    pub triple: String,
+    pub build_args: Vec<String>,
+    pub no_cache: bool,
+    pub timeout_secs: u64,
+    pub output: String,
+}
+
+impl SubmitBuildRequest {
+    pub fn encode(&self) -> Vec<u8> {
+        Encoder::new()
+            .message(1, &self.script.encode())
+            .string(2, &self.goos)
+            .string(3, &self.goarch)
+            .string(4, &self.triple)
+            .strings(5, &self.build_args)
+            .bool(6, self.no_cache)
+            .uint64(7, self.timeout_secs)
+            .string(8, &self.output)
+            .finish()
+    }
+
+    pub fn decode(data: &[u8]) -> Result<Self, SingleloadError> {
+        let mut request = Self::default();
+        for (field, value) in fields(data)? {
+            match field {
+                1 => request.script = Script::decode(value.bytes()?)?,
+                2 => request.goos = value.string()?,
+                3 => request.goarch = value.string()?,
+                4 => request.triple = value.string()?,
+                5 => request.build_args.push(value.string()?),
+                6 => request.no_cache = value.bool()?,
+                7 => request.timeout_secs = value.uint64()?,
+                8 => request.output = value.string()?,
+                _ => {}
+            }
+        }
+        Ok(request)
+    }
+
+    fn target(&self) -> Option<BuildTarget> {
+        BuildTarget::from_flags(non_empty(&self.goos), non_empty(&self.goarch), non_empty(&self.triple))
+    }
+}
+
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct SubmitBuildResponse {
+    pub language: String,
+    pub cached: bool,
+    pub duration_ms: u64,
+    pub artifact_sha256: String,
+    pub cache_key: String,
+    pub size_bytes: u64,
+}
+
+impl SubmitBuildResponse {
+    pub fn encode(&self) -> Vec<u8> {
+        Encoder::new()
+            .string(1, &self.language)
+            .bool(2, self.cached)
+            .uint64(3, self.duration_ms)
+            .string(4, &self.artifact_sha256)
+            .string(5, &self.cache_key)
+            .uint64(6, self.size_bytes)
+            .finish()
+    }
+}
+
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct StreamRunRequest {
+    pub script: Script,
+    pub args: Vec<String>,
+    pub env: BTreeMap<String, String>,
+    pub stdin: Vec<u8>,
+    pub timeout_secs: u64,
+    pub memory_mb: u64,
+    pub no_cache: bool,
+}
+
+impl StreamRunRequest {
+    pub fn encode(&self) -> Vec<u8> {
+        Encoder::new()
+            .message(1, &self.script.encode())
+            .strings(2, &self.args)
+            .map(3, &self.env)
+            .bytes(4, &self.stdin)
+            .uint64(5, self.timeout_secs)
+            .uint64(6, self.memory_mb)
+            .bool(7, self.no_cache)
+            .finish()
+    }
+
+    pub fn decode(data: &[u8]) -> Result<Self, SingleloadError> {
+        let mut request = Self::default();
+        for (field, value) in fields(data)? {
+            match field {
+                1 => request.script = Script::decode(value.bytes()?)?,
+                2 => request.args.push(value.string()?),
+                3 => {
+                    let (mut key, mut val) = (String::new(), String::new());
+                    for (field, value) in fields(value.bytes()?)? {
+                        match field {
+                            1 => key = value.string()?,
+                            2 => val = value.string()?,
+                            _ => {}
+                        }
+                    }
+                    request.env.insert(key, val);
+                }
+                4 => request.stdin = value.bytes()?.to_vec(),
+                5 => request.timeout_secs = value.uint64()?,
+                6 => request.memory_mb = value.uint64()?,
+                7 => request.no_cache = value.bool()?,
+                _ => {}
+            }
+        }
+        Ok(request)
+    }
+}
+
+/// One message of the `StreamRun` response stream
+#[derive(Debug)]
+pub enum RunEvent {
+    /// Event name and the whole event as JSON, as `--events json` writes it
+    Progress { event: String, json: String },
+    Output { stream: OutputStream, data: Vec<u8> },
+    Result(ExecutionResult),
+}
+
+impl RunEvent {
+    fn progress(event: &Event) -> Self {
+        let json = json!(event);
+        Self::Progress {
+            event: json["event"].as_str().unwrap_or_default().to_string(),
+            json: json.to_string(),
+        }
+    }
+
+    pub fn encode(&self) -> Vec<u8> {
+        match self {
+            RunEvent::Progress { event, json } => {
+                Encoder::new().message(1, &Encoder::new().string(1, event).string(2, json).finish())
+            }
+            RunEvent::Output { stream, data } => {
+                let stream = match stream {
+                    OutputStream::Stdout => 0,
+                    OutputStream::Stderr => 1,
+                };
+                Encoder::new().message(2, &Encoder::new().uint64(1, stream).bytes(2, data).finish())
+            }
+            RunEvent::Result(result) => Encoder::new().message(
+                3,
+                &Encoder::new()
+                    .string(1, &result.status)
+                    .uint64(2, u64::from(result.exit_code))
+                    .string(3, &result.stdout)
+                    .string(4, &result.stderr)
+                    .uint64(5, result.duration_ms)
+                    .string(6, result.error.as_deref().unwrap_or_default())
+                    .bool(7, result.truncated)
+                    .finish(),
+            ),
+        }
+        .finish()
+    }
+}
+
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct CacheQueryRequest {
+    pub entries: bool,
+    pub language: String,
+}
+
+impl CacheQueryRequest {
+    pub fn encode(&self) -> Vec<u8> {
+        Encoder::new().bool(1, self.entries).string(2, &self.language).finish()
+    }
+
+    pub fn decode(data: &[u8]) -> Result<Self, SingleloadError> {
+        let mut request = Self::default();
+        for (field, value) in fields(data)? {
+            match field {
+                1 => request.entries = value.bool()?,
+                2 => request.language = value.string()?,
+                _ => {}
+            }
+        }
+        Ok(request)
+    }
+}
+
+/// `CacheQueryResponse`, from the cache's stats and, if asked for, its entries
+pub fn encode_cache_stats(stats: &CacheStats, entries: &[CacheEntry]) -> Vec<u8> {
+    let mut encoder = Encoder::new()
+        .uint64(1, stats.entries as u64)
+        .uint64(2, stats.size_bytes)
+        .uint64(3, stats.shared_bytes)
+        .uint64(4, stats.max_bytes.unwrap_or_default())
+        .uint64(5, stats.hits)
+        .uint64(6, stats.misses);
+    for usage in &stats.languages {
+        let usage = Encoder::new()
+            .string(1, &usage.language)
+            .uint64(2, usage.entries as u64)
+            .uint64(3, usage.size_bytes)
+            .uint64(4, usage.hits)
+            .uint64(5, usage.misses)
+            .finish();
+        encoder = encoder.message(7, &usage);
+    }
+    for entry in entries {
+        let entry = Encoder::new()
+            .string(1, &entry.key)
+            .string(2, &entry.language)
+            .string(3, &entry.source)
+            .uint64(4, entry.size_bytes)
+            .bool(5, entry.complete)
+            .int64(6, entry.last_used_at.map(|t| t.timestamp()).unwrap_or_default())
+            .finish();
+        encoder = encoder.message(8, &entry);
+    }
+    encoder.finish()
+}
+
+/// gRPC status codes the daemon answers with
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Code {
+    Ok = 0,
+    InvalidArgument = 3,
+    DeadlineExceeded = 4,
+    NotFound = 5,
+    PermissionDenied = 7,
+    Unimplemented = 12,
+    Internal = 13,
+    Unauthenticated = 16,
+}
+
+impl Code {
+    /// The status a failed call is answered with
+    pub fn of(error: &anyhow::Error) -> Self {
+        match error.downcast_ref::<SingleloadError>() {
+            Some(SingleloadError::InvalidInput(_) | SingleloadError::UnsupportedLanguage(_)) => Code::InvalidArgument,
+            Some(SingleloadError::Timeout) => Code::DeadlineExceeded,
+            Some(SingleloadError::ScriptNotFound(_)) => Code::NotFound,
+            Some(SingleloadError::SecurityViolation(_)) => Code::PermissionDenied,
+            Some(SingleloadError::Io(e)) if e.kind() == std::io::ErrorKind::NotFound => Code::NotFound,
+            _ => Code::Internal,
+        }
+    }
+}
+
+/// A gRPC-Web frame: a flag byte, the length as a big-endian u32, then
+/// the message
+pub fn frame(message: &[u8]) -> Vec<u8> {
+    let mut frame = Vec::with_capacity(message.len() + 5);
+    frame.push(0);
+    frame.extend_from_slice(&(message.len() as u32).to_be_bytes());
+    frame.extend_from_slice(message);
+    frame
+}
+
+/// The frame ending every response, with `grpc-status` and `grpc-message`
+pub fn trailers(code: Code, message: &str) -> Vec<u8> {
+    let mut text = format!("grpc-status: {}\r\n", code as u8);
+    if !message.is_empty() {
+        text.push_str(&format!("grpc-message: {}\r\n", percent_encode(message)));
+    }
+    let mut frame = frame(text.as_bytes());
+    frame[0] = TRAILERS_FLAG;
+    frame
+}
+
+/// A frame read back from a response body
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Frame {
+    Message(Vec<u8>),
+    /// Lowercase names with their values
+    Trailers(Vec<(String, String)>),
+}
+
+/// Splits a request or response body into its frames
+pub fn parse_frames(mut data: &[u8]) -> Result<Vec<Frame>, SingleloadError> {
+    let mut frames = vec![];
+    while !data.is_empty() {
+        if data.len() < 5 {
+            return Err(SingleloadError::InvalidInput("Truncated gRPC-Web frame header".to_string()));
+        }
+        let len = u32::from_be_bytes([data[1], data[2], data[3], data[4]]) as usize;
+        let Some(payload) = data.get(5..5 + len) else {
+            return Err(SingleloadError::InvalidInput("Truncated gRPC-Web frame".to_string()));
+        };
+        frames.push(match data[0] & TRAILERS_FLAG {
+            0 => Frame::Message(payload.to_vec()),
+            _ => Frame::Trailers(
+                String::from_utf8_lossy(payload)
+                    .split("\r\n")
+                    .filter_map(|line| line.split_once(':'))
+                    .map(|(name, value)| (name.trim().to_ascii_lowercase(), value.trim().to_string()))
+                    .collect(),
+            ),
+        });
+        data = &data[5 + len..];
+    }
+    Ok(frames)
+}
+
+/// `grpc-message` is percent-encoded, leaving printable ASCII but `%` as is
+fn percent_encode(message: &str) -> String {
+    let mut encoded = String::new();
+    for byte in message.bytes() {
+        match byte {
+            b' '..=b'~' if byte != b'%' => encoded.push(byte as char),
+            _ => encoded.push_str(&format!("%{:02X}", byte)),
+        }
+    }
+    encoded
+}
+
+/// The daemon's control API: the `Daemon` service of
+/// `proto/singleload/v1/daemon.proto`, so IDE plugins and remote agents get
+/// typed messages instead of CLI output. gRPC clients connect over HTTP/2
+/// without TLS (h2c with prior knowledge); browsers and other HTTP/1.1
+/// clients use gRPC-Web on the same port. Calls wait in the daemon's queue
+/// like runs sent over its socket, and each needs the bearer token.
+pub struct GrpcServer {
+    container_manager: ContainerManager,
+    queue: Arc<BuildQueue>,
+    registry: Arc<Registry>,
+    metrics: Metrics,
+    token: String,
+    local_paths: bool,
+}
+
+impl GrpcServer {
+    pub fn new(
+        container_manager: ContainerManager,
+        queue: Arc<BuildQueue>,
+        registry: Arc<Registry>,
+        metrics: Metrics,
+        token: String,
+    ) -> Self {
+        Self {
+            container_manager,
+            queue,
+            registry,
+            metrics,
+            token,
+            local_paths: false,
+        }
+    }
+
+    /// Lets calls name scripts by their `path` on the daemon's host, for
+    /// clients that run on it
+    pub fn with_local_paths(mut self, local_paths: bool) -> Self {
+        self.local_paths = local_paths;
+        self
+    }
+
+    /// Answers calls on `listener` until the task is dropped
+    pub async fn serve(self, listener: TcpListener) {
+        if let Ok(addr) = listener.local_addr() {
+            info!("gRPC API listening on {} ({})", addr, SERVICE);
+        }
+        let server = Arc::new(self);
+        loop {
+            let Ok((stream, peer)) = listener.accept().await else {
+                continue;
+            };
+            let server = server.clone();
+            tokio::spawn(async move {
+                if let Err(e) = server.handle(stream).await {
+                    debug!("gRPC call from {} failed: {}", peer, e);
+                }
+            });
+        }
+    }
+
+    /// Serves one connection: HTTP/2 if it starts with the preface, else one
+    /// gRPC-Web call over HTTP/1.1
+    async fn handle(self: Arc<Self>, mut stream: TcpStream) -> std::io::Result<()> {
+        let start = match http2::read_start(&mut stream).await? {
+            Start::Http2 => {
+                return http2::serve(stream, move |request, responder| {
+                    let server = self.clone();
+                    async move {
+                        if let Err(e) = server.handle_native(request, responder).await {
+                            debug!("gRPC call failed: {}", e);
+                        }
+                    }
+                })
+                .await
+            }
+            Start::Http1(start) => start,
+        };
+        let request = match server::read_request(&mut start.as_slice().chain(&mut stream)).await {
+            Ok(request) => request,
+            Err(bad) => {
+                let response = format!("HTTP/1.1 {}\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", bad.status);
+                stream.write_all(response.as_bytes()).await?;
+                return stream.shutdown().await;
+            }
+        };
+        if self.method(&request).is_none() {
+            let response = "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n";
+            stream.write_all(response.as_bytes()).await?;
+            return stream.shutdown().await;
+        }
+
+        let head = format!(
+            "HTTP/1.1 200 OK\r\nContent-Type: {}\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n",
+            CONTENT_TYPE
+        );
+        stream.write_all(head.as_bytes()).await?;
+        self.call(&request, Reply::Web(&mut stream)).await
+    }
+
+    /// Answers a call made over HTTP/2
+    async fn handle_native(&self, request: HttpRequest, mut responder: Responder) -> std::io::Result<()> {
+        if self.method(&request).is_none() {
+            return responder.finish(&[(":status", "404")]).await;
+        }
+        responder
+            .headers(&[(":status", "200"), ("content-type", GRPC_CONTENT_TYPE)])
+            .await?;
+        self.call(&request, Reply::Native(responder)).await
+    }
+
+    /// The method a request calls, if it is a call to the service
+    fn method<'a>(&self, request: &'a HttpRequest) -> Option<&'a str> {
+        debug!("gRPC {} {}", request.method, request.path);
+        let method = request.path.strip_prefix(&format!("/{}/", SERVICE))?;
+        (request.method == "POST" && !method.is_empty()).then_some(method)
+    }
+
+    /// Answers a call whose response headers have been sent
+    async fn call(&self, request: &HttpRequest, mut reply: Reply<'_>) -> std::io::Result<()> {
+        let body = match self.message(request, reply.content_types()) {
+            Ok(body) => body,
+            Err((code, message)) => return reply.finish(code, &message).await,
+        };
+        let method = self.method(request).unwrap_or_default();
+        let result = match method {
+            "SubmitBuild" => self.submit_build(&body).await,
+            "StreamRun" => return self.stream_run(reply, &body).await,
+            "CacheQuery" => self.cache_query(&body),
+            _ => {
+                let message = format!("{} has no method {}", SERVICE, method);
+                return reply.finish(Code::Unimplemented, &message).await;
+            }
+        };
+        match result {
+            Ok(message) => {
+                reply.message(&message).await?;
+                reply.finish(Code::Ok, "").await
+            }
+            Err(e) => reply.finish(Code::of(&e), &e.to_string()).await,
+        }
+    }
+
+    /// The request message, once the caller and the content type are checked
+    fn message(&self, request: &HttpRequest, content_types: &[&str]) -> Result<Vec<u8>, (Code, String)> {
+        let given = request
+            .header("authorization")
+            .and_then(|value| value.strip_prefix("Bearer "))
+            .unwrap_or_default();
+        if !server::token_matches(given, &self.token) {
+            return Err((Code::Unauthenticated, "Missing or invalid bearer token".to_string()));
+        }
+        let content_type = request.header("content-type").unwrap_or_default();
+        if !content_types.contains(&content_type) {
+            return Err((Code::InvalidArgument, format!("Expected {}, got '{}'", content_types[0], content_type)));
+        }
+        match parse_frames(&request.body) {
+            Ok(frames) => match frames.into_iter().next() {
+                Some(Frame::Message(message)) => Ok(message),
+                _ => Err((Code::InvalidArgument, "The request has no message".to_string())),
+            },
+            Err(e) => Err((Code::InvalidArgument, e.to_string())),
+        }
+    }
+
+    async fn submit_build(&self, body: &[u8]) -> Result<Vec<u8>> {
+        let request = SubmitBuildRequest::decode(body)?;
+        // Clients get the artifact's digest and size; writing it to a path
+        // they choose would let them overwrite the daemon user's files
+        if !request.output.is_empty() {
+            return Err(SingleloadError::InvalidInput(
+                "SubmitBuild does not write artifacts on the daemon's host; leave output empty".to_string(),
+            )
+            .into());
+        }
+        let workspace = TempDir::new()?;
+        let script = request.script.resolve(workspace.path(), &self.registry, self.local_paths)?;
+        let output = workspace.path().join("artifact");
+
+        let _ticket = self.queue.acquire(self.job(&request.script, &script)).await;
+        let mut executor = self
+            .executor(&request.script, request.timeout_secs, 0)?
+            .with_build_args(request.build_args.clone())
+            .with_events(self.metrics.sink());
+        if request.no_cache {
+            executor = executor.without_cache();
+        }
+        let language = non_empty(&request.script.language);
+        let built = executor
+            .build_script(language.as_deref(), &script, request.target().as_ref(), &output)
+            .await?;
+        Ok(SubmitBuildResponse {
+            language: built.language,
+            cached: built.cached,
+            duration_ms: built.duration_ms,
+            artifact_sha256: built.provenance.artifact_sha256,
+            cache_key: built.provenance.cache_key,
+            size_bytes: std::fs::metadata(&output)?.len(),
+        }
+        .encode())
+    }
+
+    /// Runs a script, sending its progress and output while it runs and its
+    /// result last. A client that goes away cancels the run.
+    async fn stream_run(&self, mut reply: Reply<'_>, body: &[u8]) -> std::io::Result<()> {
+        let request = match StreamRunRequest::decode(body) {
+            Ok(request) => request,
+            Err(e) => return reply.finish(Code::InvalidArgument, &e.to_string()).await,
+        };
+
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        let events = {
+            let sender = sender.clone();
+            let metrics = self.metrics.sink();
+            EventSink::new(move |event: &Event| {
+                metrics.emit(event.clone());
+                let _ = sender.send(RunEvent::progress(event).encode());
+            })
+        };
+        let output: OutputTap = Arc::new(move |stream, data| {
+            let event = RunEvent::Output { stream, data: data.to_vec() };
+            let _ = sender.send(event.encode());
+        });
+
+        let (cancel, cancelled) = watch::channel(false);
+        let run = self.run(&request, events, output, cancelled);
+        tokio::pin!(run);
+        let mut connected = true;
+        let result = loop {
+            tokio::select! {
+                result = &mut run => break result,
+                Some(message) = receiver.recv() => {
+                    if connected && reply.message(&message).await.is_err() {
+                        debug!("gRPC client went away, cancelling the run");
+                        connected = false;
+                        let _ = cancel.send(true);
+                    }
+                }
+            }
+        };
+        if !connected {
+            return Ok(());
+        }
+
+        while let Ok(message) = receiver.try_recv() {
+            reply.message(&message).await?;
+        }
+        match result {
+            Ok(result) => {
+                reply.message(&RunEvent::Result(result).encode()).await?;
+                reply.finish(Code::Ok, "").await
+            }
+            Err(e) => reply.finish(Code::of(&e), &e.to_string()).await,
+        }
+    }
+
+    async fn run(
+        &self,
+        request: &StreamRunRequest,
+        events: EventSink,
+        output: OutputTap,
+        cancel: watch::Receiver<bool>,
+    ) -> Result<ExecutionResult> {
+        let workspace = TempDir::new()?;
+        let script = request.script.resolve(workspace.path(), &self.registry, self.local_paths)?;
+        let queued = self.metrics.queued();
+        let _ticket = self.queue.acquire(self.job(&request.script, &script)).await;
+        drop(queued);
+        let _active = self.metrics.active();
+
+        let mut executor = self
+            .executor(&request.script, request.timeout_secs, request.memory_mb)?
+            .with_env(request.env.clone().into_iter().collect())
+            .with_run_args(request.args.clone())
+            .with_events(events)
+            .with_output(Some(output));
+        if request.no_cache {
+            executor = executor.without_cache();
+        }
+        let language = non_empty(&request.script.language);
+        let input = (!request.stdin.is_empty()).then_some(request.stdin.as_slice());
+        let result = executor
+            .run_script_with_input(language.as_deref(), &script, false, cancel, input)
+            .await;
+        self.metrics.record_run(result.as_ref().ok());
+        result
+    }
+
+    fn cache_query(&self, body: &[u8]) -> Result<Vec<u8>> {
+        let request = CacheQueryRequest::decode(body)?;
+        let config = &self.container_manager.config;
+        let cache = BuildCache::new(config.cache_dir.clone())
+            .with_budget(config.cache.budget()?)
+            .with_dedupe(config.cache.dedupe);
+        let mut stats = cache.stats()?;
+        let wanted = |language: &str| request.language.is_empty() || request.language.eq_ignore_ascii_case(language);
+        stats.languages.retain(|usage| wanted(&usage.language));
+        let mut entries = match request.entries {
+            true => cache.list()?,
+            false => vec![],
+        };
+        entries.retain(|entry| wanted(&entry.language));
+        Ok(encode_cache_stats(&stats, &entries))
+    }
+
+    fn job(&self, script: &Script, path: &Path) -> Job {
+        let language = non_empty(&script.language).or_else(|| {
+            let content = std::fs::read(path).ok()?;
+            self.registry.detect(path, &content).map(|runner| runner.name().to_string())
+        });
+        Job {
+            script: path.canonicalize().unwrap_or_else(|_| path.to_path_buf()),
+            language,
+            priority: Priority::Normal,
+            supersede: false,
+        }
+    }
+
+    /// An executor within the configured defaults, which calls can lower
+    /// but not raise; 0 keeps the default. Sources sent along are staged
+    /// afresh for every call, so they get no persistent state.
+    fn executor(&self, script: &Script, timeout_secs: u64, memory_mb: u64) -> Result<Executor> {
+        let config = &self.container_manager.config;
+        let limit = |value: u64, default: u64, min: u64| match value {
+            0 => default,
+            value => value.clamp(min, default),
+        };
+        let timeout = limit(timeout_secs, config.default_timeout_secs, 1);
+        let memory = limit(memory_mb, config.default_memory_mb, 32);
+        let sandbox = SandboxProfile::resolve(&config.default_sandbox, &config.sandbox_profiles)?;
+        let executor = Executor::new(
+            self.container_manager.clone(),
+            Duration::from_secs(timeout),
+            memory * 1024 * 1024,
+            config.default_cpu_limit,
+            config.default_output_limit_kb * 1024,
+        )
+        .with_sandbox(sandbox);
+        Ok(match script.path.is_empty() {
+            true => executor.without_state(),
+            false => executor,
+        })
+    }
+}
+
+/// Where a call's response goes once its headers are sent
+enum Reply<'a> {
+    /// gRPC-Web on an HTTP/1.1 connection, which is closed after the call
+    Web(&'a mut TcpStream),
+    /// gRPC on an HTTP/2 stream
+    Native(Responder),
+}
+
+impl Reply<'_> {
+    /// The request content types the call is answered for; the first is
+    /// the one responses have
+    fn content_types(&self) -> &'static [&'static str] {
+        match self {
+            Reply::Web(_) => &[CONTENT_TYPE, "application/grpc-web"],
+            Reply::Native(_) => &[GRPC_CONTENT_TYPE, "application/grpc+proto"],
+        }
+    }
+
+    async fn message(&mut self, message: &[u8]) -> std::io::Result<()> {
+        match self {
+            Reply::Web(stream) => stream.write_all(&frame(message)).await,
+            Reply::Native(responder) => responder.data(frame(message)).await,
+        }
+    }
+
+    /// Ends the call with its status, in the trailers
+    async fn finish(self, code: Code, message: &str) -> std::io::Result<()> {
+        match self {
+            Reply::Web(stream) => {
+                stream.write_all(&trailers(code, message)).await?;
+                stream.shutdown().await
+            }
+            Reply::Native(responder) => {
+                let status = (code as u8).to_string();
+                let message = percent_encode(message);
+                let mut fields = vec![("grpc-status", status.as_str())];
+                if !message.is_empty() {
+                    fields.push(("grpc-message", message.as_str()));
+                }
+                responder.finish(&fields).await
+            }
+        }
+    }
+}
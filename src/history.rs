@@ -0,0 +1,235 @@
+use crate::errors::SingleloadError;
+use crate::platform;
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::fs::{File, OpenOptions};
+use std::io::{BufRead, BufReader, Read, Seek, SeekFrom, Write};
+use std::path::{Path, PathBuf};
+
+/// Stands in for `--set` values in recorded command lines
+pub const REDACTED: &str = "<redacted>";
+
+/// Size past which the oldest runs are dropped from the history
+const MAX_BYTES: u64 = 4 * 1024 * 1024;
+
+/// How much of the end of the history is read to find the last id
+const TAIL_BYTES: u64 = 64 * 1024;
+
+/// A past `singleload run`, as recorded in the history
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Invocation {
+    pub id: u64,
+    pub started_at: DateTime<Utc>,
+    /// Directory the command was run from
+    pub cwd: PathBuf,
+    /// Command line after the program name, as it was given
+    pub args: Vec<String>,
+    /// Script path or URL; programs read from stdin are recorded under the
+    /// copy saved in the cache directory
+    pub script: String,
+    /// True if the program was read from stdin
+    #[serde(default)]
+    pub stdin: bool,
+    /// SHA-256 of the script, or of every file of a directory project
+    pub sha256: String,
+    pub exit_code: i32,
+    pub duration_ms: u64,
+}
+
+impl Invocation {
+    pub fn is_remote(&self) -> bool {
+        crate::remote::is_remote(&self.script)
+    }
+}
+
+/// Append-only log of runs, one JSON document per line. Every write holds
+/// an exclusive lock on the file, so concurrent runs get distinct ids.
+/// Once the file outgrows [`MAX_BYTES`], the oldest half is dropped.
+#[derive(Debug, Clone)]
+pub struct HistoryStore {
+    path: PathBuf,
+}
+
+impl HistoryStore {
+    pub fn new(path: PathBuf) -> Self {
+        Self { path }
+    }
+
+    /// Default location, `~/.singleload/history.jsonl` (`%LOCALAPPDATA%\singleload\history.jsonl` on Windows)
+    pub fn default_path() -> PathBuf {
+        platform::data_dir().join("history.jsonl")
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Appends `invocation` under the next free id, which is returned
+    pub fn record(&self, mut invocation: Invocation) -> Result<u64, SingleloadError> {
+        if let Some(parent) = self.path.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        let mut options = OpenOptions::new();
+        options.read(true).append(true).create(true);
+        // Paths and arguments are nobody else's business
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::OpenOptionsExt;
+            options.mode(0o600);
+        }
+        let mut file = options.open(&self.path)?;
+        file.lock()?;
+
+        invocation.id = last_id(&mut file)?.map_or(1, |id| id + 1);
+        invocation.args = redact_args(&invocation.args);
+        let mut line = serde_json::to_vec(&invocation)?;
+        line.push(b'\n');
+        file.write_all(&line)?;
+
+        if file.metadata()?.len() > MAX_BYTES {
+            let entries = read_entries(&file);
+            let kept = &entries[entries.len() / 2..];
+            file.set_len(0)?;
+            for entry in kept {
+                let mut line = serde_json::to_vec(entry)?;
+                line.push(b'\n');
+                file.write_all(&line)?;
+            }
+        }
+        Ok(invocation.id)
+    }
+
+    /// Recorded runs, oldest first. Lines that do not parse are skipped.
+    pub fn list(&self) -> Result<Vec<Invocation>, SingleloadError> {
+        match File::open(&self.path) {
+            Ok(file) => {
+                file.lock_shared()?;
+                Ok(read_entries(&file))
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(Vec::new()),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    pub fn get(&self, id: u64) -> Result<Option<Invocation>, SingleloadError> {
+        Ok(self.list()?.into_iter().find(|invocation| invocation.id == id))
+    }
+
+    /// Empties the history, returning how many runs it held
+    pub fn clear(&self) -> Result<usize, SingleloadError> {
+        let file = match OpenOptions::new().read(true).write(true).open(&self.path) {
+            Ok(file) => file,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(0),
+            Err(e) => return Err(e.into()),
+        };
+        file.lock()?;
+        let count = read_entries(&file).len();
+        file.set_len(0)?;
+        Ok(count)
+    }
+}
+
+/// Id of the newest run, read from the end of the history, or from all of
+/// it when the last line is longer than [`TAIL_BYTES`]
+fn last_id(file: &mut File) -> std::io::Result<Option<u64>> {
+    let len = file.metadata()?.len();
+    file.seek(SeekFrom::Start(len.saturating_sub(TAIL_BYTES)))?;
+    let mut tail = Vec::new();
+    file.read_to_end(&mut tail)?;
+    let last = tail
+        .split(|b| *b == b'\n')
+        .rev()
+        .find_map(|line| serde_json::from_slice::<Invocation>(line).ok());
+    if last.is_none() && len > TAIL_BYTES {
+        file.seek(SeekFrom::Start(0))?;
+        return Ok(read_entries(file).last().map(|last| last.id));
+    }
+    Ok(last.map(|last| last.id))
+}
+
+/// A command line with the values of `--env` and `--set` taken out, up to
+/// a `--` that starts the script's own arguments. `--env KEY=VALUE` is
+/// recorded as `--env KEY`, which passes the host's value when the run is
+/// repeated; `--set KEY=VALUE` as `--set KEY=<redacted>`.
+pub fn redact_args(args: &[String]) -> Vec<String> {
+    let mut redacted = Vec::with_capacity(args.len());
+    let mut value_of: Option<&str> = None;
+    for (idx, arg) in args.iter().enumerate() {
+        if let Some(flag) = value_of.take() {
+            redacted.push(redact_value(flag, arg));
+            continue;
+        }
+        if arg == "--" {
+            redacted.extend(args[idx..].iter().cloned());
+            break;
+        }
+        match arg.as_str() {
+            "-e" | "--env" => value_of = Some("--env"),
+            "--set" => value_of = Some("--set"),
+            _ => {}
+        }
+        // Values attached to the flag: --env=KEY=VALUE, -eKEY=VALUE, --set=KEY=VALUE
+        let inline = [("--env=", "--env"), ("--set=", "--set"), ("-e", "--env")]
+            .into_iter()
+            .find_map(|(prefix, flag)| Some((prefix, flag, arg.strip_prefix(prefix).filter(|v| !v.is_empty())?)));
+        match inline {
+            Some((prefix, flag, value)) => redacted.push(format!("{}{}", prefix, redact_value(flag, value))),
+            None => redacted.push(arg.clone()),
+        }
+    }
+    redacted
+}
+
+fn redact_value(flag: &str, value: &str) -> String {
+    match value.split_once('=') {
+        Some((key, _)) if flag == "--env" => key.to_string(),
+        Some((key, _)) => format!("{}={}", key, REDACTED),
+        None => value.to_string(),
+    }
+}
+
+fn read_entries(file: &File) -> Vec<Invocation> {
+    BufReader::new(file)
+        .lines()
+        .map_while(Result::ok)
+        .filter_map(|line| serde_json::from_str(&line).ok())
+        .collect()
+}
+
+/// SHA-256 of a script, or of the relative paths and contents of every
+/// file under a directory project, in path order. Hidden files and
+/// directories such as `.git` are left out.
+pub fn content_hash(path: &Path) -> std::io::Result<String> {
+    if !path.is_dir() {
+        return Ok(hex::encode(Sha256::digest(std::fs::read(path)?)));
+    }
+
+    let mut files = Vec::new();
+    collect_files(path, &mut files)?;
+    files.sort();
+    let mut hasher = Sha256::new();
+    for file in files {
+        let relative = file.strip_prefix(path).unwrap_or(&file);
+        hasher.update(relative.to_string_lossy().as_bytes());
+        hasher.update([0]);
+        hasher.update(Sha256::digest(std::fs::read(&file)?));
+    }
+    Ok(hex::encode(hasher.finalize()))
+}
+
+fn collect_files(dir: &Path, files: &mut Vec<PathBuf>) -> std::io::Result<()> {
+    for entry in std::fs::read_dir(dir)? {
+        let entry = entry?;
+        if entry.file_name().to_string_lossy().starts_with('.') {
+            continue;
+        }
+        let path = entry.path();
+        if entry.file_type()?.is_dir() {
+            collect_files(&path, files)?;
+        } else {
+            files.push(path);
+        }
+    }
+    Ok(())
+}
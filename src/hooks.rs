@@ -0,0 +1,138 @@
+use crate::directives::Directives;
+use crate::errors::SingleloadError;
+use crate::runner::{shell_quote, supervise};
+use serde::{Deserialize, Serialize};
+use std::path::Path;
+
+/// Workspace directory hook files next to the script are staged in
+pub const HOOKS_DIR: &str = ".singleload-hooks";
+
+/// Commands run in the script's container around every script, from the
+/// `[hooks]` table of the config
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct HooksConfig {
+    pub pre: Vec<String>,
+    pub post: Vec<String>,
+}
+
+/// Shell commands run before and after a script, in the container it runs
+/// in and with the same environment
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Hooks {
+    pub pre: Vec<String>,
+    pub post: Vec<String>,
+}
+
+impl Hooks {
+    /// The configured hooks around the script's `pre` and `post` directives:
+    /// configured pre hooks run first and configured post hooks last. A hook
+    /// starting with a path relative to the script, as in `./setup.sh`, has
+    /// that file copied into `workspace` so the container can run it. Like
+    /// embedded assets, hook files have to be in the script's directory, so
+    /// a script cannot copy other host files into its container.
+    pub fn resolve(
+        config: &HooksConfig,
+        directives: &Directives,
+        script_dir: &Path,
+        workspace: &Path,
+    ) -> Result<Self, SingleloadError> {
+        let root = match script_dir.as_os_str().is_empty() {
+            true => Path::new("."),
+            false => script_dir,
+        };
+        let mut staged = 0;
+        let mut stage = |line: usize, value: &str| -> Result<String, SingleloadError> {
+            let value = value.trim();
+            let Some(file) = value.split_whitespace().next().filter(|w| w.starts_with("./") || w.starts_with("../"))
+            else {
+                return Ok(value.to_string());
+            };
+            let source = script_dir.join(file);
+            if !source.is_file() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "line {}: hook file {} not found",
+                    line,
+                    source.display()
+                )));
+            }
+            let source = source.canonicalize()?;
+            if !source.starts_with(root.canonicalize()?) {
+                return Err(SingleloadError::SecurityViolation(format!(
+                    "line {}: hook file {} is outside the script directory",
+                    line,
+                    script_dir.join(file).display()
+                )));
+            }
+            staged += 1;
+            let name = format!("{}-{}", staged, source.file_name().unwrap_or_default().to_string_lossy());
+            let dir = workspace.join(HOOKS_DIR);
+            std::fs::create_dir_all(&dir)?;
+            std::fs::copy(&source, dir.join(&name))?;
+            #[cfg(unix)]
+            {
+                use std::os::unix::fs::PermissionsExt;
+                std::fs::set_permissions(dir.join(&name), std::fs::Permissions::from_mode(0o755))?;
+            }
+            Ok(format!("/workspace/{}/{}{}", HOOKS_DIR, shell_quote(&name), &value[file.len()..]))
+        };
+
+        let mut hooks = Self {
+            pre: config.pre.clone(),
+            post: vec![],
+        };
+        for (name, hooks) in [("pre", &mut hooks.pre), ("post", &mut hooks.post)] {
+            for directive in directives.all(name) {
+                if directive.value.trim().is_empty() {
+                    return Err(SingleloadError::InvalidInput(format!(
+                        "line {}: '{}' directive needs a command, e.g. {} ./setup.sh",
+                        directive.line, name, name
+                    )));
+                }
+                hooks.push(stage(directive.line, &directive.value)?);
+            }
+        }
+        hooks.post.extend(config.post.iter().cloned());
+        Ok(hooks)
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.pre.is_empty() && self.post.is_empty()
+    }
+
+    /// Wraps `command` in a shell that runs the pre hooks first, ending the
+    /// run with the exit code of the first that fails, and the post hooks
+    /// after it whatever its outcome. Post hooks see the program's exit code
+    /// as `SINGLELOAD_EXIT_CODE`, and one that fails fails a run that
+    /// succeeded. Each hook runs in a subshell, so `exit` ends only it.
+    pub fn wrap(&self, command: &[String]) -> Vec<String> {
+        let mut script = String::new();
+        for hook in &self.pre {
+            script.push_str(&format!(
+                "( {} ) || {{ status=$?; echo {} \"$status\" >&2; exit \"$status\"; }}\n",
+                hook,
+                shell_quote(&format!("singleload: pre hook '{}' failed with exit code", hook))
+            ));
+        }
+        if self.post.is_empty() {
+            script.push_str("exec \"$@\"");
+        } else {
+            script.push_str(&supervise("\"$@\""));
+            script.push_str("\nexport SINGLELOAD_EXIT_CODE=$status\n");
+        }
+        for hook in &self.post {
+            script.push_str(&format!(
+                "( {} ) || {{ hook=$?; echo {} \"$hook\" >&2; [ \"$status\" -ne 0 ] || status=$hook; }}\n",
+                hook,
+                shell_quote(&format!("singleload: post hook '{}' failed with exit code", hook))
+            ));
+        }
+        if !self.post.is_empty() {
+            script.push_str("exit \"$status\"");
+        }
+
+        let mut wrapped = vec!["/bin/bash".to_string(), "-c".to_string(), script, "singleload-hooks".to_string()];
+        wrapped.extend(command.iter().cloned());
+        wrapped
+    }
+}
@@ -0,0 +1,1044 @@
+use crate::errors::SingleloadError;
+use crate::server::{HttpRequest, MAX_BODY_BYTES};
+use std::collections::{HashMap, VecDeque};
+use std::future::Future;
+use std::io;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, OnceLock};
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWriteExt};
+use tokio::net::tcp::{OwnedReadHalf, OwnedWriteHalf};
+use tokio::net::TcpStream;
+use tokio::sync::{mpsc, oneshot};
+use tracing::debug;
+
+/// What a client that knows the server speaks HTTP/2 sends first, before
+/// its SETTINGS frame
+pub const PREFACE: &[u8] = b"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n";
+
+/// Largest frame payload either side sends; the protocol's default, which
+/// the server does not raise
+const MAX_FRAME_SIZE: usize = 16 * 1024;
+
+/// Largest header block, and largest header list it decodes to
+const MAX_HEADER_BYTES: usize = 64 * 1024;
+
+/// Requests a connection serves at once
+const MAX_STREAMS: usize = 100;
+
+/// Size of the HPACK dynamic table the server lets clients use
+const TABLE_SIZE: usize = 4096;
+
+/// Window both sides start with, for the connection and every stream
+const INITIAL_WINDOW: i64 = 65_535;
+
+const DATA: u8 = 0x0;
+const HEADERS: u8 = 0x1;
+const PRIORITY: u8 = 0x2;
+const RST_STREAM: u8 = 0x3;
+const SETTINGS: u8 = 0x4;
+const PUSH_PROMISE: u8 = 0x5;
+const PING: u8 = 0x6;
+const GOAWAY: u8 = 0x7;
+const WINDOW_UPDATE: u8 = 0x8;
+const CONTINUATION: u8 = 0x9;
+
+const END_STREAM: u8 = 0x1;
+const ACK: u8 = 0x1;
+const END_HEADERS: u8 = 0x4;
+const PADDED: u8 = 0x8;
+const PRIORITY_FLAG: u8 = 0x20;
+
+const SETTINGS_MAX_CONCURRENT_STREAMS: u16 = 0x3;
+const SETTINGS_INITIAL_WINDOW_SIZE: u16 = 0x4;
+
+const NO_ERROR: u32 = 0x0;
+const PROTOCOL_ERROR: u32 = 0x1;
+const INTERNAL_ERROR: u32 = 0x2;
+const FLOW_CONTROL_ERROR: u32 = 0x3;
+const FRAME_SIZE_ERROR: u32 = 0x6;
+const REFUSED_STREAM: u32 = 0x7;
+const COMPRESSION_ERROR: u32 = 0x9;
+
+/// How a connection starts
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Start {
+    /// The client sent the HTTP/2 preface, which has been read
+    Http2,
+    /// What was read before it was clear the client speaks HTTP/1.1; it is
+    /// the start of its request
+    Http1(Vec<u8>),
+}
+
+/// Reads the start of a connection, as far as it takes to tell an HTTP/2
+/// client from an HTTP/1.1 one. No HTTP/1.1 request starts like the preface,
+/// so at most its first bytes are read.
+pub async fn read_start<R: AsyncRead + Unpin>(stream: &mut R) -> io::Result<Start> {
+    let mut read = Vec::with_capacity(PREFACE.len());
+    while read.len() < PREFACE.len() && PREFACE.starts_with(&read) {
+        let mut buf = [0u8; PREFACE.len()];
+        let n = stream.read(&mut buf[..PREFACE.len() - read.len()]).await?;
+        if n == 0 {
+            break;
+        }
+        read.extend_from_slice(&buf[..n]);
+    }
+    Ok(match read == PREFACE {
+        true => Start::Http2,
+        false => Start::Http1(read),
+    })
+}
+
+/// Serves HTTP/2 on `stream`, whose preface has been read, until the client
+/// closes it. Every request is read whole, then `handler` runs on a task of
+/// its own with it and the `Responder` for its response. This is the part of
+/// HTTP/2 (RFC 9113) that gRPC clients use over cleartext connections: HPACK,
+/// flow control, pings and resets; there is no server push or priority.
+pub async fn serve<F, Fut>(stream: TcpStream, handler: F) -> io::Result<()>
+where
+    F: Fn(HttpRequest, Responder) -> Fut,
+    Fut: Future<Output = ()> + Send + 'static,
+{
+    let (mut socket, output) = stream.into_split();
+    let (commands, receiver) = mpsc::unbounded_channel();
+    let writer = tokio::spawn(Writer::new(output).run(receiver));
+
+    let mut settings = Vec::new();
+    put_setting(&mut settings, SETTINGS_MAX_CONCURRENT_STREAMS, MAX_STREAMS as u32);
+    let _ = commands.send(Command::Control(frame(SETTINGS, 0, 0, &settings)));
+
+    let mut connection = Connection {
+        commands: commands.clone(),
+        decoder: Decoder::new(),
+        incoming: HashMap::new(),
+        last_stream: 0,
+        active: Arc::new(AtomicUsize::new(0)),
+    };
+    let result = connection.read(&mut socket, &handler).await;
+    if let Err(Failure::Protocol(code, reason)) = &result {
+        debug!("HTTP/2 connection error {}: {}", code, reason);
+        let mut payload = connection.last_stream.to_be_bytes().to_vec();
+        payload.extend_from_slice(&code.to_be_bytes());
+        let _ = commands.send(Command::Control(frame(GOAWAY, 0, 0, &payload)));
+    }
+    let _ = commands.send(Command::Close);
+    drop(connection);
+    drop(commands);
+    let _ = writer.await;
+    match result {
+        Ok(()) => Ok(()),
+        Err(Failure::Io(e)) => Err(e),
+        Err(Failure::Protocol(_, reason)) => Err(io::Error::new(io::ErrorKind::InvalidData, reason)),
+    }
+}
+
+/// Why a connection ended before the client closed it
+#[derive(Debug)]
+enum Failure {
+    Io(io::Error),
+    /// An HTTP/2 error code and what went wrong; the client gets the code in
+    /// a GOAWAY frame
+    Protocol(u32, String),
+}
+
+impl From<io::Error> for Failure {
+    fn from(e: io::Error) -> Self {
+        Failure::Io(e)
+    }
+}
+
+fn protocol(code: u32, reason: &str) -> Failure {
+    Failure::Protocol(code, reason.to_string())
+}
+
+/// The frame with `payload`
+fn frame(kind: u8, flags: u8, stream: u32, payload: &[u8]) -> Vec<u8> {
+    let mut frame = Vec::with_capacity(9 + payload.len());
+    put_frame(&mut frame, kind, flags, stream, payload);
+    frame
+}
+
+fn put_frame(out: &mut Vec<u8>, kind: u8, flags: u8, stream: u32, payload: &[u8]) {
+    out.extend_from_slice(&(payload.len() as u32).to_be_bytes()[1..]);
+    out.push(kind);
+    out.push(flags);
+    out.extend_from_slice(&(stream & 0x7fff_ffff).to_be_bytes());
+    out.extend_from_slice(payload);
+}
+
+fn put_setting(out: &mut Vec<u8>, id: u16, value: u32) {
+    out.extend_from_slice(&id.to_be_bytes());
+    out.extend_from_slice(&value.to_be_bytes());
+}
+
+fn reset(stream: u32, code: u32) -> Command {
+    Command::Control(frame(RST_STREAM, 0, stream, &code.to_be_bytes()))
+}
+
+fn window_update(stream: u32, increment: usize) -> Command {
+    Command::Control(frame(WINDOW_UPDATE, 0, stream, &(increment as u32).to_be_bytes()))
+}
+
+/// What the reading side and responders ask of the task writing frames
+enum Command {
+    /// A frame outside flow control, written as it is
+    Control(Vec<u8>),
+    /// The client's initial stream window changed
+    InitialWindow(u32),
+    WindowUpdate {
+        stream: u32,
+        increment: u32,
+    },
+    /// A request was read and its handler is about to answer it
+    Open(u32),
+    /// The client reset the stream; what is left to send on it is dropped
+    Reset(u32),
+    /// Part of a response; `done` is dropped if it cannot be sent
+    Send {
+        stream: u32,
+        part: Part,
+        done: oneshot::Sender<()>,
+    },
+    /// The stream's responder is gone
+    Done(u32),
+    /// The client closed the connection, so nothing more can be sent
+    Close,
+}
+
+enum Part {
+    Headers { block: Vec<u8>, end_stream: bool },
+    Data(Vec<u8>),
+}
+
+/// Sends the response to one request, in order: headers with `:status`,
+/// data, and trailers or, for a response without a body, the headers that
+/// end it. Sending fails once the client resets the stream or goes away.
+pub struct Responder {
+    stream: u32,
+    commands: mpsc::UnboundedSender<Command>,
+    active: Arc<AtomicUsize>,
+}
+
+impl Responder {
+    pub async fn headers(&mut self, fields: &[(&str, &str)]) -> io::Result<()> {
+        let block = encode_headers(fields);
+        self.send(Part::Headers {
+            block,
+            end_stream: false,
+        })
+        .await
+    }
+
+    /// Sends `data`, waiting while the client's flow control windows are
+    /// full
+    pub async fn data(&mut self, data: Vec<u8>) -> io::Result<()> {
+        self.send(Part::Data(data)).await
+    }
+
+    /// Ends the response with `fields`
+    pub async fn finish(mut self, fields: &[(&str, &str)]) -> io::Result<()> {
+        let block = encode_headers(fields);
+        self.send(Part::Headers {
+            block,
+            end_stream: true,
+        })
+        .await
+    }
+
+    async fn send(&mut self, part: Part) -> io::Result<()> {
+        let gone = || io::Error::new(io::ErrorKind::BrokenPipe, "The client reset the stream or went away");
+        let (done, sent) = oneshot::channel();
+        self.commands
+            .send(Command::Send {
+                stream: self.stream,
+                part,
+                done,
+            })
+            .map_err(|_| gone())?;
+        sent.await.map_err(|_| gone())
+    }
+}
+
+impl Drop for Responder {
+    fn drop(&mut self) {
+        self.active.fetch_sub(1, Ordering::SeqCst);
+        let _ = self.commands.send(Command::Done(self.stream));
+    }
+}
+
+/// The reading side of a connection
+struct Connection {
+    commands: mpsc::UnboundedSender<Command>,
+    decoder: Decoder,
+    /// Requests whose headers have been read, waiting for the rest of their
+    /// bodies
+    incoming: HashMap<u32, HttpRequest>,
+    /// Highest stream the client has opened
+    last_stream: u32,
+    /// Requests whose handlers are running
+    active: Arc<AtomicUsize>,
+}
+
+impl Connection {
+    async fn read<F, Fut>(&mut self, socket: &mut OwnedReadHalf, handler: &F) -> Result<(), Failure>
+    where
+        F: Fn(HttpRequest, Responder) -> Fut,
+        Fut: Future<Output = ()> + Send + 'static,
+    {
+        let mut first = true;
+        while let Some((kind, flags, stream, payload)) = read_frame(socket).await? {
+            if first && kind != SETTINGS {
+                return Err(protocol(PROTOCOL_ERROR, "The preface must be followed by SETTINGS"));
+            }
+            first = false;
+            match kind {
+                DATA => self.data(flags, stream, &payload, handler)?,
+                HEADERS => {
+                    let mut block = header_block(flags, stream, &payload)?.to_vec();
+                    let mut end_headers = flags & END_HEADERS != 0;
+                    while !end_headers {
+                        let Some((kind, flags, next, payload)) = read_frame(socket).await? else {
+                            return Err(protocol(PROTOCOL_ERROR, "The connection closed within a header block"));
+                        };
+                        if kind != CONTINUATION || next != stream {
+                            return Err(protocol(PROTOCOL_ERROR, "A header block was interrupted"));
+                        }
+                        if block.len() + payload.len() > MAX_HEADER_BYTES {
+                            return Err(protocol(PROTOCOL_ERROR, "Header block too large"));
+                        }
+                        block.extend_from_slice(&payload);
+                        end_headers = flags & END_HEADERS != 0;
+                    }
+                    self.headers(flags & END_STREAM != 0, stream, &block, handler)?;
+                }
+                PRIORITY => {}
+                RST_STREAM => {
+                    if payload.len() != 4 {
+                        return Err(protocol(FRAME_SIZE_ERROR, "RST_STREAM must be 4 bytes"));
+                    }
+                    if stream == 0 {
+                        return Err(protocol(PROTOCOL_ERROR, "RST_STREAM on stream 0"));
+                    }
+                    self.incoming.remove(&stream);
+                    self.send(Command::Reset(stream));
+                }
+                SETTINGS => self.settings(flags, stream, &payload)?,
+                PING => {
+                    if payload.len() != 8 {
+                        return Err(protocol(FRAME_SIZE_ERROR, "PING must be 8 bytes"));
+                    }
+                    if stream != 0 {
+                        return Err(protocol(PROTOCOL_ERROR, "PING on a stream"));
+                    }
+                    if flags & ACK == 0 {
+                        self.send(Command::Control(frame(PING, ACK, 0, &payload)));
+                    }
+                }
+                WINDOW_UPDATE => {
+                    if payload.len() != 4 {
+                        return Err(protocol(FRAME_SIZE_ERROR, "WINDOW_UPDATE must be 4 bytes"));
+                    }
+                    let increment = u32::from_be_bytes([payload[0], payload[1], payload[2], payload[3]]) & 0x7fff_ffff;
+                    match (increment, stream) {
+                        (0, 0) => return Err(protocol(PROTOCOL_ERROR, "WINDOW_UPDATE of 0")),
+                        (0, stream) => self.send(reset(stream, PROTOCOL_ERROR)),
+                        (increment, stream) => self.send(Command::WindowUpdate { stream, increment }),
+                    }
+                }
+                // Clients that go away close the connection once their
+                // calls are answered
+                GOAWAY => {}
+                PUSH_PROMISE | CONTINUATION => {
+                    return Err(protocol(PROTOCOL_ERROR, "Unexpected PUSH_PROMISE or CONTINUATION"));
+                }
+                _ => {}
+            }
+        }
+        Ok(())
+    }
+
+    fn send(&self, command: Command) {
+        let _ = self.commands.send(command);
+    }
+
+    fn headers<F, Fut>(&mut self, end_stream: bool, stream: u32, block: &[u8], handler: &F) -> Result<(), Failure>
+    where
+        F: Fn(HttpRequest, Responder) -> Fut,
+        Fut: Future<Output = ()> + Send + 'static,
+    {
+        // Decoded even for refused streams, which change the table too
+        let fields = self
+            .decoder
+            .decode(block)
+            .map_err(|e| Failure::Protocol(COMPRESSION_ERROR, e.to_string()))?;
+        if self.incoming.contains_key(&stream) {
+            // Trailers, which requests do not need
+            if !end_stream {
+                return Err(protocol(PROTOCOL_ERROR, "Trailers must end the stream"));
+            }
+            self.dispatch(stream, handler);
+            return Ok(());
+        }
+        if stream.is_multiple_of(2) || stream <= self.last_stream {
+            return Err(protocol(PROTOCOL_ERROR, "Clients open odd, increasing streams"));
+        }
+        self.last_stream = stream;
+        if self.active.load(Ordering::SeqCst) + self.incoming.len() >= MAX_STREAMS {
+            self.send(reset(stream, REFUSED_STREAM));
+            return Ok(());
+        }
+
+        let mut request = HttpRequest::default();
+        for (name, value) in fields {
+            match name.as_str() {
+                ":method" => request.method = value,
+                ":path" => request.path = value.split('?').next().unwrap_or_default().to_string(),
+                _ if name.starts_with(':') => {}
+                _ => request.headers.push((name, value)),
+            }
+        }
+        if request.method.is_empty() || request.path.is_empty() {
+            self.send(reset(stream, PROTOCOL_ERROR));
+            return Ok(());
+        }
+        self.incoming.insert(stream, request);
+        if end_stream {
+            self.dispatch(stream, handler);
+        }
+        Ok(())
+    }
+
+    fn data<F, Fut>(&mut self, flags: u8, stream: u32, payload: &[u8], handler: &F) -> Result<(), Failure>
+    where
+        F: Fn(HttpRequest, Responder) -> Fut,
+        Fut: Future<Output = ()> + Send + 'static,
+    {
+        if stream == 0 {
+            return Err(protocol(PROTOCOL_ERROR, "DATA on stream 0"));
+        }
+        let data = unpad(flags, payload)?;
+        // Padding counts against the windows too
+        if !payload.is_empty() {
+            self.send(window_update(0, payload.len()));
+        }
+        let Some(request) = self.incoming.get_mut(&stream) else {
+            if stream > self.last_stream {
+                return Err(protocol(PROTOCOL_ERROR, "DATA on a stream that was never opened"));
+            }
+            // A stream that was reset or answered already
+            return Ok(());
+        };
+        request.body.extend_from_slice(data);
+        if request.body.len() > MAX_BODY_BYTES {
+            self.incoming.remove(&stream);
+            let status = encode_headers(&[(":status", "413")]);
+            self.send(Command::Control(frame(
+                HEADERS,
+                END_HEADERS | END_STREAM,
+                stream,
+                &status,
+            )));
+            self.send(reset(stream, NO_ERROR));
+        } else if flags & END_STREAM != 0 {
+            self.dispatch(stream, handler);
+        } else if !payload.is_empty() {
+            self.send(window_update(stream, payload.len()));
+        }
+        Ok(())
+    }
+
+    fn settings(&mut self, flags: u8, stream: u32, payload: &[u8]) -> Result<(), Failure> {
+        if stream != 0 {
+            return Err(protocol(PROTOCOL_ERROR, "SETTINGS on a stream"));
+        }
+        if flags & ACK != 0 {
+            return match payload.is_empty() {
+                true => Ok(()),
+                false => Err(protocol(FRAME_SIZE_ERROR, "SETTINGS acknowledgement with a payload")),
+            };
+        }
+        if !payload.len().is_multiple_of(6) {
+            return Err(protocol(FRAME_SIZE_ERROR, "SETTINGS must be a multiple of 6 bytes"));
+        }
+        for setting in payload.chunks(6) {
+            let id = u16::from_be_bytes([setting[0], setting[1]]);
+            let value = u32::from_be_bytes([setting[2], setting[3], setting[4], setting[5]]);
+            if id == SETTINGS_INITIAL_WINDOW_SIZE {
+                if value > 0x7fff_ffff {
+                    return Err(protocol(FLOW_CONTROL_ERROR, "Initial window too large"));
+                }
+                self.send(Command::InitialWindow(value));
+            }
+        }
+        self.send(Command::Control(frame(SETTINGS, ACK, 0, &[])));
+        Ok(())
+    }
+
+    /// Hands a request that has been read whole to `handler`
+    fn dispatch<F, Fut>(&mut self, stream: u32, handler: &F)
+    where
+        F: Fn(HttpRequest, Responder) -> Fut,
+        Fut: Future<Output = ()> + Send + 'static,
+    {
+        let Some(request) = self.incoming.remove(&stream) else {
+            return;
+        };
+        self.send(Command::Open(stream));
+        self.active.fetch_add(1, Ordering::SeqCst);
+        let responder = Responder {
+            stream,
+            commands: self.commands.clone(),
+            active: self.active.clone(),
+        };
+        tokio::spawn(handler(request, responder));
+    }
+}
+
+/// Reads the next frame: its type, flags, stream and payload. `None` when
+/// the client closed the connection between frames.
+async fn read_frame(socket: &mut OwnedReadHalf) -> Result<Option<(u8, u8, u32, Vec<u8>)>, Failure> {
+    let mut head = [0u8; 9];
+    match socket.read_exact(&mut head).await {
+        Ok(_) => {}
+        Err(e) if e.kind() == io::ErrorKind::UnexpectedEof => return Ok(None),
+        Err(e) => return Err(e.into()),
+    }
+    let len = u32::from_be_bytes([0, head[0], head[1], head[2]]) as usize;
+    if len > MAX_FRAME_SIZE {
+        return Err(protocol(FRAME_SIZE_ERROR, "Frame larger than SETTINGS_MAX_FRAME_SIZE"));
+    }
+    let stream = u32::from_be_bytes([head[5], head[6], head[7], head[8]]) & 0x7fff_ffff;
+    let mut payload = vec![0u8; len];
+    socket.read_exact(&mut payload).await?;
+    Ok(Some((head[3], head[4], stream, payload)))
+}
+
+/// The payload without its padding
+fn unpad(flags: u8, payload: &[u8]) -> Result<&[u8], Failure> {
+    if flags & PADDED == 0 {
+        return Ok(payload);
+    }
+    match payload.first() {
+        Some(&pad) if (pad as usize) < payload.len() => Ok(&payload[1..payload.len() - pad as usize]),
+        _ => Err(protocol(PROTOCOL_ERROR, "Padding longer than the frame")),
+    }
+}
+
+/// The start of the header block in a HEADERS frame, after its padding and
+/// priority
+fn header_block(flags: u8, stream: u32, payload: &[u8]) -> Result<&[u8], Failure> {
+    if stream == 0 {
+        return Err(protocol(PROTOCOL_ERROR, "HEADERS on stream 0"));
+    }
+    let block = unpad(flags, payload)?;
+    match flags & PRIORITY_FLAG {
+        0 => Ok(block),
+        _ => block
+            .get(5..)
+            .ok_or_else(|| protocol(FRAME_SIZE_ERROR, "HEADERS too short for its priority")),
+    }
+}
+
+/// A stream's response as far as it is not written yet
+struct Outbound {
+    window: i64,
+    queue: VecDeque<(Part, oneshot::Sender<()>)>,
+    ended: bool,
+    reset: bool,
+}
+
+/// Writes the connection's frames, holding back DATA that the client's
+/// flow control windows have no room for
+struct Writer {
+    socket: OwnedWriteHalf,
+    window: i64,
+    initial_window: i64,
+    streams: HashMap<u32, Outbound>,
+    closing: bool,
+}
+
+impl Writer {
+    fn new(socket: OwnedWriteHalf) -> Self {
+        Self {
+            socket,
+            window: INITIAL_WINDOW,
+            initial_window: INITIAL_WINDOW,
+            streams: HashMap::new(),
+            closing: false,
+        }
+    }
+
+    async fn run(mut self, mut commands: mpsc::UnboundedReceiver<Command>) {
+        while let Some(command) = commands.recv().await {
+            let mut out = Vec::new();
+            self.apply(command, &mut out);
+            while let Ok(command) = commands.try_recv() {
+                self.apply(command, &mut out);
+            }
+            self.flush(&mut out);
+            if !out.is_empty() && self.socket.write_all(&out).await.is_err() {
+                break;
+            }
+            if self.closing {
+                break;
+            }
+        }
+        let _ = self.socket.shutdown().await;
+    }
+
+    fn apply(&mut self, command: Command, out: &mut Vec<u8>) {
+        match command {
+            Command::Control(frame) => out.extend_from_slice(&frame),
+            Command::InitialWindow(size) => {
+                let delta = size as i64 - self.initial_window;
+                self.initial_window = size as i64;
+                for stream in self.streams.values_mut() {
+                    stream.window += delta;
+                }
+            }
+            Command::WindowUpdate { stream: 0, increment } => {
+                self.window += increment as i64;
+                if self.window > 0x7fff_ffff {
+                    let mut payload = vec![0u8; 4];
+                    payload.extend_from_slice(&FLOW_CONTROL_ERROR.to_be_bytes());
+                    put_frame(out, GOAWAY, 0, 0, &payload);
+                    self.closing = true;
+                }
+            }
+            Command::WindowUpdate { stream, increment } => {
+                if let Some(outbound) = self.streams.get_mut(&stream) {
+                    outbound.window += increment as i64;
+                    if outbound.window > 0x7fff_ffff {
+                        outbound.reset = true;
+                        outbound.queue.clear();
+                        put_frame(out, RST_STREAM, 0, stream, &FLOW_CONTROL_ERROR.to_be_bytes());
+                    }
+                }
+            }
+            Command::Open(stream) => {
+                let outbound = Outbound {
+                    window: self.initial_window,
+                    queue: VecDeque::new(),
+                    ended: false,
+                    reset: false,
+                };
+                self.streams.insert(stream, outbound);
+            }
+            Command::Reset(stream) => {
+                if let Some(outbound) = self.streams.get_mut(&stream) {
+                    outbound.reset = true;
+                    outbound.queue.clear();
+                }
+            }
+            Command::Send { stream, part, done } => {
+                if let Some(outbound) = self.streams.get_mut(&stream).filter(|outbound| !outbound.reset) {
+                    outbound.queue.push_back((part, done));
+                }
+            }
+            Command::Done(stream) => {
+                if let Some(outbound) = self.streams.remove(&stream) {
+                    if !outbound.ended && !outbound.reset {
+                        put_frame(out, RST_STREAM, 0, stream, &INTERNAL_ERROR.to_be_bytes());
+                    }
+                }
+            }
+            Command::Close => self.closing = true,
+        }
+    }
+
+    /// Moves what the windows allow from the streams' queues to `out`
+    fn flush(&mut self, out: &mut Vec<u8>) {
+        for (&stream, outbound) in self.streams.iter_mut() {
+            while let Some((part, _)) = outbound.queue.front_mut() {
+                match part {
+                    Part::Headers { block, end_stream } => {
+                        put_headers(out, stream, block, *end_stream);
+                        outbound.ended |= *end_stream;
+                    }
+                    Part::Data(data) => {
+                        let room = self.window.min(outbound.window).min(MAX_FRAME_SIZE as i64);
+                        if room <= 0 && !data.is_empty() {
+                            break;
+                        }
+                        let n = data.len().min(room.max(0) as usize);
+                        if n > 0 {
+                            put_frame(out, DATA, 0, stream, &data[..n]);
+                            data.drain(..n);
+                            self.window -= n as i64;
+                            outbound.window -= n as i64;
+                        }
+                        if !data.is_empty() {
+                            continue;
+                        }
+                    }
+                }
+                if let Some((_, done)) = outbound.queue.pop_front() {
+                    let _ = done.send(());
+                }
+            }
+        }
+    }
+}
+
+/// Writes a header block as a HEADERS frame and as many CONTINUATION frames
+/// as it takes
+fn put_headers(out: &mut Vec<u8>, stream: u32, block: &[u8], end_stream: bool) {
+    let mut kind = HEADERS;
+    let mut flags = match end_stream {
+        true => END_STREAM,
+        false => 0,
+    };
+    let mut rest = block;
+    loop {
+        let n = rest.len().min(MAX_FRAME_SIZE);
+        if n == rest.len() {
+            flags |= END_HEADERS;
+        }
+        put_frame(out, kind, flags, stream, &rest[..n]);
+        rest = &rest[n..];
+        if rest.is_empty() {
+            break;
+        }
+        kind = CONTINUATION;
+        flags = 0;
+    }
+}
+
+/// Encodes header fields with HPACK, as literals that are not indexed, so
+/// the client's table is left alone
+pub fn encode_headers(fields: &[(&str, &str)]) -> Vec<u8> {
+    let mut block = Vec::new();
+    for &(name, value) in fields {
+        match STATIC_TABLE.iter().position(|&entry| entry == (name, value)) {
+            Some(index) => put_int(&mut block, 0x80, 7, index + 1),
+            None => {
+                block.push(0);
+                put_string(&mut block, name);
+                put_string(&mut block, value);
+            }
+        }
+    }
+    block
+}
+
+fn put_int(out: &mut Vec<u8>, bits: u8, prefix: u32, mut value: usize) {
+    let max = (1usize << prefix) - 1;
+    if value < max {
+        out.push(bits | value as u8);
+        return;
+    }
+    out.push(bits | max as u8);
+    value -= max;
+    while value >= 0x80 {
+        out.push((value & 0x7f) as u8 | 0x80);
+        value >>= 7;
+    }
+    out.push(value as u8);
+}
+
+fn put_string(out: &mut Vec<u8>, value: &str) {
+    put_int(out, 0, 7, value.len());
+    out.extend_from_slice(value.as_bytes());
+}
+
+/// Decodes HPACK header blocks (RFC 7541), keeping the dynamic table that
+/// the client's blocks add to
+pub struct Decoder {
+    /// Newest entry first
+    table: VecDeque<(String, String)>,
+    size: usize,
+    max_size: usize,
+}
+
+impl Default for Decoder {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl Decoder {
+    pub fn new() -> Self {
+        Self {
+            table: VecDeque::new(),
+            size: 0,
+            max_size: TABLE_SIZE,
+        }
+    }
+
+    /// The header fields in `block`, in order, with their names as sent
+    pub fn decode(&mut self, mut block: &[u8]) -> Result<Vec<(String, String)>, SingleloadError> {
+        let mut fields = Vec::new();
+        let mut size = 0;
+        while let Some(&first) = block.first() {
+            let field = if first & 0x80 != 0 {
+                let index = take_int(&mut block, 7)?;
+                self.entry(index)?
+            } else if first & 0x40 != 0 {
+                let field = self.literal(&mut block, 6)?;
+                self.insert(field.clone());
+                field
+            } else if first & 0x20 != 0 {
+                let max_size = take_int(&mut block, 5)?;
+                if max_size > TABLE_SIZE {
+                    return Err(invalid("table size above SETTINGS_HEADER_TABLE_SIZE"));
+                }
+                self.max_size = max_size;
+                self.evict();
+                continue;
+            } else {
+                // Literals without indexing, which may never be indexed
+                self.literal(&mut block, 4)?
+            };
+            size += field.0.len() + field.1.len() + 32;
+            if size > MAX_HEADER_BYTES {
+                return Err(invalid("header list too large"));
+            }
+            fields.push(field);
+        }
+        Ok(fields)
+    }
+
+    fn entry(&self, index: usize) -> Result<(String, String), SingleloadError> {
+        let entry = match index {
+            0 => None,
+            1..=61 => STATIC_TABLE
+                .get(index - 1)
+                .map(|&(name, value)| (name.to_string(), value.to_string())),
+            _ => self.table.get(index - 62).cloned(),
+        };
+        entry.ok_or_else(|| invalid("header index out of range"))
+    }
+
+    fn literal(&self, block: &mut &[u8], prefix: u32) -> Result<(String, String), SingleloadError> {
+        let name = match take_int(block, prefix)? {
+            0 => take_string(block)?,
+            index => self.entry(index)?.0,
+        };
+        Ok((name, take_string(block)?))
+    }
+
+    fn insert(&mut self, field: (String, String)) {
+        self.size += field.0.len() + field.1.len() + 32;
+        self.table.push_front(field);
+        self.evict();
+    }
+
+    fn evict(&mut self) {
+        while self.size > self.max_size {
+            let Some((name, value)) = self.table.pop_back() else {
+                break;
+            };
+            self.size -= name.len() + value.len() + 32;
+        }
+    }
+}
+
+fn take_int(block: &mut &[u8], prefix: u32) -> Result<usize, SingleloadError> {
+    let truncated = || invalid("truncated header block");
+    let max = (1usize << prefix) - 1;
+    let (&first, rest) = block.split_first().ok_or_else(truncated)?;
+    *block = rest;
+    let mut value = first as usize & max;
+    if value < max {
+        return Ok(value);
+    }
+    let mut shift = 0;
+    loop {
+        let (&byte, rest) = block.split_first().ok_or_else(truncated)?;
+        *block = rest;
+        if shift > 28 {
+            return Err(invalid("header integer too large"));
+        }
+        value += ((byte & 0x7f) as usize) << shift;
+        if byte & 0x80 == 0 {
+            return Ok(value);
+        }
+        shift += 7;
+    }
+}
+
+fn take_string(block: &mut &[u8]) -> Result<String, SingleloadError> {
+    let huffman = block.first().is_some_and(|&first| first & 0x80 != 0);
+    let len = take_int(block, 7)?;
+    if len > block.len() {
+        return Err(invalid("truncated header string"));
+    }
+    let (data, rest) = block.split_at(len);
+    *block = rest;
+    let data = match huffman {
+        true => decode_huffman(data).ok_or_else(|| invalid("bad Huffman code"))?,
+        false => data.to_vec(),
+    };
+    Ok(String::from_utf8_lossy(&data).into_owned())
+}
+
+fn invalid(reason: &str) -> SingleloadError {
+    SingleloadError::InvalidInput(format!("Bad HPACK header block: {}", reason))
+}
+
+/// Decodes a Huffman-coded string; `None` if it is not one. The end is
+/// padded with at most 7 one bits, the start of the code for EOS.
+fn decode_huffman(data: &[u8]) -> Option<Vec<u8>> {
+    static CODES: OnceLock<HashMap<(u32, u8), u8>> = OnceLock::new();
+    let codes = CODES.get_or_init(|| {
+        HUFFMAN
+            .iter()
+            .enumerate()
+            .map(|(octet, &(code, len))| ((code, len), octet as u8))
+            .collect()
+    });
+    let mut decoded = Vec::with_capacity(data.len() * 8 / 5);
+    let (mut code, mut len) = (0u32, 0u8);
+    for byte in data {
+        for bit in (0..8).rev() {
+            code = (code << 1) | ((byte >> bit) & 1) as u32;
+            len += 1;
+            if let Some(&octet) = codes.get(&(code, len)) {
+                decoded.push(octet);
+                (code, len) = (0, 0);
+            } else if len >= 30 {
+                // EOS, or no code at all
+                return None;
+            }
+        }
+    }
+    match len <= 7 && code == (1 << len) - 1 {
+        true => Some(decoded),
+        false => None,
+    }
+}
+
+/// The entries every HPACK decoder starts with (RFC 7541, appendix A);
+/// index 1 is the first
+const STATIC_TABLE: [(&str, &str); 61] = [
+    (":authority", ""),
+    (":method", "GET"),
+    (":method", "POST"),
+    (":path", "/"),
+    (":path", "/index.html"),
+    (":scheme", "http"),
+    (":scheme", "https"),
+    (":status", "200"),
+    (":status", "204"),
+    (":status", "206"),
+    (":status", "304"),
+    (":status", "400"),
+    (":status", "404"),
+    (":status", "500"),
+    ("accept-charset", ""),
+    ("accept-encoding", "gzip, deflate"),
+    ("accept-language", ""),
+    ("accept-ranges", ""),
+    ("accept", ""),
+    ("access-control-allow-origin", ""),
+    ("age", ""),
+    ("allow", ""),
+    ("authorization", ""),
+    ("cache-control", ""),
+    ("content-disposition", ""),
+    ("content-encoding", ""),
+    ("content-language", ""),
+    ("content-length", ""),
+    ("content-location", ""),
+    ("content-range", ""),
+    ("content-type", ""),
+    ("cookie", ""),
+    ("date", ""),
+    ("etag", ""),
+    ("expect", ""),
+    ("expires", ""),
+    ("from", ""),
+    ("host", ""),
+    ("if-match", ""),
+    ("if-modified-since", ""),
+    ("if-none-match", ""),
+    ("if-range", ""),
+    ("if-unmodified-since", ""),
+    ("last-modified", ""),
+    ("link", ""),
+    ("location", ""),
+    ("max-forwards", ""),
+    ("proxy-authenticate", ""),
+    ("proxy-authorization", ""),
+    ("range", ""),
+    ("referer", ""),
+    ("refresh", ""),
+    ("retry-after", ""),
+    ("server", ""),
+    ("set-cookie", ""),
+    ("strict-transport-security", ""),
+    ("transfer-encoding", ""),
+    ("user-agent", ""),
+    ("vary", ""),
+    ("via", ""),
+    ("www-authenticate", ""),
+];
+
+/// The Huffman code of every octet, with its length in bits (RFC 7541,
+/// appendix B)
+#[rustfmt::skip]
+const HUFFMAN: [(u32, u8); 256] = [
+    (0x1ff8, 13), (0x7fffd8, 23), (0xfffffe2, 28), (0xfffffe3, 28),
+    (0xfffffe4, 28), (0xfffffe5, 28), (0xfffffe6, 28), (0xfffffe7, 28),
+    (0xfffffe8, 28), (0xffffea, 24), (0x3ffffffc, 30), (0xfffffe9, 28),
+    (0xfffffea, 28), (0x3ffffffd, 30), (0xfffffeb, 28), (0xfffffec, 28),
+    (0xfffffed, 28), (0xfffffee, 28), (0xfffffef, 28), (0xffffff0, 28),
+    (0xffffff1, 28), (0xffffff2, 28), (0x3ffffffe, 30), (0xffffff3, 28),
+    (0xffffff4, 28), (0xffffff5, 28), (0xffffff6, 28), (0xffffff7, 28),
+    (0xffffff8, 28), (0xffffff9, 28), (0xffffffa, 28), (0xffffffb, 28),
+    (0x14, 6), (0x3f8, 10), (0x3f9, 10), (0xffa, 12),
+    (0x1ff9, 13), (0x15, 6), (0xf8, 8), (0x7fa, 11),
+    (0x3fa, 10), (0x3fb, 10), (0xf9, 8), (0x7fb, 11),
+    (0xfa, 8), (0x16, 6), (0x17, 6), (0x18, 6),
+    (0x0, 5), (0x1, 5), (0x2, 5), (0x19, 6),
+    (0x1a, 6), (0x1b, 6), (0x1c, 6), (0x1d, 6),
+    (0x1e, 6), (0x1f, 6), (0x5c, 7), (0xfb, 8),
+    (0x7ffc, 15), (0x20, 6), (0xffb, 12), (0x3fc, 10),
+    (0x1ffa, 13), (0x21, 6), (0x5d, 7), (0x5e, 7),
+    (0x5f, 7), (0x60, 7), (0x61, 7), (0x62, 7),
+    (0x63, 7), (0x64, 7), (0x65, 7), (0x66, 7),
+    (0x67, 7), (0x68, 7), (0x69, 7), (0x6a, 7),
+    (0x6b, 7), (0x6c, 7), (0x6d, 7), (0x6e, 7),
+    (0x6f, 7), (0x70, 7), (0x71, 7), (0x72, 7),
+    (0xfc, 8), (0x73, 7), (0xfd, 8), (0x1ffb, 13),
+    (0x7fff0, 19), (0x1ffc, 13), (0x3ffc, 14), (0x22, 6),
+    (0x7ffd, 15), (0x3, 5), (0x23, 6), (0x4, 5),
+    (0x24, 6), (0x5, 5), (0x25, 6), (0x26, 6),
+    (0x27, 6), (0x6, 5), (0x74, 7), (0x75, 7),
+    (0x28, 6), (0x29, 6), (0x2a, 6), (0x7, 5),
+    (0x2b, 6), (0x76, 7), (0x2c, 6), (0x8, 5),
+    (0x9, 5), (0x2d, 6), (0x77, 7), (0x78, 7),
+    (0x79, 7), (0x7a, 7), (0x7b, 7), (0x7ffe, 15),
+    (0x7fc, 11), (0x3ffd, 14), (0x1ffd, 13), (0xffffffc, 28),
+    (0xfffe6, 20), (0x3fffd2, 22), (0xfffe7, 20), (0xfffe8, 20),
+    (0x3fffd3, 22), (0x3fffd4, 22), (0x3fffd5, 22), (0x7fffd9, 23),
+    (0x3fffd6, 22), (0x7fffda, 23), (0x7fffdb, 23), (0x7fffdc, 23),
+    (0x7fffdd, 23), (0x7fffde, 23), (0xffffeb, 24), (0x7fffdf, 23),
+    (0xffffec, 24), (0xffffed, 24), (0x3fffd7, 22), (0x7fffe0, 23),
+    (0xffffee, 24), (0x7fffe1, 23), (0x7fffe2, 23), (0x7fffe3, 23),
+    (0x7fffe4, 23), (0x1fffdc, 21), (0x3fffd8, 22), (0x7fffe5, 23),
+    (0x3fffd9, 22), (0x7fffe6, 23), (0x7fffe7, 23), (0xffffef, 24),
+    (0x3fffda, 22), (0x1fffdd, 21), (0xfffe9, 20), (0x3fffdb, 22),
+    (0x3fffdc, 22), (0x7fffe8, 23), (0x7fffe9, 23), (0x1fffde, 21),
+    (0x7fffea, 23), (0x3fffdd, 22), (0x3fffde, 22), (0xfffff0, 24),
+    (0x1fffdf, 21), (0x3fffdf, 22), (0x7fffeb, 23), (0x7fffec, 23),
+    (0x1fffe0, 21), (0x1fffe1, 21), (0x3fffe0, 22), (0x1fffe2, 21),
+    (0x7fffed, 23), (0x3fffe1, 22), (0x7fffee, 23), (0x7fffef, 23),
+    (0xfffea, 20), (0x3fffe2, 22), (0x3fffe3, 22), (0x3fffe4, 22),
+    (0x7ffff0, 23), (0x3fffe5, 22), (0x3fffe6, 22), (0x7ffff1, 23),
+    (0x3ffffe0, 26), (0x3ffffe1, 26), (0xfffeb, 20), (0x7fff1, 19),
+    (0x3fffe7, 22), (0x7ffff2, 23), (0x3fffe8, 22), (0x1ffffec, 25),
+    (0x3ffffe2, 26), (0x3ffffe3, 26), (0x3ffffe4, 26), (0x7ffffde, 27),
+    (0x7ffffdf, 27), (0x3ffffe5, 26), (0xfffff1, 24), (0x1ffffed, 25),
+    (0x7fff2, 19), (0x1fffe3, 21), (0x3ffffe6, 26), (0x7ffffe0, 27),
+    (0x7ffffe1, 27), (0x3ffffe7, 26), (0x7ffffe2, 27), (0xfffff2, 24),
+    (0x1fffe4, 21), (0x1fffe5, 21), (0x3ffffe8, 26), (0x3ffffe9, 26),
+    (0xffffffd, 28), (0x7ffffe3, 27), (0x7ffffe4, 27), (0x7ffffe5, 27),
+    (0xfffec, 20), (0xfffff3, 24), (0xfffed, 20), (0x1fffe6, 21),
+    (0x3fffe9, 22), (0x1fffe7, 21), (0x1fffe8, 21), (0x7ffff3, 23),
+    (0x3fffea, 22), (0x3fffeb, 22), (0x1ffffee, 25), (0x1ffffef, 25),
+    (0xfffff4, 24), (0xfffff5, 24), (0x3ffffea, 26), (0x7ffff4, 23),
+    (0x3ffffeb, 26), (0x7ffffe6, 27), (0x3ffffec, 26), (0x3ffffed, 26),
+    (0x7ffffe7, 27), (0x7ffffe8, 27), (0x7ffffe9, 27), (0x7ffffea, 27),
+    (0x7ffffeb, 27), (0xffffffe, 28), (0x7ffffec, 27), (0x7ffffed, 27),
+    (0x7ffffee, 27), (0x7ffffef, 27), (0x7fffff0, 27), (0x3ffffee, 26),
+];
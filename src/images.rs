@@ -0,0 +1,139 @@
+use crate::errors::SingleloadError;
+use crate::platform;
+use std::collections::{BTreeMap, HashMap};
+use std::fs::OpenOptions;
+use std::io::{Read, Seek, Write};
+use std::path::{Path, PathBuf};
+
+/// Images `--containerized` runs interpreted scripts in instead of the base
+/// image: the language, the image with `{version}` standing for the
+/// interpreter version, and the version used when the script pins none.
+/// Tags name exact releases, but upstream pushes them again for updates of
+/// the distribution underneath; [`DigestPins`] keeps runs on the build a
+/// tag was first pulled at.
+const INTERPRETER_IMAGES: &[(&str, &str, &str)] = &[
+    ("bash", "docker.io/library/bash:{version}", "5.2.37"),
+    ("javascript", "docker.io/library/node:{version}-bookworm-slim", "22.11.0"),
+    ("php", "docker.io/library/php:{version}-cli-bookworm", "8.3.13"),
+    ("python", "docker.io/library/python:{version}-slim-bookworm", "3.12.7"),
+];
+
+/// Languages that can run with `--containerized`
+pub fn languages() -> Vec<&'static str> {
+    INTERPRETER_IMAGES.iter().map(|(language, _, _)| *language).collect()
+}
+
+/// The image `language` runs in with `--containerized`, at the version the
+/// script pins or the default one. `overrides` are the configured
+/// `interpreter_images`, which replace the built-in images and may use
+/// `{version}` too. None for languages that are not interpreted.
+pub fn interpreter_image(
+    language: &str,
+    version: Option<&str>,
+    overrides: &HashMap<String, String>,
+) -> Option<String> {
+    let (_, image, default_version) = INTERPRETER_IMAGES.iter().find(|(name, _, _)| *name == language)?;
+    let image = overrides.get(language).map_or(*image, String::as_str);
+    Some(image.replace("{version}", version.unwrap_or(default_version)))
+}
+
+/// Checks that a version a script pins for an interpreter image names one
+/// release: `3.12` would be a tag that moves to every new patch release
+pub fn validate_version(language: &str, version: &str) -> Result<(), SingleloadError> {
+    if version.split('.').filter(|part| !part.is_empty()).count() < 3 {
+        return Err(SingleloadError::InvalidInput(format!(
+            "containerized runs need an exact {} release such as {}, not {}",
+            language,
+            INTERPRETER_IMAGES
+                .iter()
+                .find(|(name, _, _)| *name == language)
+                .map_or("1.2.3", |(_, _, default_version)| default_version),
+            version
+        )));
+    }
+    Ok(())
+}
+
+/// `image` at `digest`, e.g. `docker.io/library/bash:5.2.37@sha256:...`
+pub fn pinned(image: &str, digest: &str) -> String {
+    format!("{}@{}", image, digest)
+}
+
+/// Digests interpreter images were first pulled at, by image reference, in
+/// `~/.singleload/image_digests.json`. Runs use the recorded digest from
+/// then on, so a tag pushed again does not change what scripts run in until
+/// its entry is removed. Every access locks the file.
+#[derive(Debug, Clone)]
+pub struct DigestPins {
+    path: PathBuf,
+}
+
+impl DigestPins {
+    pub fn new(path: PathBuf) -> Self {
+        Self { path }
+    }
+
+    /// Default location, next to the known scripts in [`platform::data_dir`]
+    pub fn default_path() -> PathBuf {
+        platform::data_dir().join("image_digests.json")
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// The digest recorded for `image`, None if it was never pulled
+    pub fn get(&self, image: &str) -> Result<Option<String>, SingleloadError> {
+        match std::fs::File::open(&self.path) {
+            Ok(mut file) => {
+                file.lock_shared()?;
+                Ok(read_pins(&mut file, &self.path)?.remove(image))
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(None),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    /// Records `digest` as the build runs of `image` use
+    pub fn record(&self, image: &str, digest: &str) -> Result<(), SingleloadError> {
+        if let Some(parent) = self.path.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        let mut file = OpenOptions::new().read(true).write(true).create(true).truncate(false).open(&self.path)?;
+        file.lock()?;
+        let mut pins = read_pins(&mut file, &self.path)?;
+        pins.insert(image.to_string(), digest.to_string());
+        let data = serde_json::to_vec_pretty(&pins)?;
+        file.set_len(0)?;
+        file.rewind()?;
+        file.write_all(&data)?;
+        Ok(())
+    }
+}
+
+fn read_pins(file: &mut std::fs::File, path: &Path) -> Result<BTreeMap<String, String>, SingleloadError> {
+    let mut data = String::new();
+    file.read_to_string(&mut data)?;
+    if data.trim().is_empty() {
+        return Ok(BTreeMap::new());
+    }
+    serde_json::from_str(&data)
+        .map_err(|e| SingleloadError::InvalidInput(format!("Invalid image digests file {}: {}", path.display(), e)))
+}
+
+/// Checks the configured `interpreter_images`
+pub fn validate_overrides(overrides: &HashMap<String, String>) -> Result<(), SingleloadError> {
+    for (language, image) in overrides {
+        if !languages().contains(&language.as_str()) {
+            return Err(SingleloadError::InvalidInput(format!(
+                "interpreter_images.{}: only {} scripts run in interpreter images",
+                language,
+                languages().join(", ")
+            )));
+        }
+        if image.trim().is_empty() {
+            return Err(SingleloadError::InvalidInput(format!("interpreter_images.{} is empty", language)));
+        }
+    }
+    Ok(())
+}
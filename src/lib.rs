@@ -1,12 +1,95 @@
+pub mod args;
+pub mod artifacts;
+pub mod assets;
+pub mod audit;
+pub mod batch;
+pub mod bench;
+pub mod bundle;
+pub mod cache;
+pub mod catalog;
+pub mod cells;
+pub mod chooser;
+pub mod completion;
 pub mod config;
 pub mod container;
+pub mod daemon;
+pub mod debugging;
+pub mod delta;
+pub mod directives;
+pub mod doctor;
+pub mod download;
+pub mod egress;
+pub mod entries;
+pub mod env;
 pub mod errors;
+pub mod events;
 pub mod executor;
+pub mod export;
+pub mod flake;
+pub mod gpu;
+pub mod grpc;
+pub mod history;
+pub mod hooks;
+pub mod http2;
+pub mod images;
+pub mod limits;
+pub mod lockfile;
+pub mod logs;
+pub mod lsp;
+pub mod matrix;
+pub mod metadata;
+pub mod metrics;
+pub mod multiplex;
+pub mod normalize;
+pub mod package;
+pub mod pins;
+pub mod pipeline;
+pub mod platform;
+pub mod plugins;
+pub mod policy;
+pub mod postmortem;
+pub mod preprocess;
+pub mod profile;
+pub mod profiling;
+pub mod progress;
+pub mod program;
+pub mod project;
+pub mod queue;
+pub mod remote;
+pub mod remote_cache;
+pub mod reproducible;
+pub mod retry;
+pub mod runner;
+pub mod sandbox;
+pub mod sbom;
+pub mod scaffold;
 pub mod security;
+pub mod server;
+pub mod service;
+pub mod signals;
+pub mod signing;
+pub mod snapshot;
+pub mod source;
+pub mod sourcemap;
+pub mod ssh;
+pub mod state;
+pub mod tofu;
+pub mod toolchain;
+pub mod tools;
+pub mod trace;
 pub mod types;
+pub mod update;
+pub mod uses;
+pub mod verify;
+pub mod vet;
+pub mod watch;
+pub mod workdir;
 
 pub use config::Config;
 pub use container::ContainerManager;
 pub use errors::SingleloadError;
 pub use executor::Executor;
+pub use program::{load, Program, RunOptions};
+pub use runner::{Registry, Runner};
+pub use sandbox::SandboxProfile;
 pub use types::{ExecutionResult, Language};
\ No newline at end of file
@@ -0,0 +1,93 @@
+/// Parses a timeout such as `30s`, `2m`, `1h30m` or a bare number of
+/// seconds into whole seconds
+pub fn parse_timeout(value: &str) -> Result<u64, String> {
+    let duration = parse_duration(value)?;
+    if duration.subsec_millis() != 0 {
+        return Err(format!("timeout '{}' must be a whole number of seconds", value.trim()));
+    }
+    Ok(duration.as_secs())
+}
+
+/// Parses a duration such as `500ms`, `2s`, `1m30s` or a bare number of
+/// seconds
+pub fn parse_duration(value: &str) -> Result<std::time::Duration, String> {
+    let value = value.trim();
+    if let Ok(secs) = value.parse::<u64>() {
+        return Ok(std::time::Duration::from_secs(secs));
+    }
+
+    let mut total_ms: u64 = 0;
+    let mut rest = value;
+    while !rest.is_empty() {
+        let digits = rest.find(|c: char| !c.is_ascii_digit()).unwrap_or(rest.len());
+        let unit_len = rest[digits..].find(|c: char| c.is_ascii_digit()).unwrap_or(rest.len() - digits);
+        let number: u64 = rest[..digits]
+            .parse()
+            .map_err(|_| format!("invalid duration '{}', expected e.g. 30s or 2m", value))?;
+        let unit_ms = match &rest[digits..digits + unit_len] {
+            "ms" => 1,
+            "s" => 1000,
+            "m" => 60_000,
+            "h" => 3_600_000,
+            other => return Err(format!("unknown duration unit '{}' in '{}' (use ms, s, m or h)", other, value)),
+        };
+        total_ms = number
+            .checked_mul(unit_ms)
+            .and_then(|ms| total_ms.checked_add(ms))
+            .ok_or_else(|| format!("duration '{}' is too long", value))?;
+        rest = &rest[digits + unit_len..];
+    }
+
+    Ok(std::time::Duration::from_millis(total_ms))
+}
+
+/// Parses a memory size such as `512M`, `1G`, `1.5GiB` or a bare number
+/// of megabytes into megabytes
+pub fn parse_memory(value: &str) -> Result<u64, String> {
+    let value = value.trim();
+    let split = value
+        .find(|c: char| !c.is_ascii_digit() && c != '.')
+        .unwrap_or(value.len());
+    let number: f64 = value[..split]
+        .parse()
+        .map_err(|_| format!("invalid size '{}', expected e.g. 512M or 1G", value))?;
+    let factor = match value[split..].trim().to_ascii_lowercase().as_str() {
+        "" | "m" | "mb" | "mi" | "mib" => 1.0,
+        "g" | "gb" | "gi" | "gib" => 1024.0,
+        "k" | "kb" | "ki" | "kib" => 1.0 / 1024.0,
+        other => return Err(format!("unknown size unit '{}' in '{}' (use K, M or G)", other, value)),
+    };
+    Ok((number * factor).round() as u64)
+}
+
+/// Parses an age such as `30d`, `2w`, `12h` or `1d12h` into seconds; a
+/// bare number is taken as days
+pub fn parse_age(value: &str) -> Result<u64, String> {
+    let value = value.trim();
+    if let Ok(days) = value.parse::<u64>() {
+        return days.checked_mul(86_400).ok_or_else(|| format!("age '{}' is too long", value));
+    }
+
+    let mut total: u64 = 0;
+    let mut rest = value;
+    while !rest.is_empty() {
+        let digits = rest.find(|c: char| !c.is_ascii_digit()).unwrap_or(rest.len());
+        let unit_len = rest[digits..].find(|c: char| c.is_ascii_digit()).unwrap_or(rest.len() - digits);
+        let number: u64 = rest[..digits]
+            .parse()
+            .map_err(|_| format!("invalid age '{}', expected e.g. 30d or 12h", value))?;
+        let unit_secs = match &rest[digits..digits + unit_len] {
+            "m" => 60,
+            "h" => 3_600,
+            "d" => 86_400,
+            "w" => 604_800,
+            other => return Err(format!("unknown age unit '{}' in '{}' (use m, h, d or w)", other, value)),
+        };
+        total = number
+            .checked_mul(unit_secs)
+            .and_then(|secs| total.checked_add(secs))
+            .ok_or_else(|| format!("age '{}' is too long", value))?;
+        rest = &rest[digits + unit_len..];
+    }
+    Ok(total)
+}
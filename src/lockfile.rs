@@ -0,0 +1,138 @@
+use crate::directives::{Dependency, PackageManager};
+use crate::errors::SingleloadError;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::path::{Path, PathBuf};
+
+const LOCKFILE_VERSION: u32 = 1;
+
+/// A dependency pinned to the exact version that was installed
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LockedPackage {
+    pub name: String,
+    pub version: String,
+    /// Checksum reported by the package manager (go.sum hash, npm integrity, ...)
+    pub hash: Option<String>,
+}
+
+/// Resolved dependencies of a script, stored next to it as `<script>.lock`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Lockfile {
+    pub version: u32,
+    pub language: String,
+    /// Hash of the dependency declarations the lock was resolved from
+    pub declarations: String,
+    pub packages: Vec<LockedPackage>,
+}
+
+impl Lockfile {
+    pub fn new(language: &str, dependencies: &[Dependency], mut packages: Vec<LockedPackage>) -> Self {
+        packages.sort_by(|a, b| a.name.cmp(&b.name).then_with(|| a.version.cmp(&b.version)));
+        Self {
+            version: LOCKFILE_VERSION,
+            language: language.to_string(),
+            declarations: Self::declarations_hash(dependencies),
+            packages,
+        }
+    }
+
+    /// `tool.go` is locked by `tool.go.lock`
+    pub fn path_for(script: &Path) -> PathBuf {
+        let mut name = script.file_name().unwrap_or_default().to_os_string();
+        name.push(".lock");
+        script.with_file_name(name)
+    }
+
+    pub fn declarations_hash(dependencies: &[Dependency]) -> String {
+        let mut specs: Vec<String> = dependencies
+            .iter()
+            .map(|d| format!("{}:{}", d.manager.directive(), d.spec()))
+            .collect();
+        specs.sort();
+
+        let mut hasher = Sha256::new();
+        for spec in specs {
+            hasher.update(spec.as_bytes());
+            hasher.update([0u8]);
+        }
+        hex::encode(hasher.finalize())
+    }
+
+    /// Reads the lockfile at `path`; a missing file is not an error
+    pub fn load(path: &Path) -> Result<Option<Self>, SingleloadError> {
+        match std::fs::read(path) {
+            Ok(data) => {
+                let lock: Self = serde_json::from_slice(&data)?;
+                if lock.version != LOCKFILE_VERSION {
+                    return Err(SingleloadError::InvalidInput(format!(
+                        "Unsupported lockfile version {} in {}",
+                        lock.version,
+                        path.display()
+                    )));
+                }
+                Ok(Some(lock))
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(None),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    pub fn save(&self, path: &Path) -> Result<(), SingleloadError> {
+        let mut data = serde_json::to_vec_pretty(self)?;
+        data.push(b'\n');
+        std::fs::write(path, data)?;
+        Ok(())
+    }
+
+    /// True if the lock was resolved from the given declarations
+    pub fn is_fresh(&self, language: &str, dependencies: &[Dependency]) -> bool {
+        self.language == language && self.declarations == Self::declarations_hash(dependencies)
+    }
+
+    /// Every locked package pinned to its exact version, for reinstalling
+    /// the same set of dependencies.
+    ///
+    /// Go only gets its declared requirements pinned: go.sum also lists
+    /// indirect modules, which `go get` would turn into direct requirements
+    /// at versions minimal version selection did not pick. The rest of the
+    /// graph follows from the requirements and is checked by hash.
+    pub fn pinned(&self, dependencies: &[Dependency]) -> Vec<Dependency> {
+        let Some(manager) = dependencies.first().map(|d| d.manager) else {
+            return Vec::new();
+        };
+        if self.packages.is_empty() {
+            return dependencies.to_vec();
+        }
+        if manager == PackageManager::Go {
+            return dependencies
+                .iter()
+                .map(|dep| match self.module_of(&dep.name) {
+                    Some(module) => Dependency::pinned(manager, &dep.name, &module.version),
+                    None => dep.clone(),
+                })
+                .collect();
+        }
+        self.packages
+            .iter()
+            .map(|p| Dependency::pinned(manager, &p.name, &p.version))
+            .collect()
+    }
+
+    /// Locked Go module providing `path`, a module or a package inside one
+    fn module_of(&self, path: &str) -> Option<&LockedPackage> {
+        self.packages
+            .iter()
+            .filter(|p| path == p.name || path.strip_prefix(p.name.as_str()).is_some_and(|rest| rest.starts_with('/')))
+            .max_by_key(|p| p.name.len())
+    }
+
+    /// Returns the first package whose installed hash differs from the lock
+    pub fn mismatch<'a>(&self, installed: &'a [LockedPackage]) -> Option<&'a LockedPackage> {
+        installed.iter().find(|pkg| {
+            self.packages
+                .iter()
+                .find(|l| l.name == pkg.name && l.version == pkg.version)
+                .map_or(true, |l| l.hash.is_some() && l.hash != pkg.hash)
+        })
+    }
+}
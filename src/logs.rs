@@ -0,0 +1,286 @@
+use chrono::{NaiveDateTime, Utc};
+use std::fs::File;
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use tracing::warn;
+
+/// Timestamp in log file names; sorts in creation order
+const TIMESTAMP_FORMAT: &str = "%Y%m%dT%H%M%S%.3fZ";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum OutputStream {
+    Stdout,
+    Stderr,
+}
+
+impl OutputStream {
+    fn name(self) -> &'static str {
+        match self {
+            Self::Stdout => "stdout",
+            Self::Stderr => "stderr",
+        }
+    }
+}
+
+/// When log files are rotated and how many are kept
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct RotationPolicy {
+    /// A file is closed and a new one started once it reaches this size
+    pub max_bytes: u64,
+    /// Files kept per script and stream, the newest ones
+    pub keep: usize,
+}
+
+impl Default for RotationPolicy {
+    fn default() -> Self {
+        Self {
+            max_bytes: 10 * 1024 * 1024,
+            keep: 10,
+        }
+    }
+}
+
+/// Where `run --log-dir` writes a script's output
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct LogCapture {
+    pub dir: PathBuf,
+    pub policy: RotationPolicy,
+    /// Also copy the output to the terminal as it arrives
+    pub echo: bool,
+}
+
+/// Receives the output of a run as it arrives, e.g. to stream it to a client
+pub type OutputTap = Arc<dyn Fn(OutputStream, &[u8]) + Send + Sync>;
+
+/// Gives the run of each script its own tap, so the output of concurrent
+/// runs can be told apart
+pub type OutputTaps = Arc<dyn Fn(&Path) -> OutputTap + Send + Sync>;
+
+/// The output of one run, written to `<name>-<timestamp>.stdout.log` and
+/// `<name>-<timestamp>.stderr.log` as it arrives
+pub struct RunLog {
+    /// Log files of stdout and stderr; None when the output is only tapped
+    files: Option<(RotatingFile, RotatingFile)>,
+    echo: bool,
+    tap: Option<OutputTap>,
+    hidden: Option<Hidden>,
+    failed: bool,
+}
+
+/// Stderr from a marker on, held back because it is not the script's own
+/// output. The tail of what arrived so far is kept until it is clear it
+/// does not start the marker.
+struct Hidden {
+    marker: Vec<u8>,
+    held: Vec<u8>,
+    found: bool,
+}
+
+impl Hidden {
+    /// What of `data` can be passed on
+    fn pass(&mut self, data: &[u8]) -> Vec<u8> {
+        if self.found {
+            return Vec::new();
+        }
+        self.held.extend_from_slice(data);
+        if let Some(at) = self.held.windows(self.marker.len()).position(|w| w == self.marker.as_slice()) {
+            self.found = true;
+            self.held.truncate(at);
+            return std::mem::take(&mut self.held);
+        }
+        let keep = self.held.len().min(self.marker.len() - 1);
+        let rest = self.held.split_off(self.held.len() - keep);
+        std::mem::replace(&mut self.held, rest)
+    }
+}
+
+impl RunLog {
+    pub fn open(capture: &LogCapture, name: &str) -> io::Result<Self> {
+        std::fs::create_dir_all(&capture.dir)?;
+        Ok(Self {
+            files: Some((
+                RotatingFile::new(&capture.dir, name, OutputStream::Stdout, capture.policy),
+                RotatingFile::new(&capture.dir, name, OutputStream::Stderr, capture.policy),
+            )),
+            echo: capture.echo,
+            tap: None,
+            hidden: None,
+            failed: false,
+        })
+    }
+
+    /// Passes the output to `tap` without writing any file
+    pub fn tapped(tap: OutputTap) -> Self {
+        Self {
+            files: None,
+            echo: false,
+            tap: Some(tap),
+            hidden: None,
+            failed: false,
+        }
+    }
+
+    /// Also passes the output to `tap`
+    pub fn with_tap(mut self, tap: Option<OutputTap>) -> Self {
+        self.tap = tap;
+        self
+    }
+
+    /// Leaves out stderr from the first `marker` on
+    pub fn hiding(mut self, marker: &str) -> Self {
+        if !marker.is_empty() {
+            self.hidden = Some(Hidden { marker: marker.as_bytes().to_vec(), held: Vec::new(), found: false });
+        }
+        self
+    }
+
+    /// Writes a chunk of output. A log that cannot be written is reported
+    /// once; the run and the terminal copy carry on without it.
+    pub fn write(&mut self, stream: OutputStream, data: &[u8]) {
+        match &mut self.hidden {
+            Some(hidden) if stream == OutputStream::Stderr => {
+                let passed = hidden.pass(data);
+                if !passed.is_empty() {
+                    self.emit(stream, &passed);
+                }
+            }
+            _ => self.emit(stream, data),
+        }
+    }
+
+    /// Writes what stderr still held back once the output has ended
+    pub fn finish(&mut self) {
+        let held = match &mut self.hidden {
+            Some(hidden) => std::mem::take(&mut hidden.held),
+            None => return,
+        };
+        if !held.is_empty() {
+            self.emit(OutputStream::Stderr, &held);
+        }
+    }
+
+    fn emit(&mut self, stream: OutputStream, data: &[u8]) {
+        if self.echo {
+            let _ = match stream {
+                OutputStream::Stdout => io::stdout().write_all(data).and_then(|_| io::stdout().flush()),
+                OutputStream::Stderr => io::stderr().write_all(data),
+            };
+        }
+        if let Some(tap) = &self.tap {
+            tap(stream, data);
+        }
+        if self.failed {
+            return;
+        }
+        let Some((stdout, stderr)) = &mut self.files else {
+            return;
+        };
+        let file = match stream {
+            OutputStream::Stdout => stdout,
+            OutputStream::Stderr => stderr,
+        };
+        if let Err(e) = file.write(data) {
+            warn!("Failed to write the log in {}: {}", file.dir.display(), e);
+            self.failed = true;
+        }
+    }
+
+    /// Log files of the run that rotation has not removed yet
+    pub fn paths(&self) -> Vec<PathBuf> {
+        let Some((stdout, stderr)) = &self.files else {
+            return Vec::new();
+        };
+        stdout
+            .paths
+            .iter()
+            .chain(&stderr.paths)
+            .filter(|path| path.exists())
+            .cloned()
+            .collect()
+    }
+}
+
+/// One stream's log, continued in a new file whenever the current one is full
+struct RotatingFile {
+    dir: PathBuf,
+    name: String,
+    stream: OutputStream,
+    policy: RotationPolicy,
+    file: Option<File>,
+    written: u64,
+    paths: Vec<PathBuf>,
+}
+
+impl RotatingFile {
+    fn new(dir: &Path, name: &str, stream: OutputStream, policy: RotationPolicy) -> Self {
+        Self {
+            dir: dir.to_path_buf(),
+            name: name.to_string(),
+            stream,
+            policy,
+            file: None,
+            written: 0,
+            paths: Vec::new(),
+        }
+    }
+
+    fn write(&mut self, data: &[u8]) -> io::Result<()> {
+        let full = self.written > 0 && self.written + data.len() as u64 > self.policy.max_bytes;
+        if self.file.is_none() || full {
+            self.rotate()?;
+        }
+        let file = self.file.as_mut().expect("rotate opens a file");
+        file.write_all(data)?;
+        self.written += data.len() as u64;
+        Ok(())
+    }
+
+    /// Starts a new file, made no earlier than the last so names stay
+    /// unique and in order, and removes the oldest ones beyond the policy
+    fn rotate(&mut self) -> io::Result<()> {
+        let mut path = log_path(&self.dir, &self.name, self.stream, Utc::now().naive_utc());
+        while self.paths.last().is_some_and(|last| *last >= path) || path.exists() {
+            std::thread::sleep(std::time::Duration::from_millis(1));
+            path = log_path(&self.dir, &self.name, self.stream, Utc::now().naive_utc());
+        }
+        self.file = Some(File::create(&path)?);
+        self.written = 0;
+        self.paths.push(path);
+        prune(&self.dir, &self.name, self.stream, self.policy.keep)
+    }
+}
+
+fn log_path(dir: &Path, name: &str, stream: OutputStream, time: NaiveDateTime) -> PathBuf {
+    dir.join(format!("{}-{}.{}.log", name, time.format(TIMESTAMP_FORMAT), stream.name()))
+}
+
+/// Log files of `name` and `stream` in `dir`, oldest first
+pub fn log_files(dir: &Path, name: &str, stream: OutputStream) -> io::Result<Vec<PathBuf>> {
+    let prefix = format!("{}-", name);
+    let suffix = format!(".{}.log", stream.name());
+    let mut files = Vec::new();
+    for entry in std::fs::read_dir(dir)? {
+        let path = entry?.path();
+        let Some(file_name) = path.file_name().and_then(|n| n.to_str()) else {
+            continue;
+        };
+        // Only names that are exactly <name>-<timestamp>, so `tool` does
+        // not claim the logs of `tool-sync`
+        let timestamp = file_name.strip_prefix(&prefix).and_then(|rest| rest.strip_suffix(&suffix));
+        if timestamp.is_some_and(|t| NaiveDateTime::parse_from_str(t, TIMESTAMP_FORMAT).is_ok()) {
+            files.push(path);
+        }
+    }
+    files.sort();
+    Ok(files)
+}
+
+fn prune(dir: &Path, name: &str, stream: OutputStream, keep: usize) -> io::Result<()> {
+    let files = log_files(dir, name, stream)?;
+    let excess = files.len().saturating_sub(keep.max(1));
+    for path in &files[..excess] {
+        std::fs::remove_file(path)?;
+    }
+    Ok(())
+}
@@ -0,0 +1,128 @@
+use crate::events::Diagnostic;
+use serde::Serialize;
+use std::path::{Path, PathBuf};
+
+/// Zero-based position, as in the Language Server Protocol
+#[derive(Debug, Clone, Copy, PartialEq, Serialize)]
+pub struct Position {
+    pub line: u32,
+    pub character: u32,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Serialize)]
+pub struct Range {
+    pub start: Position,
+    pub end: Position,
+}
+
+/// LSP `DiagnosticSeverity`
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Severity {
+    Error = 1,
+    Warning = 2,
+}
+
+impl Serialize for Severity {
+    fn serialize<S: serde::Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.serialize_u8(*self as u8)
+    }
+}
+
+/// An LSP `Diagnostic`
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct LspDiagnostic {
+    pub range: Range,
+    pub severity: Severity,
+    pub source: String,
+    pub message: String,
+}
+
+/// The parameters of a `textDocument/publishDiagnostics` notification, so
+/// editor plugins can forward them as they are
+#[derive(Debug, Clone, Serialize)]
+pub struct PublishDiagnostics {
+    pub uri: String,
+    pub diagnostics: Vec<LspDiagnostic>,
+}
+
+impl LspDiagnostic {
+    /// Singleload diagnostics count lines and columns from 1. Without a
+    /// column the range spans the whole line.
+    pub fn from_diagnostic(diagnostic: &Diagnostic, source: &str) -> Self {
+        let line = diagnostic.line.saturating_sub(1);
+        let range = match diagnostic.column {
+            Some(column) => {
+                let position = Position {
+                    line,
+                    character: column.saturating_sub(1),
+                };
+                Range {
+                    start: position,
+                    end: position,
+                }
+            }
+            None => Range {
+                start: Position { line, character: 0 },
+                end: Position {
+                    line: line + 1,
+                    character: 0,
+                },
+            },
+        };
+        let severity = if diagnostic.message.to_lowercase().starts_with("warning") {
+            Severity::Warning
+        } else {
+            Severity::Error
+        };
+
+        Self {
+            range,
+            severity,
+            source: source.to_string(),
+            message: diagnostic.message.clone(),
+        }
+    }
+}
+
+/// Groups diagnostics by file, with an entry (possibly empty, which clears
+/// stale markers in the editor) for each of `files`
+pub fn publish(files: &[PathBuf], diagnostics: &[Diagnostic], source: &str) -> Vec<PublishDiagnostics> {
+    files
+        .iter()
+        .map(|file| {
+            let name = file.display().to_string();
+            PublishDiagnostics {
+                uri: file_uri(file),
+                diagnostics: diagnostics
+                    .iter()
+                    .filter(|d| d.file == name)
+                    .map(|d| LspDiagnostic::from_diagnostic(d, source))
+                    .collect(),
+            }
+        })
+        .collect()
+}
+
+/// `file://` URI of a path, made absolute against the working directory
+pub fn file_uri(path: &Path) -> String {
+    let absolute = if path.is_absolute() {
+        path.to_path_buf()
+    } else {
+        std::env::current_dir().map(|dir| dir.join(path)).unwrap_or_else(|_| path.to_path_buf())
+    };
+    let mut path = absolute.to_string_lossy().replace('\\', "/");
+    if !path.starts_with('/') {
+        // Windows drive paths: file:///C:/...
+        path.insert(0, '/');
+    }
+
+    let mut uri = String::from("file://");
+    for byte in path.bytes() {
+        if byte.is_ascii_alphanumeric() || b"/-._~:".contains(&byte) {
+            uri.push(byte as char);
+        } else {
+            uri.push_str(&format!("%{:02X}", byte));
+        }
+    }
+    uri
+}
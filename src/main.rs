@@ -1,20 +1,146 @@
 use anyhow::Result;
-use clap::{Parser, Subcommand};
-use std::path::PathBuf;
+use clap::{CommandFactory, Parser, Subcommand};
+use std::ffi::OsString;
+use std::io::{IsTerminal, Read, Write};
+use std::net::SocketAddr;
+use std::path::{Path, PathBuf};
 use std::time::Duration;
 use tracing::{info, Level};
 use tracing_subscriber::{fmt, prelude::*, EnvFilter};
 
+mod args;
+mod artifacts;
+mod assets;
+mod audit;
+mod batch;
+mod bench;
+mod bundle;
+mod cache;
+mod catalog;
+mod cells;
+mod chooser;
+mod completion;
 mod config;
 mod container;
+mod daemon;
+mod debugging;
+mod delta;
+mod directives;
+mod doctor;
+mod download;
+mod egress;
+mod entries;
+mod env;
 mod errors;
+mod events;
 mod executor;
+mod export;
+mod flake;
+mod gpu;
+mod grpc;
+mod history;
+mod hooks;
+mod http2;
+mod images;
+mod limits;
+mod lockfile;
+mod logs;
+mod lsp;
+mod matrix;
+mod metadata;
+mod metrics;
+mod multiplex;
+mod normalize;
+mod package;
+mod pins;
+mod pipeline;
+mod platform;
+mod plugins;
+mod policy;
+mod postmortem;
+mod preprocess;
+mod profile;
+mod profiling;
+mod progress;
+mod project;
+mod queue;
+mod remote;
+mod remote_cache;
+mod reproducible;
+mod retry;
+mod runner;
+mod sandbox;
+mod sbom;
+mod scaffold;
 mod security;
+mod server;
+mod service;
+mod signals;
+mod signing;
+mod snapshot;
+mod source;
+mod sourcemap;
+mod ssh;
+mod state;
+mod tofu;
+mod toolchain;
+mod tools;
+mod trace;
 mod types;
+mod update;
+mod uses;
+mod verify;
+mod vet;
+mod watch;
+mod workdir;
 
+use crate::audit::{AuditMode, AuditReport, Severity};
+use crate::bench::{BenchSummary, Stats};
+use crate::cache::{BuildCache, CacheStats, GcReport};
+use crate::catalog::{Catalog, ScriptInfo};
+use crate::cells::CellSelection;
+use crate::completion::Shell;
 use crate::config::Config;
 use crate::container::ContainerManager;
-use crate::types::{ExecutionResult, Language};
+use crate::daemon::{Daemon, RunRequest};
+use crate::debugging::Debugging;
+use crate::download::DownloadManager;
+use crate::history::{content_hash, HistoryStore, Invocation};
+use crate::matrix::MatrixSummary;
+use crate::pipeline::Pipeline;
+use crate::policy::Policy;
+use crate::postmortem::PostmortemStore;
+use crate::preprocess::ValuesTemplate;
+use crate::profiling::{ProfileKind, Profiling};
+use crate::progress::Progress;
+use crate::project::MANIFEST_FILE;
+use crate::queue::Priority;
+use crate::remote::{RemoteSources, Verification};
+use crate::retry::{RetryCondition, RetryPolicy};
+use crate::sandbox::SandboxProfile;
+use crate::sbom::SbomFormat;
+use crate::server::ApiServer;
+use crate::scaffold::Templates;
+use crate::signals::{SignalProxy, DEFAULT_KILL_TIMEOUT};
+use crate::snapshot::SnapshotStore;
+use crate::source::{save_stdin_program, STDIN_PATH};
+use crate::ssh::SshTarget;
+use crate::service::{Manager, Restart, Service, ServiceStore};
+use crate::state::StateStore;
+use crate::tofu::{KnownCheck, KnownScripts};
+use crate::toolchain::ToolchainStore;
+use crate::tools::{ToolKind, ToolStore};
+use crate::events::{Diagnostic, Event, EventSink};
+use crate::executor::{Executor, Explanation, Measurement};
+use crate::export::ImportStore;
+use crate::logs::{LogCapture, RotationPolicy};
+use crate::multiplex::{Multiplexer, OutputMode};
+use crate::runner::{BuildTarget, Registry, WASI_TARGET};
+use crate::types::ExecutionResult;
+use crate::update::{Channel, Updater};
+use crate::vet::{FailOn, ToolStatus};
+use crate::workdir::WorkDir;
+use crate::watch::FileWatcher;
 
 #[derive(Parser)]
 #[command(name = "singleload")]
@@ -27,203 +153,4809 @@ struct Cli {
     #[arg(long, global = true)]
     debug: bool,
 
-    /// Output format (json or text)
+    /// Output format (json or text; `check` also accepts lsp)
     #[arg(long, global = true, default_value = "json")]
     format: String,
+
+    /// Machine-readable mode: JSON output, plus progress events as JSON lines on stderr
+    #[arg(long, global = true)]
+    json: bool,
+
+    /// No progress display with `--format text` on a terminal; compiler output is shown in full
+    #[arg(long, global = true)]
+    plain: bool,
+
+    /// Ignore toolchain versions pinned by the project (go.mod, .python-version, rust-toolchain.toml)
+    #[arg(long, global = true)]
+    ignore_project: bool,
+}
+
+#[derive(Subcommand)]
+enum Commands {
+    /// Install the base container image, or a script as a command
+    Install {
+        /// Script to install as a command in the bin directory (~/.singleload/bin)
+        script: Option<PathBuf>,
+
+        /// Command name for the script (defaults to the script name without extension)
+        #[arg(long = "as", value_name = "NAME", requires = "script")]
+        name: Option<String>,
+
+        /// Programming language of the script (detected when omitted)
+        #[arg(long, requires = "script")]
+        lang: Option<String>,
+
+        /// Install a launcher that runs the script in the sandbox, even if it could be compiled
+        #[arg(long, requires = "script")]
+        wrap: bool,
+
+        /// Path to Containerfile (defaults to bundled)
+        #[arg(long, conflicts_with = "script")]
+        containerfile: Option<PathBuf>,
+
+        /// Force rebuild even if image exists, or replace an installed command
+        #[arg(long)]
+        force: bool,
+    },
+
+    /// Create a new script from a template
+    New {
+        /// Path of the script to create; the extension is added when missing
+        #[arg(required_unless_present = "list")]
+        path: Option<PathBuf>,
+
+        /// Programming language (taken from the extension, or asked for, when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Template to start from (basic, cli-args or one from the templates directory)
+        #[arg(short, long, default_value = scaffold::DEFAULT_TEMPLATE)]
+        template: String,
+
+        /// List the available templates instead
+        #[arg(long)]
+        list: bool,
+
+        /// Replace the file if it exists
+        #[arg(long)]
+        force: bool,
+    },
+
+    /// Remove a command installed with 'install <script>'
+    Uninstall {
+        /// Name of the installed command
+        name: String,
+    },
+
+    /// List commands installed with 'install <script>'
+    List,
+
+    /// Run a script in an isolated container
+    Run {
+        /// Programming language (detected from the script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Path to script file, file:entry for one of its entries, an https:// URL, or - to read the program from stdin [default: pick one in the current directory]
+        #[arg(long)]
+        script: Option<PathBuf>,
+
+        /// Same as --script
+        #[arg(value_name = "SCRIPT")]
+        source: Option<PathBuf>,
+
+        /// Arguments for the script, after the script or after `--`; passed on after any --run-arg
+        #[arg(value_name = "ARGS", trailing_var_arg = true, allow_hyphen_values = true)]
+        args: Vec<String>,
+
+        /// Execution timeout: 30s, 2m or seconds [default: 30, or default_timeout_secs from the config]
+        #[arg(long, value_parser = limits::parse_timeout)]
+        timeout: Option<u64>,
+
+        /// Memory limit: 512M, 1G or MB [default: 512, or default_memory_mb from the config]
+        #[arg(long, visible_alias = "max-mem", value_parser = limits::parse_memory)]
+        memory: Option<u64>,
+
+        /// CPU limit in cores (0.1-4.0), enforced as a cgroup quota [default: 1.0, or default_cpu_limit from the config]
+        #[arg(long, visible_alias = "max-cpu")]
+        cpu: Option<f32>,
+
+        /// Keep container for debugging
+        #[arg(long)]
+        debug: bool,
+
+        /// Maximum output size in KB [default: 1024, or default_output_limit_kb from the config]
+        #[arg(long)]
+        max_output: Option<u64>,
+
+        /// Rebuild compiled languages instead of using the build cache
+        #[arg(long)]
+        no_cache: bool,
+
+        /// Re-run the script whenever it changes, stopping the previous run
+        #[arg(long)]
+        watch: bool,
+
+        /// Run locally even if a daemon is listening
+        #[arg(long)]
+        no_daemon: bool,
+
+        /// Place in the daemon's queue when it is busy
+        #[arg(long, value_enum, default_value = "normal")]
+        priority: Priority,
+
+        /// Cancel the daemon's earlier runs of the same script, queued or running
+        #[arg(long)]
+        supersede: bool,
+
+        /// Sandbox profile (default, strict, network or one from the config) [default: default_sandbox from the config]
+        #[arg(long)]
+        sandbox: Option<String>,
+
+        /// Compile to a WebAssembly module and run it with wasmtime (only `wasi`)
+        #[arg(long)]
+        target: Option<String>,
+
+        /// Fail instead of resolving dependencies when the lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+
+        /// Rebuild when a source changes at all, even if only in comments or run-time directives
+        #[arg(long)]
+        strict_hash: bool,
+
+        /// Run a remote (https) script without pinning its checksum
+        #[arg(long)]
+        trust: bool,
+
+        /// Only run a remote script if its content has this sha256 checksum
+        #[arg(long, value_name = "CHECKSUM")]
+        sha256: Option<String>,
+
+        /// Fail instead of asking when a remote or shared script changed since it last ran
+        #[arg(long)]
+        strict_tofu: bool,
+
+        /// Load environment variables from a dotenv file (repeatable)
+        #[arg(long, value_name = "PATH")]
+        env_file: Vec<PathBuf>,
+
+        /// Set an environment variable; a bare KEY passes the host's value (repeatable)
+        #[arg(short, long, value_name = "KEY=VALUE")]
+        env: Vec<String>,
+
+        /// Run without the script's persistent state directory
+        #[arg(long)]
+        no_state: bool,
+
+        /// Only run the script if its detached .sig signature matches this ed25519 public key (PEM)
+        #[arg(long, value_name = "PUBKEY")]
+        verify_with: Option<PathBuf>,
+
+        /// Build profile (debug, release or one from the config); overrides the script's profile directive
+        #[arg(long)]
+        profile: Option<String>,
+
+        /// Pass a flag to the compiler as it is, after the profile's flags (repeatable)
+        #[arg(long = "build-arg", value_name = "FLAG", allow_hyphen_values = true)]
+        build_args: Vec<String>,
+
+        /// Pass an argument to the script when it runs (repeatable)
+        #[arg(long = "run-arg", value_name = "ARG", allow_hyphen_values = true)]
+        run_args: Vec<String>,
+
+        /// Look dependencies up in the OSV database first; deny refuses critical vulnerabilities
+        #[arg(long, value_enum, default_value = "off")]
+        audit: AuditMode,
+
+        /// Also write the script's stdout and stderr to timestamped, rotated files here as it runs
+        #[arg(long, value_name = "DIR")]
+        log_dir: Option<PathBuf>,
+
+        /// Start a new log file once the current one reaches this size, e.g. `50M` or plain MB
+        #[arg(long, value_parser = limits::parse_memory, default_value = "10", requires = "log_dir")]
+        log_max_size: u64,
+
+        /// Log files kept per stream; older ones are deleted
+        #[arg(long, default_value = "10", requires = "log_dir")]
+        log_keep: usize,
+
+        /// Seconds the script may take to exit after a forwarded Ctrl-C or SIGTERM before it is killed [default: 10]
+        #[arg(long, value_name = "SECONDS")]
+        kill_timeout: Option<u64>,
+
+        /// Run only this `# %%` cell of a Python script, with the variables earlier runs left in its state
+        #[arg(long, value_name = "N", conflicts_with = "cells")]
+        cell: Option<usize>,
+
+        /// Run only these cells, e.g. `1-4` or `1,3-5`
+        #[arg(long, value_name = "RANGE", value_parser = CellSelection::parse)]
+        cells: Option<CellSelection>,
+
+        /// Build or bundle the script here, then run it on this SSH host instead of in a container
+        #[arg(long, value_name = "USER@HOST[:PORT]", conflicts_with_all = ["watch", "target", "log_dir", "debug"])]
+        on: Option<String>,
+
+        /// When a directory holds several scripts, run the first by the fallback order instead of asking
+        #[arg(long)]
+        non_interactive: bool,
+
+        /// Run in a fresh, writable temporary working directory, removed afterwards
+        #[arg(long, conflicts_with = "on")]
+        isolate_cwd: bool,
+
+        /// Copy this file, or a directory's contents, into the isolated working directory first (repeatable)
+        #[arg(long, value_name = "PATH", requires = "isolate_cwd")]
+        copy: Vec<PathBuf>,
+
+        /// Keep the isolated working directory after the run and print where it is
+        #[arg(long, requires = "isolate_cwd")]
+        keep: bool,
+
+        /// Report wall time, CPU time, peak memory and I/O of the script (a `stats` object in JSON)
+        #[arg(long, conflicts_with_all = ["watch", "on"])]
+        stats: bool,
+
+        /// Run the script under strace and write the files it read, wrote, executed or looked up to this JSON manifest
+        #[arg(long, value_name = "FILE", conflicts_with_all = ["watch", "on"])]
+        trace_files: Option<PathBuf>,
+
+        /// Profile the script's CPU use with its language's profiler (pprof, py-spy or perf), written to FILE or next to the script
+        #[arg(long, value_name = "FILE", num_args = 0..=1, conflicts_with_all = ["watch", "on", "profile_heap"])]
+        profile_cpu: Option<Option<PathBuf>>,
+
+        /// Profile the script's allocations with its language's profiler (pprof, tracemalloc or massif), written to FILE or next to the script
+        #[arg(long, value_name = "FILE", num_args = 0..=1, conflicts_with_all = ["watch", "on"])]
+        profile_heap: Option<Option<PathBuf>>,
+
+        /// Run an interpreted script in a pinned upstream image of its interpreter, pulled on first use, instead of the base image
+        #[arg(long, conflicts_with_all = ["on", "target"])]
+        containerized: bool,
+
+        /// Interpret a small Go script with yaegi instead of compiling it when its build is not cached
+        #[arg(long, conflicts_with_all = ["on", "target"])]
+        interp: bool,
+
+        /// Build and run the script in the shell of a Nix flake generated from its toolchain pin, pip dependencies and pkg-config libraries
+        #[arg(long, conflicts_with_all = ["on", "target", "containerized", "interp", "trace_files"])]
+        nix: bool,
+
+        /// Run the script again up to N times when it fails, logging each attempt
+        #[arg(long, value_name = "N", conflicts_with_all = ["watch", "on"])]
+        retries: Option<u32>,
+
+        /// Wait before the first retry, doubling for each one after: 500ms, 2s or seconds [default: 1s]
+        #[arg(long, value_name = "DURATION", value_parser = limits::parse_duration, requires = "retries")]
+        retry_backoff: Option<Duration>,
+
+        /// Failure to retry: exit!=0, exit==N (also !=, >=, <=, >, <), timeout or error (repeatable) [default: exit!=0]
+        #[arg(long, value_name = "CONDITION", value_parser = RetryCondition::parse, requires = "retries")]
+        retry_on: Vec<RetryCondition>,
+
+        /// Fill `{{.KEY}}` placeholders in the source with VALUE before it is built (repeatable)
+        #[arg(long = "set", value_name = "KEY=VALUE")]
+        set: Vec<String>,
+
+        /// Read placeholder values from a TOML or JSON file; --set wins (repeatable)
+        #[arg(long = "values", value_name = "FILE")]
+        values: Vec<PathBuf>,
+
+        /// Fail when a placeholder has no value instead of leaving it in the source
+        #[arg(long)]
+        strict_values: bool,
+    },
+
+    /// Run scripts as a pipeline, each one's stdout feeding the next one's stdin
+    Pipe {
+        /// A pipeline file (.pipe), or the scripts to chain in order
+        #[arg(required = true)]
+        steps: Vec<PathBuf>,
+
+        /// Execution timeout per step: 30s, 2m or seconds [default: default_timeout_secs from the config]
+        #[arg(long, value_parser = limits::parse_timeout)]
+        timeout: Option<u64>,
+
+        /// Memory limit per step: 512M, 1G or MB [default: default_memory_mb from the config]
+        #[arg(long, value_parser = limits::parse_memory)]
+        memory: Option<u64>,
+
+        /// Maximum output size per step in KB [default: default_output_limit_kb from the config]
+        #[arg(long)]
+        max_output: Option<u64>,
+
+        /// Rebuild compiled languages instead of using the build cache
+        #[arg(long)]
+        no_cache: bool,
+
+        /// Sandbox profile for every step [default: default_sandbox from the config]
+        #[arg(long)]
+        sandbox: Option<String>,
+
+        /// Load environment variables from a dotenv file (repeatable)
+        #[arg(long, value_name = "PATH")]
+        env_file: Vec<PathBuf>,
+
+        /// Set an environment variable; a bare KEY passes the host's value (repeatable)
+        #[arg(short, long, value_name = "KEY=VALUE")]
+        env: Vec<String>,
+    },
+
+    /// Show what running a script would do, without building or running anything
+    Explain {
+        /// Path to script file, or a directory project
+        script: PathBuf,
+
+        /// Programming language (detected from the file when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Execution timeout: 30s, 2m or seconds [default: default_timeout_secs from the config]
+        #[arg(long, value_parser = limits::parse_timeout)]
+        timeout: Option<u64>,
+
+        /// Memory limit: 512M, 1G or MB [default: default_memory_mb from the config]
+        #[arg(long, value_parser = limits::parse_memory)]
+        memory: Option<u64>,
+
+        /// CPU limit in cores [default: default_cpu_limit from the config]
+        #[arg(long)]
+        cpu: Option<f32>,
+
+        /// Explain a run that does not use the build cache
+        #[arg(long)]
+        no_cache: bool,
+
+        /// Sandbox profile (see `run --sandbox`)
+        #[arg(long)]
+        sandbox: Option<String>,
+
+        /// Compilation target; only wasm32-wasip1 can be run
+        #[arg(long)]
+        target: Option<String>,
+
+        /// Fail when the dependency lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+
+        /// Build profile (debug, release or one from the config); overrides the script's profile directive
+        #[arg(long)]
+        profile: Option<String>,
+
+        /// Pass a flag to the compiler as it is, after the profile's flags (repeatable)
+        #[arg(long = "build-arg", value_name = "FLAG", allow_hyphen_values = true)]
+        build_args: Vec<String>,
+
+        /// Pass an argument to the script when it runs (repeatable)
+        #[arg(long = "run-arg", value_name = "ARG", allow_hyphen_values = true)]
+        run_args: Vec<String>,
+    },
+
+    /// Show what a script declares about itself: description, authors, version, tags and options
+    Info {
+        script: PathBuf,
+    },
+
+    /// Catalog the scripts in a directory tree for `singleload search`
+    Index {
+        #[arg(default_value = ".", value_hint = clap::ValueHint::DirPath)]
+        dir: PathBuf,
+    },
+
+    /// Find indexed scripts by name, tag, description or author
+    Search {
+        /// Words that all have to match
+        #[arg(required = true)]
+        query: Vec<String>,
+    },
+
+    /// Download the dependencies and toolchains of scripts without running them
+    Fetch {
+        /// Scripts or glob patterns such as 'tools/*.go'
+        #[arg(required = true)]
+        patterns: Vec<String>,
+
+        /// Programming language (detected per script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Memory limit for install containers in MB
+        #[arg(long, default_value = "1024")]
+        memory: u64,
+
+        /// Fail instead of resolving dependencies when the lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+    },
+
+    /// Report known vulnerabilities in the inline dependencies of a script
+    Audit {
+        /// Path to script file
+        script: PathBuf,
+
+        /// Programming language (detected from the file when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Exit with status 1 when a vulnerability of this severity or worse is found
+        #[arg(long, value_enum, default_value = "low")]
+        fail_on: Severity,
+
+        /// Memory limit for install containers in MB
+        #[arg(long, default_value = "1024")]
+        memory: u64,
+
+        /// Fail instead of resolving dependencies when the lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+    },
+
+    /// Bundle an interpreted script and its dependencies into a self-extracting executable
+    Bundle {
+        /// Path to script file
+        script: PathBuf,
+
+        /// Where to write the bundle (defaults to the script name in the current directory)
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+
+        /// Programming language (detected from the script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Dependency install timeout in seconds
+        #[arg(long, default_value = "300")]
+        timeout: u64,
+
+        /// Memory limit in MB
+        #[arg(long, default_value = "1024")]
+        memory: u64,
+
+        /// Resolve dependencies again instead of reusing cached ones
+        #[arg(long)]
+        no_cache: bool,
+
+        /// Fail instead of resolving dependencies when the lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+    },
+
+    /// Package a compiled script as a minimal container image
+    Package {
+        /// Path to script file
+        script: PathBuf,
+
+        /// Produce an OCI image on a distroless base with the binary as entrypoint
+        #[arg(long, required = true)]
+        oci: bool,
+
+        /// Programming language (detected from the script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Image tag, including the registry when pushing (defaults to singleload/<script>:latest)
+        #[arg(short, long)]
+        tag: Option<String>,
+
+        /// Push the image to the registry in its tag after building it
+        #[arg(long)]
+        push: bool,
+
+        /// Build timeout in seconds
+        #[arg(long, default_value = "300")]
+        timeout: u64,
+
+        /// Memory limit in MB
+        #[arg(long, default_value = "1024")]
+        memory: u64,
+
+        /// Rebuild instead of reusing a cached artifact
+        #[arg(long)]
+        no_cache: bool,
+
+        /// Fail instead of resolving dependencies when the lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+
+        /// Build profile (debug, release or one from the config); overrides the script's profile directive
+        #[arg(long)]
+        profile: Option<String>,
+
+        /// Pass a flag to the compiler as it is, after the profile's flags (repeatable)
+        #[arg(long = "build-arg", value_name = "FLAG", allow_hyphen_values = true)]
+        build_args: Vec<String>,
+    },
+
+    /// Run the tests defined in a single file with the language's test runner
+    Test {
+        /// Script containing the tests, or a directory project
+        script: PathBuf,
+
+        /// Programming language (detected from the script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Write a coverage report next to the script (Go and JavaScript)
+        #[arg(long)]
+        coverage: bool,
+
+        /// Test timeout in seconds
+        #[arg(long, default_value = "300")]
+        timeout: u64,
+
+        /// Memory limit in MB
+        #[arg(long, default_value = "1024")]
+        memory: u64,
+
+        /// CPU limit (0.1-4.0)
+        #[arg(long, default_value = "1.0")]
+        cpu: f32,
+
+        /// Maximum output size in KB
+        #[arg(long, default_value = "1024")]
+        max_output: u64,
+
+        /// Sandbox profile (default, strict, network or one from the config)
+        #[arg(long, default_value = "default")]
+        sandbox: String,
+
+        /// Fail instead of resolving dependencies when the lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+
+        /// Load environment variables from a dotenv file (repeatable)
+        #[arg(long, value_name = "PATH")]
+        env_file: Vec<PathBuf>,
+
+        /// Set an environment variable; a bare KEY passes the host's value (repeatable)
+        #[arg(short, long, value_name = "KEY=VALUE")]
+        env: Vec<String>,
+    },
+
+    /// Report compile and syntax errors in a script without running it
+    Check {
+        /// Path to script file, or a directory project
+        script: PathBuf,
+
+        /// Programming language (detected from the script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Check timeout in seconds
+        #[arg(long, default_value = "120")]
+        timeout: u64,
+
+        /// Memory limit in MB
+        #[arg(long, default_value = "1024")]
+        memory: u64,
+
+        /// Fail instead of resolving dependencies when the lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+    },
+
+    /// Run the language's linters on a script: go vet and staticcheck, ruff, clippy, shellcheck or compiler warnings
+    Vet {
+        /// Path to script file, or a directory project
+        script: PathBuf,
+
+        /// Programming language (detected from the script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Exit with status 1 when a finding of this severity or worse is reported
+        #[arg(long, value_enum, default_value = "warning")]
+        fail_on: FailOn,
+
+        /// Timeout in seconds
+        #[arg(long, default_value = "120")]
+        timeout: u64,
+
+        /// Memory limit in MB
+        #[arg(long, default_value = "1024")]
+        memory: u64,
+
+        /// Fail instead of resolving dependencies when the lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+    },
+
+    /// Build and run many scripts concurrently, e.g. an examples suite
+    RunAll {
+        /// Scripts or glob patterns such as 'examples/**/*.go'
+        #[arg(required = true)]
+        patterns: Vec<String>,
+
+        /// Programming language (detected per script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Number of scripts to run at the same time
+        #[arg(short, long, default_value = "4")]
+        jobs: usize,
+
+        /// Execution timeout per script in seconds
+        #[arg(long, default_value = "30")]
+        timeout: u64,
+
+        /// Memory limit per script in MB
+        #[arg(long, default_value = "512")]
+        memory: u64,
+
+        /// CPU limit per script (0.1-4.0)
+        #[arg(long, default_value = "1.0")]
+        cpu: f32,
+
+        /// Maximum output size per script in KB
+        #[arg(long, default_value = "1024")]
+        max_output: u64,
+
+        /// Rebuild compiled languages instead of using the build cache
+        #[arg(long)]
+        no_cache: bool,
+
+        /// Sandbox profile (default, strict, network or one from the config)
+        #[arg(long, default_value = "default")]
+        sandbox: String,
+
+        /// Load environment variables from a dotenv file (repeatable)
+        #[arg(long, value_name = "PATH")]
+        env_file: Vec<PathBuf>,
+
+        /// Set an environment variable; a bare KEY passes the host's value (repeatable)
+        #[arg(short, long, value_name = "KEY=VALUE")]
+        env: Vec<String>,
+
+        /// How the output of scripts running at the same time is shown
+        #[arg(long, value_enum, default_value_t = OutputMode::Interleaved)]
+        output: OutputMode,
+    },
+
+    /// Run example scripts and check their exit code and output against golden files
+    Verify {
+        /// Scripts or glob patterns such as 'examples/**/*.go'
+        #[arg(required = true)]
+        patterns: Vec<String>,
+
+        /// Programming language (detected per script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Exit code every script has to end with
+        #[arg(long, default_value = "0", value_name = "CODE")]
+        expect_exit: u32,
+
+        /// File holding the exact stdout of the script [default: <script>.golden when it exists]
+        #[arg(long, value_name = "PATH")]
+        expect_stdout_file: Option<PathBuf>,
+
+        /// Write each script's stdout to its golden file instead of comparing it
+        #[arg(long)]
+        update: bool,
+
+        /// Also write the results as a JUnit XML report
+        #[arg(long, value_name = "PATH")]
+        junit: Option<PathBuf>,
+
+        /// Number of scripts to run at the same time
+        #[arg(short, long, default_value = "4")]
+        jobs: usize,
+
+        /// Execution timeout per script in seconds
+        #[arg(long, default_value = "30")]
+        timeout: u64,
+
+        /// Memory limit per script in MB
+        #[arg(long, default_value = "512")]
+        memory: u64,
+
+        /// CPU limit per script (0.1-4.0)
+        #[arg(long, default_value = "1.0")]
+        cpu: f32,
+
+        /// Maximum output size per script in KB
+        #[arg(long, default_value = "1024")]
+        max_output: u64,
+
+        /// Rebuild compiled languages instead of using the build cache
+        #[arg(long)]
+        no_cache: bool,
+
+        /// Sandbox profile (default, strict, network or one from the config)
+        #[arg(long, default_value = "default")]
+        sandbox: String,
+
+        /// Load environment variables from a dotenv file (repeatable)
+        #[arg(long, value_name = "PATH")]
+        env_file: Vec<PathBuf>,
+
+        /// Set an environment variable; a bare KEY passes the host's value (repeatable)
+        #[arg(short, long, value_name = "KEY=VALUE")]
+        env: Vec<String>,
+    },
+
+    /// Build and run a script under several toolchain versions and compare
+    Matrix {
+        /// Script file or project directory
+        script: PathBuf,
+
+        /// Go versions to test, comma separated, e.g. 1.21,1.22.5,1.23.1;
+        /// 1.22 means 1.22.0
+        #[arg(long, required = true, value_name = "VERSIONS")]
+        go: Vec<String>,
+
+        /// Number of versions to run at the same time
+        #[arg(short, long, default_value = "4")]
+        jobs: usize,
+
+        /// Execution timeout per version in seconds
+        #[arg(long, default_value = "30")]
+        timeout: u64,
+
+        /// Memory limit per version in MB
+        #[arg(long, default_value = "512")]
+        memory: u64,
+
+        /// CPU limit per version (0.1-4.0)
+        #[arg(long, default_value = "1.0")]
+        cpu: f32,
+
+        /// Sandbox profile (default, strict, network or one from the config)
+        #[arg(long, default_value = "default")]
+        sandbox: String,
+
+        /// Load environment variables from a dotenv file (repeatable)
+        #[arg(long, value_name = "PATH")]
+        env_file: Vec<PathBuf>,
+
+        /// Set an environment variable; a bare KEY passes the host's value (repeatable)
+        #[arg(short, long, value_name = "KEY=VALUE")]
+        env: Vec<String>,
+    },
+
+    /// Measure run time and peak memory of scripts over repeated runs
+    Bench {
+        /// Scripts or glob patterns; several are compared with each other
+        #[arg(required = true)]
+        patterns: Vec<String>,
+
+        /// Programming language (detected per script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Measured runs per script
+        #[arg(short = 'n', long, default_value = "10")]
+        runs: usize,
+
+        /// Unmeasured runs before measuring; the first one builds compiled languages
+        #[arg(long, default_value = "1")]
+        warmup: usize,
+
+        /// Execution timeout per run: 30s, 2m or seconds [default: default_timeout_secs from the config]
+        #[arg(long, value_parser = limits::parse_timeout)]
+        timeout: Option<u64>,
+
+        /// Memory limit per run: 512M, 1G or MB [default: default_memory_mb from the config]
+        #[arg(long, value_parser = limits::parse_memory)]
+        memory: Option<u64>,
+
+        /// CPU limit per run (0.1-4.0) [default: default_cpu_limit from the config]
+        #[arg(long)]
+        cpu: Option<f32>,
+
+        /// Sandbox profile [default: default_sandbox from the config]
+        #[arg(long)]
+        sandbox: Option<String>,
+
+        /// Load environment variables from a dotenv file (repeatable)
+        #[arg(long, value_name = "PATH")]
+        env_file: Vec<PathBuf>,
+
+        /// Set an environment variable; a bare KEY passes the host's value (repeatable)
+        #[arg(short, long, value_name = "KEY=VALUE")]
+        env: Vec<String>,
+    },
+
+    /// Start an interactive session (yaegi for Go, native REPLs otherwise)
+    Repl {
+        /// Programming language (detected from --script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Script to load first; its dependency and toolchain directives apply
+        #[arg(long)]
+        script: Option<PathBuf>,
+
+        /// Session timeout in seconds
+        #[arg(long, default_value = "3600")]
+        timeout: u64,
+
+        /// Memory limit in MB
+        #[arg(long, default_value = "512")]
+        memory: u64,
+
+        /// Sandbox profile (default, strict, network or one from the config)
+        #[arg(long, default_value = "default")]
+        sandbox: String,
+
+        /// Load environment variables from a dotenv file (repeatable)
+        #[arg(long, value_name = "PATH")]
+        env_file: Vec<PathBuf>,
+
+        /// Set an environment variable; a bare KEY passes the host's value (repeatable)
+        #[arg(short, long, value_name = "KEY=VALUE")]
+        env: Vec<String>,
+
+        /// Run without the script's persistent state directory
+        #[arg(long)]
+        no_state: bool,
+    },
+
+    /// Build a script with debug symbols and run it under delve, pdb or lldb
+    Debug {
+        /// Path to script file
+        script: PathBuf,
+
+        /// Programming language (detected from the file when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Serve debug adapter (DAP) clients on this address instead, e.g. :4711
+        #[arg(long, value_name = "ADDR", value_parser = debugging::parse_dap)]
+        dap: Option<SocketAddr>,
+
+        /// Session timeout in seconds
+        #[arg(long, default_value = "3600")]
+        timeout: u64,
+
+        /// Memory limit in MB
+        #[arg(long, default_value = "1024")]
+        memory: u64,
+
+        /// Sandbox profile (default, strict, network or one from the config)
+        #[arg(long, default_value = "default")]
+        sandbox: String,
+
+        /// Load environment variables from a dotenv file (repeatable)
+        #[arg(long, value_name = "PATH")]
+        env_file: Vec<PathBuf>,
+
+        /// Set an environment variable; a bare KEY passes the host's value (repeatable)
+        #[arg(short, long, value_name = "KEY=VALUE")]
+        env: Vec<String>,
+
+        /// Pass an argument to the script when it runs (repeatable)
+        #[arg(long = "run-arg", value_name = "ARG", allow_hyphen_values = true)]
+        run_args: Vec<String>,
+
+        /// Run without the script's persistent state directory
+        #[arg(long)]
+        no_state: bool,
+    },
+
+    /// Serve run requests over a unix socket, keeping Podman state warm
+    Daemon {
+        /// Socket path (defaults to $XDG_RUNTIME_DIR/singleload/daemon.sock)
+        #[arg(long)]
+        socket: Option<PathBuf>,
+
+        /// Serve Prometheus metrics over HTTP at this address, e.g. :9090
+        /// or 127.0.0.1:9090
+        #[arg(long, value_name = "ADDR")]
+        metrics: Option<String>,
+
+        /// Serve the gRPC control API (proto/singleload/v1) at this address,
+        /// e.g. :7687; HTTP/2 gRPC and HTTP/1.1 gRPC-Web clients share it
+        #[arg(long, value_name = "ADDR")]
+        grpc: Option<String>,
+
+        /// Bearer token every gRPC call must send; one is generated and
+        /// printed when not given
+        #[arg(long, env = "SINGLELOAD_GRPC_TOKEN", hide_env_values = true, requires = "grpc")]
+        grpc_token: Option<String>,
+
+        /// Let gRPC calls name scripts by their path on this host rather than
+        /// send their source; only for clients running on this host
+        #[arg(long, requires = "grpc")]
+        grpc_allow_paths: bool,
+    },
+
+    /// Serve an HTTP/JSON API to run and build submitted scripts, e.g. for a playground
+    Serve {
+        /// Address to listen on, e.g. :8080 or 127.0.0.1:8080
+        #[arg(long, value_name = "ADDR", default_value = "127.0.0.1:8080")]
+        listen: String,
+
+        /// Bearer token every request but /v1/health has to send (generated and printed when omitted)
+        #[arg(long, env = "SINGLELOAD_SERVE_TOKEN", hide_env_values = true)]
+        token: Option<String>,
+
+        /// Allow browser pages from this origin to call the API (`*` for any)
+        #[arg(long, value_name = "ORIGIN")]
+        allow_origin: Option<String>,
+    },
+
+    /// Compile a script into a standalone binary without running it
+    Build {
+        /// Programming language (detected from the script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Path to script file
+        #[arg(long)]
+        script: PathBuf,
+
+        /// Where to write the binary, or a template such as `{name}-{goos}-{goarch}{ext}` (defaults to the script name in the current directory)
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+
+        /// Write the binaries into this directory, creating it if needed
+        #[arg(long, value_name = "DIR")]
+        emit_dir: Option<PathBuf>,
+
+        /// Target operating systems for Go builds (GOOS), comma-separated or repeated
+        #[arg(long, value_delimiter = ',')]
+        goos: Vec<String>,
+
+        /// Target architectures for Go builds (GOARCH), comma-separated or repeated
+        #[arg(long, value_delimiter = ',')]
+        goarch: Vec<String>,
+
+        /// Target triples for Rust builds, runtime identifiers for .NET builds, or `wasi` for a WebAssembly module (comma-separated or repeated)
+        #[arg(long, value_delimiter = ',')]
+        target: Vec<String>,
+
+        /// Build timeout in seconds
+        #[arg(long, default_value = "300")]
+        timeout: u64,
+
+        /// Memory limit in MB
+        #[arg(long, default_value = "1024")]
+        memory: u64,
+
+        /// Rebuild instead of reusing a cached artifact
+        #[arg(long)]
+        no_cache: bool,
+
+        /// Fail instead of resolving dependencies when the lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+
+        /// Rebuild when a source changes at all, even if only in comments or run-time directives
+        #[arg(long)]
+        strict_hash: bool,
+
+        /// Build profile (debug, release or one from the config); overrides the script's profile directive
+        #[arg(long)]
+        profile: Option<String>,
+
+        /// Pass a flag to the compiler as it is, after the profile's flags (repeatable)
+        #[arg(long = "build-arg", value_name = "FLAG", allow_hyphen_values = true)]
+        build_args: Vec<String>,
+
+        /// Build with deterministic paths and timestamps, and fail unless a second build is byte-identical
+        #[arg(long)]
+        reproducible: bool,
+
+        /// Write an SBOM of the binary here, and SLSA provenance next to it as <name>.intoto.json
+        #[arg(long, value_name = "PATH")]
+        sbom: Option<PathBuf>,
+
+        /// SBOM format
+        #[arg(long, value_enum, default_value = "spdx", requires = "sbom")]
+        sbom_format: SbomFormat,
+
+        /// Fill `{{.KEY}}` placeholders in the source with VALUE before it is built (repeatable)
+        #[arg(long = "set", value_name = "KEY=VALUE")]
+        set: Vec<String>,
+
+        /// Read placeholder values from a TOML or JSON file; --set wins (repeatable)
+        #[arg(long = "values", value_name = "FILE")]
+        values: Vec<PathBuf>,
+
+        /// Fail when a placeholder has no value instead of leaving it in the source
+        #[arg(long)]
+        strict_values: bool,
+    },
+
+    /// Package a compiled script's artifact, lockfile and build metadata into a .slp archive that runs offline
+    Export {
+        /// Path to script file
+        script: PathBuf,
+
+        /// Where to write the archive (defaults to <script name>.slp in the current directory)
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+
+        /// Programming language (detected from the script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// WebAssembly target (`wasi`); other targets do not run in the runner image
+        #[arg(long)]
+        target: Option<String>,
+
+        /// Build timeout in seconds
+        #[arg(long, default_value = "300")]
+        timeout: u64,
+
+        /// Memory limit in MB
+        #[arg(long, default_value = "1024")]
+        memory: u64,
+
+        /// Fail instead of resolving dependencies when the lockfile is missing or stale
+        #[arg(long)]
+        frozen: bool,
+
+        /// Build profile (debug, release or one from the config); overrides the script's profile directive
+        #[arg(long)]
+        profile: Option<String>,
+    },
+
+    /// Verify a .slp archive written by `export` and keep it for `run <name>`
+    Import {
+        /// Archive written by `export`
+        archive: PathBuf,
+
+        /// Replace an import of the same name from another build
+        #[arg(long)]
+        force: bool,
+    },
+
+    /// Write a detached ed25519 signature (<script>.sig) for sharing a script
+    Sign {
+        /// Script to sign
+        script: PathBuf,
+
+        /// ed25519 private key in PKCS#8 PEM form
+        #[arg(long, value_name = "PATH")]
+        key: PathBuf,
+    },
+
+    /// Manage the build artifact cache
+    Cache {
+        #[command(subcommand)]
+        action: CacheCommands,
+    },
+
+    /// Inspect the pinned toolchains installed in the toolchains directory
+    Toolchain {
+        #[command(subcommand)]
+        action: ToolchainCommands,
+    },
+
+    /// Run compiled scripts as services of systemd, launchd or the Windows Task Scheduler
+    Service {
+        #[command(subcommand)]
+        action: ServiceCommands,
+    },
+
+    /// Manage the persistent state directories of scripts
+    State {
+        #[command(subcommand)]
+        action: StateCommands,
+    },
+
+    /// Inspect the bundles saved when scripts crashed
+    Postmortem {
+        #[command(subcommand)]
+        action: PostmortemCommands,
+    },
+
+    /// List past runs, newest last
+    History {
+        /// Show only the most recent runs; 0 shows all of them
+        #[arg(long, default_value = "20")]
+        limit: usize,
+
+        /// Empty the history
+        #[arg(long)]
+        clear: bool,
+    },
+
+    /// Manage the checksums of remote and shared scripts trusted on first use
+    Known {
+        #[command(subcommand)]
+        action: KnownCommands,
+    },
+
+    /// Repeat a run from the history with the same command line and directory
+    Rerun {
+        /// Id shown by `singleload history`
+        id: u64,
+
+        /// Run even if the script changed since, or without pinning a remote script to its old checksum
+        #[arg(long)]
+        force: bool,
+    },
+
+    /// Read and change the configuration files
+    Config {
+        #[command(subcommand)]
+        action: ConfigCommands,
+    },
+
+    /// List the singleload-<name> plugins found on PATH
+    Plugins,
+
+    /// Show the organization policy in effect and where it comes from
+    Policy,
+
+    /// Check Podman, toolchains, PATH, directories, kernel features and proxies, with fixes for what is wrong
+    Doctor,
+
+    /// Replace this binary with the latest signed release
+    #[command(name = "self-update", args_conflicts_with_subcommands = true)]
+    SelfUpdate {
+        #[command(subcommand)]
+        action: Option<SelfUpdateCommands>,
+
+        /// Release channel to follow
+        #[arg(long, value_enum, default_value_t = Channel::Stable)]
+        channel: Channel,
+
+        /// Only report whether an update is available
+        #[arg(long)]
+        check: bool,
+
+        /// Install the channel's release even if it is not newer
+        #[arg(long)]
+        force: bool,
+    },
+
+    /// Print the shell completion script, e.g. `source <(singleload completion bash)`
+    Completion {
+        #[arg(value_enum)]
+        shell: Shell,
+    },
+
+    /// Suggestions for the completion scripts: the words after `singleload`
+    /// up to the cursor, one suggestion per line
+    #[command(name = "__complete", hide = true)]
+    Complete {
+        #[arg(trailing_var_arg = true, allow_hyphen_values = true)]
+        words: Vec<String>,
+    },
+
+    /// Relays a confined container's loopback port to its egress proxy;
+    /// started by singleload in the container's network namespace
+    #[command(name = "__egress-relay", hide = true)]
+    EgressRelay {
+        socket: PathBuf,
+        port: u16,
+    },
+
+    /// Any other command runs the singleload-<name> plugin on PATH
+    #[command(external_subcommand)]
+    External(Vec<OsString>),
+}
+
+#[derive(Subcommand)]
+enum ToolchainCommands {
+    /// List installed toolchains
+    Ls,
+
+    /// Check installed toolchains against the checksums recorded when they were installed
+    Verify {
+        /// Only check this language's toolchains
+        language: Option<String>,
+
+        /// Only check this version
+        version: Option<String>,
+    },
+}
+
+#[derive(Subcommand)]
+enum CacheCommands {
+    /// List cached build artifacts
+    Ls,
+
+    /// Remove incomplete entries and entries not used recently
+    Gc {
+        /// Remove entries unused for more than this many days
+        #[arg(long, default_value = "7")]
+        max_age_days: i64,
+    },
+
+    /// Remove all cached build artifacts
+    Clear,
+
+    /// Show cache usage and hit rates per language
+    Stats {
+        /// Start counting hits and misses from zero
+        #[arg(long)]
+        reset: bool,
+    },
+
+    /// List the environment snapshots of locked Python and JavaScript scripts
+    Snapshots {
+        /// Remove every snapshot
+        #[arg(long)]
+        clear: bool,
+    },
+}
+
+#[derive(Subcommand)]
+enum ServiceCommands {
+    /// Build a script and install it as a service that starts with the session (or system)
+    Add {
+        /// Path to script file, or a directory project
+        script: PathBuf,
+
+        /// Service name (defaults to the script name without extension)
+        #[arg(long = "name")]
+        name: Option<String>,
+
+        /// Programming language (detected from the script when omitted)
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// When the service is restarted after its process exits
+        #[arg(long, value_enum, default_value = "on-failure")]
+        restart: Restart,
+
+        /// Working directory of the service (defaults to the script's directory)
+        #[arg(long, value_name = "DIR")]
+        workdir: Option<PathBuf>,
+
+        /// Load environment variables from a dotenv file (repeatable)
+        #[arg(long, value_name = "PATH")]
+        env_file: Vec<PathBuf>,
+
+        /// Set an environment variable; a bare KEY passes the host's value (repeatable)
+        #[arg(short, long, value_name = "KEY=VALUE")]
+        env: Vec<String>,
+
+        /// Install a system-wide service instead of one for the current user
+        #[arg(long)]
+        system: bool,
+
+        /// Register the service without starting it
+        #[arg(long)]
+        no_start: bool,
+
+        /// Replace an installed service of the same name
+        #[arg(long)]
+        force: bool,
+
+        /// Print the unit and the commands that would run, without building or installing
+        #[arg(long)]
+        dry_run: bool,
+
+        /// Arguments passed to the binary
+        #[arg(last = true)]
+        args: Vec<String>,
+    },
+
+    /// Stop a service and remove its unit and binary
+    Remove {
+        name: String,
+    },
+
+    /// List installed services
+    Ls,
+}
+
+#[derive(Subcommand)]
+enum StateCommands {
+    /// Print the host directory holding a script's state
+    Path {
+        script: PathBuf,
+    },
+
+    /// List state directories
+    Ls,
+
+    /// Delete a script's state
+    Clear {
+        script: PathBuf,
+    },
+}
+
+#[derive(Subcommand)]
+enum PostmortemCommands {
+    /// List postmortems, oldest first
+    Ls {
+        /// Only those of this script
+        script: Option<PathBuf>,
+    },
+
+    /// Print a postmortem's stack and native backtrace
+    Show {
+        /// Postmortem id, or a unique prefix of one
+        id: String,
+    },
+}
+
+#[derive(Subcommand)]
+enum KnownCommands {
+    /// List trusted scripts and their checksums
+    Ls,
+
+    /// Forget a script, so its next run trusts its content again
+    Forget {
+        /// Script path or URL
+        script: String,
+    },
+}
+
+#[derive(Subcommand)]
+enum SelfUpdateCommands {
+    /// Swap back the binary the last update replaced
+    Rollback,
+}
+
+#[derive(Subcommand)]
+enum ConfigCommands {
+    /// Print the effective value of a key (e.g. proxy.https), or the whole configuration
+    Get {
+        key: Option<String>,
+    },
+
+    /// Set a key in the user config file, or the project's with --project
+    Set {
+        key: String,
+
+        /// TOML value (60, true, ["go", "python"]); anything else is taken as a string
+        value: String,
+
+        /// Write the nearest .singleload.toml (created in the current directory if there is none)
+        #[arg(long)]
+        project: bool,
+    },
+
+    /// Print the config files that are read, in the order they apply
+    Path,
+}
+
+#[tokio::main]
+async fn main() -> Result<()> {
+    let argv = expand_shebang_args(std::env::args_os().collect());
+    let mut cli = Cli::parse_from(&argv);
+    if cli.json {
+        cli.format = "json".to_string();
+    }
+
+    // Initialize tracing
+    let filter = if cli.debug {
+        EnvFilter::new("singleload=debug,podman_api=debug")
+    } else {
+        EnvFilter::new("singleload=info")
+    };
+
+    let fmt_layer = fmt::layer()
+        .with_target(false)
+        .with_thread_ids(false)
+        .with_file(false)
+        .with_line_number(false);
+
+    if cli.json {
+        // Keep stdout for the result document
+        tracing_subscriber::registry()
+            .with(filter)
+            .with(fmt_layer.json().with_writer(std::io::stderr))
+            .init();
+    } else if cli.format == "json" {
+        tracing_subscriber::registry()
+            .with(filter)
+            .with(fmt_layer.json())
+            .init();
+    } else if cli.format == "lsp" {
+        // Editors read the diagnostics from stdout
+        tracing_subscriber::registry()
+            .with(filter)
+            .with(fmt_layer.with_writer(std::io::stderr))
+            .init();
+    } else {
+        tracing_subscriber::registry()
+            .with(filter)
+            .with(fmt_layer)
+            .init();
+    }
+
+    // Config commands must work even when the current configuration does not load
+    if let Commands::Config { action } = &cli.command {
+        return run_config_command(action, &cli.format);
+    }
+
+    // Completions run on every Tab press, so they skip the policy and do
+    // not fail on a broken configuration
+    if let Commands::Completion { shell } = &cli.command {
+        print!("{}", completion::script(*shell));
+        return Ok(());
+    }
+    // The relay runs in a container's namespaces and needs nothing else
+    #[cfg(unix)]
+    if let Commands::EgressRelay { socket, port } = &cli.command {
+        egress::relay(socket, *port).await?;
+        return Ok(());
+    }
+    if let Commands::Complete { words } = &cli.command {
+        let config = Config::load().unwrap_or_default();
+        let sources = completion::Sources {
+            registry: &plugins::registry(&config),
+            tools: &ToolStore::new(config.bin_dir.clone()),
+            plugins: true,
+        };
+        for candidate in completion::complete(&Cli::command(), words, &sources) {
+            println!("{}", candidate.line());
+        }
+        return Ok(());
+    }
+
+    // Plugins read the configuration themselves, if at all
+    if let Commands::External(args) = &cli.command {
+        let name = args[0].to_string_lossy();
+        let plugin = plugins::find(&name).ok_or_else(|| {
+            anyhow::anyhow!(
+                "unrecognized command '{}'; no {}{} plugin on PATH (see 'singleload --help')",
+                name,
+                plugins::PLUGIN_PREFIX,
+                name
+            )
+        })?;
+        let exit_code = plugin.exec(&args[1..], &cli.format)?;
+        if exit_code != 0 {
+            std::process::exit(exit_code);
+        }
+        return Ok(());
+    }
+
+    // Load configuration
+    let mut config = Config::load()?;
+    if cli.ignore_project {
+        config.project_pins = false;
+    }
+    let downloads = DownloadManager::new(&config.download, &config.proxy)?;
+    config.policy = Policy::load(&downloads).await?;
+
+    match cli.command {
+        Commands::Install {
+            script: Some(script),
+            name,
+            lang,
+            wrap,
+            containerfile: _,
+            force,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            let name = name.unwrap_or_else(|| {
+                script
+                    .file_stem()
+                    .map(|s| s.to_string_lossy().to_string())
+                    .unwrap_or_default()
+            });
+            let tools = ToolStore::new(config.bin_dir.clone());
+            tools.check_free(&name, force)?;
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let executor = Executor::new(
+                container_manager,
+                Duration::from_secs(300),
+                config.default_memory_mb * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_events(events(cli.json));
+
+            let tool = executor
+                .install_script(lang.as_deref(), &script, &tools, &name, wrap)
+                .await?;
+
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&tool)?);
+            } else {
+                println!("✓ Installed {} ({})", tools.entry_path(&tool).display(), tool.language);
+                if !tools.on_path() {
+                    println!("  Add {} to your PATH to run it as '{}'", tools.bin_dir().display(), tool.name);
+                }
+            }
+        }
+
+        Commands::New {
+            path,
+            lang,
+            template,
+            list,
+            force,
+        } => {
+            let templates = Templates::new(config.templates_dir.clone());
+            if list {
+                let available = templates.list()?;
+                if cli.format == "json" {
+                    println!("{}", serde_json::to_string_pretty(&available)?);
+                } else {
+                    for t in available {
+                        let source = t.path.map_or("built-in".to_string(), |p| p.display().to_string());
+                        println!("{:<12} {:<16} {}", t.language, t.name, source);
+                    }
+                }
+                return Ok(());
+            }
+
+            let mut path = path.expect("required unless --list");
+            let registry = plugins::registry(&config);
+            let lang = match lang {
+                Some(lang) => lang,
+                None => match registry.detect(&path, b"") {
+                    Some(runner) => runner.name().to_string(),
+                    None => prompt_language(&registry)?,
+                },
+            };
+            let runner = registry.get(&lang).ok_or_else(|| {
+                anyhow::anyhow!("Unsupported language {} (available: {})", lang, registry.names().join(", "))
+            })?;
+            if path.extension().is_none() {
+                path.set_extension(runner.file_extension().trim_start_matches('.'));
+            }
+
+            let name = path
+                .file_stem()
+                .map(|s| s.to_string_lossy().to_string())
+                .unwrap_or_else(|| "app".to_string());
+            let content = scaffold::render(&templates.get(runner.name(), &template)?, &name);
+            scaffold::write(&path, &content, force)?;
+
+            if cli.format == "json" {
+                println!(
+                    "{}",
+                    serde_json::json!({
+                        "status": "success",
+                        "path": path,
+                        "language": runner.name(),
+                        "template": template
+                    })
+                );
+            } else {
+                println!("✓ Created {} ({} {})", path.display(), runner.name(), template);
+                println!("  Run it with ./{}", path.display());
+            }
+        }
+
+        Commands::Uninstall { name } => {
+            let tools = ToolStore::new(config.bin_dir.clone());
+            if !tools.remove(&name)? {
+                anyhow::bail!("No command named '{}' is installed", name);
+            }
+
+            if cli.format == "json" {
+                println!("{}", serde_json::json!({ "status": "success", "removed": name }));
+            } else {
+                println!("✓ Removed {} from {}", name, tools.bin_dir().display());
+            }
+        }
+
+        Commands::List => {
+            let tools = ToolStore::new(config.bin_dir.clone());
+            let installed = tools.list()?;
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&installed)?);
+            } else if installed.is_empty() {
+                println!("No commands installed ({})", tools.bin_dir().display());
+            } else {
+                for tool in installed {
+                    let kind = match tool.kind {
+                        ToolKind::Binary => "binary",
+                        ToolKind::Launcher => "launcher",
+                    };
+                    println!("{:<20} {:<10} {:<8}  {}", tool.name, tool.language, kind, tool.script.display());
+                }
+            }
+        }
+
+        Commands::Install { script: None, containerfile, force, .. } => {
+            info!("Installing Singleload base image...");
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            
+            let containerfile_path = containerfile.unwrap_or_else(|| {
+                // Use bundled Containerfile
+                PathBuf::from("Containerfile")
+            });
+
+            container_manager.install_base_image(containerfile_path, force).await?;
+            
+            if cli.format == "json" {
+                println!(
+                    "{}",
+                    serde_json::json!({
+                        "status": "success",
+                        "message": "Base image installed successfully",
+                        "image": config.base_image_name
+                    })
+                );
+            } else {
+                println!("✓ Base image installed successfully");
+            }
+        }
+
+        Commands::Run {
+            lang,
+            script,
+            source,
+            args,
+            timeout,
+            memory,
+            cpu,
+            debug,
+            max_output,
+            no_cache,
+            watch,
+            no_daemon,
+            priority,
+            supersede,
+            sandbox,
+            target,
+            frozen,
+            strict_hash,
+            trust,
+            sha256,
+            strict_tofu,
+            env_file,
+            env,
+            no_state,
+            verify_with,
+            profile,
+            build_args,
+            mut run_args,
+            audit,
+            log_dir,
+            log_max_size,
+            log_keep,
+            kill_timeout,
+            cell,
+            cells,
+            on,
+            non_interactive,
+            isolate_cwd,
+            copy,
+            keep,
+            stats,
+            trace_files,
+            profile_cpu,
+            profile_heap,
+            containerized,
+            interp,
+            nix,
+            retries,
+            retry_backoff,
+            retry_on,
+            set,
+            values,
+            strict_values,
+        } => {
+            let verifying_key = verify_with.as_deref().map(signing::load_verifying_key).transpose()?;
+            let profiling = match (profile_cpu, profile_heap) {
+                (Some(output), _) => Some(Profiling { kind: ProfileKind::Cpu, output }),
+                (None, Some(output)) => Some(Profiling { kind: ProfileKind::Heap, output }),
+                (None, None) => None,
+            };
+            // With --script, every positional argument is the script's
+            let script = match script {
+                Some(script) => {
+                    run_args.extend(source.map(|arg| arg.to_string_lossy().to_string()));
+                    script
+                }
+                None => source.unwrap_or_else(|| PathBuf::from(".")),
+            };
+            run_args.extend(args);
+            let started_at = chrono::Utc::now();
+            let from_stdin = script == Path::new(STDIN_PATH);
+            let given = script.to_string_lossy().to_string();
+            // `tool.go:backup` runs the entry `backup` of tool.go
+            let (script, entry) = match entries::split_target(&script) {
+                Some((script, entry)) => (script, Some(entry)),
+                None => (script, None),
+            };
+
+            // Remote scripts are downloaded and verified, then run from the local copy
+            let remote = script.to_str().map_or(false, remote::is_remote);
+            let pinned = sha256.is_some() || verifying_key.is_some();
+            let script = if from_stdin {
+                if watch {
+                    anyhow::bail!("--watch is not supported for programs read from stdin");
+                }
+                if verifying_key.is_some() {
+                    anyhow::bail!("--verify-with needs a signed file, not a program read from stdin");
+                }
+                read_stdin_program(&config, lang.as_deref())?
+            } else if remote {
+                if watch {
+                    anyhow::bail!("--watch is not supported for remote scripts");
+                }
+                // A signature from a trusted key vouches for whatever the URL serves
+                let verification = Verification {
+                    trust: trust || verifying_key.is_some(),
+                    sha256,
+                };
+                let sources = RemoteSources::new(&config.cache_dir, downloads.clone());
+                let url = script.to_string_lossy();
+                let local = sources.fetch(&url, &verification).await?;
+                if verifying_key.is_some() || config.policy.require_signatures {
+                    sources.fetch_signature(&url).await?;
+                }
+                local
+            } else {
+                if trust || sha256.is_some() {
+                    anyhow::bail!("--trust and --sha256 only apply to remote scripts");
+                }
+                // Directories without a manifest are not projects; one of their scripts is run
+                if script.is_dir() && !script.join(MANIFEST_FILE).exists() {
+                    pick_script(&config, &script, !non_interactive && !cli.json)?
+                } else {
+                    script
+                }
+            };
+
+            // Scripts others could change are trusted on first use, like SSH
+            // host keys; pinned and signed ones are verified already. The
+            // check is made on the files the run stages.
+            let known = if !from_stdin && !pinned && (remote || tofu::is_shared(&script)) {
+                Some(KnownCheck {
+                    store: KnownScripts::new(config.known_scripts_file.clone()),
+                    key: match remote {
+                        true => given.clone(),
+                        false => script.canonicalize()?.to_string_lossy().to_string(),
+                    },
+                    strict: strict_tofu || config.strict_tofu,
+                    interactive: !non_interactive
+                        && !cli.json
+                        && std::io::stdin().is_terminal()
+                        && std::io::stderr().is_terminal(),
+                })
+            } else {
+                None
+            };
+
+            // Exported programs run from their archive, or by name once imported
+            let imported = if from_stdin || remote {
+                None
+            } else if export::is_archive(&script) && script.is_file() {
+                let (dir, program) = export::open(&script)?;
+                // Archives run as unpacked, without being staged
+                if let Some(known) = &known {
+                    known.confirm(&content_hash(dir.path())?)?;
+                }
+                Some((program, Some(dir)))
+            } else if !script.exists() {
+                let store = ImportStore::new(config.imports_dir.clone());
+                store.get(&script.to_string_lossy())?.map(|program| (program, None))
+            } else {
+                None
+            };
+
+            // Flags left out fall back to the configured defaults
+            let timeout = timeout.unwrap_or(config.default_timeout_secs);
+            let memory = memory.unwrap_or(config.default_memory_mb);
+            let cpu = cpu.unwrap_or(config.default_cpu_limit);
+            let max_output = max_output.unwrap_or(config.default_output_limit_kb);
+            let sandbox = sandbox.unwrap_or_else(|| config.default_sandbox.clone());
+
+            // Validate inputs
+            if imported.is_none() && !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            if imported.is_some()
+                && (watch
+                    || on.is_some()
+                    || cells.is_some()
+                    || lang.is_some()
+                    || stats
+                    || trace_files.is_some()
+                    || profiling.is_some()
+                    || containerized
+                    || nix
+                    || entry.is_some())
+            {
+                anyhow::bail!(
+                    "--watch, --on, --cell, --lang, --stats, --trace-files, --profile-cpu, --profile-heap, --containerized, --nix and entries do not apply to exported programs"
+                );
+            }
+
+            if entry.is_some() && (cells.is_some() || cell.is_some()) {
+                anyhow::bail!("--cell cannot be combined with a script entry");
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            if cpu < 0.1 || cpu > 4.0 {
+                anyhow::bail!("CPU must be between 0.1 and 4.0");
+            }
+
+            if max_output == 0 || max_output > 10240 {
+                anyhow::bail!("Max output must be between 1 and 10240 KB");
+            }
+
+            if log_keep == 0 {
+                anyhow::bail!("--log-keep must be at least 1");
+            }
+
+            if kill_timeout.is_some_and(|t| t > 3600) {
+                anyhow::bail!("Kill timeout must be at most 3600 seconds");
+            }
+
+            if cell == Some(0) {
+                anyhow::bail!("Cells are numbered from 1");
+            }
+            let cells = cells.or(cell.map(CellSelection::single));
+            let on = on.as_deref().map(SshTarget::parse).transpose()?;
+
+            let sandbox = SandboxProfile::resolve(&sandbox, &config.sandbox_profiles)?;
+
+            // Cross-compiled binaries cannot run in the container, WASI modules can
+            if target.as_deref().map_or(false, |t| t != WASI_TARGET) {
+                anyhow::bail!("Run only supports --target {}", WASI_TARGET);
+            }
+            let target = BuildTarget::from_flags(None, None, target);
+            let env = env::collect(&env_file, &env)?;
+            let template = template(&values, &set, strict_values)?;
+
+            // Execute script
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            let mut executor = Executor::new(
+                container_manager.clone(),
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024, // Convert MB to bytes
+                cpu,
+                max_output * 1024,    // Convert KB to bytes
+            )
+            .with_sandbox(sandbox.clone())
+            .with_target(target.clone())
+            .with_env(env.clone());
+            if no_cache {
+                executor = executor.without_cache();
+            }
+            if frozen {
+                executor = executor.frozen();
+            }
+            if strict_hash {
+                executor = executor.strict_hash();
+            }
+            if no_state {
+                executor = executor.without_state();
+            }
+            if containerized {
+                executor = executor.containerized();
+            }
+            if interp {
+                executor = executor.interpreted();
+            }
+            if nix {
+                executor = executor.nix();
+            }
+            executor = executor
+                .with_verifying_key(verifying_key.clone())
+                .with_profile(profile.clone())
+                .with_build_args(build_args.clone())
+                .with_run_args(run_args.clone())
+                .with_audit(audit)
+                .with_cells(cells)
+                .with_entry(entry)
+                .with_template(template)
+                .with_trace_file(trace_files)
+                .with_profiling(profiling)
+                .with_known_check(known);
+
+            // Text output is copied to the terminal as it arrives, JSON
+            // output stays a single document
+            let logged = log_dir.is_some();
+            let streamed = logged && cli.format != "json";
+            let logs = log_dir.map(|dir| LogCapture {
+                dir,
+                policy: RotationPolicy {
+                    max_bytes: log_max_size * 1024 * 1024,
+                    keep: log_keep,
+                },
+                echo: streamed,
+            });
+            executor = executor.with_logs(logs);
+
+            let work_dir = if isolate_cwd { Some(WorkDir::create(&copy)?) } else { None };
+            executor = executor.with_work_dir(work_dir.as_ref().map(|dir| dir.path().to_path_buf()));
+
+            // Hand the run to a daemon if one is listening; events are only
+            // reported for local runs, and only they forward signals
+            if !watch
+                && !no_daemon
+                && !cli.json
+                && on.is_none()
+                && imported.is_none()
+                && !stats
+                && kill_timeout.is_none()
+                && retries.is_none()
+                && executor.daemon_compatible()
+            {
+                let request = RunRequest {
+                    lang: lang.clone(),
+                    script: script.canonicalize()?,
+                    timeout_secs: timeout,
+                    memory_mb: memory,
+                    cpu,
+                    max_output_kb: max_output,
+                    keep_container: debug,
+                    no_cache,
+                    sandbox: sandbox.clone(),
+                    target: target.clone(),
+                    frozen,
+                    env: env.clone(),
+                    no_state,
+                    verify_key: verifying_key.as_ref().map(|k| hex::encode(k.to_bytes())),
+                    profile: profile.clone(),
+                    build_args: build_args.clone(),
+                    run_args: run_args.clone(),
+                    audit,
+                    priority,
+                    supersede,
+                };
+                if let Some(result) = daemon::try_proxy(&config.daemon_socket, &request).await {
+                    let exit_code = print_run_result(result, &cli.format)?;
+                    let recorded = if remote { given } else { script.display().to_string() };
+                    record_run(&config, &argv, recorded, &script, from_stdin, started_at, exit_code);
+                    if exit_code != 0 {
+                        std::process::exit(exit_code);
+                    }
+                    return Ok(());
+                }
+            }
+
+            // Check if base image exists; containerized runs pull their own
+            if !containerized && !container_manager.base_image_exists().await? {
+                if cli.format == "json" {
+                    println!(
+                        "{}",
+                        serde_json::json!({
+                            "status": "error",
+                            "error": "Base image not found. Please run 'singleload install' first."
+                        })
+                    );
+                } else {
+                    eprintln!("Error: Base image not found. Please run 'singleload install' first.");
+                }
+                std::process::exit(1);
+            }
+
+            // The progress display holds the terminal while the script runs,
+            // so it stays off when output is streamed or the run is elsewhere
+            let progress = (!watch && on.is_none() && !logged && progress::enabled(&cli.format, cli.plain))
+                .then(Progress::start);
+            let sink = progress.as_ref().map_or_else(|| events(cli.json), Progress::sink);
+            executor = executor.with_events(sink.clone());
+
+            if watch {
+                watch_script(&executor, lang.as_deref(), &script, debug, &cli.format).await?;
+                finish_work_dir(work_dir, keep);
+                return Ok(());
+            }
+
+            if let Some(host) = on {
+                let exit_code = executor.run_on_host(lang.as_deref(), &script, &host).await?;
+                let recorded = if remote { given } else { script.display().to_string() };
+                record_run(&config, &argv, recorded, &script, from_stdin, started_at, exit_code);
+                if exit_code != 0 {
+                    std::process::exit(exit_code);
+                }
+                return Ok(());
+            }
+
+            // Ctrl-C and SIGTERM go to the script's container from here on
+            let kill_timeout = kill_timeout.map_or(DEFAULT_KILL_TIMEOUT, Duration::from_secs);
+            match SignalProxy::install(kill_timeout) {
+                Ok(proxy) => executor = executor.with_signals(Some(proxy)),
+                Err(e) => tracing::warn!("Signals will not be forwarded to the script: {}", e),
+            }
+
+            let retry = retries.map(|n| RetryPolicy::new(n, retry_backoff.unwrap_or(Duration::from_secs(1)), retry_on));
+            let mut attempt = 1;
+            let (mut result, measurement) = loop {
+                let mut measurement = None;
+                let result = match &imported {
+                    Some((program, _)) => executor.run_imported(program, debug).await,
+                    None if stats => executor
+                        .run_script_measured(lang.as_deref(), &script, debug)
+                        .await
+                        .map(|(result, measured)| {
+                            measurement = Some(measured);
+                            result
+                        }),
+                    None => executor.run_script(lang.as_deref(), &script, debug).await,
+                };
+                // Only runs that got as far as the script are retried, not
+                // scripts that could not be prepared
+                let condition = match (&retry, &result) {
+                    (Some(policy), Ok(result)) => policy.retry(attempt, result).map(|c| (policy, c, result.exit_code)),
+                    _ => None,
+                };
+                let Some((policy, condition, exit_code)) = condition else {
+                    break (result, measurement);
+                };
+                let delay = policy.delay(attempt);
+                tracing::warn!(
+                    "Attempt {} of {} failed ({}, exit code {}); retrying in {:?}",
+                    attempt,
+                    policy.retries + 1,
+                    condition,
+                    exit_code,
+                    delay
+                );
+                sink.emit(Event::Retry {
+                    attempt,
+                    retries: policy.retries,
+                    exit_code: exit_code as i32,
+                    condition: condition.to_string(),
+                    delay_ms: delay.as_millis() as u64,
+                });
+                tokio::time::sleep(delay).await;
+                attempt += 1;
+            };
+            if streamed {
+                // Already on the terminal
+                result = result.map(|r| ExecutionResult { stdout: String::new(), stderr: String::new(), ..r });
+            }
+            if let Some(outcome) = progress.map(Progress::finish).filter(|o| o.build_failed) {
+                result = result.map(|r| ExecutionResult {
+                    stderr: progress::collapse(&r.stderr, &outcome.diagnostics),
+                    ..r
+                });
+            }
+
+            // Output result
+            let exit_code = match (result, &measurement) {
+                (Ok(result), Some(measurement)) => print_measured_result(&result, measurement, &cli.format)?,
+                (result, _) => print_run_result(result, &cli.format)?,
+            };
+            finish_work_dir(work_dir, keep);
+            let recorded = if remote { given } else { script.display().to_string() };
+            record_run(&config, &argv, recorded, &script, from_stdin, started_at, exit_code);
+            if exit_code != 0 {
+                signals::terminate(exit_code);
+            }
+        }
+
+        Commands::Build {
+            lang,
+            script,
+            output,
+            emit_dir,
+            goos,
+            goarch,
+            target,
+            timeout,
+            memory,
+            no_cache,
+            frozen,
+            strict_hash,
+            profile,
+            build_args,
+            reproducible,
+            sbom,
+            sbom_format,
+            set,
+            values,
+            strict_values,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            let targets = artifacts::targets(&goos, &goarch, &target);
+            let template = template(&values, &set, strict_values)?;
+
+            // Every target gets its own file: a template names each one,
+            // and the default names include the target
+            if targets.len() > 1 {
+                if output.as_deref().is_some_and(|o| !artifacts::is_template(o)) {
+                    anyhow::bail!("Building for {} targets needs an --output template such as {{name}}-{{goos}}-{{goarch}}{{ext}}", targets.len());
+                }
+                if sbom.is_some() {
+                    anyhow::bail!("--sbom needs a single target");
+                }
+            }
+            let mut outputs = Vec::new();
+            for build_target in &targets {
+                let name = match &output {
+                    Some(output) if artifacts::is_template(output) => {
+                        artifacts::expand(&output.to_string_lossy(), &script, build_target.as_ref())?
+                    }
+                    Some(output) => output.clone(),
+                    None => default_build_output(&script, build_target.as_ref()),
+                };
+                let path = match &emit_dir {
+                    Some(dir) => dir.join(name),
+                    None => name,
+                };
+                if outputs.contains(&path) {
+                    anyhow::bail!("Several targets would be written to {}", path.display());
+                }
+                if let Some(parent) = path.parent().filter(|p| !p.as_os_str().is_empty()) {
+                    std::fs::create_dir_all(parent)?;
+                }
+                outputs.push(path);
+            }
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut progress = progress::enabled(&cli.format, cli.plain).then(Progress::start);
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_events(progress.as_ref().map_or_else(|| events(cli.json), Progress::sink))
+            .with_profile(profile)
+            .with_build_args(build_args)
+            .with_template(template);
+            if no_cache {
+                executor = executor.without_cache();
+            }
+            if frozen {
+                executor = executor.frozen();
+            }
+            if strict_hash {
+                executor = executor.strict_hash();
+            }
+            if reproducible {
+                executor = executor.reproducible();
+            }
+
+            let mut results = Vec::new();
+            for (build_target, output) in targets.iter().zip(&outputs) {
+                let result = executor
+                    .build_script(lang.as_deref(), &script, build_target.as_ref(), output)
+                    .await;
+                results.push(match result {
+                    Err(e) => match progress.take().map(Progress::finish) {
+                        Some(outcome) if outcome.build_failed => {
+                            anyhow::bail!("Build failed\n{}", progress::collapse(&e.to_string(), &outcome.diagnostics))
+                        }
+                        _ => return Err(e),
+                    },
+                    Ok(result) => result,
+                });
+            }
+            if let Some(progress) = progress {
+                progress.finish();
+            }
+            let provenance = match (&sbom, results.first()) {
+                (Some(path), Some(result)) => Some(sbom::write(&result.provenance, sbom_format, path)?),
+                _ => None,
+            };
+
+            if cli.format == "json" {
+                let mut reports = Vec::new();
+                for result in &results {
+                    let mut report = serde_json::to_value(result)?;
+                    if let (Some(sbom), Some(provenance)) = (&sbom, &provenance) {
+                        report["sbom"] = serde_json::json!(sbom);
+                        report["provenance"] = serde_json::json!(provenance);
+                    }
+                    reports.push(report);
+                }
+                // A single build keeps reporting a single object
+                let document = match reports.len() {
+                    1 => reports.remove(0),
+                    _ => serde_json::Value::Array(reports),
+                };
+                println!("{}", serde_json::to_string_pretty(&document)?);
+            } else {
+                for result in &results {
+                    println!(
+                        "✓ Built {} ({}{}{}ms)",
+                        result.artifact.display(),
+                        if result.cached { "cached, " } else { "" },
+                        if result.reproducible { "reproducible, " } else { "" },
+                        result.duration_ms
+                    );
+                }
+                if let (Some(sbom), Some(provenance)) = (&sbom, &provenance) {
+                    println!("  SBOM: {}", sbom.display());
+                    println!("  Provenance: {}", provenance.display());
+                }
+            }
+        }
+
+        Commands::Export {
+            script,
+            output,
+            lang,
+            target,
+            timeout,
+            memory,
+            frozen,
+            profile,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            // Archives run in the runner image, so only WASI modules can be cross-built
+            if target.as_deref().map_or(false, |t| t != WASI_TARGET) {
+                anyhow::bail!("Export only supports --target {}", WASI_TARGET);
+            }
+            let build_target = BuildTarget::from_flags(None, None, target);
+
+            let output = output.unwrap_or_else(|| {
+                let stem = script.file_stem().map(|s| s.to_string_lossy().to_string());
+                PathBuf::from(format!("{}.{}", stem.as_deref().unwrap_or("program"), export::EXTENSION))
+            });
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_events(events(cli.json))
+            .with_profile(profile);
+            if frozen {
+                executor = executor.frozen();
+            }
+
+            let result = executor
+                .export_script(lang.as_deref(), &script, build_target.as_ref(), &output)
+                .await?;
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&result)?);
+            } else {
+                println!(
+                    "✓ Exported {} to {} ({} files, {}{}ms)",
+                    result.name,
+                    result.archive.display(),
+                    result.files,
+                    if result.cached { "cached, " } else { "" },
+                    result.duration_ms
+                );
+            }
+        }
+
+        Commands::Import { archive, force } => {
+            if !archive.exists() {
+                anyhow::bail!("Archive not found: {}", archive.display());
+            }
+            let store = ImportStore::new(config.imports_dir.clone());
+            let program = store.import(&archive, force)?;
+            let manifest = &program.manifest;
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(manifest)?);
+            } else {
+                println!(
+                    "✓ Imported {} ({}, built {} with {})",
+                    manifest.name,
+                    manifest.language,
+                    manifest.created_at.format("%Y-%m-%d"),
+                    manifest.toolchain
+                );
+                println!("  Run it with: singleload run {}", manifest.name);
+            }
+        }
+
+        Commands::Pipe {
+            steps,
+            timeout,
+            memory,
+            max_output,
+            no_cache,
+            sandbox,
+            env_file,
+            env,
+        } => {
+            let timeout = timeout.unwrap_or(config.default_timeout_secs);
+            let memory = memory.unwrap_or(config.default_memory_mb);
+            let max_output = max_output.unwrap_or(config.default_output_limit_kb);
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            if max_output == 0 || max_output > 10240 {
+                anyhow::bail!("Max output must be between 1 and 10240 KB");
+            }
+
+            let pipeline = match steps.as_slice() {
+                [file] if Pipeline::is_file(file) => Pipeline::load(file)?,
+                _ => Pipeline::from_scripts(steps)?,
+            };
+            let sandbox = SandboxProfile::resolve(
+                sandbox.as_deref().unwrap_or(&config.default_sandbox),
+                &config.sandbox_profiles,
+            )?;
+            let env = env::collect(&env_file, &env)?;
+
+            // Piped input goes to the first step
+            let input = if std::io::stdin().is_terminal() {
+                None
+            } else {
+                let mut data = Vec::new();
+                std::io::stdin().read_to_end(&mut data)?;
+                Some(data)
+            };
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                max_output * 1024,
+            )
+            .with_events(events(cli.json))
+            .with_sandbox(sandbox)
+            .with_env(env);
+            if no_cache {
+                executor = executor.without_cache();
+            }
+            let (tap, captured) = pipeline::capture();
+            let executor = executor.with_output(Some(tap));
+
+            let (cancel_tx, cancel_rx) = tokio::sync::watch::channel(false);
+            tokio::spawn(async move {
+                if tokio::signal::ctrl_c().await.is_ok() {
+                    let _ = cancel_tx.send(true);
+                }
+            });
+
+            let text = cli.format != "json";
+            let result = pipeline::run(&executor, &pipeline, input, &captured, cancel_rx, |_, step| {
+                if text && !step.result.stderr.is_empty() {
+                    eprint!("{}", step.result.stderr);
+                }
+            })
+            .await;
+
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&result)?);
+            } else {
+                std::io::stdout().write_all(&result.stdout)?;
+                std::io::stdout().flush()?;
+                if let Some(idx) = result.failed_step {
+                    let step = &result.steps[idx];
+                    let reason = match &step.result.error {
+                        Some(error) => error.clone(),
+                        None if step.result.truncated => "output was truncated".to_string(),
+                        None => format!("exit code {}", step.result.exit_code),
+                    };
+                    eprintln!("✗ Step {} ({}) failed: {}", idx + 1, step.script.display(), reason);
+                }
+            }
+
+            if result.exit_code != 0 {
+                std::process::exit(result.exit_code as i32);
+            }
+        }
+
+        Commands::Explain {
+            script,
+            lang,
+            timeout,
+            memory,
+            cpu,
+            no_cache,
+            sandbox,
+            target,
+            frozen,
+            profile,
+            build_args,
+            run_args,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+            if target.as_deref().map_or(false, |t| t != WASI_TARGET) {
+                anyhow::bail!("Run only supports --target {}", WASI_TARGET);
+            }
+            let sandbox = sandbox.unwrap_or_else(|| config.default_sandbox.clone());
+            let sandbox = SandboxProfile::resolve(&sandbox, &config.sandbox_profiles)?;
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout.unwrap_or(config.default_timeout_secs)),
+                memory.unwrap_or(config.default_memory_mb) * 1024 * 1024,
+                cpu.unwrap_or(config.default_cpu_limit),
+                config.default_output_limit_kb * 1024,
+            )
+            .with_sandbox(sandbox)
+            .with_target(BuildTarget::from_flags(None, None, target))
+            .with_profile(profile)
+            .with_build_args(build_args)
+            .with_run_args(run_args);
+            if no_cache {
+                executor = executor.without_cache();
+            }
+            if frozen {
+                executor = executor.frozen();
+            }
+
+            let explanation = executor.explain_script(lang.as_deref(), &script).await?;
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&explanation)?);
+            } else {
+                print_explanation(&explanation);
+            }
+        }
+
+        Commands::Fetch {
+            patterns,
+            lang,
+            memory,
+            frozen,
+        } => {
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            let scripts = batch::expand_patterns(&patterns)?;
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(config.default_timeout_secs),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_events(events(cli.json));
+            if frozen {
+                executor = executor.frozen();
+            }
+
+            let mut results = Vec::new();
+            for script in &scripts {
+                let result = executor.fetch_script(lang.as_deref(), script).await?;
+                if cli.format != "json" {
+                    let toolchain = match &result.toolchain {
+                        Some(version) => format!(", {} {}", result.language, version),
+                        None => String::new(),
+                    };
+                    println!(
+                        "✓ Fetched {} ({} dependencies{})",
+                        script.display(),
+                        result.dependencies.len(),
+                        toolchain
+                    );
+                }
+                results.push(result);
+            }
+
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&results)?);
+            }
+        }
+
+        Commands::Audit {
+            script,
+            lang,
+            fail_on,
+            memory,
+            frozen,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(config.default_timeout_secs),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_events(events(cli.json));
+            if frozen {
+                executor = executor.frozen();
+            }
+
+            let report = executor.audit_script(lang.as_deref(), &script).await?;
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&report)?);
+            } else {
+                print_audit_report(&script, &report);
+            }
+            if report.at_least(fail_on).next().is_some() {
+                std::process::exit(1);
+            }
+        }
+
+        Commands::Bundle {
+            script,
+            output,
+            lang,
+            timeout,
+            memory,
+            no_cache,
+            frozen,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            let output = output.unwrap_or_else(|| default_build_output(&script, None));
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_events(events(cli.json));
+            if no_cache {
+                executor = executor.without_cache();
+            }
+            if frozen {
+                executor = executor.frozen();
+            }
+
+            let result = executor.bundle_script(lang.as_deref(), &script, &output).await?;
+
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&result)?);
+            } else {
+                println!(
+                    "✓ Bundled {} ({} dependencies, {} KB)",
+                    result.bundle.display(),
+                    result.dependencies,
+                    result.size_bytes / 1024
+                );
+            }
+        }
+
+        Commands::Package {
+            script,
+            oci: _,
+            lang,
+            tag,
+            push,
+            timeout,
+            memory,
+            no_cache,
+            frozen,
+            profile,
+            build_args,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            let tag = tag.unwrap_or_else(|| package::default_tag(&script));
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_events(events(cli.json))
+            .with_profile(profile)
+            .with_build_args(build_args);
+            if no_cache {
+                executor = executor.without_cache();
+            }
+            if frozen {
+                executor = executor.frozen();
+            }
+
+            let result = executor.package_script(lang.as_deref(), &script, &tag, push).await?;
+
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&result)?);
+            } else {
+                println!("✓ Built image {} on {} ({}ms)", result.image, result.base, result.duration_ms);
+                if result.pushed {
+                    println!("✓ Pushed {}", result.image);
+                }
+            }
+        }
+
+        Commands::Test {
+            script,
+            lang,
+            coverage,
+            timeout,
+            memory,
+            cpu,
+            max_output,
+            sandbox,
+            frozen,
+            env_file,
+            env,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            if cpu < 0.1 || cpu > 4.0 {
+                anyhow::bail!("CPU must be between 0.1 and 4.0");
+            }
+
+            if max_output == 0 || max_output > 10240 {
+                anyhow::bail!("Max output must be between 1 and 10240 KB");
+            }
+
+            let sandbox = SandboxProfile::resolve(&sandbox, &config.sandbox_profiles)?;
+            let env = env::collect(&env_file, &env)?;
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                cpu,
+                max_output * 1024,
+            )
+            .with_sandbox(sandbox)
+            .with_events(events(cli.json))
+            .with_env(env);
+            if frozen {
+                executor = executor.frozen();
+            }
+
+            let output = executor.test_script(lang.as_deref(), &script, coverage).await?;
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&output)?);
+            } else {
+                print_text_result(&output.result);
+                if let Some(path) = &output.coverage {
+                    println!("Coverage written to {}", path.display());
+                }
+            }
+
+            if output.result.exit_code != 0 {
+                std::process::exit(output.result.exit_code as i32);
+            }
+        }
+
+        Commands::Check {
+            script,
+            lang,
+            timeout,
+            memory,
+            frozen,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_events(events(cli.json));
+            if frozen {
+                executor = executor.frozen();
+            }
+
+            let mut output = executor.check_script(lang.as_deref(), &script).await?;
+            if !output.passed && output.diagnostics.is_empty() {
+                // Still point the editor at the script when the compiler's
+                // output had no location in it
+                let message = output
+                    .output
+                    .lines()
+                    .rev()
+                    .find(|line| !line.trim().is_empty())
+                    .unwrap_or("check failed")
+                    .trim()
+                    .to_string();
+                if let Some(file) = output.files.first() {
+                    output.diagnostics.push(Diagnostic {
+                        file: file.display().to_string(),
+                        line: 1,
+                        column: None,
+                        message,
+                    });
+                }
+            }
+
+            match cli.format.as_str() {
+                "json" => println!("{}", serde_json::to_string_pretty(&output)?),
+                "lsp" => {
+                    let published = lsp::publish(&output.files, &output.diagnostics, &output.language);
+                    println!("{}", serde_json::to_string_pretty(&published)?);
+                }
+                _ => {
+                    for diagnostic in &output.diagnostics {
+                        match diagnostic.column {
+                            Some(column) => println!(
+                                "{}:{}:{}: {}",
+                                diagnostic.file, diagnostic.line, column, diagnostic.message
+                            ),
+                            None => println!("{}:{}: {}", diagnostic.file, diagnostic.line, diagnostic.message),
+                        }
+                    }
+                    if output.passed {
+                        println!("✓ No problems found ({}ms)", output.duration_ms);
+                    }
+                }
+            }
+
+            if !output.passed {
+                std::process::exit(1);
+            }
+        }
+
+        Commands::Vet {
+            script,
+            lang,
+            fail_on,
+            timeout,
+            memory,
+            frozen,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_events(events(cli.json));
+            if frozen {
+                executor = executor.frozen();
+            }
+
+            let output = executor.vet_script(lang.as_deref(), &script, fail_on).await?;
+            match cli.format.as_str() {
+                "json" => println!("{}", serde_json::to_string_pretty(&output)?),
+                "lsp" => {
+                    let diagnostics: Vec<Diagnostic> = output.findings.iter().map(|f| f.diagnostic.clone()).collect();
+                    let published = lsp::publish(&output.files, &diagnostics, &output.language);
+                    println!("{}", serde_json::to_string_pretty(&published)?);
+                }
+                _ => {
+                    for finding in &output.findings {
+                        println!("{}", finding);
+                    }
+                    for tool in output.tools.iter().filter(|t| t.status == ToolStatus::Skipped) {
+                        println!("- {} is not installed in the image, skipped", tool.name);
+                    }
+                    if output.findings.is_empty() {
+                        println!("✓ No problems found ({}ms)", output.duration_ms);
+                    } else {
+                        println!("{} problem(s) found ({}ms)", output.findings.len(), output.duration_ms);
+                    }
+                }
+            }
+
+            if !output.passed {
+                std::process::exit(1);
+            }
+        }
+
+        Commands::Bench {
+            patterns,
+            lang,
+            runs,
+            warmup,
+            timeout,
+            memory,
+            cpu,
+            sandbox,
+            env_file,
+            env,
+        } => {
+            let timeout = timeout.unwrap_or(config.default_timeout_secs);
+            let memory = memory.unwrap_or(config.default_memory_mb);
+            let cpu = cpu.unwrap_or(config.default_cpu_limit);
+
+            if runs == 0 || runs > 1000 {
+                anyhow::bail!("Runs must be between 1 and 1000");
+            }
+
+            if warmup > 100 {
+                anyhow::bail!("Warmup must be at most 100 runs");
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            if cpu < 0.1 || cpu > 4.0 {
+                anyhow::bail!("CPU must be between 0.1 and 4.0");
+            }
+
+            let scripts = batch::expand_patterns(&patterns)?;
+            let sandbox = SandboxProfile::resolve(
+                sandbox.as_deref().unwrap_or(&config.default_sandbox),
+                &config.sandbox_profiles,
+            )?;
+            let env = env::collect(&env_file, &env)?;
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                cpu,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_sandbox(sandbox)
+            .with_env(env);
+
+            let progress = cli.format != "json" && std::io::stderr().is_terminal();
+            let mut summaries = Vec::new();
+            for script in &scripts {
+                let summary = bench::bench(&executor, lang.as_deref(), script, runs, warmup, |idx, _| {
+                    if progress {
+                        eprint!("\r{}: run {}/{}", script.display(), idx + 1, runs);
+                    }
+                })
+                .await?;
+                if progress {
+                    eprint!("\r\x1b[K");
+                }
+                if cli.format != "json" {
+                    print_bench_summary(&summary);
+                }
+                summaries.push(summary);
+            }
+
+            if cli.format == "json" {
+                if summaries.len() == 1 {
+                    println!("{}", serde_json::to_string_pretty(&summaries[0])?);
+                } else {
+                    println!("{}", serde_json::to_string_pretty(&summaries)?);
+                }
+            } else if summaries.len() > 1 {
+                print_bench_comparison(&summaries);
+            }
+        }
+
+        Commands::RunAll {
+            patterns,
+            lang,
+            jobs,
+            timeout,
+            memory,
+            cpu,
+            max_output,
+            no_cache,
+            sandbox,
+            env_file,
+            env,
+            output,
+        } => {
+            if jobs == 0 || jobs > config.max_concurrent_containers {
+                anyhow::bail!(
+                    "Jobs must be between 1 and {} (max_concurrent_containers)",
+                    config.max_concurrent_containers
+                );
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            if cpu < 0.1 || cpu > 4.0 {
+                anyhow::bail!("CPU must be between 0.1 and 4.0");
+            }
+
+            if max_output == 0 || max_output > 10240 {
+                anyhow::bail!("Max output must be between 1 and 10240 KB");
+            }
+
+            let scripts = batch::expand_patterns(&patterns)?;
+            let sandbox = SandboxProfile::resolve(&sandbox, &config.sandbox_profiles)?;
+            let env = env::collect(&env_file, &env)?;
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                cpu,
+                max_output * 1024,
+            )
+            .with_sandbox(sandbox)
+            .with_env(env);
+            if no_cache {
+                executor = executor.without_cache();
+            }
+
+            let multiplexer = (cli.format != "json").then(|| {
+                let color = std::io::stdout().is_terminal() && std::env::var_os("NO_COLOR").is_none();
+                Multiplexer::new(output, &scripts, color, (max_output * 1024) as usize, Box::new(std::io::stdout()))
+            });
+            executor = executor.with_output_taps(multiplexer.as_ref().map(Multiplexer::taps));
+
+            info!("Running {} scripts with {} jobs", scripts.len(), jobs);
+            let summary = batch::run_all(&executor, lang.as_deref(), scripts, jobs, |item| {
+                if let Some(multiplexer) = &multiplexer {
+                    multiplexer.finish(item);
+                }
+            })
+            .await;
+
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&summary)?);
+            } else {
+                println!(
+                    "\n{} passed, {} failed ({}ms)",
+                    summary.passed, summary.failed, summary.duration_ms
+                );
+            }
+
+            if summary.failed > 0 {
+                std::process::exit(1);
+            }
+        }
+
+        Commands::Verify {
+            patterns,
+            lang,
+            expect_exit,
+            expect_stdout_file,
+            update,
+            junit,
+            jobs,
+            timeout,
+            memory,
+            cpu,
+            max_output,
+            no_cache,
+            sandbox,
+            env_file,
+            env,
+        } => {
+            if jobs == 0 || jobs > config.max_concurrent_containers {
+                anyhow::bail!(
+                    "Jobs must be between 1 and {} (max_concurrent_containers)",
+                    config.max_concurrent_containers
+                );
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            if cpu < 0.1 || cpu > 4.0 {
+                anyhow::bail!("CPU must be between 0.1 and 4.0");
+            }
+
+            if max_output == 0 || max_output > 10240 {
+                anyhow::bail!("Max output must be between 1 and 10240 KB");
+            }
+
+            let scripts = batch::expand_patterns(&patterns)?;
+            if expect_stdout_file.is_some() && scripts.len() > 1 {
+                anyhow::bail!(
+                    "--expect-stdout-file applies to a single script; {} scripts match, give each a .golden file instead",
+                    scripts.len()
+                );
+            }
+            // Golden files are read up front, so a missing one fails before anything runs
+            let mut expectations = std::collections::HashMap::new();
+            for script in &scripts {
+                let expectation = verify::Expectation::load(script, expect_exit, expect_stdout_file.as_deref(), update)
+                    .map_err(|e| anyhow::anyhow!("Failed to read the expected output of {}: {}", script.display(), e))?;
+                expectations.insert(script.clone(), expectation);
+            }
+
+            let sandbox = SandboxProfile::resolve(&sandbox, &config.sandbox_profiles)?;
+            let env = env::collect(&env_file, &env)?;
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                cpu,
+                max_output * 1024,
+            )
+            .with_sandbox(sandbox)
+            .with_env(env);
+            if no_cache {
+                executor = executor.without_cache();
+            }
+
+            info!("Verifying {} scripts with {} jobs", scripts.len(), jobs);
+            let summary = batch::run_all(&executor, lang.as_deref(), scripts, jobs, |_| {}).await;
+            let summary = verify::check_all(summary, |script| expectations.remove(script).unwrap_or_default());
+
+            if let Some(path) = &junit {
+                std::fs::write(path, verify::junit_xml(&summary))
+                    .map_err(|e| anyhow::anyhow!("Failed to write {}: {}", path.display(), e))?;
+            }
+
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&summary)?);
+            } else {
+                for verified in &summary.results {
+                    print_verified(verified);
+                }
+                let updated = match summary.updated {
+                    0 => String::new(),
+                    1 => ", 1 golden file updated".to_string(),
+                    n => format!(", {} golden files updated", n),
+                };
+                println!(
+                    "\n{} passed, {} failed{} ({}ms)",
+                    summary.passed, summary.failed, updated, summary.duration_ms
+                );
+            }
+
+            if summary.failed > 0 {
+                std::process::exit(1);
+            }
+        }
+
+        Commands::Matrix {
+            script,
+            go,
+            jobs,
+            timeout,
+            memory,
+            cpu,
+            sandbox,
+            env_file,
+            env,
+        } => {
+            let versions = matrix::go_versions(&go);
+            if versions.is_empty() {
+                anyhow::bail!("No versions given to --go");
+            }
+            for version in &versions {
+                ToolchainStore::validate_version(version)?;
+            }
+
+            if jobs == 0 || jobs > config.max_concurrent_containers {
+                anyhow::bail!(
+                    "Jobs must be between 1 and {} (max_concurrent_containers)",
+                    config.max_concurrent_containers
+                );
+            }
+
+            if timeout == 0 || timeout > 3600 {
+                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            if cpu < 0.1 || cpu > 4.0 {
+                anyhow::bail!("CPU must be between 0.1 and 4.0");
+            }
+
+            let sandbox = SandboxProfile::resolve(&sandbox, &config.sandbox_profiles)?;
+            let env = env::collect(&env_file, &env)?;
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let executors = versions
+                .iter()
+                .map(|version| {
+                    let executor = Executor::new(
+                        container_manager.clone(),
+                        Duration::from_secs(timeout),
+                        memory * 1024 * 1024,
+                        cpu,
+                        1024 * 1024,
+                    )
+                    .with_sandbox(sandbox.clone())
+                    .with_env(env.clone())
+                    .with_toolchain_version(Some(version.clone()));
+                    (version.clone(), executor)
+                })
+                .collect();
+
+            info!("Running {} under {} Go versions", script.display(), versions.len());
+            let summary = matrix::run_matrix("go", &script, executors, jobs).await;
+
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&summary)?);
+            } else {
+                print_matrix_summary(&summary);
+            }
+
+            if summary.failed > 0 {
+                std::process::exit(1);
+            }
+        }
+
+        Commands::Repl {
+            lang,
+            script,
+            timeout,
+            memory,
+            sandbox,
+            env_file,
+            env,
+            no_state,
+        } => {
+            if let Some(script) = &script {
+                if !script.exists() {
+                    anyhow::bail!("Script file not found: {}", script.display());
+                }
+            }
+
+            if timeout == 0 || timeout > 86400 {
+                anyhow::bail!("Timeout must be between 1 and 86400 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            let sandbox = SandboxProfile::resolve(&sandbox, &config.sandbox_profiles)?;
+            let env = env::collect(&env_file, &env)?;
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_sandbox(sandbox)
+            .with_env(env);
+            if no_state {
+                executor = executor.without_state();
+            }
+
+            let exit_code = executor.repl(lang.as_deref(), script.as_deref()).await?;
+            if exit_code != 0 {
+                std::process::exit(exit_code);
+            }
+        }
+
+        Commands::Debug {
+            script,
+            lang,
+            dap,
+            timeout,
+            memory,
+            sandbox,
+            env_file,
+            env,
+            run_args,
+            no_state,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+
+            if timeout == 0 || timeout > 86400 {
+                anyhow::bail!("Timeout must be between 1 and 86400 seconds");
+            }
+
+            if memory < 32 || memory > 8192 {
+                anyhow::bail!("Memory must be between 32 and 8192 MB");
+            }
+
+            let sandbox = SandboxProfile::resolve(&sandbox, &config.sandbox_profiles)?;
+            let env = env::collect(&env_file, &env)?;
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let mut executor = Executor::new(
+                container_manager,
+                Duration::from_secs(timeout),
+                memory * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_sandbox(sandbox)
+            .with_env(env)
+            .with_run_args(run_args)
+            .with_debugging(Some(Debugging { dap }));
+            if no_state {
+                executor = executor.without_state();
+            }
+
+            let exit_code = executor.debug(lang.as_deref(), &script).await?;
+            if exit_code != 0 {
+                std::process::exit(exit_code);
+            }
+        }
+
+        Commands::Daemon {
+            socket,
+            metrics,
+            grpc,
+            grpc_token,
+            grpc_allow_paths,
+        } => {
+            let metrics = metrics.as_deref().map(metrics::parse_addr).transpose()?;
+            let grpc = grpc.as_deref().map(metrics::parse_addr).transpose()?.map(|addr| {
+                let token = grpc_token.unwrap_or_else(|| {
+                    let token = server::generate_token();
+                    eprintln!("gRPC API token (pass --grpc-token to choose one): {}", token);
+                    token
+                });
+                (addr, token)
+            });
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let socket = socket.unwrap_or_else(|| config.daemon_socket.clone());
+            Daemon::new(container_manager, socket)
+                .with_metrics(metrics)
+                .with_grpc(grpc)
+                .with_grpc_paths(grpc_allow_paths)
+                .serve()
+                .await?;
+        }
+
+        Commands::Serve { listen, token, allow_origin } => {
+            let addr = metrics::parse_addr(&listen)?;
+            // Local pages and processes can reach the API too, so it never
+            // runs without a token
+            let token = token.unwrap_or_else(|| {
+                let token = server::generate_token();
+                eprintln!("API token (pass --token to choose one): {}", token);
+                token
+            });
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+
+            let listener = tokio::net::TcpListener::bind(addr)
+                .await
+                .map_err(|e| anyhow::anyhow!("Cannot listen on {}: {}", addr, e))?;
+            ApiServer::new(container_manager)
+                .with_token(Some(token))
+                .with_allow_origin(allow_origin)
+                .serve(listener)
+                .await?;
+        }
+
+        Commands::Sign { script, key } => {
+            if !script.is_file() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+            let key = signing::load_signing_key(&key)?;
+            let content = std::fs::read(&script)?;
+            let output = signing::signature_path(&script);
+            std::fs::write(&output, signing::sign(&content, &key))?;
+
+            if cli.format == "json" {
+                println!("{}", serde_json::json!({ "status": "success", "signature": output }));
+            } else {
+                println!("✓ Signed {} ({})", script.display(), output.display());
+            }
+        }
+
+        Commands::Config { .. } => unreachable!("handled before the configuration is loaded"),
+        Commands::External(_) | Commands::Completion { .. } | Commands::Complete { .. } | Commands::EgressRelay { .. } => {
+            unreachable!("handled before the configuration is loaded")
+        }
+
+        Commands::Plugins => {
+            let listed = plugins::list(&config.cache_dir);
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&listed)?);
+            } else if listed.is_empty() {
+                println!("No {}* plugins on PATH", plugins::PLUGIN_PREFIX);
+            } else {
+                for plugin in listed {
+                    let kind = match (&plugin.language, &plugin.error) {
+                        (_, Some(error)) => format!("error: {}", error),
+                        (Some(language), None) => format!("language {}", language),
+                        (None, None) => "command".to_string(),
+                    };
+                    println!("{:<20} {:<24} {}", plugin.name, kind, plugin.path.display());
+                    if !plugin.description.is_empty() {
+                        println!("{:<20} {}", "", plugin.description);
+                    }
+                }
+            }
+        }
+
+        Commands::Policy => {
+            let policy = &config.policy;
+            if cli.format == "json" {
+                let mut value = serde_json::to_value(policy)?;
+                value["source"] = serde_json::json!(policy.source);
+                println!("{}", serde_json::to_string_pretty(&value)?);
+            } else if let Some(source) = &policy.source {
+                println!("# {}", source);
+                print!("{}", toml::to_string_pretty(policy)?);
+            } else {
+                println!("No policy in {}", Policy::path().display());
+            }
+        }
+
+        Commands::Service { action } => {
+            let store = ServiceStore::new(config.services_dir.clone());
+            run_service_command(&store, action, &config, &cli.format, cli.json).await?;
+        }
+
+        Commands::State { action } => {
+            let store = StateStore::new(config.state_dir.clone());
+            run_state_command(&store, action, &cli.format)?;
+        }
+
+        Commands::Postmortem { action } => {
+            let store = PostmortemStore::new(config.state_dir.clone());
+            run_postmortem_command(&store, action, &cli.format)?;
+        }
+
+        Commands::Info { script } => {
+            let info = ScriptInfo::read(&script, &plugins::registry(&config))?;
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&info)?);
+            } else {
+                print_script_info(&info);
+            }
+        }
+
+        Commands::Index { dir } => {
+            let catalog = Catalog::new(config.index_file.clone());
+            let scripts = catalog.index(&dir, &plugins::registry(&config))?;
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&scripts)?);
+            } else {
+                let described = scripts.iter().filter(|s| s.description.is_some()).count();
+                println!(
+                    "Indexed {} scripts in {} ({} with a description) into {}",
+                    scripts.len(),
+                    dir.display(),
+                    described,
+                    catalog.path().display()
+                );
+            }
+        }
+
+        Commands::Search { query } => {
+            let catalog = Catalog::new(config.index_file.clone());
+            let scripts = catalog.search(&query.join(" "))?;
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&scripts)?);
+            } else if scripts.is_empty() {
+                println!("No indexed scripts match (index a directory with `singleload index <dir>`)");
+            } else {
+                for script in scripts {
+                    let version = script.version.as_deref().map(|v| format!(" {}", v)).unwrap_or_default();
+                    println!("{}{}", script.path.display(), version);
+                    if let Some(description) = &script.description {
+                        println!("    {}", description);
+                    }
+                }
+            }
+        }
+
+        Commands::Doctor => {
+            let report = doctor::diagnose(&config).await;
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&report)?);
+            } else {
+                let width = report.findings.iter().map(|f| f.check.len()).max().unwrap_or(0);
+                for finding in &report.findings {
+                    let mark = match finding.status {
+                        doctor::Status::Ok => "✓",
+                        doctor::Status::Skip => "-",
+                        doctor::Status::Warn => "!",
+                        doctor::Status::Fail => "✗",
+                    };
+                    println!("{} {:<width$}  {}", mark, finding.check, finding.detail, width = width);
+                    if let Some(fix) = &finding.fix {
+                        println!("  {:<width$}  fix: {}", "", fix, width = width);
+                    }
+                }
+                println!(
+                    "\nsingleload {} on {}-{}; attach `singleload doctor --format json` to support requests",
+                    report.version, report.arch, report.os
+                );
+            }
+            if report.status() == doctor::Status::Fail {
+                std::process::exit(1);
+            }
+        }
+
+        Commands::SelfUpdate {
+            action,
+            channel,
+            check,
+            force,
+        } => {
+            let key = update::release_key(&config.update)?;
+            let updater = Updater::new(&config.update.url, key, downloads.clone())?;
+            if let Some(SelfUpdateCommands::Rollback) = action {
+                let kept = updater.rollback()?;
+                if cli.format == "json" {
+                    println!("{}", serde_json::json!({ "exe": updater.exe(), "previous": kept }));
+                } else {
+                    println!("Rolled back {}; the replaced binary is kept at {}", updater.exe().display(), kept.display());
+                }
+                return Ok(());
+            }
+
+            let release = updater.check(channel).await?;
+            let available = force || release.is_update(update::VERSION, channel);
+            let installed = if available && !check {
+                Some(updater.install(&release).await?)
+            } else {
+                None
+            };
+            if cli.format == "json" {
+                println!(
+                    "{}",
+                    serde_json::to_string_pretty(&serde_json::json!({
+                        "current": update::VERSION,
+                        "channel": channel,
+                        "release": release,
+                        "update_available": available,
+                        "updated": installed.is_some(),
+                        "previous": installed,
+                    }))?
+                );
+            } else if let Some(kept) = installed {
+                println!("Updated {} from {} to {}", updater.exe().display(), update::VERSION, release.version);
+                if let Some(notes) = &release.notes {
+                    println!("Release notes: {}", notes);
+                }
+                println!("The previous binary is kept at {}; `singleload self-update rollback` restores it", kept.display());
+            } else if available {
+                println!("{} {} is available (running {})", channel, release.version, update::VERSION);
+            } else {
+                println!("Up to date: {} is the latest {} release", update::VERSION, channel);
+            }
+        }
+
+        Commands::Known { action } => {
+            let store = KnownScripts::new(config.known_scripts_file.clone());
+            run_known_command(&store, action, &cli.format)?;
+        }
+
+        Commands::Cache { action } => {
+            let cache = BuildCache::new(config.cache_dir.clone())
+                .with_budget(config.cache.budget()?)
+                .with_dedupe(config.cache.dedupe);
+            let snapshots = SnapshotStore::new(config.snapshots_dir.clone());
+            run_cache_command(&cache, &snapshots, action, &cli.format)?;
+        }
+
+        Commands::Toolchain { action } => {
+            let store = ToolchainStore::new(config.toolchains_dir.clone());
+            run_toolchain_command(&store, action, &cli.format)?;
+        }
+
+        Commands::History { limit, clear } => {
+            let store = HistoryStore::new(config.history_file.clone());
+            if clear {
+                let count = store.clear()?;
+                if cli.format == "json" {
+                    println!("{}", serde_json::json!({ "removed": count }));
+                } else {
+                    println!("Removed {} runs from the history", count);
+                }
+                return Ok(());
+            }
+
+            let mut runs = store.list()?;
+            if limit > 0 && runs.len() > limit {
+                runs.drain(..runs.len() - limit);
+            }
+            if cli.format == "json" {
+                println!("{}", serde_json::to_string_pretty(&runs)?);
+            } else if runs.is_empty() {
+                println!("No runs recorded ({})", store.path().display());
+            } else {
+                for run in runs {
+                    println!(
+                        "{:>5}  {}  exit {:<3} {:>8}  singleload {}",
+                        run.id,
+                        run.started_at.with_timezone(&chrono::Local).format("%Y-%m-%d %H:%M:%S"),
+                        run.exit_code,
+                        format!("{}ms", run.duration_ms),
+                        runner::shell_join(&run.args)
+                    );
+                }
+            }
+        }
+
+        Commands::Rerun { id, force } => {
+            let store = HistoryStore::new(config.history_file.clone());
+            let run = store
+                .get(id)?
+                .ok_or_else(|| anyhow::anyhow!("No run {} in the history ({})", id, store.path().display()))?;
+            let exit_code = rerun(&run, force)?;
+            std::process::exit(exit_code);
+        }
+    }
+
+    Ok(())
+}
+
+fn print_script_info(info: &ScriptInfo) {
+    println!("{}", info.path.display());
+    let fields = [
+        ("language", info.language.clone()),
+        ("description", info.description.clone()),
+        ("author", (!info.authors.is_empty()).then(|| info.authors.join(", "))),
+        ("version", info.version.clone()),
+        ("tags", (!info.tags.is_empty()).then(|| info.tags.join(", "))),
+        ("entries", (!info.entries.is_empty()).then(|| info.entries.join(", "))),
+        (
+            "options",
+            (!info.options.is_empty()).then(|| info.options.iter().map(|o| format!("--{}", o)).collect::<Vec<_>>().join(", ")),
+        ),
+        ("deprecated", info.deprecated.clone()),
+    ];
+    for (name, value) in fields {
+        if let Some(value) = value {
+            println!("  {:<12} {}", format!("{}:", name), value);
+        }
+    }
+}
+
+fn run_cache_command(cache: &BuildCache, snapshots: &SnapshotStore, action: CacheCommands, format: &str) -> Result<()> {
+    match action {
+        CacheCommands::Ls => {
+            let entries = cache.list()?;
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&entries)?);
+            } else if entries.is_empty() {
+                println!("Cache is empty ({})", cache.root().display());
+            } else {
+                for entry in entries {
+                    println!(
+                        "{}  {:<10} {:>10}  {}{}",
+                        &entry.key[..12.min(entry.key.len())],
+                        entry.language,
+                        format_size(entry.size_bytes),
+                        entry.source,
+                        if entry.complete { "" } else { " (incomplete)" }
+                    );
+                }
+            }
+        }
+        CacheCommands::Gc { max_age_days } => {
+            let mut report = cache.gc(chrono::Duration::days(max_age_days))?;
+            // Also trim to the configured budget
+            let evicted = cache.evict(None)?;
+            report.removed += evicted.removed;
+            report.freed_bytes += evicted.freed_bytes;
+            print_gc_report(&report, format)?;
+        }
+        CacheCommands::Clear => {
+            let report = cache.clear()?;
+            print_gc_report(&report, format)?;
+        }
+        CacheCommands::Stats { reset } => {
+            if reset {
+                cache.reset_stats()?;
+                if format != "json" {
+                    println!("✓ Cache statistics reset");
+                }
+                return Ok(());
+            }
+            let stats = cache.stats()?;
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&stats)?);
+            } else {
+                print_cache_stats(&stats);
+            }
+        }
+        CacheCommands::Snapshots { clear: true } => {
+            let report = snapshots.clear()?;
+            print_gc_report(&report, format)?;
+        }
+        CacheCommands::Snapshots { clear: false } => {
+            let list = snapshots.list()?;
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&list)?);
+            } else if list.is_empty() {
+                println!("No snapshots ({})", snapshots.root().display());
+            } else {
+                for snapshot in list {
+                    println!(
+                        "{}  {:<10} {:>10}",
+                        &snapshot.key[..12.min(snapshot.key.len())],
+                        snapshot.language,
+                        format_size(snapshot.size_bytes)
+                    );
+                }
+            }
+        }
+    }
+
+    Ok(())
+}
+
+fn run_toolchain_command(store: &ToolchainStore, action: ToolchainCommands, format: &str) -> Result<()> {
+    match action {
+        ToolchainCommands::Ls => {
+            let toolchains = store.list()?;
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&toolchains)?);
+            } else if toolchains.is_empty() {
+                println!("No toolchains installed ({})", store.root().display());
+            } else {
+                for toolchain in toolchains {
+                    println!(
+                        "{:<10} {:<10} {:>10}{}",
+                        toolchain.language,
+                        toolchain.version,
+                        format_size(toolchain.size_bytes),
+                        match (toolchain.complete, toolchain.has_manifest) {
+                            (false, _) => " (incomplete)",
+                            (true, false) => " (no manifest)",
+                            (true, true) => "",
+                        }
+                    );
+                }
+            }
+        }
+        ToolchainCommands::Verify { language, version } => {
+            let checks: Vec<_> = store
+                .list()?
+                .into_iter()
+                .filter(|t| language.as_ref().map_or(true, |l| *l == t.language))
+                .filter(|t| version.as_ref().map_or(true, |v| *v == t.version))
+                .map(|t| store.verify(&t.language, &t.version))
+                .collect();
+            if checks.is_empty() {
+                anyhow::bail!("No matching toolchains installed in {}", store.root().display());
+            }
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&checks)?);
+            } else {
+                for check in &checks {
+                    if check.ok {
+                        println!("✓ {} {} ({} files)", check.language, check.version, check.files);
+                        continue;
+                    }
+                    match &check.error {
+                        Some(error) => println!("✗ {} {}: {}", check.language, check.version, error),
+                        None => println!(
+                            "✗ {} {}: {} modified, {} missing, {} unexpected",
+                            check.language,
+                            check.version,
+                            check.modified.len(),
+                            check.missing.len(),
+                            check.unexpected.len()
+                        ),
+                    }
+                    for path in &check.modified {
+                        println!("    modified    {}", path);
+                    }
+                    for path in &check.missing {
+                        println!("    missing     {}", path);
+                    }
+                    for path in &check.unexpected {
+                        println!("    unexpected  {}", path);
+                    }
+                }
+            }
+            if checks.iter().any(|check| !check.ok) {
+                std::process::exit(1);
+            }
+        }
+    }
+
+    Ok(())
+}
+
+async fn run_service_command(
+    store: &ServiceStore,
+    action: ServiceCommands,
+    config: &Config,
+    format: &str,
+    json: bool,
+) -> Result<()> {
+    match action {
+        ServiceCommands::Add {
+            script,
+            name,
+            lang,
+            restart,
+            workdir,
+            env_file,
+            env,
+            system,
+            no_start,
+            force,
+            dry_run,
+            args,
+        } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+            let script = script.canonicalize()?;
+            let name = match name {
+                Some(name) => name,
+                None => script
+                    .file_stem()
+                    .map(|stem| stem.to_string_lossy().to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Cannot derive a service name from {}", script.display()))?,
+            };
+            ServiceStore::validate_name(&name)?;
+
+            let existing = store.get(&name)?;
+            if existing.is_some() && !force {
+                anyhow::bail!("Service '{}' is already installed; use --force to replace it", name);
+            }
+
+            let manager = Manager::host()?;
+            let working_dir = match workdir {
+                Some(dir) => dir.canonicalize()?,
+                None => script.parent().map(Path::to_path_buf).unwrap_or_else(|| PathBuf::from("/")),
+            };
+            let mut service = Service {
+                name: name.clone(),
+                script: script.clone(),
+                language: lang.clone().unwrap_or_default(),
+                binary: store.binary_path(&name),
+                args,
+                env: env::collect(&env_file, &env)?,
+                working_dir,
+                restart,
+                manager,
+                system,
+                unit: manager.unit_path(&name, system, &store.dir(&name)),
+                installed_at: chrono::Utc::now(),
+            };
+            let unit = manager.render(&service)?;
+            let commands = manager.activate(&service, !no_start);
+
+            if dry_run {
+                println!("# {}", service.unit.display());
+                print!("{}", unit);
+                for command in &commands {
+                    println!("$ {}", command.join(" "));
+                }
+                return Ok(());
+            }
+
+            if let Some(old) = &existing {
+                service::run_commands(&old.manager.deactivate(old), false)?;
+            }
+
+            let container_manager = ContainerManager::new(config.clone()).await?;
+            if !container_manager.base_image_exists().await? {
+                anyhow::bail!("Base image not found. Please run 'singleload install' first.");
+            }
+            let executor = Executor::new(
+                container_manager,
+                Duration::from_secs(config.default_timeout_secs),
+                config.default_memory_mb * 1024 * 1024,
+                config.default_cpu_limit,
+                config.default_output_limit_kb * 1024,
+            )
+            .with_events(events(json));
+
+            std::fs::create_dir_all(store.dir(&name))?;
+            let output = executor.build_for_host(lang.as_deref(), &script, &service.binary).await?;
+            service.language = output.language;
+
+            if let Some(parent) = service.unit.parent() {
+                std::fs::create_dir_all(parent)?;
+            }
+            std::fs::write(&service.unit, manager.encode(&unit))?;
+            service::run_commands(&commands, true)?;
+            store.record(&service)?;
+
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&service)?);
+            } else {
+                println!(
+                    "✓ Installed service {} ({} {})",
+                    service.name,
+                    service.manager,
+                    service.unit.display()
+                );
+                if service.manager == Manager::Systemd && !service.system {
+                    println!("  Run 'loginctl enable-linger' to keep it running while you are logged out");
+                }
+            }
+        }
+
+        ServiceCommands::Remove { name } => {
+            let Some(service) = store.get(&name)? else {
+                anyhow::bail!("No service named '{}' is installed", name);
+            };
+            service::run_commands(&service.manager.deactivate(&service), false)?;
+            // Scheduled task definitions live in the service directory
+            if service.unit.exists() && !service.unit.starts_with(store.dir(&name)) {
+                std::fs::remove_file(&service.unit)?;
+            }
+            service::run_commands(&service.manager.reload(service.system), false)?;
+            store.remove(&name)?;
+
+            if format == "json" {
+                println!("{}", serde_json::json!({ "status": "success", "removed": name }));
+            } else {
+                println!("✓ Removed service {}", name);
+            }
+        }
+
+        ServiceCommands::Ls => {
+            let services = store.list()?;
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&services)?);
+            } else if services.is_empty() {
+                println!("No services installed");
+            } else {
+                for service in services {
+                    println!(
+                        "{:<20} {:<10} {:<15} {:<11} {}",
+                        service.name,
+                        service.language,
+                        service.manager.to_string(),
+                        service.restart.to_string(),
+                        service.script.display()
+                    );
+                }
+            }
+        }
+    }
+    Ok(())
+}
+
+fn run_postmortem_command(store: &PostmortemStore, action: PostmortemCommands, format: &str) -> Result<()> {
+    match action {
+        PostmortemCommands::Ls { script } => {
+            if let Some(script) = script.as_deref().filter(|s| !s.exists()) {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+            let postmortems = store.list(script.as_deref())?;
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&postmortems)?);
+            } else if postmortems.is_empty() {
+                println!("No postmortems");
+            } else {
+                for postmortem in postmortems {
+                    println!(
+                        "{}  {:<8} {:<8} {}  {}",
+                        postmortem.id,
+                        postmortem.language,
+                        postmortem.signal.as_deref().unwrap_or("-"),
+                        postmortem.script,
+                        postmortem.summary
+                    );
+                }
+            }
+        }
+        PostmortemCommands::Show { id } => {
+            let postmortem = store.get(&id)?.ok_or_else(|| anyhow::anyhow!("No postmortem {}", id))?;
+            let stack = postmortem.stack();
+            let backtrace = postmortem.native_backtrace();
+            if format == "json" {
+                let mut value = serde_json::to_value(&postmortem)?;
+                value["dir"] = serde_json::json!(postmortem.dir);
+                value["stack"] = serde_json::json!(stack);
+                value["native_backtrace"] = serde_json::json!(backtrace);
+                println!("{}", serde_json::to_string_pretty(&value)?);
+                return Ok(());
+            }
+            println!("Postmortem {}", postmortem.id);
+            println!("Script:    {} ({})", postmortem.script, postmortem.language);
+            println!(
+                "Crashed:   {}, exit code {}{}",
+                postmortem.created_at.with_timezone(&chrono::Local).format("%Y-%m-%d %H:%M:%S"),
+                postmortem.exit_code,
+                postmortem.signal.as_deref().map(|s| format!(" ({})", s)).unwrap_or_default()
+            );
+            println!("Summary:   {}", postmortem.summary);
+            for source in &postmortem.sources {
+                println!("Source:    {} (copy in {})", source.path, postmortem.source_copy(source).display());
+            }
+            if let Some(core) = postmortem.core_path() {
+                println!("Core:      {}", core.display());
+            }
+            if !stack.is_empty() {
+                println!("\n{}", stack);
+            }
+            if let Some(backtrace) = backtrace {
+                println!("\nNative backtrace:\n{}", backtrace);
+            }
+        }
+    }
+    Ok(())
+}
+
+fn run_state_command(store: &StateStore, action: StateCommands, format: &str) -> Result<()> {
+    match action {
+        StateCommands::Path { script } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+            let dir = store.dir(&script)?;
+            if format == "json" {
+                println!("{}", serde_json::json!({ "path": dir }));
+            } else {
+                println!("{}", dir.display());
+            }
+        }
+        StateCommands::Ls => {
+            let entries = store.list()?;
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&entries)?);
+            } else if entries.is_empty() {
+                println!("No state directories ({})", store.root().display());
+            } else {
+                for entry in entries {
+                    println!(
+                        "{}  {:>10}  {}",
+                        &entry.key[..12.min(entry.key.len())],
+                        format_size(entry.size_bytes),
+                        entry.script
+                    );
+                }
+            }
+        }
+        StateCommands::Clear { script } => {
+            if !script.exists() {
+                anyhow::bail!("Script file not found: {}", script.display());
+            }
+            let removed = store.clear(&script)?;
+            if format == "json" {
+                println!("{}", serde_json::json!({ "removed": removed }));
+            } else if removed {
+                println!("Cleared state of {}", script.display());
+            } else {
+                println!("{} has no state", script.display());
+            }
+        }
+    }
+    Ok(())
 }
 
-#[derive(Subcommand)]
-enum Commands {
-    /// Install the base container image
-    Install {
-        /// Path to Containerfile (defaults to bundled)
-        #[arg(long)]
-        containerfile: Option<PathBuf>,
+fn run_known_command(store: &KnownScripts, action: KnownCommands, format: &str) -> Result<()> {
+    match action {
+        KnownCommands::Ls => {
+            let entries = store.list()?;
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&entries)?);
+            } else if entries.is_empty() {
+                println!("No known scripts ({})", store.path().display());
+            } else {
+                for entry in entries {
+                    println!(
+                        "{}  {}  {}",
+                        &entry.sha256[..12.min(entry.sha256.len())],
+                        entry.last_seen.with_timezone(&chrono::Local).format("%Y-%m-%d %H:%M:%S"),
+                        entry.script
+                    );
+                }
+            }
+        }
+        KnownCommands::Forget { script } => {
+            // Local scripts are known under their canonical path
+            let key = match Path::new(&script).canonicalize() {
+                Ok(path) if !remote::is_remote(&script) => path.to_string_lossy().to_string(),
+                _ => script.clone(),
+            };
+            let removed = store.forget(&key)?;
+            if format == "json" {
+                println!("{}", serde_json::json!({ "removed": removed }));
+            } else if removed {
+                println!("Forgot {}", key);
+            } else {
+                println!("{} is not known", key);
+            }
+        }
+    }
+    Ok(())
+}
 
-        /// Force rebuild even if image exists
-        #[arg(long)]
-        force: bool,
-    },
+fn run_config_command(action: &ConfigCommands, format: &str) -> Result<()> {
+    let cwd = std::env::current_dir()?;
+    let user = Config::user_path();
+    let project = Config::project_path(&cwd);
 
-    /// Run a script in an isolated container
-    Run {
-        /// Programming language
-        #[arg(long, value_enum)]
-        lang: Language,
+    match action {
+        ConfigCommands::Get { key } => {
+            let config = Config::load()?;
+            let value = match key {
+                Some(key) => config.get(key)?,
+                None => toml::Value::try_from(&config)?,
+            };
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&value)?);
+            } else {
+                match &value {
+                    toml::Value::String(s) => println!("{}", s),
+                    toml::Value::Table(table) => print!("{}", toml::to_string_pretty(table)?),
+                    other => println!("{}", other),
+                }
+            }
+        }
+        ConfigCommands::Set { key, value, project: to_project } => {
+            let path = match (to_project, &project) {
+                (true, Some(path)) => path.clone(),
+                (true, None) => cwd.join(config::PROJECT_CONFIG_FILE),
+                (false, _) => user.clone(),
+            };
+            let mut layers = vec![user.clone()];
+            layers.extend(project.clone().or_else(|| to_project.then(|| path.clone())));
+            Config::set(&path, key, value, &layers)?;
 
-        /// Path to script file
-        #[arg(long)]
-        script: PathBuf,
+            if format == "json" {
+                println!("{}", serde_json::json!({ "key": key, "file": path }));
+            } else {
+                println!("✓ Set {} in {}", key, path.display());
+            }
+        }
+        ConfigCommands::Path => {
+            let files: Vec<PathBuf> = std::iter::once(user).chain(project).collect();
+            if format == "json" {
+                let files: Vec<_> = files
+                    .iter()
+                    .map(|f| serde_json::json!({ "path": f, "exists": f.is_file() }))
+                    .collect();
+                println!("{}", serde_json::to_string_pretty(&files)?);
+            } else {
+                for file in files {
+                    let note = if file.is_file() { "" } else { " (missing)" };
+                    println!("{}{}", file.display(), note);
+                }
+            }
+        }
+    }
+    Ok(())
+}
 
-        /// Execution timeout in seconds
-        #[arg(long, default_value = "30")]
-        timeout: u64,
+fn print_cache_stats(stats: &CacheStats) {
+    let limit = match stats.max_bytes {
+        Some(max) => format!(" of {}", format_size(max)),
+        None => String::new(),
+    };
+    println!(
+        "{}: {} entries, {}{}",
+        stats.root.display(),
+        stats.entries,
+        format_size(stats.size_bytes),
+        limit
+    );
+    if let Some(age) = stats.max_age_secs {
+        let age = match age {
+            age if age % 86_400 == 0 => format!("{} days", age / 86_400),
+            age if age % 3_600 == 0 => format!("{} hours", age / 3_600),
+            age => format!("{} minutes", age / 60),
+        };
+        println!("Entries unused for {} are evicted", age);
+    }
+    if stats.shared_bytes > 0 {
+        println!("{} shared between entries with identical files", format_size(stats.shared_bytes));
+    }
+    let rate = |rate: Option<f64>| rate.map_or("-".to_string(), |r| format!("{:.1}%", r * 100.0));
+    match stats.since {
+        Some(since) => println!(
+            "{} hits, {} misses, {} hit rate since {}",
+            stats.hits,
+            stats.misses,
+            rate(stats.hit_rate),
+            since.format("%Y-%m-%d %H:%M")
+        ),
+        None => println!("No lookups recorded yet"),
+    }
+    if stats.languages.is_empty() {
+        return;
+    }
 
-        /// Memory limit in MB
-        #[arg(long, default_value = "512")]
-        memory: u64,
+    println!();
+    println!(
+        "{:<12} {:>7} {:>10} {:>7} {:>7} {:>8}",
+        "LANGUAGE", "ENTRIES", "SIZE", "HITS", "MISSES", "HIT RATE"
+    );
+    for usage in &stats.languages {
+        println!(
+            "{:<12} {:>7} {:>10} {:>7} {:>7} {:>8}",
+            usage.language,
+            usage.entries,
+            format_size(usage.size_bytes),
+            usage.hits,
+            usage.misses,
+            rate(usage.hit_rate)
+        );
+    }
+}
 
-        /// CPU limit (0.1-4.0)
-        #[arg(long, default_value = "1.0")]
-        cpu: f32,
+fn print_explanation(explanation: &Explanation) {
+    let yes_no = |cached: bool| if cached { "cached" } else { "not cached" };
+    println!("{:<13} {}", "Script", explanation.script.display());
+    println!("{:<13} {} ({})", "Language", explanation.language, explanation.detected_by);
+    let toolchain = match (&explanation.toolchain, &explanation.toolchain_pinned_by) {
+        (Some(version), Some(origin)) => format!(
+            "{} {}, pinned by {}{}",
+            explanation.language,
+            version,
+            origin,
+            if explanation.toolchain_installed { "" } else { ", not installed yet" }
+        ),
+        _ => "base image".to_string(),
+    };
+    println!("{:<13} {}", "Toolchain", toolchain);
+    if explanation.dependencies.is_empty() {
+        println!("{:<13} none", "Dependencies");
+    } else {
+        let lockfile = match &explanation.lockfile {
+            Some(path) => format!("pinned by {}", path.display()),
+            None => "no lockfile".to_string(),
+        };
+        println!(
+            "{:<13} {} ({}, {})",
+            "Dependencies",
+            explanation.dependencies.join(" "),
+            lockfile,
+            yes_no(explanation.dependencies_cached)
+        );
+    }
+    if !explanation.build_flags.is_empty() {
+        println!("{:<13} {}", "Build flags", runner::shell_join(&explanation.build_flags));
+    }
+    match &explanation.build_command {
+        Some(build) => {
+            if let Some(key) = &explanation.cache_key {
+                println!("{:<13} {} ({})", "Cache key", key, yes_no(explanation.cached));
+            }
+            println!("{:<13} {}", "Build", build);
+        }
+        None => println!("{:<13} none", "Build"),
+    }
+    println!("{:<13} {}", "Run", runner::shell_join(&explanation.run_command));
+    println!(
+        "{:<13} {}s, {} MB, {} CPU, network {}",
+        "Limits",
+        explanation.timeout_secs,
+        explanation.memory_mb,
+        explanation.cpu_limit,
+        if explanation.network { "on" } else { "off" }
+    );
+}
 
-        /// Keep container for debugging
-        #[arg(long)]
-        debug: bool,
+fn print_gc_report(report: &GcReport, format: &str) -> Result<()> {
+    if format == "json" {
+        println!("{}", serde_json::to_string_pretty(report)?);
+    } else {
+        println!(
+            "✓ Removed {} cache entries ({})",
+            report.removed,
+            format_size(report.freed_bytes)
+        );
+    }
+    Ok(())
+}
 
-        /// Maximum output size in KB
-        #[arg(long, default_value = "1024")]
-        max_output: u64,
-    },
+fn format_size(bytes: u64) -> String {
+    const UNITS: &[&str] = &["B", "KB", "MB", "GB"];
+    let mut size = bytes as f64;
+    let mut unit = 0;
+    while size >= 1024.0 && unit < UNITS.len() - 1 {
+        size /= 1024.0;
+        unit += 1;
+    }
+    if unit == 0 {
+        format!("{} {}", bytes, UNITS[0])
+    } else {
+        format!("{:.1} {}", size, UNITS[unit])
+    }
 }
 
-#[tokio::main]
-async fn main() -> Result<()> {
-    let cli = Cli::parse();
+/// Asks for the language of a new script on a terminal; elsewhere --lang is required
+fn prompt_language(registry: &Registry) -> Result<String> {
+    use std::io::{BufRead, Write};
 
-    // Initialize tracing
-    let filter = if cli.debug {
-        EnvFilter::new("singleload=debug,podman_api=debug")
-    } else {
-        EnvFilter::new("singleload=info")
+    let names = registry.names();
+    if !std::io::stdin().is_terminal() {
+        anyhow::bail!("Cannot tell the language from the file name, use --lang ({})", names.join(", "));
+    }
+    loop {
+        eprint!("Language ({}): ", names.join(", "));
+        std::io::stderr().flush()?;
+        let mut answer = String::new();
+        if std::io::stdin().lock().read_line(&mut answer)? == 0 {
+            anyhow::bail!("No language given");
+        }
+        let answer = answer.trim();
+        if names.iter().any(|n| n == answer) {
+            return Ok(answer.to_string());
+        }
+    }
+}
+
+/// Removes the `--isolate-cwd` directory, or with `--keep` says where it is
+fn finish_work_dir(dir: Option<WorkDir>, keep: bool) {
+    if let Some(dir) = dir {
+        if keep {
+            eprintln!("Working directory kept at {}", dir.keep().display());
+        }
+    }
+}
+
+/// The script to run from `dir`: the only one there, the one chosen on the
+/// terminal, or the first by the fallback order when not `interactive`
+fn pick_script(config: &Config, dir: &Path, interactive: bool) -> Result<PathBuf> {
+    let registry = plugins::registry(config);
+    let mut candidates = chooser::candidates(dir, &registry)?;
+    chooser::order(dir, &mut candidates);
+    match candidates.as_slice() {
+        [] => anyhow::bail!(
+            "No scripts in {}; pass one with --script, or add a {} to run it as a project",
+            dir.display(),
+            MANIFEST_FILE
+        ),
+        [only] => Ok(only.clone()),
+        _ if interactive && chooser::is_interactive() => Ok(chooser::choose(dir, &candidates)?),
+        [first, ..] => {
+            tracing::warn!(
+                "{} scripts in {}, running {} (pass --script to pick another)",
+                candidates.len(),
+                dir.display(),
+                first.display()
+            );
+            Ok(first.clone())
+        }
+    }
+}
+
+/// Reads the program to run from stdin and saves it under the cache
+/// directory, named after its content with the extension of its language
+fn read_stdin_program(config: &Config, lang: Option<&str>) -> Result<PathBuf> {
+    if std::io::stdin().is_terminal() {
+        anyhow::bail!("Expected the program on stdin, e.g. `singleload run --lang python - <<'EOF'`");
+    }
+    let mut content = Vec::new();
+    std::io::stdin().read_to_end(&mut content)?;
+    if content.is_empty() {
+        anyhow::bail!("No program on stdin");
+    }
+
+    let registry = plugins::registry(config);
+    let runner = match lang {
+        Some(name) => registry
+            .get(name)
+            .ok_or_else(|| anyhow::anyhow!("Unsupported language: {} (available: {})", name, registry.names().join(", ")))?,
+        None => registry
+            .detect(Path::new(STDIN_PATH), &content)
+            .ok_or_else(|| anyhow::anyhow!("Could not detect the language of the program on stdin, use --lang"))?,
     };
+    let dir = config.cache_dir.join("sources").join("stdin");
+    Ok(save_stdin_program(&dir, &content, runner.file_extension())?)
+}
 
-    let fmt_layer = fmt::layer()
-        .with_target(false)
-        .with_thread_ids(false)
-        .with_file(false)
-        .with_line_number(false);
+/// Turns `singleload <script> [args]`, which is how the kernel invokes a
+/// script starting with `#!/usr/bin/env singleload`, into
+/// `singleload run --script <script> -- [args]`, so the arguments go to the
+/// script.
+fn expand_shebang_args(args: Vec<OsString>) -> Vec<OsString> {
+    let is_script = args.get(1).map_or(false, |arg| {
+        let path = Path::new(arg);
+        !arg.to_string_lossy().starts_with('-')
+            && Cli::command().find_subcommand(&*arg.to_string_lossy()).is_none()
+            && path.is_file()
+    });
 
-    if cli.format == "json" {
-        tracing_subscriber::registry()
-            .with(filter)
-            .with(fmt_layer.json())
-            .init();
+    if !is_script {
+        return args;
+    }
+
+    let mut args = args.into_iter();
+    let mut expanded: Vec<OsString> = args.next().into_iter().collect();
+    expanded.extend(["run".into(), "--script".into()]);
+    expanded.extend(args.next());
+    expanded.push("--".into());
+    expanded.extend(args);
+    expanded
+}
+
+fn events(json: bool) -> EventSink {
+    if json {
+        EventSink::json_lines()
     } else {
-        tracing_subscriber::registry()
-            .with(filter)
-            .with(fmt_layer)
-            .init();
+        EventSink::default()
     }
+}
 
-    // Load configuration
-    let config = Config::load()?;
-    let container_manager = ContainerManager::new(config.clone()).await?;
+/// `<script stem>[-<goos>-<goarch>][.exe]` in the current directory
+fn default_build_output(script: &Path, target: Option<&BuildTarget>) -> PathBuf {
+    let stem = script
+        .file_stem()
+        .map(|s| s.to_string_lossy().to_string())
+        .unwrap_or_else(|| "app".to_string());
 
-    match cli.command {
-        Commands::Install { containerfile, force } => {
-            info!("Installing Singleload base image...");
-            
-            let containerfile_path = containerfile.unwrap_or_else(|| {
-                // Use bundled Containerfile
-                PathBuf::from("Containerfile")
-            });
+    let mut name = stem;
+    if target.map_or(false, |t| t.is_wasm()) {
+        name.push_str(".wasm");
+        return PathBuf::from(name);
+    }
+    if let Some(target) = target {
+        let suffix = target.to_string().replace('/', "-");
+        if !suffix.is_empty() {
+            name = format!("{}-{}", name, suffix);
+        }
+        if target.is_windows() {
+            name.push_str(".exe");
+        }
+    }
 
-            container_manager.install_base_image(containerfile_path, force).await?;
-            
-            if cli.format == "json" {
+    PathBuf::from(name)
+}
+
+/// Prints the outcome of a run and returns the process exit code it maps to
+fn print_audit_report(script: &Path, report: &AuditReport) {
+    let count: usize = report.findings.iter().map(|f| f.vulnerabilities.len()).sum();
+    if count == 0 {
+        println!(
+            "✓ No known vulnerabilities in the {} packages of {}",
+            report.scanned,
+            script.display()
+        );
+    } else {
+        println!(
+            "✗ {} vulnerabilities in {} of the {} packages of {}",
+            count,
+            report.findings.len(),
+            report.scanned,
+            script.display()
+        );
+    }
+    for finding in &report.findings {
+        println!("  {} {}", finding.name, finding.version);
+        for vulnerability in &finding.vulnerabilities {
+            let aliases = match vulnerability.aliases.is_empty() {
+                true => String::new(),
+                false => format!(" ({})", vulnerability.aliases.join(", ")),
+            };
+            let score = vulnerability.score.map(|s| format!(" {:.1}", s)).unwrap_or_default();
+            let fixed = match vulnerability.fixed.is_empty() {
+                true => String::new(),
+                false => format!(", fixed in {}", vulnerability.fixed.join(", ")),
+            };
+            println!(
+                "    {}{} {}{}: {}{}",
+                vulnerability.id, aliases, vulnerability.severity, score, vulnerability.summary, fixed
+            );
+        }
+    }
+    if !report.unpinned.is_empty() {
+        println!("  Not checked, no exact version: {}", report.unpinned.join(", "));
+    }
+}
+
+/// Appends a finished run to the history; failing to is only worth a warning
+fn record_run(
+    config: &Config,
+    argv: &[OsString],
+    script: String,
+    local: &Path,
+    stdin: bool,
+    started_at: chrono::DateTime<chrono::Utc>,
+    exit_code: i32,
+) {
+    if !config.record_history {
+        return;
+    }
+    let invocation = Invocation {
+        id: 0,
+        started_at,
+        cwd: std::env::current_dir().unwrap_or_default(),
+        args: argv.iter().skip(1).map(|arg| arg.to_string_lossy().to_string()).collect(),
+        script,
+        stdin,
+        sha256: content_hash(local).unwrap_or_default(),
+        exit_code,
+        duration_ms: (chrono::Utc::now() - started_at).num_milliseconds().max(0) as u64,
+    };
+    if let Err(e) = HistoryStore::new(config.history_file.clone()).record(invocation) {
+        tracing::warn!("Failed to record the run in {}: {}", config.history_file.display(), e);
+    }
+}
+
+/// Runs the command line of a recorded run again from its directory,
+/// returning its exit code. The script must still have the recorded
+/// checksum unless `force` is set; remote scripts are pinned to it.
+fn rerun(run: &Invocation, force: bool) -> Result<i32> {
+    if run.args.iter().any(|arg| arg.ends_with(history::REDACTED)) {
+        anyhow::bail!("Run {} set placeholders with --set, whose values the history does not keep", run.id);
+    }
+    let mut args = run.args.clone();
+    if run.is_remote() {
+        let pinned = args.iter().any(|arg| arg == "--sha256" || arg.starts_with("--sha256="));
+        if !force && !pinned {
+            args.push(format!("--sha256={}", run.sha256));
+        }
+    } else {
+        let script = Path::new(&run.script);
+        match content_hash(script) {
+            Ok(hash) if hash == run.sha256 => {}
+            Ok(_) if force => tracing::warn!("{} changed since run {}", script.display(), run.id),
+            Ok(_) => anyhow::bail!(
+                "{} changed since run {}; use --force to run the current version",
+                script.display(),
+                run.id
+            ),
+            Err(e) => anyhow::bail!("Cannot read {}: {}", script.display(), e),
+        }
+    }
+
+    let mut command = std::process::Command::new(std::env::current_exe()?);
+    command.args(&args).current_dir(&run.cwd);
+    if run.stdin {
+        // Feed the saved copy of the program to `run -` again
+        command.stdin(std::fs::File::open(&run.script)?);
+    }
+    let mut child = command
+        .spawn()
+        .map_err(|e| anyhow::anyhow!("Failed to start singleload: {}", e))?;
+    #[cfg(windows)]
+    let _job = platform::ProcessTree::attach(&child)?;
+    Ok(child.wait()?.code().unwrap_or(1))
+}
+
+fn print_run_result(result: Result<ExecutionResult>, format: &str) -> Result<i32> {
+    match result {
+        Ok(execution_result) => {
+            if format == "json" {
+                println!("{}", serde_json::to_string_pretty(&execution_result)?);
+            } else {
+                print_text_result(&execution_result);
+            }
+            Ok(execution_result.exit_code as i32)
+        }
+        Err(e) => {
+            if format == "json" {
                 println!(
                     "{}",
                     serde_json::json!({
-                        "status": "success",
-                        "message": "Base image installed successfully",
-                        "image": config.base_image_name
+                        "status": "error",
+                        "error": e.to_string()
                     })
                 );
             } else {
-                println!("✓ Base image installed successfully");
+                eprintln!("Error: {}", e);
             }
+            Ok(1)
         }
+    }
+}
 
-        Commands::Run {
-            lang,
-            script,
-            timeout,
-            memory,
-            cpu,
-            debug,
-            max_output,
-        } => {
-            // Validate inputs
-            if !script.exists() {
-                anyhow::bail!("Script file not found: {}", script.display());
-            }
+/// The placeholder values of `--values` files and `--set` flags; None when
+/// no flag was given, so sources are left alone
+fn template(files: &[PathBuf], pairs: &[String], strict: bool) -> Result<Option<ValuesTemplate>> {
+    if files.is_empty() && pairs.is_empty() && !strict {
+        return Ok(None);
+    }
+    Ok(Some(ValuesTemplate::load(files, pairs, strict)?))
+}
 
-            if timeout == 0 || timeout > 3600 {
-                anyhow::bail!("Timeout must be between 1 and 3600 seconds");
-            }
+/// Prints a run's result with the resources it used, for `run --stats`
+fn print_measured_result(result: &ExecutionResult, measurement: &Measurement, format: &str) -> Result<i32> {
+    if format == "json" {
+        let mut document = serde_json::to_value(result)?;
+        document["stats"] = serde_json::to_value(measurement)?;
+        println!("{}", serde_json::to_string_pretty(&document)?);
+    } else {
+        print_text_result(result);
+        print_resource_usage(measurement);
+    }
+    Ok(result.exit_code as i32)
+}
 
-            if memory < 32 || memory > 8192 {
-                anyhow::bail!("Memory must be between 32 and 8192 MB");
-            }
+fn print_resource_usage(measurement: &Measurement) {
+    let millis = |ms: Option<f64>| ms.map_or("unknown".to_string(), |ms| format!("{:.1}ms", ms));
+    println!("\nResources:");
+    println!("  Wall time: {}", millis(measurement.elapsed_ms));
+    println!(
+        "  CPU:       {} user, {} system",
+        millis(measurement.user_cpu_ms),
+        millis(measurement.system_cpu_ms)
+    );
+    match measurement.peak_rss_bytes {
+        Some(peak) => println!("  Memory:    {} peak", format_size(peak)),
+        None => println!("  Memory:    unknown"),
+    }
+    match &measurement.io {
+        Some(io) => println!(
+            "  I/O:       {} read ({} ops), {} written ({} ops)",
+            format_size(io.read_bytes),
+            io.read_ops,
+            format_size(io.write_bytes),
+            io.write_ops
+        ),
+        None => println!("  I/O:       unknown"),
+    }
+}
 
-            if cpu < 0.1 || cpu > 4.0 {
-                anyhow::bail!("CPU must be between 0.1 and 4.0");
-            }
+/// Runs the script, restarting it every time it or a file it reads
+/// changes (see [`watch::inputs`])
+async fn watch_script(
+    executor: &Executor,
+    lang: Option<&str>,
+    script: &Path,
+    debug: bool,
+    format: &str,
+) -> Result<()> {
+    info!("Watching {} for changes", script.display());
 
-            if max_output == 0 || max_output > 10240 {
-                anyhow::bail!("Max output must be between 1 and 10240 KB");
-            }
+    loop {
+        // Edits can add or drop inputs, so they are looked up on every run
+        let mut watcher = FileWatcher::new(watch::inputs(script, lang, executor.registry()));
+        let (cancel_tx, cancel_rx) = tokio::sync::watch::channel(false);
+        let run = executor.run_script_cancellable(lang, script, debug, cancel_rx);
+        tokio::pin!(run);
 
-            // Check if base image exists
-            if !container_manager.base_image_exists().await? {
-                if cli.format == "json" {
-                    println!(
-                        "{}",
-                        serde_json::json!({
-                            "status": "error",
-                            "error": "Base image not found. Please run 'singleload install' first."
-                        })
-                    );
-                } else {
-                    eprintln!("Error: Base image not found. Please run 'singleload install' first.");
-                }
-                std::process::exit(1);
+        tokio::select! {
+            result = &mut run => {
+                print_run_result(result, format)?;
+                // Including a lockfile the run wrote
+                let mut watcher = FileWatcher::new(watch::inputs(script, lang, executor.registry()));
+                watcher.changed().await;
             }
+            _ = watcher.changed() => {
+                let _ = cancel_tx.send(true);
+                let _ = run.await;
+            }
+        }
 
-            // Execute script
-            let executor = executor::Executor::new(
-                container_manager,
-                Duration::from_secs(timeout),
-                memory * 1024 * 1024, // Convert MB to bytes
-                cpu,
-                max_output * 1024,    // Convert KB to bytes
-            );
+        info!("Change detected in {}, restarting", script.display());
+    }
+}
 
-            let result = executor.run_script(lang, &script, debug).await;
+fn print_verified(verified: &verify::Verified) {
+    if verified.passed {
+        println!("✓ {} ({}ms)", verified.script.display(), verified.duration_ms);
+        if let Some(path) = &verified.updated {
+            println!("    updated {}", path.display());
+        }
+        return;
+    }
+    println!("✗ {} ({}ms)", verified.script.display(), verified.duration_ms);
+    for failure in &verified.failures {
+        println!("    {}", failure);
+    }
+}
 
-            // Output result
-            match result {
-                Ok(execution_result) => {
-                    if cli.format == "json" {
-                        println!("{}", serde_json::to_string_pretty(&execution_result)?);
-                    } else {
-                        print_text_result(&execution_result);
-                    }
-                    
-                    if execution_result.exit_code != 0 {
-                        std::process::exit(execution_result.exit_code as i32);
-                    }
-                }
-                Err(e) => {
-                    if cli.format == "json" {
-                        println!(
-                            "{}",
-                            serde_json::json!({
-                                "status": "error",
-                                "error": e.to_string()
-                            })
-                        );
-                    } else {
-                        eprintln!("Error: {}", e);
-                    }
-                    std::process::exit(1);
-                }
-            }
+fn print_matrix_summary(summary: &MatrixSummary) {
+    let width = summary.results.iter().map(|e| e.version.len()).max().unwrap_or(0).max("VERSION".len());
+    println!("{:<width$}  {:<6}  {:>4}  {:>8}", "VERSION", "RESULT", "EXIT", "TIME", width = width);
+    for entry in &summary.results {
+        let result = &entry.result;
+        let outcome = if entry.passed() {
+            "ok"
+        } else if result.error.is_some() {
+            "error"
+        } else {
+            "failed"
+        };
+        println!(
+            "{:<width$}  {:<6}  {:>4}  {:>8}",
+            entry.version,
+            outcome,
+            result.exit_code,
+            format!("{}ms", result.duration_ms),
+            width = width
+        );
+    }
+
+    for entry in summary.results.iter().filter(|e| !e.passed()) {
+        println!("\n{} {}:", summary.language, entry.version);
+        let detail = entry.result.error.as_deref().unwrap_or(&entry.result.stderr);
+        for line in detail.lines().take(20) {
+            println!("    {}", line);
         }
     }
 
-    Ok(())
+    println!(
+        "\n{} of {} versions passed ({}ms)",
+        summary.passed,
+        summary.results.len(),
+        summary.duration_ms
+    );
+}
+
+fn print_bench_summary(summary: &BenchSummary) {
+    println!("{} ({}), {} runs", summary.script.display(), summary.language, summary.runs);
+    match &summary.time_ms {
+        Some(time) => println!(
+            "  Time:    {:.1}ms ± {:.1}ms  (median {:.1}ms, min {:.1}ms, max {:.1}ms, p95 {:.1}ms)",
+            time.mean, time.stddev, time.median, time.min, time.max, time.p95
+        ),
+        None => println!("  Time:    no run completed"),
+    }
+    if let Some(memory) = &summary.peak_rss_bytes {
+        println!(
+            "  Memory:  {} peak  (min {}, max {})",
+            format_size(memory.mean as u64),
+            format_size(memory.min as u64),
+            format_size(memory.max as u64)
+        );
+    }
+    let exits: Vec<String> = summary
+        .exit_codes
+        .iter()
+        .map(|(code, count)| format!("{} × {}", count, code))
+        .collect();
+    println!("  Exit:    {}", exits.join(", "));
+    let errors: Vec<&String> = summary.results.iter().filter_map(|run| run.error.as_ref()).collect();
+    if let Some(error) = errors.first() {
+        println!("  ✗ {} runs did not complete: {}", errors.len(), error);
+    }
+    println!();
+}
+
+/// Ranks benchmarked scripts by mean run time
+fn print_bench_comparison(summaries: &[BenchSummary]) {
+    let mut ranked: Vec<(&BenchSummary, &Stats)> = summaries
+        .iter()
+        .filter_map(|summary| summary.time_ms.as_ref().map(|time| (summary, time)))
+        .collect();
+    ranked.sort_by(|a, b| a.1.mean.total_cmp(&b.1.mean));
+
+    let Some((fastest, base)) = ranked.first().copied() else {
+        return;
+    };
+    println!("Fastest: {} ({})", fastest.script.display(), fastest.language);
+    for (summary, time) in &ranked[1..] {
+        let ratio = if base.mean > 0.0 { time.mean / base.mean } else { f64::INFINITY };
+        println!("  {:.2}x slower: {} ({})", ratio, summary.script.display(), summary.language);
+    }
 }
 
 fn print_text_result(result: &ExecutionResult) {
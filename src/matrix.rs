@@ -0,0 +1,92 @@
+use crate::executor::Executor;
+use crate::pins;
+use crate::types::ExecutionResult;
+use futures::StreamExt;
+use serde::Serialize;
+use std::path::{Path, PathBuf};
+use std::time::Instant;
+
+/// Outcome of the script under one toolchain version
+#[derive(Debug, Serialize)]
+pub struct MatrixEntry {
+    pub version: String,
+    #[serde(flatten)]
+    pub result: ExecutionResult,
+}
+
+impl MatrixEntry {
+    pub fn passed(&self) -> bool {
+        self.result.exit_code == 0 && self.result.error.is_none()
+    }
+}
+
+#[derive(Debug, Serialize)]
+pub struct MatrixSummary {
+    pub script: PathBuf,
+    pub language: String,
+    pub passed: usize,
+    pub failed: usize,
+    pub duration_ms: u64,
+    /// In the order the versions were given
+    pub results: Vec<MatrixEntry>,
+}
+
+/// Splits `1.21,1.22, 1.23` into versions, without blanks or duplicates
+pub fn parse_versions(list: &[String]) -> Vec<String> {
+    let mut versions: Vec<String> = Vec::new();
+    for version in list.iter().flat_map(|v| v.split(',')).map(str::trim) {
+        if !version.is_empty() && !versions.iter().any(|v| v == version) {
+            versions.push(version.to_string());
+        }
+    }
+    versions
+}
+
+/// The Go releases a `--go` list names. `1.22` is read as `1.22.0`, as in a
+/// go.mod `go` line, rather than whichever patch release is newest.
+pub fn go_versions(list: &[String]) -> Vec<String> {
+    let mut versions: Vec<String> = Vec::new();
+    for version in parse_versions(list).iter().map(|version| pins::go_release(version)) {
+        if !versions.contains(&version) {
+            versions.push(version);
+        }
+    }
+    versions
+}
+
+/// Runs `script` once per executor, each set up with its own toolchain
+/// version, at most `jobs` at a time
+pub async fn run_matrix(
+    language: &str,
+    script: &Path,
+    executors: Vec<(String, Executor)>,
+    jobs: usize,
+) -> MatrixSummary {
+    let start_time = Instant::now();
+
+    let mut results: Vec<(usize, MatrixEntry)> = futures::stream::iter(executors.into_iter().enumerate())
+        .map(|(idx, (version, executor))| async move {
+            let started = Instant::now();
+            let result = executor
+                .run_script(Some(language), script, false)
+                .await
+                .unwrap_or_else(|e| ExecutionResult::error(e.to_string(), started.elapsed().as_millis() as u64));
+            (idx, MatrixEntry { version, result })
+        })
+        .buffer_unordered(jobs.max(1))
+        .collect()
+        .await;
+
+    results.sort_by_key(|(idx, _)| *idx);
+    let results: Vec<MatrixEntry> = results.into_iter().map(|(_, entry)| entry).collect();
+    let passed = results.iter().filter(|entry| entry.passed()).count();
+
+    MatrixSummary {
+        script: script.to_path_buf(),
+        language: language.to_string(),
+        passed,
+        failed: results.len() - passed,
+        duration_ms: start_time.elapsed().as_millis() as u64,
+        results,
+    }
+}
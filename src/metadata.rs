@@ -0,0 +1,86 @@
+use crate::reproducible;
+use chrono::{DateTime, SecondsFormat, Utc};
+use sha2::{Digest, Sha256};
+
+/// Environment variable holding the SHA-256 of the script's source
+pub const SOURCE_SHA256_VAR: &str = "SINGLELOAD_SOURCE_SHA256";
+/// Environment variable holding the build time, RFC 3339 in UTC
+pub const BUILD_TIME_VAR: &str = "SINGLELOAD_BUILD_TIME";
+/// Environment variable holding the version of Singleload that made the build
+pub const VERSION_VAR: &str = "SINGLELOAD_VERSION";
+
+/// Go variables of package `main` set with `-ldflags -X`; Go leaves the
+/// flag alone for programs that do not declare them
+pub const GO_SOURCE_SHA256: &str = "main.singleloadSourceSHA256";
+pub const GO_BUILD_TIME: &str = "main.singleloadBuildTime";
+pub const GO_VERSION: &str = "main.singleloadVersion";
+
+/// What a script was built from, when, and by which Singleload
+#[derive(Debug, Clone, PartialEq)]
+pub struct BuildMetadata {
+    pub source_sha256: String,
+    pub build_time: DateTime<Utc>,
+    pub version: String,
+}
+
+impl BuildMetadata {
+    /// Metadata of a build of `content` starting now. Reproducible builds
+    /// take their time from [`reproducible::SOURCE_DATE_EPOCH`] instead.
+    pub fn new(content: &[u8], reproducible: bool) -> Self {
+        let build_time = match reproducible {
+            true => DateTime::from_timestamp(reproducible::SOURCE_DATE_EPOCH as i64, 0).unwrap_or_default(),
+            false => Utc::now(),
+        };
+        Self {
+            source_sha256: hex::encode(Sha256::digest(content)),
+            build_time,
+            version: env!("CARGO_PKG_VERSION").to_string(),
+        }
+    }
+
+    pub fn build_time_rfc3339(&self) -> String {
+        self.build_time.to_rfc3339_opts(SecondsFormat::Secs, true)
+    }
+
+    /// Variables of the build and run containers
+    pub fn env(&self) -> Vec<(String, String)> {
+        vec![
+            (SOURCE_SHA256_VAR.to_string(), self.source_sha256.clone()),
+            (BUILD_TIME_VAR.to_string(), self.build_time_rfc3339()),
+            (VERSION_VAR.to_string(), self.version.clone()),
+        ]
+    }
+
+    /// `flags` with the metadata added for `language`'s compiler. For Go the
+    /// `-X` settings go into the last `-ldflags`, since `go build` only
+    /// keeps the last one; other compilers read the environment instead.
+    pub fn stamp_flags(&self, language: &str, flags: &[String]) -> Vec<String> {
+        let mut flags = flags.to_vec();
+        if language != "go" {
+            return flags;
+        }
+        let settings = format!(
+            "-X {}={} -X {}={} -X {}={}",
+            GO_SOURCE_SHA256,
+            self.source_sha256,
+            GO_BUILD_TIME,
+            self.build_time_rfc3339(),
+            GO_VERSION,
+            self.version
+        );
+        let last = flags
+            .iter()
+            .rposition(|f| f == "-ldflags" || f == "--ldflags" || f.starts_with("-ldflags=") || f.starts_with("--ldflags="));
+        match last {
+            // `-ldflags "-s -w"`: the value is the next word
+            Some(index) if !flags[index].contains('=') && index + 1 < flags.len() => {
+                flags[index + 1] = format!("{} {}", flags[index + 1], settings);
+            }
+            Some(index) if flags[index].contains('=') => {
+                flags[index] = format!("{} {}", flags[index], settings);
+            }
+            _ => flags.push(format!("-ldflags={}", settings)),
+        }
+        flags
+    }
+}
@@ -0,0 +1,237 @@
+use crate::errors::SingleloadError;
+use crate::events::{Event, EventSink};
+use crate::types::ExecutionResult;
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::net::{SocketAddr, ToSocketAddrs};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream};
+use tracing::{debug, info};
+
+/// Upper bounds, in seconds, of the run duration histogram's buckets
+const DURATION_BUCKETS: &[f64] = &[0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0, 60.0, 300.0];
+
+/// Largest request head the endpoint reads before giving up
+const MAX_REQUEST_BYTES: usize = 8 * 1024;
+
+/// Counters a daemon keeps about the runs it serves, exposed to Prometheus
+/// by [`serve`]. Clones share the same counters.
+#[derive(Debug, Clone, Default)]
+pub struct Metrics {
+    inner: Arc<Inner>,
+}
+
+#[derive(Debug, Default)]
+struct Inner {
+    builds: Mutex<BTreeMap<String, u64>>,
+    cache_hits: Mutex<BTreeMap<String, u64>>,
+    runs: Mutex<BTreeMap<String, u64>>,
+    durations: Mutex<Histogram>,
+    active: AtomicU64,
+    queued: AtomicU64,
+}
+
+#[derive(Debug, Default)]
+struct Histogram {
+    counts: [u64; DURATION_BUCKETS.len()],
+    count: u64,
+    sum: f64,
+}
+
+/// Marks a run as waiting for or holding a container slot until dropped
+pub struct Tracked<'a> {
+    gauge: &'a AtomicU64,
+}
+
+impl Drop for Tracked<'_> {
+    fn drop(&mut self) {
+        self.gauge.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+impl Metrics {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// An event sink counting the builds and build cache hits of a run
+    pub fn sink(&self) -> EventSink {
+        let metrics = self.clone();
+        EventSink::new(move |event| match event {
+            Event::BuildStarted { language } => increment(&metrics.inner.builds, language),
+            Event::BuildCached { language } => increment(&metrics.inner.cache_hits, language),
+            _ => {}
+        })
+    }
+
+    /// Counts a request waiting for a container slot
+    pub fn queued(&self) -> Tracked<'_> {
+        self.inner.queued.fetch_add(1, Ordering::Relaxed);
+        Tracked { gauge: &self.inner.queued }
+    }
+
+    /// Counts a run holding a container slot
+    pub fn active(&self) -> Tracked<'_> {
+        self.inner.active.fetch_add(1, Ordering::Relaxed);
+        Tracked { gauge: &self.inner.active }
+    }
+
+    /// Records a finished run: its status (`success`, `failed`, `timeout`,
+    /// `error`, ...) and how long it took, builds included
+    pub fn record_run(&self, result: Option<&ExecutionResult>) {
+        let status = result.map(|r| r.status.as_str()).unwrap_or("error");
+        increment(&self.inner.runs, status);
+        if let Some(result) = result {
+            let seconds = result.duration_ms as f64 / 1000.0;
+            let mut histogram = self.inner.durations.lock().unwrap();
+            for (count, bound) in histogram.counts.iter_mut().zip(DURATION_BUCKETS) {
+                if seconds <= *bound {
+                    *count += 1;
+                }
+            }
+            histogram.count += 1;
+            histogram.sum += seconds;
+        }
+    }
+
+    /// The metrics in the Prometheus text exposition format
+    pub fn render(&self) -> String {
+        let mut out = String::new();
+        counter(
+            &mut out,
+            "singleload_builds_total",
+            "Builds run, by language",
+            "language",
+            &self.inner.builds.lock().unwrap(),
+        );
+        counter(
+            &mut out,
+            "singleload_build_cache_hits_total",
+            "Builds skipped because the build cache had the artifact, by language",
+            "language",
+            &self.inner.cache_hits.lock().unwrap(),
+        );
+        counter(
+            &mut out,
+            "singleload_runs_total",
+            "Runs served, by result status",
+            "status",
+            &self.inner.runs.lock().unwrap(),
+        );
+
+        let histogram = self.inner.durations.lock().unwrap();
+        let name = "singleload_run_duration_seconds";
+        let _ = writeln!(out, "# HELP {} Time from request to result, builds included", name);
+        let _ = writeln!(out, "# TYPE {} histogram", name);
+        for (count, bound) in histogram.counts.iter().zip(DURATION_BUCKETS) {
+            let _ = writeln!(out, "{}_bucket{{le=\"{}\"}} {}", name, bound, count);
+        }
+        let _ = writeln!(out, "{}_bucket{{le=\"+Inf\"}} {}", name, histogram.count);
+        let _ = writeln!(out, "{}_sum {}", name, histogram.sum);
+        let _ = writeln!(out, "{}_count {}", name, histogram.count);
+        drop(histogram);
+
+        gauge(
+            &mut out,
+            "singleload_active_runs",
+            "Runs holding a container slot",
+            self.inner.active.load(Ordering::Relaxed),
+        );
+        gauge(
+            &mut out,
+            "singleload_queued_runs",
+            "Runs waiting for a container slot",
+            self.inner.queued.load(Ordering::Relaxed),
+        );
+        out
+    }
+}
+
+fn increment(counts: &Mutex<BTreeMap<String, u64>>, label: &str) {
+    *counts.lock().unwrap().entry(label.to_string()).or_default() += 1;
+}
+
+fn counter(out: &mut String, name: &str, help: &str, label: &str, counts: &BTreeMap<String, u64>) {
+    let _ = writeln!(out, "# HELP {} {}", name, help);
+    let _ = writeln!(out, "# TYPE {} counter", name);
+    for (value, count) in counts {
+        let _ = writeln!(out, "{}{{{}=\"{}\"}} {}", name, label, escape_label(value), count);
+    }
+}
+
+fn gauge(out: &mut String, name: &str, help: &str, value: u64) {
+    let _ = writeln!(out, "# HELP {} {}", name, help);
+    let _ = writeln!(out, "# TYPE {} gauge", name);
+    let _ = writeln!(out, "{} {}", name, value);
+}
+
+fn escape_label(value: &str) -> String {
+    value.replace('\\', "\\\\").replace('"', "\\\"").replace('\n', "\\n")
+}
+
+/// Parses a listen address for `--metrics` and `serve --listen`:
+/// `HOST:PORT`, or `:PORT` for the loopback interface like `--dap`. Other
+/// hosts are only reached with an explicit address such as `0.0.0.0:PORT`.
+pub fn parse_addr(value: &str) -> Result<SocketAddr, SingleloadError> {
+    let invalid = || SingleloadError::InvalidInput(format!("Invalid listen address '{}', expected HOST:PORT or :PORT", value));
+    let value = match value.strip_prefix(':') {
+        Some(port) => format!("127.0.0.1:{}", port),
+        None => value.to_string(),
+    };
+    value.to_socket_addrs().map_err(|_| invalid())?.next().ok_or_else(invalid)
+}
+
+/// Answers `GET /metrics` on `listener` with the daemon's metrics until the
+/// task is dropped. Nothing is sent anywhere; Prometheus scrapes it.
+pub async fn serve(listener: TcpListener, metrics: Metrics) {
+    if let Ok(addr) = listener.local_addr() {
+        info!("Metrics available at http://{}/metrics", addr);
+    }
+    loop {
+        let Ok((stream, _)) = listener.accept().await else {
+            continue;
+        };
+        let metrics = metrics.clone();
+        tokio::spawn(async move {
+            if let Err(e) = respond(stream, &metrics).await {
+                debug!("Metrics request failed: {}", e);
+            }
+        });
+    }
+}
+
+async fn respond(mut stream: TcpStream, metrics: &Metrics) -> std::io::Result<()> {
+    let mut head = Vec::new();
+    let mut buf = [0u8; 1024];
+    while !head.windows(4).any(|w| w == b"\r\n\r\n") && head.len() < MAX_REQUEST_BYTES {
+        let n = stream.read(&mut buf).await?;
+        if n == 0 {
+            break;
+        }
+        head.extend_from_slice(&buf[..n]);
+    }
+
+    let head = String::from_utf8_lossy(&head);
+    let mut request_line = head.lines().next().unwrap_or_default().split_whitespace();
+    let (method, path) = (request_line.next(), request_line.next());
+    let path = path.map(|p| p.split('?').next().unwrap_or(p));
+    let (status, content_type, body) = match (method, path) {
+        (Some("GET" | "HEAD"), Some("/metrics")) => ("200 OK", "text/plain; version=0.0.4", metrics.render()),
+        (Some("GET" | "HEAD"), _) => ("404 Not Found", "text/plain", "Not found, try /metrics\n".to_string()),
+        _ => ("405 Method Not Allowed", "text/plain", "Only GET is supported\n".to_string()),
+    };
+
+    let mut response = format!(
+        "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+        status,
+        content_type,
+        body.len()
+    );
+    if method != Some("HEAD") {
+        response.push_str(&body);
+    }
+    stream.write_all(response.as_bytes()).await?;
+    stream.shutdown().await
+}
@@ -0,0 +1,233 @@
+use crate::batch::BatchItem;
+use crate::logs::{OutputStream, OutputTap, OutputTaps};
+use clap::ValueEnum;
+use std::collections::HashMap;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+
+/// Colors the prefixes of scripts cycle through: cyan, yellow, green,
+/// magenta, blue, and their bright variants
+const COLORS: &[&str] = &["36", "33", "32", "35", "34", "96", "93", "92", "95", "94"];
+
+/// How `run-all` shows the output of scripts running at the same time
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum OutputMode {
+    /// Lines as they arrive, each prefixed with the script it came from
+    #[default]
+    Interleaved,
+    /// All of a script's output at once when it finishes
+    Grouped,
+    /// Only whether each script passed
+    Quiet,
+}
+
+/// Keeps the output of concurrent runs readable, the way docker-compose
+/// does: output is split into whole lines, so lines of two scripts never
+/// mix, and every line is labelled with its script in a color of its own.
+/// Cheap to clone; clones write to the same output.
+#[derive(Clone)]
+pub struct Multiplexer {
+    shared: Arc<Shared>,
+}
+
+struct Shared {
+    mode: OutputMode,
+    color: bool,
+    /// Width labels are padded to, so the output lines up
+    width: usize,
+    /// Output a grouped script keeps before the rest is dropped
+    limit: usize,
+    panes: Mutex<HashMap<PathBuf, Pane>>,
+    out: Mutex<Box<dyn Write + Send>>,
+}
+
+/// Output of one script
+struct Pane {
+    label: String,
+    color: &'static str,
+    /// Incomplete last line per stream
+    partial: [Vec<u8>; 2],
+    /// Lines held back until the script finishes, in grouped mode
+    lines: Vec<String>,
+    held: usize,
+    truncated: bool,
+    /// Whether any output arrived through the tap
+    tapped: bool,
+}
+
+impl Multiplexer {
+    /// Multiplexes the output of `scripts` into `out`. Scripts are labelled
+    /// with their file names, or their paths where two share a name;
+    /// grouped mode holds up to `limit` bytes of each.
+    pub fn new(mode: OutputMode, scripts: &[PathBuf], color: bool, limit: usize, out: Box<dyn Write + Send>) -> Self {
+        let name = |script: &Path| script.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+        let mut counts: HashMap<String, usize> = HashMap::new();
+        for script in scripts {
+            *counts.entry(name(script)).or_default() += 1;
+        }
+        let panes: HashMap<PathBuf, Pane> = scripts
+            .iter()
+            .enumerate()
+            .map(|(idx, script)| {
+                let label = match counts[&name(script)] {
+                    1 => name(script),
+                    _ => script.display().to_string(),
+                };
+                (script.clone(), Pane::new(label, COLORS[idx % COLORS.len()]))
+            })
+            .collect();
+        let width = panes.values().map(|pane| pane.label.chars().count()).max().unwrap_or(0);
+        Self {
+            shared: Arc::new(Shared {
+                mode,
+                color,
+                width,
+                limit,
+                panes: Mutex::new(panes),
+                out: Mutex::new(out),
+            }),
+        }
+    }
+
+    /// Taps for the executor, each writing into the pane of its script
+    pub fn taps(&self) -> OutputTaps {
+        let shared = self.shared.clone();
+        Arc::new(move |script: &Path| -> OutputTap {
+            let shared = shared.clone();
+            let script = script.to_path_buf();
+            Arc::new(move |stream, data| shared.write(&script, stream, data))
+        })
+    }
+
+    /// Writes what is left of a finished script's output and whether it
+    /// passed. Output that never went through a tap, such as a failed
+    /// build's, is taken from the result.
+    pub fn finish(&self, item: &BatchItem) {
+        let shared = &self.shared;
+        let mut panes = shared.panes.lock().unwrap();
+        let pane = panes
+            .entry(item.script.clone())
+            .or_insert_with(|| Pane::new(item.script.display().to_string(), COLORS[0]));
+        for stream in [OutputStream::Stdout, OutputStream::Stderr] {
+            let rest = std::mem::take(&mut pane.partial[index(stream)]);
+            if !rest.is_empty() {
+                shared.line(pane, &rest);
+            }
+        }
+        if !pane.tapped {
+            for line in item.result.stdout.lines().chain(item.result.stderr.lines()) {
+                shared.line(pane, line.as_bytes());
+            }
+        }
+
+        let script = item.script.display().to_string();
+        let mut out = shared.out.lock().unwrap();
+        match shared.mode {
+            OutputMode::Interleaved => {
+                let subject = if item.passed() { "passed" } else { "failed" };
+                let _ = writeln!(out, "{}{}", shared.prefix(pane), status(item, shared.color, subject));
+            }
+            OutputMode::Grouped => {
+                let _ = writeln!(out, "{}", status(item, shared.color, &script));
+                for line in pane.lines.drain(..) {
+                    let _ = writeln!(out, "    {}", line);
+                }
+                if pane.truncated {
+                    let _ = writeln!(out, "    [output truncated]");
+                }
+            }
+            OutputMode::Quiet => {
+                let _ = writeln!(out, "{}", status(item, shared.color, &script));
+            }
+        }
+        let _ = out.flush();
+    }
+}
+
+impl Pane {
+    fn new(label: String, color: &'static str) -> Self {
+        Self {
+            label,
+            color,
+            partial: [Vec::new(), Vec::new()],
+            lines: Vec::new(),
+            held: 0,
+            truncated: false,
+            tapped: false,
+        }
+    }
+}
+
+impl Shared {
+    fn write(&self, script: &Path, stream: OutputStream, data: &[u8]) {
+        if self.mode == OutputMode::Quiet {
+            return;
+        }
+        let mut panes = self.panes.lock().unwrap();
+        let Some(pane) = panes.get_mut(script) else {
+            return;
+        };
+        pane.tapped = true;
+        let mut partial = std::mem::take(&mut pane.partial[index(stream)]);
+        partial.extend_from_slice(data);
+        let mut start = 0;
+        while let Some(end) = partial[start..].iter().position(|b| *b == b'\n') {
+            self.line(pane, &partial[start..start + end]);
+            start += end + 1;
+        }
+        partial.drain(..start);
+        pane.partial[index(stream)] = partial;
+    }
+
+    /// Writes a complete line of a script's output, or holds it back in
+    /// grouped mode
+    fn line(&self, pane: &mut Pane, line: &[u8]) {
+        let line = String::from_utf8_lossy(line);
+        let line = line.strip_suffix('\r').unwrap_or(&line);
+        match self.mode {
+            OutputMode::Interleaved => {
+                let mut out = self.out.lock().unwrap();
+                let _ = writeln!(out, "{}{}", self.prefix(pane), line);
+                let _ = out.flush();
+            }
+            OutputMode::Grouped if pane.held + line.len() > self.limit => pane.truncated = true,
+            OutputMode::Grouped => {
+                pane.held += line.len();
+                pane.lines.push(line.to_string());
+            }
+            OutputMode::Quiet => {}
+        }
+    }
+
+    fn prefix(&self, pane: &Pane) -> String {
+        let label = format!("{:<width$} |", pane.label, width = self.width);
+        match self.color {
+            true => format!("\x1b[{}m{}\x1b[0m ", pane.color, label),
+            false => format!("{} ", label),
+        }
+    }
+}
+
+fn index(stream: OutputStream) -> usize {
+    match stream {
+        OutputStream::Stdout => 0,
+        OutputStream::Stderr => 1,
+    }
+}
+
+/// `✓ <subject> (120ms)`, `✗ <subject> (exit code 2, 120ms)` or
+/// `✗ <subject>: <error>`
+fn status(item: &BatchItem, color: bool, subject: &str) -> String {
+    let result = &item.result;
+    let (mark, detail) = match (&result.error, item.passed()) {
+        (_, true) => ("✓", format!(" ({}ms)", result.duration_ms)),
+        (Some(error), false) => ("✗", format!(": {}", error)),
+        (None, false) => ("✗", format!(" (exit code {}, {}ms)", result.exit_code, result.duration_ms)),
+    };
+    match (color, item.passed()) {
+        (true, true) => format!("\x1b[32m{}\x1b[0m {}{}", mark, subject, detail),
+        (true, false) => format!("\x1b[31m{}\x1b[0m {}{}", mark, subject, detail),
+        (false, _) => format!("{} {}{}", mark, subject, detail),
+    }
+}
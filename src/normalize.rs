@@ -0,0 +1,221 @@
+use crate::directives::Directives;
+use std::borrow::Cow;
+
+/// Languages whose build cache keys ignore comments; the others are keyed
+/// on their source as written
+pub const NORMALIZED_LANGUAGES: &[&str] = &["c", "cpp", "cuda", "dotnet", "go", "opencl", "rust"];
+
+/// Directives that only change how a built program is run, never the build,
+/// so editing them reuses the cached build
+pub const RUNTIME_DIRECTIVES: &[&str] = &["arg", "deprecated", "entry", "env", "net", "normalize", "post", "pre", "requires"];
+
+/// Comments that compilers read, kept in Go sources
+const GO_PRAGMAS: &[&str] = &["//go:", "//export ", "//line ", "// +build", "//extern "];
+
+/// `content` as build cache keys see it: comments blanked and trailing
+/// whitespace dropped, so edits to them alone keep the key. Line breaks stay
+/// where they were, so the line numbers a cached build reports in panics,
+/// stack traces and debug info still match the source. String literals are
+/// kept whole, trailing whitespace included, and so are Rust doc comments,
+/// which are attributes macros read. Sources that are not UTF-8, and Go
+/// sources using cgo, whose preamble is a comment, are kept as they are.
+pub fn normalize_source<'a>(language: &str, content: &'a [u8]) -> Cow<'a, [u8]> {
+    if !NORMALIZED_LANGUAGES.contains(&language) {
+        return Cow::Borrowed(content);
+    }
+    let Ok(source) = std::str::from_utf8(content) else {
+        return Cow::Borrowed(content);
+    };
+    if language == "go" && source.contains("import \"C\"") {
+        return Cow::Borrowed(content);
+    }
+    Cow::Owned(strip_comments(language, source).into_bytes())
+}
+
+/// The directives that can change a build, one per line, for cache keys
+/// that no longer see them in the comments
+pub fn build_directives(directives: &Directives) -> Vec<u8> {
+    let mut key = Vec::new();
+    for directive in directives.iter().filter(|d| !RUNTIME_DIRECTIVES.contains(&d.name.as_str())) {
+        key.extend_from_slice(format!("{} {}\n", directive.name, directive.value.trim()).as_bytes());
+    }
+    key
+}
+
+/// Blanks the comments of `source` and drops trailing whitespace from its
+/// lines, except inside literals and the comments that are kept
+fn strip_comments(language: &str, source: &str) -> String {
+    let chars: Vec<char> = source.chars().collect();
+    let mut out = String::with_capacity(source.len());
+    // Where the last literal or kept comment ended: whitespace before it
+    // is part of it
+    let mut kept = 0;
+    let mut i = 0;
+    while i < chars.len() {
+        let c = chars[i];
+        let next = chars.get(i + 1).copied();
+        match c {
+            '/' if next == Some('/') => {
+                let end = chars[i..].iter().position(|&c| c == '\n').map_or(chars.len(), |n| i + n);
+                let comment: String = chars[i..end].iter().collect();
+                let pragma = language == "go" && GO_PRAGMAS.iter().any(|p| comment.starts_with(p));
+                if pragma || (language == "rust" && is_doc_comment(&chars[i..end])) {
+                    out.push_str(&comment);
+                }
+                i = end;
+            }
+            '/' if next == Some('*') => {
+                // Rust block comments nest
+                let (mut depth, mut j) = (1, i + 2);
+                while j < chars.len() && depth > 0 {
+                    match (chars[j], chars.get(j + 1)) {
+                        ('*', Some('/')) => {
+                            depth -= 1;
+                            j += 2;
+                        }
+                        ('/', Some('*')) if language == "rust" => {
+                            depth += 1;
+                            j += 2;
+                        }
+                        _ => j += 1,
+                    }
+                }
+                let j = j.min(chars.len());
+                if language == "rust" && is_doc_comment(&chars[i..j]) {
+                    out.extend(&chars[i..j]);
+                    kept = out.len();
+                } else {
+                    // A comment separates tokens like a space does
+                    out.push(' ');
+                    for _ in chars[i..j].iter().filter(|&&c| c == '\n') {
+                        end_line(&mut out, kept);
+                    }
+                }
+                i = j;
+            }
+            '"' | '`' if c == '"' || language == "go" => {
+                let end = quoted_end(&chars, i, c, language == "dotnet" && prev(&chars, i) == Some('@'));
+                out.extend(&chars[i..end]);
+                kept = out.len();
+                i = end;
+            }
+            '\'' if is_char_literal(&chars, i, language) => {
+                let end = quoted_end(&chars, i, '\'', false);
+                out.extend(&chars[i..end]);
+                kept = out.len();
+                i = end;
+            }
+            'r' | 'R' if raw_string(&chars, i, language).is_some() => {
+                let end = raw_string(&chars, i, language).unwrap_or(chars.len());
+                out.extend(&chars[i..end]);
+                kept = out.len();
+                i = end;
+            }
+            '\n' => {
+                end_line(&mut out, kept);
+                i += 1;
+            }
+            c => {
+                out.push(c);
+                i += 1;
+            }
+        }
+    }
+    trim_line(&mut out, kept);
+    out
+}
+
+/// Ends a line of `out`, dropping the whitespace it ends with after `kept`
+fn end_line(out: &mut String, kept: usize) {
+    trim_line(out, kept);
+    out.push('\n');
+}
+
+fn trim_line(out: &mut String, kept: usize) {
+    let end = out.trim_end_matches(|c: char| c.is_whitespace() && c != '\n').len().max(kept);
+    out.truncate(end);
+}
+
+/// Whether a Rust comment is documentation: `///` and `/**` outer docs,
+/// but not `////` or `/***`, and `//!` and `/*!` inner docs
+fn is_doc_comment(comment: &[char]) -> bool {
+    match comment {
+        ['/', '/', '!', ..] | ['/', '*', '!', ..] => true,
+        ['/', '/', '/', next, ..] => *next != '/',
+        ['/', '/', '/'] => true,
+        ['/', '*', '*', next, ..] => *next != '*' && *next != '/',
+        _ => false,
+    }
+}
+
+fn prev(chars: &[char], i: usize) -> Option<char> {
+    i.checked_sub(1).map(|p| chars[p])
+}
+
+/// End of the literal quoted with `quote` that starts at `start`, past the
+/// closing quote. Backslash escapes, except in Go raw strings and C#
+/// verbatim strings, where a doubled quote is one.
+fn quoted_end(chars: &[char], start: usize, quote: char, verbatim: bool) -> usize {
+    let mut j = start + 1;
+    while j < chars.len() {
+        match chars[j] {
+            '\\' if !verbatim && quote != '`' => j += 2,
+            c if c == quote && verbatim && chars.get(j + 1) == Some(&quote) => j += 2,
+            c if c == quote => return j + 1,
+            _ => j += 1,
+        }
+    }
+    chars.len()
+}
+
+/// Whether the `'` at `i` opens a character literal rather than being a
+/// Rust lifetime or a C++ digit separator such as `1'000`
+fn is_char_literal(chars: &[char], i: usize, language: &str) -> bool {
+    let mut word = i;
+    while word > 0 && (chars[word - 1].is_ascii_alphanumeric() || chars[word - 1] == '_') {
+        word -= 1;
+    }
+    if word < i && chars[word].is_ascii_digit() {
+        return false;
+    }
+    if language == "rust" {
+        return chars.get(i + 1) == Some(&'\\') || chars.get(i + 2) == Some(&'\'');
+    }
+    true
+}
+
+/// End of the Rust (`r#"..."#`) or C++ (`R"delim(...)delim"`) raw string
+/// starting at `i`, if one does
+fn raw_string(chars: &[char], i: usize, language: &str) -> Option<usize> {
+    // `br"..."` in Rust, `u8R"(...)"` and `LR"(...)"` in C++
+    let mut word = i;
+    while word > 0 && chars[word - 1].is_ascii_alphanumeric() {
+        word -= 1;
+    }
+    let prefix: String = chars[word..i].iter().collect();
+    match (language, chars[i]) {
+        ("rust", 'r') if prefix.is_empty() || prefix == "b" || prefix == "c" => {
+            let hashes = chars[i + 1..].iter().take_while(|&&c| c == '#').count();
+            if chars.get(i + 1 + hashes) != Some(&'"') {
+                return None;
+            }
+            let close: Vec<char> = std::iter::once('"').chain(std::iter::repeat('#').take(hashes)).collect();
+            let body = i + 2 + hashes;
+            let end = (body..chars.len()).find(|&j| chars[j..].starts_with(&close));
+            Some(end.map_or(chars.len(), |j| j + close.len()))
+        }
+        ("c" | "cpp" | "cuda" | "opencl", 'R') if ["", "u8", "u", "U", "L"].contains(&prefix.as_str()) => {
+            if chars.get(i + 1) != Some(&'"') {
+                return None;
+            }
+            let open = chars[i + 2..].iter().position(|&c| c == '(' || c == '"' || c == '\n')? + i + 2;
+            if chars[open] != '(' {
+                return None;
+            }
+            let close: Vec<char> = std::iter::once(')').chain(chars[i + 2..open].iter().copied()).chain(Some('"')).collect();
+            let end = (open..chars.len()).find(|&j| chars[j..].starts_with(&close));
+            Some(end.map_or(chars.len(), |j| j + close.len()))
+        }
+        _ => None,
+    }
+}
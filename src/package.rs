@@ -0,0 +1,32 @@
+use std::path::Path;
+
+/// Name of the binary inside a packaged image
+pub const IMAGE_BINARY: &str = "app";
+
+/// Containerfile that copies the binary onto `base` and runs it as the
+/// image entrypoint, as the distroless nonroot user
+pub fn containerfile(base: &str) -> String {
+    format!(
+        "FROM {base}\n\
+         COPY --chmod=0755 {bin} /{bin}\n\
+         USER nonroot:nonroot\n\
+         ENTRYPOINT [\"/{bin}\"]\n",
+        base = base,
+        bin = IMAGE_BINARY,
+    )
+}
+
+/// Image tag used when `--tag` is omitted: `singleload/<script>:latest`
+pub fn default_tag(script: &Path) -> String {
+    let stem = script
+        .file_stem()
+        .map(|s| s.to_string_lossy().to_lowercase())
+        .unwrap_or_default();
+    // Repository names only allow lowercase alphanumerics and separators
+    let name: String = stem
+        .chars()
+        .map(|c| if c.is_ascii_alphanumeric() || c == '.' || c == '-' { c } else { '-' })
+        .collect();
+    let name = name.trim_matches(|c| c == '-' || c == '.');
+    format!("singleload/{}:latest", if name.is_empty() { "app" } else { name })
+}
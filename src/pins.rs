@@ -0,0 +1,128 @@
+use crate::toolchain::ToolchainStore;
+use std::path::{Path, PathBuf};
+use tracing::{debug, warn};
+
+/// A toolchain version pinned by the project a script is in
+#[derive(Debug, Clone, PartialEq)]
+pub struct ProjectPin {
+    pub version: String,
+    /// The file the version was read from
+    pub file: PathBuf,
+}
+
+/// Files pinning `language`'s version, in the order they are looked for in
+/// each directory
+pub fn pin_files(language: &str) -> &'static [&'static str] {
+    match language {
+        "go" => &["go.mod"],
+        "node" => &[".nvmrc", ".node-version"],
+        "python" => &[".python-version"],
+        "rust" => &["rust-toolchain.toml", "rust-toolchain"],
+        _ => &[],
+    }
+}
+
+/// The version the project around `dir` pins for `language`, looked up in
+/// `dir` and its parents up to the root of the repository (the directory
+/// with `.git`). Pins that are not full release numbers, such as `stable`,
+/// `pypy3.10` or `3.12`, are skipped.
+pub fn find(language: &str, dir: &Path) -> Option<ProjectPin> {
+    let files = pin_files(language);
+    if files.is_empty() {
+        return None;
+    }
+    for dir in dir.ancestors() {
+        for name in files {
+            let file = dir.join(name);
+            let Ok(content) = std::fs::read_to_string(&file) else {
+                continue;
+            };
+            match parse(name, &content) {
+                Some(version) if ToolchainStore::validate_version(&version).is_ok() => {
+                    return Some(ProjectPin { version, file });
+                }
+                // A partial release would float to whatever is newest
+                Some(version) if version.split('.').all(|part| part.parse::<u64>().is_ok()) => warn!(
+                    "Ignoring {} pin '{}' in {}: toolchains are pinned to a full release such as 1.22.3",
+                    language,
+                    version,
+                    file.display()
+                ),
+                Some(version) => debug!("Ignoring {} pin '{}' in {}", language, version, file.display()),
+                None => {}
+            }
+            // The nearest file decides, even when it pins nothing usable
+            return None;
+        }
+        if dir.join(".git").exists() {
+            break;
+        }
+    }
+    None
+}
+
+/// The version a pin file of the given name sets, if any
+pub fn parse(name: &str, content: &str) -> Option<String> {
+    match name {
+        "go.mod" => parse_go_mod(content),
+        ".python-version" => content
+            .lines()
+            .map(str::trim)
+            .find(|line| !line.is_empty() && !line.starts_with('#'))
+            .map(String::from),
+        // nvm and the version managers reading .node-version take `v22.11.0`
+        // as well as `22.11.0`
+        ".nvmrc" | ".node-version" => content
+            .lines()
+            .map(str::trim)
+            .find(|line| !line.is_empty() && !line.starts_with('#'))
+            .map(|line| line.trim_start_matches('v').to_string()),
+        "rust-toolchain.toml" => parse_rust_toolchain_toml(content),
+        // The legacy file holds either the channel alone or the TOML form
+        "rust-toolchain" => match content.trim() {
+            channel if !channel.is_empty() && !channel.contains('\n') && !channel.contains('=') => {
+                Some(channel.to_string())
+            }
+            _ => parse_rust_toolchain_toml(content),
+        },
+        _ => None,
+    }
+}
+
+/// `toolchain go1.22.3` when there is one, otherwise the `go 1.22` line
+fn parse_go_mod(content: &str) -> Option<String> {
+    let mut go = None;
+    for line in content.lines() {
+        let line = line.split("//").next().unwrap_or_default().trim();
+        let mut words = line.split_whitespace();
+        match (words.next(), words.next()) {
+            (Some("toolchain"), Some(name)) => {
+                if let Some(version) = name.strip_prefix("go") {
+                    return Some(version.to_string());
+                }
+            }
+            (Some("go"), Some(version)) => go = Some(go_release(version)),
+            _ => {}
+        }
+    }
+    go
+}
+
+/// Since Go 1.21 the language version `1.22` is not a release; its first
+/// release is `1.22.0`
+pub fn go_release(version: &str) -> String {
+    let parts: Vec<&str> = version.split('.').collect();
+    match parts.as_slice() {
+        ["1", minor] if minor.parse::<u32>().is_ok_and(|minor| minor >= 21) => format!("{}.0", version),
+        _ => version.to_string(),
+    }
+}
+
+fn parse_rust_toolchain_toml(content: &str) -> Option<String> {
+    let table: toml::Table = toml::from_str(content).ok()?;
+    table
+        .get("toolchain")?
+        .get("channel")?
+        .as_str()
+        .map(String::from)
+}
@@ -0,0 +1,217 @@
+use crate::directives::Directives;
+use crate::errors::SingleloadError;
+use crate::executor::{CancelReceiver, Executor};
+use crate::logs::{OutputStream, OutputTap};
+use crate::types::ExecutionResult;
+use serde::Serialize;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::time::Instant;
+
+/// Extension of pipeline files, which `pipe` reads instead of running
+pub const PIPELINE_EXTENSION: &str = "pipe";
+
+/// Scripts chained stdout to stdin, described by the directive block of a
+/// pipeline file, one `step` per script:
+///
+/// ```text
+/// # singleload: step extract.py
+/// # singleload: step transform.go lang=go
+/// ```
+#[derive(Debug, Clone)]
+pub struct Pipeline {
+    pub steps: Vec<Step>,
+}
+
+#[derive(Debug, Clone)]
+pub struct Step {
+    /// Script or directory project, relative to the pipeline file
+    pub script: PathBuf,
+    /// Language, detected from the script when omitted
+    pub lang: Option<String>,
+}
+
+/// Outcome of one step
+#[derive(Debug, Serialize)]
+pub struct StepResult {
+    pub script: PathBuf,
+    /// Everything the step wrote to stdout, byte for byte; the next step's input
+    #[serde(skip)]
+    pub stdout: Vec<u8>,
+    #[serde(flatten)]
+    pub result: ExecutionResult,
+}
+
+#[derive(Debug, Serialize)]
+pub struct PipelineResult {
+    pub status: String,
+    /// Exit code of the first step that failed, or 0
+    pub exit_code: u32,
+    /// Output of the last step
+    #[serde(serialize_with = "lossy")]
+    pub stdout: Vec<u8>,
+    /// Index of the step that failed; later steps did not run
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub failed_step: Option<usize>,
+    pub duration_ms: u64,
+    /// Steps that ran, in order; their stdout is the next step's input
+    pub steps: Vec<StepResult>,
+}
+
+/// Stdout of the step running, collected by the tap [`capture`] returns
+#[derive(Debug, Clone, Default)]
+pub struct Captured(Arc<Mutex<Vec<u8>>>);
+
+impl Captured {
+    /// Takes the output captured so far, leaving the buffer empty
+    pub fn take(&self) -> Vec<u8> {
+        std::mem::take(&mut *self.0.lock().unwrap_or_else(|e| e.into_inner()))
+    }
+}
+
+/// A tap for [`Executor::with_output`] that keeps the stdout of each step
+/// as it was written. A run's result holds it as text, which would mangle
+/// binary data and drop trailing newlines between steps.
+pub fn capture() -> (OutputTap, Captured) {
+    let captured = Captured::default();
+    let buffer = captured.0.clone();
+    let tap: OutputTap = Arc::new(move |stream, data| {
+        if stream == OutputStream::Stdout {
+            buffer.lock().unwrap_or_else(|e| e.into_inner()).extend_from_slice(data);
+        }
+    });
+    (tap, captured)
+}
+
+impl Pipeline {
+    /// True for the files [`Pipeline::load`] reads
+    pub fn is_file(path: &Path) -> bool {
+        path.extension().is_some_and(|e| e == PIPELINE_EXTENSION)
+    }
+
+    /// Reads a pipeline file, resolving scripts against its directory
+    pub fn load(path: &Path) -> Result<Self, SingleloadError> {
+        let content = std::fs::read(path)?;
+        let invalid = |line: usize, reason: String| {
+            SingleloadError::InvalidInput(format!("{}:{}: {}", path.display(), line, reason))
+        };
+
+        let dir = path.parent().unwrap_or(Path::new(""));
+        let mut steps = Vec::new();
+        for directive in Directives::parse(&content).iter() {
+            if directive.name != "step" {
+                return Err(invalid(
+                    directive.line,
+                    format!("unknown directive '{}'; pipeline files only declare steps", directive.name),
+                ));
+            }
+            let mut words = directive.value.split_whitespace();
+            let script = words
+                .next()
+                .ok_or_else(|| invalid(directive.line, "'step' needs a script, e.g. step extract.py".to_string()))?;
+            let mut step = Step {
+                script: dir.join(script),
+                lang: None,
+            };
+            for word in words {
+                match word.strip_prefix("lang=") {
+                    Some(lang) => step.lang = Some(lang.to_string()),
+                    None => {
+                        return Err(invalid(
+                            directive.line,
+                            format!("unknown step option '{}'; expected lang=<language>", word),
+                        ))
+                    }
+                }
+            }
+            steps.push(step);
+        }
+
+        let pipeline = Self { steps };
+        pipeline.validate()?;
+        Ok(pipeline)
+    }
+
+    /// A pipeline running `scripts` in order, with detected languages
+    pub fn from_scripts(scripts: Vec<PathBuf>) -> Result<Self, SingleloadError> {
+        let pipeline = Self {
+            steps: scripts.into_iter().map(|script| Step { script, lang: None }).collect(),
+        };
+        pipeline.validate()?;
+        Ok(pipeline)
+    }
+
+    fn validate(&self) -> Result<(), SingleloadError> {
+        if self.steps.is_empty() {
+            return Err(SingleloadError::InvalidInput("A pipeline needs at least one step".to_string()));
+        }
+        for step in &self.steps {
+            if !step.script.exists() {
+                return Err(SingleloadError::ScriptNotFound(step.script.display().to_string()));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Runs the steps one after another, each in its own container, feeding
+/// `input` to the first and each step's stdout to the next. `executor`
+/// must pass its output to the tap `captured` came from. Like a shell
+/// pipeline with `pipefail`, the first failing step stops the pipeline and
+/// its exit code is the pipeline's.
+pub async fn run(
+    executor: &Executor,
+    pipeline: &Pipeline,
+    input: Option<Vec<u8>>,
+    captured: &Captured,
+    cancel: CancelReceiver,
+    mut on_step: impl FnMut(usize, &StepResult),
+) -> PipelineResult {
+    let start_time = Instant::now();
+    let mut input = input;
+    let mut steps = Vec::new();
+    let mut failed_step = None;
+
+    for (idx, step) in pipeline.steps.iter().enumerate() {
+        let started = Instant::now();
+        captured.take();
+        let result = executor
+            .run_script_with_input(step.lang.as_deref(), &step.script, false, cancel.clone(), input.as_deref())
+            .await
+            .unwrap_or_else(|e| ExecutionResult::error(e.to_string(), started.elapsed().as_millis() as u64));
+
+        // A truncated output would silently feed the next step partial data
+        let failed = result.exit_code != 0 || result.error.is_some() || result.truncated;
+        let step_result = StepResult {
+            script: step.script.clone(),
+            stdout: captured.take(),
+            result,
+        };
+        on_step(idx, &step_result);
+        input = Some(step_result.stdout.clone());
+        steps.push(step_result);
+
+        if failed {
+            failed_step = Some(idx);
+            break;
+        }
+    }
+
+    let exit_code = match failed_step {
+        Some(idx) => steps[idx].result.exit_code.max(1),
+        None => 0,
+    };
+    PipelineResult {
+        status: if failed_step.is_none() { "success" } else { "failed" }.to_string(),
+        exit_code,
+        stdout: steps.last().map(|s| s.stdout.clone()).unwrap_or_default(),
+        failed_step,
+        duration_ms: start_time.elapsed().as_millis() as u64,
+        steps,
+    }
+}
+
+/// Output as text in JSON reports
+fn lossy<S: serde::Serializer>(data: &[u8], serializer: S) -> Result<S::Ok, S::Error> {
+    serializer.serialize_str(&String::from_utf8_lossy(data))
+}
@@ -0,0 +1,241 @@
+use crate::runner::BuildTarget;
+use std::path::{Path, PathBuf};
+
+/// The user's home directory: `HOME`, or `USERPROFILE` on Windows
+pub fn home_dir() -> PathBuf {
+    std::env::var_os("HOME")
+        .or_else(|| cfg!(windows).then(|| std::env::var_os("USERPROFILE")).flatten())
+        .map(PathBuf::from)
+        .unwrap_or_else(std::env::temp_dir)
+}
+
+/// Root of singleload's own data (state, toolchains, installed tools):
+/// `~/.singleload`, or `%LOCALAPPDATA%\singleload` on Windows
+pub fn data_dir() -> PathBuf {
+    if cfg!(windows) {
+        if let Some(dir) = std::env::var_os("LOCALAPPDATA") {
+            return PathBuf::from(dir).join("singleload");
+        }
+    }
+    home_dir().join(".singleload")
+}
+
+/// Build cache root: `$XDG_CACHE_HOME/singleload` or `~/.cache/singleload`,
+/// and `%LOCALAPPDATA%\singleload\cache` on Windows
+pub fn cache_dir() -> PathBuf {
+    if cfg!(windows) {
+        if let Some(dir) = std::env::var_os("LOCALAPPDATA") {
+            return PathBuf::from(dir).join("singleload").join("cache");
+        }
+    }
+    match std::env::var_os("XDG_CACHE_HOME").filter(|d| !d.is_empty()) {
+        Some(dir) => PathBuf::from(dir).join("singleload"),
+        None => home_dir().join(".cache").join("singleload"),
+    }
+}
+
+/// Directory of the user config file: `$XDG_CONFIG_HOME/singleload` or
+/// `~/.config/singleload`, and `%APPDATA%\singleload` on Windows
+pub fn config_dir() -> PathBuf {
+    if cfg!(windows) {
+        if let Some(dir) = std::env::var_os("APPDATA") {
+            return PathBuf::from(dir).join("singleload");
+        }
+    }
+    match std::env::var_os("XDG_CONFIG_HOME").filter(|d| !d.is_empty()) {
+        Some(dir) => PathBuf::from(dir).join("singleload"),
+        None => home_dir().join(".config").join("singleload"),
+    }
+}
+
+/// Directory of files an administrator sets for every user: `/etc/singleload`,
+/// and `%ProgramData%\singleload` on Windows
+pub fn system_config_dir() -> PathBuf {
+    if cfg!(windows) {
+        let root = std::env::var_os("ProgramData").unwrap_or_else(|| "C:\\ProgramData".into());
+        return PathBuf::from(root).join("singleload");
+    }
+    PathBuf::from("/etc/singleload")
+}
+
+/// Files singleload keeps for every user and only an administrator can
+/// change: `/var/cache/singleload`, and `%ProgramData%\singleload\cache` on
+/// Windows
+pub fn system_cache_dir() -> PathBuf {
+    if cfg!(windows) {
+        return system_config_dir().join("cache");
+    }
+    PathBuf::from("/var/cache/singleload")
+}
+
+/// Scratch space for workspaces: `/tmp/singleload`, or under `%TEMP%`
+pub fn temp_dir() -> PathBuf {
+    std::env::temp_dir().join("singleload")
+}
+
+/// The rootless Podman socket of the current user; on Windows, the named
+/// pipe of the default podman machine
+pub fn default_podman_socket() -> String {
+    if cfg!(windows) {
+        return "npipe:////./pipe/podman-machine-default".to_string();
+    }
+    format!(
+        "unix:///run/user/{}/podman/podman.sock",
+        std::env::var("UID").unwrap_or_else(|_| "1000".to_string())
+    )
+}
+
+/// Where the daemon listens: a unix socket, or a named pipe on Windows
+pub fn default_daemon_socket() -> PathBuf {
+    if cfg!(windows) {
+        return PathBuf::from(r"\\.\pipe\singleload-daemon");
+    }
+    temp_dir().join("daemon.sock")
+}
+
+/// A host path as the Podman service sees it, for bind mounts. On Windows
+/// the service runs in the podman machine's WSL distribution, which has the
+/// Windows drives mounted under `/mnt`.
+pub fn podman_path(path: &Path) -> String {
+    let path = path.to_string_lossy();
+    if cfg!(windows) {
+        wsl_path(&path)
+    } else {
+        path.to_string()
+    }
+}
+
+/// `C:\Users\me\tool.go` as WSL sees it, `/mnt/c/Users/me/tool.go`.
+/// Verbatim (`\\?\C:\...`) paths are handled too; other paths only get
+/// forward slashes.
+pub fn wsl_path(path: &str) -> String {
+    let path = path.strip_prefix(r"\\?\").unwrap_or(path);
+    let bytes = path.as_bytes();
+    if bytes.len() >= 2 && bytes[0].is_ascii_alphabetic() && bytes[1] == b':' {
+        let rest = path[2..].replace('\\', "/");
+        return format!("/mnt/{}{}", (bytes[0] as char).to_ascii_lowercase(), rest);
+    }
+    path.replace('\\', "/")
+}
+
+/// Target a compiled tool must be built for to run natively on this
+/// machine; None when `language` cannot be cross-compiled for it. Linux
+/// hosts run what the container builds, so they need no target.
+pub fn host_target(language: &str) -> Option<Option<BuildTarget>> {
+    let os = std::env::consts::OS;
+    if os == "linux" {
+        return Some(None);
+    }
+    let goarch = match std::env::consts::ARCH {
+        "x86_64" => "amd64",
+        "aarch64" => "arm64",
+        _ => return None,
+    };
+    match (language, os) {
+        ("go", "windows" | "macos") => Some(Some(BuildTarget {
+            goos: Some(if os == "macos" { "darwin" } else { "windows" }.to_string()),
+            goarch: Some(goarch.to_string()),
+            triple: None,
+        })),
+        _ => None,
+    }
+}
+
+/// Every process a host child started, so they can be stopped together.
+/// On Windows the child is assigned to a job object, which also kills
+/// whatever is left of the tree when singleload exits; elsewhere the child
+/// leads its own process group (see [`ProcessTree::isolate`]), which is
+/// signalled as a whole.
+pub struct ProcessTree {
+    #[cfg(unix)]
+    group: nix::unistd::Pid,
+    #[cfg(windows)]
+    job: job::Job,
+}
+
+impl ProcessTree {
+    /// Makes `command` start its child in a process group of its own; call
+    /// before spawning a child passed to [`ProcessTree::attach`]
+    pub fn isolate(command: &mut std::process::Command) {
+        #[cfg(unix)]
+        std::os::unix::process::CommandExt::process_group(command, 0);
+        #[cfg(not(unix))]
+        let _ = command;
+    }
+
+    pub fn attach(child: &std::process::Child) -> std::io::Result<Self> {
+        Ok(Self {
+            #[cfg(unix)]
+            group: nix::unistd::Pid::from_raw(child.id() as i32),
+            #[cfg(windows)]
+            job: job::Job::assign(child)?,
+        })
+    }
+
+    /// Kills the child and everything it started
+    pub fn kill(&self) {
+        #[cfg(unix)]
+        let _ = nix::sys::signal::killpg(self.group, nix::sys::signal::Signal::SIGKILL);
+        #[cfg(windows)]
+        self.job.terminate();
+    }
+}
+
+#[cfg(windows)]
+mod job {
+    use std::os::windows::io::AsRawHandle;
+    use windows_sys::Win32::Foundation::{CloseHandle, HANDLE};
+    use windows_sys::Win32::System::JobObjects::{
+        AssignProcessToJobObject, CreateJobObjectW, JobObjectExtendedLimitInformation, SetInformationJobObject,
+        TerminateJobObject, JOBOBJECT_EXTENDED_LIMIT_INFORMATION, JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+    };
+
+    /// A job object that kills its processes when its last handle closes
+    pub struct Job(HANDLE);
+
+    // The handle is only used through thread-safe Win32 calls
+    unsafe impl Send for Job {}
+    unsafe impl Sync for Job {}
+
+    impl Job {
+        pub fn assign(child: &std::process::Child) -> std::io::Result<Self> {
+            // SAFETY: the handle is owned by the returned Job, and `info`
+            // outlives the call that reads it
+            unsafe {
+                let handle = CreateJobObjectW(std::ptr::null(), std::ptr::null());
+                if handle.is_null() {
+                    return Err(std::io::Error::last_os_error());
+                }
+                let job = Job(handle);
+                let mut info: JOBOBJECT_EXTENDED_LIMIT_INFORMATION = std::mem::zeroed();
+                info.BasicLimitInformation.LimitFlags = JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE;
+                let set = SetInformationJobObject(
+                    handle,
+                    JobObjectExtendedLimitInformation,
+                    &info as *const _ as *const std::ffi::c_void,
+                    std::mem::size_of_val(&info) as u32,
+                );
+                if set == 0 || AssignProcessToJobObject(handle, child.as_raw_handle() as HANDLE) == 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+                Ok(job)
+            }
+        }
+
+        pub fn terminate(&self) {
+            // SAFETY: the handle stays open until drop
+            unsafe {
+                TerminateJobObject(self.0, 1);
+            }
+        }
+    }
+
+    impl Drop for Job {
+        fn drop(&mut self) {
+            // SAFETY: the handle was opened by assign and is closed once
+            unsafe {
+                CloseHandle(self.0);
+            }
+        }
+    }
+}
@@ -0,0 +1,568 @@
+use crate::config::Config;
+use crate::errors::SingleloadError;
+use crate::platform::ProcessTree;
+use crate::runner::{shell_quote, BuildContext, BuildTarget, Registry, Runner};
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::ffi::OsString;
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use std::sync::Mutex;
+use std::time::{Duration, Instant, UNIX_EPOCH};
+use tracing::{debug, warn};
+
+/// File name prefix plugins are discovered by
+pub const PLUGIN_PREFIX: &str = "singleload-";
+
+/// Version of the handshake protocol this build speaks
+pub const PROTOCOL_VERSION: u32 = 1;
+
+/// Name prefix, after [`PLUGIN_PREFIX`], of plugins providing a language
+/// backend; only they are ever started for a handshake
+pub const LANGUAGE_PREFIX: &str = "lang-";
+
+/// Only argument plugins are started with for a handshake request
+pub const HANDSHAKE_ARG: &str = "--singleload-plugin";
+
+/// Time a plugin has to answer a handshake request
+const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Remembered `describe` answers, so plugins are not started on every run
+const MANIFEST_CACHE_FILE: &str = "plugins.json";
+
+/// An executable named `singleload-<name>` found on `PATH`, like git and
+/// kubectl plugins.
+///
+/// `singleload <name> [ARGS...]`, for a name that is not a built-in command,
+/// runs the plugin with the arguments and the terminal's stdio. Language
+/// backends, named `singleload-lang-<language>`, answer a JSON handshake
+/// instead: started with [`HANDSHAKE_ARG`] as their only argument, they read
+/// one request from stdin and write one response to stdout.
+///
+/// ```text
+/// > {"protocol":1,"method":"describe"}
+/// < {"protocol":1,"name":"zig","language":{"name":"zig","extension":".zig"}}
+/// > {"protocol":1,"method":"plan","context":{"script_path":"/workspace/script.zig",...}}
+/// < {"protocol":1,"build":"zig build-exe -femit-bin=/cache/app /workspace/script.zig","run":["/cache/app"],"artifact":"app"}
+/// ```
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Plugin {
+    /// Name without the prefix (and `.exe` on Windows)
+    pub name: String,
+    pub path: PathBuf,
+}
+
+/// A plugin's answer to `describe`
+#[derive(Debug, Clone, PartialEq, Default, Serialize, Deserialize)]
+pub struct Manifest {
+    pub protocol: u32,
+    pub name: String,
+    #[serde(default)]
+    pub description: String,
+    /// Language backend the plugin provides, if any
+    #[serde(default)]
+    pub language: Option<LanguageSpec>,
+}
+
+/// How a plugin language is recognized
+#[derive(Debug, Clone, PartialEq, Default, Serialize, Deserialize)]
+pub struct LanguageSpec {
+    /// Name accepted by `--lang`
+    pub name: String,
+    /// Script extension, including the dot
+    pub extension: String,
+    /// Shebang interpreters that select the language
+    #[serde(default)]
+    pub interpreters: Vec<String>,
+    /// Regex matching scripts in the language, for content sniffing
+    #[serde(default)]
+    pub sniff: Option<String>,
+}
+
+/// A plugin's answer to `plan`: how to build and run one script. The
+/// commands run in the runner container like those of built-in languages.
+#[derive(Debug, Clone, PartialEq, Default, Deserialize)]
+pub struct Plan {
+    #[serde(default)]
+    pub build: Option<String>,
+    pub run: Vec<String>,
+    #[serde(default)]
+    pub check: Option<String>,
+    #[serde(default)]
+    pub artifact: Option<String>,
+    #[serde(default)]
+    pub env: BTreeMap<String, String>,
+}
+
+#[derive(Serialize)]
+struct Request<'a> {
+    protocol: u32,
+    method: &'a str,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    context: Option<PlanContext<'a>>,
+}
+
+/// [`BuildContext`] as plugins receive it
+#[derive(Debug, Serialize)]
+struct PlanContext<'a> {
+    script_path: &'a str,
+    sources: &'a [String],
+    assets: &'a [String],
+    out_dir: &'a str,
+    deps_dir: &'a str,
+    /// Dependency specs such as `requests==2.32.3`
+    dependencies: Vec<String>,
+    target: Option<&'a BuildTarget>,
+    build_flags: &'a [String],
+    libraries: &'a [String],
+    gpu_archs: &'a [String],
+}
+
+impl<'a> From<&'a BuildContext<'a>> for PlanContext<'a> {
+    fn from(ctx: &'a BuildContext<'a>) -> Self {
+        Self {
+            script_path: ctx.script_path,
+            sources: ctx.sources,
+            assets: ctx.assets,
+            out_dir: ctx.out_dir,
+            deps_dir: ctx.deps_dir,
+            dependencies: ctx.dependencies.iter().map(|d| d.spec()).collect(),
+            target: ctx.target,
+            build_flags: ctx.build_flags,
+            libraries: ctx.libraries,
+            gpu_archs: ctx.gpu_archs,
+        }
+    }
+}
+
+/// Plugins on `PATH`, by name; the first directory providing a name wins
+pub fn discover() -> Vec<Plugin> {
+    let mut plugins: Vec<Plugin> = Vec::new();
+    let path = std::env::var_os("PATH").unwrap_or_default();
+    for dir in std::env::split_paths(&path) {
+        let Ok(entries) = std::fs::read_dir(&dir) else {
+            continue;
+        };
+        let mut found: Vec<Plugin> = entries
+            .flatten()
+            .filter_map(|entry| plugin_name(&entry.path()).map(|name| Plugin { name, path: entry.path() }))
+            .filter(|plugin| is_executable(&plugin.path))
+            .collect();
+        found.sort_by(|a, b| a.name.cmp(&b.name));
+        for plugin in found {
+            if !plugins.iter().any(|p| p.name == plugin.name) {
+                plugins.push(plugin);
+            }
+        }
+    }
+    plugins.sort_by(|a, b| a.name.cmp(&b.name));
+    plugins
+}
+
+/// The plugin providing `singleload <name>`
+pub fn find(name: &str) -> Option<Plugin> {
+    discover().into_iter().find(|p| p.name == name)
+}
+
+fn plugin_name(path: &Path) -> Option<String> {
+    let file_name = path.file_name()?.to_str()?;
+    let name = file_name.strip_prefix(PLUGIN_PREFIX)?;
+    let name = if cfg!(windows) { name.strip_suffix(".exe")? } else { name };
+    // Names are subcommands: no dots (editor backups, .sh sources) or spaces
+    let valid = !name.is_empty() && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_');
+    valid.then(|| name.to_string())
+}
+
+fn is_executable(path: &Path) -> bool {
+    let Ok(metadata) = std::fs::metadata(path) else {
+        return false;
+    };
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        metadata.is_file() && metadata.permissions().mode() & 0o111 != 0
+    }
+    #[cfg(not(unix))]
+    {
+        metadata.is_file()
+    }
+}
+
+impl Plugin {
+    /// True for `singleload-lang-*` plugins
+    pub fn is_language(&self) -> bool {
+        self.name.starts_with(LANGUAGE_PREFIX)
+    }
+
+    /// Runs the plugin as `singleload <name>` with `args` and the terminal's
+    /// stdio, and returns its exit code. It learns where singleload is
+    /// from `SINGLELOAD_BIN`, so it can call back into it.
+    pub fn exec(&self, args: &[OsString], format: &str) -> Result<i32, SingleloadError> {
+        let mut command = Command::new(&self.path);
+        command
+            .args(args)
+            .env("SINGLELOAD_PLUGIN_PROTOCOL", PROTOCOL_VERSION.to_string())
+            .env("SINGLELOAD_FORMAT", format);
+        if let Ok(exe) = std::env::current_exe() {
+            command.env("SINGLELOAD_BIN", exe);
+        }
+        let mut child = command
+            .spawn()
+            .map_err(|e| SingleloadError::InvalidInput(format!("failed to run {}: {}", self.path.display(), e)))?;
+        // It stays in the terminal's process group for Ctrl-C; on Windows
+        // what it leaves running is killed with its job when singleload exits
+        #[cfg(windows)]
+        let _job = ProcessTree::attach(&child)?;
+        Ok(child.wait()?.code().unwrap_or(1))
+    }
+
+    pub fn describe(&self) -> Result<Manifest, SingleloadError> {
+        let manifest: Manifest = self.call(&Request {
+            protocol: PROTOCOL_VERSION,
+            method: "describe",
+            context: None,
+        })?;
+        if let Some(language) = &manifest.language {
+            if language.name.is_empty() || !language.extension.starts_with('.') {
+                return Err(self.error("describe needs a language name and an extension starting with '.'"));
+            }
+        }
+        Ok(manifest)
+    }
+
+    pub fn plan(&self, ctx: &BuildContext) -> Result<Plan, SingleloadError> {
+        self.call(&Request {
+            protocol: PROTOCOL_VERSION,
+            method: "plan",
+            context: Some(PlanContext::from(ctx)),
+        })
+    }
+
+    fn error(&self, message: impl std::fmt::Display) -> SingleloadError {
+        SingleloadError::InvalidInput(format!("plugin {}: {}", self.name, message))
+    }
+
+    /// Sends one handshake request and reads the response
+    fn call<T: DeserializeOwned>(&self, request: &Request) -> Result<T, SingleloadError> {
+        let mut command = Command::new(&self.path);
+        command
+            .arg(HANDSHAKE_ARG)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::inherit());
+        // A plugin that hangs is stopped with whatever it started, which
+        // could otherwise keep its stdout open
+        ProcessTree::isolate(&mut command);
+        let mut child = command.spawn().map_err(|e| self.error(e))?;
+        let tree = ProcessTree::attach(&child);
+
+        let mut stdin = child.stdin.take().expect("stdin is piped");
+        let mut line = serde_json::to_vec(request)?;
+        line.push(b'\n');
+        // A plugin that does not read its request is caught by the wait below
+        let _ = stdin.write_all(&line);
+        drop(stdin);
+
+        let mut stdout = child.stdout.take().expect("stdout is piped");
+        let reader = std::thread::spawn(move || {
+            let mut output = Vec::new();
+            stdout.read_to_end(&mut output).map(|_| output)
+        });
+        let deadline = Instant::now() + HANDSHAKE_TIMEOUT;
+        let status = loop {
+            if let Some(status) = child.try_wait()? {
+                break status;
+            }
+            if Instant::now() >= deadline {
+                match &tree {
+                    Ok(tree) => tree.kill(),
+                    Err(_) => {
+                        let _ = child.kill();
+                    }
+                }
+                let _ = child.wait();
+                return Err(self.error(format!("no answer within {}s", HANDSHAKE_TIMEOUT.as_secs())));
+            }
+            std::thread::sleep(Duration::from_millis(10));
+        };
+        let output = reader.join().map_err(|_| self.error("failed to read the answer"))??;
+        if !status.success() {
+            return Err(self.error(format!("{} failed ({})", request.method, status)));
+        }
+
+        let value: serde_json::Value = serde_json::from_slice(&output)
+            .map_err(|e| self.error(format!("{} did not answer with JSON: {}", request.method, e)))?;
+        let protocol = value.get("protocol").and_then(|p| p.as_u64());
+        if protocol != Some(PROTOCOL_VERSION as u64) {
+            return Err(self.error(format!(
+                "speaks protocol {}, singleload speaks {}",
+                protocol.map_or("none".to_string(), |p| p.to_string()),
+                PROTOCOL_VERSION
+            )));
+        }
+        serde_json::from_value(value).map_err(|e| self.error(format!("invalid {} answer: {}", request.method, e)))
+    }
+}
+
+/// A language backend provided by a plugin. Each script's build and run
+/// commands come from the plugin's `plan` answer for it.
+pub struct PluginRunner {
+    plugin: Plugin,
+    spec: LanguageSpec,
+    /// The trait lends out `&[&str]`; the handful of names of each plugin
+    /// are leaked once so they can be borrowed for the whole run
+    interpreters: Vec<&'static str>,
+    sniff: Option<regex::Regex>,
+    /// Plans by context, so a run asks the plugin once per script
+    plans: Mutex<HashMap<String, Plan>>,
+}
+
+impl PluginRunner {
+    pub fn new(plugin: Plugin, spec: LanguageSpec) -> Result<Self, SingleloadError> {
+        let sniff = match &spec.sniff {
+            Some(pattern) => Some(
+                regex::Regex::new(pattern)
+                    .map_err(|e| plugin.error(format!("invalid sniff pattern: {}", e)))?,
+            ),
+            None => None,
+        };
+        let interpreters = spec
+            .interpreters
+            .iter()
+            .map(|name| &*Box::leak(name.clone().into_boxed_str()))
+            .collect();
+        Ok(Self {
+            plugin,
+            spec,
+            interpreters,
+            sniff,
+            plans: Mutex::new(HashMap::new()),
+        })
+    }
+
+    /// The plugin's plan for `ctx`. A plugin that fails gets a run command
+    /// reporting the failure, so the script fails with a message instead
+    /// of an empty command.
+    fn plan(&self, ctx: &BuildContext) -> Plan {
+        let key = serde_json::to_string(&PlanContext::from(ctx)).unwrap_or_default();
+        let mut plans = self.plans.lock().unwrap_or_else(|e| e.into_inner());
+        if let Some(plan) = plans.get(&key) {
+            return plan.clone();
+        }
+        let plan = self.plugin.plan(ctx).unwrap_or_else(|e| {
+            warn!("{}", e);
+            Plan {
+                run: vec![
+                    "bash".to_string(),
+                    "-c".to_string(),
+                    format!("echo {} >&2; exit 1", shell_quote(&e.to_string())),
+                ],
+                ..Plan::default()
+            }
+        });
+        plans.insert(key, plan.clone());
+        plan
+    }
+}
+
+impl Runner for PluginRunner {
+    fn name(&self) -> &str {
+        &self.spec.name
+    }
+
+    fn file_extension(&self) -> &str {
+        &self.spec.extension
+    }
+
+    fn interpreters(&self) -> &[&str] {
+        &self.interpreters
+    }
+
+    fn sniff(&self, content: &[u8]) -> bool {
+        self.sniff
+            .as_ref()
+            .map_or(false, |re| re.is_match(&String::from_utf8_lossy(content)))
+    }
+
+    fn build(&self, ctx: &BuildContext) -> Option<String> {
+        self.plan(ctx).build
+    }
+
+    fn run(&self, ctx: &BuildContext) -> Vec<String> {
+        self.plan(ctx).run
+    }
+
+    fn check(&self, ctx: &BuildContext) -> Option<String> {
+        let plan = self.plan(ctx);
+        plan.check.or(plan.build)
+    }
+
+    fn artifact(&self, ctx: &BuildContext) -> Option<String> {
+        self.plan(ctx).artifact
+    }
+
+    fn env(&self, ctx: &BuildContext) -> Vec<(String, String)> {
+        self.plan(ctx).env.into_iter().collect()
+    }
+
+    fn supports_target(&self, _target: &BuildTarget) -> bool {
+        // The plugin sees the target in the plan context and decides there
+        true
+    }
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct CachedManifest {
+    size: u64,
+    modified: u64,
+    manifest: Manifest,
+}
+
+/// `describe` answers of plugin executables, remembered in the cache
+/// directory until the executable changes
+pub struct ManifestCache {
+    path: PathBuf,
+    entries: HashMap<PathBuf, CachedManifest>,
+    dirty: bool,
+}
+
+impl ManifestCache {
+    pub fn open(cache_dir: &Path) -> Self {
+        let path = cache_dir.join(MANIFEST_CACHE_FILE);
+        let entries = std::fs::read(&path)
+            .ok()
+            .and_then(|data| serde_json::from_slice(&data).ok())
+            .unwrap_or_default();
+        Self {
+            path,
+            entries,
+            dirty: false,
+        }
+    }
+
+    /// The plugin's manifest, asking it only if it changed since last time
+    pub fn describe(&mut self, plugin: &Plugin) -> Result<Manifest, SingleloadError> {
+        let metadata = std::fs::metadata(&plugin.path)?;
+        let modified = metadata
+            .modified()
+            .ok()
+            .and_then(|m| m.duration_since(UNIX_EPOCH).ok())
+            .map_or(0, |d| d.as_secs());
+        if let Some(cached) = self.entries.get(&plugin.path) {
+            if cached.size == metadata.len() && cached.modified == modified {
+                return Ok(cached.manifest.clone());
+            }
+        }
+        let manifest = plugin.describe()?;
+        self.entries.insert(
+            plugin.path.clone(),
+            CachedManifest {
+                size: metadata.len(),
+                modified,
+                manifest: manifest.clone(),
+            },
+        );
+        self.dirty = true;
+        Ok(manifest)
+    }
+
+    pub fn save(&self) {
+        if !self.dirty {
+            return;
+        }
+        let written = serde_json::to_vec(&self.entries)
+            .map_err(SingleloadError::from)
+            .and_then(|data| {
+                if let Some(parent) = self.path.parent() {
+                    std::fs::create_dir_all(parent)?;
+                }
+                Ok(std::fs::write(&self.path, data)?)
+            });
+        if let Err(e) = written {
+            debug!("Failed to save plugin manifests to {}: {}", self.path.display(), e);
+        }
+    }
+}
+
+/// A plugin as `singleload plugins` lists it
+#[derive(Debug, Clone, Serialize)]
+pub struct PluginInfo {
+    pub name: String,
+    pub path: PathBuf,
+    /// Language a `singleload-lang-*` plugin provides
+    pub language: Option<String>,
+    pub description: String,
+    /// Why a language plugin's handshake failed
+    pub error: Option<String>,
+}
+
+/// The plugins on `PATH`; only language plugins are asked to describe themselves
+pub fn list(cache_dir: &Path) -> Vec<PluginInfo> {
+    let mut manifests = ManifestCache::open(cache_dir);
+    let listed = discover()
+        .into_iter()
+        .map(|plugin| {
+            let manifest = plugin.is_language().then(|| manifests.describe(&plugin));
+            let (language, description, error) = match manifest {
+                Some(Ok(manifest)) => (manifest.language.map(|l| l.name), manifest.description, None),
+                Some(Err(e)) => (None, String::new(), Some(e.to_string())),
+                None => (None, String::new(), None),
+            };
+            PluginInfo {
+                name: plugin.name,
+                path: plugin.path,
+                language,
+                description,
+                error,
+            }
+        })
+        .collect();
+    manifests.save();
+    listed
+}
+
+/// The built-in languages, plus those of plugins unless `plugins` is off
+/// in the configuration
+pub fn registry(config: &Config) -> Registry {
+    let mut registry = Registry::with_languages(&config.languages);
+    if config.plugins {
+        register_languages(&mut registry, &config.cache_dir);
+    }
+    registry
+}
+
+/// Adds the language backends of the `singleload-lang-*` plugins on `PATH`
+/// to `registry`. Built-in languages are never replaced; a plugin that
+/// fails its handshake is skipped with a warning.
+pub fn register_languages(registry: &mut Registry, cache_dir: &Path) {
+    let plugins: Vec<Plugin> = discover().into_iter().filter(Plugin::is_language).collect();
+    if plugins.is_empty() {
+        return;
+    }
+    let builtin = registry.names();
+    let mut manifests = ManifestCache::open(cache_dir);
+    for plugin in plugins {
+        let manifest = match manifests.describe(&plugin) {
+            Ok(manifest) => manifest,
+            Err(e) => {
+                warn!("Skipping {}", e);
+                continue;
+            }
+        };
+        let Some(spec) = manifest.language else {
+            warn!("Plugin {} describes no language; ignoring it", plugin.name);
+            continue;
+        };
+        if builtin.iter().any(|name| name.eq_ignore_ascii_case(&spec.name)) {
+            warn!("Plugin {} provides {}, which is built in; ignoring it", plugin.name, spec.name);
+            continue;
+        }
+        match PluginRunner::new(plugin, spec) {
+            Ok(runner) => registry.register(runner),
+            Err(e) => warn!("Skipping {}", e),
+        }
+    }
+    manifests.save();
+}
@@ -0,0 +1,360 @@
+use crate::directives::NetRule;
+use crate::download::DownloadManager;
+use crate::errors::SingleloadError;
+use crate::limits;
+use crate::platform;
+use crate::security::MAX_SCRIPT_SIZE;
+use crate::signing;
+use anyhow::Result;
+use chrono::{DateTime, Utc};
+use ed25519_dalek::VerifyingKey;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime};
+use tracing::{debug, warn};
+
+/// Policy file in the system configuration directory
+pub const POLICY_FILE: &str = "policy.toml";
+
+/// How long a fetched policy is used before it is fetched again
+const DEFAULT_REFRESH: Duration = Duration::from_secs(3600);
+
+/// Organization-wide restrictions an administrator sets in
+/// `/etc/singleload/policy.toml`, or publishes at `url`. Unlike the
+/// configuration they cannot be changed by users, and every build and run
+/// is checked against them first.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct Policy {
+    /// https URL the policy is fetched from, signed in `<url>.sig`; the
+    /// fetched policy replaces the rules of the local file
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub url: Option<String>,
+    /// ed25519 public key the fetched policy is signed with, as PEM or the
+    /// path of a PEM file
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub public_key: Option<String>,
+    /// How long a fetched policy is used before it is fetched again, e.g. `1h`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub refresh: Option<String>,
+    /// Version of a fetched policy, raised with every change. A policy with
+    /// a lower serial than the cached one is refused, so an older signed
+    /// policy cannot be replayed.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub serial: Option<u64>,
+    /// When a fetched policy stops being valid, as an RFC 3339 time
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub expires: Option<String>,
+    /// Languages scripts may be written in; empty allows all not denied
+    pub allowed_languages: Vec<String>,
+    pub denied_languages: Vec<String>,
+    /// Scripts and their sources must be signed by one of `trusted_keys`
+    pub require_signatures: bool,
+    /// ed25519 public keys, as PEM or paths of PEM files
+    pub trusted_keys: Vec<String>,
+    /// Upper bounds of `--timeout`, `--memory` and `--cpu`, which are lowered
+    /// to them, e.g. `10m` and `2GB`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub max_timeout: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub max_memory: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub max_cpu: Option<f32>,
+    /// Refuse scripts with `net allow` directives and sandboxes with network access
+    pub deny_network: bool,
+    /// Where the rules were read from; None when no policy is set
+    #[serde(skip)]
+    pub source: Option<String>,
+}
+
+impl Policy {
+    /// `/etc/singleload/policy.toml` (`%ProgramData%\singleload` on Windows)
+    pub fn path() -> PathBuf {
+        platform::system_config_dir().join(POLICY_FILE)
+    }
+
+    /// Where the last fetched policy is kept, with its signature:
+    /// `/var/cache/singleload/policy/policy.toml`
+    pub fn cache_path() -> PathBuf {
+        platform::system_cache_dir().join("policy").join(POLICY_FILE)
+    }
+
+    /// The policy in effect: the system policy file, or the policy it points
+    /// to with `url`. A fetched policy is cached in [`Policy::cache_path`]
+    /// when singleload may write there, as when an administrator runs it,
+    /// and used until `refresh` has passed, or while the URL cannot be
+    /// reached; copies a user could have changed are ignored. It is verified
+    /// against `public_key` every time it is read, and refused once it
+    /// expired or when its serial is below the cached one's.
+    pub async fn load(downloads: &DownloadManager) -> Result<Self> {
+        let local = Self::from_file(&Self::path())?;
+        let Some(url) = local.url.clone() else {
+            return Ok(local);
+        };
+        // validate() makes sure a key comes with the URL
+        let key = parse_key(local.public_key.as_deref().unwrap_or_default())?;
+        let cache = Self::cache_path();
+        let refresh = local.refresh.as_deref().map_or(Ok(DEFAULT_REFRESH), limits::parse_duration)
+            .map_err(|e| anyhow::anyhow!("policy refresh: {}", e))?;
+
+        let cached = match is_system_owned(&cache) {
+            true => Self::read_cached(&cache, &key, &url)
+                .map_err(|e| warn!("Ignoring the cached policy: {}", e))
+                .ok(),
+            false => None,
+        };
+        let age = std::fs::metadata(&cache)
+            .and_then(|m| m.modified())
+            .ok()
+            .and_then(|modified| SystemTime::now().duration_since(modified).ok());
+        let mut policy = match cached {
+            Some(cached) if age.is_some_and(|age| age < refresh) => cached,
+            cached => match fetch(&url, downloads).await {
+                Ok((data, sig)) => {
+                    signing::verify(&data, &sig, &key).map_err(|e| anyhow::anyhow!("policy from {}: {}", url, e))?;
+                    let fetched = Self::parse_fetched(&String::from_utf8_lossy(&data), &url)?;
+                    fetched.check_replaces(cached.as_ref())?;
+                    if let Err(e) = store(&cache, &data, &sig) {
+                        debug!("Not caching the policy in {}: {}", cache.display(), e);
+                    }
+                    debug!("Fetched the policy from {}", url);
+                    fetched
+                }
+                Err(e) => match cached {
+                    Some(cached) => {
+                        warn!("Failed to fetch the policy ({}), using the cached copy", e);
+                        cached
+                    }
+                    None => return Err(e.context(format!("the policy at {} is required but could not be fetched", url))),
+                },
+            },
+        };
+        policy.check_expiry(Utc::now())?;
+        policy.source = Some(url);
+        Ok(policy)
+    }
+
+    fn read_cached(path: &Path, key: &VerifyingKey, url: &str) -> Result<Self> {
+        let data = std::fs::read(path)?;
+        signing::verify_file(path, &data, key)?;
+        Self::parse_fetched(&String::from_utf8_lossy(&data), url)
+    }
+
+    /// Reads a policy fetched from `url`, which has to say until when it is
+    /// valid and which serial it has, and cannot point elsewhere
+    pub fn parse_fetched(text: &str, url: &str) -> Result<Self> {
+        let policy = Self::parse(text, url)?;
+        if policy.url.is_some() {
+            anyhow::bail!("policy from {}: a fetched policy cannot point to another url", url);
+        }
+        if policy.serial.is_none() || policy.expires.is_none() {
+            anyhow::bail!("policy from {}: a fetched policy needs a serial and an expires time", url);
+        }
+        Ok(policy)
+    }
+
+    /// Refuses a fetched policy older than the `previous` one seen
+    pub fn check_replaces(&self, previous: Option<&Self>) -> Result<()> {
+        let (serial, previous) = (self.serial.unwrap_or(0), previous.and_then(|p| p.serial).unwrap_or(0));
+        if serial < previous {
+            anyhow::bail!(
+                "policy from {}: serial {} is older than the serial {} seen before",
+                self.source.as_deref().unwrap_or("the url"),
+                serial,
+                previous
+            );
+        }
+        Ok(())
+    }
+
+    /// Refuses a policy that expired by `now`
+    pub fn check_expiry(&self, now: DateTime<Utc>) -> Result<()> {
+        let Some(expires) = self.expires.as_deref() else {
+            return Ok(());
+        };
+        // validate() made sure it parses
+        let expires = DateTime::parse_from_rfc3339(expires)?;
+        if expires <= now {
+            anyhow::bail!(
+                "the policy from {} expired at {}; nothing runs until a current one can be fetched",
+                self.source.as_deref().unwrap_or("its url"),
+                expires
+            );
+        }
+        Ok(())
+    }
+
+    /// Reads a policy file; a missing one sets no policy
+    pub fn from_file(path: &Path) -> Result<Self> {
+        match std::fs::read_to_string(path) {
+            Ok(text) => Ok(Self::parse(&text, &path.display().to_string())?),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(Self::default()),
+            Err(e) => Err(anyhow::anyhow!("{}: {}", path.display(), e)),
+        }
+    }
+
+    pub fn parse(text: &str, source: &str) -> Result<Self> {
+        let mut policy: Self = toml::from_str(text).map_err(|e| anyhow::anyhow!("{}: {}", source, e))?;
+        policy.validate().map_err(|e| anyhow::anyhow!("{}: {}", source, e))?;
+        policy.source = Some(source.to_string());
+        Ok(policy)
+    }
+
+    fn validate(&self) -> Result<(), String> {
+        if let Some(url) = &self.url {
+            if !url.starts_with("https://") {
+                return Err(format!("url '{}' must be https", url));
+            }
+            if self.public_key.is_none() {
+                return Err("url needs the public_key the policy is signed with".to_string());
+            }
+        }
+        if let Some(key) = &self.public_key {
+            parse_key(key).map_err(|e| format!("public_key: {}", e))?;
+        }
+        if let Some(refresh) = &self.refresh {
+            limits::parse_duration(refresh).map_err(|e| format!("refresh: {}", e))?;
+        }
+        if let Some(expires) = &self.expires {
+            DateTime::parse_from_rfc3339(expires).map_err(|e| format!("expires '{}': {}", expires, e))?;
+        }
+        if self.require_signatures && self.trusted_keys.is_empty() {
+            return Err("require_signatures needs trusted_keys".to_string());
+        }
+        for key in &self.trusted_keys {
+            parse_key(key).map_err(|e| format!("trusted_keys: {}", e))?;
+        }
+        if let Some(timeout) = &self.max_timeout {
+            limits::parse_duration(timeout).map_err(|e| format!("max_timeout: {}", e))?;
+        }
+        if let Some(memory) = &self.max_memory {
+            limits::parse_memory(memory).map_err(|e| format!("max_memory: {}", e))?;
+        }
+        if self.max_cpu.is_some_and(|cpu| cpu <= 0.0) {
+            return Err("max_cpu must be greater than 0".to_string());
+        }
+        Ok(())
+    }
+
+    /// Whether scripts in `language` may be built and run
+    pub fn check_language(&self, language: &str) -> Result<(), SingleloadError> {
+        let listed = |list: &[String]| list.iter().any(|l| l.eq_ignore_ascii_case(language));
+        if listed(&self.denied_languages)
+            || (!self.allowed_languages.is_empty() && !listed(&self.allowed_languages))
+        {
+            return Err(self.violation(format!("{} scripts are not allowed", language)));
+        }
+        Ok(())
+    }
+
+    /// Checks the signature of a script or source file when signatures are
+    /// required; any trusted key will do
+    pub fn verify(&self, path: &Path, content: &[u8]) -> Result<(), SingleloadError> {
+        if !self.require_signatures {
+            return Ok(());
+        }
+        let mut error = None;
+        for key in &self.trusted_keys {
+            match parse_key(key).and_then(|key| signing::verify_file(path, content, &key)) {
+                Ok(()) => return Ok(()),
+                Err(e) => error = Some(e),
+            }
+        }
+        Err(self.violation(match error {
+            Some(e) => format!("signatures are required: {}", e),
+            None => "signatures are required".to_string(),
+        }))
+    }
+
+    /// Refuses network access when the policy denies it: a sandbox with
+    /// network access, or endpoints the script allows itself
+    pub fn check_network(&self, sandbox_network: bool, rules: &[NetRule]) -> Result<(), SingleloadError> {
+        if !self.deny_network {
+            return Ok(());
+        }
+        if sandbox_network {
+            return Err(self.violation("sandboxes with network access are not allowed".to_string()));
+        }
+        if let Some(rule) = rules.first() {
+            return Err(self.violation(format!("network access is not allowed ('net allow {}')", rule)));
+        }
+        Ok(())
+    }
+
+    /// Limits lowered to the policy's caps, with a warning for each lowered one
+    pub fn clamp(&self, timeout: Duration, memory_bytes: u64, cpu: f32) -> (Duration, u64, f32) {
+        let max_timeout = self.max_timeout.as_deref().and_then(|t| limits::parse_duration(t).ok());
+        let max_memory = self.max_memory.as_deref().and_then(|m| limits::parse_memory(m).ok());
+        let mut limits = (timeout, memory_bytes, cpu);
+        if let Some(max) = max_timeout.filter(|max| timeout > *max) {
+            warn!("Timeout lowered to {}s by the policy", max.as_secs());
+            limits.0 = max;
+        }
+        if let Some(max) = max_memory.map(|mb| mb * 1024 * 1024).filter(|max| memory_bytes > *max) {
+            warn!("Memory limit lowered to {}MB by the policy", max / 1024 / 1024);
+            limits.1 = max;
+        }
+        if let Some(max) = self.max_cpu.filter(|max| cpu > *max) {
+            warn!("CPU limit lowered to {} by the policy", max);
+            limits.2 = max;
+        }
+        limits
+    }
+
+    fn violation(&self, message: String) -> SingleloadError {
+        SingleloadError::SecurityViolation(format!(
+            "{} by the policy in {}",
+            message,
+            self.source.as_deref().unwrap_or("effect")
+        ))
+    }
+}
+
+/// Downloads the policy at `url` and its signature
+async fn fetch(url: &str, downloads: &DownloadManager) -> Result<(Vec<u8>, String)> {
+    let data = downloads.fetch(url, MAX_SCRIPT_SIZE).await?;
+    let signature = downloads.fetch(&format!("{}.sig", url), MAX_SCRIPT_SIZE).await?;
+    Ok((data, String::from_utf8_lossy(&signature).into_owned()))
+}
+
+/// Writes a fetched policy and its signature over the cached ones, so
+/// readers never see half of one
+fn store(path: &Path, data: &[u8], signature: &str) -> std::io::Result<()> {
+    let dir = path.parent().unwrap_or(Path::new("."));
+    std::fs::create_dir_all(dir)?;
+    for (target, content) in [(signing::signature_path(path), signature.as_bytes()), (path.to_path_buf(), data)] {
+        let mut staged = tempfile::NamedTempFile::new_in(dir)?;
+        std::io::Write::write_all(&mut staged, content)?;
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            staged.as_file().set_permissions(std::fs::Permissions::from_mode(0o644))?;
+        }
+        staged.persist(target).map_err(|e| e.error)?;
+    }
+    Ok(())
+}
+
+/// True if only an administrator can have written the cached policy: it,
+/// its signature and their directory belong to root and nobody else may
+/// write them
+fn is_system_owned(path: &Path) -> bool {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::MetadataExt;
+        let dir = path.parent().unwrap_or(Path::new("/"));
+        [path, &signing::signature_path(path), dir]
+            .iter()
+            .all(|p| std::fs::symlink_metadata(p).is_ok_and(|m| m.uid() == 0 && m.mode() & 0o022 == 0))
+    }
+    #[cfg(not(unix))]
+    path.is_file()
+}
+
+/// A key given inline as PEM or as the path of a PEM file
+fn parse_key(key: &str) -> Result<VerifyingKey, SingleloadError> {
+    match key.trim_start().starts_with("-----BEGIN") {
+        true => signing::parse_verifying_key(key),
+        false => signing::load_verifying_key(Path::new(key)),
+    }
+}
@@ -0,0 +1,358 @@
+use crate::errors::SingleloadError;
+use crate::runner::supervise;
+use crate::sourcemap::SourceMap;
+use crate::state::StateStore;
+use chrono::{DateTime, Utc};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use tracing::debug;
+
+/// Container path crashed programs leave their core file and backtrace in
+pub const CONTAINER_POSTMORTEM_DIR: &str = "/postmortem";
+
+/// Postmortems kept per script; older ones are deleted first
+pub const MAX_POSTMORTEMS: usize = 10;
+
+/// Largest core file a crash dumps, in bytes
+pub const MAX_CORE_SIZE: u64 = 256 * 1024 * 1024;
+
+/// Variables that make runtimes print a full stack when they crash. Values
+/// the user sets for them take precedence.
+pub const CRASH_ENV: &[(&str, &str)] = &[("RUST_BACKTRACE", "1"), ("GOTRACEBACK", "all"), ("PYTHONFAULTHANDLER", "1")];
+
+const POSTMORTEMS_DIR: &str = "postmortems";
+const BUNDLE_FILE: &str = "postmortem.json";
+const STACK_FILE: &str = "stack";
+const BACKTRACE_FILE: &str = "backtrace";
+const CORE_FILE: &str = "core";
+const SOURCES_DIR: &str = "sources";
+
+/// Lines of stderr kept as the stack of a crash
+const MAX_STACK_LINES: usize = 400;
+
+/// Signals the kernel dumps core for
+const CORE_SIGNALS: &[(u32, &str)] = &[
+    (3, "SIGQUIT"),
+    (4, "SIGILL"),
+    (5, "SIGTRAP"),
+    (6, "SIGABRT"),
+    (7, "SIGBUS"),
+    (8, "SIGFPE"),
+    (11, "SIGSEGV"),
+    (31, "SIGSYS"),
+];
+
+/// First lines of the reports runtimes print for an uncaught panic or
+/// exception: Rust, Go, Python, .NET, Java and Kotlin, and PHP
+const PANIC_PATTERN: &str = r#"(?m)^(thread '[^']*' panicked at|panic: |fatal error: |Traceback \(most recent call last\):|Fatal Python error: |Unhandled exception\. |Exception in thread "|PHP Fatal error: )"#;
+
+/// How a run crashed, as read from its exit code and stderr
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Crash {
+    /// Signal that killed the program, e.g. `SIGSEGV`
+    pub signal: Option<&'static str>,
+    /// One line saying what happened
+    pub summary: String,
+    /// The runtime's report of the crash, or the end of stderr
+    pub stack: String,
+}
+
+impl Crash {
+    /// The crash a run that ended with `exit_code` had, if it crashed:
+    /// killed by a signal that dumps core, or failed with a runtime's panic
+    /// or uncaught exception report on stderr
+    pub fn detect(exit_code: u32, stderr: &str) -> Option<Self> {
+        if exit_code == 0 {
+            return None;
+        }
+        let signal = exit_code
+            .checked_sub(128)
+            .and_then(|number| CORE_SIGNALS.iter().find(|(n, _)| *n == number))
+            .map(|(_, name)| *name);
+        let report = Regex::new(PANIC_PATTERN).ok()?.find(stderr).map(|m| m.start());
+        if signal.is_none() && report.is_none() {
+            return None;
+        }
+
+        let lines: Vec<&str> = stderr[report.unwrap_or(0)..].lines().collect();
+        let stack = match report {
+            Some(_) => lines[..lines.len().min(MAX_STACK_LINES)].join("\n"),
+            None => lines[lines.len().saturating_sub(MAX_STACK_LINES)..].join("\n"),
+        };
+        let summary = match report {
+            // Python names the exception last
+            Some(_) if stack.starts_with("Traceback") => {
+                lines.iter().rev().find(|l| !l.trim().is_empty() && !l.starts_with(' ')).copied()
+            }
+            Some(_) => lines.first().copied(),
+            None => None,
+        };
+        let summary = match (summary, signal) {
+            (Some(line), _) => line.trim().to_string(),
+            (None, Some(signal)) => format!("killed by {}", signal),
+            (None, None) => String::new(),
+        };
+        Some(Self { signal, summary, stack })
+    }
+}
+
+/// Wraps `command` so that a crash that dumps core leaves the core file and
+/// a gdb backtrace of every thread in [`CONTAINER_POSTMORTEM_DIR`]. Where
+/// the core goes is up to the host's `kernel.core_pattern`: cores piped to
+/// a handler such as systemd-coredump stay with it, and cores written to a
+/// read-only working directory are not written at all.
+pub fn wrap(command: &[String]) -> Vec<String> {
+    let codes: Vec<String> = CORE_SIGNALS.iter().map(|(n, _)| (128 + n).to_string()).collect();
+    let script = format!(
+        r#"ulimit -c {blocks} 2>/dev/null
+: > {dir}/.started
+{run}
+case $status in
+    {codes})
+        read -r pattern < /proc/sys/kernel/core_pattern
+        case $pattern in
+            '|'* | '') cores= ;;
+            */*) cores=${{pattern%/*}} ;;
+            *) cores=. ;;
+        esac
+        name=${{pattern##*/}}
+        name=${{name%%\%*}}
+        core=
+        if [ -n "$cores" ]; then
+            for file in "$cores/${{name:-core}}"*; do
+                [ -f "$file" ] && [ "$file" -nt {dir}/.started ] && core=$file
+            done
+        fi
+        if [ -n "$core" ]; then
+            if command -v gdb > /dev/null; then
+                gdb -batch -q -ex 'thread apply all bt' "$(command -v "$1")" "$core" > {dir}/{backtrace} 2>&1
+            fi
+            cp "$core" {dir}/{core} 2>/dev/null
+        fi
+        ;;
+esac
+exit $status"#,
+        blocks = MAX_CORE_SIZE / 1024,
+        dir = CONTAINER_POSTMORTEM_DIR,
+        codes = codes.join("|"),
+        run = supervise("\"$@\""),
+        backtrace = BACKTRACE_FILE,
+        core = CORE_FILE,
+    );
+
+    let mut wrapped = vec!["/bin/bash".to_string(), "-c".to_string(), script, "singleload-postmortem".to_string()];
+    wrapped.extend(command.iter().cloned());
+    wrapped
+}
+
+/// A source file as it was when the script crashed
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct BundledSource {
+    /// Host path of the original
+    pub path: String,
+    /// Name of the copy in the bundle's `sources` directory
+    pub file: String,
+}
+
+/// What `singleload postmortem` knows about a crash, from `postmortem.json`
+/// in its bundle directory
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Postmortem {
+    pub id: String,
+    pub created_at: DateTime<Utc>,
+    pub script: String,
+    pub language: String,
+    pub exit_code: u32,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub signal: Option<String>,
+    pub summary: String,
+    pub sources: Vec<BundledSource>,
+    /// A core file was captured
+    pub core: bool,
+    /// gdb produced a backtrace from the core
+    pub backtrace: bool,
+    /// Bundle directory
+    #[serde(skip)]
+    pub dir: PathBuf,
+}
+
+impl Postmortem {
+    /// The runtime's report of the crash, with paths and lines of the
+    /// original sources
+    pub fn stack(&self) -> String {
+        std::fs::read_to_string(self.dir.join(STACK_FILE)).unwrap_or_default()
+    }
+
+    /// gdb's backtrace of the core file, if one was captured
+    pub fn native_backtrace(&self) -> Option<String> {
+        std::fs::read_to_string(self.dir.join(BACKTRACE_FILE)).ok()
+    }
+
+    /// Where the bundle keeps its copy of `source`
+    pub fn source_copy(&self, source: &BundledSource) -> PathBuf {
+        self.dir.join(SOURCES_DIR).join(&source.file)
+    }
+
+    pub fn core_path(&self) -> Option<PathBuf> {
+        self.core.then(|| self.dir.join(CORE_FILE))
+    }
+}
+
+/// Postmortem bundles, kept in the `postmortems` directory of each script's
+/// state entry next to its data, out of the script's reach
+#[derive(Debug, Clone)]
+pub struct PostmortemStore {
+    root: PathBuf,
+}
+
+impl PostmortemStore {
+    /// Store over the state directories in `state_root`
+    pub fn new(state_root: PathBuf) -> Self {
+        Self { root: state_root }
+    }
+
+    /// Host directory holding the postmortems of `script`
+    pub fn dir(&self, script: &Path) -> Result<PathBuf, SingleloadError> {
+        Ok(self.root.join(StateStore::key(script)?).join(POSTMORTEMS_DIR))
+    }
+
+    /// Saves the bundle of a crash of `script`: the stack, the core file and
+    /// backtrace the program left in `capture`, and copies of the sources
+    /// in `source_map`, whose paths and lines the stack and backtrace are
+    /// translated to. Only the newest [`MAX_POSTMORTEMS`] are kept.
+    pub fn record(
+        &self,
+        script: &Path,
+        language: &str,
+        exit_code: u32,
+        crash: &Crash,
+        capture: Option<&Path>,
+        source_map: &SourceMap,
+    ) -> Result<Postmortem, SingleloadError> {
+        let created_at = Utc::now();
+        let base = self.dir(script)?;
+        let key = StateStore::key(script)?;
+        // Microseconds, so that ids freed by pruning are not handed out again
+        let stamp = format!("{}-{}", created_at.format("%Y%m%d-%H%M%S%.6f"), &key[..6]);
+        let mut id = stamp.clone();
+        let mut n = 1;
+        while base.join(&id).exists() {
+            n += 1;
+            id = format!("{}-{}", stamp, n);
+        }
+        let dir = base.join(&id);
+        std::fs::create_dir_all(dir.join(SOURCES_DIR))?;
+
+        std::fs::write(dir.join(STACK_FILE), &crash.stack)?;
+        let captured = |name: &str| capture.map(|c| c.join(name)).filter(|p| p.is_file());
+        let backtrace = match captured(BACKTRACE_FILE) {
+            Some(path) => {
+                let text = String::from_utf8_lossy(&std::fs::read(path)?).into_owned();
+                std::fs::write(dir.join(BACKTRACE_FILE), source_map.translate(&text))?;
+                true
+            }
+            None => false,
+        };
+        let core = match captured(CORE_FILE) {
+            Some(path) => std::fs::rename(&path, dir.join(CORE_FILE))
+                .or_else(|_| std::fs::copy(&path, dir.join(CORE_FILE)).map(|_| ()))
+                .is_ok(),
+            None => false,
+        };
+
+        let mut sources = Vec::new();
+        for (i, original) in source_map.originals().enumerate() {
+            let name = original.file_name().unwrap_or_default().to_string_lossy().into_owned();
+            let file = match sources.iter().any(|s: &BundledSource| s.file == name) {
+                true => format!("{}-{}", i, name),
+                false => name,
+            };
+            if std::fs::copy(original, dir.join(SOURCES_DIR).join(&file)).is_ok() {
+                sources.push(BundledSource {
+                    path: original.display().to_string(),
+                    file,
+                });
+            }
+        }
+
+        let postmortem = Postmortem {
+            id,
+            created_at,
+            script: script.canonicalize()?.display().to_string(),
+            language: language.to_string(),
+            exit_code,
+            signal: crash.signal.map(str::to_string),
+            summary: crash.summary.clone(),
+            sources,
+            core,
+            backtrace,
+            dir,
+        };
+        std::fs::write(postmortem.dir.join(BUNDLE_FILE), serde_json::to_vec_pretty(&postmortem)?)?;
+        self.prune(&base)?;
+        debug!("Saved postmortem {} of {}", postmortem.id, script.display());
+        Ok(postmortem)
+    }
+
+    /// Postmortems, oldest first: of `script`, or of every script
+    pub fn list(&self, script: Option<&Path>) -> Result<Vec<Postmortem>, SingleloadError> {
+        let dirs = match script {
+            Some(script) => vec![self.dir(script)?],
+            None => match std::fs::read_dir(&self.root) {
+                Ok(entries) => entries.flatten().map(|e| e.path().join(POSTMORTEMS_DIR)).collect(),
+                Err(_) => vec![],
+            },
+        };
+        let mut postmortems = Vec::new();
+        for dir in dirs {
+            let Ok(entries) = std::fs::read_dir(&dir) else {
+                continue;
+            };
+            for entry in entries.flatten() {
+                if let Some(postmortem) = read_bundle(&entry.path()) {
+                    postmortems.push(postmortem);
+                }
+            }
+        }
+        postmortems.sort_by(|a, b| a.created_at.cmp(&b.created_at).then_with(|| a.id.cmp(&b.id)));
+        Ok(postmortems)
+    }
+
+    /// The postmortem with `id`, or the only one whose id starts with it
+    pub fn get(&self, id: &str) -> Result<Option<Postmortem>, SingleloadError> {
+        let all = self.list(None)?;
+        if let Some(exact) = all.iter().find(|p| p.id == id) {
+            return Ok(Some(exact.clone()));
+        }
+        let matching: Vec<&Postmortem> = all.iter().filter(|p| p.id.starts_with(id)).collect();
+        match matching.as_slice() {
+            [] => Ok(None),
+            [one] => Ok(Some((*one).clone())),
+            _ => Err(SingleloadError::InvalidInput(format!(
+                "postmortem id '{}' is ambiguous ({} match)",
+                id,
+                matching.len()
+            ))),
+        }
+    }
+
+    fn prune(&self, base: &Path) -> Result<(), SingleloadError> {
+        let mut bundles: Vec<Postmortem> = std::fs::read_dir(base)?
+            .flatten()
+            .filter_map(|entry| read_bundle(&entry.path()))
+            .collect();
+        bundles.sort_by(|a, b| b.created_at.cmp(&a.created_at).then_with(|| b.id.cmp(&a.id)));
+        for old in bundles.iter().skip(MAX_POSTMORTEMS) {
+            std::fs::remove_dir_all(&old.dir)?;
+        }
+        Ok(())
+    }
+}
+
+fn read_bundle(dir: &Path) -> Option<Postmortem> {
+    let data = std::fs::read(dir.join(BUNDLE_FILE)).ok()?;
+    let mut postmortem: Postmortem = serde_json::from_slice(&data).ok()?;
+    postmortem.dir = dir.to_path_buf();
+    Some(postmortem)
+}
@@ -0,0 +1,348 @@
+use crate::errors::SingleloadError;
+#[cfg(windows)]
+use crate::platform::ProcessTree;
+use regex::{Captures, Regex};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeSet, HashMap};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use std::sync::Arc;
+
+/// A transformation applied to a script's source before it is staged and
+/// compiled. Implementations should keep line numbers intact so compiler
+/// diagnostics still point at the right lines of the original file.
+pub trait Preprocessor: Send + Sync {
+    /// Name shown in errors
+    fn name(&self) -> &str;
+
+    fn preprocess(&self, src: &[u8]) -> Result<Vec<u8>, SingleloadError>;
+}
+
+/// A preprocessor as declared under `[preprocessors]` in the config
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(untagged)]
+pub enum PreprocessorSpec {
+    /// A built-in preprocessor by name: `env` or `strip`
+    Builtin(String),
+    /// A host command reading the source on stdin and writing the result to
+    /// stdout. It runs outside the sandbox, which is why project config
+    /// files cannot declare preprocessors.
+    Command { command: String },
+}
+
+/// Preprocessor chains per language, applied in order
+#[derive(Clone, Default)]
+pub struct Preprocessors {
+    chains: HashMap<String, Vec<Arc<dyn Preprocessor>>>,
+}
+
+impl Preprocessors {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn from_config(specs: &HashMap<String, Vec<PreprocessorSpec>>) -> Result<Self, SingleloadError> {
+        let mut preprocessors = Self::new();
+        for (language, chain) in specs {
+            for spec in chain {
+                let preprocessor: Arc<dyn Preprocessor> = match spec {
+                    PreprocessorSpec::Builtin(name) => builtin(name).ok_or_else(|| {
+                        SingleloadError::InvalidInput(format!(
+                            "Unknown preprocessor '{}' for {} (expected env, strip or {{ command = \"...\" }})",
+                            name, language
+                        ))
+                    })?,
+                    PreprocessorSpec::Command { command } => Arc::new(CommandPreprocessor::new(command.clone())),
+                };
+                preprocessors.register(language, preprocessor);
+            }
+        }
+        Ok(preprocessors)
+    }
+
+    /// Appends `preprocessor` to the chain of `language`
+    pub fn register(&mut self, language: &str, preprocessor: Arc<dyn Preprocessor>) {
+        self.chains.entry(language.to_string()).or_default().push(preprocessor);
+    }
+
+    pub fn is_empty(&self, language: &str) -> bool {
+        self.chains.get(language).map_or(true, |chain| chain.is_empty())
+    }
+
+    /// Runs the chain of `language` over `src`
+    pub fn apply(&self, language: &str, src: Vec<u8>) -> Result<Vec<u8>, SingleloadError> {
+        let Some(chain) = self.chains.get(language) else {
+            return Ok(src);
+        };
+        chain.iter().try_fold(src, |src, preprocessor| {
+            preprocessor.preprocess(&src).map_err(|e| {
+                SingleloadError::InvalidInput(format!("Preprocessor '{}' failed: {}", preprocessor.name(), e))
+            })
+        })
+    }
+}
+
+/// Looks up a built-in preprocessor
+pub fn builtin(name: &str) -> Option<Arc<dyn Preprocessor>> {
+    match name {
+        "env" => Some(Arc::new(EnvTemplate)),
+        "strip" => Some(Arc::new(StripBlocks)),
+        _ => None,
+    }
+}
+
+/// Replaces `{{env.NAME}}` with the host's `NAME`, or with `fallback` for
+/// `{{env.NAME:-fallback}}` when it is unset. Values are inserted as they
+/// are, without quoting for the script's language.
+pub struct EnvTemplate;
+
+impl Preprocessor for EnvTemplate {
+    fn name(&self) -> &str {
+        "env"
+    }
+
+    fn preprocess(&self, src: &[u8]) -> Result<Vec<u8>, SingleloadError> {
+        let text = std::str::from_utf8(src)
+            .map_err(|_| SingleloadError::InvalidInput("source is not valid UTF-8".to_string()))?;
+        let pattern = Regex::new(r"\{\{\s*env\.([A-Za-z_][A-Za-z0-9_]*)(?::-(.*?))?\s*\}\}").expect("valid pattern");
+
+        let mut missing = Vec::new();
+        let output = pattern.replace_all(text, |caps: &Captures| {
+            match std::env::var(&caps[1]).ok().or_else(|| caps.get(2).map(|m| m.as_str().to_string())) {
+                Some(value) => value,
+                None => {
+                    missing.push(caps[1].to_string());
+                    String::new()
+                }
+            }
+        });
+
+        if !missing.is_empty() {
+            missing.dedup();
+            return Err(SingleloadError::InvalidInput(format!("{} not set", missing.join(", "))));
+        }
+        Ok(output.into_owned().into_bytes())
+    }
+}
+
+/// Replaces `{{.Name}}` placeholders with values given with `--set` or read
+/// from a values file, so one source can be turned into several small
+/// tools. Nested tables of a values file are reached with dots, as in
+/// `{{.db.host}}`. Placeholders without a value are left as they are, since
+/// a Go script may have templates of its own, unless `strict` is set.
+pub struct ValuesTemplate {
+    values: HashMap<String, String>,
+    strict: bool,
+}
+
+impl ValuesTemplate {
+    pub fn new(values: HashMap<String, String>, strict: bool) -> Self {
+        Self { values, strict }
+    }
+
+    /// Values from `files` in order, then from `KEY=VALUE` pairs, later
+    /// ones replacing earlier ones
+    pub fn load(files: &[PathBuf], pairs: &[String], strict: bool) -> Result<Self, SingleloadError> {
+        let mut values = HashMap::new();
+        for file in files {
+            values.extend(load_values(file)?);
+        }
+        for pair in pairs {
+            let (key, value) = parse_set(pair)?;
+            values.insert(key, value);
+        }
+        Ok(Self::new(values, strict))
+    }
+}
+
+impl Preprocessor for ValuesTemplate {
+    fn name(&self) -> &str {
+        "values"
+    }
+
+    fn preprocess(&self, src: &[u8]) -> Result<Vec<u8>, SingleloadError> {
+        let text = std::str::from_utf8(src)
+            .map_err(|_| SingleloadError::InvalidInput("source is not valid UTF-8".to_string()))?;
+        let pattern = Regex::new(r"\{\{\s*\.([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)\s*\}\}")
+            .expect("valid pattern");
+
+        let mut unresolved = BTreeSet::new();
+        let output = pattern.replace_all(text, |caps: &Captures| match self.values.get(&caps[1]) {
+            Some(value) => value.clone(),
+            None => {
+                let start = caps.get(0).expect("whole match").start();
+                let line = text[..start].matches('\n').count() + 1;
+                unresolved.insert(format!("{{{{.{}}}}} (line {})", &caps[1], line));
+                caps[0].to_string()
+            }
+        });
+
+        if self.strict && !unresolved.is_empty() {
+            let unresolved: Vec<String> = unresolved.into_iter().collect();
+            return Err(SingleloadError::InvalidInput(format!(
+                "no value for {}; pass one with --set or a values file",
+                unresolved.join(", ")
+            )));
+        }
+        Ok(output.into_owned().into_bytes())
+    }
+}
+
+/// Splits a `--set KEY=VALUE` flag
+pub fn parse_set(pair: &str) -> Result<(String, String), SingleloadError> {
+    let (key, value) = pair
+        .split_once('=')
+        .ok_or_else(|| SingleloadError::InvalidInput(format!("Invalid --set '{}' (expected KEY=VALUE)", pair)))?;
+    let valid = !key.is_empty()
+        && key.split('.').all(|part| {
+            part.chars().next().is_some_and(|c| c.is_ascii_alphabetic() || c == '_')
+                && part.chars().all(|c| c.is_ascii_alphanumeric() || c == '_')
+        });
+    if !valid {
+        return Err(SingleloadError::InvalidInput(format!("Invalid --set key '{}'", key)));
+    }
+    Ok((key.to_string(), value.to_string()))
+}
+
+/// Reads a values file: JSON when it ends in `.json`, TOML otherwise.
+/// Tables are flattened to dotted keys; strings are used as they are and
+/// numbers and booleans as written.
+pub fn load_values(path: &Path) -> Result<HashMap<String, String>, SingleloadError> {
+    let content = std::fs::read_to_string(path)?;
+    let invalid = |e: String| SingleloadError::InvalidInput(format!("Invalid values file {}: {}", path.display(), e));
+    let document: serde_json::Value = if path.extension().is_some_and(|e| e == "json") {
+        serde_json::from_str(&content).map_err(|e| invalid(e.to_string()))?
+    } else {
+        let table: toml::Table = toml::from_str(&content).map_err(|e| invalid(e.to_string()))?;
+        serde_json::to_value(table).map_err(|e| invalid(e.to_string()))?
+    };
+    if !document.is_object() {
+        return Err(invalid("expected a table of values".to_string()));
+    }
+    let mut values = HashMap::new();
+    flatten_values("", &document, &mut values).map_err(invalid)?;
+    Ok(values)
+}
+
+fn flatten_values(prefix: &str, value: &serde_json::Value, values: &mut HashMap<String, String>) -> Result<(), String> {
+    use serde_json::Value;
+    match value {
+        Value::Object(table) => {
+            for (key, value) in table {
+                let key = if prefix.is_empty() { key.clone() } else { format!("{}.{}", prefix, key) };
+                flatten_values(&key, value, values)?;
+            }
+        }
+        Value::String(s) => {
+            values.insert(prefix.to_string(), s.clone());
+        }
+        Value::Number(_) | Value::Bool(_) => {
+            values.insert(prefix.to_string(), value.to_string());
+        }
+        Value::Null | Value::Array(_) => return Err(format!("'{}' is not a string, number or boolean", prefix)),
+    }
+    Ok(())
+}
+
+/// Blanks the lines from a `singleload:strip-begin` marker through the
+/// next `singleload:strip-end`, e.g. experimental code a toolchain cannot
+/// compile yet. Blank lines keep the line numbers of the rest.
+pub struct StripBlocks;
+
+const STRIP_BEGIN: &str = "singleload:strip-begin";
+const STRIP_END: &str = "singleload:strip-end";
+
+impl Preprocessor for StripBlocks {
+    fn name(&self) -> &str {
+        "strip"
+    }
+
+    fn preprocess(&self, src: &[u8]) -> Result<Vec<u8>, SingleloadError> {
+        let text = String::from_utf8_lossy(src);
+        let mut output = String::with_capacity(text.len());
+        let mut opened_at = None;
+
+        for (idx, line) in text.split_inclusive('\n').enumerate() {
+            let newline = if line.ends_with('\n') { "\n" } else { "" };
+            if opened_at.is_none() && line.contains(STRIP_BEGIN) {
+                opened_at = Some(idx + 1);
+            }
+            if opened_at.is_some() {
+                output.push_str(newline);
+                if line.contains(STRIP_END) {
+                    opened_at = None;
+                }
+            } else {
+                output.push_str(line);
+            }
+        }
+
+        if let Some(line) = opened_at {
+            return Err(SingleloadError::InvalidInput(format!(
+                "{} on line {} has no matching {}",
+                STRIP_BEGIN, line, STRIP_END
+            )));
+        }
+        Ok(output.into_bytes())
+    }
+}
+
+/// Pipes the source through a shell command on the host (`sh -c`, or
+/// `cmd /C` on Windows), which must exit with status 0
+pub struct CommandPreprocessor {
+    command: String,
+}
+
+impl CommandPreprocessor {
+    pub fn new(command: String) -> Self {
+        Self { command }
+    }
+}
+
+impl Preprocessor for CommandPreprocessor {
+    fn name(&self) -> &str {
+        &self.command
+    }
+
+    fn preprocess(&self, src: &[u8]) -> Result<Vec<u8>, SingleloadError> {
+        let mut command = if cfg!(windows) {
+            let mut command = Command::new("cmd");
+            command.arg("/C").arg(&self.command);
+            command
+        } else {
+            let mut command = Command::new("sh");
+            command.arg("-c").arg(&self.command);
+            command
+        };
+        let mut child = command
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()?;
+        // Ctrl-C reaches the whole foreground process group on Unix; on
+        // Windows whatever the command leaves running is killed with its job
+        // when singleload exits
+        #[cfg(windows)]
+        let _job = ProcessTree::attach(&child)?;
+
+        // Feed stdin from another thread so a command writing a lot of
+        // output before reading all of its input cannot deadlock
+        let mut stdin = child.stdin.take().expect("stdin is piped");
+        let input = src.to_vec();
+        let writer = std::thread::spawn(move || stdin.write_all(&input));
+
+        let output = child.wait_with_output()?;
+        // A command that exits without reading its input is not an error in itself
+        let _ = writer.join();
+
+        if !output.status.success() {
+            return Err(SingleloadError::InvalidInput(format!(
+                "exited with {}: {}",
+                output.status,
+                String::from_utf8_lossy(&output.stderr).trim()
+            )));
+        }
+        Ok(output.stdout)
+    }
+}
@@ -0,0 +1,66 @@
+use crate::errors::SingleloadError;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+
+/// Profile used when neither `--profile` nor a `profile` directive picks one
+pub const DEFAULT_PROFILE: &str = "debug";
+
+/// Compiler flags of a named build mode, per language, e.g. in the
+/// configuration:
+///
+/// ```json
+/// "build_profiles": { "small": { "go": ["-trimpath", "-ldflags=-s -w"] } }
+/// ```
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(transparent)]
+pub struct BuildProfile {
+    flags: HashMap<String, Vec<String>>,
+}
+
+impl BuildProfile {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn with_flags(mut self, language: &str, flags: &[&str]) -> Self {
+        self.flags
+            .insert(language.to_string(), flags.iter().map(|f| f.to_string()).collect());
+        self
+    }
+
+    /// Built-in profiles: `debug`, the toolchains' own defaults, and
+    /// `release` for optimized, stripped binaries
+    pub fn builtin(name: &str) -> Option<Self> {
+        match name {
+            "debug" => Some(Self::new()),
+            "release" => Some(
+                Self::new()
+                    .with_flags("go", &["-trimpath", "-ldflags=-s -w"])
+                    .with_flags("rust", &["-C", "opt-level=3", "-C", "strip=symbols"])
+                    .with_flags("dotnet", &["-c", "Release"])
+                    .with_flags("c", &["-O2", "-DNDEBUG", "-s"])
+                    .with_flags("cpp", &["-O2", "-DNDEBUG", "-s"])
+                    .with_flags("cuda", &["-O3", "-DNDEBUG"])
+                    .with_flags("opencl", &["-O2", "-DNDEBUG", "-s"]),
+            ),
+            _ => None,
+        }
+    }
+
+    /// Resolves a profile by name, preferring profiles defined in the configuration
+    pub fn resolve(
+        name: &str,
+        configured: &HashMap<String, BuildProfile>,
+    ) -> Result<Self, SingleloadError> {
+        configured
+            .get(name)
+            .cloned()
+            .or_else(|| Self::builtin(name))
+            .ok_or_else(|| SingleloadError::InvalidInput(format!("Unknown build profile: {}", name)))
+    }
+
+    /// Extra compiler flags for `language`; empty when the profile has none
+    pub fn flags_for(&self, language: &str) -> &[String] {
+        self.flags.get(language).map(|f| f.as_slice()).unwrap_or(&[])
+    }
+}
@@ -0,0 +1,275 @@
+use crate::errors::SingleloadError;
+use regex::Regex;
+use std::fmt;
+use std::path::{Path, PathBuf};
+
+/// Where profiled runs write their profile
+pub const CONTAINER_PROFILE_DIR: &str = "/profile";
+
+/// Name of the profile the profiler writes in [`CONTAINER_PROFILE_DIR`]
+const PROFILE_FILE: &str = "profile";
+
+/// Variables the shim compiled into profiled Go programs reads the
+/// profile's path from
+const GO_CPU_ENV: &str = "SINGLELOAD_PROFILE_CPU";
+const GO_HEAP_ENV: &str = "SINGLELOAD_PROFILE_HEAP";
+
+/// Languages built into native programs, which perf and massif profile
+const NATIVE_LANGUAGES: &[&str] = &["c", "cpp", "cuda", "opencl", "rust"];
+
+/// Frames of each allocation tracemalloc keeps, and allocation sites reported
+const TRACEMALLOC_FRAMES: usize = 25;
+const TRACEMALLOC_TOP: usize = 50;
+
+/// Sampling rate of perf and py-spy, in samples per second
+const SAMPLE_RATE: u32 = 999;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ProfileKind {
+    Cpu,
+    Heap,
+}
+
+impl fmt::Display for ProfileKind {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            ProfileKind::Cpu => "CPU",
+            ProfileKind::Heap => "heap",
+        })
+    }
+}
+
+/// What `run --profile-cpu` or `--profile-heap` asked for
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Profiling {
+    pub kind: ProfileKind,
+    /// Where the profile is written; next to the script when not given
+    pub output: Option<PathBuf>,
+}
+
+impl Profiling {
+    /// Where the profile of `script` goes, e.g. `tool.cpu.pprof` beside `tool.go`
+    pub fn output_path(&self, script: &Path, profiler: Profiler) -> PathBuf {
+        let kind = match self.kind {
+            ProfileKind::Cpu => "cpu",
+            ProfileKind::Heap => "heap",
+        };
+        match &self.output {
+            Some(path) => path.clone(),
+            None => script.with_extension(format!("{}.{}", kind, profiler.extension())),
+        }
+    }
+}
+
+/// The native profiler of a language's backend
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Profiler {
+    /// runtime/pprof, started by a shim compiled into the program
+    Pprof,
+    PySpy,
+    Tracemalloc,
+    Perf,
+    /// valgrind's heap profiler
+    Massif,
+}
+
+impl Profiler {
+    pub fn for_language(language: &str, kind: ProfileKind) -> Result<Self, SingleloadError> {
+        let native = NATIVE_LANGUAGES.contains(&language);
+        match (language, kind) {
+            ("go", _) => Ok(Self::Pprof),
+            ("python", ProfileKind::Cpu) => Ok(Self::PySpy),
+            ("python", ProfileKind::Heap) => Ok(Self::Tracemalloc),
+            (_, ProfileKind::Cpu) if native => Ok(Self::Perf),
+            (_, ProfileKind::Heap) if native => Ok(Self::Massif),
+            (other, _) => Err(SingleloadError::InvalidInput(format!(
+                "{} profiles are supported for go, python, {} scripts, not {}",
+                kind,
+                NATIVE_LANGUAGES.join(", "),
+                other
+            ))),
+        }
+    }
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            Self::Pprof => "pprof",
+            Self::PySpy => "py-spy",
+            Self::Tracemalloc => "tracemalloc",
+            Self::Perf => "perf",
+            Self::Massif => "massif",
+        }
+    }
+
+    /// Extension of the profile's file, after `.cpu` or `.heap`
+    pub fn extension(&self) -> &'static str {
+        match self {
+            Self::Pprof => "pprof",
+            Self::PySpy => "speedscope.json",
+            Self::Tracemalloc => "txt",
+            Self::Perf => "perf.data",
+            Self::Massif => "massif",
+        }
+    }
+
+    /// The command that shows the profile at `path`
+    pub fn viewer(&self, path: &Path) -> String {
+        let path = path.display();
+        match self {
+            Self::Pprof => format!("go tool pprof -http=: {}", path),
+            Self::PySpy => format!("speedscope {}", path),
+            Self::Tracemalloc => format!("less {}", path),
+            Self::Perf => format!("perf report -i {}", path),
+            Self::Massif => format!("ms_print {}", path),
+        }
+    }
+
+    /// Wraps `command`, the one running the program without its build, so
+    /// the profiler starts it
+    pub fn wrap(&self, command: &[String]) -> Vec<String> {
+        let output = format!("{}/{}", CONTAINER_PROFILE_DIR, PROFILE_FILE);
+        let rate = SAMPLE_RATE.to_string();
+        let prefix: Vec<String> = match self {
+            Self::Pprof => return command.to_vec(),
+            // Without --nonblocking py-spy stops the program with ptrace
+            // for every sample
+            Self::PySpy => vec![
+                "py-spy", "record", "--nonblocking", "--format", "speedscope", "--rate", &rate, "-o", &output, "--",
+            ]
+            .into_iter()
+            .map(String::from)
+            .collect(),
+            // Python's own allocator hooks, reported when the interpreter exits
+            Self::Tracemalloc => {
+                let Some((python, rest)) = command.split_first() else {
+                    return command.to_vec();
+                };
+                let mut wrapped = vec![
+                    python.clone(),
+                    "-X".to_string(),
+                    format!("tracemalloc={}", TRACEMALLOC_FRAMES),
+                    "-c".to_string(),
+                    tracemalloc_shim(&output),
+                ];
+                wrapped.extend(rest.iter().cloned());
+                return wrapped;
+            }
+            // User space only, which perf_event_paranoid 2 still allows
+            Self::Perf => vec!["perf", "record", "-q", "-g", "-e", "cpu-clock:u", "-F", &rate, "-o", &output, "--"]
+                .into_iter()
+                .map(String::from)
+                .collect(),
+            Self::Massif => vec![
+                "valgrind".to_string(),
+                "-q".to_string(),
+                "--tool=massif".to_string(),
+                format!("--massif-out-file={}", output),
+            ],
+        };
+        prefix.into_iter().chain(command.iter().cloned()).collect()
+    }
+
+    /// Environment the profiled program needs
+    pub fn env(&self, kind: ProfileKind) -> Vec<(String, String)> {
+        let variable = match (self, kind) {
+            (Self::Pprof, ProfileKind::Cpu) => GO_CPU_ENV,
+            (Self::Pprof, ProfileKind::Heap) => GO_HEAP_ENV,
+            _ => return vec![],
+        };
+        vec![(variable.to_string(), format!("{}/{}", CONTAINER_PROFILE_DIR, PROFILE_FILE))]
+    }
+
+    /// Calls the default seccomp profile blocks that the profiler makes
+    pub fn syscalls(&self) -> &'static [&'static str] {
+        match self {
+            Self::PySpy => &["process_vm_readv"],
+            Self::Perf => &["perf_event_open"],
+            _ => &[],
+        }
+    }
+}
+
+/// Compiles the profiling shim into a Go program: the script's `main`
+/// is renamed and a new one starts runtime/pprof around it when
+/// [`GO_CPU_ENV`] or [`GO_HEAP_ENV`] is set. The imports join the package
+/// clause and the shim is appended, leaving line numbers alone. Other
+/// languages are profiled from outside and stay as they are.
+pub fn instrument(language: &str, content: &[u8]) -> Vec<u8> {
+    if language != "go" {
+        return content.to_vec();
+    }
+    let source = String::from_utf8_lossy(content);
+    let source = Regex::new(r"(?m)^package\s+main\b")
+        .expect("valid pattern")
+        .replace(&source, r#"package main; import (singleloadOS "os"; singleloadPprof "runtime/pprof")"#);
+    let source = Regex::new(r"(?m)^func\s+main\s*\(\s*\)")
+        .expect("valid pattern")
+        .replace(&source, "func singleloadProfiledMain()");
+    format!(
+        r#"{source}
+func main() {{
+	if path := singleloadOS.Getenv("{cpu}"); path != "" {{
+		if f, err := singleloadOS.Create(path); err == nil {{
+			singleloadPprof.StartCPUProfile(f)
+			defer singleloadPprof.StopCPUProfile()
+		}}
+	}}
+	if path := singleloadOS.Getenv("{heap}"); path != "" {{
+		defer func() {{
+			if f, err := singleloadOS.Create(path); err == nil {{
+				singleloadPprof.Lookup("allocs").WriteTo(f, 0)
+				f.Close()
+			}}
+		}}()
+	}}
+	singleloadProfiledMain()
+}}
+"#,
+        source = source,
+        cpu = GO_CPU_ENV,
+        heap = GO_HEAP_ENV
+    )
+    .into_bytes()
+}
+
+/// `python -c` program running the script given after it as `__main__`,
+/// then writing the peak and the allocation sites still holding memory
+/// when it finished or raised
+fn tracemalloc_shim(output: &str) -> String {
+    format!(
+        r#"import os, runpy, sys, tracemalloc
+def _singleload_report():
+    _, peak = tracemalloc.get_traced_memory()
+    snapshot = tracemalloc.take_snapshot().filter_traces([tracemalloc.Filter(False, "<frozen importlib._bootstrap*>")])
+    stats = snapshot.statistics("traceback")
+    with open({output:?}, "w") as f:
+        f.write(f"peak: {{peak}} bytes\nheld at exit: {{sum(s.size for s in stats)}} bytes in {{sum(s.count for s in stats)}} blocks\n\n")
+        for stat in stats[:{top}]:
+            f.write(f"{{stat.size}} bytes in {{stat.count}} blocks\n")
+            f.writelines(line + "\n" for line in stat.traceback.format(most_recent_first=True))
+            f.write("\n")
+sys.argv = sys.argv[1:]
+sys.path[0] = os.path.dirname(os.path.abspath(sys.argv[0]))
+try:
+    # The script's globals are still alive when it is reported
+    _singleload_globals = runpy.run_path(sys.argv[0], run_name="__main__")
+finally:
+    _singleload_report()
+"#,
+        output = output,
+        top = TRACEMALLOC_TOP
+    )
+}
+
+/// Copies the profile a run left in `dir`, the host side of the profile
+/// mount, to `path` and returns its size
+pub fn collect(dir: &Path, path: &Path, profiler: Profiler) -> Result<u64, SingleloadError> {
+    let profile = dir.join(PROFILE_FILE);
+    if !profile.is_file() {
+        return Err(SingleloadError::Container(format!(
+            "the run left no profile; is {} in the base image and allowed to run?",
+            profiler.name()
+        )));
+    }
+    Ok(std::fs::copy(&profile, path)?)
+}
@@ -0,0 +1,215 @@
+use crate::config::Config;
+use crate::container::ContainerManager;
+use crate::errors::SingleloadError;
+use crate::events::EventSink;
+use crate::executor::{BuildOutput, CancelReceiver, Executor};
+use crate::project::Project;
+use crate::runner::{BuildTarget, Registry};
+use crate::sandbox::SandboxProfile;
+use crate::types::ExecutionResult;
+use anyhow::Result;
+use ed25519_dalek::VerifyingKey;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+/// Options for [`Program::run`]; defaults follow the loaded [`Config`]
+#[derive(Debug, Clone)]
+pub struct RunOptions {
+    pub timeout: Duration,
+    pub memory_mb: u64,
+    pub cpu: f32,
+    pub max_output_kb: u64,
+    pub sandbox: SandboxProfile,
+    /// Build and run for this target, e.g. [`BuildTarget::wasi`]
+    pub target: Option<BuildTarget>,
+    pub no_cache: bool,
+    /// Fail when the dependency lockfile is missing or stale
+    pub frozen: bool,
+    pub keep_container: bool,
+    /// Environment variables passed to the program
+    pub env: Vec<(String, String)>,
+    /// Run without the persistent state directory
+    pub no_state: bool,
+    /// Refuse to run unless the program's `.sig` signature matches this key
+    pub verifying_key: Option<VerifyingKey>,
+    /// Build profile; None uses the program's `profile` directive or `debug`
+    pub profile: Option<String>,
+    /// Compiler flags appended to those of the profile
+    pub build_args: Vec<String>,
+    /// Arguments passed to the program
+    pub args: Vec<String>,
+    /// Stops the run when set to true
+    pub cancel: Option<CancelReceiver>,
+    /// Receives progress events and compiler diagnostics
+    pub events: EventSink,
+}
+
+impl RunOptions {
+    pub fn from_config(config: &Config) -> Self {
+        Self {
+            timeout: Duration::from_secs(config.default_timeout_secs),
+            memory_mb: config.default_memory_mb,
+            cpu: config.default_cpu_limit,
+            max_output_kb: config.default_output_limit_kb,
+            sandbox: SandboxProfile::resolve(&config.default_sandbox, &config.sandbox_profiles).unwrap_or_default(),
+            target: None,
+            no_cache: false,
+            frozen: false,
+            keep_container: false,
+            env: Vec::new(),
+            no_state: false,
+            verifying_key: None,
+            profile: None,
+            build_args: Vec::new(),
+            args: Vec::new(),
+            cancel: None,
+            events: EventSink::default(),
+        }
+    }
+}
+
+impl Default for RunOptions {
+    fn default() -> Self {
+        Self::from_config(&Config::default())
+    }
+}
+
+/// A single-file program resolved to a language, ready to run or build.
+///
+/// This is the entry point for tools embedding Singleload:
+///
+/// ```no_run
+/// # async fn example() -> anyhow::Result<()> {
+/// let program = singleload::load("hello.go")?;
+/// let result = program.run(&singleload::RunOptions::default()).await?;
+/// println!("{}", result.stdout);
+/// # Ok(())
+/// # }
+/// ```
+pub struct Program {
+    path: PathBuf,
+    language: String,
+    registry: Registry,
+    config: Config,
+}
+
+/// Loads a program, detecting its language from the extension or content
+pub fn load(path: impl AsRef<Path>) -> Result<Program> {
+    Program::load(path, None, Registry::default())
+}
+
+impl Program {
+    /// Loads a program with an explicit language and/or registry of runners.
+    /// `path` may also be a directory project with a `singleload.toml`.
+    pub fn load(path: impl AsRef<Path>, lang: Option<&str>, registry: Registry) -> Result<Self> {
+        let path = path.as_ref();
+        if !path.exists() {
+            return Err(SingleloadError::ScriptNotFound(path.display().to_string()).into());
+        }
+        let project = if Project::is_project(path) {
+            Some(Project::load(path, &registry)?)
+        } else {
+            None
+        };
+        let main = project.as_ref().map_or(path, |p| p.main.as_path());
+        let lang = lang.or(project.as_ref().and_then(|p| p.lang.as_deref()));
+        let content = std::fs::read(main)?;
+
+        let runner = match lang {
+            Some(name) => registry.get(name),
+            None => registry.detect(main, &content),
+        }
+        .ok_or_else(|| {
+            SingleloadError::UnsupportedLanguage(format!(
+                "{} (available: {})",
+                lang.unwrap_or_else(|| path.to_str().unwrap_or("script")),
+                registry.names().join(", ")
+            ))
+        })?;
+
+        Ok(Self {
+            path: path.to_path_buf(),
+            language: runner.name().to_string(),
+            registry,
+            config: Config::load()?,
+        })
+    }
+
+    /// Uses `config` instead of the one loaded from the environment
+    pub fn with_config(mut self, config: Config) -> Self {
+        self.config = config;
+        self
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    pub fn language(&self) -> &str {
+        &self.language
+    }
+
+    /// Compiles (if needed) and runs the program in a container
+    pub async fn run(&self, opts: &RunOptions) -> Result<ExecutionResult> {
+        let executor = self.executor(opts).await?;
+        match &opts.cancel {
+            Some(cancel) => {
+                executor
+                    .run_script_cancellable(Some(&self.language), &self.path, opts.keep_container, cancel.clone())
+                    .await
+            }
+            None => {
+                executor
+                    .run_script(Some(&self.language), &self.path, opts.keep_container)
+                    .await
+            }
+        }
+    }
+
+    /// Compiles the program into a standalone artifact at `output`
+    pub async fn build(
+        &self,
+        output: &Path,
+        target: Option<&BuildTarget>,
+        opts: &RunOptions,
+    ) -> Result<BuildOutput> {
+        let executor = self.executor(opts).await?;
+        executor
+            .build_script(Some(&self.language), &self.path, target, output)
+            .await
+    }
+
+    async fn executor(&self, opts: &RunOptions) -> Result<Executor> {
+        let container_manager = ContainerManager::new(self.config.clone()).await?;
+        if !container_manager.base_image_exists().await? {
+            return Err(SingleloadError::BaseImageNotFound.into());
+        }
+
+        let mut executor = Executor::new(
+            container_manager,
+            opts.timeout,
+            opts.memory_mb * 1024 * 1024,
+            opts.cpu,
+            opts.max_output_kb * 1024,
+        )
+        .with_registry(self.registry.clone())
+        .with_sandbox(opts.sandbox.clone())
+        .with_target(opts.target.clone())
+        .with_events(opts.events.clone())
+        .with_env(opts.env.clone())
+        .with_verifying_key(opts.verifying_key)
+        .with_profile(opts.profile.clone())
+        .with_build_args(opts.build_args.clone())
+        .with_run_args(opts.args.clone());
+        if opts.no_cache {
+            executor = executor.without_cache();
+        }
+        if opts.frozen {
+            executor = executor.frozen();
+        }
+        if opts.no_state {
+            executor = executor.without_state();
+        }
+        Ok(executor)
+    }
+}
@@ -0,0 +1,257 @@
+use crate::events::{Diagnostic, Event, EventSink};
+use std::io::{IsTerminal, Write};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+use std::thread::JoinHandle;
+use std::time::{Duration, Instant};
+
+const SPINNER: &[&str] = &["⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"];
+const TICK: Duration = Duration::from_millis(100);
+
+/// Lines of compiler output shown when a build fails and no diagnostic
+/// could be parsed from it
+pub const COLLAPSED_LINES: usize = 20;
+
+/// Steps of a run or build, in the order they happen
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Phase {
+    /// Reading the script, its directives and lockfile
+    Resolve,
+    /// Installing toolchains and dependencies
+    Fetch,
+    Build,
+    Run,
+}
+
+impl Phase {
+    fn label(self) -> &'static str {
+        match self {
+            Phase::Resolve => "resolve",
+            Phase::Fetch => "fetch",
+            Phase::Build => "build",
+            Phase::Run => "run",
+        }
+    }
+}
+
+/// How a run or build ended, as far as the progress display saw it
+#[derive(Debug, Clone, Default)]
+pub struct Outcome {
+    /// True if the build step failed, so the output is the compiler's
+    pub build_failed: bool,
+    pub diagnostics: Vec<Diagnostic>,
+}
+
+/// Whether to show the progress display: text output on a terminal,
+/// unless `--plain` asks for the output as it was before, or `TERM=dumb`
+pub fn enabled(format: &str, plain: bool) -> bool {
+    !plain
+        && format == "text"
+        && std::io::stderr().is_terminal()
+        && std::env::var("TERM").map_or(true, |term| term != "dumb")
+}
+
+/// Draws the phases of a run on stderr as they happen, one line each with
+/// its elapsed time, the current one with a spinner
+pub struct Progress {
+    state: Arc<Mutex<State>>,
+    stop: Arc<AtomicBool>,
+    ticker: Option<JoinHandle<()>>,
+}
+
+struct State {
+    color: bool,
+    current: Option<(Phase, Instant, String)>,
+    frame: usize,
+    outcome: Outcome,
+}
+
+impl Progress {
+    /// Starts the display, in color unless `NO_COLOR` is set
+    pub fn start() -> Self {
+        let color = std::env::var_os("NO_COLOR").is_none();
+        let state = Arc::new(Mutex::new(State {
+            color,
+            current: Some((Phase::Resolve, Instant::now(), String::new())),
+            frame: 0,
+            outcome: Outcome::default(),
+        }));
+        let stop = Arc::new(AtomicBool::new(false));
+        let ticker = std::thread::spawn({
+            let state = state.clone();
+            let stop = stop.clone();
+            move || {
+                while !stop.load(Ordering::Relaxed) {
+                    state.lock().unwrap().draw();
+                    std::thread::sleep(TICK);
+                }
+            }
+        });
+        Self {
+            state,
+            stop,
+            ticker: Some(ticker),
+        }
+    }
+
+    /// Events of the executor, moving the display from phase to phase
+    pub fn sink(&self) -> EventSink {
+        let state = self.state.clone();
+        EventSink::new(move |event| state.lock().unwrap().handle(event))
+    }
+
+    /// Stops the display, leaving the finished phases on the terminal
+    pub fn finish(mut self) -> Outcome {
+        self.stop();
+        let mut state = self.state.lock().unwrap();
+        // A run that failed before finishing, e.g. on a missing dependency
+        if let Some((phase, started, _)) = state.current.take() {
+            state.complete(phase, started, false, "");
+        }
+        std::mem::take(&mut state.outcome)
+    }
+
+    fn stop(&mut self) {
+        self.stop.store(true, Ordering::Relaxed);
+        if let Some(ticker) = self.ticker.take() {
+            let _ = ticker.join();
+        }
+    }
+}
+
+impl Drop for Progress {
+    fn drop(&mut self) {
+        self.stop();
+    }
+}
+
+impl State {
+    fn handle(&mut self, event: &Event) {
+        match event {
+            Event::ToolchainInstall { language, version } => {
+                self.enter(Phase::Fetch, format!("{} {} toolchain", language, version));
+            }
+            Event::DependencyInstall { count } => {
+                self.enter(Phase::Fetch, format!("{} dependencies", count));
+            }
+            Event::Started { .. } => self.end(),
+            Event::BuildCached { language } => {
+                self.end();
+                self.complete(Phase::Build, Instant::now(), true, &format!("{}, cached", language));
+            }
+            Event::BuildStarted { language } => self.enter(Phase::Build, language.clone()),
+            Event::BuildFinished { .. } => {
+                self.end();
+                self.enter(Phase::Run, String::new());
+            }
+            Event::ContainerCreated { .. } => {
+                // A build runs first in the script's container and is over
+                // with `build_finished`
+                if !matches!(self.current, Some((Phase::Build, ..))) {
+                    self.enter(Phase::Run, String::new());
+                }
+            }
+            Event::Diagnostic(diagnostic) => self.outcome.diagnostics.push(diagnostic.clone()),
+            Event::Finished { exit_code, .. } => {
+                if let Some((phase, started, detail)) = self.current.take() {
+                    let detail = match exit_code {
+                        0 => detail,
+                        code => format!("exit code {}", code),
+                    };
+                    self.outcome.build_failed = phase == Phase::Build && *exit_code != 0;
+                    self.complete(phase, started, *exit_code == 0, &detail);
+                }
+            }
+            Event::Network { .. } | Event::Retry { .. } => {}
+        }
+    }
+
+    /// Moves on to `phase`, finishing the current one unless it is the same
+    fn enter(&mut self, phase: Phase, detail: String) {
+        match &mut self.current {
+            Some((current, _, current_detail)) if *current == phase => *current_detail = detail,
+            _ => {
+                self.end();
+                self.current = Some((phase, Instant::now(), detail));
+            }
+        }
+        self.draw();
+    }
+
+    fn end(&mut self) {
+        if let Some((phase, started, detail)) = self.current.take() {
+            self.complete(phase, started, true, &detail);
+        }
+    }
+
+    fn complete(&mut self, phase: Phase, started: Instant, ok: bool, detail: &str) {
+        let mark = match (ok, self.color) {
+            (true, true) => "\x1b[32m✓\x1b[0m",
+            (true, false) => "✓",
+            (false, true) => "\x1b[31m✗\x1b[0m",
+            (false, false) => "✗",
+        };
+        let line = self.line(mark, phase.label(), started.elapsed(), detail);
+        let _ = writeln!(std::io::stderr().lock(), "\r\x1b[K{}", line);
+    }
+
+    fn draw(&mut self) {
+        let Some((phase, started, detail)) = &self.current else {
+            return;
+        };
+        let spinner = SPINNER[self.frame % SPINNER.len()];
+        self.frame += 1;
+        let mark = match self.color {
+            true => format!("\x1b[36m{}\x1b[0m", spinner),
+            false => spinner.to_string(),
+        };
+        let line = self.line(&mark, phase.label(), started.elapsed(), detail);
+        let mut stderr = std::io::stderr().lock();
+        let _ = write!(stderr, "\r\x1b[K{}", line);
+        let _ = stderr.flush();
+    }
+
+    fn line(&self, mark: &str, label: &str, elapsed: Duration, detail: &str) -> String {
+        let elapsed = format_elapsed(elapsed);
+        let detail = match (detail.is_empty(), self.color) {
+            (true, _) => String::new(),
+            (false, true) => format!("  \x1b[2m{}\x1b[0m", detail),
+            (false, false) => format!("  {}", detail),
+        };
+        format!("{} {:<9} {:>6}{}", mark, label, elapsed, detail)
+    }
+}
+
+fn format_elapsed(elapsed: Duration) -> String {
+    match elapsed.as_millis() {
+        ms if ms < 1000 => format!("{}ms", ms),
+        ms if ms < 60_000 => format!("{:.1}s", ms as f64 / 1000.0),
+        ms => format!("{}m{:02}s", ms / 60_000, ms / 1000 % 60),
+    }
+}
+
+/// Folds the output of a failed build: the diagnostics parsed from it when
+/// there are any, otherwise its first [`COLLAPSED_LINES`] lines, followed
+/// by how much was left out
+pub fn collapse(output: &str, diagnostics: &[Diagnostic]) -> String {
+    let total = output.lines().count();
+    let mut shown: Vec<String> = if diagnostics.is_empty() {
+        output.lines().take(COLLAPSED_LINES).map(String::from).collect()
+    } else {
+        diagnostics
+            .iter()
+            .map(|d| match d.column {
+                Some(column) => format!("{}:{}:{}: {}", d.file, d.line, column, d.message),
+                None => format!("{}:{}: {}", d.file, d.line, d.message),
+            })
+            .collect()
+    };
+    if diagnostics.is_empty() && total <= COLLAPSED_LINES {
+        return output.to_string();
+    }
+    shown.push(format!(
+        "({} lines of compiler output folded, --plain shows all of it)",
+        total
+    ));
+    shown.join("\n")
+}
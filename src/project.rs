@@ -0,0 +1,132 @@
+use crate::errors::SingleloadError;
+use crate::runner::Registry;
+use serde::Deserialize;
+use std::path::{Path, PathBuf};
+
+/// Manifest that turns a directory into a runnable project
+pub const MANIFEST_FILE: &str = "singleload.toml";
+
+/// Contents of `singleload.toml`; every key is optional
+///
+/// ```toml
+/// lang = "go"
+/// main = "main.go"
+/// files = ["main.go", "util.go"]
+/// ```
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ProjectManifest {
+    /// Language of the sources (detected from `main` when omitted)
+    pub lang: Option<String>,
+    /// Entry point (defaults to `main.<ext>`)
+    pub main: Option<String>,
+    /// Sources to build (defaults to every file with the entry point's extension)
+    #[serde(default)]
+    pub files: Vec<String>,
+}
+
+/// A directory of sources built and run like a single script
+#[derive(Debug, Clone)]
+pub struct Project {
+    pub root: PathBuf,
+    pub lang: Option<String>,
+    /// Entry point, the file directives are read from
+    pub main: PathBuf,
+    /// The other sources, all directly inside `root`
+    pub sources: Vec<PathBuf>,
+}
+
+impl Project {
+    pub fn is_project(path: &Path) -> bool {
+        path.is_dir()
+    }
+
+    pub fn load(root: &Path, registry: &Registry) -> Result<Self, SingleloadError> {
+        let manifest_path = root.join(MANIFEST_FILE);
+        let manifest: ProjectManifest = match std::fs::read_to_string(&manifest_path) {
+            Ok(content) => toml::from_str(&content).map_err(|e| {
+                SingleloadError::InvalidInput(format!("Invalid {}: {}", manifest_path.display(), e))
+            })?,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "{} is a directory without a {}",
+                    root.display(),
+                    MANIFEST_FILE
+                )))
+            }
+            Err(e) => return Err(e.into()),
+        };
+
+        let main = match &manifest.main {
+            Some(main) => project_file(root, main)?,
+            None => find_main(root, manifest.lang.as_deref(), registry)?,
+        };
+        if !main.is_file() {
+            return Err(SingleloadError::ScriptNotFound(main.display().to_string()));
+        }
+
+        let mut sources = if manifest.files.is_empty() {
+            let extension = main.extension().map(|e| e.to_os_string());
+            let mut sources = Vec::new();
+            for entry in std::fs::read_dir(root)? {
+                let path = entry?.path();
+                if path.is_file() && path != main && path.extension().map(|e| e.to_os_string()) == extension {
+                    sources.push(path);
+                }
+            }
+            sources
+        } else {
+            manifest
+                .files
+                .iter()
+                .map(|name| project_file(root, name))
+                .collect::<Result<Vec<_>, _>>()?
+                .into_iter()
+                .filter(|path| *path != main)
+                .collect()
+        };
+        sources.sort();
+
+        Ok(Self {
+            root: root.to_path_buf(),
+            lang: manifest.lang,
+            main,
+            sources,
+        })
+    }
+}
+
+/// Resolves a file name from the manifest; projects are flat, so names
+/// must not contain path separators
+fn project_file(root: &Path, name: &str) -> Result<PathBuf, SingleloadError> {
+    if name.is_empty() || name.contains('/') || name.contains('\\') || name.starts_with('.') {
+        return Err(SingleloadError::InvalidInput(format!(
+            "Invalid project file '{}': files must be directly inside the project directory",
+            name
+        )));
+    }
+    Ok(root.join(name))
+}
+
+/// `main.<ext>` for the declared language, or for the first language that has one
+fn find_main(root: &Path, lang: Option<&str>, registry: &Registry) -> Result<PathBuf, SingleloadError> {
+    let extensions = match lang {
+        Some(name) => registry
+            .get(name)
+            .map(|runner| vec![runner.file_extension().to_string()])
+            .ok_or_else(|| SingleloadError::UnsupportedLanguage(name.to_string()))?,
+        None => registry.extensions(),
+    };
+
+    extensions
+        .iter()
+        .map(|ext| root.join(format!("main{}", ext)))
+        .find(|path| path.is_file())
+        .ok_or_else(|| {
+            SingleloadError::InvalidInput(format!(
+                "No main file found in {}, set `main` in {}",
+                root.display(),
+                MANIFEST_FILE
+            ))
+        })
+}
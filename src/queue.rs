@@ -0,0 +1,180 @@
+use crate::executor::CancelReceiver;
+use serde::{Deserialize, Serialize};
+use std::cmp::Reverse;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex};
+use tokio::sync::{oneshot, watch};
+
+/// Order in which queued requests get a container slot
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, PartialOrd, Ord, Serialize, Deserialize, clap::ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum Priority {
+    /// Background work, like builds an editor starts on save
+    Low,
+    #[default]
+    Normal,
+    /// Someone is waiting for the result
+    High,
+}
+
+/// A request waiting for its turn
+#[derive(Debug, Clone)]
+pub struct Job {
+    /// Canonical path of the script, to find superseded requests
+    pub script: PathBuf,
+    /// Language of the script, for the per-language limits; None when it
+    /// could not be told yet
+    pub language: Option<String>,
+    pub priority: Priority,
+    /// Replace earlier requests for the same script: queued ones are
+    /// dropped and running ones cancelled
+    pub supersede: bool,
+}
+
+/// Hands out container slots to requests, highest priority first and in
+/// arrival order within a priority, so a burst of requests does not spawn
+/// a compiler for each at once. Languages can have lower limits of their
+/// own, e.g. one Rust build at a time; requests of a language at its limit
+/// wait without holding up other languages.
+pub struct BuildQueue {
+    limit: usize,
+    language_limits: HashMap<String, usize>,
+    state: Mutex<State>,
+}
+
+#[derive(Default)]
+struct State {
+    next_id: u64,
+    waiting: Vec<Waiting>,
+    running: Vec<Running>,
+}
+
+struct Waiting {
+    id: u64,
+    job: Job,
+    /// Dropped without sending when the request is superseded
+    ready: oneshot::Sender<Ticket>,
+}
+
+struct Running {
+    id: u64,
+    script: PathBuf,
+    language: Option<String>,
+    cancel: watch::Sender<bool>,
+}
+
+/// A slot held by a request; dropping it lets the next one start
+pub struct Ticket {
+    queue: Arc<BuildQueue>,
+    /// None once the slot went back without being used
+    id: Option<u64>,
+    cancel: CancelReceiver,
+}
+
+impl Ticket {
+    /// Fires when a newer request for the same script supersedes this one
+    pub fn cancel(&self) -> CancelReceiver {
+        self.cancel.clone()
+    }
+}
+
+impl Drop for Ticket {
+    fn drop(&mut self) {
+        if let Some(id) = self.id.take() {
+            self.queue.finish(id);
+        }
+    }
+}
+
+impl BuildQueue {
+    pub fn new(limit: usize, language_limits: HashMap<String, usize>) -> Arc<Self> {
+        Arc::new(Self {
+            limit: limit.max(1),
+            language_limits,
+            state: Mutex::new(State::default()),
+        })
+    }
+
+    /// Waits for a slot for `job`. Returns None if a newer request for the
+    /// same script superseded it while it was queued.
+    pub async fn acquire(self: &Arc<Self>, job: Job) -> Option<Ticket> {
+        let ready = {
+            let mut state = self.state.lock().unwrap();
+            if job.supersede {
+                state.waiting.retain(|w| w.job.script != job.script);
+                for running in state.running.iter().filter(|r| r.script == job.script) {
+                    let _ = running.cancel.send(true);
+                }
+            }
+            let (ready, wait) = oneshot::channel();
+            let id = state.next_id;
+            state.next_id += 1;
+            state.waiting.push(Waiting { id, job, ready });
+            self.dispatch(&mut state);
+            wait
+        };
+        ready.await.ok()
+    }
+
+    /// Requests waiting for a slot
+    pub fn queued(&self) -> usize {
+        self.state.lock().unwrap().waiting.len()
+    }
+
+    /// Requests holding a slot
+    pub fn running(&self) -> usize {
+        self.state.lock().unwrap().running.len()
+    }
+
+    fn finish(self: &Arc<Self>, id: u64) {
+        let mut state = self.state.lock().unwrap();
+        state.running.retain(|r| r.id != id);
+        self.dispatch(&mut state);
+    }
+
+    /// Starts waiting requests while there are free slots
+    fn dispatch(self: &Arc<Self>, state: &mut State) {
+        while state.running.len() < self.limit {
+            let next = state
+                .waiting
+                .iter()
+                .enumerate()
+                .filter(|(_, w)| self.has_room(state, w.job.language.as_deref()))
+                .max_by_key(|(_, w)| (w.job.priority, Reverse(w.id)))
+                .map(|(index, _)| index);
+            let Some(index) = next else {
+                break;
+            };
+
+            let waiting = state.waiting.remove(index);
+            let (cancel, cancelled) = watch::channel(false);
+            state.running.push(Running {
+                id: waiting.id,
+                script: waiting.job.script,
+                language: waiting.job.language,
+                cancel,
+            });
+            let ticket = Ticket {
+                queue: self.clone(),
+                id: Some(waiting.id),
+                cancel: cancelled,
+            };
+            // The client went away while waiting; the slot is free again
+            if let Err(mut ticket) = waiting.ready.send(ticket) {
+                ticket.id = None;
+                state.running.retain(|r| r.id != waiting.id);
+            }
+        }
+    }
+
+    fn has_room(&self, state: &State, language: Option<&str>) -> bool {
+        let Some(language) = language else {
+            return true;
+        };
+        match self.language_limits.get(language) {
+            Some(limit) => state.running.iter().filter(|r| r.language.as_deref() == Some(language)).count() < *limit,
+            None => true,
+        }
+    }
+}
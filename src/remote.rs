@@ -0,0 +1,144 @@
+use crate::download::DownloadManager;
+use crate::errors::SingleloadError;
+use crate::security::MAX_SCRIPT_SIZE;
+use crate::signing::signature_path;
+use anyhow::Result;
+use sha2::{Digest, Sha256};
+use std::path::{Path, PathBuf};
+use tracing::{debug, info, warn};
+
+/// Returns true if `source` names a remote script rather than a local path
+pub fn is_remote(source: &str) -> bool {
+    source.starts_with("https://") || source.starts_with("http://")
+}
+
+/// How a remote script is allowed to run
+#[derive(Debug, Clone, Default)]
+pub struct Verification {
+    /// Run whatever the URL currently serves
+    pub trust: bool,
+    /// Only run content with this sha256 checksum (hex)
+    pub sha256: Option<String>,
+}
+
+/// Downloads remote scripts into `<cache>/sources` so they can be run like
+/// local files.
+pub struct RemoteSources {
+    root: PathBuf,
+    downloads: DownloadManager,
+}
+
+impl RemoteSources {
+    pub fn new(cache_root: &Path, downloads: DownloadManager) -> Self {
+        Self {
+            root: cache_root.join("sources"),
+            downloads,
+        }
+    }
+
+    /// Fetches `url` and returns the local copy to run.
+    ///
+    /// Pinned scripts are served from the local copy once downloaded;
+    /// trusted ones are downloaded again on every run and only fall back to
+    /// the local copy when the server cannot be reached.
+    pub async fn fetch(&self, url: &str, verification: &Verification) -> Result<PathBuf> {
+        if !url.starts_with("https://") {
+            return Err(SingleloadError::SecurityViolation(
+                "Remote scripts must be fetched over https".to_string(),
+            )
+            .into());
+        }
+
+        let expected = verification.sha256.as_ref().map(|s| s.trim().to_lowercase());
+        if expected.is_none() && !verification.trust {
+            return Err(SingleloadError::SecurityViolation(format!(
+                "Refusing to run {} without --trust or --sha256=<checksum>",
+                url
+            ))
+            .into());
+        }
+
+        let path = self.local_path(url);
+
+        if let Some(expected) = &expected {
+            if let Ok(data) = std::fs::read(&path) {
+                if sha256_hex(&data) == *expected {
+                    debug!("Using cached copy of {}", url);
+                    return Ok(path);
+                }
+            }
+        }
+
+        let data = match self.downloads.fetch(url, MAX_SCRIPT_SIZE).await {
+            Ok(data) => data,
+            Err(e) if expected.is_none() && path.exists() => {
+                warn!("Failed to download {} ({}), using cached copy", url, e);
+                return Ok(path);
+            }
+            Err(e) => return Err(e.into()),
+        };
+
+        let actual = sha256_hex(&data);
+        if let Some(expected) = &expected {
+            if actual != *expected {
+                return Err(SingleloadError::SecurityViolation(format!(
+                    "Checksum mismatch for {}: expected {}, got {}",
+                    url, expected, actual
+                ))
+                .into());
+            }
+        }
+
+        if let Some(parent) = path.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        std::fs::write(&path, &data)?;
+        info!("Fetched {} (sha256 {})", url, actual);
+
+        Ok(path)
+    }
+
+    /// Fetches the detached signature published next to `url` (`<url>.sig`)
+    /// and stores it beside the local copy of the script, falling back to
+    /// the stored one when the server cannot be reached
+    pub async fn fetch_signature(&self, url: &str) -> Result<PathBuf> {
+        let path = signature_path(&self.local_path(url));
+        let sig_url = match url.split_once(['?', '#']) {
+            Some((base, _)) => format!("{}.sig", base),
+            None => format!("{}.sig", url),
+        };
+
+        match self.downloads.fetch(&sig_url, MAX_SCRIPT_SIZE).await {
+            Ok(data) => {
+                if let Some(parent) = path.parent() {
+                    std::fs::create_dir_all(parent)?;
+                }
+                std::fs::write(&path, data)?;
+            }
+            Err(e) if path.exists() => warn!("Failed to download {} ({}), using cached copy", sig_url, e),
+            Err(e) => return Err(e.into()),
+        }
+        Ok(path)
+    }
+
+    /// `<root>/<sha256 of url>/<file name from url>`, keeping the extension
+    /// so the language can still be detected
+    fn local_path(&self, url: &str) -> PathBuf {
+        let name = url
+            .split(['?', '#'])
+            .next()
+            .and_then(|u| u.rsplit('/').next())
+            .filter(|n| {
+                !n.is_empty()
+                    && !n.starts_with('.')
+                    && n.chars().all(|c| c.is_ascii_alphanumeric() || "._-".contains(c))
+            })
+            .unwrap_or("script");
+
+        self.root.join(sha256_hex(url.as_bytes())).join(name)
+    }
+}
+
+fn sha256_hex(data: &[u8]) -> String {
+    hex::encode(Sha256::digest(data))
+}
@@ -0,0 +1,537 @@
+use crate::cache::BuildCache;
+use crate::config::RemoteCacheConfig;
+use crate::errors::SingleloadError;
+use crate::signing;
+use chrono::Utc;
+use ed25519_dalek::{SigningKey, VerifyingKey};
+use flate2::read::GzDecoder;
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use futures::future::BoxFuture;
+use sha2::{Digest, Sha256};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tracing::{debug, warn};
+
+/// Remote transfers move whole artifacts, so they get more time than script downloads
+const TRANSFER_TIMEOUT: Duration = Duration::from_secs(300);
+
+/// Bearer token sent to HTTP cache servers
+pub const TOKEN_VAR: &str = "SINGLELOAD_REMOTE_CACHE_TOKEN";
+
+/// First line of the statement a builder signs for each artifact
+const SIGNED_HEADER: &str = "singleload remote cache artifact v1";
+
+/// A shared store of build artifacts consulted after the local cache.
+///
+/// Entries are the gzipped tarball of a complete artifact directory, stored
+/// as `<key>.tar.gz` under the build cache key, and its signature, stored as
+/// `<key>.sig`. Implementations exist for HTTP servers, S3-compatible object
+/// stores and shared directories; others can be added by implementing this
+/// trait and passing them to `Executor::with_remote_cache`.
+pub trait Backend: Send + Sync {
+    /// URL or path shown in logs
+    fn location(&self) -> &str;
+
+    /// Fetches the object called `name`; None when there is none
+    fn get<'a>(&'a self, name: &'a str) -> BoxFuture<'a, Result<Option<Vec<u8>>, SingleloadError>>;
+
+    /// Stores `data` as `name`, replacing any previous object
+    fn put<'a>(&'a self, name: &'a str, data: Vec<u8>) -> BoxFuture<'a, Result<(), SingleloadError>>;
+}
+
+/// Creates the backend for a configured URL: `https://...` (HTTP PUT/GET),
+/// `s3://bucket/prefix`, or a directory path (`file://` optional). Plain
+/// HTTP is refused: anyone on the path could swap the binaries.
+pub fn from_config(config: &RemoteCacheConfig) -> Result<Arc<dyn Backend>, SingleloadError> {
+    let url = config.url.trim_end_matches('/');
+    let plain = url.starts_with("http://") || config.endpoint.as_deref().is_some_and(|e| e.starts_with("http://"));
+    if plain {
+        return Err(SingleloadError::SecurityViolation(format!(
+            "Remote cache {} must be reached over https",
+            config.endpoint.as_deref().unwrap_or(url)
+        )));
+    }
+    if url.starts_with("https://") {
+        return Ok(Arc::new(HttpBackend::new(url, std::env::var(TOKEN_VAR).ok())?));
+    }
+    if let Some(rest) = url.strip_prefix("s3://") {
+        let (bucket, prefix) = rest.split_once('/').unwrap_or((rest, ""));
+        return Ok(Arc::new(S3Backend::from_env(bucket, prefix, config)?));
+    }
+    let path = url.strip_prefix("file://").unwrap_or(url);
+    Ok(Arc::new(DirBackend::new(PathBuf::from(path))))
+}
+
+/// A backend together with how the executor may use it. Remote failures are
+/// logged and treated as misses; they never fail a build.
+///
+/// Fetched archives are only unpacked when they carry a signature of the
+/// builders' key over the cache key and the archive's sha256, so write
+/// access to the store alone is not enough to plant a binary.
+#[derive(Clone)]
+pub struct RemoteCache {
+    backend: Arc<dyn Backend>,
+    read_only: bool,
+    public_key: Option<VerifyingKey>,
+    signing_key: Option<SigningKey>,
+}
+
+impl RemoteCache {
+    /// A cache that neither trusts nor signs anything until given keys:
+    /// every fetch is a miss and nothing is uploaded
+    pub fn new(backend: Arc<dyn Backend>, read_only: bool) -> Self {
+        Self {
+            backend,
+            read_only,
+            public_key: None,
+            signing_key: None,
+        }
+    }
+
+    /// Key fetched artifacts must be signed with
+    pub fn with_public_key(mut self, key: VerifyingKey) -> Self {
+        self.public_key = Some(key);
+        self
+    }
+
+    /// Key uploaded artifacts are signed with
+    pub fn with_signing_key(mut self, key: SigningKey) -> Self {
+        self.signing_key = Some(key);
+        self
+    }
+
+    pub fn from_config(config: &RemoteCacheConfig) -> Result<Self, SingleloadError> {
+        let mut remote = Self::new(from_config(config)?, config.read_only);
+        match &config.public_key {
+            Some(pem) => {
+                let key = signing::parse_verifying_key(pem)
+                    .map_err(|e| SingleloadError::InvalidInput(format!("remote_cache.public_key: {}", e)))?;
+                remote = remote.with_public_key(key);
+            }
+            None => warn!("Remote cache {} has no public_key; nothing is fetched from it", config.url),
+        }
+        if let Some(path) = config.signing_key.as_ref().filter(|_| !config.read_only) {
+            remote = remote.with_signing_key(signing::load_signing_key(path)?);
+        }
+        Ok(remote)
+    }
+
+    /// Fills the local entry for `key` from the remote cache. Returns true
+    /// when the entry is complete afterwards.
+    pub async fn fetch(&self, cache: &BuildCache, key: &str, language: &str, source: &str) -> bool {
+        let location = self.backend.location();
+        let Some(public_key) = &self.public_key else {
+            debug!("Not fetching {} from {}: no key to verify it with", key, location);
+            return false;
+        };
+        let fetched = async {
+            let Some(archive) = self.backend.get(&object_name(key)).await? else {
+                return Ok(false);
+            };
+            let unsigned = || {
+                SingleloadError::SecurityViolation(format!(
+                    "{} is not signed with remote_cache.public_key",
+                    object_name(key)
+                ))
+            };
+            let signature = self.backend.get(&signature_name(key)).await?.ok_or_else(unsigned)?;
+            signing::verify(&signed_statement(key, &archive), &String::from_utf8_lossy(&signature), public_key)
+                .map_err(|_| unsigned())?;
+            let staging = cache.stage(key, language, source)?;
+            unpack(&archive, &staging.artifact_dir())?;
+            staging.publish()
+        }
+        .await;
+
+        match fetched {
+            Ok(true) => {
+                debug!("Remote cache hit for {} from {}", key, location);
+                return true;
+            }
+            Ok(false) => debug!("Remote cache miss for {} at {}", key, location),
+            Err(e) => warn!("Remote cache {} unavailable: {}", location, e),
+        }
+        false
+    }
+
+    /// Uploads the local entry for `key`, which the build just completed,
+    /// together with its signature
+    pub async fn publish(&self, cache: &BuildCache, key: &str) {
+        let Some(signing_key) = self.signing_key.as_ref().filter(|_| !self.read_only) else {
+            return;
+        };
+        if !cache.is_complete(key) {
+            return;
+        }
+        let location = self.backend.location();
+        let uploaded = async {
+            let archive = pack(&cache.artifact_dir(key))?;
+            let signature = signing::sign(&signed_statement(key, &archive), signing_key);
+            // The archive first: a signature without it is only a miss
+            self.backend.put(&object_name(key), archive).await?;
+            self.backend.put(&signature_name(key), signature.into_bytes()).await
+        }
+        .await;
+        match uploaded {
+            Ok(()) => debug!("Uploaded {} to remote cache {}", key, location),
+            Err(e) => warn!("Could not upload {} to remote cache {}: {}", key, location, e),
+        }
+    }
+}
+
+/// Packs a complete artifact directory for upload
+pub fn pack(dir: &Path) -> Result<Vec<u8>, SingleloadError> {
+    let mut archive = tar::Builder::new(GzEncoder::new(Vec::new(), Compression::default()));
+    archive.follow_symlinks(false);
+    archive.append_dir_all(".", dir)?;
+    Ok(archive.into_inner()?.finish()?)
+}
+
+/// Unpacks a downloaded archive into an artifact directory. Entries that
+/// would land outside `dir` are skipped.
+pub fn unpack(archive: &[u8], dir: &Path) -> Result<(), SingleloadError> {
+    tar::Archive::new(GzDecoder::new(archive)).unpack(dir)?;
+    Ok(())
+}
+
+fn object_name(key: &str) -> String {
+    format!("{}.tar.gz", key)
+}
+
+fn signature_name(key: &str) -> String {
+    format!("{}.sig", key)
+}
+
+/// What a builder signs for an artifact: the cache key it answers and the
+/// archive's digest, so a signed archive cannot be served for another key
+fn signed_statement(key: &str, archive: &[u8]) -> Vec<u8> {
+    format!("{}\n{}\n{}\n", SIGNED_HEADER, key, hex::encode(Sha256::digest(archive))).into_bytes()
+}
+
+fn transfer_error(location: &str, e: impl std::fmt::Display) -> SingleloadError {
+    SingleloadError::Container(format!("Remote cache {}: {}", location, e))
+}
+
+fn http_client(location: &str) -> Result<reqwest::Client, SingleloadError> {
+    reqwest::Client::builder()
+        .timeout(TRANSFER_TIMEOUT)
+        .build()
+        .map_err(|e| transfer_error(location, e))
+}
+
+/// Reads a response body, mapping 404 to a miss
+async fn read_response(location: &str, response: reqwest::Response) -> Result<Option<Vec<u8>>, SingleloadError> {
+    if response.status() == reqwest::StatusCode::NOT_FOUND {
+        return Ok(None);
+    }
+    let response = response.error_for_status().map_err(|e| transfer_error(location, e))?;
+    let body = response.bytes().await.map_err(|e| transfer_error(location, e))?;
+    Ok(Some(body.to_vec()))
+}
+
+/// Plain HTTP server storing `<url>/<key>.tar.gz` (nginx with WebDAV,
+/// bazel-remote, a presigned bucket, ...)
+pub struct HttpBackend {
+    base: String,
+    token: Option<String>,
+    client: reqwest::Client,
+}
+
+impl HttpBackend {
+    pub fn new(base: &str, token: Option<String>) -> Result<Self, SingleloadError> {
+        Ok(Self {
+            base: base.to_string(),
+            token,
+            client: http_client(base)?,
+        })
+    }
+
+    fn request(&self, method: reqwest::Method, name: &str) -> reqwest::RequestBuilder {
+        let request = self.client.request(method, format!("{}/{}", self.base, name));
+        match &self.token {
+            Some(token) => request.bearer_auth(token),
+            None => request,
+        }
+    }
+}
+
+impl Backend for HttpBackend {
+    fn location(&self) -> &str {
+        &self.base
+    }
+
+    fn get<'a>(&'a self, name: &'a str) -> BoxFuture<'a, Result<Option<Vec<u8>>, SingleloadError>> {
+        Box::pin(async move {
+            let response = self
+                .request(reqwest::Method::GET, name)
+                .send()
+                .await
+                .map_err(|e| transfer_error(&self.base, e))?;
+            read_response(&self.base, response).await
+        })
+    }
+
+    fn put<'a>(&'a self, name: &'a str, data: Vec<u8>) -> BoxFuture<'a, Result<(), SingleloadError>> {
+        Box::pin(async move {
+            self.request(reqwest::Method::PUT, name)
+                .body(data)
+                .send()
+                .await
+                .and_then(|r| r.error_for_status())
+                .map_err(|e| transfer_error(&self.base, e))?;
+            Ok(())
+        })
+    }
+}
+
+/// S3 or an S3-compatible store (MinIO, R2, ...), addressed path-style and
+/// signed with AWS Signature Version 4. Credentials come from
+/// `AWS_ACCESS_KEY_ID`, `AWS_SECRET_ACCESS_KEY` and `AWS_SESSION_TOKEN`.
+pub struct S3Backend {
+    location: String,
+    endpoint: reqwest::Url,
+    bucket: String,
+    prefix: String,
+    region: String,
+    access_key: String,
+    secret_key: String,
+    session_token: Option<String>,
+    client: reqwest::Client,
+}
+
+impl S3Backend {
+    fn from_env(bucket: &str, prefix: &str, config: &RemoteCacheConfig) -> Result<Self, SingleloadError> {
+        let location = config.url.clone();
+        let credential = |name: &str| {
+            std::env::var(name).map_err(|_| {
+                SingleloadError::InvalidInput(format!("Remote cache {} needs {} to be set", location, name))
+            })
+        };
+        let region = config
+            .region
+            .clone()
+            .or_else(|| std::env::var("AWS_REGION").ok())
+            .unwrap_or_else(|| "us-east-1".to_string());
+        let endpoint = config
+            .endpoint
+            .clone()
+            .unwrap_or_else(|| format!("https://s3.{}.amazonaws.com", region));
+        let endpoint = reqwest::Url::parse(&endpoint)
+            .map_err(|e| SingleloadError::InvalidInput(format!("Invalid remote cache endpoint {}: {}", endpoint, e)))?;
+
+        Ok(Self {
+            access_key: credential("AWS_ACCESS_KEY_ID")?,
+            secret_key: credential("AWS_SECRET_ACCESS_KEY")?,
+            session_token: std::env::var("AWS_SESSION_TOKEN").ok(),
+            client: http_client(&location)?,
+            location,
+            endpoint,
+            bucket: bucket.to_string(),
+            prefix: prefix.trim_matches('/').to_string(),
+            region,
+        })
+    }
+
+    /// Path-style object path, each segment URI-encoded
+    fn object_path(&self, name: &str) -> String {
+        std::iter::once(self.bucket.as_str())
+            .chain(self.prefix.split('/').filter(|s| !s.is_empty()))
+            .chain(std::iter::once(name))
+            .map(uri_encode)
+            .fold(String::new(), |path, segment| format!("{}/{}", path, segment))
+    }
+
+    fn request(&self, method: reqwest::Method, name: &str, body: &[u8]) -> reqwest::RequestBuilder {
+        let path = self.object_path(name);
+        let mut url = self.endpoint.clone();
+        url.set_path(&path);
+
+        let host = match (url.host_str(), url.port()) {
+            (Some(host), Some(port)) => format!("{}:{}", host, port),
+            (Some(host), None) => host.to_string(),
+            (None, _) => String::new(),
+        };
+        let now = Utc::now();
+        let headers = sigv4_headers(&SigningRequest {
+            method: method.as_str(),
+            path: &path,
+            host: &host,
+            payload: body,
+            region: &self.region,
+            access_key: &self.access_key,
+            secret_key: &self.secret_key,
+            session_token: self.session_token.as_deref(),
+            amz_date: &now.format("%Y%m%dT%H%M%SZ").to_string(),
+        });
+
+        let mut request = self.client.request(method, url);
+        for (name, value) in headers {
+            request = request.header(name, value);
+        }
+        request
+    }
+}
+
+impl Backend for S3Backend {
+    fn location(&self) -> &str {
+        &self.location
+    }
+
+    fn get<'a>(&'a self, name: &'a str) -> BoxFuture<'a, Result<Option<Vec<u8>>, SingleloadError>> {
+        Box::pin(async move {
+            let response = self
+                .request(reqwest::Method::GET, name, b"")
+                .send()
+                .await
+                .map_err(|e| transfer_error(&self.location, e))?;
+            read_response(&self.location, response).await
+        })
+    }
+
+    fn put<'a>(&'a self, name: &'a str, data: Vec<u8>) -> BoxFuture<'a, Result<(), SingleloadError>> {
+        Box::pin(async move {
+            self.request(reqwest::Method::PUT, name, &data)
+                .body(data)
+                .send()
+                .await
+                .and_then(|r| r.error_for_status())
+                .map_err(|e| transfer_error(&self.location, e))?;
+            Ok(())
+        })
+    }
+}
+
+/// Directory shared between machines, e.g. an NFS mount
+pub struct DirBackend {
+    dir: PathBuf,
+    location: String,
+}
+
+impl DirBackend {
+    pub fn new(dir: PathBuf) -> Self {
+        Self {
+            location: dir.display().to_string(),
+            dir,
+        }
+    }
+}
+
+impl Backend for DirBackend {
+    fn location(&self) -> &str {
+        &self.location
+    }
+
+    fn get<'a>(&'a self, name: &'a str) -> BoxFuture<'a, Result<Option<Vec<u8>>, SingleloadError>> {
+        Box::pin(async move {
+            match tokio::fs::read(self.dir.join(name)).await {
+                Ok(data) => Ok(Some(data)),
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(None),
+                Err(e) => Err(e.into()),
+            }
+        })
+    }
+
+    fn put<'a>(&'a self, name: &'a str, data: Vec<u8>) -> BoxFuture<'a, Result<(), SingleloadError>> {
+        Box::pin(async move {
+            // Readers on other machines must never see a partial archive
+            tokio::fs::create_dir_all(&self.dir).await?;
+            let staged = self.dir.join(format!(".{}.{}", name, uuid::Uuid::new_v4()));
+            tokio::fs::write(&staged, data).await?;
+            tokio::fs::rename(&staged, self.dir.join(name)).await?;
+            Ok(())
+        })
+    }
+}
+
+/// Inputs of an AWS Signature Version 4 request signature
+pub struct SigningRequest<'a> {
+    pub method: &'a str,
+    /// URI-encoded absolute path
+    pub path: &'a str,
+    pub host: &'a str,
+    pub payload: &'a [u8],
+    pub region: &'a str,
+    pub access_key: &'a str,
+    pub secret_key: &'a str,
+    pub session_token: Option<&'a str>,
+    /// Request time as `YYYYMMDDTHHMMSSZ`
+    pub amz_date: &'a str,
+}
+
+/// Headers that sign an S3 request without a query string
+pub fn sigv4_headers(req: &SigningRequest) -> Vec<(String, String)> {
+    let payload_hash = hex::encode(Sha256::digest(req.payload));
+    let date = &req.amz_date[..8];
+
+    let mut headers = vec![
+        ("host".to_string(), req.host.to_string()),
+        ("x-amz-content-sha256".to_string(), payload_hash.clone()),
+        ("x-amz-date".to_string(), req.amz_date.to_string()),
+    ];
+    if let Some(token) = req.session_token {
+        headers.push(("x-amz-security-token".to_string(), token.to_string()));
+    }
+
+    let signed_headers = headers.iter().map(|(name, _)| name.as_str()).collect::<Vec<_>>().join(";");
+    let canonical_headers: String = headers.iter().map(|(name, value)| format!("{}:{}\n", name, value)).collect();
+    let canonical_request = format!(
+        "{}\n{}\n\n{}\n{}\n{}",
+        req.method, req.path, canonical_headers, signed_headers, payload_hash
+    );
+
+    let scope = format!("{}/{}/s3/aws4_request", date, req.region);
+    let string_to_sign = format!(
+        "AWS4-HMAC-SHA256\n{}\n{}\n{}",
+        req.amz_date,
+        scope,
+        hex::encode(Sha256::digest(canonical_request.as_bytes()))
+    );
+
+    let mut key = hmac_sha256(format!("AWS4{}", req.secret_key).as_bytes(), date.as_bytes());
+    for part in [req.region, "s3", "aws4_request"] {
+        key = hmac_sha256(&key, part.as_bytes());
+    }
+    let signature = hex::encode(hmac_sha256(&key, string_to_sign.as_bytes()));
+
+    // reqwest derives Host from the URL
+    headers.remove(0);
+    headers.push((
+        "authorization".to_string(),
+        format!(
+            "AWS4-HMAC-SHA256 Credential={}/{}, SignedHeaders={}, Signature={}",
+            req.access_key, scope, signed_headers, signature
+        ),
+    ));
+    headers
+}
+
+fn hmac_sha256(key: &[u8], message: &[u8]) -> Vec<u8> {
+    const BLOCK_SIZE: usize = 64;
+    let mut block = [0u8; BLOCK_SIZE];
+    if key.len() > BLOCK_SIZE {
+        block[..32].copy_from_slice(&Sha256::digest(key));
+    } else {
+        block[..key.len()].copy_from_slice(key);
+    }
+
+    let mut inner = Sha256::new();
+    inner.update(block.map(|b| b ^ 0x36));
+    inner.update(message);
+    let mut outer = Sha256::new();
+    outer.update(block.map(|b| b ^ 0x5c));
+    outer.update(inner.finalize());
+    outer.finalize().to_vec()
+}
+
+/// Percent-encodes everything but the characters S3 leaves alone in a path segment
+fn uri_encode(segment: &str) -> String {
+    segment
+        .bytes()
+        .map(|b| match b {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'_' | b'.' | b'~' => (b as char).to_string(),
+            _ => format!("%{:02X}", b),
+        })
+        .collect()
+}
@@ -0,0 +1,63 @@
+use crate::errors::SingleloadError;
+use sha2::{Digest, Sha256};
+use std::fs::File;
+use std::path::Path;
+use std::time::{Duration, UNIX_EPOCH};
+
+/// `SOURCE_DATE_EPOCH` of reproducible builds: 1980-01-01, the earliest
+/// date zip archives can hold
+pub const SOURCE_DATE_EPOCH: u64 = 315_532_800;
+
+/// Compiler flags that keep container paths and random seeds out of
+/// `language`'s artifacts. They come before the script's and the user's
+/// own flags, which can still override them.
+pub fn flags(language: &str) -> Vec<String> {
+    let flags: &[&str] = match language {
+        "go" => &["-trimpath", "-buildvcs=false"],
+        "rust" => &["--remap-path-prefix=/workspace=.", "--remap-path-prefix=/deps=deps"],
+        "c" | "cpp" | "opencl" => &["-ffile-prefix-map=/workspace=.", "-frandom-seed=singleload"],
+        "dotnet" => &[
+            "-p:Deterministic=true",
+            "-p:ContinuousIntegrationBuild=true",
+            // MSBuild splits -p values at commas, so only the project is mapped
+            "-p:PathMap=/tmp/app=/src",
+        ],
+        _ => &[],
+    };
+    flags.iter().map(|f| f.to_string()).collect()
+}
+
+/// Environment of reproducible builds, so timestamps, `__DATE__` and
+/// locale-dependent output are the same everywhere
+pub fn env() -> Vec<(String, String)> {
+    vec![
+        ("SOURCE_DATE_EPOCH".to_string(), SOURCE_DATE_EPOCH.to_string()),
+        ("TZ".to_string(), "UTC".to_string()),
+        ("LC_ALL".to_string(), "C".to_string()),
+    ]
+}
+
+/// Sets the modification time of a written artifact to [`SOURCE_DATE_EPOCH`]
+pub fn stamp(path: &Path) -> Result<(), SingleloadError> {
+    let file = File::options().write(true).open(path)?;
+    file.set_modified(UNIX_EPOCH + Duration::from_secs(SOURCE_DATE_EPOCH))?;
+    Ok(())
+}
+
+/// Fails unless two builds of the same artifact are byte-identical,
+/// naming the first offset where they differ
+pub fn compare(first: &Path, second: &Path) -> Result<(), SingleloadError> {
+    let (a, b) = (std::fs::read(first)?, std::fs::read(second)?);
+    if a == b {
+        return Ok(());
+    }
+    let offset = a.iter().zip(&b).position(|(x, y)| x != y).unwrap_or(a.len().min(b.len()));
+    Err(SingleloadError::NotReproducible(format!(
+        "two builds differ from byte {} on ({} bytes, sha256 {} vs {} bytes, sha256 {})",
+        offset,
+        a.len(),
+        hex::encode(Sha256::digest(&a)),
+        b.len(),
+        hex::encode(Sha256::digest(&b))
+    )))
+}
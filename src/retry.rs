@@ -0,0 +1,107 @@
+use crate::errors::SingleloadError;
+use crate::types::ExecutionResult;
+use std::time::Duration;
+
+/// Longest wait between two attempts, however many came before
+pub const MAX_BACKOFF: Duration = Duration::from_secs(300);
+
+/// A failure `run --retry-on` retries
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum RetryCondition {
+    /// The script exited with a code for which `code <op> value` holds,
+    /// e.g. `exit!=0` or `exit==75`
+    Exit { op: &'static str, code: u32 },
+    /// The run was stopped at its timeout
+    Timeout,
+    /// The script could not be run to the end, e.g. its container failed
+    Error,
+}
+
+impl RetryCondition {
+    pub fn parse(value: &str) -> Result<Self, String> {
+        let value = value.trim();
+        match value {
+            "timeout" => return Ok(Self::Timeout),
+            "error" => return Ok(Self::Error),
+            _ => {}
+        }
+        let invalid = || format!("invalid retry condition '{}', expected e.g. exit!=0, exit==75, timeout or error", value);
+        let rest = value.strip_prefix("exit").ok_or_else(invalid)?.trim_start();
+        // Two-character operators first, so `>=` is not read as `>`
+        let (op, code) = ["==", "!=", ">=", "<=", "=", ">", "<"]
+            .iter()
+            .find_map(|op| rest.strip_prefix(op).map(|code| (*op, code)))
+            .ok_or_else(invalid)?;
+        let code = code.trim().parse().map_err(|_| invalid())?;
+        Ok(Self::Exit {
+            op: if op == "=" { "==" } else { op },
+            code,
+        })
+    }
+
+    fn matches(&self, result: &ExecutionResult) -> bool {
+        let timed_out = result.error.as_deref() == Some(SingleloadError::Timeout.to_string().as_str());
+        match self {
+            Self::Exit { op, code } if result.error.is_none() => match *op {
+                "==" => result.exit_code == *code,
+                "!=" => result.exit_code != *code,
+                ">=" => result.exit_code >= *code,
+                "<=" => result.exit_code <= *code,
+                ">" => result.exit_code > *code,
+                _ => result.exit_code < *code,
+            },
+            Self::Exit { .. } => false,
+            Self::Timeout => timed_out,
+            Self::Error => result.error.is_some() && !timed_out,
+        }
+    }
+}
+
+impl std::fmt::Display for RetryCondition {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Exit { op, code } => write!(f, "exit{}{}", op, code),
+            Self::Timeout => f.write_str("timeout"),
+            Self::Error => f.write_str("error"),
+        }
+    }
+}
+
+/// How `run --retries` runs a failing script again
+#[derive(Debug, Clone, PartialEq)]
+pub struct RetryPolicy {
+    /// Attempts after the first one
+    pub retries: u32,
+    /// Wait before the first retry; each later one waits twice as long as
+    /// the one before, up to [`MAX_BACKOFF`] or the backoff itself if longer
+    pub backoff: Duration,
+    /// Failures that are retried, any of them; `exit!=0` when none are given
+    pub on: Vec<RetryCondition>,
+}
+
+impl RetryPolicy {
+    pub fn new(retries: u32, backoff: Duration, on: Vec<RetryCondition>) -> Self {
+        let on = if on.is_empty() {
+            vec![RetryCondition::Exit { op: "!=", code: 0 }]
+        } else {
+            on
+        };
+        Self { retries, backoff, on }
+    }
+
+    /// The condition `result` of attempt `attempt` (from 1) meets, if it is
+    /// to be retried. Scripts stopped with Ctrl-C or SIGTERM never are.
+    pub fn retry(&self, attempt: u32, result: &ExecutionResult) -> Option<&RetryCondition> {
+        let interrupted = result.error.is_none() && matches!(result.exit_code, 130 | 143);
+        if attempt > self.retries || interrupted {
+            return None;
+        }
+        self.on.iter().find(|condition| condition.matches(result))
+    }
+
+    /// Wait before the attempt after `attempt`
+    pub fn delay(&self, attempt: u32) -> Duration {
+        let factor = 2u32.saturating_pow(attempt.saturating_sub(1));
+        self.backoff.saturating_mul(factor).min(MAX_BACKOFF.max(self.backoff))
+    }
+}
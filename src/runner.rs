@@ -0,0 +1,1516 @@
+use crate::config::LanguageConfig;
+use crate::directives::{Dependency, Directives, PackageManager};
+use crate::gpu::{self, GpuApi};
+use crate::lockfile::LockedPackage;
+use crate::source::shebang_interpreter;
+use crate::toolchain::{ReleaseAsset, ReleaseHost, CONTAINER_ARCHIVE};
+use crate::types::Language;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::{BTreeSet, HashMap};
+use std::path::Path;
+use std::sync::Arc;
+
+/// A language backend that knows how to build and run a single script
+/// inside the runner container.
+///
+/// Built-in languages are provided by [`BuiltinRunner`]; additional languages
+/// (Zig, Crystal, ...) can be added by implementing this trait and calling
+/// [`Registry::register`] before handing the registry to the executor.
+pub trait Runner: Send + Sync {
+    /// Language name as accepted by `--lang`
+    fn name(&self) -> &str;
+
+    /// Extension (including the dot) used for the script inside the container
+    fn file_extension(&self) -> &str;
+
+    /// Name the script is staged under in `/workspace`: `script` with the
+    /// runner's extension, unless the language ties file names to their content
+    fn script_name(&self, _content: &[u8]) -> String {
+        format!("script{}", self.file_extension())
+    }
+
+    /// Returns true if this runner can handle the given script
+    fn detect(&self, path: &Path, _content: &[u8]) -> bool {
+        path.extension()
+            .and_then(|e| e.to_str())
+            .map(|e| format!(".{}", e) == self.file_extension())
+            .unwrap_or(false)
+    }
+
+    /// Interpreters that select this runner from a `#!` line, e.g. `python3`
+    fn interpreters(&self) -> &[&str] {
+        &[]
+    }
+
+    /// Returns true if the content looks like this language. Used when
+    /// neither the extension, a `lang` modeline nor the shebang decide.
+    fn sniff(&self, _content: &[u8]) -> bool {
+        false
+    }
+
+    /// Shell command that compiles the script into `ctx.out_dir`, if the
+    /// language has a build step
+    fn build(&self, ctx: &BuildContext) -> Option<String>;
+
+    /// Command that executes the script (or the artifact `build` left in `ctx.out_dir`)
+    fn run(&self, ctx: &BuildContext) -> Vec<String>;
+
+    /// Shell command that reports errors in the script without running it.
+    /// Compiled languages just build into `ctx.out_dir`.
+    fn check(&self, ctx: &BuildContext) -> Option<String> {
+        self.build(ctx)
+    }
+
+    /// Path of the standalone binary `build` produces, relative to `ctx.out_dir`
+    fn artifact(&self, _ctx: &BuildContext) -> Option<String> {
+        None
+    }
+
+    /// Minimal base image `singleload package --oci` puts the artifact on
+    fn image_base(&self) -> Option<&str> {
+        None
+    }
+
+    /// Package managers whose inline dependency declarations this runner understands
+    fn package_managers(&self) -> &[PackageManager] {
+        &[]
+    }
+
+    /// Shell command that installs `ctx.dependencies` into `ctx.deps_dir`.
+    /// It runs in a separate container with network access.
+    fn fetch(&self, _ctx: &BuildContext) -> Option<String> {
+        None
+    }
+
+    /// What in `content`, the script and its sources, decides what `fetch`
+    /// installs besides the dependencies themselves. It is part of the key
+    /// the installed dependencies are cached under.
+    fn fetch_inputs(&self, _content: &[u8]) -> Vec<String> {
+        Vec::new()
+    }
+
+    /// Other container paths `build` or `test` copy sources to, as
+    /// (staged path, copy) pairs, so their diagnostics can be mapped back
+    fn relocations(&self, _ctx: &BuildContext) -> Vec<(String, String)> {
+        Vec::new()
+    }
+
+    /// Shell command that runs the tests defined in the script, writing a
+    /// coverage report to `coverage` (a path in the container) when given
+    fn test(&self, _ctx: &BuildContext, _coverage: Option<&str>) -> Option<String> {
+        None
+    }
+
+    /// Command that starts an interactive session, after loading `preload`
+    /// (a script in the container) when given
+    fn repl(&self, _preload: Option<&str>) -> Option<Vec<String>> {
+        None
+    }
+
+    /// Command that runs a compiled language's script with an interpreter
+    /// instead of `build`, for `run --interp`, or why it needs the compiler
+    fn interpret(&self, _ctx: &BuildContext, _content: &[u8]) -> Result<Vec<String>, String> {
+        Err(format!("{} scripts cannot be interpreted", self.name()))
+    }
+
+    /// Static analysis tools `singleload vet` runs on the script, in order
+    fn linters(&self, _ctx: &BuildContext) -> Vec<Linter> {
+        Vec::new()
+    }
+
+    /// Name the toolchain is pinned by, in `// singleload: <name> <version>`
+    /// and project pin files: the runner's own, unless it runs on another
+    /// language's runtime
+    fn toolchain(&self) -> &str {
+        self.name()
+    }
+
+    /// Shell command that installs `version` of the toolchain into `dir`,
+    /// leaving its binaries in `{dir}/bin`. It runs with network access.
+    fn install_toolchain(&self, _version: &str, _dir: &str) -> Option<String> {
+        None
+    }
+
+    /// Release the host downloads before `install_toolchain` runs, which
+    /// finds the archive at [`CONTAINER_ARCHIVE`]; toolchains fetched by
+    /// their own tools have none
+    fn toolchain_release(&self) -> Option<ReleaseAsset> {
+        None
+    }
+
+    /// Packages that `fetch` installed into `deps_dir` (a host path), with
+    /// exact versions and checksums for the lockfile
+    fn installed_packages(&self, _deps_dir: &Path) -> Vec<LockedPackage> {
+        Vec::new()
+    }
+
+    /// Key identifying the build output for the given script content
+    fn cache_key(&self, content: &[u8]) -> String {
+        let mut hasher = Sha256::new();
+        hasher.update(self.name().as_bytes());
+        hasher.update([0u8]);
+        hasher.update(content);
+        hex::encode(hasher.finalize())
+    }
+
+    /// Extra environment variables the toolchain needs
+    fn env(&self, _ctx: &BuildContext) -> Vec<(String, String)> {
+        Vec::new()
+    }
+
+    /// Returns true if `build` can produce an artifact for `target`
+    fn supports_target(&self, _target: &BuildTarget) -> bool {
+        true
+    }
+
+    /// GPU interface the script's programs use; their run containers get
+    /// the configured `gpu_devices`
+    fn gpu(&self) -> Option<GpuApi> {
+        None
+    }
+}
+
+/// A static analysis tool run by `singleload vet`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Linter {
+    /// Name in the report, e.g. `staticcheck`
+    pub name: &'static str,
+    /// Executable the linter is skipped without
+    pub program: &'static str,
+    /// Shell command reporting problems as `file:line:column: message`
+    /// lines, or in rustc's format
+    pub command: String,
+}
+
+/// Paths and inputs a runner builds and runs a script with
+#[derive(Debug, Clone)]
+pub struct BuildContext<'a> {
+    /// Script location inside the container
+    pub script_path: &'a str,
+    /// Other source files of a directory project, next to `script_path`
+    pub sources: &'a [String],
+    /// Files declared with `embed`, relative to the script's directory
+    pub assets: &'a [String],
+    /// Directory build artifacts are written to
+    pub out_dir: &'a str,
+    /// Directory resolved dependencies are installed into
+    pub deps_dir: &'a str,
+    /// Inline dependencies declared by the script
+    pub dependencies: &'a [Dependency],
+    /// Platform to build for; None builds for the container's platform
+    pub target: Option<&'a BuildTarget>,
+    /// Compiler flags of the selected build profile
+    pub build_flags: &'a [String],
+    /// System libraries declared with `pkg-config` for C and C++ builds
+    pub libraries: &'a [String],
+    /// GPU architectures declared with `cuda-arch` for CUDA builds
+    pub gpu_archs: &'a [String],
+    /// Where C and C++ builds keep the object of each source between
+    /// builds, in the order of `all_sources`; empty to compile without them
+    pub objects: &'a [String],
+}
+
+/// Cross-compilation target of `singleload build`
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct BuildTarget {
+    /// GOOS for Go builds
+    pub goos: Option<String>,
+    /// GOARCH for Go builds
+    pub goarch: Option<String>,
+    /// Target triple (Rust) or runtime identifier (.NET) for other compilers
+    pub triple: Option<String>,
+}
+
+/// Name accepted by `--target` for WebAssembly modules using WASI preview 1
+pub const WASI_TARGET: &str = "wasi";
+
+impl BuildTarget {
+    /// Builds the target from the CLI flags; None when no flag is set
+    pub fn from_flags(goos: Option<String>, goarch: Option<String>, triple: Option<String>) -> Option<Self> {
+        if triple.as_deref() == Some(WASI_TARGET) {
+            return Some(Self::wasi());
+        }
+        if goos.is_none() && goarch.is_none() && triple.is_none() {
+            return None;
+        }
+        Some(Self { goos, goarch, triple })
+    }
+
+    pub fn wasi() -> Self {
+        Self {
+            goos: Some("wasip1".to_string()),
+            goarch: Some("wasm".to_string()),
+            triple: Some("wasm32-wasip1".to_string()),
+        }
+    }
+
+    pub fn is_wasm(&self) -> bool {
+        self.goarch.as_deref() == Some("wasm")
+            || self.triple.as_deref().map_or(false, |t| t.starts_with("wasm32"))
+    }
+
+    /// Returns true if the target sets GOOS or GOARCH beyond what WASI
+    /// implies, which only Go builds can honour
+    pub fn go_platform(&self) -> bool {
+        (self.goos.is_some() || self.goarch.is_some()) && *self != Self::wasi()
+    }
+
+    pub fn is_windows(&self) -> bool {
+        self.goos.as_deref() == Some("windows")
+            || self.triple.as_deref().map_or(false, |t| t.contains("windows") || t.starts_with("win-"))
+    }
+}
+
+impl std::fmt::Display for BuildTarget {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let parts: Vec<&str> = [&self.goos, &self.goarch, &self.triple]
+            .iter()
+            .filter_map(|p| p.as_deref())
+            .collect();
+        write!(f, "{}", parts.join("/"))
+    }
+}
+
+impl BuildContext<'_> {
+    /// The script followed by the other project sources, shell-quoted
+    fn all_sources(&self) -> String {
+        std::iter::once(self.script_path)
+            .chain(self.sources.iter().map(|s| s.as_str()))
+            .map(shell_quote)
+            .collect::<Vec<_>>()
+            .join(" ")
+    }
+
+    /// Shell step copying the embedded assets into `dest`, keeping their
+    /// relative paths so `go:embed` patterns still match
+    fn copy_assets(&self, dest: &str) -> String {
+        if self.assets.is_empty() {
+            return String::new();
+        }
+        let dir = Path::new(self.script_path).parent().and_then(|p| p.to_str()).unwrap_or("/workspace");
+        let assets = self.assets.iter().map(|a| shell_quote(a)).collect::<Vec<_>>().join(" ");
+        format!(" && (cd {} && cp --parents {} {})", shell_quote(dir), assets, shell_quote(dest))
+    }
+
+    /// Build profile flags, shell-quoted with a leading space
+    fn flags(&self) -> String {
+        self.build_flags.iter().map(|f| format!(" {}", shell_quote(f))).collect()
+    }
+
+    /// Shell step appending the pkg-config flags of the declared libraries
+    /// to `$flags`, so a missing library fails before the compiler runs
+    fn pkg_config(&self) -> String {
+        if self.libraries.is_empty() {
+            return String::new();
+        }
+        let libraries = self.libraries.iter().map(|l| shell_quote(l)).collect::<Vec<_>>().join(" ");
+        format!(" && flags=$(pkg-config --cflags --libs {})", libraries)
+    }
+
+    fn dependency_specs(&self) -> String {
+        self.dependencies
+            .iter()
+            .map(|d| shell_quote(&d.spec()))
+            .collect::<Vec<_>>()
+            .join(" ")
+    }
+}
+
+/// Content that marks a script as C++ rather than C
+const CPP_PATTERN: &str =
+    r"(?m)^#include <(iostream|string|vector|map|memory|algorithm|fstream|sstream|cstdio|cstdlib)>|\bstd::|^using namespace ";
+
+/// Content that marks a C++ script as an OpenCL host program
+const OPENCL_PATTERN: &str = r#"(?m)^#include [<"]CL/(cl|opencl|cl2)\.hp?p?[>"]"#;
+
+/// Content that marks a script as CUDA
+const CUDA_PATTERN: &str = r"\b__global__\b|<<<.*>>>";
+
+/// Type annotations and declarations that mark a script as TypeScript
+/// rather than JavaScript
+const TYPESCRIPT_PATTERN: &str = r"(?m)^\s*(export\s+)?(interface\s+\w+|type\s+\w+(<[^>]*>)?\s*=|enum\s+\w+\s*\{)|^import\s+type\s|\)\s*:\s*(string|number|boolean|void|Promise<.*>)\s*(\{|=>)|\b(const|let)\s+\w+\s*:\s*\w+(\[\])?\s*=";
+
+/// Banner of TypeScript bundles: they are ES modules, which have no
+/// `require` for the CommonJS packages bundled into them
+const ESM_REQUIRE_BANNER: &str =
+    "import { createRequire } from 'node:module'; const require = createRequire(import.meta.url);";
+
+/// First class, interface, enum or record a Java file declares, and the
+/// first public one, which javac wants the file named after
+const JAVA_CLASS_PATTERN: &str =
+    r"(?m)^\s*(public\s+)?(?:(?:final|abstract|sealed|strictfp)\s+)*(?:class|interface|enum|record)\s+([A-Za-z_$][\w$]*)";
+
+/// Import declarations of a Go file, single or grouped
+const GO_IMPORT_PATTERN: &str = r#"(?m)^\s*import\s*(\([^)]*\)|([\w.]+\s+)?"[^"]*")"#;
+
+/// File in `out_dir` holding the class path and main class of a JVM
+/// program, which `run` passes to `java` as an argument file
+const JVM_ARGS_FILE: &str = "java.args";
+
+/// ES module in `out_dir` that esbuild bundles a TypeScript script into
+const TYPESCRIPT_BUNDLE: &str = "script.mjs";
+
+/// Resolution report `fetch` has coursier write into `deps_dir`
+const COURSIER_REPORT: &str = "coursier.json";
+
+/// Longest Go script `run --interp` hands to yaegi; longer ones are worth
+/// compiling once and caching
+const INTERP_MAX_LINES: usize = 300;
+
+/// Go features yaegi does not interpret, with how they are spotted
+const INTERP_UNSUPPORTED: &[(&str, &str)] = &[
+    ("cgo", r#"(?m)^\s*import\s+"C"|^\s*"C"\s*$"#),
+    ("go:embed", r"(?m)^//go:embed\b"),
+    ("go:linkname", r"(?m)^//go:linkname\b"),
+    ("plugins", r#""plugin""#),
+];
+
+/// Runner for the languages shipped in the base image
+pub struct BuiltinRunner {
+    language: Language,
+    interpreter: Option<String>,
+    compiler: Option<String>,
+}
+
+impl BuiltinRunner {
+    pub fn new(language: Language) -> Self {
+        Self {
+            language,
+            interpreter: None,
+            compiler: None,
+        }
+    }
+
+    /// Uses the configured interpreter and compiler instead of the defaults
+    pub fn with_config(mut self, config: &LanguageConfig) -> Self {
+        self.interpreter = config.interpreter.clone();
+        self.compiler = config.compiler.clone();
+        self
+    }
+
+    /// The binary scripts run in, `python3` and the like unless configured
+    fn interpreter(&self) -> &str {
+        self.interpreter.as_deref().unwrap_or(self.language.command())
+    }
+
+    /// The binary building programs, `default` unless configured, shell quoted
+    fn compiler(&self, default: &str) -> String {
+        shell_quote(self.compiler.as_deref().unwrap_or(default))
+    }
+
+    /// Shell setting `$cp` to the class path `fetch` resolved, empty without
+    /// dependencies, and `$main` to `class` in the package the script
+    /// declares, or the class a Kotlin `@file:JvmName` names
+    fn jvm_setup(&self, ctx: &BuildContext, class: &str) -> String {
+        let jvm_name = match self.language {
+            Language::Kotlin => r#" && if [[ $src =~ @file:JvmName\(\"([^\"]+)\"\) ]]; then main=${BASH_REMATCH[1]}; fi"#,
+            _ => "",
+        };
+        format!(
+            "cd /tmp && cp='' && if [ -f {d}/classpath ]; then cp=$(< {d}/classpath); fi && src=$(< {script}) && main={class}{jvm_name} && if [[ $src =~ (^|$'\\n')package[[:space:]]+([A-Za-z0-9_.]+) ]]; then main=\"${{BASH_REMATCH[2]}}.$main\"; fi",
+            d = shell_quote(ctx.deps_dir),
+            script = shell_quote(ctx.script_path),
+            class = shell_quote(class),
+            jvm_name = jvm_name
+        )
+    }
+
+    /// C or C++ build compiling each source into its object in
+    /// `ctx.objects`, unless an earlier build left it complete there, and
+    /// linking the objects. The `.ok` file next to an object marks it
+    /// complete, so one a killed build left half-written is made again.
+    fn object_build(&self, ctx: &BuildContext, compilers: &str) -> String {
+        let libraries = ctx.libraries.iter().map(|l| shell_quote(l)).collect::<Vec<_>>().join(" ");
+        let pkg_config = match libraries.is_empty() {
+            true => String::new(),
+            false => format!(
+                " && cflags=$(pkg-config --cflags {l}) && libs=$(pkg-config --libs {l})",
+                l = libraries
+            ),
+        };
+        let units = std::iter::once(ctx.script_path).chain(ctx.sources.iter().map(|s| s.as_str()));
+        let compiles: String = units
+            .zip(ctx.objects)
+            .map(|(source, object)| {
+                let object = shell_quote(object);
+                format!(
+                    " && {{ [ -e {o}.ok ] || {{ \"$compiler\"{f} -c -o {o} {s} $cflags && : > {o}.ok; }}; }}",
+                    o = object,
+                    f = ctx.flags(),
+                    s = shell_quote(source)
+                )
+            })
+            .collect();
+        let objects = ctx.objects.iter().map(|o| shell_quote(o)).collect::<Vec<_>>().join(" ");
+        format!(
+            "cd /tmp && cflags='' && libs=''{} && compiler=$(command -v {}){} && \"$compiler\"{} -o {}/app {} $libs",
+            pkg_config,
+            compilers,
+            compiles,
+            ctx.flags(),
+            shell_quote(ctx.out_dir),
+            objects
+        )
+    }
+
+    /// esbuild bundling a TypeScript script and the modules it imports,
+    /// from its sources and the `node_modules` on NODE_PATH, into the ES
+    /// module `outfile`. Native addons stay outside the bundle.
+    fn esbuild(&self, ctx: &BuildContext, outfile: &str) -> String {
+        format!(
+            "{} {} --bundle --platform=node --format=esm --sourcemap=inline --log-level=warning --external:*.node --banner:js={}{} --outfile={}",
+            self.compiler("esbuild"),
+            shell_quote(ctx.script_path),
+            shell_quote(ESM_REQUIRE_BANNER),
+            ctx.flags(),
+            shell_quote(outfile)
+        )
+    }
+}
+
+impl Runner for BuiltinRunner {
+    fn name(&self) -> &str {
+        self.language.name()
+    }
+
+    fn toolchain(&self) -> &str {
+        match self.language {
+            Language::TypeScript => "node",
+            _ => self.name(),
+        }
+    }
+
+    fn file_extension(&self) -> &str {
+        self.language.file_extension()
+    }
+
+    fn script_name(&self, content: &[u8]) -> String {
+        match java_class(content).filter(|_| self.language == Language::Java) {
+            Some(class) => format!("{}.java", class),
+            None => format!("script{}", self.file_extension()),
+        }
+    }
+
+    fn detect(&self, path: &Path, content: &[u8]) -> bool {
+        let extension = path.extension().and_then(|e| e.to_str()).map(|e| format!(".{}", e));
+        match (self.language, extension.as_deref()) {
+            // OpenCL host programs are C++ files that include the OpenCL headers
+            (Language::Cpp | Language::OpenCl, Some(".cpp" | ".cc" | ".cxx")) => {
+                (self.language == Language::OpenCl) == matches_pattern(OPENCL_PATTERN, content)
+            }
+            (_, Some(extension)) => extension == self.file_extension(),
+            (_, None) => false,
+        }
+    }
+
+    fn interpreters(&self) -> &[&str] {
+        match self.language {
+            Language::Python => &["python", "python3"],
+            Language::Javascript => &["node", "nodejs"],
+            Language::Php => &["php"],
+            Language::Bash => &["bash", "sh"],
+            // `#!/usr/bin/java --source 21` single-file programs
+            Language::Java => &["java"],
+            Language::Kotlin => &["kotlin"],
+            Language::TypeScript => &["tsx", "ts-node"],
+            _ => &[],
+        }
+    }
+
+    fn sniff(&self, content: &[u8]) -> bool {
+        let pattern = match self.language {
+            Language::Go => r"(?m)^package \w+\s*$",
+            Language::Rust => r"(?m)^\s*(pub )?fn main\s*\(\s*\)|^use (std|crate)::",
+            Language::Php => r"^\s*<\?php",
+            Language::DotNet => r"(?m)^using System(\.\w+)*;|Console\.Write(Line)?\(",
+            Language::Python => {
+                r#"(?m)^(def \w+\(.*\).*:\s*$|from [\w.]+ import |import [\w.]+(\s+as \w+)?\s*$|if __name__ == ['"]__main__['"]:)"#
+            }
+            Language::Javascript => {
+                r#"(?m)\brequire\(['"][\w@/.-]+['"]\)|^(import .+ from ['"].+['"];?|export (default|function|const) )|console\.log\("#
+            }
+            Language::Bash => r"(?m)^(set -[euxo]+|\s*(fi|done|esac)\s*$)",
+            Language::C => r"(?m)^#include <\w+(/\w+)*\.h>",
+            Language::Cpp => CPP_PATTERN,
+            Language::Cuda => CUDA_PATTERN,
+            Language::OpenCl => OPENCL_PATTERN,
+            Language::Java => r"(?m)^\s*public\s+static\s+void\s+main\s*\(|^import java\.",
+            Language::Kotlin => r"(?m)^fun main\s*\(|^import kotlin\.",
+            Language::TypeScript => TYPESCRIPT_PATTERN,
+        };
+        let matches = |pattern: &str| matches_pattern(pattern, content);
+        match self.language {
+            // C++ sources often include C headers too, and CUDA and OpenCL
+            // programs look like C++
+            Language::C => matches(pattern) && !matches(CPP_PATTERN) && !matches(CUDA_PATTERN),
+            Language::Cpp => matches(pattern) && !matches(CUDA_PATTERN) && !matches(OPENCL_PATTERN),
+            Language::Javascript => matches(pattern) && !matches(TYPESCRIPT_PATTERN),
+            _ => matches(pattern),
+        }
+    }
+
+    fn build(&self, ctx: &BuildContext) -> Option<String> {
+        let script = shell_quote(ctx.script_path);
+        let out_dir = shell_quote(ctx.out_dir);
+        match self.language {
+            Language::Rust => {
+                let target = match ctx.target.and_then(|t| t.triple.as_deref()) {
+                    Some(triple) => format!(" --target {}", shell_quote(triple)),
+                    None => String::new(),
+                };
+                Some(format!(
+                    "cd /tmp && {}{} {}{} -o {}/rust_binary",
+                    self.compiler("rustc"),
+                    ctx.flags(),
+                    script,
+                    target,
+                    out_dir
+                ))
+            }
+            Language::Go if !ctx.dependencies.is_empty() => {
+                // Build inside a writable copy of the module synthesized by `fetch`
+                Some(format!(
+                    "cp -r {}/module /tmp/module && rm -f /tmp/module/*.go && cp {} /tmp/module/{} && cd /tmp/module && {} build{} -o {}/app .",
+                    shell_quote(ctx.deps_dir),
+                    ctx.all_sources(),
+                    ctx.copy_assets("/tmp/module"),
+                    self.compiler("go"),
+                    ctx.flags(),
+                    out_dir
+                ))
+            }
+            Language::Go => Some(format!(
+                "{} build{} -o {}/app {}",
+                self.compiler("go"),
+                ctx.flags(),
+                out_dir,
+                ctx.all_sources()
+            )),
+            Language::C | Language::Cpp => {
+                // Prefer clang when the image has it, like the cc/c++ defaults of most distros
+                let compilers = match (self.language, &self.compiler) {
+                    (_, Some(compiler)) => shell_quote(compiler),
+                    (Language::C, None) => "clang || command -v cc".to_string(),
+                    _ => "clang++ || command -v c++".to_string(),
+                };
+                if !ctx.objects.is_empty() {
+                    return Some(self.object_build(ctx, &compilers));
+                }
+                Some(format!(
+                    "cd /tmp && flags=''{} && compiler=$(command -v {}) && \"$compiler\"{} -o {}/app {} $flags",
+                    ctx.pkg_config(),
+                    compilers,
+                    ctx.flags(),
+                    out_dir,
+                    ctx.all_sources()
+                ))
+            }
+            Language::Cuda => {
+                // nvcc from the mounted toolkit, or clang's CUDA support
+                // with the toolkit's headers and runtime
+                let nvcc_archs: String = gpu::nvcc_arch_flags(ctx.gpu_archs)
+                    .iter()
+                    .map(|f| format!(" {}", shell_quote(f)))
+                    .collect();
+                let clang_archs: String = gpu::clang_arch_flags(ctx.gpu_archs)
+                    .iter()
+                    .map(|f| format!(" {}", shell_quote(f)))
+                    .collect();
+                let nvcc = match &self.compiler {
+                    Some(compiler) => shell_quote(compiler),
+                    None => "nvcc || command -v \"$cuda/bin/nvcc\"".to_string(),
+                };
+                Some(format!(
+                    "cd /tmp && cuda=${{CUDA_HOME:-{cuda}}} && if nvcc=$(command -v {nvcc}); then \"$nvcc\" -ccbin \"$(command -v c++)\"{nvcc_archs}{flags} -o {out}/app {sources}; elif command -v clang++ >/dev/null; then clang++ -x cuda --cuda-path=\"$cuda\"{clang_archs}{flags} -o {out}/app {sources} -L\"$cuda/lib64\" -lcudart_static -ldl -lrt -pthread; else echo 'No CUDA compiler: set cuda_dir to a CUDA toolkit, or install clang++' >&2; exit 127; fi",
+                    cuda = gpu::CONTAINER_CUDA_DIR,
+                    nvcc = nvcc,
+                    nvcc_archs = nvcc_archs,
+                    clang_archs = clang_archs,
+                    flags = ctx.flags(),
+                    out = out_dir,
+                    sources = ctx.all_sources()
+                ))
+            }
+            Language::OpenCl => Some(format!(
+                "cd /tmp && flags=''{} && compiler=$(command -v {}) && \"$compiler\" -DCL_TARGET_OPENCL_VERSION=300 -DCL_HPP_TARGET_OPENCL_VERSION=300{} -o {}/app {} $flags -lOpenCL",
+                ctx.pkg_config(),
+                self.compiler.as_deref().map_or("clang++ || command -v c++".to_string(), shell_quote),
+                ctx.flags(),
+                out_dir,
+                ctx.all_sources()
+            )),
+            Language::DotNet => {
+                // .NET needs a project structure around the script. Builds for
+                // a runtime identifier are published as one self-contained
+                // file that runs without the SDK
+                let (verb, runtime) = match ctx.target.and_then(|t| t.triple.as_deref()) {
+                    Some(rid) => (
+                        "publish",
+                        format!(" -r {} --self-contained true -p:PublishSingleFile=true", shell_quote(rid)),
+                    ),
+                    None => ("build", String::new()),
+                };
+                let sources = ctx
+                    .sources
+                    .iter()
+                    .map(|s| format!(" && cp {} /tmp/app/", shell_quote(s)))
+                    .collect::<String>();
+                Some(format!(
+                    "cd /tmp && {dotnet} new console -o app && cp {} /tmp/app/Program.cs{} && {dotnet} {} /tmp/app{}{} -o {}",
+                    script,
+                    sources,
+                    verb,
+                    runtime,
+                    ctx.flags(),
+                    out_dir,
+                    dotnet = self.compiler("dotnet")
+                ))
+            }
+            Language::Java => {
+                // The script is staged under its class's name, see script_name
+                let class = Path::new(ctx.script_path).file_stem()?.to_string_lossy().to_string();
+                Some(format!(
+                    "{} && {}{} ${{cp:+-cp \"$cp\"}} -d {}/classes {} && {}",
+                    self.jvm_setup(ctx, &class),
+                    self.compiler("javac"),
+                    ctx.flags(),
+                    out_dir,
+                    ctx.all_sources(),
+                    jvm_args(ctx, "classes")
+                ))
+            }
+            Language::Kotlin => {
+                // Top-level functions of my-tool.kt live in the class My_toolKt
+                let stem = Path::new(ctx.script_path).file_stem()?.to_string_lossy().to_string();
+                let class: String = stem
+                    .chars()
+                    .enumerate()
+                    .map(|(i, c)| match c {
+                        c if i == 0 => c.to_ascii_uppercase(),
+                        c if c.is_ascii_alphanumeric() => c,
+                        _ => '_',
+                    })
+                    .chain("Kt".chars())
+                    .collect();
+                // The jar carries the Kotlin standard library
+                Some(format!(
+                    "{} && {}{} ${{cp:+-cp \"$cp\"}} -include-runtime -d {}/app.jar {} && {}",
+                    self.jvm_setup(ctx, &class),
+                    self.compiler("kotlinc"),
+                    ctx.flags(),
+                    out_dir,
+                    ctx.all_sources(),
+                    jvm_args(ctx, "app.jar")
+                ))
+            }
+            Language::TypeScript => Some(self.esbuild(ctx, &format!("{}/{}", ctx.out_dir, TYPESCRIPT_BUNDLE))),
+            _ => None,
+        }
+    }
+
+    fn check(&self, ctx: &BuildContext) -> Option<String> {
+        let script = shell_quote(ctx.script_path);
+        let interpreter = shell_quote(self.interpreter());
+        match self.language {
+            // compile() catches what the parser alone does not, like a
+            // `return` outside a function, without writing bytecode
+            Language::Python => Some(format!(
+                "{} -c 'import sys; compile(open(sys.argv[1]).read(), sys.argv[1], \"exec\", dont_inherit=True)' {}",
+                interpreter, script
+            )),
+            Language::Javascript => Some(format!("{} --check {}", interpreter, script)),
+            Language::Php => Some(format!("{} -l {}", interpreter, script)),
+            Language::Bash => Some(format!("{} -n {}", interpreter, script)),
+            // Transpiling alone finds syntax errors; esbuild checks no types
+            Language::TypeScript => Some(format!(
+                "{} {} --log-level=warning > /dev/null",
+                self.compiler("esbuild"),
+                script
+            )),
+            _ => self.build(ctx),
+        }
+    }
+
+    fn run(&self, ctx: &BuildContext) -> Vec<String> {
+        if ctx.target.map_or(false, |t| t.is_wasm()) {
+            if let Some(artifact) = self.artifact(ctx) {
+                // WebAssembly modules run in the wasmtime shipped with the base image
+                return vec![
+                    "wasmtime".to_string(),
+                    "run".to_string(),
+                    format!("{}/{}", ctx.out_dir, artifact),
+                ];
+            }
+        }
+
+        match self.language {
+            Language::Rust => vec![format!("{}/rust_binary", ctx.out_dir)],
+            Language::Go | Language::C | Language::Cpp | Language::Cuda | Language::OpenCl => {
+                vec![format!("{}/app", ctx.out_dir)]
+            }
+            Language::DotNet => vec![
+                self.interpreter().to_string(),
+                format!("{}/app.dll", ctx.out_dir),
+            ],
+            // The class path and main class `build` worked out
+            Language::Java | Language::Kotlin => vec![
+                self.interpreter().to_string(),
+                format!("@{}/{}", ctx.out_dir, JVM_ARGS_FILE),
+            ],
+            // Stack traces point into the script through the bundle's source map
+            Language::TypeScript => vec![
+                self.interpreter().to_string(),
+                "--enable-source-maps".to_string(),
+                format!("{}/{}", ctx.out_dir, TYPESCRIPT_BUNDLE),
+            ],
+            _ => vec![
+                self.interpreter().to_string(),
+                ctx.script_path.to_string(),
+            ],
+        }
+    }
+
+    fn artifact(&self, ctx: &BuildContext) -> Option<String> {
+        match self.language {
+            Language::Rust => Some("rust_binary".to_string()),
+            Language::Go | Language::C | Language::Cpp | Language::Cuda | Language::OpenCl => Some("app".to_string()),
+            // Without a runtime identifier the build is an app.dll for the SDK
+            Language::DotNet => ctx.target.filter(|t| t.triple.is_some()).map(|t| match t.is_windows() {
+                true => "app.exe".to_string(),
+                false => "app".to_string(),
+            }),
+            _ => None,
+        }
+    }
+
+    fn image_base(&self) -> Option<&str> {
+        match self.language {
+            // Packaged Go builds disable cgo, so nothing beyond the binary is needed
+            Language::Go => Some("gcr.io/distroless/static-debian12:nonroot"),
+            // Shared libraries from pkg-config are not copied, so only builds
+            // linking nothing beyond libc and libstdc++ run on it
+            Language::Rust | Language::C | Language::Cpp => Some("gcr.io/distroless/cc-debian12:nonroot"),
+            _ => None,
+        }
+    }
+
+    fn supports_target(&self, target: &BuildTarget) -> bool {
+        match self.language {
+            // The base image has no cross toolchains or sysroots for C and C++
+            Language::C | Language::Cpp | Language::Cuda | Language::OpenCl => false,
+            Language::Go => true,
+            // Only Go builds read GOOS and GOARCH
+            _ if target.go_platform() => false,
+            _ => !target.is_wasm() || self.language == Language::Rust,
+        }
+    }
+
+    fn gpu(&self) -> Option<GpuApi> {
+        match self.language {
+            Language::Cuda => Some(GpuApi::Cuda),
+            Language::OpenCl => Some(GpuApi::OpenCl),
+            _ => None,
+        }
+    }
+
+    fn package_managers(&self) -> &[PackageManager] {
+        match self.language {
+            Language::Go => &[PackageManager::Go],
+            Language::Python => &[PackageManager::Pip],
+            Language::Javascript | Language::TypeScript => &[PackageManager::Npm],
+            Language::Java | Language::Kotlin => &[PackageManager::Maven],
+            _ => &[],
+        }
+    }
+
+    fn fetch(&self, ctx: &BuildContext) -> Option<String> {
+        if ctx.dependencies.is_empty() {
+            return None;
+        }
+        let deps_dir = shell_quote(ctx.deps_dir);
+        match self.language {
+            Language::Go => {
+                let requires = ctx
+                    .dependencies
+                    .iter()
+                    .map(|d| format!("-require={}", shell_quote(&d.spec())))
+                    .collect::<Vec<_>>()
+                    .join(" ");
+                Some(format!(
+                    "mkdir -p {d}/module && cd {d}/module && {go} mod init singleload/script && {go} mod edit {r} && cp {s} . && {go} mod tidy",
+                    go = self.compiler("go"),
+                    d = deps_dir,
+                    r = requires,
+                    s = ctx.all_sources()
+                ))
+            }
+            Language::Python => Some(format!(
+                "{} -m pip install --no-cache-dir --target {}/site-packages {}",
+                shell_quote(self.interpreter()),
+                deps_dir,
+                ctx.dependency_specs()
+            )),
+            Language::Javascript | Language::TypeScript => Some(format!(
+                "npm install --no-audit --no-fund --prefix {} {}",
+                deps_dir,
+                ctx.dependency_specs()
+            )),
+            // coursier resolves the coordinates and their transitive
+            // dependencies; the jars stay in deps_dir with the class path
+            Language::Java | Language::Kotlin => Some(format!(
+                "mkdir -p {d} && COURSIER_CACHE={d}/cache cs fetch --quiet --classpath --json-output-file {d}/{json} {specs} > {d}/classpath",
+                d = deps_dir,
+                json = COURSIER_REPORT,
+                specs = ctx.dependency_specs()
+            )),
+            _ => None,
+        }
+    }
+
+    fn fetch_inputs(&self, content: &[u8]) -> Vec<String> {
+        match self.language {
+            // go mod tidy keeps only the modules the sources import
+            Language::Go => go_imports(content),
+            _ => Vec::new(),
+        }
+    }
+
+    fn relocations(&self, ctx: &BuildContext) -> Vec<(String, String)> {
+        let copy_to = |dir: &str, path: &str| {
+            let name = Path::new(path).file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+            format!("{}/{}", dir, name)
+        };
+        match self.language {
+            Language::Go => {
+                let mut copies = vec![(ctx.script_path.to_string(), copy_to("/tmp/module", ctx.script_path))];
+                if let Some(stem) = ctx.script_path.strip_suffix(".go").filter(|s| !s.ends_with("_test")) {
+                    copies.push((ctx.script_path.to_string(), copy_to("/tmp/module", &format!("{}_test.go", stem))));
+                }
+                copies.extend(ctx.sources.iter().map(|s| (s.clone(), copy_to("/tmp/module", s))));
+                copies
+            }
+            Language::DotNet => {
+                let mut copies = vec![(ctx.script_path.to_string(), "/tmp/app/Program.cs".to_string())];
+                copies.extend(ctx.sources.iter().map(|s| (s.clone(), copy_to("/tmp/app", s))));
+                copies
+            }
+            _ => Vec::new(),
+        }
+    }
+
+    fn test(&self, ctx: &BuildContext, coverage: Option<&str>) -> Option<String> {
+        let script = shell_quote(ctx.script_path);
+        match self.language {
+            Language::Go => {
+                // go test only picks up tests from _test.go files inside a module
+                let name = Path::new(ctx.script_path).file_name()?.to_string_lossy().to_string();
+                let test_name = match name.strip_suffix(".go") {
+                    Some(stem) if !stem.ends_with("_test") => format!("{}_test.go", stem),
+                    _ => name,
+                };
+                let module = if ctx.dependencies.is_empty() {
+                    "mkdir -p /tmp/module && cd /tmp/module && go mod init singleload/test".to_string()
+                } else {
+                    format!(
+                        "cp -r {}/module /tmp/module && rm -f /tmp/module/*.go",
+                        shell_quote(ctx.deps_dir)
+                    )
+                };
+                let sources = ctx
+                    .sources
+                    .iter()
+                    .map(|s| format!(" && cp {} /tmp/module/", shell_quote(s)))
+                    .collect::<String>();
+                let cover = match coverage {
+                    Some(path) => format!(" -coverprofile={}", shell_quote(path)),
+                    None => String::new(),
+                };
+                Some(format!(
+                    "{}{}{} && cp {} /tmp/module/{} && cd /tmp/module && {} test -v{} .",
+                    module,
+                    sources,
+                    ctx.copy_assets("/tmp/module"),
+                    script,
+                    shell_quote(&test_name),
+                    self.compiler("go"),
+                    cover
+                ))
+            }
+            Language::Python => {
+                // pytest when the script declares it, the standard library otherwise
+                let module = Path::new(ctx.script_path).file_stem()?.to_string_lossy().to_string();
+                Some(format!(
+                    "cd /workspace && if {python} -c 'import pytest' 2>/dev/null; then {python} -m pytest -v -p no:cacheprovider {}; else {python} -m unittest -v {}; fi",
+                    script,
+                    shell_quote(&module),
+                    python = shell_quote(self.interpreter())
+                ))
+            }
+            Language::Javascript => {
+                let cover = match coverage {
+                    Some(path) => format!(
+                        " --experimental-test-coverage --test-reporter=spec --test-reporter-destination=stdout --test-reporter=lcov --test-reporter-destination={}",
+                        shell_quote(path)
+                    ),
+                    None => String::new(),
+                };
+                Some(format!("{} --test{} {}", shell_quote(self.interpreter()), cover, script))
+            }
+            Language::TypeScript => {
+                let cover = match coverage {
+                    Some(path) => format!(
+                        " --experimental-test-coverage --test-reporter=spec --test-reporter-destination=stdout --test-reporter=lcov --test-reporter-destination={}",
+                        shell_quote(path)
+                    ),
+                    None => String::new(),
+                };
+                Some(format!(
+                    "{} && {} --enable-source-maps --test{} /tmp/test.mjs",
+                    self.esbuild(ctx, "/tmp/test.mjs"),
+                    shell_quote(self.interpreter()),
+                    cover
+                ))
+            }
+            Language::Rust => Some(format!(
+                "cd /tmp && {} --test {} -o /tmp/test_binary && /tmp/test_binary",
+                self.compiler("rustc"),
+                script
+            )),
+            _ => None,
+        }
+    }
+
+    fn linters(&self, ctx: &BuildContext) -> Vec<Linter> {
+        let script = shell_quote(ctx.script_path);
+        let linter = |name, program, command| Linter { name, program, command };
+        match self.language {
+            Language::Go => {
+                // Both analyze the package the script and its sources form
+                // in a module, using the pinned toolchain's type checker
+                let module = if ctx.dependencies.is_empty() {
+                    "mkdir -p /tmp/module && cd /tmp/module && go mod init singleload/vet >/dev/null 2>&1".to_string()
+                } else {
+                    format!(
+                        "cp -r {}/module /tmp/module && rm -f /tmp/module/*.go",
+                        shell_quote(ctx.deps_dir)
+                    )
+                };
+                let setup = format!(
+                    "rm -rf /tmp/module && {} && cp {} /tmp/module/{} && cd /tmp/module",
+                    module,
+                    ctx.all_sources(),
+                    ctx.copy_assets("/tmp/module")
+                );
+                vec![
+                    linter("go vet", "go", format!("{} && go vet .", setup)),
+                    linter("staticcheck", "staticcheck", format!("{} && staticcheck .", setup)),
+                ]
+            }
+            Language::Python => vec![linter(
+                "ruff",
+                "ruff",
+                format!("ruff check --no-cache --output-format=concise {}", script),
+            )],
+            Language::Rust => vec![linter(
+                "clippy",
+                "clippy-driver",
+                format!(
+                    "cd /tmp && clippy-driver{} -W clippy::all --emit=metadata -o /tmp/clippy.rmeta {}",
+                    ctx.flags(),
+                    script
+                ),
+            )],
+            Language::Bash => vec![linter("shellcheck", "shellcheck", format!("shellcheck --format=gcc {}", script))],
+            Language::C | Language::Cpp | Language::OpenCl => {
+                let (name, program) = match self.language {
+                    Language::C => ("cc -Wall", "cc"),
+                    _ => ("c++ -Wall", "c++"),
+                };
+                vec![linter(
+                    name,
+                    program,
+                    format!(
+                        "cd /tmp && flags=''{} && {} -fsyntax-only -Wall -Wextra{} {} $flags",
+                        ctx.pkg_config(),
+                        program,
+                        ctx.flags(),
+                        ctx.all_sources()
+                    ),
+                )]
+            }
+            _ => Vec::new(),
+        }
+    }
+
+    fn interpret(&self, ctx: &BuildContext, content: &[u8]) -> Result<Vec<String>, String> {
+        if self.language != Language::Go {
+            return Err(format!("{} scripts cannot be interpreted", self.name()));
+        }
+        if !ctx.dependencies.is_empty() {
+            return Err("it has module dependencies".to_string());
+        }
+        if !ctx.sources.is_empty() || !ctx.assets.is_empty() {
+            return Err("it has more than one file".to_string());
+        }
+        if ctx.target.is_some() {
+            return Err("it is built for a target".to_string());
+        }
+        let text = String::from_utf8_lossy(content);
+        if text.lines().count() > INTERP_MAX_LINES {
+            return Err(format!("it is longer than {} lines", INTERP_MAX_LINES));
+        }
+        if let Some((feature, _)) = INTERP_UNSUPPORTED.iter().find(|(_, pattern)| matches_pattern(pattern, content)) {
+            return Err(format!("it uses {}", feature));
+        }
+        // The container is the sandbox, so yaegi gets the whole standard library
+        Ok(["yaegi", "run", "-syscall", "-unsafe", "-unrestricted", ctx.script_path]
+            .into_iter()
+            .map(String::from)
+            .collect())
+    }
+
+    fn repl(&self, preload: Option<&str>) -> Option<Vec<String>> {
+        let interpreter = self.interpreter();
+        let mut command: Vec<String> = match self.language {
+            Language::Python => vec![interpreter, "-i", "-q"],
+            Language::Javascript => vec![interpreter, "-i"],
+            Language::Php => vec![interpreter, "-a"],
+            Language::Bash => vec![interpreter, "--norc", "-i"],
+            // Go has no native REPL; the base image ships the yaegi interpreter
+            Language::Go => vec!["yaegi"],
+            Language::Java => vec!["jshell", "-q"],
+            _ => return None,
+        }
+        .into_iter()
+        .map(String::from)
+        .collect();
+
+        match (self.language, preload) {
+            (_, None) => {}
+            (Language::Python | Language::Java, Some(script)) => command.push(script.to_string()),
+            // yaegi -i runs the file, then starts the REPL
+            (Language::Go, Some(script)) => command.extend(["-i".to_string(), script.to_string()]),
+            (Language::Javascript, Some(script)) => {
+                command.extend(["--require".to_string(), script.to_string()])
+            }
+            (Language::Php, Some(script)) => command.insert(1, format!("-dauto_prepend_file={}", script)),
+            (Language::Bash, Some(script)) => {
+                command = vec![interpreter.to_string(), "--rcfile".to_string(), script.to_string(), "-i".to_string()]
+            }
+            _ => {}
+        }
+
+        Some(command)
+    }
+
+    fn install_toolchain(&self, version: &str, dir: &str) -> Option<String> {
+        match self.language {
+            // The go command downloads and verifies release toolchains itself
+            Language::Go => Some(format!(
+                "export GOMODCACHE={d}/mod GOPATH=/tmp/gopath GOCACHE=/tmp/gocache GOTOOLCHAIN=go{v} && ln -s \"$(go env GOROOT)/bin\" {d}/bin",
+                d = shell_quote(dir),
+                v = version
+            )),
+            // The python-build-standalone or Node.js archive of `toolchain_release`
+            Language::Python | Language::TypeScript => Some(format!(
+                "python3 -c {} {} {}",
+                shell_quote(TOOLCHAIN_EXTRACT),
+                CONTAINER_ARCHIVE,
+                shell_quote(dir)
+            )),
+            Language::Rust => Some(format!(
+                "export RUSTUP_HOME={d}/rustup CARGO_HOME=/tmp/cargo && rustup toolchain install {v} --profile minimal --no-self-update && ln -s \"$(dirname \"$(rustup which --toolchain {v} rustc)\")\" {d}/bin",
+                d = shell_quote(dir),
+                v = version
+            )),
+            _ => None,
+        }
+    }
+
+    fn toolchain_release(&self) -> Option<ReleaseAsset> {
+        match self.language {
+            // The base image has no Python installer
+            Language::Python => Some(ReleaseAsset {
+                host: ReleaseHost::GitHub("astral-sh/python-build-standalone"),
+                pattern: format!(
+                    r"cpython-([0-9.]+)\+[0-9]+-{}-unknown-linux-gnu-install_only\.tar\.gz",
+                    std::env::consts::ARCH
+                ),
+                checksums: "SHA256SUMS",
+            }),
+            Language::TypeScript => Some(ReleaseAsset {
+                host: ReleaseHost::Dist("https://nodejs.org/dist"),
+                pattern: format!(r"node-v([0-9.]+)-linux-{}\.tar\.gz", node_arch()),
+                checksums: "SHASUMS256.txt",
+            }),
+            _ => None,
+        }
+    }
+
+    fn installed_packages(&self, deps_dir: &Path) -> Vec<LockedPackage> {
+        match self.language {
+            Language::Go => go_sum_packages(&deps_dir.join("module/go.sum")),
+            Language::Python => dist_info_packages(&deps_dir.join("site-packages")),
+            Language::Javascript | Language::TypeScript => npm_lock_packages(&deps_dir.join("package-lock.json")),
+            Language::Java | Language::Kotlin => coursier_packages(deps_dir),
+            _ => Vec::new(),
+        }
+    }
+
+    fn env(&self, ctx: &BuildContext) -> Vec<(String, String)> {
+        let mut env = match self.language {
+            Language::Python => vec![
+                ("PYTHONUNBUFFERED".to_string(), "1".to_string()),
+                ("PYTHONDONTWRITEBYTECODE".to_string(), "1".to_string()),
+            ],
+            Language::Go => {
+                let mut env = vec![
+                    ("GOCACHE".to_string(), "/tmp/gocache".to_string()),
+                    ("GOPATH".to_string(), "/tmp/gopath".to_string()),
+                    // Never switch toolchains behind the script's back
+                    ("GOTOOLCHAIN".to_string(), "local".to_string()),
+                ];
+                if let Some(target) = ctx.target {
+                    if let Some(goos) = &target.goos {
+                        env.push(("GOOS".to_string(), goos.clone()));
+                    }
+                    if let Some(goarch) = &target.goarch {
+                        env.push(("GOARCH".to_string(), goarch.clone()));
+                    }
+                    // Cross builds must not depend on the container's libc
+                    env.push(("CGO_ENABLED".to_string(), "0".to_string()));
+                }
+                env
+            }
+            Language::DotNet => vec![
+                ("DOTNET_CLI_HOME".to_string(), "/tmp".to_string()),
+                ("DOTNET_CLI_TELEMETRY_OPTOUT".to_string(), "1".to_string()),
+            ],
+            _ => vec![],
+        };
+
+        if !ctx.dependencies.is_empty() {
+            match self.language {
+                Language::Python => {
+                    env.push(("PYTHONPATH".to_string(), format!("{}/site-packages", ctx.deps_dir)));
+                }
+                Language::Go => {
+                    env.push(("GOMODCACHE".to_string(), format!("{}/gomodcache", ctx.deps_dir)));
+                    env.push(("GOFLAGS".to_string(), "-modcacherw".to_string()));
+                }
+                // esbuild resolves the packages it bundles on NODE_PATH too
+                Language::Javascript | Language::TypeScript => {
+                    env.push(("NODE_PATH".to_string(), format!("{}/node_modules", ctx.deps_dir)));
+                }
+                _ => {}
+            }
+        }
+
+        env
+    }
+}
+
+/// The name Node.js builds use for this machine's architecture
+fn node_arch() -> &'static str {
+    match std::env::consts::ARCH {
+        "x86_64" => "x64",
+        "aarch64" => "arm64",
+        arch => arch,
+    }
+}
+
+fn matches_pattern(pattern: &str, content: &[u8]) -> bool {
+    regex::Regex::new(pattern)
+        .map(|re| re.is_match(&String::from_utf8_lossy(content)))
+        .unwrap_or(false)
+}
+
+/// The class a Java script is named after and started from: its public
+/// class, or the first class it declares without one
+fn java_class(content: &[u8]) -> Option<String> {
+    let source = String::from_utf8_lossy(content);
+    let classes: Vec<_> = regex::Regex::new(JAVA_CLASS_PATTERN).ok()?.captures_iter(&source).collect();
+    let class = classes.iter().find(|c| c.get(1).is_some()).or(classes.first())?;
+    Some(class[2].to_string())
+}
+
+/// Sorted packages Go sources import
+pub fn go_imports(content: &[u8]) -> Vec<String> {
+    let source = String::from_utf8_lossy(content);
+    let (Ok(imports), Ok(path)) = (regex::Regex::new(GO_IMPORT_PATTERN), regex::Regex::new(r#""([^"]*)""#)) else {
+        return Vec::new();
+    };
+    let mut packages = BTreeSet::new();
+    for import in imports.find_iter(&source) {
+        packages.extend(path.captures_iter(import.as_str()).map(|p| p[1].to_string()));
+    }
+    packages.into_iter().collect()
+}
+
+/// Shell writing the `java` arguments that run `program`, the classes
+/// directory or jar in `ctx.out_dir`, with the resolved class path
+fn jvm_args(ctx: &BuildContext, program: &str) -> String {
+    format!(
+        "printf -- '-cp %s %s\\n' {}\"${{cp:+:$cp}}\" \"$main\" > {}/{}",
+        shell_quote(&format!("{}/{}", ctx.out_dir, program)),
+        shell_quote(ctx.out_dir),
+        JVM_ARGS_FILE
+    )
+}
+
+/// Resolved artifacts from coursier's report, hashed by their jar, with
+/// `group:artifact` names like the `maven` directive's
+fn coursier_packages(deps_dir: &Path) -> Vec<LockedPackage> {
+    let Some(report) = std::fs::read(deps_dir.join(COURSIER_REPORT))
+        .ok()
+        .and_then(|data| serde_json::from_slice::<serde_json::Value>(&data).ok())
+    else {
+        return Vec::new();
+    };
+    let Some(dependencies) = report.get("dependencies").and_then(|d| d.as_array()) else {
+        return Vec::new();
+    };
+    dependencies
+        .iter()
+        .filter_map(|dependency| {
+            // group:artifact:version, or group:artifact:type:classifier:version
+            let coord = dependency.get("coord")?.as_str()?;
+            let parts: Vec<&str> = coord.split(':').collect();
+            let (name, version) = (format!("{}:{}", parts.first()?, parts.get(1)?), parts.last()?);
+            // The jar's path in the fetch container; the cache is in deps_dir
+            let jar = dependency
+                .get("file")
+                .and_then(|f| f.as_str())
+                .and_then(|f| f.split_once("/cache/"))
+                .map(|(_, path)| deps_dir.join("cache").join(path));
+            let hash = jar
+                .and_then(|jar| std::fs::read(jar).ok())
+                .map(|data| format!("sha256:{}", hex::encode(Sha256::digest(&data))));
+            Some(LockedPackage {
+                name,
+                version: version.to_string(),
+                hash,
+            })
+        })
+        .collect()
+}
+
+/// Module versions and hashes from go.sum, ignoring the go.mod-only entries
+fn go_sum_packages(path: &Path) -> Vec<LockedPackage> {
+    let Ok(content) = std::fs::read_to_string(path) else {
+        return Vec::new();
+    };
+    content
+        .lines()
+        .filter_map(|line| {
+            let mut parts = line.split_whitespace();
+            let (name, version, hash) = (parts.next()?, parts.next()?, parts.next()?);
+            if version.ends_with("/go.mod") {
+                return None;
+            }
+            Some(LockedPackage {
+                name: name.to_string(),
+                version: version.to_string(),
+                hash: Some(hash.to_string()),
+            })
+        })
+        .collect()
+}
+
+/// Installed distributions from `<name>-<version>.dist-info` directories,
+/// hashed by their RECORD file which lists every installed file's digest
+fn dist_info_packages(site_packages: &Path) -> Vec<LockedPackage> {
+    let Ok(entries) = std::fs::read_dir(site_packages) else {
+        return Vec::new();
+    };
+    entries
+        .filter_map(|entry| {
+            let path = entry.ok()?.path();
+            let stem = path.file_name()?.to_str()?.strip_suffix(".dist-info")?.to_string();
+            let (name, version) = stem.rsplit_once('-')?;
+            let hash = std::fs::read(path.join("RECORD"))
+                .ok()
+                .map(|record| format!("sha256:{}", hex::encode(Sha256::digest(&record))));
+            Some(LockedPackage {
+                name: name.to_string(),
+                version: version.to_string(),
+                hash,
+            })
+        })
+        .collect()
+}
+
+/// Packages and integrity hashes from npm's package-lock.json
+fn npm_lock_packages(path: &Path) -> Vec<LockedPackage> {
+    let Some(lock) = std::fs::read(path)
+        .ok()
+        .and_then(|data| serde_json::from_slice::<serde_json::Value>(&data).ok())
+    else {
+        return Vec::new();
+    };
+    let Some(packages) = lock.get("packages").and_then(|p| p.as_object()) else {
+        return Vec::new();
+    };
+    packages
+        .iter()
+        .filter_map(|(key, info)| {
+            // Nested copies are installed by npm from the same resolution
+            let name = key.strip_prefix("node_modules/")?;
+            if name.contains("/node_modules/") {
+                return None;
+            }
+            Some(LockedPackage {
+                name: name.to_string(),
+                version: info.get("version")?.as_str()?.to_string(),
+                hash: info.get("integrity").and_then(|i| i.as_str()).map(|i| i.to_string()),
+            })
+        })
+        .collect()
+}
+
+/// Set of available language runners
+#[derive(Clone)]
+pub struct Registry {
+    runners: Vec<Arc<dyn Runner>>,
+}
+
+impl Registry {
+    /// Creates an empty registry
+    pub fn new() -> Self {
+        Self { runners: Vec::new() }
+    }
+
+    /// Creates a registry containing all built-in languages
+    pub fn with_builtins() -> Self {
+        Self::with_languages(&HashMap::new())
+    }
+
+    /// Creates a registry containing all built-in languages, using the
+    /// interpreters and compilers configured for them
+    pub fn with_languages(languages: &HashMap<String, LanguageConfig>) -> Self {
+        let mut registry = Self::new();
+        for language in Language::all() {
+            let config = languages.get(language.name()).cloned().unwrap_or_default();
+            registry.register(BuiltinRunner::new(*language).with_config(&config));
+        }
+        registry
+    }
+
+    /// Adds a runner, replacing any existing runner with the same name
+    pub fn register<R: Runner + 'static>(&mut self, runner: R) {
+        self.runners.retain(|r| r.name() != runner.name());
+        self.runners.push(Arc::new(runner));
+    }
+
+    pub fn get(&self, name: &str) -> Option<Arc<dyn Runner>> {
+        self.runners
+            .iter()
+            .find(|r| r.name().eq_ignore_ascii_case(name))
+            .cloned()
+    }
+
+    /// Finds the runner for a script, trying in order a `lang` modeline
+    /// (`// singleload: lang=go`), the runners' own detection (the file
+    /// extension by default), the shebang interpreter and content sniffing.
+    /// `content` is the script as written, shebang included.
+    pub fn detect(&self, path: &Path, content: &[u8]) -> Option<Arc<dyn Runner>> {
+        self.detect_with_reason(path, content).map(|(runner, _)| runner)
+    }
+
+    /// Like [`Registry::detect`], also saying what gave the language away
+    pub fn detect_with_reason(&self, path: &Path, content: &[u8]) -> Option<(Arc<dyn Runner>, String)> {
+        if let Some(modeline) = Directives::parse(content).first("lang") {
+            if let Some(runner) = self.get(modeline.value.trim()) {
+                return Some((runner, "lang directive".to_string()));
+            }
+        }
+        if let Some(runner) = self.runners.iter().find(|r| r.detect(path, content)) {
+            return Some((runner.clone(), "file name".to_string()));
+        }
+        if let Some(interpreter) = shebang_interpreter(content) {
+            // Versioned names such as python3.12 select the same runner
+            let base = interpreter.trim_end_matches(|c: char| c.is_ascii_digit() || c == '.');
+            if let Some(runner) = self
+                .runners
+                .iter()
+                .find(|r| r.interpreters().iter().any(|i| *i == interpreter || *i == base))
+            {
+                return Some((runner.clone(), format!("#! {}", interpreter)));
+            }
+        }
+        self.runners
+            .iter()
+            .find(|r| r.sniff(content))
+            .map(|runner| (runner.clone(), "script content".to_string()))
+    }
+
+    pub fn names(&self) -> Vec<String> {
+        self.runners.iter().map(|r| r.name().to_string()).collect()
+    }
+
+    /// Script extensions accepted by the registered runners
+    pub fn extensions(&self) -> Vec<String> {
+        self.runners
+            .iter()
+            .map(|r| r.file_extension().to_string())
+            .collect()
+    }
+}
+
+impl Default for Registry {
+    fn default() -> Self {
+        Self::with_builtins()
+    }
+}
+
+/// Unpacks a toolchain archive into a directory and links `bin` to the
+/// binaries in its top directory, `python/` in python-build-standalone
+/// archives and `node-v22.11.0-linux-x64/` in Node.js ones
+const TOOLCHAIN_EXTRACT: &str = r#"
+import os, sys, tarfile
+archive, dest = sys.argv[1], sys.argv[2]
+with tarfile.open(archive) as tar:
+    top = os.path.normpath(tar.getmembers()[0].name).split(os.sep)[0]
+    tar.extractall(dest)
+os.symlink(os.path.join(top, "bin"), os.path.join(dest, "bin"))
+"#;
+
+/// Quotes a single argument for use in a `/bin/bash -c` command line
+pub fn shell_quote(arg: &str) -> String {
+    if !arg.is_empty()
+        && arg
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || "/._-=:+,".contains(c))
+    {
+        arg.to_string()
+    } else {
+        format!("'{}'", arg.replace('\'', "'\\''"))
+    }
+}
+
+/// Bash code that runs `command` as a child and waits for it, passing on
+/// the SIGINT, SIGTERM and SIGHUP the shell receives, and leaves its exit
+/// status in `$status`. For wrappers with more to do once the program
+/// exits, which cannot `exec` it: as PID 1 of the container they get the
+/// signals meant for the program. The child gets the shell's stdin and
+/// does not ignore SIGINT and SIGQUIT like background jobs normally do.
+/// A trap cuts `wait` short, so it is repeated until the child's own
+/// status comes back; 127 means an earlier round already collected it.
+pub fn supervise(command: &str) -> String {
+    format!(
+        "for sig in INT TERM HUP; do trap \"kill -s $sig \\$pid 2>/dev/null; interrupted=1\" $sig; done; \
+         (trap - INT QUIT; exec {}) <&0 & pid=$!; status=; \
+         while :; do interrupted=; wait $pid 2>/dev/null; code=$?; \
+         [ $code -eq 127 ] && [ -n \"$status\" ] && break; status=$code; [ -n \"$interrupted\" ] || break; done",
+        command
+    )
+}
+
+/// Joins a command vector into a single shell command line
+pub fn shell_join(args: &[String]) -> String {
+    args.iter()
+        .map(|a| shell_quote(a))
+        .collect::<Vec<_>>()
+        .join(" ")
+}
@@ -0,0 +1,84 @@
+use crate::errors::SingleloadError;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+
+/// Restrictions applied to the container a script runs in. Fields left out
+/// of a configured profile keep the `default` profile's values.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct SandboxProfile {
+    /// Allow outbound network access
+    pub network: bool,
+    /// Mount the root filesystem read-only (only /tmp is writable)
+    pub read_only: bool,
+    /// Size of the writable /tmp tmpfs in MB
+    pub tmpfs_size_mb: u64,
+    /// Maximum number of processes
+    pub pids_limit: u64,
+    /// Upper bound for --memory, in MB
+    pub max_memory_mb: Option<u64>,
+    /// Upper bound for --cpu
+    pub max_cpu: Option<f32>,
+}
+
+impl Default for SandboxProfile {
+    fn default() -> Self {
+        Self {
+            network: false,
+            read_only: true,
+            tmpfs_size_mb: 100,
+            pids_limit: 100,
+            max_memory_mb: None,
+            max_cpu: None,
+        }
+    }
+}
+
+impl SandboxProfile {
+    /// Built-in profiles: `default`, `strict` for untrusted snippets and
+    /// `network` for trusted scripts that need to reach the outside world
+    pub fn builtin(name: &str) -> Option<Self> {
+        match name {
+            "default" => Some(Self::default()),
+            "strict" => Some(Self {
+                tmpfs_size_mb: 16,
+                pids_limit: 32,
+                max_memory_mb: Some(256),
+                max_cpu: Some(1.0),
+                ..Self::default()
+            }),
+            "network" => Some(Self {
+                network: true,
+                ..Self::default()
+            }),
+            _ => None,
+        }
+    }
+
+    /// Resolves a profile by name, preferring profiles defined in the configuration
+    pub fn resolve(
+        name: &str,
+        configured: &HashMap<String, SandboxProfile>,
+    ) -> Result<Self, SingleloadError> {
+        configured
+            .get(name)
+            .cloned()
+            .or_else(|| Self::builtin(name))
+            .ok_or_else(|| SingleloadError::InvalidInput(format!("Unknown sandbox profile: {}", name)))
+    }
+
+    /// Memory limit in bytes after applying the profile cap
+    pub fn clamp_memory(&self, memory_bytes: u64) -> u64 {
+        match self.max_memory_mb {
+            Some(max) => memory_bytes.min(max * 1024 * 1024),
+            None => memory_bytes,
+        }
+    }
+
+    pub fn clamp_cpu(&self, cpu: f32) -> f32 {
+        match self.max_cpu {
+            Some(max) => cpu.min(max),
+            None => cpu,
+        }
+    }
+}
@@ -0,0 +1,326 @@
+use crate::directives::PackageManager;
+use crate::errors::SingleloadError;
+use chrono::{DateTime, SecondsFormat, Utc};
+use clap::ValueEnum;
+use serde::Serialize;
+use serde_json::{json, Value};
+use std::path::{Path, PathBuf};
+
+const TOOL_NAME: &str = env!("CARGO_PKG_NAME");
+const TOOL_VERSION: &str = env!("CARGO_PKG_VERSION");
+const BUILD_TYPE: &str = "https://github.com/Singleload/Singleload/build/v1";
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum SbomFormat {
+    /// SPDX 2.3 JSON
+    #[default]
+    Spdx,
+    /// CycloneDX 1.5 JSON
+    Cyclonedx,
+}
+
+/// A third-party package that went into a build
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Component {
+    pub manager: Option<PackageManager>,
+    pub name: String,
+    /// The installed version, or the declared requirement when nothing was installed
+    pub version: Option<String>,
+    /// Checksum reported by the package manager, in its own notation
+    pub hash: Option<String>,
+}
+
+impl Component {
+    /// Package URL, with the version only when it is an exact one
+    pub fn purl(&self) -> Option<String> {
+        let (kind, name) = match self.manager? {
+            PackageManager::Go => ("golang", self.name.clone()),
+            PackageManager::Pip => ("pypi", self.name.to_lowercase().replace('_', "-")),
+            PackageManager::Npm => ("npm", self.name.replacen('@', "%40", 1)),
+            PackageManager::Maven => ("maven", self.name.replacen(':', "/", 1)),
+        };
+        let mut purl = format!("pkg:{}/{}", kind, name);
+        if let Some(version) = self.version.as_deref().filter(|v| is_exact_version(v)) {
+            purl.push('@');
+            purl.push_str(version.trim_start_matches("=="));
+        }
+        Some(purl)
+    }
+}
+
+/// True for a single version rather than a requirement like `^2.0` or `>=1.4`
+pub fn is_exact_version(version: &str) -> bool {
+    let version = version.trim_start_matches("==");
+    !version.is_empty() && !version.contains(|c: char| "<>=~^*, |".contains(c))
+}
+
+/// How an artifact was built, recorded by [`crate::executor::Executor::build_script`]
+#[derive(Debug, Clone, Serialize)]
+pub struct Provenance {
+    pub language: String,
+    pub script: PathBuf,
+    /// SHA-256 of the sources and embedded assets the build is keyed on
+    pub source_sha256: String,
+    pub artifact: PathBuf,
+    pub artifact_sha256: String,
+    /// Base image id, followed by the pinned toolchain version if any
+    pub toolchain: String,
+    pub build_command: String,
+    /// Compiler flags of the build profile
+    pub build_flags: Vec<String>,
+    pub target: Option<String>,
+    pub cache_key: String,
+    /// True if the artifact was reused from the build cache
+    pub cached: bool,
+    pub components: Vec<Component>,
+    pub started_at: DateTime<Utc>,
+    pub finished_at: DateTime<Utc>,
+}
+
+impl Provenance {
+    fn artifact_name(&self) -> String {
+        self.artifact
+            .file_name()
+            .map(|name| name.to_string_lossy().to_string())
+            .unwrap_or_else(|| self.artifact.display().to_string())
+    }
+
+    fn script_name(&self) -> String {
+        self.script
+            .file_name()
+            .map(|name| name.to_string_lossy().to_string())
+            .unwrap_or_else(|| self.script.display().to_string())
+    }
+}
+
+/// SBOM of the artifact in `format`
+pub fn sbom(provenance: &Provenance, format: SbomFormat) -> Value {
+    match format {
+        SbomFormat::Spdx => spdx(provenance),
+        SbomFormat::Cyclonedx => cyclonedx(provenance),
+    }
+}
+
+/// SPDX 2.3 document describing the artifact, the source it was generated
+/// from and the packages it depends on
+pub fn spdx(provenance: &Provenance) -> Value {
+    let name = provenance.artifact_name();
+    let mut packages = vec![
+        json!({
+            "SPDXID": "SPDXRef-Artifact",
+            "name": name,
+            "downloadLocation": "NOASSERTION",
+            "filesAnalyzed": false,
+            "primaryPackagePurpose": "APPLICATION",
+            "checksums": [{ "algorithm": "SHA256", "checksumValue": provenance.artifact_sha256 }],
+        }),
+        json!({
+            "SPDXID": "SPDXRef-Source",
+            "name": provenance.script_name(),
+            "downloadLocation": "NOASSERTION",
+            "filesAnalyzed": false,
+            "primaryPackagePurpose": "SOURCE",
+            "checksums": [{ "algorithm": "SHA256", "checksumValue": provenance.source_sha256 }],
+        }),
+    ];
+    let mut relationships = vec![
+        relationship("SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Artifact"),
+        relationship("SPDXRef-Artifact", "GENERATED_FROM", "SPDXRef-Source"),
+    ];
+
+    for (idx, component) in provenance.components.iter().enumerate() {
+        let id = format!("SPDXRef-Package-{}", idx + 1);
+        let mut package = json!({
+            "SPDXID": id,
+            "name": component.name,
+            "downloadLocation": "NOASSERTION",
+            "filesAnalyzed": false,
+            "primaryPackagePurpose": "LIBRARY",
+        });
+        if let Some(version) = &component.version {
+            package["versionInfo"] = json!(version);
+        }
+        if let Some(purl) = component.purl() {
+            package["externalRefs"] = json!([{
+                "referenceCategory": "PACKAGE-MANAGER",
+                "referenceType": "purl",
+                "referenceLocator": purl,
+            }]);
+        }
+        packages.push(package);
+        relationships.push(relationship("SPDXRef-Artifact", "DEPENDS_ON", &id));
+    }
+
+    json!({
+        "spdxVersion": "SPDX-2.3",
+        "dataLicense": "CC0-1.0",
+        "SPDXID": "SPDXRef-DOCUMENT",
+        "name": name,
+        "documentNamespace": format!(
+            "https://github.com/Singleload/Singleload/spdx/{}-{}",
+            name,
+            uuid::Uuid::new_v4()
+        ),
+        "creationInfo": {
+            "created": timestamp(&provenance.finished_at),
+            "creators": [format!("Tool: {}-{}", TOOL_NAME, TOOL_VERSION)],
+            "comment": format!("Toolchain: {}", provenance.toolchain),
+        },
+        "packages": packages,
+        "relationships": relationships,
+    })
+}
+
+fn relationship(from: &str, kind: &str, to: &str) -> Value {
+    json!({ "spdxElementId": from, "relationshipType": kind, "relatedSpdxElement": to })
+}
+
+/// CycloneDX 1.5 BOM with the artifact as its subject and the build
+/// inputs as `singleload:*` properties
+pub fn cyclonedx(provenance: &Provenance) -> Value {
+    let mut properties = vec![
+        property("singleload:language", &provenance.language),
+        property("singleload:source_sha256", &provenance.source_sha256),
+        property("singleload:toolchain", &provenance.toolchain),
+        property("singleload:build_command", &provenance.build_command),
+    ];
+    for flag in &provenance.build_flags {
+        properties.push(property("singleload:build_flag", flag));
+    }
+    if let Some(target) = &provenance.target {
+        properties.push(property("singleload:target", target));
+    }
+
+    let components: Vec<Value> = provenance
+        .components
+        .iter()
+        .enumerate()
+        .map(|(idx, component)| {
+            let mut value = json!({
+                "type": "library",
+                "bom-ref": component_ref(idx, component),
+                "name": component.name,
+            });
+            if let Some(version) = &component.version {
+                value["version"] = json!(version);
+            }
+            if let Some(purl) = component.purl() {
+                value["purl"] = json!(purl);
+            }
+            if let Some(hash) = &component.hash {
+                value["properties"] = json!([property("singleload:checksum", hash)]);
+            }
+            value
+        })
+        .collect();
+    let depends_on: Vec<String> = provenance
+        .components
+        .iter()
+        .enumerate()
+        .map(|(idx, component)| component_ref(idx, component))
+        .collect();
+
+    json!({
+        "bomFormat": "CycloneDX",
+        "specVersion": "1.5",
+        "serialNumber": format!("urn:uuid:{}", uuid::Uuid::new_v4()),
+        "version": 1,
+        "metadata": {
+            "timestamp": timestamp(&provenance.finished_at),
+            "tools": {
+                "components": [{ "type": "application", "name": TOOL_NAME, "version": TOOL_VERSION }],
+            },
+            "component": {
+                "type": "application",
+                "bom-ref": "artifact",
+                "name": provenance.artifact_name(),
+                "hashes": [{ "alg": "SHA-256", "content": provenance.artifact_sha256 }],
+                "properties": properties,
+            },
+        },
+        "components": components,
+        "dependencies": [{ "ref": "artifact", "dependsOn": depends_on }],
+    })
+}
+
+fn component_ref(idx: usize, component: &Component) -> String {
+    component.purl().unwrap_or_else(|| format!("component-{}", idx + 1))
+}
+
+fn property(name: &str, value: &str) -> Value {
+    json!({ "name": name, "value": value })
+}
+
+/// SLSA v1 provenance as an in-toto statement about the artifact
+pub fn slsa_provenance(provenance: &Provenance) -> Value {
+    let mut resolved = vec![json!({
+        "uri": crate::lsp::file_uri(&provenance.script),
+        "digest": { "sha256": provenance.source_sha256 },
+    })];
+    for component in &provenance.components {
+        let mut dependency = json!({ "name": component.name });
+        if let Some(purl) = component.purl() {
+            dependency["uri"] = json!(purl);
+        }
+        if let Some(hash) = &component.hash {
+            dependency["annotations"] = json!({ "checksum": hash });
+        }
+        resolved.push(dependency);
+    }
+
+    json!({
+        "_type": "https://in-toto.io/Statement/v1",
+        "subject": [{
+            "name": provenance.artifact_name(),
+            "digest": { "sha256": provenance.artifact_sha256 },
+        }],
+        "predicateType": "https://slsa.dev/provenance/v1",
+        "predicate": {
+            "buildDefinition": {
+                "buildType": BUILD_TYPE,
+                "externalParameters": {
+                    "script": provenance.script.display().to_string(),
+                    "language": provenance.language,
+                    "target": provenance.target,
+                    "buildFlags": provenance.build_flags,
+                },
+                "internalParameters": {
+                    "toolchain": provenance.toolchain,
+                    "buildCommand": provenance.build_command,
+                    "cacheKey": provenance.cache_key,
+                    "cached": provenance.cached,
+                },
+                "resolvedDependencies": resolved,
+            },
+            "runDetails": {
+                "builder": { "id": format!("https://github.com/Singleload/Singleload@{}", TOOL_VERSION) },
+                "metadata": {
+                    "startedOn": timestamp(&provenance.started_at),
+                    "finishedOn": timestamp(&provenance.finished_at),
+                },
+            },
+        },
+    })
+}
+
+fn timestamp(time: &DateTime<Utc>) -> String {
+    time.to_rfc3339_opts(SecondsFormat::Secs, true)
+}
+
+/// Where [`write`] puts the provenance next to an SBOM: `out.json` gets
+/// `out.intoto.json`
+pub fn provenance_path(sbom_path: &Path) -> PathBuf {
+    sbom_path.with_extension("intoto.json")
+}
+
+/// Writes the SBOM to `path` and the SLSA provenance next to it, returning
+/// the provenance path
+pub fn write(provenance: &Provenance, format: SbomFormat, path: &Path) -> Result<PathBuf, SingleloadError> {
+    let provenance_path = provenance_path(path);
+    for (path, document) in [(path, sbom(provenance, format)), (&provenance_path, slsa_provenance(provenance))] {
+        let mut json = serde_json::to_string_pretty(&document)?;
+        json.push('\n');
+        std::fs::write(path, json)?;
+    }
+    Ok(provenance_path)
+}
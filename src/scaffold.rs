@@ -0,0 +1,165 @@
+use crate::errors::SingleloadError;
+use crate::platform;
+use serde::Serialize;
+use std::path::{Path, PathBuf};
+
+pub const DEFAULT_TEMPLATE: &str = "basic";
+
+/// Placeholder replaced with the name of the new script
+const NAME_PLACEHOLDER: &str = "{{name}}";
+
+/// Templates shipped with singleload, from the repository's `templates`
+/// directory: language, template name and content
+const BUILTIN: &[(&str, &str, &str)] = &[
+    ("python", "basic", include_str!("../templates/python/basic.py")),
+    ("python", "cli-args", include_str!("../templates/python/cli-args.py")),
+    ("javascript", "basic", include_str!("../templates/javascript/basic.js")),
+    ("javascript", "cli-args", include_str!("../templates/javascript/cli-args.js")),
+    ("php", "basic", include_str!("../templates/php/basic.php")),
+    ("php", "cli-args", include_str!("../templates/php/cli-args.php")),
+    ("go", "basic", include_str!("../templates/go/basic.go")),
+    ("go", "cli-args", include_str!("../templates/go/cli-args.go")),
+    ("rust", "basic", include_str!("../templates/rust/basic.rs")),
+    ("rust", "cli-args", include_str!("../templates/rust/cli-args.rs")),
+    ("bash", "basic", include_str!("../templates/bash/basic.sh")),
+    ("bash", "cli-args", include_str!("../templates/bash/cli-args.sh")),
+    ("dotnet", "basic", include_str!("../templates/dotnet/basic.cs")),
+    ("dotnet", "cli-args", include_str!("../templates/dotnet/cli-args.cs")),
+    ("c", "basic", include_str!("../templates/c/basic.c")),
+    ("c", "cli-args", include_str!("../templates/c/cli-args.c")),
+    ("cpp", "basic", include_str!("../templates/cpp/basic.cpp")),
+    ("cpp", "cli-args", include_str!("../templates/cpp/cli-args.cpp")),
+    ("cuda", "basic", include_str!("../templates/cuda/basic.cu")),
+    ("cuda", "cli-args", include_str!("../templates/cuda/cli-args.cu")),
+    ("opencl", "basic", include_str!("../templates/opencl/basic.cpp")),
+    ("opencl", "cli-args", include_str!("../templates/opencl/cli-args.cpp")),
+    ("java", "basic", include_str!("../templates/java/basic.java")),
+    ("java", "cli-args", include_str!("../templates/java/cli-args.java")),
+    ("kotlin", "basic", include_str!("../templates/kotlin/basic.kt")),
+    ("kotlin", "cli-args", include_str!("../templates/kotlin/cli-args.kt")),
+    ("typescript", "basic", include_str!("../templates/typescript/basic.ts")),
+    ("typescript", "cli-args", include_str!("../templates/typescript/cli-args.ts")),
+];
+
+/// Script templates for `singleload new`: the built-in ones, plus any found
+/// at `<dir>/<language>/<template>.<ext>`, which take precedence
+#[derive(Debug, Clone)]
+pub struct Templates {
+    dir: PathBuf,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct TemplateInfo {
+    pub language: String,
+    pub name: String,
+    /// File the template is read from; None for built-in templates
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub path: Option<PathBuf>,
+}
+
+impl Templates {
+    pub fn new(dir: PathBuf) -> Self {
+        Self { dir }
+    }
+
+    /// Default location, `~/.singleload/templates` (`%LOCALAPPDATA%\singleload\templates` on Windows)
+    pub fn default_root() -> PathBuf {
+        platform::data_dir().join("templates")
+    }
+
+    /// Every template, user templates replacing built-in ones of the same
+    /// language and name, sorted by language and name
+    pub fn list(&self) -> Result<Vec<TemplateInfo>, SingleloadError> {
+        let mut templates: Vec<TemplateInfo> = BUILTIN
+            .iter()
+            .map(|(language, name, _)| TemplateInfo {
+                language: language.to_string(),
+                name: name.to_string(),
+                path: None,
+            })
+            .collect();
+
+        if self.dir.is_dir() {
+            for language in std::fs::read_dir(&self.dir)? {
+                let language = language?;
+                if !language.file_type()?.is_dir() {
+                    continue;
+                }
+                for file in std::fs::read_dir(language.path())? {
+                    let path = file?.path();
+                    let Some(name) = path.file_stem().map(|s| s.to_string_lossy().to_string()) else {
+                        continue;
+                    };
+                    if name.starts_with('.') || !path.is_file() {
+                        continue;
+                    }
+                    let language = language.file_name().to_string_lossy().to_string();
+                    templates.retain(|t| !(t.language == language && t.name == name));
+                    templates.push(TemplateInfo { language, name, path: Some(path) });
+                }
+            }
+        }
+
+        templates.sort_by(|a, b| (&a.language, &a.name).cmp(&(&b.language, &b.name)));
+        Ok(templates)
+    }
+
+    /// Names of the templates available for `language`
+    pub fn names(&self, language: &str) -> Result<Vec<String>, SingleloadError> {
+        Ok(self
+            .list()?
+            .into_iter()
+            .filter(|t| t.language == language)
+            .map(|t| t.name)
+            .collect())
+    }
+
+    /// Content of a template, read from the templates directory if it is there
+    pub fn get(&self, language: &str, name: &str) -> Result<String, SingleloadError> {
+        let found = self
+            .list()?
+            .into_iter()
+            .find(|t| t.language == language && t.name == name);
+        match found {
+            Some(TemplateInfo { path: Some(path), .. }) => Ok(std::fs::read_to_string(path)?),
+            Some(_) => Ok(BUILTIN
+                .iter()
+                .find(|(l, n, _)| *l == language && *n == name)
+                .map(|(_, _, content)| content.to_string())
+                .unwrap_or_default()),
+            None => Err(SingleloadError::InvalidInput(format!(
+                "No template '{}' for {} (available: {})",
+                name,
+                language,
+                self.names(language)?.join(", ")
+            ))),
+        }
+    }
+}
+
+/// Fills in a template for a script called `name`
+pub fn render(template: &str, name: &str) -> String {
+    template.replace(NAME_PLACEHOLDER, name)
+}
+
+/// Writes a new script, executable so its shebang works; existing files are
+/// only replaced with `force`
+pub fn write(path: &Path, content: &str, force: bool) -> Result<(), SingleloadError> {
+    if path.exists() && !force {
+        return Err(SingleloadError::InvalidInput(format!(
+            "{} already exists; use --force to replace it",
+            path.display()
+        )));
+    }
+    if let Some(parent) = path.parent().filter(|p| !p.as_os_str().is_empty()) {
+        std::fs::create_dir_all(parent)?;
+    }
+    std::fs::write(path, content)?;
+
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(path, std::fs::Permissions::from_mode(0o755))?;
+    }
+    Ok(())
+}
@@ -1,14 +1,12 @@
 use crate::errors::SingleloadError;
-use std::collections::HashSet;
 use std::path::{Path, PathBuf};
 use tracing::warn;
 
-const MAX_SCRIPT_SIZE: u64 = 10 * 1024 * 1024; // 10MB
+pub const MAX_SCRIPT_SIZE: u64 = 10 * 1024 * 1024; // 10MB
 const MAX_PATH_DEPTH: usize = 10;
 const SUSPICIOUS_EXTENSIONS: &[&str] = &[".so", ".dll", ".dylib", ".ko", ".sys"];
 
 pub struct SecurityValidator {
-    allowed_extensions: HashSet<String>,
     max_file_size: u64,
     compiled_patterns: SecurityPatterns,
 }
@@ -62,7 +60,7 @@ impl SecurityPatterns {
             ])?,
             resource_patterns: Self::compile_patterns(&[
                 (r"fork\s*\(\s*\)\s*while.*true", "Fork bomb pattern detected"),
-                (r":\(\)\s*{\s*:\|:&\s*}", "Bash fork bomb detected"),
+                (r":\(\)\s*\{\s*:\|:&\s*\}", "Bash fork bomb detected"),
                 (r"while.*true.*malloc", "Memory exhaustion pattern detected"),
                 (r"/dev/zero.*dd", "Disk filling pattern detected"),
                 (r"openfiles\s*=\s*\d{5,}", "File descriptor exhaustion detected"),
@@ -95,12 +93,11 @@ impl SecurityPatterns {
 }
 
 impl SecurityValidator {
-    pub fn new(allowed_extensions: Vec<String>) -> Self {
+    pub fn new() -> Self {
         let patterns = SecurityPatterns::new()
             .unwrap_or_else(|_| panic!("Failed to compile security patterns"));
         
         Self {
-            allowed_extensions: allowed_extensions.into_iter().collect(),
             max_file_size: MAX_SCRIPT_SIZE,
             compiled_patterns: patterns,
         }
@@ -121,20 +118,14 @@ impl SecurityValidator {
             ));
         }
 
-        // Validate extension
+        // Any extension (or none) is accepted as long as a runner claims
+        // the script, see Registry::detect
         let extension = path
             .extension()
             .and_then(|e| e.to_str())
             .map(|e| format!(".{}", e))
             .unwrap_or_default();
 
-        if !self.allowed_extensions.contains(&extension) {
-            return Err(SingleloadError::InvalidInput(format!(
-                "File extension '{}' not allowed. Allowed: {:?}",
-                extension, self.allowed_extensions
-            )));
-        }
-
         // Check for suspicious extensions that might be libraries
         if SUSPICIOUS_EXTENSIONS.contains(&extension.as_str()) {
             return Err(SingleloadError::SecurityViolation(
@@ -372,4 +363,20 @@ impl Default for SeccompProfile {
             }"#.to_string(),
         }
     }
-}
\ No newline at end of file
+}
+
+impl SeccompProfile {
+    /// The profile with `names` taken off the calls it blocks or restricts
+    pub fn allowing(&self, names: &[String]) -> Result<String, SingleloadError> {
+        let mut profile: serde_json::Value = serde_json::from_str(&self.content)?;
+        if let Some(rules) = profile.get_mut("syscalls").and_then(|s| s.as_array_mut()) {
+            for rule in rules.iter_mut() {
+                if let Some(listed) = rule.get_mut("names").and_then(|n| n.as_array_mut()) {
+                    listed.retain(|name| !name.as_str().is_some_and(|name| names.iter().any(|n| n == name)));
+                }
+            }
+            rules.retain(|rule| rule.get("names").and_then(|n| n.as_array()).map_or(true, |n| !n.is_empty()));
+        }
+        Ok(serde_json::to_string(&profile)?)
+    }
+}
@@ -0,0 +1,580 @@
+use crate::cache::BuildCache;
+use crate::container::ContainerManager;
+use crate::errors::SingleloadError;
+use crate::events::{Event, EventSink};
+use crate::executor::Executor;
+use crate::logs::{OutputStream, OutputTap};
+use crate::plugins;
+use crate::queue::{BuildQueue, Job, Priority};
+use crate::runner::Registry;
+use crate::sandbox::SandboxProfile;
+use crate::types::ExecutionResult;
+use anyhow::Result;
+use serde::Deserialize;
+use serde_json::json;
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tempfile::TempDir;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream};
+use tokio::sync::{mpsc, watch};
+use tracing::{debug, info, warn};
+
+/// Largest request head (request line and headers) read before giving up
+const MAX_HEAD_BYTES: usize = 16 * 1024;
+
+/// Largest request body; scripts are single files
+pub const MAX_BODY_BYTES: usize = 1024 * 1024;
+
+/// A parsed HTTP/1.1 request. Connections serve one request each.
+#[derive(Debug, Clone, Default)]
+pub struct HttpRequest {
+    pub method: String,
+    /// Path without the query string
+    pub path: String,
+    /// Header names are lowercase
+    pub headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+}
+
+impl HttpRequest {
+    pub fn header(&self, name: &str) -> Option<&str> {
+        self.headers
+            .iter()
+            .find(|(key, _)| key.eq_ignore_ascii_case(name))
+            .map(|(_, value)| value.as_str())
+    }
+
+    /// True if the client asked for the run as server-sent events
+    pub fn wants_events(&self) -> bool {
+        self.header("accept").is_some_and(|accept| accept.contains("text/event-stream"))
+    }
+
+    /// True if the body is declared as JSON. Browsers send pages' requests
+    /// with other types, like `text/plain`, to any origin without asking it.
+    pub fn is_json(&self) -> bool {
+        self.header("content-type").is_some_and(|value| {
+            value.split(';').next().unwrap_or_default().trim().eq_ignore_ascii_case("application/json")
+        })
+    }
+}
+
+/// True if `host`, a request's `Host` header, names the local machine. A
+/// server on the loopback interface gets other names from pages that point
+/// their own domain at 127.0.0.1 to get around the browser (DNS rebinding).
+pub fn is_local_host(host: &str) -> bool {
+    let name = match host.strip_prefix('[') {
+        Some(rest) => rest.split(']').next().unwrap_or_default(),
+        None => host.rsplit_once(':').map_or(host, |(name, _)| name),
+    };
+    name.eq_ignore_ascii_case("localhost") || name.parse::<std::net::IpAddr>().is_ok_and(|ip| ip.is_loopback())
+}
+
+/// A bearer token for servers started without one
+pub fn generate_token() -> String {
+    format!("{}{}", uuid::Uuid::new_v4().simple(), uuid::Uuid::new_v4().simple())
+}
+
+/// Why a request could not be read, with the status it is answered with
+#[derive(Debug, Clone, PartialEq)]
+pub struct BadRequest {
+    pub status: &'static str,
+    pub message: String,
+}
+
+impl BadRequest {
+    fn new(status: &'static str, message: impl Into<String>) -> Self {
+        Self {
+            status,
+            message: message.into(),
+        }
+    }
+}
+
+/// Reads one request: the head up to the blank line, then `Content-Length`
+/// bytes of body. Chunked bodies are not accepted.
+pub async fn read_request<R: AsyncRead + Unpin>(stream: &mut R) -> Result<HttpRequest, BadRequest> {
+    let mut data = Vec::new();
+    let mut buf = [0u8; 4096];
+    let head_end = loop {
+        if let Some(end) = data.windows(4).position(|w| w == b"\r\n\r\n") {
+            break end;
+        }
+        if data.len() > MAX_HEAD_BYTES {
+            return Err(BadRequest::new("431 Request Header Fields Too Large", "Request head is too large"));
+        }
+        let n = stream
+            .read(&mut buf)
+            .await
+            .map_err(|e| BadRequest::new("400 Bad Request", e.to_string()))?;
+        if n == 0 {
+            return Err(BadRequest::new("400 Bad Request", "Incomplete request"));
+        }
+        data.extend_from_slice(&buf[..n]);
+    };
+
+    let head = String::from_utf8_lossy(&data[..head_end]).to_string();
+    let mut lines = head.split("\r\n");
+    let mut request_line = lines.next().unwrap_or_default().split_whitespace();
+    let (Some(method), Some(target)) = (request_line.next(), request_line.next()) else {
+        return Err(BadRequest::new("400 Bad Request", "Malformed request line"));
+    };
+    let headers: Vec<(String, String)> = lines
+        .filter_map(|line| line.split_once(':'))
+        .map(|(name, value)| (name.trim().to_ascii_lowercase(), value.trim().to_string()))
+        .collect();
+    let mut request = HttpRequest {
+        method: method.to_string(),
+        path: target.split('?').next().unwrap_or(target).to_string(),
+        headers,
+        body: Vec::new(),
+    };
+
+    if request.header("transfer-encoding").is_some() {
+        return Err(BadRequest::new("411 Length Required", "Send the body with a Content-Length"));
+    }
+    let length = match request.header("content-length") {
+        Some(value) => value
+            .parse::<usize>()
+            .map_err(|_| BadRequest::new("400 Bad Request", "Invalid Content-Length"))?,
+        None => 0,
+    };
+    if length > MAX_BODY_BYTES {
+        return Err(BadRequest::new(
+            "413 Content Too Large",
+            format!("Request body is larger than {} bytes", MAX_BODY_BYTES),
+        ));
+    }
+    let mut body = data[head_end + 4..].to_vec();
+    while body.len() < length {
+        let n = stream
+            .read(&mut buf)
+            .await
+            .map_err(|e| BadRequest::new("400 Bad Request", e.to_string()))?;
+        if n == 0 {
+            return Err(BadRequest::new("400 Bad Request", "Incomplete request body"));
+        }
+        body.extend_from_slice(&buf[..n]);
+    }
+    body.truncate(length);
+    request.body = body;
+    Ok(request)
+}
+
+/// A script submitted to `POST /v1/runs` or `POST /v1/builds`
+#[derive(Debug, Clone, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Submission {
+    /// Language name; detected from `filename` and the source when omitted
+    #[serde(default)]
+    pub language: Option<String>,
+    pub source: String,
+    /// File name the source is saved as, `main` and the language's extension by default
+    #[serde(default)]
+    pub filename: Option<String>,
+    #[serde(default)]
+    pub stdin: Option<String>,
+    /// Arguments passed to the script
+    #[serde(default)]
+    pub args: Vec<String>,
+    #[serde(default)]
+    pub env: BTreeMap<String, String>,
+    /// At most the server's `default_timeout_secs`
+    #[serde(default)]
+    pub timeout_secs: Option<u64>,
+    /// At most the server's `default_memory_mb`
+    #[serde(default)]
+    pub memory_mb: Option<u64>,
+}
+
+impl Submission {
+    /// Writes the source to `dir` under its file name and returns the path
+    pub fn stage(&self, dir: &Path, registry: &Registry) -> Result<PathBuf, SingleloadError> {
+        let name = match (&self.filename, &self.language) {
+            (Some(name), _) => {
+                let plain = Path::new(name).file_name().is_some_and(|n| n == name.as_str());
+                if !plain || name.starts_with('.') {
+                    return Err(SingleloadError::InvalidInput(format!("Invalid filename '{}'", name)));
+                }
+                name.clone()
+            }
+            (None, Some(language)) => {
+                let runner = registry
+                    .get(language)
+                    .ok_or_else(|| SingleloadError::UnsupportedLanguage(language.clone()))?;
+                format!("main{}", runner.file_extension())
+            }
+            (None, None) => {
+                return Err(SingleloadError::InvalidInput(
+                    "Either language or filename is required".to_string(),
+                ))
+            }
+        };
+        let path = dir.join(name);
+        std::fs::write(&path, &self.source)?;
+        Ok(path)
+    }
+}
+
+/// HTTP/JSON API for running and building submitted scripts, e.g. behind
+/// a playground or an internal "run this snippet" service. Requests wait
+/// in a [`BuildQueue`] like the daemon's, so the container limits of the
+/// configuration hold however many clients there are.
+pub struct ApiServer {
+    container_manager: ContainerManager,
+    queue: Arc<BuildQueue>,
+    registry: Arc<Registry>,
+    token: Option<String>,
+    allow_origin: Option<String>,
+}
+
+impl ApiServer {
+    pub fn new(container_manager: ContainerManager) -> Self {
+        let queue = BuildQueue::new(
+            container_manager.config.max_concurrent_containers,
+            container_manager.config.language_concurrency.clone(),
+        );
+        let registry = Arc::new(plugins::registry(&container_manager.config));
+        Self {
+            container_manager,
+            queue,
+            registry,
+            token: None,
+            allow_origin: None,
+        }
+    }
+
+    /// Requires `Authorization: Bearer <token>` on every endpoint but `/v1/health`
+    pub fn with_token(mut self, token: Option<String>) -> Self {
+        self.token = token;
+        self
+    }
+
+    /// Lets pages from `origin` (`*` for any) call the API from a browser
+    pub fn with_allow_origin(mut self, origin: Option<String>) -> Self {
+        self.allow_origin = origin;
+        self
+    }
+
+    /// Answers requests on `listener` until Ctrl-C
+    pub async fn serve(self, listener: TcpListener) -> Result<()> {
+        if let Ok(addr) = listener.local_addr() {
+            info!("API listening on http://{}/v1", addr);
+            if self.token.is_none() && !addr.ip().is_loopback() {
+                warn!("Anyone who can reach {} can run scripts; consider --token", addr);
+            }
+        }
+        let server = Arc::new(self);
+        loop {
+            tokio::select! {
+                accepted = listener.accept() => {
+                    let Ok((stream, peer)) = accepted else {
+                        continue;
+                    };
+                    let server = server.clone();
+                    tokio::spawn(async move {
+                        if let Err(e) = server.handle(stream).await {
+                            debug!("API request from {} failed: {}", peer, e);
+                        }
+                    });
+                }
+                _ = tokio::signal::ctrl_c() => {
+                    info!("API server shutting down");
+                    return Ok(());
+                }
+            }
+        }
+    }
+
+    async fn handle(&self, mut stream: TcpStream) -> std::io::Result<()> {
+        let request = match read_request(&mut stream).await {
+            Ok(request) => request,
+            Err(bad) => return self.respond(&mut stream, bad.status, &json!({ "error": bad.message })).await,
+        };
+        debug!("API {} {}", request.method, request.path);
+
+        let loopback = stream.local_addr().is_ok_and(|addr| addr.ip().is_loopback());
+        if loopback && !request.header("host").is_some_and(is_local_host) {
+            let body = json!({ "error": "Requests to a local server have to name it as localhost or its address" });
+            return self.respond(&mut stream, "403 Forbidden", &body).await;
+        }
+        if !self.origin_allowed(&request) {
+            let body = json!({ "error": "Requests from this origin are not allowed, see --allow-origin" });
+            return self.respond(&mut stream, "403 Forbidden", &body).await;
+        }
+        if request.method == "OPTIONS" && self.allow_origin.is_some() {
+            return self.respond_empty(&mut stream, "204 No Content").await;
+        }
+        if request.path != "/v1/health" && !self.authorized(&request) {
+            return self
+                .respond(&mut stream, "401 Unauthorized", &json!({ "error": "Missing or invalid bearer token" }))
+                .await;
+        }
+        if request.method == "POST" && !request.is_json() {
+            let body = json!({ "error": "Send the body as Content-Type: application/json" });
+            return self.respond(&mut stream, "415 Unsupported Media Type", &body).await;
+        }
+
+        match (request.method.as_str(), request.path.as_str()) {
+            ("GET", "/v1/health") => {
+                let body = json!({ "status": "ok", "version": env!("CARGO_PKG_VERSION") });
+                self.respond(&mut stream, "200 OK", &body).await
+            }
+            ("GET", "/v1/languages") => {
+                let body = json!({ "languages": self.registry.names() });
+                self.respond(&mut stream, "200 OK", &body).await
+            }
+            ("GET", "/v1/cache") => {
+                match self.cache_stats() {
+                    Ok(stats) => self.respond(&mut stream, "200 OK", &stats).await,
+                    Err(e) => self.respond_error(&mut stream, "500 Internal Server Error", e).await,
+                }
+            }
+            ("POST", "/v1/runs") => {
+                let submission = match parse_submission(&request) {
+                    Ok(submission) => submission,
+                    Err(e) => return self.respond_error(&mut stream, "400 Bad Request", e).await,
+                };
+                if request.wants_events() {
+                    self.stream_run(&mut stream, submission).await
+                } else {
+                    let (_cancel, cancelled) = watch::channel(false);
+                    match self.run(submission, EventSink::default(), None, cancelled).await {
+                        Ok(result) => self.respond(&mut stream, "200 OK", &json!(result)).await,
+                        Err(e) => self.respond_error(&mut stream, "422 Unprocessable Content", e).await,
+                    }
+                }
+            }
+            ("POST", "/v1/builds") => {
+                let submission = match parse_submission(&request) {
+                    Ok(submission) => submission,
+                    Err(e) => return self.respond_error(&mut stream, "400 Bad Request", e).await,
+                };
+                match self.build(submission).await {
+                    Ok(body) => self.respond(&mut stream, "200 OK", &body).await,
+                    Err(e) => self.respond_error(&mut stream, "422 Unprocessable Content", e).await,
+                }
+            }
+            (_, "/v1/health" | "/v1/languages" | "/v1/cache" | "/v1/runs" | "/v1/builds") => {
+                let body = json!({ "error": format!("{} is not supported on {}", request.method, request.path) });
+                self.respond(&mut stream, "405 Method Not Allowed", &body).await
+            }
+            _ => {
+                let body = json!({ "error": format!("No endpoint at {}", request.path) });
+                self.respond(&mut stream, "404 Not Found", &body).await
+            }
+        }
+    }
+
+    fn cache_stats(&self) -> Result<serde_json::Value> {
+        let config = &self.container_manager.config;
+        let cache = BuildCache::new(config.cache_dir.clone())
+            .with_budget(config.cache.budget()?)
+            .with_dedupe(config.cache.dedupe);
+        Ok(json!(cache.stats()?))
+    }
+
+    /// Browser pages may only call the API from the origin it allows; other
+    /// clients send no `Origin`
+    fn origin_allowed(&self, request: &HttpRequest) -> bool {
+        match (request.header("origin"), self.allow_origin.as_deref()) {
+            (None, _) | (Some(_), Some("*")) => true,
+            (Some(origin), Some(allowed)) => origin == allowed,
+            (Some(_), None) => false,
+        }
+    }
+
+    fn authorized(&self, request: &HttpRequest) -> bool {
+        let Some(token) = &self.token else {
+            return true;
+        };
+        let given = request
+            .header("authorization")
+            .and_then(|value| value.strip_prefix("Bearer "))
+            .unwrap_or_default();
+        token_matches(given, token)
+    }
+
+    /// Runs a submission in its own workspace once the queue has a slot for it
+    async fn run(
+        &self,
+        submission: Submission,
+        events: EventSink,
+        output: Option<OutputTap>,
+        cancel: watch::Receiver<bool>,
+    ) -> Result<ExecutionResult> {
+        let workspace = TempDir::new()?;
+        let script = submission.stage(workspace.path(), &self.registry)?;
+        let _ticket = self.queue.acquire(self.job(&submission, &script)).await;
+        let executor = self.executor(&submission)?.with_events(events).with_output(output);
+        let input = submission.stdin.as_ref().map(|s| s.as_bytes());
+        executor
+            .run_script_with_input(submission.language.as_deref(), &script, false, cancel, input)
+            .await
+    }
+
+    async fn build(&self, submission: Submission) -> Result<serde_json::Value> {
+        let workspace = TempDir::new()?;
+        let script = submission.stage(workspace.path(), &self.registry)?;
+        let _ticket = self.queue.acquire(self.job(&submission, &script)).await;
+        let output = self
+            .executor(&submission)?
+            .build_script(submission.language.as_deref(), &script, None, &workspace.path().join("artifact"))
+            .await?;
+        Ok(json!({
+            "language": output.language,
+            "cached": output.cached,
+            "duration_ms": output.duration_ms,
+            "artifact_sha256": output.provenance.artifact_sha256,
+            "cache_key": output.provenance.cache_key,
+            "size_bytes": std::fs::metadata(&output.artifact)?.len(),
+        }))
+    }
+
+    fn job(&self, submission: &Submission, script: &Path) -> Job {
+        let language = submission.language.clone().or_else(|| {
+            let runner = self.registry.detect(script, submission.source.as_bytes())?;
+            Some(runner.name().to_string())
+        });
+        Job {
+            script: script.to_path_buf(),
+            language,
+            priority: Priority::Normal,
+            supersede: false,
+        }
+    }
+
+    /// An executor within the configured defaults, which submissions can
+    /// lower but not raise. Submissions are staged afresh every time, so the
+    /// state directory they were keyed by would never be used again.
+    fn executor(&self, submission: &Submission) -> Result<Executor> {
+        let config = &self.container_manager.config;
+        let timeout = submission.timeout_secs.unwrap_or(config.default_timeout_secs).clamp(1, config.default_timeout_secs);
+        let memory = submission.memory_mb.unwrap_or(config.default_memory_mb).clamp(32, config.default_memory_mb);
+        let sandbox = SandboxProfile::resolve(&config.default_sandbox, &config.sandbox_profiles)?;
+        Ok(Executor::new(
+            self.container_manager.clone(),
+            Duration::from_secs(timeout),
+            memory * 1024 * 1024,
+            config.default_cpu_limit,
+            config.default_output_limit_kb * 1024,
+        )
+        .with_sandbox(sandbox)
+        .with_env(submission.env.clone().into_iter().collect())
+        .with_run_args(submission.args.clone())
+        .without_state())
+    }
+
+    /// Runs a submission, sending its progress and output as server-sent
+    /// events while it runs and its result as the last event. A client
+    /// that goes away cancels the run.
+    async fn stream_run(&self, stream: &mut TcpStream, submission: Submission) -> std::io::Result<()> {
+        let mut head = String::from(
+            "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\nConnection: close\r\n",
+        );
+        head.push_str(&self.cors_headers());
+        head.push_str("\r\n");
+        stream.write_all(head.as_bytes()).await?;
+
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        let events = {
+            let sender = sender.clone();
+            EventSink::new(move |event: &Event| {
+                let _ = sender.send(sse_frame("progress", &json!(event)));
+            })
+        };
+        let output: OutputTap = Arc::new(move |output_stream, data| {
+            let name = match output_stream {
+                OutputStream::Stdout => "stdout",
+                OutputStream::Stderr => "stderr",
+            };
+            let data = String::from_utf8_lossy(data);
+            let _ = sender.send(sse_frame("output", &json!({ "stream": name, "data": data })));
+        });
+
+        let (cancel, cancelled) = watch::channel(false);
+        let run = self.run(submission, events, Some(output), cancelled);
+        tokio::pin!(run);
+        let mut connected = true;
+        let result = loop {
+            tokio::select! {
+                result = &mut run => break result,
+                Some(frame) = receiver.recv() => {
+                    if connected && stream.write_all(frame.as_bytes()).await.is_err() {
+                        debug!("Client went away, cancelling the run");
+                        connected = false;
+                        let _ = cancel.send(true);
+                    }
+                }
+            }
+        };
+        if !connected {
+            return Ok(());
+        }
+
+        while let Ok(frame) = receiver.try_recv() {
+            stream.write_all(frame.as_bytes()).await?;
+        }
+        let frame = match result {
+            Ok(result) => sse_frame("result", &json!(result)),
+            Err(e) => sse_frame("error", &json!({ "error": e.to_string() })),
+        };
+        stream.write_all(frame.as_bytes()).await?;
+        stream.shutdown().await
+    }
+
+    async fn respond_error(&self, stream: &mut TcpStream, status: &str, error: impl std::fmt::Display) -> std::io::Result<()> {
+        self.respond(stream, status, &json!({ "error": error.to_string() })).await
+    }
+
+    async fn respond(&self, stream: &mut TcpStream, status: &str, body: &serde_json::Value) -> std::io::Result<()> {
+        let body = body.to_string();
+        let response = format!(
+            "HTTP/1.1 {}\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n{}\r\n{}",
+            status,
+            body.len(),
+            self.cors_headers(),
+            body
+        );
+        stream.write_all(response.as_bytes()).await?;
+        stream.shutdown().await
+    }
+
+    async fn respond_empty(&self, stream: &mut TcpStream, status: &str) -> std::io::Result<()> {
+        let response = format!(
+            "HTTP/1.1 {}\r\nContent-Length: 0\r\nConnection: close\r\n{}\r\n",
+            status,
+            self.cors_headers()
+        );
+        stream.write_all(response.as_bytes()).await?;
+        stream.shutdown().await
+    }
+
+    fn cors_headers(&self) -> String {
+        match &self.allow_origin {
+            Some(origin) => format!(
+                "Access-Control-Allow-Origin: {}\r\nAccess-Control-Allow-Methods: GET, POST, OPTIONS\r\nAccess-Control-Allow-Headers: Authorization, Content-Type, Accept\r\n",
+                origin
+            ),
+            None => String::new(),
+        }
+    }
+}
+
+/// Compares a bearer token in full, so the time taken does not tell how
+/// much of it matched
+pub fn token_matches(given: &str, token: &str) -> bool {
+    given.len() == token.len() && given.bytes().zip(token.bytes()).fold(0, |acc, (a, b)| acc | (a ^ b)) == 0
+}
+
+fn parse_submission(request: &HttpRequest) -> Result<Submission, SingleloadError> {
+    serde_json::from_slice(&request.body)
+        .map_err(|e| SingleloadError::InvalidInput(format!("Invalid request body: {}", e)))
+}
+
+/// One server-sent event; `data` is a single line of JSON
+pub fn sse_frame(event: &str, data: &serde_json::Value) -> String {
+    format!("event: {}\ndata: {}\n\n", event, data)
+}
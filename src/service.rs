@@ -0,0 +1,500 @@
+use crate::errors::SingleloadError;
+use crate::platform;
+use chrono::{DateTime, Utc};
+use clap::ValueEnum;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use tracing::{debug, warn};
+
+const META_FILE: &str = "service.json";
+
+/// When the service manager restarts a service's process
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Restart {
+    No,
+    #[default]
+    OnFailure,
+    Always,
+}
+
+impl std::fmt::Display for Restart {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let name = match self {
+            Self::No => "no",
+            Self::OnFailure => "on-failure",
+            Self::Always => "always",
+        };
+        write!(f, "{}", name)
+    }
+}
+
+/// The host's service manager
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Manager {
+    Systemd,
+    Launchd,
+    /// Windows Task Scheduler. SCM services need binaries that implement
+    /// the service control protocol, which script binaries do not, so a
+    /// task started at logon (or boot) supervises them instead.
+    Schtasks,
+}
+
+/// A compiled script installed with `singleload service add`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Service {
+    pub name: String,
+    /// Canonical path of the script it was built from
+    pub script: PathBuf,
+    pub language: String,
+    pub binary: PathBuf,
+    pub args: Vec<String>,
+    pub env: Vec<(String, String)>,
+    pub working_dir: PathBuf,
+    pub restart: Restart,
+    pub manager: Manager,
+    /// Installed system-wide rather than for the current user
+    pub system: bool,
+    /// The unit file, plist or task definition that was written
+    pub unit: PathBuf,
+    pub installed_at: DateTime<Utc>,
+}
+
+/// Binaries and metadata of installed services, one directory each
+#[derive(Debug, Clone)]
+pub struct ServiceStore {
+    root: PathBuf,
+}
+
+impl ServiceStore {
+    pub fn new(root: PathBuf) -> Self {
+        Self { root }
+    }
+
+    /// Default location, `~/.singleload/services` (`%LOCALAPPDATA%\singleload\services` on Windows)
+    pub fn default_root() -> PathBuf {
+        platform::data_dir().join("services")
+    }
+
+    /// Service names end up in unit file names, so they follow the same
+    /// rules as installed tools
+    pub fn validate_name(name: &str) -> Result<(), SingleloadError> {
+        let valid = !name.is_empty()
+            && !name.starts_with(['.', '-'])
+            && name.len() <= 64
+            && name.chars().all(|c| c.is_ascii_alphanumeric() || matches!(c, '.' | '_' | '-'));
+        if !valid {
+            return Err(SingleloadError::InvalidInput(format!("Invalid service name '{}'", name)));
+        }
+        Ok(())
+    }
+
+    pub fn dir(&self, name: &str) -> PathBuf {
+        self.root.join(name)
+    }
+
+    /// Where the service's binary is built to
+    pub fn binary_path(&self, name: &str) -> PathBuf {
+        self.dir(name).join(format!("{}{}", name, std::env::consts::EXE_SUFFIX))
+    }
+
+    pub fn get(&self, name: &str) -> Result<Option<Service>, SingleloadError> {
+        Self::validate_name(name)?;
+        let path = self.dir(name).join(META_FILE);
+        if !path.is_file() {
+            return Ok(None);
+        }
+        Ok(Some(serde_json::from_slice(&std::fs::read(path)?)?))
+    }
+
+    pub fn record(&self, service: &Service) -> Result<(), SingleloadError> {
+        std::fs::create_dir_all(self.dir(&service.name))?;
+        std::fs::write(self.dir(&service.name).join(META_FILE), serde_json::to_vec_pretty(service)?)?;
+        debug!("Recorded service {}", service.name);
+        Ok(())
+    }
+
+    pub fn list(&self) -> Result<Vec<Service>, SingleloadError> {
+        let mut services = vec![];
+        if !self.root.exists() {
+            return Ok(services);
+        }
+
+        for entry in std::fs::read_dir(&self.root)? {
+            let path = entry?.path().join(META_FILE);
+            if let Ok(data) = std::fs::read(&path) {
+                if let Ok(service) = serde_json::from_slice::<Service>(&data) {
+                    services.push(service);
+                }
+            }
+        }
+
+        services.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(services)
+    }
+
+    /// Removes the service's binary, logs and metadata
+    pub fn remove(&self, name: &str) -> Result<(), SingleloadError> {
+        Self::validate_name(name)?;
+        if self.dir(name).exists() {
+            std::fs::remove_dir_all(self.dir(name))?;
+        }
+        Ok(())
+    }
+}
+
+impl Manager {
+    pub fn host() -> Result<Self, SingleloadError> {
+        match std::env::consts::OS {
+            "linux" => Ok(Self::Systemd),
+            "macos" => Ok(Self::Launchd),
+            "windows" => Ok(Self::Schtasks),
+            os => Err(SingleloadError::ServiceManager(format!("No supported service manager on {}", os))),
+        }
+    }
+
+    /// Name the service manager knows the service by
+    pub fn unit_name(self, name: &str) -> String {
+        match self {
+            Self::Systemd => format!("singleload-{}.service", name),
+            Self::Launchd => format!("dev.singleload.{}", name),
+            Self::Schtasks => format!(r"singleload\{}", name),
+        }
+    }
+
+    /// Where the unit is written. Scheduled tasks are registered from a
+    /// definition kept with the binary in `service_dir`.
+    pub fn unit_path(self, name: &str, system: bool, service_dir: &Path) -> PathBuf {
+        match (self, system) {
+            (Self::Systemd, true) => PathBuf::from("/etc/systemd/system").join(self.unit_name(name)),
+            (Self::Systemd, false) => {
+                let config = std::env::var_os("XDG_CONFIG_HOME")
+                    .filter(|d| !d.is_empty())
+                    .map(PathBuf::from)
+                    .unwrap_or_else(|| platform::home_dir().join(".config"));
+                config.join("systemd/user").join(self.unit_name(name))
+            }
+            (Self::Launchd, true) => PathBuf::from("/Library/LaunchDaemons").join(format!("{}.plist", self.unit_name(name))),
+            (Self::Launchd, false) => platform::home_dir()
+                .join("Library/LaunchAgents")
+                .join(format!("{}.plist", self.unit_name(name))),
+            (Self::Schtasks, _) => service_dir.join("task.xml"),
+        }
+    }
+
+    /// The unit file for `service`
+    pub fn render(self, service: &Service) -> Result<String, SingleloadError> {
+        match self {
+            Self::Systemd => Ok(systemd_unit(service)),
+            Self::Launchd => Ok(launchd_plist(service)),
+            Self::Schtasks => task_xml(service),
+        }
+    }
+
+    /// The unit file as it is written to disk
+    pub fn encode(self, unit: &str) -> Vec<u8> {
+        match self {
+            // schtasks only reads task definitions in UTF-16
+            Self::Schtasks => {
+                let mut bytes = vec![0xFF, 0xFE];
+                bytes.extend(unit.encode_utf16().flat_map(|unit| unit.to_le_bytes()));
+                bytes
+            }
+            _ => unit.as_bytes().to_vec(),
+        }
+    }
+
+    /// Commands that register the written unit and, with `start`, start it
+    pub fn activate(self, service: &Service, start: bool) -> Vec<Vec<String>> {
+        let unit = self.unit_name(&service.name);
+        let mut commands = self.reload(service.system);
+        match self {
+            Self::Systemd => {
+                let mut enable = systemctl(service.system, &["enable"]);
+                if start {
+                    enable.push("--now".to_string());
+                }
+                enable.push(unit);
+                commands.push(enable);
+            }
+            // Loading a plist with RunAtLoad starts it
+            Self::Launchd if start => commands.push(args(&["launchctl", "load", "-w", &service.unit.to_string_lossy()])),
+            Self::Launchd => {}
+            Self::Schtasks => {
+                commands.push(args(&["schtasks", "/Create", "/TN", &unit, "/XML", &service.unit.to_string_lossy(), "/F"]));
+                if start {
+                    commands.push(args(&["schtasks", "/Run", "/TN", &unit]));
+                }
+            }
+        }
+        commands
+    }
+
+    /// Commands that stop the service and unregister it, before its unit
+    /// file is removed
+    pub fn deactivate(self, service: &Service) -> Vec<Vec<String>> {
+        let unit = self.unit_name(&service.name);
+        match self {
+            Self::Systemd => {
+                let mut disable = systemctl(service.system, &["disable", "--now"]);
+                disable.push(unit);
+                vec![disable]
+            }
+            Self::Launchd => vec![args(&["launchctl", "unload", "-w", &service.unit.to_string_lossy()])],
+            Self::Schtasks => vec![
+                args(&["schtasks", "/End", "/TN", &unit]),
+                args(&["schtasks", "/Delete", "/TN", &unit, "/F"]),
+            ],
+        }
+    }
+
+    /// Commands that make the manager notice added or removed unit files
+    pub fn reload(self, system: bool) -> Vec<Vec<String>> {
+        match self {
+            Self::Systemd => vec![systemctl(system, &["daemon-reload"])],
+            _ => vec![],
+        }
+    }
+}
+
+impl std::fmt::Display for Manager {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let name = match self {
+            Self::Systemd => "systemd",
+            Self::Launchd => "launchd",
+            Self::Schtasks => "Task Scheduler",
+        };
+        write!(f, "{}", name)
+    }
+}
+
+/// Runs service manager commands in order. With `strict`, the first one to
+/// fail stops the sequence; otherwise failures are only logged, for
+/// teardown of services that may already be stopped.
+pub fn run_commands(commands: &[Vec<String>], strict: bool) -> Result<(), SingleloadError> {
+    for command in commands {
+        let Some((program, rest)) = command.split_first() else {
+            continue;
+        };
+        debug!("Running {}", command.join(" "));
+        let output = std::process::Command::new(program).args(rest).output().map_err(|e| {
+            SingleloadError::ServiceManager(format!("Could not run {}: {}", program, e))
+        })?;
+        if !output.status.success() {
+            let message = format!(
+                "'{}' failed: {}",
+                command.join(" "),
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+            if strict {
+                return Err(SingleloadError::ServiceManager(message));
+            }
+            warn!("{}", message);
+        }
+    }
+    Ok(())
+}
+
+/// systemd unit running the binary directly
+pub fn systemd_unit(service: &Service) -> String {
+    let exec = std::iter::once(service.binary.to_string_lossy().to_string())
+        .chain(service.args.iter().cloned())
+        .map(|arg| systemd_quote(&arg))
+        .collect::<Vec<_>>()
+        .join(" ");
+
+    let mut unit = format!(
+        "# Installed by singleload from {}\n\
+         [Unit]\n\
+         Description={} (singleload service)\n\
+         After=network-online.target\n\
+         Wants=network-online.target\n\
+         \n\
+         [Service]\n\
+         Type=simple\n\
+         ExecStart={}\n\
+         WorkingDirectory={}\n\
+         Restart={}\n\
+         RestartSec=1\n",
+        service.script.display(),
+        service.name,
+        exec,
+        systemd_escape(&service.working_dir.to_string_lossy()),
+        service.restart
+    );
+    for (key, value) in &service.env {
+        unit.push_str(&format!("Environment={}\n", systemd_quote(&format!("{}={}", key, value))));
+    }
+    let target = if service.system { "multi-user.target" } else { "default.target" };
+    unit.push_str(&format!("\n[Install]\nWantedBy={}\n", target));
+    unit
+}
+
+/// launchd property list; output goes to log files next to the binary
+pub fn launchd_plist(service: &Service) -> String {
+    let dir = service.binary.parent().unwrap_or(Path::new("/"));
+    let program: String = std::iter::once(service.binary.to_string_lossy().to_string())
+        .chain(service.args.iter().cloned())
+        .map(|arg| format!("        <string>{}</string>\n", xml_escape(&arg)))
+        .collect();
+    let keep_alive = match service.restart {
+        Restart::No => "<false/>".to_string(),
+        Restart::OnFailure => "<dict>\n        <key>SuccessfulExit</key>\n        <false/>\n    </dict>".to_string(),
+        Restart::Always => "<true/>".to_string(),
+    };
+
+    let mut plist = format!(
+        "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n\
+         <!DOCTYPE plist PUBLIC \"-//Apple//DTD PLIST 1.0//EN\" \"http://www.apple.com/DTDs/PropertyList-1.0.dtd\">\n\
+         <!-- Installed by singleload from {} -->\n\
+         <plist version=\"1.0\">\n\
+         <dict>\n    \
+         <key>Label</key>\n    <string>{}</string>\n    \
+         <key>ProgramArguments</key>\n    <array>\n{}    </array>\n    \
+         <key>WorkingDirectory</key>\n    <string>{}</string>\n    \
+         <key>RunAtLoad</key>\n    <true/>\n    \
+         <key>KeepAlive</key>\n    {}\n    \
+         <key>StandardOutPath</key>\n    <string>{}</string>\n    \
+         <key>StandardErrorPath</key>\n    <string>{}</string>\n",
+        xml_escape(&service.script.to_string_lossy()),
+        Manager::Launchd.unit_name(&service.name),
+        program,
+        xml_escape(&service.working_dir.to_string_lossy()),
+        keep_alive,
+        xml_escape(&dir.join("stdout.log").to_string_lossy()),
+        xml_escape(&dir.join("stderr.log").to_string_lossy())
+    );
+    if !service.env.is_empty() {
+        plist.push_str("    <key>EnvironmentVariables</key>\n    <dict>\n");
+        for (key, value) in &service.env {
+            plist.push_str(&format!(
+                "        <key>{}</key>\n        <string>{}</string>\n",
+                xml_escape(key),
+                xml_escape(value)
+            ));
+        }
+        plist.push_str("    </dict>\n");
+    }
+    plist.push_str("</dict>\n</plist>\n");
+    plist
+}
+
+/// Task Scheduler definition starting the binary at logon (at boot for
+/// system services). Tasks cannot be restarted after a successful exit, so
+/// `always` behaves like `on-failure`, and they have no environment of
+/// their own.
+pub fn task_xml(service: &Service) -> Result<String, SingleloadError> {
+    if !service.env.is_empty() {
+        return Err(SingleloadError::InvalidInput(
+            "Scheduled tasks cannot set environment variables; read them from a file instead".to_string(),
+        ));
+    }
+
+    let (trigger, principal) = if service.system {
+        (
+            "<BootTrigger><Enabled>true</Enabled></BootTrigger>",
+            "<UserId>S-1-5-18</UserId><RunLevel>HighestAvailable</RunLevel>",
+        )
+    } else {
+        (
+            "<LogonTrigger><Enabled>true</Enabled></LogonTrigger>",
+            "<LogonType>InteractiveToken</LogonType><RunLevel>LeastPrivilege</RunLevel>",
+        )
+    };
+    let restart = match service.restart {
+        Restart::No => "",
+        Restart::OnFailure | Restart::Always => {
+            "\n    <RestartOnFailure><Interval>PT1M</Interval><Count>999</Count></RestartOnFailure>"
+        }
+    };
+    let arguments = service.args.iter().map(|arg| windows_quote(arg)).collect::<Vec<_>>().join(" ");
+
+    Ok(format!(
+        "<?xml version=\"1.0\" encoding=\"UTF-16\"?>\n\
+         <Task version=\"1.2\" xmlns=\"http://schemas.microsoft.com/windows/2004/02/mit/task\">\n  \
+         <RegistrationInfo><Description>{} (installed by singleload from {})</Description></RegistrationInfo>\n  \
+         <Triggers>{}</Triggers>\n  \
+         <Principals><Principal id=\"Author\">{}</Principal></Principals>\n  \
+         <Settings>\n    \
+         <MultipleInstancesPolicy>IgnoreNew</MultipleInstancesPolicy>\n    \
+         <DisallowStartIfOnBatteries>false</DisallowStartIfOnBatteries>\n    \
+         <StopIfGoingOnBatteries>false</StopIfGoingOnBatteries>\n    \
+         <ExecutionTimeLimit>PT0S</ExecutionTimeLimit>{}\n  \
+         </Settings>\n  \
+         <Actions Context=\"Author\">\n    \
+         <Exec><Command>{}</Command><Arguments>{}</Arguments><WorkingDirectory>{}</WorkingDirectory></Exec>\n  \
+         </Actions>\n\
+         </Task>\n",
+        xml_escape(&service.name),
+        xml_escape(&service.script.to_string_lossy()),
+        trigger,
+        principal,
+        restart,
+        xml_escape(&service.binary.to_string_lossy()),
+        xml_escape(&arguments),
+        xml_escape(&service.working_dir.to_string_lossy())
+    ))
+}
+
+fn systemctl(system: bool, rest: &[&str]) -> Vec<String> {
+    let mut command = vec!["systemctl".to_string()];
+    if !system {
+        command.push("--user".to_string());
+    }
+    command.extend(rest.iter().map(|s| s.to_string()));
+    command
+}
+
+fn args(parts: &[&str]) -> Vec<String> {
+    parts.iter().map(|s| s.to_string()).collect()
+}
+
+/// Escapes systemd's `%` specifiers and `$` variable expansion
+fn systemd_escape(value: &str) -> String {
+    value.replace('%', "%%").replace('$', "$$")
+}
+
+/// Quotes a word of a systemd command line or assignment
+fn systemd_quote(value: &str) -> String {
+    let escaped = systemd_escape(value);
+    if !escaped.is_empty() && !escaped.contains(|c: char| c.is_whitespace() || "\"'\\;".contains(c)) {
+        return escaped;
+    }
+    format!("\"{}\"", escaped.replace('\\', "\\\\").replace('"', "\\\""))
+}
+
+/// Quotes an argument the way the Windows C runtime splits command lines
+fn windows_quote(value: &str) -> String {
+    if !value.is_empty() && !value.contains(|c: char| c.is_whitespace() || c == '"') {
+        return value.to_string();
+    }
+    let mut quoted = String::from("\"");
+    let mut backslashes = 0;
+    for c in value.chars() {
+        match c {
+            '\\' => backslashes += 1,
+            '"' => {
+                quoted.push_str(&"\\".repeat(backslashes * 2 + 1));
+                quoted.push('"');
+                backslashes = 0;
+            }
+            _ => {
+                quoted.push_str(&"\\".repeat(backslashes));
+                quoted.push(c);
+                backslashes = 0;
+            }
+        }
+    }
+    quoted.push_str(&"\\".repeat(backslashes * 2));
+    quoted.push('"');
+    quoted
+}
+
+fn xml_escape(value: &str) -> String {
+    value
+        .replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
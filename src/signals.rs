@@ -0,0 +1,153 @@
+use std::time::Duration;
+use tokio::sync::broadcast;
+use tracing::debug;
+
+/// How long a script may take to exit after a forwarded signal before it is killed
+pub const DEFAULT_KILL_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// A signal the wrapper received and passes on to the script
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Signal {
+    /// SIGINT, Ctrl-C in a Windows console
+    Interrupt,
+    /// SIGTERM, Ctrl-Break or closing the console window on Windows
+    Terminate,
+}
+
+impl Signal {
+    /// Name podman's kill endpoint takes
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Interrupt => "SIGINT",
+            Self::Terminate => "SIGTERM",
+        }
+    }
+
+    pub fn number(self) -> i32 {
+        match self {
+            Self::Interrupt => 2,
+            Self::Terminate => 15,
+        }
+    }
+}
+
+/// Catches SIGINT and SIGTERM (console events on Windows) so that they
+/// reach the running container instead of ending the wrapper, which would
+/// leave the container behind. A signal that arrives while no container
+/// runs ends the wrapper as if it had not been caught.
+#[derive(Debug, Clone)]
+pub struct SignalProxy {
+    sender: broadcast::Sender<Signal>,
+    kill_timeout: Duration,
+}
+
+impl SignalProxy {
+    pub fn install(kill_timeout: Duration) -> std::io::Result<Self> {
+        let (sender, _) = broadcast::channel(16);
+        let mut signals = platform_signals()?;
+        let forward = sender.clone();
+        tokio::spawn(async move {
+            while let Some(signal) = signals.recv().await {
+                if forward.send(signal).is_err() {
+                    debug!("{} received with no container running", signal.name());
+                    terminate(signal.number() + 128);
+                }
+            }
+        });
+        Ok(Self { sender, kill_timeout })
+    }
+
+    /// Signals received from now on
+    pub fn subscribe(&self) -> broadcast::Receiver<Signal> {
+        self.sender.subscribe()
+    }
+
+    /// Time between the first forwarded signal and SIGKILL
+    pub fn kill_timeout(&self) -> Duration {
+        self.kill_timeout
+    }
+}
+
+#[cfg(unix)]
+struct PlatformSignals {
+    interrupt: tokio::signal::unix::Signal,
+    terminate: tokio::signal::unix::Signal,
+}
+
+#[cfg(unix)]
+fn platform_signals() -> std::io::Result<PlatformSignals> {
+    use tokio::signal::unix::{signal, SignalKind};
+    Ok(PlatformSignals {
+        interrupt: signal(SignalKind::interrupt())?,
+        terminate: signal(SignalKind::terminate())?,
+    })
+}
+
+#[cfg(unix)]
+impl PlatformSignals {
+    async fn recv(&mut self) -> Option<Signal> {
+        tokio::select! {
+            received = self.interrupt.recv() => received.map(|_| Signal::Interrupt),
+            received = self.terminate.recv() => received.map(|_| Signal::Terminate),
+        }
+    }
+}
+
+#[cfg(windows)]
+struct PlatformSignals {
+    ctrl_c: tokio::signal::windows::CtrlC,
+    ctrl_break: tokio::signal::windows::CtrlBreak,
+    ctrl_close: tokio::signal::windows::CtrlClose,
+}
+
+#[cfg(windows)]
+fn platform_signals() -> std::io::Result<PlatformSignals> {
+    use tokio::signal::windows;
+    Ok(PlatformSignals {
+        ctrl_c: windows::ctrl_c()?,
+        ctrl_break: windows::ctrl_break()?,
+        ctrl_close: windows::ctrl_close()?,
+    })
+}
+
+#[cfg(windows)]
+impl PlatformSignals {
+    async fn recv(&mut self) -> Option<Signal> {
+        tokio::select! {
+            received = self.ctrl_c.recv() => received.map(|_| Signal::Interrupt),
+            received = self.ctrl_break.recv() => received.map(|_| Signal::Terminate),
+            received = self.ctrl_close.recv() => received.map(|_| Signal::Terminate),
+        }
+    }
+}
+
+/// Signal that ended a script, from its exit code: container runtimes
+/// report death by signal N as 128 + N, like shells do
+pub fn exit_signal(exit_code: i32) -> Option<i32> {
+    match exit_code - 128 {
+        // SIGHUP, SIGINT, SIGKILL and SIGTERM; signals that dump core are
+        // left as exit codes so the wrapper does not dump core too
+        signal @ (1 | 2 | 9 | 15) => Some(signal),
+        _ => None,
+    }
+}
+
+/// Exits with the script's exit code. A script ended by a signal ends the
+/// wrapper with the same signal, so a calling shell sees what happened,
+/// e.g. a loop stops on Ctrl-C.
+pub fn terminate(exit_code: i32) -> ! {
+    use std::io::Write;
+    let _ = std::io::stdout().flush();
+    #[cfg(unix)]
+    if let Some(number) = exit_signal(exit_code) {
+        use nix::sys::signal::{raise, signal, SigHandler, Signal as UnixSignal};
+        if let Ok(unix_signal) = UnixSignal::try_from(number) {
+            // SAFETY: the process exits right after, nothing relies on the handler
+            unsafe {
+                let _ = signal(unix_signal, SigHandler::SigDfl);
+            }
+            let _ = raise(unix_signal);
+        }
+    }
+    std::process::exit(exit_code)
+}
@@ -0,0 +1,104 @@
+use crate::errors::SingleloadError;
+use base64::engine::general_purpose::STANDARD as BASE64;
+use base64::Engine;
+use ed25519_dalek::pkcs8::{DecodePrivateKey, DecodePublicKey};
+use ed25519_dalek::{Signature, Signer, SigningKey, VerifyingKey};
+use std::path::{Path, PathBuf};
+
+const SIGNATURE_COMMENT: &str = "untrusted comment: singleload ed25519 signature";
+
+/// Detached signature of a script: `tool.go` -> `tool.go.sig`
+pub fn signature_path(script: &Path) -> PathBuf {
+    let mut name = script.file_name().unwrap_or_default().to_os_string();
+    name.push(".sig");
+    script.with_file_name(name)
+}
+
+/// Reads an ed25519 private key in PKCS#8 PEM form, as written by
+/// `openssl genpkey -algorithm ed25519`
+pub fn load_signing_key(path: &Path) -> Result<SigningKey, SingleloadError> {
+    let der = read_pem(path, "PRIVATE KEY")?;
+    SigningKey::from_pkcs8_der(&der).map_err(|e| {
+        SingleloadError::InvalidInput(format!("{} is not an ed25519 private key: {}", path.display(), e))
+    })
+}
+
+/// Reads an ed25519 public key in SubjectPublicKeyInfo PEM form, as written
+/// by `openssl pkey -pubout`
+pub fn load_verifying_key(path: &Path) -> Result<VerifyingKey, SingleloadError> {
+    let der = read_pem(path, "PUBLIC KEY")?;
+    VerifyingKey::from_public_key_der(&der).map_err(|e| {
+        SingleloadError::InvalidInput(format!("{} is not an ed25519 public key: {}", path.display(), e))
+    })
+}
+
+/// Parses an ed25519 public key given inline as PEM, as some configuration
+/// files do instead of naming a file
+pub fn parse_verifying_key(pem: &str) -> Result<VerifyingKey, SingleloadError> {
+    let invalid = || SingleloadError::InvalidInput("not an ed25519 public key in PEM form".to_string());
+    let der = pem_der(pem, "PUBLIC KEY").ok_or_else(invalid)?;
+    VerifyingKey::from_public_key_der(&der).map_err(|_| invalid())
+}
+
+/// Signs `content` and returns the signature file contents
+pub fn sign(content: &[u8], key: &SigningKey) -> String {
+    let signature = key.sign(content);
+    format!("{}\n{}\n", SIGNATURE_COMMENT, BASE64.encode(signature.to_bytes()))
+}
+
+/// Checks `content` against a signature file written by [`sign`]
+pub fn verify(content: &[u8], signature_file: &str, key: &VerifyingKey) -> Result<(), SingleloadError> {
+    let encoded = signature_file
+        .lines()
+        .map(str::trim)
+        .find(|line| !line.is_empty() && !line.starts_with("untrusted comment:"))
+        .ok_or_else(|| SingleloadError::SecurityViolation("Signature file is empty".to_string()))?;
+    let bytes = BASE64
+        .decode(encoded)
+        .map_err(|_| SingleloadError::SecurityViolation("Signature is not valid base64".to_string()))?;
+    let signature = Signature::from_slice(&bytes)
+        .map_err(|_| SingleloadError::SecurityViolation("Signature has the wrong length".to_string()))?;
+
+    key.verify_strict(content, &signature)
+        .map_err(|_| SingleloadError::SecurityViolation("Signature does not match the script".to_string()))
+}
+
+/// Verifies a script on disk against its detached `.sig` file
+pub fn verify_file(script: &Path, content: &[u8], key: &VerifyingKey) -> Result<(), SingleloadError> {
+    let sig_path = signature_path(script);
+    let signature = std::fs::read_to_string(&sig_path).map_err(|_| {
+        SingleloadError::SecurityViolation(format!(
+            "{} is not signed: {} not found",
+            script.display(),
+            sig_path.display()
+        ))
+    })?;
+    verify(content, &signature, key).map_err(|e| match e {
+        SingleloadError::SecurityViolation(msg) => {
+            SingleloadError::SecurityViolation(format!("{}: {}", script.display(), msg))
+        }
+        other => other,
+    })
+}
+
+fn read_pem(path: &Path, label: &str) -> Result<Vec<u8>, SingleloadError> {
+    let text = std::fs::read_to_string(path)?;
+    if !text.contains(&format!("-----BEGIN {}-----", label)) {
+        return Err(SingleloadError::InvalidInput(format!(
+            "{} does not contain a PEM {}",
+            path.display(),
+            label
+        )));
+    }
+    pem_der(&text, label)
+        .ok_or_else(|| SingleloadError::InvalidInput(format!("{} has invalid PEM data", path.display())))
+}
+
+/// The DER bytes of the first `label` block in `text`
+fn pem_der(text: &str, label: &str) -> Option<Vec<u8>> {
+    let begin = format!("-----BEGIN {}-----", label);
+    let end = format!("-----END {}-----", label);
+    let (body, _) = text.split_once(&begin)?.1.split_once(&end)?;
+    let body: String = body.chars().filter(|c| !c.is_whitespace()).collect();
+    BASE64.decode(body).ok()
+}
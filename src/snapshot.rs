@@ -0,0 +1,138 @@
+use crate::cache::GcReport;
+use crate::errors::SingleloadError;
+use crate::lockfile::Lockfile;
+use crate::platform;
+use crate::remote_cache::{pack, unpack};
+use chrono::{DateTime, Utc};
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+use std::path::{Path, PathBuf};
+use tracing::debug;
+
+/// Languages whose environments (site-packages, node_modules) are snapshotted
+pub const SNAPSHOT_LANGUAGES: &[&str] = &["python", "javascript", "typescript"];
+
+const SNAPSHOT_EXTENSION: &str = ".tar.gz";
+
+/// Compressed copies of fully installed interpreter environments, keyed by
+/// the lockfile they were installed from. Unlike build cache entries they
+/// are not trimmed to the cache budget, so a locked script whose
+/// dependencies were evicted gets them back without running pip or npm.
+#[derive(Debug, Clone)]
+pub struct SnapshotStore {
+    root: PathBuf,
+}
+
+/// A snapshot as listed by `cache snapshots`
+#[derive(Debug, Serialize)]
+pub struct Snapshot {
+    pub key: String,
+    pub language: String,
+    pub size_bytes: u64,
+    pub created_at: Option<DateTime<Utc>>,
+}
+
+impl SnapshotStore {
+    pub fn new(root: PathBuf) -> Self {
+        Self { root }
+    }
+
+    /// Default location, `~/.singleload/snapshots` (`%LOCALAPPDATA%\singleload\snapshots` on Windows)
+    pub fn default_root() -> PathBuf {
+        platform::data_dir().join("snapshots")
+    }
+
+    pub fn root(&self) -> &Path {
+        &self.root
+    }
+
+    /// Key of the environment `lock` resolves to on a toolchain. The lock's
+    /// packages and their checksums are hashed, not the declarations, so two
+    /// scripts with the same lock share a snapshot.
+    pub fn key(language: &str, toolchain: &str, lock: &Lockfile) -> String {
+        let mut hasher = Sha256::new();
+        hasher.update(language.as_bytes());
+        hasher.update([0u8]);
+        hasher.update(toolchain.as_bytes());
+        for package in &lock.packages {
+            hasher.update([0u8]);
+            hasher.update(package.name.as_bytes());
+            hasher.update([0u8]);
+            hasher.update(package.version.as_bytes());
+            hasher.update([0u8]);
+            hasher.update(package.hash.as_deref().unwrap_or_default().as_bytes());
+        }
+        hex::encode(hasher.finalize())
+    }
+
+    pub fn supports(language: &str) -> bool {
+        SNAPSHOT_LANGUAGES.contains(&language)
+    }
+
+    pub fn path(&self, language: &str, key: &str) -> PathBuf {
+        self.root.join(format!("{}-{}{}", language, key, SNAPSHOT_EXTENSION))
+    }
+
+    /// Unpacks the snapshot stored under `key` into `dir`. Returns false when
+    /// there is none.
+    pub fn restore(&self, language: &str, key: &str, dir: &Path) -> Result<bool, SingleloadError> {
+        let archive = match std::fs::read(self.path(language, key)) {
+            Ok(archive) => archive,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(false),
+            Err(e) => return Err(e.into()),
+        };
+        unpack(&archive, dir)?;
+        debug!("Restored {} environment snapshot {}", language, key);
+        Ok(true)
+    }
+
+    /// Stores the environment installed in `dir` under `key`, keeping an
+    /// existing snapshot since it holds the same packages
+    pub fn save(&self, language: &str, key: &str, dir: &Path) -> Result<(), SingleloadError> {
+        let path = self.path(language, key);
+        if path.exists() {
+            return Ok(());
+        }
+        std::fs::create_dir_all(&self.root)?;
+        // Written aside and renamed, so a concurrent restore never sees half an archive
+        let partial = tempfile::NamedTempFile::new_in(&self.root)?;
+        std::fs::write(partial.path(), pack(dir)?)?;
+        partial.persist(&path).map_err(|e| SingleloadError::Io(e.error))?;
+        debug!("Saved {} environment snapshot {}", language, key);
+        Ok(())
+    }
+
+    pub fn list(&self) -> Result<Vec<Snapshot>, SingleloadError> {
+        let mut snapshots = Vec::new();
+        if !self.root.exists() {
+            return Ok(snapshots);
+        }
+        for entry in std::fs::read_dir(&self.root)? {
+            let entry = entry?;
+            let name = entry.file_name().to_string_lossy().to_string();
+            let Some((language, key)) = name.strip_suffix(SNAPSHOT_EXTENSION).and_then(|n| n.rsplit_once('-')) else {
+                continue;
+            };
+            let metadata = entry.metadata()?;
+            snapshots.push(Snapshot {
+                key: key.to_string(),
+                language: language.to_string(),
+                size_bytes: metadata.len(),
+                created_at: metadata.modified().ok().map(DateTime::<Utc>::from),
+            });
+        }
+        snapshots.sort_by(|a, b| b.created_at.cmp(&a.created_at));
+        Ok(snapshots)
+    }
+
+    /// Removes every snapshot
+    pub fn clear(&self) -> Result<GcReport, SingleloadError> {
+        let mut report = GcReport::default();
+        for snapshot in self.list()? {
+            std::fs::remove_file(self.path(&snapshot.language, &snapshot.key))?;
+            report.removed += 1;
+            report.freed_bytes += snapshot.size_bytes;
+        }
+        Ok(report)
+    }
+}
@@ -0,0 +1,52 @@
+use sha2::{Digest, Sha256};
+use std::borrow::Cow;
+use std::path::{Path, PathBuf};
+
+/// Path argument that reads the program from stdin
+pub const STDIN_PATH: &str = "-";
+
+/// Name of the interpreter a `#!` line invokes: `python3` for both
+/// `#!/usr/bin/python3` and `#!/usr/bin/env -S python3 -u`
+pub fn shebang_interpreter(content: &[u8]) -> Option<String> {
+    if !content.starts_with(b"#!") || content.starts_with(b"#![") {
+        return None;
+    }
+    let end = content.iter().position(|&b| b == b'\n').unwrap_or(content.len());
+    let line = String::from_utf8_lossy(&content[2..end]);
+
+    let mut words = line.split_whitespace();
+    let mut program = words.next()?;
+    if program.rsplit('/').next() == Some("env") {
+        program = words.find(|w| !w.starts_with('-') && !w.contains('='))?;
+    }
+    program.rsplit('/').next().map(|name| name.to_string())
+}
+
+/// Replaces a leading `#!` line with an empty line.
+///
+/// Most toolchains reject a shebang, but the line must stay so compiler
+/// errors keep pointing at the right line of the original file. Rust inner
+/// attributes (`#![...]`) are left untouched.
+pub fn strip_shebang(content: &[u8]) -> Cow<'_, [u8]> {
+    if !content.starts_with(b"#!") || content.starts_with(b"#![") {
+        return Cow::Borrowed(content);
+    }
+
+    match content.iter().position(|&b| b == b'\n') {
+        Some(newline) => Cow::Owned(content[newline..].to_vec()),
+        None => Cow::Owned(Vec::new()),
+    }
+}
+
+/// Saves a program read from stdin as `<dir>/<sha256>/stdin<extension>`.
+/// The same program always gets the same path, so reruns share its
+/// lockfile and state like a script on disk would.
+pub fn save_stdin_program(dir: &Path, content: &[u8], extension: &str) -> std::io::Result<PathBuf> {
+    let dir = dir.join(hex::encode(Sha256::digest(content)));
+    std::fs::create_dir_all(&dir)?;
+    let path = dir.join(format!("stdin{}", extension));
+    if std::fs::read(&path).ok().as_deref() != Some(content) {
+        std::fs::write(&path, content)?;
+    }
+    Ok(path)
+}
@@ -0,0 +1,90 @@
+use regex::{Captures, Regex};
+use std::path::{Path, PathBuf};
+
+/// One staged file: the paths toolchains may print for it and the file it
+/// came from
+#[derive(Debug, Clone)]
+struct Entry {
+    /// Container paths of the staged copy, e.g. `/workspace/script.go` and
+    /// the `/tmp/module/script.go` copy a Go module build compiles
+    aliases: Vec<String>,
+    original: PathBuf,
+}
+
+/// Translates compiler and interpreter output that refers to staged copies
+/// of a script (temp workspace, synthesized module or project) back to the
+/// user's files. Staged copies keep the original's lines, so the locations
+/// toolchains print (`path:line[:col]`, `path(line,col)`, `File "path",
+/// line N`, ...) only need their path replaced.
+#[derive(Debug, Clone, Default)]
+pub struct SourceMap {
+    entries: Vec<Entry>,
+}
+
+impl SourceMap {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Maps `container_path` (and the `./name` form toolchains print for
+    /// files in their working directory) back to `original`
+    pub fn add(&mut self, container_path: &str, original: &Path) {
+        let mut aliases = vec![container_path.to_string()];
+        if let Some(name) = Path::new(container_path).file_name().and_then(|n| n.to_str()) {
+            aliases.push(format!("./{}", name));
+        }
+        self.entries.push(Entry {
+            aliases,
+            original: original.to_path_buf(),
+        });
+    }
+
+    /// Adds another path the staged copy of `container_path` is known under
+    pub fn alias(&mut self, container_path: &str, alias: &str) {
+        if let Some(entry) = self.entry_mut(container_path) {
+            entry.aliases.push(alias.to_string());
+            if let Some(name) = Path::new(alias).file_name().and_then(|n| n.to_str()) {
+                entry.aliases.push(format!("./{}", name));
+            }
+        }
+    }
+
+    /// Host files the map points to
+    pub fn originals(&self) -> impl Iterator<Item = &Path> {
+        self.entries.iter().map(|e| e.original.as_path())
+    }
+
+    /// Rewrites paths in `text`
+    pub fn translate(&self, text: &str) -> String {
+        if self.entries.is_empty() {
+            return text.to_string();
+        }
+
+        // Longest aliases first so /tmp/module/x.go wins over ./x.go
+        let mut aliases: Vec<(&str, &Entry)> = self
+            .entries
+            .iter()
+            .flat_map(|e| e.aliases.iter().map(move |a| (a.as_str(), e)))
+            .collect();
+        aliases.sort_by_key(|(alias, _)| std::cmp::Reverse(alias.len()));
+        aliases.dedup_by(|a, b| a.0 == b.0);
+
+        let pattern = aliases.iter().map(|(alias, _)| regex::escape(alias)).collect::<Vec<_>>().join("|");
+        let re = match Regex::new(&pattern) {
+            Ok(re) => re,
+            Err(_) => return text.to_string(),
+        };
+
+        re.replace_all(text, |caps: &Captures| match aliases.iter().find(|(alias, _)| *alias == &caps[0]) {
+            Some((_, entry)) => entry.original.display().to_string(),
+            None => caps[0].to_string(),
+        })
+        .into_owned()
+    }
+
+    fn entry_mut(&mut self, container_path: &str) -> Option<&mut Entry> {
+        self.entries
+            .iter_mut()
+            .find(|e| e.aliases.first().map_or(false, |a| a == container_path))
+    }
+}
@@ -0,0 +1,294 @@
+use crate::delta::{self, Manifest, SyncStats};
+use crate::errors::SingleloadError;
+use crate::runner::{shell_quote, BuildTarget};
+use std::io::IsTerminal;
+use std::process::Stdio;
+use tokio::io::AsyncWriteExt;
+use tokio::process::Command;
+use tracing::debug;
+
+/// Name of the uploaded binary or script in the remote directory
+pub const REMOTE_PROGRAM: &str = "program";
+
+/// Host `run --on` runs scripts on, as `user@host` or `user@host:port`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SshTarget {
+    pub destination: String,
+    pub port: Option<u16>,
+}
+
+impl SshTarget {
+    pub fn parse(value: &str) -> Result<Self, SingleloadError> {
+        let invalid = || SingleloadError::InvalidInput(format!("'{}' is not user@host or user@host:port", value));
+        // A leading dash would be read as an ssh option
+        if value.is_empty() || value.starts_with('-') || value.chars().any(|c| c.is_whitespace()) {
+            return Err(invalid());
+        }
+        // IPv6 addresses are written in brackets: user@[::1]:2222
+        let (destination, port) = match value.rfind(']') {
+            Some(end) if end + 1 == value.len() => (value, None),
+            Some(end) => (&value[..=end], Some(value[end + 1..].strip_prefix(':').ok_or_else(invalid)?)),
+            None => match value.rsplit_once(':') {
+                Some((destination, port)) => (destination, Some(port)),
+                None => (value, None),
+            },
+        };
+        let port = port.map(|p| p.parse::<u16>().map_err(|_| invalid())).transpose()?;
+        let (user, host) = match destination.rsplit_once('@') {
+            Some((user, host)) => (Some(user), host),
+            None => (None, destination),
+        };
+        let host = host.trim_start_matches('[').trim_end_matches(']');
+        if host.is_empty() || host.starts_with('-') || user.is_some_and(str::is_empty) {
+            return Err(invalid());
+        }
+        Ok(Self {
+            destination: match user {
+                Some(user) => format!("{}@{}", user, host),
+                None => host.to_string(),
+            },
+            port,
+        })
+    }
+
+    /// An ssh command for `remote_command`. On unix the connections of one
+    /// run share a control master, so the user authenticates only once;
+    /// its socket lives in [`control_dir`].
+    fn command(&self, remote_command: &str, tty: bool) -> Command {
+        let mut command = Command::new("ssh");
+        command.args(["-o", "ConnectTimeout=15"]);
+        if tty {
+            command.arg("-t");
+        }
+        #[cfg(unix)]
+        if let Some(dir) = control_dir() {
+            command.args([
+                "-o",
+                "ControlMaster=auto",
+                "-o",
+                &format!("ControlPath={}", dir.join("%C").display()),
+                "-o",
+                "ControlPersist=30",
+            ]);
+        }
+        if let Some(port) = self.port {
+            command.args(["-p", &port.to_string()]);
+        }
+        command.arg("--").arg(&self.destination).arg(remote_command);
+        command
+    }
+
+    /// Runs `remote_command` and returns its stdout
+    async fn output(&self, remote_command: &str, input: Option<Vec<u8>>) -> Result<String, SingleloadError> {
+        let mut child = self
+            .command(remote_command, false)
+            .stdin(if input.is_some() { Stdio::piped() } else { Stdio::null() })
+            .stdout(Stdio::piped())
+            .stderr(Stdio::inherit())
+            .spawn()
+            .map_err(|e| SingleloadError::Remote(format!("failed to start ssh: {}", e)))?;
+        if let (Some(input), Some(mut stdin)) = (input, child.stdin.take()) {
+            stdin.write_all(&input).await?;
+        }
+        let output = child.wait_with_output().await?;
+        if !output.status.success() {
+            return Err(SingleloadError::Remote(format!(
+                "ssh {} failed ({})",
+                self.destination, output.status
+            )));
+        }
+        Ok(String::from_utf8_lossy(&output.stdout).trim().to_string())
+    }
+
+    /// Operating system and architecture of the host, from `uname -sm`
+    pub async fn platform(&self) -> Result<RemotePlatform, SingleloadError> {
+        let uname = self.output("uname -sm", None).await?;
+        RemotePlatform::from_uname(&uname).ok_or_else(|| {
+            SingleloadError::InvalidInput(format!("{} runs an unsupported platform: {}", self.destination, uname))
+        })
+    }
+
+    /// Writes the files of `manifest` into a new temporary directory on the
+    /// host and returns its path there. Only the chunks missing from the
+    /// host's chunk store are sent; the rest are taken from earlier
+    /// uploads, so running a large program again after a small change
+    /// sends little more than the change.
+    pub async fn sync(&self, manifest: &Manifest) -> Result<(String, SyncStats), SingleloadError> {
+        // The chunks the store has are linked into the upload's own
+        // directory as they are found, so pruning cannot remove them before
+        // the upload is assembled
+        let listing: String = manifest.chunks().iter().map(|hash| format!("{}\n", hash)).collect();
+        let answer = self
+            .output(
+                &format!(
+                    "store=\"{}\" && mkdir -p \"$store\" && incoming=$(mktemp -d \"$store/.incoming.XXXXXX\") && mkdir \"$incoming/chunks\" && echo \"$incoming\" && while read -r chunk; do ln \"$store/$chunk\" \"$incoming/chunks/$chunk\" 2>/dev/null || echo \"$chunk\"; done",
+                    delta::REMOTE_STORE
+                ),
+                Some(listing.into_bytes()),
+            )
+            .await?;
+        let mut lines = answer.lines().map(str::trim);
+        let incoming = lines.next().filter(|dir| dir.starts_with('/')).ok_or_else(|| {
+            SingleloadError::Remote(format!("{} did not create an upload directory", self.destination))
+        })?;
+        let missing: Vec<String> = lines.filter(|hash| delta::is_chunk_name(hash)).map(String::from).collect();
+
+        // Chunks join the store only once the files they make up check out
+        let remote_dir = self
+            .output(
+                &format!(
+                    "store=\"{store}\" && incoming={incoming} && dir=$(mktemp -d \"${{TMPDIR:-/tmp}}/singleload.XXXXXX\") && tar -xf - -C \"$incoming\" && (cd \"$dir\" && sh \"$incoming/{script}\" \"$store\") && rm -rf \"$incoming\" && echo \"$dir\"",
+                    store = delta::REMOTE_STORE,
+                    incoming = shell_quote(incoming),
+                    script = delta::ASSEMBLE_SCRIPT
+                ),
+                Some(manifest.pack(&missing)?),
+            )
+            .await?;
+        let stats = SyncStats {
+            files: manifest.files(),
+            bytes: manifest.size(),
+            sent_bytes: manifest.chunk_size(&missing),
+        };
+        debug!(
+            "Uploaded {} files to {}:{}, sending {} of {} bytes",
+            stats.files, self.destination, remote_dir, stats.sent_bytes, stats.bytes
+        );
+        Ok((remote_dir, stats))
+    }
+
+    /// Runs the uploaded [`REMOTE_PROGRAM`] in `dir` on the host with the
+    /// terminal's stdin, stdout and stderr, removes `dir` afterwards and
+    /// returns the exit code. From a terminal it gets a remote one too, so
+    /// Ctrl-C reaches it.
+    pub async fn run_program(&self, dir: &str, args: &[String], env: &[(String, String)]) -> Result<i32, SingleloadError> {
+        let env = env
+            .iter()
+            .map(|(key, value)| format!("{}={} ", key, shell_quote(value)))
+            .collect::<String>();
+        let args = args.iter().map(|arg| format!(" {}", shell_quote(arg))).collect::<String>();
+        // The executable bit does not survive uploads from Windows
+        let remote_command = format!(
+            "cd {dir} && chmod +x {program} && {env}./{program}{args}; status=$?; rm -rf {dir}; exit $status",
+            dir = shell_quote(dir),
+            program = REMOTE_PROGRAM,
+            env = env,
+            args = args
+        );
+        let status = self
+            .command(&remote_command, std::io::stdin().is_terminal())
+            .stdin(Stdio::inherit())
+            .stdout(Stdio::inherit())
+            .stderr(Stdio::inherit())
+            .status()
+            .await
+            .map_err(|e| SingleloadError::Remote(format!("failed to start ssh: {}", e)))?;
+        // ssh exits with 255 for its own errors, and with the remote status otherwise
+        Ok(status.code().unwrap_or(255))
+    }
+}
+
+/// Directory of the control master sockets: `$XDG_RUNTIME_DIR/singleload/ssh`,
+/// else `~/.ssh/singleload`. It is owner-only, so no other local user can
+/// plant a socket there or connect through one; if it cannot be made so,
+/// connections are not shared.
+#[cfg(unix)]
+fn control_dir() -> Option<std::path::PathBuf> {
+    use crate::platform;
+    use std::os::unix::fs::{DirBuilderExt, MetadataExt, PermissionsExt};
+    use std::path::PathBuf;
+    let dir = match std::env::var_os("XDG_RUNTIME_DIR").filter(|d| !d.is_empty()) {
+        Some(dir) => PathBuf::from(dir).join("singleload").join("ssh"),
+        None => platform::home_dir().join(".ssh").join("singleload"),
+    };
+    if let Err(e) = std::fs::DirBuilder::new().recursive(true).mode(0o700).create(&dir) {
+        debug!("Not sharing ssh connections, cannot create {}: {}", dir.display(), e);
+        return None;
+    }
+    let metadata = std::fs::symlink_metadata(&dir).ok()?;
+    if !metadata.is_dir() || metadata.uid() != nix::unistd::geteuid().as_raw() {
+        debug!("Not sharing ssh connections, {} belongs to another user", dir.display());
+        return None;
+    }
+    if metadata.mode() & 0o077 != 0 {
+        std::fs::set_permissions(&dir, std::fs::Permissions::from_mode(0o700)).ok()?;
+    }
+    Some(dir)
+}
+
+/// What `uname -sm` reports for the remote host
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RemotePlatform {
+    /// GOOS naming: linux, darwin, freebsd
+    pub os: String,
+    /// GOARCH naming: amd64, arm64, arm, 386
+    pub arch: String,
+}
+
+impl RemotePlatform {
+    pub fn from_uname(uname: &str) -> Option<Self> {
+        let mut words = uname.split_whitespace();
+        let os = match words.next()? {
+            "Linux" => "linux",
+            "Darwin" => "darwin",
+            "FreeBSD" => "freebsd",
+            _ => return None,
+        };
+        let arch = match words.next()? {
+            "x86_64" | "amd64" => "amd64",
+            "aarch64" | "arm64" => "arm64",
+            "armv7l" | "armv6l" => "arm",
+            "i386" | "i686" => "386",
+            _ => return None,
+        };
+        Some(Self {
+            os: os.to_string(),
+            arch: arch.to_string(),
+        })
+    }
+
+    /// True for the platform of the runner container, whose native builds
+    /// run on the host as they are
+    pub fn is_container_platform(&self) -> bool {
+        self.os == "linux" && self.arch == "amd64"
+    }
+
+    /// Target to compile `language` for, None for a native build
+    pub fn build_target(&self, language: &str) -> Option<BuildTarget> {
+        match language {
+            "go" => Some(BuildTarget {
+                goos: Some(self.os.clone()),
+                goarch: Some(self.arch.clone()),
+                triple: None,
+            }),
+            _ if self.is_container_platform() => None,
+            _ => Some(BuildTarget {
+                goos: None,
+                goarch: None,
+                triple: Some(self.rust_triple()),
+            }),
+        }
+    }
+
+    fn rust_triple(&self) -> String {
+        let arch = match self.arch.as_str() {
+            "amd64" => "x86_64",
+            "arm64" => "aarch64",
+            "arm" => "armv7",
+            "386" => "i686",
+            other => other,
+        };
+        match self.os.as_str() {
+            "darwin" => format!("{}-apple-darwin", arch),
+            "freebsd" => format!("{}-unknown-freebsd", arch),
+            _ if arch == "armv7" => "armv7-unknown-linux-gnueabihf".to_string(),
+            _ => format!("{}-unknown-linux-gnu", arch),
+        }
+    }
+}
+
+impl std::fmt::Display for RemotePlatform {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}/{}", self.os, self.arch)
+    }
+}
@@ -0,0 +1,158 @@
+use crate::cache::dir_size;
+use crate::errors::SingleloadError;
+use crate::platform;
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+use std::path::{Path, PathBuf};
+use tracing::debug;
+
+/// Container path a script's state directory is mounted at
+pub const CONTAINER_STATE_DIR: &str = "/state";
+
+/// Variable telling scripts where their state directory is
+pub const STATE_DIR_VAR: &str = "SINGLELOAD_STATE_DIR";
+
+/// Container path the helper modules are mounted at, on PYTHONPATH and NODE_PATH
+pub const CONTAINER_HELPERS_DIR: &str = "/helpers";
+
+const DATA_DIR: &str = "data";
+const ORIGIN_FILE: &str = "script";
+const HELPERS_DIR: &str = ".helpers";
+
+/// Modules scripts use their state directory with: `import singleload_state`
+/// in Python, `require("singleload-state")` in JavaScript
+const HELPERS: &[(&str, &str)] = &[
+    ("singleload_state.py", include_str!("../helpers/python/singleload_state.py")),
+    ("singleload-state.js", include_str!("../helpers/javascript/singleload-state.js")),
+];
+
+/// Persistent per-script directories, keyed on the script's canonical path,
+/// so tools can keep config and data between runs
+#[derive(Debug, Clone)]
+pub struct StateStore {
+    root: PathBuf,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct StateEntry {
+    pub key: String,
+    /// Script the directory belongs to, as it was first run
+    pub script: String,
+    pub size_bytes: u64,
+}
+
+impl StateStore {
+    pub fn new(root: PathBuf) -> Self {
+        Self { root }
+    }
+
+    /// Default location, `~/.singleload/state` (`%LOCALAPPDATA%\singleload\state` on Windows)
+    pub fn default_root() -> PathBuf {
+        platform::data_dir().join("state")
+    }
+
+    pub fn root(&self) -> &Path {
+        &self.root
+    }
+
+    /// Stable key for a script: moving or renaming it starts a new state
+    pub fn key(script: &Path) -> Result<String, SingleloadError> {
+        let canonical = script.canonicalize()?;
+        let mut hasher = Sha256::new();
+        hasher.update(canonical.to_string_lossy().as_bytes());
+        Ok(hex::encode(hasher.finalize()))
+    }
+
+    /// Host directory holding the script's state
+    pub fn dir(&self, script: &Path) -> Result<PathBuf, SingleloadError> {
+        Ok(self.root.join(Self::key(script)?).join(DATA_DIR))
+    }
+
+    /// Creates the state directory on first use and returns it
+    pub fn prepare(&self, script: &Path) -> Result<PathBuf, SingleloadError> {
+        let key = Self::key(script)?;
+        let entry = self.root.join(&key);
+        let dir = entry.join(DATA_DIR);
+        if !dir.exists() {
+            std::fs::create_dir_all(&dir)?;
+            std::fs::write(entry.join(ORIGIN_FILE), script.canonicalize()?.to_string_lossy().as_bytes())?;
+            debug!("Created state directory {} for {}", dir.display(), script.display());
+        }
+        restrict(&[&self.root, &entry, &dir])?;
+        Ok(dir)
+    }
+
+    /// Writes the helper modules next to the state directories, where they
+    /// are mounted from read-only, and returns their directory
+    pub fn helpers(&self) -> Result<PathBuf, SingleloadError> {
+        let dir = self.root.join(HELPERS_DIR);
+        std::fs::create_dir_all(&dir)?;
+        restrict(&[&self.root, &dir])?;
+        for (name, content) in HELPERS {
+            let path = dir.join(name);
+            if std::fs::read(&path).ok().as_deref() != Some(content.as_bytes()) {
+                std::fs::write(&path, content)?;
+            }
+        }
+        Ok(dir)
+    }
+
+    pub fn list(&self) -> Result<Vec<StateEntry>, SingleloadError> {
+        let mut entries = vec![];
+        if !self.root.exists() {
+            return Ok(entries);
+        }
+
+        for dir_entry in std::fs::read_dir(&self.root)? {
+            let dir_entry = dir_entry?;
+            if !dir_entry.file_type()?.is_dir() || dir_entry.file_name().to_string_lossy().starts_with('.') {
+                continue;
+            }
+            let script = std::fs::read_to_string(dir_entry.path().join(ORIGIN_FILE)).unwrap_or_default();
+            entries.push(StateEntry {
+                key: dir_entry.file_name().to_string_lossy().to_string(),
+                script,
+                size_bytes: dir_size(&dir_entry.path().join(DATA_DIR)),
+            });
+        }
+
+        entries.sort_by(|a, b| a.script.cmp(&b.script));
+        Ok(entries)
+    }
+
+    /// Deletes the script's state; returns false if it had none
+    pub fn clear(&self, script: &Path) -> Result<bool, SingleloadError> {
+        let entry = self.root.join(Self::key(script)?);
+        if !entry.exists() {
+            return Ok(false);
+        }
+        std::fs::remove_dir_all(entry)?;
+        Ok(true)
+    }
+}
+
+/// Makes the directories owner-only, refusing those another user owns:
+/// scripts trust what earlier runs left in their state, such as the
+/// variables of cells, so nobody else may write there
+fn restrict(dirs: &[&Path]) -> Result<(), SingleloadError> {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::{MetadataExt, PermissionsExt};
+        let uid = nix::unistd::geteuid().as_raw();
+        for dir in dirs {
+            let metadata = std::fs::metadata(dir)?;
+            if metadata.uid() != uid {
+                return Err(SingleloadError::SecurityViolation(format!(
+                    "State directory {} belongs to another user",
+                    dir.display()
+                )));
+            }
+            if metadata.mode() & 0o777 != 0o700 {
+                std::fs::set_permissions(dir, std::fs::Permissions::from_mode(0o700))?;
+            }
+        }
+    }
+    #[cfg(not(unix))]
+    let _ = dirs;
+    Ok(())
+}
@@ -0,0 +1,226 @@
+use crate::errors::SingleloadError;
+use crate::platform;
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use std::fs::{File, OpenOptions};
+use std::io::{Read, Seek, Write};
+use std::path::{Path, PathBuf};
+use tracing::info;
+
+/// A script whose content was trusted the first time it ran
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct KnownScript {
+    /// URL of a remote script, or the canonical path of a local one
+    pub script: String,
+    /// SHA-256 of the content last trusted, see [`KnownCheck`]
+    pub sha256: String,
+    pub first_seen: DateTime<Utc>,
+    pub last_seen: DateTime<Utc>,
+}
+
+/// What the store knows about a script's current content
+#[derive(Debug, Clone, PartialEq)]
+pub enum Trust {
+    /// Never run before
+    New,
+    /// Unchanged since it was trusted
+    Known,
+    /// Different from the content trusted before
+    Changed(KnownScript),
+}
+
+/// Checksums of the remote and shared scripts that were run, like SSH's
+/// `known_hosts`: the first run trusts a script's content, and later runs
+/// notice when it changed. Every access locks the file, so concurrent runs
+/// do not lose entries.
+#[derive(Debug, Clone)]
+pub struct KnownScripts {
+    path: PathBuf,
+}
+
+impl KnownScripts {
+    pub fn new(path: PathBuf) -> Self {
+        Self { path }
+    }
+
+    /// Default location, `~/.singleload/known_scripts.json` (`%LOCALAPPDATA%\singleload\known_scripts.json` on Windows)
+    pub fn default_path() -> PathBuf {
+        platform::data_dir().join("known_scripts.json")
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    pub fn check(&self, script: &str, sha256: &str) -> Result<Trust, SingleloadError> {
+        Ok(match self.list()?.into_iter().find(|known| known.script == script) {
+            None => Trust::New,
+            Some(known) if known.sha256 == sha256 => Trust::Known,
+            Some(known) => Trust::Changed(known),
+        })
+    }
+
+    /// Trusts `sha256` as the content of `script` from now on
+    pub fn trust(&self, script: &str, sha256: &str) -> Result<(), SingleloadError> {
+        self.update(|entries| {
+            let now = Utc::now();
+            match entries.iter_mut().find(|known| known.script == script) {
+                Some(known) => {
+                    known.sha256 = sha256.to_string();
+                    known.last_seen = now;
+                }
+                None => entries.push(KnownScript {
+                    script: script.to_string(),
+                    sha256: sha256.to_string(),
+                    first_seen: now,
+                    last_seen: now,
+                }),
+            }
+        })
+    }
+
+    /// Forgets `script`, so its next run trusts whatever it holds then.
+    /// Returns false if it was not known.
+    pub fn forget(&self, script: &str) -> Result<bool, SingleloadError> {
+        let mut removed = false;
+        self.update(|entries| {
+            let before = entries.len();
+            entries.retain(|known| known.script != script);
+            removed = entries.len() != before;
+        })?;
+        Ok(removed)
+    }
+
+    /// Known scripts, sorted by URL or path
+    pub fn list(&self) -> Result<Vec<KnownScript>, SingleloadError> {
+        match File::open(&self.path) {
+            Ok(mut file) => {
+                file.lock_shared()?;
+                read_entries(&mut file)
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(Vec::new()),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    fn update(&self, change: impl FnOnce(&mut Vec<KnownScript>)) -> Result<(), SingleloadError> {
+        if let Some(parent) = self.path.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        let mut options = OpenOptions::new();
+        options.read(true).write(true).create(true).truncate(false);
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::OpenOptionsExt;
+            options.mode(0o600);
+        }
+        let mut file = options.open(&self.path)?;
+        file.lock()?;
+
+        let mut entries = read_entries(&mut file)?;
+        change(&mut entries);
+        entries.sort_by(|a, b| a.script.cmp(&b.script));
+        let data = serde_json::to_vec_pretty(&entries)?;
+        file.set_len(0)?;
+        file.rewind()?;
+        file.write_all(&data)?;
+        Ok(())
+    }
+}
+
+/// The trust check of one run. The checksum covers what the run staged:
+/// the script and the files it pulls in with `uses`, `embed`, `pre` and
+/// `post`, as they were read for the run, so a file that changes after the
+/// check is not what runs.
+#[derive(Debug, Clone)]
+pub struct KnownCheck {
+    pub store: KnownScripts,
+    /// URL of a remote script, or the canonical path of a local one
+    pub key: String,
+    /// Refuse changed content even on a terminal
+    pub strict: bool,
+    /// Ask on the terminal before running changed content
+    pub interactive: bool,
+}
+
+impl KnownCheck {
+    /// Checks `sha256` against the content trusted for the script before.
+    /// New scripts are trusted; changed ones run only once the user agrees
+    /// on the terminal.
+    pub fn confirm(&self, sha256: &str) -> Result<(), SingleloadError> {
+        use std::io::BufRead;
+
+        let previous = match self.store.check(&self.key, sha256)? {
+            Trust::Known => return Ok(()),
+            Trust::New => {
+                info!("Trusting {} on first use (sha256 {})", self.key, sha256);
+                return self.store.trust(&self.key, sha256);
+            }
+            Trust::Changed(previous) => previous,
+        };
+
+        let warning = format!(
+            "{} changed since it was trusted on {}: sha256 {} is now {}",
+            self.key,
+            previous.last_seen.with_timezone(&chrono::Local).format("%Y-%m-%d %H:%M:%S"),
+            previous.sha256,
+            sha256
+        );
+        if self.strict || !self.interactive {
+            return Err(SingleloadError::SecurityViolation(format!(
+                "{}. Run `singleload known forget {}` to accept the new content{}",
+                warning,
+                self.key,
+                if self.strict { "" } else { ", or run it on a terminal to review the change" }
+            )));
+        }
+
+        eprintln!("WARNING: {}", warning);
+        eprint!("Run it and trust the new content? [y/N] ");
+        std::io::stderr().flush()?;
+        let mut answer = String::new();
+        std::io::stdin().lock().read_line(&mut answer)?;
+        if !matches!(answer.trim().to_lowercase().as_str(), "y" | "yes") {
+            return Err(SingleloadError::SecurityViolation("Not running the changed script".to_string()));
+        }
+        self.store.trust(&self.key, sha256)
+    }
+}
+
+fn read_entries(file: &mut File) -> Result<Vec<KnownScript>, SingleloadError> {
+    let mut data = String::new();
+    file.read_to_string(&mut data)?;
+    if data.trim().is_empty() {
+        return Ok(Vec::new());
+    }
+    serde_json::from_str(&data).map_err(|e| SingleloadError::InvalidInput(format!("Invalid known scripts file: {}", e)))
+}
+
+/// True if someone other than the current user could have changed the
+/// script: it, or the directory holding it, belongs to another user than
+/// root, or is writable by another group or everyone
+pub fn is_shared(path: &Path) -> bool {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::MetadataExt;
+        let uid = nix::unistd::geteuid().as_raw();
+        let gid = nix::unistd::getegid().as_raw();
+        let parent = path.parent().filter(|p| !p.as_os_str().is_empty()).unwrap_or(Path::new("."));
+        [path, parent].iter().any(|p| {
+            std::fs::metadata(p).is_ok_and(|m| {
+                // Root could change anything anyway, and the sticky bit keeps
+                // others from replacing files in /tmp and the like. With a
+                // umask of 002 files are writable by the user's own group.
+                let sticky_dir = m.is_dir() && m.mode() & 0o1000 != 0;
+                let group_writable = m.mode() & 0o020 != 0 && m.gid() != gid;
+                let world_writable = m.mode() & 0o002 != 0;
+                (m.uid() != uid && m.uid() != 0) || ((group_writable || world_writable) && !sticky_dir)
+            })
+        })
+    }
+    #[cfg(not(unix))]
+    {
+        let _ = path;
+        false
+    }
+}
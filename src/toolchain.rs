@@ -0,0 +1,545 @@
+use crate::cache::{dir_size, COMPLETE_MARKER};
+use crate::download::DownloadManager;
+use crate::errors::SingleloadError;
+use crate::platform;
+use chrono::{DateTime, Utc};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::BTreeMap;
+use std::fs::{File, OpenOptions, TryLockError};
+use std::io::Read;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
+use tracing::{debug, info};
+
+/// Container path a pinned toolchain is mounted at; its binaries are put
+/// in front of PATH from `<dir>/bin`
+pub const CONTAINER_TOOLCHAIN_DIR: &str = "/toolchain";
+
+/// Checksums of every file of the installed toolchains, one
+/// `<language>-<version>.json` each under the store root. They are kept out
+/// of the toolchain directories, which the install container writes to.
+const MANIFESTS_DIR: &str = ".manifests";
+
+/// Lock files of toolchains being installed, under the store root
+const LOCKS_DIR: &str = ".locks";
+
+/// Release archives downloaded for installs, under the store root; an
+/// interrupted download is resumed from here
+const DOWNLOADS_DIR: &str = ".downloads";
+
+/// Container path of the release archive while `install_toolchain` runs
+pub const CONTAINER_ARCHIVE: &str = "/toolchain-archive.tar.gz";
+
+/// Largest release listing and checksum file read
+const RELEASE_INFO_LIMIT: u64 = 64 * 1024 * 1024;
+
+/// A published toolchain build, downloaded on the host so it goes through
+/// the download manager
+#[derive(Debug, Clone)]
+pub struct ReleaseAsset {
+    pub host: ReleaseHost,
+    /// Matches the names of the builds for this machine; its one group is
+    /// the version
+    pub pattern: String,
+    /// File listing `<sha256>  <name>` for the others
+    pub checksums: &'static str,
+}
+
+/// Where a toolchain's builds are published
+#[derive(Debug, Clone)]
+pub enum ReleaseHost {
+    /// Assets of the latest release of a GitHub repository, `owner/name`
+    GitHub(&'static str),
+    /// A download server laid out like nodejs.org/dist: `index.json` lists
+    /// the versions, and `v<version>/` holds the builds of each with the
+    /// checksum file
+    Dist(&'static str),
+}
+
+impl std::fmt::Display for ReleaseHost {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::GitHub(repo) => write!(f, "the latest release of {}", repo),
+            Self::Dist(base) => write!(f, "{}", base),
+        }
+    }
+}
+
+const LOCK_POLL_INTERVAL: Duration = Duration::from_millis(100);
+
+/// Held while a toolchain is installed; released when dropped
+#[derive(Debug)]
+pub struct ToolchainLock {
+    _file: File,
+}
+
+/// The files a toolchain had when its install completed
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ToolchainManifest {
+    pub language: String,
+    pub version: String,
+    pub installed_at: DateTime<Utc>,
+    /// Paths relative to the toolchain directory
+    pub files: BTreeMap<String, ManifestEntry>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ManifestEntry {
+    pub size: u64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub sha256: Option<String>,
+    /// Target of a symlink, which is recorded instead of followed
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub link: Option<String>,
+}
+
+/// An installed toolchain, as `toolchain ls` lists it
+#[derive(Debug, Serialize)]
+pub struct InstalledToolchain {
+    pub language: String,
+    pub version: String,
+    pub size_bytes: u64,
+    pub complete: bool,
+    /// False for toolchains installed before manifests were written
+    pub has_manifest: bool,
+}
+
+/// Result of checking a toolchain against its manifest
+#[derive(Debug, Default, Serialize)]
+pub struct ToolchainCheck {
+    pub language: String,
+    pub version: String,
+    pub ok: bool,
+    pub files: usize,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub missing: Vec<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub modified: Vec<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub unexpected: Vec<String>,
+    /// Why the toolchain could not be checked at all
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+/// Toolchains pinned by scripts with `// singleload: go 1.22.3`, installed
+/// once per language and version
+#[derive(Debug, Clone)]
+pub struct ToolchainStore {
+    root: PathBuf,
+}
+
+impl ToolchainStore {
+    pub fn new(root: PathBuf) -> Self {
+        Self { root }
+    }
+
+    /// Default location, `~/.singleload/toolchains` (`%LOCALAPPDATA%\singleload\toolchains` on Windows)
+    pub fn default_root() -> PathBuf {
+        platform::data_dir().join("toolchains")
+    }
+
+    pub fn root(&self) -> &Path {
+        &self.root
+    }
+
+    pub fn dir(&self, language: &str, version: &str) -> PathBuf {
+        self.root.join(format!("{}-{}", language, version))
+    }
+
+    fn manifest_path(&self, language: &str, version: &str) -> PathBuf {
+        self.root.join(MANIFESTS_DIR).join(format!("{}-{}.json", language, version))
+    }
+
+    pub fn is_installed(&self, language: &str, version: &str) -> bool {
+        self.dir(language, version).join(COMPLETE_MARKER).exists()
+    }
+
+    /// Downloads the newest build of `version` (e.g. `3.12.4`)
+    /// published on `asset.host`, checked against the published checksums,
+    /// and returns where it is. Only the build itself may come from a
+    /// mirror; the release listing and checksums are fetched from the host. The archive is kept until
+    /// [`Self::remove_download`] so a failed install does not fetch it again.
+    pub async fn download_release(
+        &self,
+        downloads: &DownloadManager,
+        asset: &ReleaseAsset,
+        version: &str,
+    ) -> Result<PathBuf, SingleloadError> {
+        let (assets, sums) = match &asset.host {
+            ReleaseHost::GitHub(repo) => {
+                let api = format!("https://api.github.com/repos/{}/releases/latest", repo);
+                let release: serde_json::Value =
+                    serde_json::from_slice(&downloads.fetch_origin(&api, RELEASE_INFO_LIMIT).await?)?;
+                let assets: Vec<(String, String)> = release["assets"]
+                    .as_array()
+                    .into_iter()
+                    .flatten()
+                    .filter_map(|a| Some((a["name"].as_str()?.to_string(), a["browser_download_url"].as_str()?.to_string())))
+                    .collect();
+                let sums_url = assets.iter().find(|(n, _)| n == asset.checksums).map(|(_, url)| url).ok_or_else(|| {
+                    SingleloadError::Container(format!("{} has no {}", asset.host, asset.checksums))
+                })?;
+                let sums = downloads.fetch_origin(sums_url, RELEASE_INFO_LIMIT).await?;
+                (assets, sums)
+            }
+            // The checksum file of a version lists every build of it
+            ReleaseHost::Dist(base) => {
+                let index: serde_json::Value =
+                    serde_json::from_slice(&downloads.fetch_origin(&format!("{}/index.json", base), RELEASE_INFO_LIMIT).await?)?;
+                let newest = index
+                    .as_array()
+                    .into_iter()
+                    .flatten()
+                    .filter_map(|release| release["version"].as_str())
+                    .map(|found| found.trim_start_matches('v'))
+                    .filter(|found| version_matches(found, version))
+                    .max_by_key(|found| version_parts(found));
+                let Some(newest) = newest else {
+                    return Err(SingleloadError::InvalidInput(format!("{} has no version {}", base, version)));
+                };
+                let dir = format!("{}/v{}", base, newest);
+                let sums = downloads.fetch_origin(&format!("{}/{}", dir, asset.checksums), RELEASE_INFO_LIMIT).await?;
+                let assets = String::from_utf8_lossy(&sums)
+                    .lines()
+                    .filter_map(|line| line.split_whitespace().nth(1))
+                    .map(|name| (name.to_string(), format!("{}/{}", dir, name)))
+                    .collect();
+                (assets, sums)
+            }
+        };
+
+        let pattern = Regex::new(&format!("^(?:{})$", asset.pattern))
+            .map_err(|e| SingleloadError::InvalidInput(format!("release pattern of {}: {}", asset.host, e)))?;
+        let newest = assets
+            .iter()
+            .filter_map(|(name, url)| {
+                let found = pattern.captures(name)?.get(1)?.as_str();
+                version_matches(found, version).then(|| (version_parts(found), name.as_str(), url.as_str()))
+            })
+            .max();
+        let Some((_, name, url)) = newest else {
+            return Err(SingleloadError::InvalidInput(format!(
+                "{} has no build of version {}",
+                asset.host, version
+            )));
+        };
+
+        let sha256 = String::from_utf8_lossy(&sums)
+            .lines()
+            .find_map(|line| {
+                let (digest, file) = line.split_once(char::is_whitespace)?;
+                (file.trim_start().trim_start_matches('*') == name).then(|| digest.to_string())
+            })
+            .ok_or_else(|| SingleloadError::Container(format!("{} has no checksum for {}", asset.checksums, name)))?;
+
+        let dir = self.root.join(DOWNLOADS_DIR);
+        std::fs::create_dir_all(&dir)?;
+        let path = dir.join(name);
+        if !path.exists() {
+            info!("Downloading {}", url);
+            downloads.download(url, &path, Some(&sha256)).await?;
+        }
+        Ok(path)
+    }
+
+    /// Deletes a release archive once its toolchain is installed
+    pub fn remove_download(&self, path: &Path) {
+        if path.starts_with(self.root.join(DOWNLOADS_DIR)) {
+            let _ = std::fs::remove_file(path);
+        }
+    }
+
+    /// Waits until no other process is installing `version` of `language`,
+    /// then holds its lock. Unlike build locks it is never skipped: two
+    /// installs into one directory would leave a mix of both behind.
+    pub async fn lock(&self, language: &str, version: &str, wait: Duration) -> Result<ToolchainLock, SingleloadError> {
+        let dir = self.root.join(LOCKS_DIR);
+        std::fs::create_dir_all(&dir)?;
+        let file = OpenOptions::new()
+            .create(true)
+            .write(true)
+            .truncate(false)
+            .open(dir.join(format!("{}-{}.lock", language, version)))?;
+
+        let deadline = Instant::now() + wait;
+        let mut waiting = false;
+        loop {
+            match file.try_lock() {
+                Ok(()) => return Ok(ToolchainLock { _file: file }),
+                Err(TryLockError::WouldBlock) => {}
+                Err(TryLockError::Error(e)) => return Err(e.into()),
+            }
+            if !waiting {
+                info!("Waiting for another install of {} toolchain {}", language, version);
+                waiting = true;
+            }
+            if Instant::now() >= deadline {
+                return Err(SingleloadError::Container(format!(
+                    "{} toolchain {} is still being installed by another process after {}s",
+                    language,
+                    version,
+                    wait.as_secs()
+                )));
+            }
+            tokio::time::sleep(LOCK_POLL_INTERVAL).await;
+        }
+    }
+
+    /// Every toolchain directory in the store, sorted by language and version
+    pub fn list(&self) -> Result<Vec<InstalledToolchain>, SingleloadError> {
+        let mut toolchains = Vec::new();
+        if !self.root.exists() {
+            return Ok(toolchains);
+        }
+        for entry in std::fs::read_dir(&self.root)? {
+            let entry = entry?;
+            let name = entry.file_name().to_string_lossy().to_string();
+            if !entry.file_type()?.is_dir() || name.starts_with('.') {
+                continue;
+            }
+            let Some((language, version)) = name.rsplit_once('-') else {
+                continue;
+            };
+            toolchains.push(InstalledToolchain {
+                language: language.to_string(),
+                version: version.to_string(),
+                size_bytes: dir_size(&entry.path()),
+                complete: self.is_installed(language, version),
+                has_manifest: self.manifest_path(language, version).is_file(),
+            });
+        }
+        toolchains.sort_by(|a, b| (&a.language, &a.version).cmp(&(&b.language, &b.version)));
+        Ok(toolchains)
+    }
+
+    /// Reads every file of the complete toolchains once, so the first
+    /// builds with them do not wait on the disk; returns how many were read
+    pub fn warm(&self) -> Result<usize, SingleloadError> {
+        let complete: Vec<_> = self.list()?.into_iter().filter(|t| t.complete).collect();
+        for toolchain in &complete {
+            read_all(&self.dir(&toolchain.language, &toolchain.version))?;
+        }
+        Ok(complete.len())
+    }
+
+    /// Records the checksum of every file of an installed toolchain
+    pub fn write_manifest(&self, language: &str, version: &str) -> Result<ToolchainManifest, SingleloadError> {
+        let dir = self.dir(language, version);
+        let manifest = ToolchainManifest {
+            language: language.to_string(),
+            version: version.to_string(),
+            installed_at: Utc::now(),
+            files: scan(&dir)?,
+        };
+        let mut data = serde_json::to_vec_pretty(&manifest)?;
+        data.push(b'\n');
+        let path = self.manifest_path(language, version);
+        std::fs::create_dir_all(self.root.join(MANIFESTS_DIR))?;
+        std::fs::write(path, data)?;
+        debug!("Recorded {} files of {} toolchain {}", manifest.files.len(), language, version);
+        Ok(manifest)
+    }
+
+    /// Compares an installed toolchain with the manifest written when it
+    /// was installed
+    pub fn verify(&self, language: &str, version: &str) -> ToolchainCheck {
+        let mut check = ToolchainCheck {
+            language: language.to_string(),
+            version: version.to_string(),
+            ..Default::default()
+        };
+        let dir = self.dir(language, version);
+        if !self.is_installed(language, version) {
+            check.error = Some("the install did not complete".to_string());
+            return check;
+        }
+        let manifest_path = self.manifest_path(language, version);
+        let manifest: ToolchainManifest = match std::fs::read(&manifest_path) {
+            Ok(data) => match serde_json::from_slice(&data) {
+                Ok(manifest) => manifest,
+                Err(e) => {
+                    check.error = Some(format!("unreadable {}: {}", manifest_path.display(), e));
+                    return check;
+                }
+            },
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+                check.error = Some("no manifest, reinstall the toolchain to create one".to_string());
+                return check;
+            }
+            Err(e) => {
+                check.error = Some(e.to_string());
+                return check;
+            }
+        };
+        let files = match scan(&dir) {
+            Ok(files) => files,
+            Err(e) => {
+                check.error = Some(e.to_string());
+                return check;
+            }
+        };
+
+        for (path, expected) in &manifest.files {
+            match files.get(path) {
+                None => check.missing.push(path.clone()),
+                Some(actual) if actual != expected => check.modified.push(path.clone()),
+                Some(_) => {}
+            }
+        }
+        check.unexpected = files
+            .keys()
+            .filter(|path| !manifest.files.contains_key(*path))
+            .cloned()
+            .collect();
+        check.files = manifest.files.len();
+        check.ok = check.missing.is_empty() && check.modified.is_empty() && check.unexpected.is_empty();
+        check
+    }
+
+    /// Creates an empty toolchain directory for the install container to write into
+    pub fn prepare(&self, language: &str, version: &str) -> Result<PathBuf, SingleloadError> {
+        let dir = self.dir(language, version);
+        if dir.exists() {
+            // Leftovers of an interrupted install
+            self.remove(language, version)?;
+        }
+        std::fs::create_dir_all(&dir)?;
+
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&self.root, std::fs::Permissions::from_mode(0o711))?;
+            // The install container's user is mapped to ours, see container::userns
+            std::fs::set_permissions(&dir, std::fs::Permissions::from_mode(0o755))?;
+        }
+
+        debug!("Prepared toolchain directory {}", dir.display());
+        Ok(dir)
+    }
+
+    pub fn remove(&self, language: &str, version: &str) -> Result<(), SingleloadError> {
+        let _ = std::fs::remove_file(self.manifest_path(language, version));
+        let dir = self.dir(language, version);
+        if !dir.exists() {
+            return Ok(());
+        }
+        // Go marks its module cache read-only
+        #[cfg(unix)]
+        make_writable(&dir)?;
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    /// Rejects versions that are not a full `major.minor.patch` release,
+    /// since they end up in install commands and directory names. Shorter
+    /// versions would name whichever release was newest at install time.
+    pub fn validate_version(version: &str) -> Result<(), SingleloadError> {
+        let valid = version.split('.').count() == 3
+            && version
+                .split('.')
+                .all(|part| !part.is_empty() && part.chars().all(|c| c.is_ascii_digit()));
+        if valid {
+            Ok(())
+        } else {
+            Err(SingleloadError::InvalidInput(format!(
+                "Invalid toolchain version '{}', expected a full release such as 1.22.3",
+                version
+            )))
+        }
+    }
+}
+
+/// Whether `found` is `version` or a release of it, `3.12.4` of `3.12`
+fn version_matches(found: &str, version: &str) -> bool {
+    found == version || found.starts_with(&format!("{}.", version))
+}
+
+fn version_parts(version: &str) -> Vec<u64> {
+    version.split('.').map(|p| p.parse().unwrap_or(0)).collect()
+}
+
+/// Every file under `dir` but the marker, with its checksum
+fn scan(dir: &Path) -> Result<BTreeMap<String, ManifestEntry>, SingleloadError> {
+    let mut files = BTreeMap::new();
+    scan_into(dir, dir, &mut files)?;
+    files.remove(COMPLETE_MARKER);
+    Ok(files)
+}
+
+fn scan_into(root: &Path, dir: &Path, files: &mut BTreeMap<String, ManifestEntry>) -> Result<(), SingleloadError> {
+    for entry in std::fs::read_dir(dir)? {
+        let entry = entry?;
+        let path = entry.path();
+        let file_type = entry.file_type()?;
+        if file_type.is_dir() {
+            scan_into(root, &path, files)?;
+            continue;
+        }
+        let name = path
+            .strip_prefix(root)
+            .unwrap_or(&path)
+            .to_string_lossy()
+            .replace('\\', "/");
+        let entry = if file_type.is_symlink() {
+            ManifestEntry {
+                size: 0,
+                sha256: None,
+                link: Some(std::fs::read_link(&path)?.to_string_lossy().to_string()),
+            }
+        } else {
+            let mut hasher = Sha256::new();
+            let mut file = File::open(&path)?;
+            let mut buffer = vec![0; 64 * 1024];
+            let mut size = 0;
+            loop {
+                let read = file.read(&mut buffer)?;
+                if read == 0 {
+                    break;
+                }
+                hasher.update(&buffer[..read]);
+                size += read as u64;
+            }
+            ManifestEntry {
+                size,
+                sha256: Some(hex::encode(hasher.finalize())),
+                link: None,
+            }
+        };
+        files.insert(name, entry);
+    }
+    Ok(())
+}
+
+/// Reads the files under `dir` into the page cache, without following links
+fn read_all(dir: &Path) -> Result<(), SingleloadError> {
+    for entry in std::fs::read_dir(dir)? {
+        let entry = entry?;
+        let file_type = entry.file_type()?;
+        if file_type.is_dir() {
+            read_all(&entry.path())?;
+        } else if file_type.is_file() {
+            std::io::copy(&mut File::open(entry.path())?, &mut std::io::sink())?;
+        }
+    }
+    Ok(())
+}
+
+#[cfg(unix)]
+fn make_writable(path: &Path) -> Result<(), SingleloadError> {
+    use std::os::unix::fs::PermissionsExt;
+    let metadata = std::fs::symlink_metadata(path)?;
+    if metadata.file_type().is_symlink() {
+        return Ok(());
+    }
+    let mode = metadata.permissions().mode();
+    std::fs::set_permissions(path, std::fs::Permissions::from_mode(mode | 0o700))?;
+    if metadata.is_dir() {
+        for entry in std::fs::read_dir(path)? {
+            make_writable(&entry?.path())?;
+        }
+    }
+    Ok(())
+}
@@ -0,0 +1,234 @@
+use crate::errors::SingleloadError;
+use crate::platform;
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use tracing::debug;
+
+/// Metadata of installed tools, kept next to their launchers
+const META_DIR: &str = ".singleload-tools";
+
+/// Scripts installed as commands with `singleload install <script> --as <name>`
+#[derive(Debug, Clone)]
+pub struct ToolStore {
+    bin_dir: PathBuf,
+}
+
+/// How an installed tool runs
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ToolKind {
+    /// A compiled binary, run directly on the host
+    Binary,
+    /// A launcher running the script through `singleload run` in the sandbox
+    Launcher,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Tool {
+    pub name: String,
+    /// Canonical path of the script it was installed from
+    pub script: PathBuf,
+    pub language: String,
+    pub kind: ToolKind,
+    pub installed_at: DateTime<Utc>,
+}
+
+impl ToolStore {
+    pub fn new(bin_dir: PathBuf) -> Self {
+        Self { bin_dir }
+    }
+
+    /// Default location, `~/.singleload/bin` (`%LOCALAPPDATA%\singleload\bin` on Windows)
+    pub fn default_root() -> PathBuf {
+        platform::data_dir().join("bin")
+    }
+
+    pub fn bin_dir(&self) -> &Path {
+        &self.bin_dir
+    }
+
+    /// Tool names become file names in the bin directory, so they are kept
+    /// to letters, digits, `.`, `_` and `-`
+    pub fn validate_name(name: &str) -> Result<(), SingleloadError> {
+        let valid = !name.is_empty()
+            && !name.starts_with(['.', '-'])
+            && name.len() <= 64
+            && name.chars().all(|c| c.is_ascii_alphanumeric() || matches!(c, '.' | '_' | '-'));
+        if !valid {
+            return Err(SingleloadError::InvalidInput(format!("Invalid tool name '{}'", name)));
+        }
+        Ok(())
+    }
+
+    /// Where a compiled tool's executable goes (`<name>.exe` on Windows)
+    pub fn path(&self, name: &str) -> PathBuf {
+        self.bin_dir.join(format!("{}{}", name, std::env::consts::EXE_SUFFIX))
+    }
+
+    /// Launcher files for a tool: a sh script on unix, a `.cmd` shim for
+    /// cmd.exe plus a `.ps1` one for PowerShell on Windows
+    pub fn launcher_paths(&self, name: &str) -> Vec<PathBuf> {
+        if cfg!(windows) {
+            vec![self.bin_dir.join(format!("{}.cmd", name)), self.bin_dir.join(format!("{}.ps1", name))]
+        } else {
+            vec![self.bin_dir.join(name)]
+        }
+    }
+
+    /// The file users run for an installed tool
+    pub fn entry_path(&self, tool: &Tool) -> PathBuf {
+        match tool.kind {
+            ToolKind::Binary => self.path(&tool.name),
+            ToolKind::Launcher => self.launcher_paths(&tool.name).swap_remove(0),
+        }
+    }
+
+    pub fn is_installed(&self, name: &str) -> bool {
+        self.meta_path(name).is_file()
+    }
+
+    /// Refuses to overwrite an existing file unless `force` is set, so
+    /// installing never clobbers something the user put there themselves
+    pub fn check_free(&self, name: &str, force: bool) -> Result<(), SingleloadError> {
+        Self::validate_name(name)?;
+        if !force {
+            if let Some(existing) = self.files(name).into_iter().find(|path| path.exists()) {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "{} already exists; use --force to replace it",
+                    existing.display()
+                )));
+            }
+            if self.is_installed(name) {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "'{}' is already installed; use --force to replace it",
+                    name
+                )));
+            }
+        }
+        std::fs::create_dir_all(&self.bin_dir)?;
+        Ok(())
+    }
+
+    /// Writes the launchers that run `script` with `singleload` and returns
+    /// the first one
+    pub fn write_launcher(&self, name: &str, singleload: &Path, script: &Path) -> Result<PathBuf, SingleloadError> {
+        let paths = self.launcher_paths(name);
+        for path in &paths {
+            let content = match path.extension().and_then(|ext| ext.to_str()) {
+                Some("cmd") => cmd_launcher(singleload, script),
+                Some("ps1") => ps1_launcher(singleload, script),
+                _ => launcher(singleload, script),
+            };
+            std::fs::write(path, content)?;
+            make_executable(path)?;
+        }
+        Ok(paths[0].clone())
+    }
+
+    /// Records an installed tool once its executable is in place
+    pub fn record(&self, tool: &Tool) -> Result<(), SingleloadError> {
+        make_executable(&self.entry_path(tool))?;
+        std::fs::create_dir_all(self.bin_dir.join(META_DIR))?;
+        std::fs::write(self.meta_path(&tool.name), serde_json::to_vec_pretty(tool)?)?;
+        debug!("Installed {} from {}", tool.name, tool.script.display());
+        Ok(())
+    }
+
+    pub fn list(&self) -> Result<Vec<Tool>, SingleloadError> {
+        let mut tools = vec![];
+        let meta_dir = self.bin_dir.join(META_DIR);
+        if !meta_dir.exists() {
+            return Ok(tools);
+        }
+
+        for entry in std::fs::read_dir(meta_dir)? {
+            let data = std::fs::read(entry?.path())?;
+            if let Ok(tool) = serde_json::from_slice::<Tool>(&data) {
+                tools.push(tool);
+            }
+        }
+
+        tools.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(tools)
+    }
+
+    /// Removes an installed tool; returns false if there is none by that name.
+    /// Files that were not installed by singleload are left alone.
+    pub fn remove(&self, name: &str) -> Result<bool, SingleloadError> {
+        Self::validate_name(name)?;
+        if !self.is_installed(name) {
+            return Ok(false);
+        }
+        for path in self.files(name) {
+            if path.exists() {
+                std::fs::remove_file(path)?;
+            }
+        }
+        std::fs::remove_file(self.meta_path(name))?;
+        Ok(true)
+    }
+
+    /// True if the bin directory is on `PATH`
+    pub fn on_path(&self) -> bool {
+        std::env::var_os("PATH").map_or(false, |path| std::env::split_paths(&path).any(|dir| dir == self.bin_dir))
+    }
+
+    /// Every file a tool by this name may have in the bin directory
+    fn files(&self, name: &str) -> Vec<PathBuf> {
+        let mut files = self.launcher_paths(name);
+        files.push(self.path(name));
+        files.dedup();
+        files
+    }
+
+    fn meta_path(&self, name: &str) -> PathBuf {
+        self.bin_dir.join(META_DIR).join(format!("{}.json", name))
+    }
+}
+
+/// POSIX sh launcher; arguments are passed on to the script, as for
+/// scripts started through their shebang
+pub fn launcher(singleload: &Path, script: &Path) -> String {
+    format!(
+        "#!/bin/sh\n# Installed by singleload from {}\nexec {} --format text run --script {} -- \"$@\"\n",
+        script.display(),
+        sh_quote(&singleload.to_string_lossy()),
+        sh_quote(&script.to_string_lossy())
+    )
+}
+
+/// cmd.exe shim; `%` is doubled so paths are not expanded as variables
+pub fn cmd_launcher(singleload: &Path, script: &Path) -> String {
+    let quote = |path: &Path| format!("\"{}\"", path.to_string_lossy().replace('%', "%%"));
+    format!(
+        "@echo off\r\nrem Installed by singleload from {}\r\n{} --format text run --script {} -- %*\r\nexit /b %ERRORLEVEL%\r\n",
+        script.display(),
+        quote(singleload),
+        quote(script)
+    )
+}
+
+/// PowerShell shim, used when the tool is started from a PowerShell prompt
+pub fn ps1_launcher(singleload: &Path, script: &Path) -> String {
+    let quote = |path: &Path| format!("'{}'", path.to_string_lossy().replace('\'', "''"));
+    format!(
+        "# Installed by singleload from {}\r\n& {} --format text run --script {} -- @args\r\nexit $LASTEXITCODE\r\n",
+        script.display(),
+        quote(singleload),
+        quote(script)
+    )
+}
+
+fn sh_quote(value: &str) -> String {
+    format!("'{}'", value.replace('\'', "'\\''"))
+}
+
+fn make_executable(path: &Path) -> std::io::Result<()> {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(path, std::fs::Permissions::from_mode(0o755))?;
+    }
+    Ok(())
+}
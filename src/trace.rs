@@ -0,0 +1,255 @@
+use crate::errors::SingleloadError;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeSet;
+use std::path::{Component, Path, PathBuf};
+
+/// Where traced runs write strace's logs, one file per process
+pub const CONTAINER_TRACE_DIR: &str = "/trace";
+
+const LOG_PREFIX: &str = "strace";
+
+/// Calls the seccomp profile blocks that strace needs: it follows the
+/// script with ptrace and reads path arguments with process_vm_readv
+pub const SYSCALLS: &[&str] = &["ptrace", "process_vm_readv"];
+
+/// Calls that open their path, for writing when given one of `WRITE_FLAGS`
+const OPEN_CALLS: &[&str] = &["open", "openat", "openat2"];
+const WRITE_FLAGS: &[&str] = &["O_WRONLY", "O_RDWR", "O_CREAT", "O_TRUNC", "O_APPEND"];
+const EXEC_CALLS: &[&str] = &["execve", "execveat"];
+
+/// Calls that change their paths or what is at them; the rest of strace's
+/// `%file` class only looks
+const WRITE_CALLS: &[&str] = &[
+    "creat", "unlink", "unlinkat", "rename", "renameat", "renameat2", "mkdir", "mkdirat", "rmdir", "symlink",
+    "symlinkat", "link", "linkat", "truncate", "chmod", "fchmodat", "chown", "lchown", "fchownat", "utimes",
+    "utimensat", "mknod", "mknodat", "setxattr", "lsetxattr", "removexattr", "lremovexattr",
+];
+
+/// Files a run touched, as `run --trace-files` records them: the manifest
+/// sandbox policies and cache keys can be derived from. Paths are absolute
+/// inside the container, sorted and listed once per kind. strace writes its
+/// logs where the traced program can write too, so a script can forge its
+/// own manifest: it describes scripts that are trusted, and is no proof of
+/// what an untrusted one did.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct FileTrace {
+    pub script: String,
+    pub language: String,
+    /// Files opened for reading and paths inspected, e.g. with stat
+    pub read: Vec<String>,
+    /// Files opened for writing, and paths created, removed, renamed or
+    /// whose metadata changed
+    pub written: Vec<String>,
+    /// Programs started
+    pub executed: Vec<String>,
+    /// Paths looked up that did not exist, which change the run once they do
+    pub missing: Vec<String>,
+}
+
+/// Wraps `command` so strace records the file calls of it and every process
+/// it starts in [`CONTAINER_TRACE_DIR`]. File descriptors are printed with
+/// their paths so calls relative to a directory can be resolved.
+pub fn trace_command(command: &[String]) -> Vec<String> {
+    let mut traced: Vec<String> = [
+        "strace",
+        "-ff",
+        "-qq",
+        "-y",
+        "-s",
+        "4096",
+        "-e",
+        "trace=%file",
+        "-o",
+    ]
+    .iter()
+    .map(|s| s.to_string())
+    .collect();
+    traced.push(format!("{}/{}", CONTAINER_TRACE_DIR, LOG_PREFIX));
+    traced.push("--".to_string());
+    traced.extend(command.iter().cloned());
+    traced
+}
+
+impl FileTrace {
+    /// Reads the logs a traced run left in `dir`, the host side of the trace
+    /// mount. Relative paths are resolved against `cwd`, the directory the
+    /// run started in.
+    pub fn read(script: &str, language: &str, dir: &Path, cwd: &str) -> Result<Self, SingleloadError> {
+        let mut logs = Vec::new();
+        for entry in std::fs::read_dir(dir)? {
+            let entry = entry?;
+            if entry.file_name().to_string_lossy().starts_with(LOG_PREFIX) {
+                logs.push(std::fs::read_to_string(entry.path())?);
+            }
+        }
+        if logs.is_empty() {
+            return Err(SingleloadError::Container(
+                "the run left no trace; is strace in the base image?".to_string(),
+            ));
+        }
+        let mut trace = Self::parse(&logs.join("\n"), cwd);
+        trace.script = script.to_string();
+        trace.language = language.to_string();
+        Ok(trace)
+    }
+
+    /// Collects the paths of strace lines such as
+    /// `openat(AT_FDCWD</workspace>, "/etc/hosts", O_RDONLY|O_CLOEXEC) = 3</etc/hosts>`
+    pub fn parse(log: &str, cwd: &str) -> Self {
+        let (mut read, mut written, mut executed, mut missing) =
+            (BTreeSet::new(), BTreeSet::new(), BTreeSet::new(), BTreeSet::new());
+        for line in log.lines() {
+            let Some(call) = Call::parse(line) else {
+                continue;
+            };
+            let paths: Vec<String> = call
+                .paths
+                .iter()
+                .map(|(dir, path)| resolve(dir.as_deref().unwrap_or(cwd), path))
+                .collect();
+            match call.result {
+                Outcome::Failed(error) if error == "ENOENT" || error == "ENOTDIR" => {
+                    // Only the first path is looked up; a failed rename's
+                    // target was never expected to exist
+                    if let Some(path) = paths.into_iter().next() {
+                        missing.insert(path);
+                    }
+                }
+                Outcome::Failed(_) => {}
+                Outcome::Succeeded => {
+                    let set = if EXEC_CALLS.contains(&call.name) {
+                        &mut executed
+                    } else if WRITE_CALLS.contains(&call.name)
+                        || (OPEN_CALLS.contains(&call.name) && WRITE_FLAGS.iter().any(|f| call.args.contains(f)))
+                    {
+                        &mut written
+                    } else {
+                        &mut read
+                    };
+                    set.extend(paths);
+                }
+            }
+        }
+        Self {
+            read: read.into_iter().collect(),
+            written: written.into_iter().collect(),
+            executed: executed.into_iter().collect(),
+            missing: missing.into_iter().collect(),
+            ..Default::default()
+        }
+    }
+
+    /// Number of distinct paths recorded
+    pub fn len(&self) -> usize {
+        let all: BTreeSet<&String> =
+            self.read.iter().chain(&self.written).chain(&self.executed).chain(&self.missing).collect();
+        all.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+}
+
+enum Outcome<'a> {
+    Succeeded,
+    Failed(&'a str),
+}
+
+/// One line of an strace log
+struct Call<'a> {
+    name: &'a str,
+    args: &'a str,
+    /// Path arguments, each with the directory of the descriptor before it
+    /// when that is how an `*at` call resolves it
+    paths: Vec<(Option<String>, String)>,
+    result: Outcome<'a>,
+}
+
+impl<'a> Call<'a> {
+    fn parse(line: &'a str) -> Option<Self> {
+        // Signals, exits and calls still running when the process died
+        if line.starts_with("---") || line.starts_with("+++") {
+            return None;
+        }
+        let (name, rest) = line.split_once('(')?;
+        if name.is_empty() || !name.chars().all(|c| c.is_ascii_alphanumeric() || c == '_') {
+            return None;
+        }
+        let (args, result) = rest.rsplit_once(") = ")?;
+        let result = match result.strip_prefix("-1 ") {
+            Some(error) => Outcome::Failed(error.split_whitespace().next().unwrap_or_default()),
+            None if result.starts_with('?') => return None,
+            None => Outcome::Succeeded,
+        };
+        // Only renames and links take two paths; the other strings are
+        // argv, link targets or attribute values
+        let mut paths = quoted_paths(args);
+        if name.starts_with("symlink") {
+            paths = paths.split_off(paths.len().saturating_sub(1));
+        } else {
+            paths.truncate(if name.starts_with("rename") || name.starts_with("link") { 2 } else { 1 });
+        }
+        Some(Self {
+            name,
+            args,
+            paths,
+            result,
+        })
+    }
+}
+
+/// The quoted strings of an argument list, with the path of a descriptor
+/// printed right before one, as in `3</workspace/data>, "input.csv"`
+fn quoted_paths(args: &str) -> Vec<(Option<String>, String)> {
+    let mut paths = Vec::new();
+    let mut dir: Option<String> = None;
+    let mut chars = args.char_indices().peekable();
+    while let Some((idx, c)) = chars.next() {
+        match c {
+            '<' => {
+                let end = args[idx + 1..].find('>').map_or(args.len(), |end| idx + 1 + end);
+                dir = Some(args[idx + 1..end].to_string());
+                while chars.peek().is_some_and(|(i, _)| *i <= end) {
+                    chars.next();
+                }
+            }
+            '"' => {
+                let mut value = String::new();
+                while let Some((_, c)) = chars.next() {
+                    match c {
+                        '"' => break,
+                        '\\' => {
+                            if let Some((_, escaped)) = chars.next() {
+                                value.push(escaped);
+                            }
+                        }
+                        c => value.push(c),
+                    }
+                }
+                // Only the argument right after a descriptor is relative to it
+                paths.push((dir.take(), value));
+            }
+            ',' => {}
+            c if c.is_whitespace() => {}
+            _ => dir = None,
+        }
+    }
+    paths.retain(|(_, path)| !path.is_empty());
+    paths
+}
+
+/// `path` made absolute against `dir`, without `.` and `..`
+fn resolve(dir: &str, path: &str) -> String {
+    let mut resolved = PathBuf::from("/");
+    for component in Path::new(dir).join(path).components() {
+        match component {
+            Component::ParentDir => {
+                resolved.pop();
+            }
+            Component::Normal(part) => resolved.push(part),
+            _ => {}
+        }
+    }
+    resolved.to_string_lossy().to_string()
+}
@@ -12,9 +12,58 @@ pub enum Language {
     Bash,
     #[value(name = "dotnet")]
     DotNet,
+    C,
+    Cpp,
+    Cuda,
+    /// C++ host programs using OpenCL
+    #[value(name = "opencl")]
+    OpenCl,
+    Java,
+    Kotlin,
+    /// TypeScript transpiled with esbuild and run on Node.js
+    #[value(name = "typescript")]
+    TypeScript,
 }
 
 impl Language {
+    pub fn all() -> &'static [Language] {
+        &[
+            Language::Python,
+            Language::Javascript,
+            Language::Php,
+            Language::Go,
+            Language::Rust,
+            Language::Bash,
+            Language::DotNet,
+            Language::C,
+            Language::Cpp,
+            Language::Cuda,
+            Language::OpenCl,
+            Language::Java,
+            Language::Kotlin,
+            Language::TypeScript,
+        ]
+    }
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            Language::Python => "python",
+            Language::Javascript => "javascript",
+            Language::Php => "php",
+            Language::Go => "go",
+            Language::Rust => "rust",
+            Language::Bash => "bash",
+            Language::DotNet => "dotnet",
+            Language::C => "c",
+            Language::Cpp => "cpp",
+            Language::Cuda => "cuda",
+            Language::OpenCl => "opencl",
+            Language::Java => "java",
+            Language::Kotlin => "kotlin",
+            Language::TypeScript => "typescript",
+        }
+    }
+
     pub fn file_extension(&self) -> &'static str {
         match self {
             Language::Python => ".py",
@@ -24,6 +73,13 @@ impl Language {
             Language::Rust => ".rs",
             Language::Bash => ".sh",
             Language::DotNet => ".cs",
+            Language::C => ".c",
+            Language::Cpp => ".cpp",
+            Language::Cuda => ".cu",
+            Language::OpenCl => ".cpp",
+            Language::Java => ".java",
+            Language::Kotlin => ".kt",
+            Language::TypeScript => ".ts",
         }
     }
 
@@ -36,6 +92,13 @@ impl Language {
             Language::Rust => "rustc",
             Language::Bash => "bash",
             Language::DotNet => "dotnet",
+            Language::C => "cc",
+            Language::Cpp => "c++",
+            Language::Cuda => "nvcc",
+            Language::OpenCl => "c++",
+            // Both run their compiled classes on the JVM
+            Language::Java | Language::Kotlin => "java",
+            Language::TypeScript => "node",
         }
     }
 
@@ -57,6 +120,15 @@ impl Language {
             }
             Language::Bash => vec![script_path.to_string()],
             Language::DotNet => vec!["run".to_string(), script_path.to_string()],
+            Language::C | Language::Cpp | Language::Cuda | Language::OpenCl => vec![
+                script_path.to_string(),
+                "-o".to_string(),
+                "/tmp/app".to_string(),
+                "&&".to_string(),
+                "/tmp/app".to_string(),
+            ],
+            Language::Java | Language::Kotlin => vec![script_path.to_string()],
+            Language::TypeScript => vec![script_path.to_string()],
         }
     }
 }
@@ -104,16 +176,32 @@ impl ExecutionResult {
 pub struct ContainerConfig {
     pub image: String,
     pub name: String,
+    pub command: Vec<String>,
     pub memory_limit: u64,
     pub cpu_limit: f32,
     pub timeout: std::time::Duration,
     pub network_disabled: bool,
+    /// Podman network mode, overriding `network_disabled`
+    pub network_mode: Option<String>,
     pub read_only: bool,
+    /// Size of the writable /tmp tmpfs in MB
+    pub tmpfs_size_mb: u64,
+    pub pids_limit: u64,
+    /// Keep stdin open so a terminal can be attached
+    pub interactive: bool,
     pub user: String,
     pub security_opts: Vec<String>,
     pub cap_drop: Vec<String>,
     pub mounts: Vec<Mount>,
     pub env: Vec<(String, String)>,
+    /// Working directory of the command, instead of the image's
+    pub working_dir: Option<String>,
+    /// Host devices passed in, as paths or CDI names like `nvidia.com/gpu=all`
+    pub devices: Vec<String>,
+    /// Calls the seccomp profile blocks that this container may make
+    pub allowed_syscalls: Vec<String>,
+    /// Host addresses forwarded to the same port in the container
+    pub published_ports: Vec<std::net::SocketAddr>,
 }
 
 #[derive(Debug, Clone)]
@@ -128,12 +216,17 @@ impl Default for ContainerConfig {
         Self {
             image: String::new(),
             name: String::new(),
+            command: vec![],
             memory_limit: 512 * 1024 * 1024, // 512MB
             cpu_limit: 1.0,
             timeout: std::time::Duration::from_secs(30),
             network_disabled: true,
+            network_mode: None,
             read_only: true,
-            user: "65532:65532", // nonroot user
+            tmpfs_size_mb: 100,
+            pids_limit: 100,
+            interactive: false,
+            user: "65532:65532".to_string(), // nonroot user
             security_opts: vec![
                 "no-new-privileges".to_string(),
                 "seccomp=unconfined".to_string(), // We'll use a custom profile later
@@ -141,6 +234,10 @@ impl Default for ContainerConfig {
             cap_drop: vec!["ALL".to_string()],
             mounts: vec![],
             env: vec![],
+            working_dir: None,
+            devices: vec![],
+            allowed_syscalls: vec![],
+            published_ports: vec![],
         }
     }
 }
\ No newline at end of file
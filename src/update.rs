@@ -0,0 +1,320 @@
+use crate::config::UpdateConfig;
+use crate::directives::VersionRequirement;
+use crate::download::DownloadManager;
+use crate::errors::SingleloadError;
+use crate::signing;
+use clap::ValueEnum;
+use ed25519_dalek::VerifyingKey;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use tracing::{debug, info};
+
+/// Version of the running binary
+pub const VERSION: &str = env!("CARGO_PKG_VERSION");
+
+/// Release manifest every release publishes next to its binaries
+const MANIFEST_FILE: &str = "release.json";
+
+const MANIFEST_LIMIT: u64 = 1024 * 1024;
+
+const SIGNATURE_LIMIT: u64 = 4096;
+
+/// Public key releases are signed with, compiled into release builds;
+/// `update.public_key` is only used by builds without one
+const RELEASE_KEY: Option<&str> = option_env!("SINGLELOAD_RELEASE_KEY");
+
+/// Which releases `self-update` follows
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Channel {
+    /// Tagged releases, only ever moving to a newer version
+    #[default]
+    Stable,
+    /// The build of the latest commit, versioned like `0.5.0-nightly.20261014`
+    /// and also only ever moving forward
+    Nightly,
+}
+
+impl Channel {
+    /// Where the channel's manifest is under `update.url`, laid out like
+    /// GitHub release downloads
+    pub fn manifest_url(&self, base: &str) -> String {
+        let base = base.trim_end_matches('/');
+        match self {
+            Self::Stable => format!("{}/latest/download/{}", base, MANIFEST_FILE),
+            Self::Nightly => format!("{}/download/nightly/{}", base, MANIFEST_FILE),
+        }
+    }
+}
+
+impl std::fmt::Display for Channel {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let name = match self {
+            Self::Stable => "stable",
+            Self::Nightly => "nightly",
+        };
+        write!(f, "{}", name)
+    }
+}
+
+/// A release manifest:
+///
+/// ```json
+/// {
+///   "version": "0.4.0",
+///   "notes": "https://github.com/Singleload/Singleload/releases/tag/v0.4.0",
+///   "binaries": {
+///     "x86_64-linux": {"url": "https://.../singleload-x86_64-linux", "sha256": "..."}
+///   }
+/// }
+/// ```
+///
+/// Every binary has a detached signature at its URL with `.sig` appended.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Release {
+    pub version: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub notes: Option<String>,
+    /// Binaries by platform, `<arch>-<os>` as Rust names them
+    pub binaries: HashMap<String, Binary>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Binary {
+    pub url: String,
+    pub sha256: String,
+}
+
+impl Release {
+    pub fn parse(data: &[u8]) -> Result<Self, SingleloadError> {
+        let mut release: Self = serde_json::from_slice(data)
+            .map_err(|e| SingleloadError::InvalidInput(format!("Invalid release manifest: {}", e)))?;
+        release.version = release.version.trim_start_matches('v').to_string();
+        if VersionRequirement::parse(&release.version).is_none() {
+            return Err(SingleloadError::InvalidInput(format!(
+                "Invalid release manifest: '{}' is not a version",
+                release.version
+            )));
+        }
+        Ok(release)
+    }
+
+    /// The binary built for this host
+    pub fn binary(&self) -> Result<&Binary, SingleloadError> {
+        let platform = platform();
+        self.binaries.get(&platform).ok_or_else(|| {
+            SingleloadError::InvalidInput(format!("Release {} has no binary for {}", self.version, platform))
+        })
+    }
+
+    /// Whether moving from `current` to this release is an update: stable
+    /// releases have to have a newer version number, nightly builds a newer
+    /// version including its pre-release part, so an older signed build is
+    /// never installed over a newer one
+    pub fn is_update(&self, current: &str, channel: Channel) -> bool {
+        match channel {
+            Channel::Stable => VersionRequirement {
+                op: ">",
+                version: current.to_string(),
+            }
+            .matches(&self.version),
+            Channel::Nightly => compare_versions(&self.version, current) == Some(std::cmp::Ordering::Greater),
+        }
+    }
+}
+
+/// Orders versions as semver does: by their release numbers, then a
+/// pre-release such as `0.5.0-nightly.20261014` before the release itself,
+/// and pre-releases part by part, numbers numerically. Build metadata after
+/// `+` is ignored.
+fn compare_versions(a: &str, b: &str) -> Option<std::cmp::Ordering> {
+    let split = |version: &str| -> Option<(Vec<u64>, Option<String>)> {
+        let version = version.split('+').next()?;
+        let (core, pre) = match version.split_once('-') {
+            Some((core, pre)) => (core, Some(pre.to_string())),
+            None => (version, None),
+        };
+        let mut numbers = core.split('.').map(|part| part.parse().ok()).collect::<Option<Vec<u64>>>()?;
+        numbers.resize(numbers.len().max(3), 0);
+        Some((numbers, pre))
+    };
+    let ((a_numbers, a_pre), (b_numbers, b_pre)) = (split(a)?, split(b)?);
+    Some(a_numbers.cmp(&b_numbers).then_with(|| match (a_pre, b_pre) {
+        (None, None) => std::cmp::Ordering::Equal,
+        (None, Some(_)) => std::cmp::Ordering::Greater,
+        (Some(_), None) => std::cmp::Ordering::Less,
+        (Some(a), Some(b)) => {
+            let parts = |pre: &str| {
+                pre.split('.')
+                    .map(|part| match part.parse::<u64>() {
+                        // Numeric parts sort before alphanumeric ones
+                        Ok(number) => (0, number, String::new()),
+                        Err(_) => (1, 0, part.to_string()),
+                    })
+                    .collect::<Vec<_>>()
+            };
+            parts(&a).cmp(&parts(&b))
+        }
+    }))
+}
+
+/// Platform name of the host in release manifests, e.g. `aarch64-macos`
+pub fn platform() -> String {
+    format!("{}-{}", std::env::consts::ARCH, std::env::consts::OS)
+}
+
+/// The key releases are verified with: the one compiled in, or
+/// `update.public_key` for builds without one. [`crate::config::Config`]
+/// only takes `update` from the user configuration.
+pub fn release_key(config: &UpdateConfig) -> Result<VerifyingKey, SingleloadError> {
+    let pem = RELEASE_KEY.or(config.public_key.as_deref()).ok_or_else(|| {
+        SingleloadError::InvalidInput(
+            "This build has no release key; set update.public_key to the key releases are signed with".to_string(),
+        )
+    })?;
+    signing::parse_verifying_key(pem).map_err(|e| SingleloadError::InvalidInput(format!("update.public_key: {}", e)))
+}
+
+/// Replaces the running binary with a signed release. The new binary is
+/// staged next to the old one, so the final rename stays on one file
+/// system and is atomic; the old binary is kept as `<exe>.previous` for
+/// [`Updater::rollback`].
+pub struct Updater {
+    downloads: DownloadManager,
+    key: VerifyingKey,
+    url: String,
+    exe: PathBuf,
+}
+
+impl Updater {
+    pub fn new(url: &str, key: VerifyingKey, downloads: DownloadManager) -> Result<Self, SingleloadError> {
+        // Replace the binary a symlink on PATH points at, not the link
+        let exe = std::env::current_exe()?.canonicalize()?;
+        Ok(Self {
+            downloads,
+            key,
+            url: url.to_string(),
+            exe,
+        })
+    }
+
+    /// Updates the binary at `exe` instead of the running one
+    pub fn with_exe(mut self, exe: PathBuf) -> Self {
+        self.exe = exe;
+        self
+    }
+
+    pub fn exe(&self) -> &Path {
+        &self.exe
+    }
+
+    /// Where the binary replaced by the last update or rollback is kept
+    pub fn backup_path(&self) -> PathBuf {
+        sibling(&self.exe, "previous")
+    }
+
+    /// The latest release of `channel`
+    pub async fn check(&self, channel: Channel) -> Result<Release, SingleloadError> {
+        let url = channel.manifest_url(&self.url);
+        debug!("Checking {} for a {} release", url, channel);
+        Release::parse(&self.downloads.fetch(&url, MANIFEST_LIMIT).await?)
+    }
+
+    /// Downloads the release's binary, checks its checksum and signature
+    /// and that it runs, then swaps it in. Returns where the old binary was
+    /// kept.
+    pub async fn install(&self, release: &Release) -> Result<PathBuf, SingleloadError> {
+        let binary = release.binary()?;
+        let staged = sibling(&self.exe, "new");
+        self.downloads.download(&binary.url, &staged, Some(&binary.sha256)).await?;
+        if let Err(e) = self.check_staged(&staged, binary, &release.version).await {
+            let _ = std::fs::remove_file(&staged);
+            return Err(e);
+        }
+        self.swap(&staged)?;
+        info!("Updated {} to {}", self.exe.display(), release.version);
+        Ok(self.backup_path())
+    }
+
+    /// Swaps the binary kept by the last update back in, keeping the
+    /// current one in its place, so a second rollback undoes the first
+    pub fn rollback(&self) -> Result<PathBuf, SingleloadError> {
+        let backup = self.backup_path();
+        if !backup.is_file() {
+            return Err(SingleloadError::InvalidInput(format!(
+                "No previous binary at {} to roll back to",
+                backup.display()
+            )));
+        }
+        let staged = sibling(&self.exe, "new");
+        std::fs::rename(&backup, &staged)?;
+        self.swap(&staged)?;
+        info!("Rolled {} back", self.exe.display());
+        Ok(backup)
+    }
+
+    async fn check_staged(&self, staged: &Path, binary: &Binary, version: &str) -> Result<(), SingleloadError> {
+        let signature = self.downloads.fetch(&format!("{}.sig", binary.url), SIGNATURE_LIMIT).await?;
+        let signature = String::from_utf8_lossy(&signature);
+        let content = std::fs::read(staged)?;
+        signing::verify(&content, &signature, &self.key).map_err(|_| {
+            SingleloadError::SecurityViolation(format!("{} is not signed with the release key", binary.url))
+        })?;
+
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(staged, std::fs::Permissions::from_mode(0o755))?;
+        }
+
+        // A binary that does not start on this host must not replace one that does
+        let output = Command::new(staged).arg("--version").output().map_err(|e| {
+            SingleloadError::InvalidInput(format!("The downloaded binary does not run: {}", e))
+        })?;
+        let printed = String::from_utf8_lossy(&output.stdout);
+        if !output.status.success() || !printed.split_whitespace().any(|word| word == version) {
+            return Err(SingleloadError::InvalidInput(format!(
+                "The downloaded binary reports '{}' instead of version {}",
+                printed.trim(),
+                version
+            )));
+        }
+        Ok(())
+    }
+
+    /// Keeps the binary at `exe` as the backup and moves `staged` into its
+    /// place. Unix replaces the file in one rename while it runs; Windows
+    /// cannot overwrite a running executable but can rename it away.
+    fn swap(&self, staged: &Path) -> Result<(), SingleloadError> {
+        let backup = self.backup_path();
+        if backup.exists() {
+            std::fs::remove_file(&backup)?;
+        }
+        #[cfg(windows)]
+        {
+            std::fs::rename(&self.exe, &backup)?;
+            if let Err(e) = std::fs::rename(staged, &self.exe) {
+                let _ = std::fs::rename(&backup, &self.exe);
+                return Err(e.into());
+            }
+        }
+        #[cfg(not(windows))]
+        {
+            if std::fs::hard_link(&self.exe, &backup).is_err() {
+                std::fs::copy(&self.exe, &backup)?;
+            }
+            std::fs::rename(staged, &self.exe)?;
+        }
+        Ok(())
+    }
+}
+
+/// `singleload` -> `singleload.new`, `singleload.exe` -> `singleload.exe.new`
+fn sibling(exe: &Path, suffix: &str) -> PathBuf {
+    let mut name = exe.file_name().unwrap_or_default().to_os_string();
+    name.push(".");
+    name.push(suffix);
+    exe.with_file_name(name)
+}
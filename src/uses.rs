@@ -0,0 +1,111 @@
+use crate::directives::Directives;
+use crate::errors::SingleloadError;
+use crate::source::strip_shebang;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+
+/// A local file pulled into a script's build with `// singleload: uses`,
+/// staged next to the script under its file name
+#[derive(Debug, Clone, PartialEq)]
+pub struct UsedFile {
+    pub name: String,
+    /// Canonical location on the host
+    pub source: PathBuf,
+}
+
+/// Follows the `uses` directives of `script` and of every file it uses, in
+/// declaration order. Paths are relative to the file declaring them and
+/// have to stay inside the script's directory, symlinks included. Each
+/// file is listed once however many files use it; a file that ends up
+/// using itself, directly or through others, is an error naming the cycle.
+pub fn resolve(script: &Path) -> Result<Vec<UsedFile>, SingleloadError> {
+    let root = script.canonicalize()?;
+    let mut resolver = Resolver {
+        dir: root.parent().unwrap_or(Path::new("/")).to_path_buf(),
+        names: HashMap::from([(file_name(&root)?, root.clone())]),
+        used: Vec::new(),
+        stack: vec![root.clone()],
+    };
+    let directives = Directives::parse(&strip_shebang(&std::fs::read(&root)?));
+    resolver.visit(&root, &directives)?;
+    Ok(resolver.used)
+}
+
+struct Resolver {
+    /// Canonical directory of the script, which used files cannot leave
+    dir: PathBuf,
+    /// Staged names taken so far, and by which file
+    names: HashMap<String, PathBuf>,
+    used: Vec<UsedFile>,
+    /// Files being resolved, from the script down
+    stack: Vec<PathBuf>,
+}
+
+impl Resolver {
+    fn visit(&mut self, file: &Path, directives: &Directives) -> Result<(), SingleloadError> {
+        let dir = file.parent().unwrap_or(Path::new(""));
+        for (line, path) in directives.uses()? {
+            let source = dir.join(&path).canonicalize().map_err(|e| {
+                SingleloadError::InvalidInput(format!("{}:{}: uses {}: {}", file.display(), line, path, e))
+            })?;
+            if !source.starts_with(&self.dir) {
+                return Err(SingleloadError::SecurityViolation(format!(
+                    "{}:{}: uses {}: {} is outside the script's directory",
+                    file.display(),
+                    line,
+                    path,
+                    source.display()
+                )));
+            }
+
+            if let Some(start) = self.stack.iter().position(|f| *f == source) {
+                let cycle: Vec<_> = self.stack[start..]
+                    .iter()
+                    .chain(std::iter::once(&source))
+                    .map(|f| f.display().to_string())
+                    .collect();
+                return Err(SingleloadError::InvalidInput(format!("uses cycle: {}", cycle.join(" -> "))));
+            }
+            if self.used.iter().any(|u| u.source == source) {
+                continue;
+            }
+            if !source.is_file() {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "{}:{}: uses {}: not a file",
+                    file.display(),
+                    line,
+                    path
+                )));
+            }
+
+            // Files are staged side by side, so their names must differ
+            let name = file_name(&source)?;
+            if let Some(other) = self.names.get(&name) {
+                return Err(SingleloadError::InvalidInput(format!(
+                    "{} and {} are both named {}; files a script uses are staged next to it",
+                    other.display(),
+                    source.display(),
+                    name
+                )));
+            }
+            self.names.insert(name.clone(), source.clone());
+
+            let content = std::fs::read(&source)?;
+            let nested = Directives::parse(&strip_shebang(&content));
+            self.used.push(UsedFile {
+                name,
+                source: source.clone(),
+            });
+            self.stack.push(source.clone());
+            self.visit(&source, &nested)?;
+            self.stack.pop();
+        }
+        Ok(())
+    }
+}
+
+fn file_name(path: &Path) -> Result<String, SingleloadError> {
+    path.file_name()
+        .map(|n| n.to_string_lossy().to_string())
+        .ok_or_else(|| SingleloadError::InvalidInput(format!("Invalid path {}", path.display())))
+}
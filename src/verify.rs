@@ -0,0 +1,358 @@
+use crate::batch::{BatchItem, BatchSummary};
+use crate::directives::Directives;
+use crate::errors::SingleloadError;
+use regex::Regex;
+use serde::Serialize;
+use std::path::{Path, PathBuf};
+
+/// Extension of the expected output kept next to a script, `hello.go.golden`
+pub const GOLDEN_EXTENSION: &str = "golden";
+
+/// Rules `normalize` directives name: what they match and the placeholder
+/// it becomes
+const BUILTIN_RULES: &[(&str, &str, &str)] = &[
+    (
+        "timestamps",
+        r"\b\d{4}-\d{2}-\d{2}(?:[T ]\d{2}:\d{2}(?::\d{2}(?:[.,]\d+)?)?(?:Z|[+-]\d{2}:?\d{2})?)?\b|\b\d{2}:\d{2}:\d{2}(?:\.\d+)?\b",
+        "<timestamp>",
+    ),
+    ("uuids", r"\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b", "<uuid>"),
+    ("durations", r"\b\d+(?:\.\d+)?(?:ns|µs|us|ms|s|m|h)\b", "<duration>"),
+    ("addresses", r"\b0x[0-9a-fA-F]{6,16}\b", "<address>"),
+    // Podman names containers' hosts after the first 12 digits of their id
+    ("hostnames", r"\b[0-9a-f]{12}\b", "<hostname>"),
+];
+
+/// A rewrite applied to a script's stdout and to its golden file before they
+/// are compared, so that output that changes from run to run still matches
+#[derive(Debug, Clone)]
+pub struct Normalizer {
+    pattern: Regex,
+    replacement: String,
+}
+
+impl Normalizer {
+    /// Parses the value of a `normalize` directive: built-in rules by name,
+    /// e.g. `timestamps hostnames`, or one substitution such as
+    /// `s/took \d+ files/took N files/`, in the regex crate's syntax
+    pub fn parse(line: usize, value: &str) -> Result<Vec<Self>, SingleloadError> {
+        let invalid = |reason: String| SingleloadError::InvalidInput(format!("line {}: {}", line, reason));
+        let value = value.trim();
+        let mut chars = value.chars();
+        if let (Some('s'), Some(delimiter)) = (chars.next(), chars.next()) {
+            if !delimiter.is_alphanumeric() && !delimiter.is_whitespace() {
+                let parts = split_unescaped(&value[1 + delimiter.len_utf8()..], delimiter);
+                let [pattern, replacement, rest] = parts.as_slice() else {
+                    return Err(invalid(format!("expected s{d}<regex>{d}<replacement>{d}", d = delimiter)));
+                };
+                if !rest.is_empty() {
+                    return Err(invalid(format!("unexpected '{}' after the substitution", rest)));
+                }
+                let pattern = Regex::new(pattern).map_err(|e| invalid(format!("invalid regex: {}", e)))?;
+                return Ok(vec![Self {
+                    pattern,
+                    replacement: replacement.to_string(),
+                }]);
+            }
+        }
+
+        let mut rules = Vec::new();
+        for name in value.split_whitespace() {
+            let names = || BUILTIN_RULES.iter().map(|(n, _, _)| *n).collect::<Vec<_>>().join(", ");
+            let (_, pattern, placeholder) = BUILTIN_RULES
+                .iter()
+                .find(|(n, _, _)| n.eq_ignore_ascii_case(name))
+                .ok_or_else(|| invalid(format!("unknown normalization '{}' (use {} or s/<regex>/<text>/)", name, names())))?;
+            let mut pattern = pattern.to_string();
+            if name.eq_ignore_ascii_case("hostnames") {
+                if let Some(host) = host_name() {
+                    pattern = format!(r"\b{}\b|{}", regex::escape(&host), pattern);
+                }
+            }
+            rules.push(Self {
+                pattern: Regex::new(&pattern).map_err(|e| invalid(e.to_string()))?,
+                replacement: placeholder.to_string(),
+            });
+        }
+        if rules.is_empty() {
+            return Err(invalid("'normalize' directive needs a rule, e.g. normalize timestamps".to_string()));
+        }
+        Ok(rules)
+    }
+
+    pub fn apply(&self, text: &str) -> String {
+        self.pattern.replace_all(text, self.replacement.as_str()).into_owned()
+    }
+}
+
+/// `text` with every rule applied, in order
+pub fn normalize(text: &str, rules: &[Normalizer]) -> String {
+    rules.iter().fold(text.to_string(), |text, rule| rule.apply(&text))
+}
+
+/// Splits `text` at each `delimiter` not escaped with a backslash; escaped
+/// delimiters lose their backslash, other escapes are kept for the regex
+fn split_unescaped(text: &str, delimiter: char) -> Vec<String> {
+    let mut parts = vec![String::new()];
+    let mut chars = text.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' if chars.peek() == Some(&delimiter) => parts.last_mut().unwrap().push(chars.next().unwrap()),
+            c if c == delimiter => parts.push(String::new()),
+            c => parts.last_mut().unwrap().push(c),
+        }
+    }
+    parts
+}
+
+/// Name of the machine singleload runs on, which scripts that print the
+/// hostname of an SSH target or a service may show
+fn host_name() -> Option<String> {
+    let name = std::fs::read_to_string("/proc/sys/kernel/hostname")
+        .ok()
+        .or_else(|| std::env::var("HOSTNAME").ok())
+        .or_else(|| std::env::var("COMPUTERNAME").ok())?;
+    Some(name.trim().to_string()).filter(|name| !name.is_empty())
+}
+
+/// What a script has to do to pass
+#[derive(Debug, Clone, Default)]
+pub struct Expectation {
+    pub exit_code: u32,
+    /// Expected stdout and the file it was read from
+    pub stdout: Option<(PathBuf, String)>,
+    /// Rules from the script's `normalize` directives
+    pub normalize: Vec<Normalizer>,
+    /// Golden file `verify --update` writes the stdout to instead of
+    /// comparing it
+    pub update: Option<PathBuf>,
+}
+
+impl Expectation {
+    /// Reads the expected stdout from `golden`, or from the `.golden` file
+    /// next to `script` when there is one, and the `normalize` directives of
+    /// `script`. With `update`, the golden file is to be written instead and
+    /// need not exist.
+    pub fn load(script: &Path, exit_code: u32, golden: Option<&Path>, update: bool) -> Result<Self, SingleloadError> {
+        let normalize = match std::fs::read(script) {
+            Ok(content) => Directives::parse(&content).normalizers()?,
+            // Directory projects have no header of their own
+            Err(_) => Vec::new(),
+        };
+        if update {
+            let path = golden.map_or_else(|| golden_path(script), Path::to_path_buf);
+            return Ok(Self {
+                exit_code,
+                stdout: None,
+                normalize,
+                update: Some(path),
+            });
+        }
+
+        let path = match golden {
+            Some(path) => Some(path.to_path_buf()),
+            None => Some(golden_path(script)).filter(|path| path.is_file()),
+        };
+        let stdout = match path {
+            Some(path) => {
+                let content = std::fs::read_to_string(&path)?;
+                Some((path, content))
+            }
+            None => None,
+        };
+        Ok(Self {
+            exit_code,
+            stdout,
+            normalize,
+            update: None,
+        })
+    }
+}
+
+/// `hello.go` → `hello.go.golden`
+pub fn golden_path(script: &Path) -> PathBuf {
+    let mut name = script.file_name().unwrap_or_default().to_os_string();
+    name.push(".");
+    name.push(GOLDEN_EXTENSION);
+    script.with_file_name(name)
+}
+
+/// Outcome of one verified script
+#[derive(Debug, Serialize)]
+pub struct Verified {
+    pub script: PathBuf,
+    pub passed: bool,
+    pub exit_code: u32,
+    pub duration_ms: u64,
+    /// Why the script did not pass, one line each
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub failures: Vec<String>,
+    /// Golden file `verify --update` rewrote with the stdout
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub updated: Option<PathBuf>,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub stdout: String,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub stderr: String,
+}
+
+#[derive(Debug, Serialize)]
+pub struct VerifySummary {
+    pub total: usize,
+    pub passed: usize,
+    pub failed: usize,
+    /// Golden files rewritten by `verify --update`
+    pub updated: usize,
+    pub duration_ms: u64,
+    pub results: Vec<Verified>,
+}
+
+/// Checks a script's result against what was expected of it. A script
+/// whose golden file is to be updated gets it written when it ended with
+/// the expected exit code and its whole output.
+pub fn check(item: BatchItem, expectation: &Expectation) -> Verified {
+    let result = item.result;
+    let mut failures = Vec::new();
+    let mut updated = None;
+    if let Some(error) = &result.error {
+        failures.push(error.clone());
+    } else {
+        if result.exit_code != expectation.exit_code {
+            failures.push(format!(
+                "exit code {}, expected {}",
+                result.exit_code, expectation.exit_code
+            ));
+        }
+        if let Some((path, expected)) = &expectation.stdout {
+            let expected = normalize(expected, &expectation.normalize);
+            if let Some(difference) = compare_output(&expected, &normalize(&result.stdout, &expectation.normalize)) {
+                failures.push(format!("stdout differs from {}: {}", path.display(), difference));
+            }
+        }
+        if result.truncated {
+            failures.push("output was truncated".to_string());
+        }
+        if let Some(path) = expectation.update.as_ref().filter(|_| failures.is_empty()) {
+            match std::fs::write(path, normalize(&result.stdout, &expectation.normalize)) {
+                Ok(()) => updated = Some(path.clone()),
+                Err(e) => failures.push(format!("failed to write {}: {}", path.display(), e)),
+            }
+        }
+    }
+
+    Verified {
+        script: item.script,
+        passed: failures.is_empty(),
+        exit_code: result.exit_code,
+        duration_ms: result.duration_ms,
+        failures,
+        updated,
+        stdout: result.stdout,
+        stderr: result.stderr,
+    }
+}
+
+/// Checks every script of a batch, with the expectation `expect` gives for it
+pub fn check_all(summary: BatchSummary, mut expect: impl FnMut(&Path) -> Expectation) -> VerifySummary {
+    let results: Vec<Verified> = summary
+        .results
+        .into_iter()
+        .map(|item| {
+            let expectation = expect(&item.script);
+            check(item, &expectation)
+        })
+        .collect();
+    let passed = results.iter().filter(|v| v.passed).count();
+    VerifySummary {
+        total: results.len(),
+        passed,
+        failed: results.len() - passed,
+        updated: results.iter().filter(|v| v.updated.is_some()).count(),
+        duration_ms: summary.duration_ms,
+        results,
+    }
+}
+
+/// Describes where `actual` first differs from `expected`, or None if they
+/// are the same. Line endings and trailing newlines do not count, since
+/// golden files are often edited by hand.
+pub fn compare_output(expected: &str, actual: &str) -> Option<String> {
+    let expected: Vec<&str> = expected.trim_end_matches(['\n', '\r']).lines().collect();
+    let actual: Vec<&str> = actual.trim_end_matches(['\n', '\r']).lines().collect();
+    let line = (0..expected.len().max(actual.len())).find(|&i| expected.get(i) != actual.get(i))?;
+    Some(match (expected.get(line), actual.get(line)) {
+        (Some(want), Some(got)) => format!("line {}: expected {:?}, got {:?}", line + 1, want, got),
+        (Some(want), None) => format!("line {}: expected {:?}, got end of output", line + 1, want),
+        (None, Some(got)) => format!("line {}: unexpected {:?}", line + 1, got),
+        (None, None) => unreachable!(),
+    })
+}
+
+/// JUnit XML report, one test case per script, as CI systems display them
+pub fn junit_xml(summary: &VerifySummary) -> String {
+    let mut xml = String::from("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n");
+    xml.push_str(&format!(
+        "<testsuites tests=\"{}\" failures=\"{}\" time=\"{}\">\n",
+        summary.total,
+        summary.failed,
+        seconds(summary.duration_ms)
+    ));
+    xml.push_str(&format!(
+        "  <testsuite name=\"singleload verify\" tests=\"{}\" failures=\"{}\" time=\"{}\">\n",
+        summary.total,
+        summary.failed,
+        seconds(summary.duration_ms)
+    ));
+    for verified in &summary.results {
+        let script = verified.script.display().to_string();
+        let classname = verified
+            .script
+            .parent()
+            .map(|p| p.display().to_string())
+            .filter(|p| !p.is_empty())
+            .unwrap_or_else(|| ".".to_string());
+        xml.push_str(&format!(
+            "    <testcase name=\"{}\" classname=\"{}\" time=\"{}\">\n",
+            escape(&script),
+            escape(&classname),
+            seconds(verified.duration_ms)
+        ));
+        if let Some(first) = verified.failures.first() {
+            xml.push_str(&format!(
+                "      <failure message=\"{}\">{}</failure>\n",
+                escape(first),
+                escape(&verified.failures.join("\n"))
+            ));
+        }
+        if !verified.stdout.is_empty() {
+            xml.push_str(&format!("      <system-out>{}</system-out>\n", escape(&verified.stdout)));
+        }
+        if !verified.stderr.is_empty() {
+            xml.push_str(&format!("      <system-err>{}</system-err>\n", escape(&verified.stderr)));
+        }
+        xml.push_str("    </testcase>\n");
+    }
+    xml.push_str("  </testsuite>\n</testsuites>\n");
+    xml
+}
+
+fn seconds(ms: u64) -> String {
+    format!("{:.3}", ms as f64 / 1000.0)
+}
+
+fn escape(text: &str) -> String {
+    let mut escaped = String::with_capacity(text.len());
+    for c in text.chars() {
+        match c {
+            '&' => escaped.push_str("&amp;"),
+            '<' => escaped.push_str("&lt;"),
+            '>' => escaped.push_str("&gt;"),
+            '"' => escaped.push_str("&quot;"),
+            '\'' => escaped.push_str("&apos;"),
+            // Control characters other than tab and newlines are not allowed in XML 1.0
+            c if c.is_control() && !matches!(c, '\t' | '\n' | '\r') => {}
+            c => escaped.push(c),
+        }
+    }
+    escaped
+}
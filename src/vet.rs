@@ -0,0 +1,210 @@
+use crate::events::Diagnostic;
+use crate::runner::{shell_quote, Linter};
+use clap::ValueEnum;
+use serde::Serialize;
+use std::path::PathBuf;
+
+/// Prefix of the lines separating the output of each linter
+const SECTION_MARKER: &str = "::singleload-vet::";
+
+/// How serious a finding is, from the level the tool printed
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Severity {
+    Note,
+    Warning,
+    Error,
+}
+
+impl Severity {
+    /// Reads the `error:` or `note:` style level compilers, clippy and
+    /// shellcheck start their messages with. Tools without levels, like
+    /// go vet, staticcheck and ruff, report warnings.
+    pub fn of_message(message: &str) -> Self {
+        let message = message.trim_start().to_lowercase();
+        if message.starts_with("error") || message.starts_with("fatal error") {
+            Self::Error
+        } else if ["note", "help", "info", "style"].iter().any(|level| message.starts_with(level)) {
+            Self::Note
+        } else {
+            Self::Warning
+        }
+    }
+}
+
+impl std::fmt::Display for Severity {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(match self {
+            Self::Note => "note",
+            Self::Warning => "warning",
+            Self::Error => "error",
+        })
+    }
+}
+
+/// `vet --fail-on`: the least severe finding that makes vet exit with 1
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum FailOn {
+    Note,
+    #[default]
+    Warning,
+    Error,
+    /// Report findings but always exit with 0
+    Never,
+}
+
+impl FailOn {
+    pub fn fails(&self, severity: Severity) -> bool {
+        match self {
+            Self::Note => true,
+            Self::Warning => severity >= Severity::Warning,
+            Self::Error => severity == Severity::Error,
+            Self::Never => false,
+        }
+    }
+}
+
+/// A diagnostic and the linter that reported it
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Finding {
+    pub tool: String,
+    pub severity: Severity,
+    #[serde(flatten)]
+    pub diagnostic: Diagnostic,
+}
+
+/// `file:line:column: severity: message [tool]`, whatever the tool printed
+impl std::fmt::Display for Finding {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let diagnostic = &self.diagnostic;
+        write!(f, "{}:{}:", diagnostic.file, diagnostic.line)?;
+        if let Some(column) = diagnostic.column {
+            write!(f, "{}:", column)?;
+        }
+        // Compilers and clippy already start their messages with the level
+        if !diagnostic.message.to_lowercase().starts_with(&self.severity.to_string()) {
+            write!(f, " {}:", self.severity)?;
+        }
+        write!(f, " {} [{}]", diagnostic.message, self.tool)
+    }
+}
+
+/// How one linter's run went
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ToolStatus {
+    Passed,
+    Failed,
+    /// Not installed in the image
+    Skipped,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct ToolReport {
+    pub name: String,
+    pub status: ToolStatus,
+    pub exit_code: Option<i32>,
+    /// Everything the tool printed, for failures no finding was parsed from
+    #[serde(skip)]
+    pub output: String,
+}
+
+/// Result of [`crate::executor::Executor::vet_script`]
+#[derive(Debug, Serialize)]
+pub struct VetOutput {
+    pub language: String,
+    /// No finding reached the `--fail-on` level
+    pub passed: bool,
+    /// The script and, for directory projects, the other sources vetted
+    pub files: Vec<PathBuf>,
+    pub tools: Vec<ToolReport>,
+    pub findings: Vec<Finding>,
+    pub duration_ms: u64,
+}
+
+/// A shell program running each linter in turn, with its stderr merged
+/// into stdout and markers around its output, so one container serves all
+/// of them. Linters whose program is missing are reported as skipped.
+pub fn script(linters: &[Linter]) -> String {
+    linters
+        .iter()
+        .map(|linter| {
+            format!(
+                "echo {begin}; if command -v {program} >/dev/null 2>&1; then ( {command} ) 2>&1; echo \"{marker}end $?\"; else echo {skipped}; fi",
+                begin = shell_quote(&format!("{}begin {}", SECTION_MARKER, linter.name)),
+                program = shell_quote(linter.program),
+                command = linter.command,
+                marker = SECTION_MARKER,
+                skipped = shell_quote(&format!("{}end skipped", SECTION_MARKER)),
+            )
+        })
+        .collect::<Vec<_>>()
+        .join("; ")
+}
+
+/// Splits the output of [`script`] into a report per linter
+pub fn parse(output: &str) -> Vec<ToolReport> {
+    let mut reports = Vec::new();
+    let mut current: Option<(String, String)> = None;
+    for line in output.lines() {
+        if let Some(name) = line.strip_prefix(SECTION_MARKER).and_then(|rest| rest.strip_prefix("begin ")) {
+            current = Some((name.to_string(), String::new()));
+        } else if let Some(status) = line.strip_prefix(SECTION_MARKER).and_then(|rest| rest.strip_prefix("end ")) {
+            let Some((name, output)) = current.take() else {
+                continue;
+            };
+            let exit_code = status.trim().parse::<i32>().ok();
+            let status = match exit_code {
+                None => ToolStatus::Skipped,
+                Some(0) => ToolStatus::Passed,
+                Some(_) => ToolStatus::Failed,
+            };
+            reports.push(ToolReport {
+                name,
+                status,
+                exit_code,
+                output,
+            });
+        } else if let Some((_, output)) = current.as_mut() {
+            output.push_str(line);
+            output.push('\n');
+        }
+    }
+    reports
+}
+
+/// Turns diagnostics parsed from a linter's output into findings. A
+/// linter that failed without a parsable diagnostic, like one that
+/// crashed, is reported as an error against the first file.
+pub fn findings(report: &ToolReport, diagnostics: Vec<Diagnostic>, files: &[PathBuf]) -> Vec<Finding> {
+    let mut findings: Vec<Finding> = diagnostics
+        .into_iter()
+        .map(|diagnostic| Finding {
+            tool: report.name.clone(),
+            severity: Severity::of_message(&diagnostic.message),
+            diagnostic,
+        })
+        .collect();
+    if findings.is_empty() && report.status == ToolStatus::Failed {
+        let message = report
+            .output
+            .lines()
+            .rev()
+            .find(|line| !line.trim().is_empty())
+            .map(|line| line.trim().to_string())
+            .unwrap_or_else(|| format!("exited with {}", report.exit_code.unwrap_or(1)));
+        if let Some(file) = files.first() {
+            findings.push(Finding {
+                tool: report.name.clone(),
+                severity: Severity::Error,
+                diagnostic: Diagnostic {
+                    file: file.display().to_string(),
+                    line: 1,
+                    column: None,
+                    message,
+                },
+            });
+        }
+    }
+    findings
+}
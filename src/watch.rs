@@ -0,0 +1,212 @@
+use crate::assets;
+use crate::directives::Directives;
+use crate::lockfile::Lockfile;
+use crate::pins;
+use crate::project::{Project, MANIFEST_FILE};
+use crate::runner::Registry;
+use crate::source::strip_shebang;
+use crate::uses;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime};
+use tracing::debug;
+
+const POLL_INTERVAL: Duration = Duration::from_millis(500);
+
+/// How often files are polled when change notifications are delivered too,
+/// in case they are on a network filesystem that does not send them
+const FALLBACK_POLL_INTERVAL: Duration = Duration::from_secs(2);
+
+/// Files a run of `script` reads on the host, which `--watch` restarts it
+/// for: the script or project sources, files pulled in with `uses`,
+/// embedded assets, hook files, the lockfile and the toolchain pin. Broken
+/// directives are left for the run itself to report.
+pub fn inputs(script: &Path, lang: Option<&str>, registry: &Registry) -> Vec<PathBuf> {
+    let (main, mut paths) = match Project::is_project(script) {
+        true => match Project::load(script, registry) {
+            Ok(project) => {
+                let mut paths = vec![script.join(MANIFEST_FILE), project.main.clone()];
+                paths.extend(project.sources);
+                (project.main, paths)
+            }
+            // A broken manifest is watched until it is fixed
+            Err(_) => return vec![script.join(MANIFEST_FILE)],
+        },
+        false => (script.to_path_buf(), vec![script.to_path_buf()]),
+    };
+    paths.extend(uses::resolve(&main).unwrap_or_default().into_iter().map(|file| file.source));
+
+    let content = std::fs::read(&main).unwrap_or_default();
+    let directives = Directives::parse(&strip_shebang(&content));
+    let dir = main.parent().unwrap_or(Path::new(""));
+    let embeds = directives.embeds().unwrap_or_default();
+    paths.extend(assets::resolve(dir, &embeds).unwrap_or_default().into_iter().map(|asset| asset.source));
+    for directive in directives.all("pre").chain(directives.all("post")) {
+        if let Some(file) = directive.value.split_whitespace().next().filter(|w| w.starts_with("./") || w.starts_with("../")) {
+            paths.push(dir.join(file));
+        }
+    }
+
+    // Only a lockfile that exists: the run writes a missing one itself
+    let lockfile = Lockfile::path_for(&main);
+    if lockfile.is_file() {
+        paths.push(lockfile);
+    }
+    let runner = match lang {
+        Some(name) => registry.get(name),
+        None => registry.detect(&main, &content),
+    };
+    if let Some(pin) = runner.and_then(|runner| pins::find(runner.toolchain(), dir)) {
+        paths.push(pin.file);
+    }
+
+    paths.dedup();
+    paths
+}
+
+/// Watches a set of files for modifications.
+///
+/// On Linux the directories holding the files are watched with inotify,
+/// which also sees editors that replace a file instead of writing it.
+/// Elsewhere, and as a fallback for network filesystems where inotify
+/// events are not delivered, the files are polled.
+pub struct FileWatcher {
+    paths: Vec<PathBuf>,
+    snapshot: Vec<Option<(SystemTime, u64)>>,
+    #[cfg(target_os = "linux")]
+    notify: Option<inotify::Notify>,
+}
+
+impl FileWatcher {
+    pub fn new(paths: Vec<PathBuf>) -> Self {
+        let snapshot = paths.iter().map(|p| Self::stat(p)).collect();
+        Self {
+            #[cfg(target_os = "linux")]
+            notify: inotify::Notify::watch(&paths)
+                .map_err(|e| debug!("Polling for changes, inotify is unavailable: {}", e))
+                .ok(),
+            paths,
+            snapshot,
+        }
+    }
+
+    /// Waits until one of the watched files is modified, created or removed
+    pub async fn changed(&mut self) -> PathBuf {
+        loop {
+            let notified = self.wait().await;
+            if let Some(path) = notified.or_else(|| self.poll()) {
+                debug!("Detected change in {}", path.display());
+                // Editors often write files in several steps; let them settle
+                tokio::time::sleep(POLL_INTERVAL).await;
+                #[cfg(target_os = "linux")]
+                if let Some(notify) = &self.notify {
+                    notify.drain();
+                }
+                self.snapshot = self.paths.iter().map(|p| Self::stat(p)).collect();
+                return path;
+            }
+        }
+    }
+
+    /// Waits for a change notification, or until it is time to poll
+    async fn wait(&mut self) -> Option<PathBuf> {
+        #[cfg(target_os = "linux")]
+        if let Some(notify) = &self.notify {
+            let idx = tokio::time::timeout(FALLBACK_POLL_INTERVAL, notify.changed()).await.ok()?;
+            return Some(self.paths[idx].clone());
+        }
+        tokio::time::sleep(POLL_INTERVAL).await;
+        None
+    }
+
+    fn poll(&mut self) -> Option<PathBuf> {
+        for (idx, path) in self.paths.iter().enumerate() {
+            let current = Self::stat(path);
+            if current != self.snapshot[idx] {
+                self.snapshot[idx] = current;
+                return Some(path.clone());
+            }
+        }
+        None
+    }
+
+    fn stat(path: &PathBuf) -> Option<(SystemTime, u64)> {
+        let metadata = std::fs::metadata(path).ok()?;
+        Some((metadata.modified().ok()?, metadata.len()))
+    }
+}
+
+#[cfg(target_os = "linux")]
+mod inotify {
+    use nix::sys::inotify::{AddWatchFlags, InitFlags, Inotify, WatchDescriptor};
+    use std::ffi::OsString;
+    use std::os::fd::{AsFd, AsRawFd, RawFd};
+    use std::path::{Path, PathBuf};
+    use tokio::io::unix::AsyncFd;
+
+    /// Changes to the entries a file is watched through
+    const EVENTS: AddWatchFlags = AddWatchFlags::IN_CLOSE_WRITE
+        .union(AddWatchFlags::IN_MOVED_TO)
+        .union(AddWatchFlags::IN_CREATE)
+        .union(AddWatchFlags::IN_DELETE)
+        .union(AddWatchFlags::IN_ATTRIB);
+
+    struct Fd(Inotify);
+
+    impl AsRawFd for Fd {
+        fn as_raw_fd(&self) -> RawFd {
+            self.0.as_fd().as_raw_fd()
+        }
+    }
+
+    /// inotify watches on the directories of a list of files
+    pub struct Notify {
+        fd: AsyncFd<Fd>,
+        /// Directory watch and file name of each file, in order
+        files: Vec<(WatchDescriptor, OsString)>,
+    }
+
+    impl Notify {
+        pub fn watch(paths: &[PathBuf]) -> std::io::Result<Self> {
+            // Readiness comes from the runtime's reactor
+            tokio::runtime::Handle::try_current().map_err(std::io::Error::other)?;
+            let inotify = Inotify::init(InitFlags::IN_NONBLOCK | InitFlags::IN_CLOEXEC)?;
+            let mut files = Vec::new();
+            for path in paths {
+                let dir = match path.parent() {
+                    Some(dir) if !dir.as_os_str().is_empty() => dir,
+                    _ => Path::new("."),
+                };
+                let wd = inotify.add_watch(dir, EVENTS)?;
+                files.push((wd, path.file_name().unwrap_or_default().to_os_string()));
+            }
+            Ok(Self { fd: AsyncFd::new(Fd(inotify))?, files })
+        }
+
+        /// Waits until one of the files changes and returns its index
+        pub async fn changed(&self) -> usize {
+            loop {
+                let Ok(mut ready) = self.fd.readable().await else {
+                    return std::future::pending().await;
+                };
+                match self.fd.get_ref().0.read_events() {
+                    Ok(events) => {
+                        let changed = events.iter().find_map(|event| {
+                            let name = event.name.as_ref()?;
+                            self.files.iter().position(|(wd, file)| *wd == event.wd && file == name)
+                        });
+                        if let Some(idx) = changed {
+                            return idx;
+                        }
+                    }
+                    Err(nix::errno::Errno::EAGAIN) => ready.clear_ready(),
+                    Err(_) => return std::future::pending().await,
+                }
+            }
+        }
+
+        /// Drops the events that arrived so far
+        pub fn drain(&self) {
+            while self.fd.get_ref().0.read_events().is_ok_and(|events| !events.is_empty()) {}
+        }
+    }
+}
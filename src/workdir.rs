@@ -0,0 +1,69 @@
+use crate::errors::SingleloadError;
+use std::path::{Path, PathBuf};
+use tempfile::TempDir;
+
+/// Working directory of `run --isolate-cwd` inside the container
+pub const CONTAINER_WORK_DIR: &str = "/work";
+
+/// A fresh, writable working directory for one run, removed when dropped
+/// unless it is kept. It is owner-only, under `$XDG_RUNTIME_DIR` where
+/// there is one, since seeds can hold credentials; the container user gets
+/// it through [`crate::container::grant`].
+pub struct WorkDir {
+    dir: TempDir,
+}
+
+impl WorkDir {
+    /// Creates the directory and copies `seeds` into it: the contents of
+    /// directories, and files under their own name. Symlinks are skipped
+    /// so nothing outside the seeds is copied.
+    pub fn create(seeds: &[PathBuf]) -> Result<Self, SingleloadError> {
+        let base = std::env::var_os("XDG_RUNTIME_DIR")
+            .filter(|d| !d.is_empty())
+            .map(PathBuf::from)
+            .unwrap_or_else(std::env::temp_dir);
+        let dir = tempfile::Builder::new().prefix("singleload-cwd-").tempdir_in(base)?;
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(dir.path(), std::fs::Permissions::from_mode(0o700))?;
+        }
+        for seed in seeds {
+            let metadata = std::fs::symlink_metadata(seed)
+                .map_err(|e| SingleloadError::InvalidInput(format!("Cannot copy {}: {}", seed.display(), e)))?;
+            if metadata.is_dir() {
+                copy_tree(seed, dir.path())?;
+            } else if metadata.is_file() {
+                let name = seed
+                    .file_name()
+                    .ok_or_else(|| SingleloadError::InvalidInput(format!("Cannot copy {}", seed.display())))?;
+                std::fs::copy(seed, dir.path().join(name))?;
+            }
+        }
+        Ok(Self { dir })
+    }
+
+    pub fn path(&self) -> &Path {
+        self.dir.path()
+    }
+
+    /// Leaves the directory in place and returns where it is
+    pub fn keep(self) -> PathBuf {
+        self.dir.keep()
+    }
+}
+
+fn copy_tree(from: &Path, to: &Path) -> Result<(), SingleloadError> {
+    for entry in std::fs::read_dir(from)? {
+        let entry = entry?;
+        let target = to.join(entry.file_name());
+        let file_type = entry.file_type()?;
+        if file_type.is_dir() {
+            std::fs::create_dir_all(&target)?;
+            copy_tree(&entry.path(), &target)?;
+        } else if file_type.is_file() {
+            std::fs::copy(entry.path(), &target)?;
+        }
+    }
+    Ok(())
+}
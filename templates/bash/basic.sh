@@ -0,0 +1,5 @@
+#!/usr/bin/env singleload
+# {{name}}
+set -euo pipefail
+
+echo "Hello from {{name}}!"
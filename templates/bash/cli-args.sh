@@ -0,0 +1,29 @@
+#!/usr/bin/env singleload
+# {{name}}
+set -euo pipefail
+
+usage() {
+    echo "Usage: {{name}} [-n COUNT] [-v] [NAME...]" >&2
+    exit 2
+}
+
+count=1
+verbose=false
+while getopts "n:vh" opt; do
+    case "$opt" in
+        n) count="$OPTARG" ;;
+        v) verbose=true ;;
+        *) usage ;;
+    esac
+done
+shift $((OPTIND - 1))
+
+names=("${@:-world}")
+for name in "${names[@]}"; do
+    for ((i = 0; i < count; i++)); do
+        echo "Hello, $name!"
+    done
+done
+if [ "$verbose" = true ]; then
+    echo "Greeted ${#names[@]} name(s)" >&2
+fi
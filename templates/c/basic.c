@@ -0,0 +1,9 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+#include <stdio.h>
+
+int main(void) {
+    printf("Hello from {{name}}!\n");
+    return 0;
+}
@@ -0,0 +1,59 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+static void usage(void) {
+    fprintf(stderr, "Usage: {{name}} [-n COUNT] [-v] [NAME...]\n");
+    exit(2);
+}
+
+int main(int argc, char **argv) {
+    int count = 1;
+    int verbose = 0;
+    int first_name = argc;
+    int i;
+
+    for (i = 1; i < argc; i++) {
+        const char *arg = argv[i];
+        if (strcmp(arg, "-n") == 0 || strcmp(arg, "--count") == 0) {
+            char *end;
+            if (++i >= argc) {
+                usage();
+            }
+            count = (int)strtol(argv[i], &end, 10);
+            if (*end != '\0' || count < 0) {
+                usage();
+            }
+        } else if (strcmp(arg, "-v") == 0 || strcmp(arg, "--verbose") == 0) {
+            verbose = 1;
+        } else if (strcmp(arg, "-h") == 0 || strcmp(arg, "--help") == 0) {
+            usage();
+        } else if (strcmp(arg, "--") == 0) {
+            first_name = i + 1;
+            break;
+        } else if (arg[0] == '-') {
+            usage();
+        } else {
+            first_name = i;
+            break;
+        }
+    }
+
+    const char *fallback[] = {"world"};
+    const char **names = first_name < argc ? (const char **)&argv[first_name] : fallback;
+    int name_count = first_name < argc ? argc - first_name : 1;
+
+    for (i = 0; i < name_count; i++) {
+        int n;
+        for (n = 0; n < count; n++) {
+            printf("Hello, %s!\n", names[i]);
+        }
+    }
+    if (verbose) {
+        fprintf(stderr, "Greeted %d name(s)\n", name_count);
+    }
+    return 0;
+}
@@ -0,0 +1,9 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+#include <iostream>
+
+int main() {
+    std::cout << "Hello from {{name}}!" << std::endl;
+    return 0;
+}
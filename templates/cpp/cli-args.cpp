@@ -0,0 +1,63 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+#include <cstdlib>
+#include <iostream>
+#include <string>
+#include <vector>
+
+struct Args {
+    int count = 1;
+    bool verbose = false;
+    std::vector<std::string> names;
+};
+
+[[noreturn]] static void usage() {
+    std::cerr << "Usage: {{name}} [-n COUNT] [-v] [NAME...]" << std::endl;
+    std::exit(2);
+}
+
+static Args parse_args(int argc, char **argv) {
+    Args args;
+    for (int i = 1; i < argc; i++) {
+        std::string arg = argv[i];
+        if (arg == "-n" || arg == "--count") {
+            if (++i >= argc) {
+                usage();
+            }
+            try {
+                args.count = std::stoi(argv[i]);
+            } catch (const std::exception &) {
+                usage();
+            }
+        } else if (arg == "-v" || arg == "--verbose") {
+            args.verbose = true;
+        } else if (arg == "-h" || arg == "--help") {
+            usage();
+        } else if (arg == "--") {
+            args.names.insert(args.names.end(), argv + i + 1, argv + argc);
+            break;
+        } else if (!arg.empty() && arg[0] == '-') {
+            usage();
+        } else {
+            args.names.push_back(arg);
+        }
+    }
+    if (args.names.empty()) {
+        args.names.push_back("world");
+    }
+    return args;
+}
+
+int main(int argc, char **argv) {
+    Args args = parse_args(argc, argv);
+    for (const auto &name : args.names) {
+        for (int n = 0; n < args.count; n++) {
+            std::cout << "Hello, " << name << "!" << std::endl;
+        }
+    }
+    if (args.verbose) {
+        std::cerr << "Greeted " << args.names.size() << " name(s)" << std::endl;
+    }
+    return 0;
+}
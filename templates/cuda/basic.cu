@@ -0,0 +1,18 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+#include <cstdio>
+
+__global__ void hello() {
+    printf("Hello from {{name}}, thread %d!\n", threadIdx.x);
+}
+
+int main() {
+    hello<<<1, 4>>>();
+    cudaError_t err = cudaDeviceSynchronize();
+    if (err != cudaSuccess) {
+        std::fprintf(stderr, "{{name}}: %s\n", cudaGetErrorString(err));
+        return 1;
+    }
+    return 0;
+}
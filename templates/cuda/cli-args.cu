@@ -0,0 +1,85 @@
+#!/usr/bin/env singleload
+// {{name}}
+// singleload: cuda-arch sm_75 compute_75
+
+#include <cstdio>
+#include <cstdlib>
+#include <cstring>
+#include <vector>
+
+struct Args {
+    int count = 1024;
+    float scale = 2.0f;
+    bool verbose = false;
+};
+
+[[noreturn]] static void usage() {
+    std::fprintf(stderr, "Usage: {{name}} [-n COUNT] [-s SCALE] [-v]\n");
+    std::exit(2);
+}
+
+static Args parse_args(int argc, char **argv) {
+    Args args;
+    for (int i = 1; i < argc; i++) {
+        const char *arg = argv[i];
+        if (!std::strcmp(arg, "-n") || !std::strcmp(arg, "--count")) {
+            if (++i >= argc || (args.count = std::atoi(argv[i])) <= 0) {
+                usage();
+            }
+        } else if (!std::strcmp(arg, "-s") || !std::strcmp(arg, "--scale")) {
+            if (++i >= argc) {
+                usage();
+            }
+            args.scale = std::strtof(argv[i], nullptr);
+        } else if (!std::strcmp(arg, "-v") || !std::strcmp(arg, "--verbose")) {
+            args.verbose = true;
+        } else {
+            usage();
+        }
+    }
+    return args;
+}
+
+__global__ void scale(float *x, float a, int n) {
+    int i = blockIdx.x * blockDim.x + threadIdx.x;
+    if (i < n) {
+        x[i] *= a;
+    }
+}
+
+static void check(cudaError_t err) {
+    if (err != cudaSuccess) {
+        std::fprintf(stderr, "{{name}}: %s\n", cudaGetErrorString(err));
+        std::exit(1);
+    }
+}
+
+int main(int argc, char **argv) {
+    Args args = parse_args(argc, argv);
+    std::vector<float> host(args.count);
+    for (int i = 0; i < args.count; i++) {
+        host[i] = static_cast<float>(i);
+    }
+
+    float *device = nullptr;
+    size_t bytes = host.size() * sizeof(float);
+    check(cudaMalloc(&device, bytes));
+    check(cudaMemcpy(device, host.data(), bytes, cudaMemcpyHostToDevice));
+    int threads = 256;
+    scale<<<(args.count + threads - 1) / threads, threads>>>(device, args.scale, args.count);
+    check(cudaGetLastError());
+    check(cudaMemcpy(host.data(), device, bytes, cudaMemcpyDeviceToHost));
+    check(cudaFree(device));
+
+    double sum = 0;
+    for (float x : host) {
+        sum += x;
+    }
+    std::printf("Sum of %d scaled values: %.1f\n", args.count, sum);
+    if (args.verbose) {
+        cudaDeviceProp prop;
+        check(cudaGetDeviceProperties(&prop, 0));
+        std::fprintf(stderr, "Ran on %s (sm_%d%d)\n", prop.name, prop.major, prop.minor);
+    }
+    return 0;
+}
@@ -0,0 +1,5 @@
+#!/usr/bin/env singleload
+// {{name}}
+using System;
+
+Console.WriteLine("Hello from {{name}}!");
@@ -0,0 +1,44 @@
+#!/usr/bin/env singleload
+// {{name}}
+using System;
+using System.Collections.Generic;
+
+var count = 1;
+var verbose = false;
+var names = new List<string>();
+for (var i = 0; i < args.Length; i++)
+{
+    switch (args[i])
+    {
+        case "-n" or "--count" when i + 1 < args.Length && int.TryParse(args[i + 1], out var n):
+            count = n;
+            i++;
+            break;
+        case "-v" or "--verbose":
+            verbose = true;
+            break;
+        case var flag when flag.StartsWith("-"):
+            Console.Error.WriteLine("Usage: {{name}} [-n COUNT] [-v] [NAME...]");
+            return 2;
+        default:
+            names.Add(args[i]);
+            break;
+    }
+}
+if (names.Count == 0)
+{
+    names.Add("world");
+}
+
+foreach (var name in names)
+{
+    for (var i = 0; i < count; i++)
+    {
+        Console.WriteLine($"Hello, {name}!");
+    }
+}
+if (verbose)
+{
+    Console.Error.WriteLine($"Greeted {names.Count} name(s)");
+}
+return 0;
@@ -0,0 +1,9 @@
+#!/usr/bin/env singleload
+// {{name}}
+package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("Hello from {{name}}!")
+}
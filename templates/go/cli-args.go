@@ -0,0 +1,36 @@
+#!/usr/bin/env singleload
+// {{name}}
+//
+// Dependencies are fetched on first run and pinned in a lockfile next to it:
+// singleload: require github.com/spf13/pflag v1.0.5
+package main
+
+import (
+	"fmt"
+	"os"
+
+	flag "github.com/spf13/pflag"
+)
+
+func main() {
+	count := flag.IntP("count", "n", 1, "times to greet each name")
+	verbose := flag.BoolP("verbose", "v", false, "print more")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: {{name}} [flags] [NAME...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	names := flag.Args()
+	if len(names) == 0 {
+		names = []string{"world"}
+	}
+	for _, name := range names {
+		for i := 0; i < *count; i++ {
+			fmt.Printf("Hello, %s!\n", name)
+		}
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "Greeted %d name(s)\n", len(names))
+	}
+}
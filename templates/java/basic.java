@@ -0,0 +1,8 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+public class Main {
+    public static void main(String[] args) {
+        System.out.println("Hello from {{name}}!");
+    }
+}
@@ -0,0 +1,41 @@
+#!/usr/bin/env singleload
+// {{name}}
+//
+// Dependencies are fetched on first run and pinned in a lockfile next to it:
+// singleload: maven info.picocli:picocli:4.7.6
+import java.util.List;
+import java.util.concurrent.Callable;
+
+import picocli.CommandLine;
+import picocli.CommandLine.Command;
+import picocli.CommandLine.Option;
+import picocli.CommandLine.Parameters;
+
+@Command(name = "{{name}}", mixinStandardHelpOptions = true)
+public class Main implements Callable<Integer> {
+    @Option(names = {"-n", "--count"}, description = "times to greet each name")
+    int count = 1;
+
+    @Option(names = {"-v", "--verbose"}, description = "print more")
+    boolean verbose;
+
+    @Parameters(paramLabel = "NAME", defaultValue = "world")
+    List<String> names;
+
+    @Override
+    public Integer call() {
+        for (String name : names) {
+            for (int i = 0; i < count; i++) {
+                System.out.printf("Hello, %s!%n", name);
+            }
+        }
+        if (verbose) {
+            System.err.printf("Greeted %d name(s)%n", names.size());
+        }
+        return 0;
+    }
+
+    public static void main(String[] args) {
+        System.exit(new CommandLine(new Main()).execute(args));
+    }
+}
@@ -0,0 +1,8 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+function main() {
+  console.log("Hello from {{name}}!");
+}
+
+main();
@@ -0,0 +1,6 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+fun main() {
+    println("Hello from {{name}}!")
+}
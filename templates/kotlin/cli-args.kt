@@ -0,0 +1,35 @@
+#!/usr/bin/env singleload
+// {{name}}
+import kotlin.system.exitProcess
+
+fun main(args: Array<String>) {
+    var count = 1
+    var verbose = false
+    val names = mutableListOf<String>()
+    var i = 0
+    while (i < args.size) {
+        when (val arg = args[i]) {
+            "-n", "--count" -> {
+                count = args.getOrNull(++i)?.toIntOrNull() ?: usage()
+            }
+            "-v", "--verbose" -> verbose = true
+            else -> if (arg.startsWith("-")) usage() else names.add(arg)
+        }
+        i++
+    }
+    if (names.isEmpty()) {
+        names.add("world")
+    }
+
+    for (name in names) {
+        repeat(count) { println("Hello, $name!") }
+    }
+    if (verbose) {
+        System.err.println("Greeted ${names.size} name(s)")
+    }
+}
+
+fun usage(): Nothing {
+    System.err.println("Usage: {{name}} [-n COUNT] [-v] [NAME...]")
+    exitProcess(2)
+}
@@ -0,0 +1,23 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+#include <CL/opencl.hpp>
+#include <iostream>
+#include <vector>
+
+int main() {
+    std::vector<cl::Platform> platforms;
+    cl::Platform::get(&platforms);
+    if (platforms.empty()) {
+        std::cerr << "{{name}}: no OpenCL platforms" << std::endl;
+        return 1;
+    }
+    for (const auto &platform : platforms) {
+        std::vector<cl::Device> devices;
+        platform.getDevices(CL_DEVICE_TYPE_ALL, &devices);
+        for (const auto &device : devices) {
+            std::cout << "Hello from {{name}} on " << device.getInfo<CL_DEVICE_NAME>() << "!" << std::endl;
+        }
+    }
+    return 0;
+}
@@ -0,0 +1,92 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+#include <CL/opencl.hpp>
+#include <cstdlib>
+#include <iostream>
+#include <string>
+#include <vector>
+
+struct Args {
+    int count = 1024;
+    float scale = 2.0f;
+    bool verbose = false;
+};
+
+[[noreturn]] static void usage() {
+    std::cerr << "Usage: {{name}} [-n COUNT] [-s SCALE] [-v]" << std::endl;
+    std::exit(2);
+}
+
+static Args parse_args(int argc, char **argv) {
+    Args args;
+    for (int i = 1; i < argc; i++) {
+        std::string arg = argv[i];
+        if (arg == "-n" || arg == "--count") {
+            if (++i >= argc) {
+                usage();
+            }
+            try {
+                args.count = std::stoi(argv[i]);
+            } catch (const std::exception &) {
+                usage();
+            }
+            if (args.count <= 0) {
+                usage();
+            }
+        } else if (arg == "-s" || arg == "--scale") {
+            if (++i >= argc) {
+                usage();
+            }
+            try {
+                args.scale = std::stof(argv[i]);
+            } catch (const std::exception &) {
+                usage();
+            }
+        } else if (arg == "-v" || arg == "--verbose") {
+            args.verbose = true;
+        } else {
+            usage();
+        }
+    }
+    return args;
+}
+
+static const char *KERNEL = R"(
+__kernel void scale(__global float *x, float a) {
+    size_t i = get_global_id(0);
+    x[i] *= a;
+}
+)";
+
+int main(int argc, char **argv) {
+    Args args = parse_args(argc, argv);
+    std::vector<float> values(args.count);
+    for (int i = 0; i < args.count; i++) {
+        values[i] = static_cast<float>(i);
+    }
+
+    try {
+        cl::Context context(CL_DEVICE_TYPE_DEFAULT);
+        cl::Device device = context.getInfo<CL_CONTEXT_DEVICES>().front();
+        cl::Program program(context, KERNEL, true);
+        cl::CommandQueue queue(context, device);
+        cl::Buffer buffer(context, values.begin(), values.end(), false);
+        cl::KernelFunctor<cl::Buffer, float> scale(program, "scale");
+        scale(cl::EnqueueArgs(queue, cl::NDRange(values.size())), buffer, args.scale);
+        cl::copy(queue, buffer, values.begin(), values.end());
+        if (args.verbose) {
+            std::cerr << "Ran on " << device.getInfo<CL_DEVICE_NAME>() << std::endl;
+        }
+    } catch (const cl::Error &e) {
+        std::cerr << "{{name}}: " << e.what() << " (" << e.err() << ")" << std::endl;
+        return 1;
+    }
+
+    double sum = 0;
+    for (float x : values) {
+        sum += x;
+    }
+    std::cout << "Sum of " << args.count << " scaled values: " << sum << std::endl;
+    return 0;
+}
@@ -0,0 +1,5 @@
+#!/usr/bin/env singleload
+<?php
+// {{name}}
+
+echo "Hello from {{name}}!\n";
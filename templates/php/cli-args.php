@@ -0,0 +1,22 @@
+#!/usr/bin/env singleload
+<?php
+// {{name}}
+
+$options = getopt("n:vh", ["count:", "verbose", "help"], $rest);
+if (isset($options["h"]) || isset($options["help"])) {
+    echo "Usage: {{name}} [-n COUNT] [-v] [NAME...]\n";
+    exit(0);
+}
+
+$count = (int) ($options["n"] ?? $options["count"] ?? 1);
+$verbose = isset($options["v"]) || isset($options["verbose"]);
+$names = array_slice($argv, $rest) ?: ["world"];
+
+foreach ($names as $name) {
+    for ($i = 0; $i < $count; $i++) {
+        echo "Hello, $name!\n";
+    }
+}
+if ($verbose) {
+    fwrite(STDERR, "Greeted " . count($names) . " name(s)\n");
+}
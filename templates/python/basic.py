@@ -0,0 +1,10 @@
+#!/usr/bin/env singleload
+# {{name}}
+
+
+def main() -> None:
+    print("Hello from {{name}}!")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,28 @@
+#!/usr/bin/env singleload
+# {{name}}
+#
+# Dependencies are installed on first run and pinned in a lockfile next to it:
+# singleload: pip rich==13.7.1
+
+import argparse
+
+from rich.console import Console
+
+
+def main() -> None:
+    parser = argparse.ArgumentParser(prog="{{name}}", description="Describe {{name}} here.")
+    parser.add_argument("names", nargs="*", default=["world"], help="who to greet")
+    parser.add_argument("-n", "--count", type=int, default=1, help="times to greet each name")
+    parser.add_argument("-v", "--verbose", action="store_true", help="print more")
+    args = parser.parse_args()
+
+    console = Console()
+    for name in args.names:
+        for _ in range(args.count):
+            console.print(f"Hello, [bold]{name}[/bold]!")
+    if args.verbose:
+        console.print(f"Greeted {len(args.names)} name(s)", style="dim")
+
+
+if __name__ == "__main__":
+    main()
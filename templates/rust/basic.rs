@@ -0,0 +1,6 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+fn main() {
+    println!("Hello from {{name}}!");
+}
@@ -0,0 +1,48 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+use std::process::exit;
+
+struct Args {
+    count: usize,
+    verbose: bool,
+    names: Vec<String>,
+}
+
+fn usage() -> ! {
+    eprintln!("Usage: {{name}} [-n COUNT] [-v] [NAME...]");
+    exit(2);
+}
+
+fn parse_args() -> Args {
+    let mut args = Args { count: 1, verbose: false, names: Vec::new() };
+    let mut argv = std::env::args().skip(1);
+    while let Some(arg) = argv.next() {
+        match arg.as_str() {
+            "-n" | "--count" => {
+                args.count = argv.next().and_then(|v| v.parse().ok()).unwrap_or_else(|| usage());
+            }
+            "-v" | "--verbose" => args.verbose = true,
+            "-h" | "--help" => usage(),
+            "--" => args.names.extend(argv.by_ref()),
+            flag if flag.starts_with('-') => usage(),
+            name => args.names.push(name.to_string()),
+        }
+    }
+    if args.names.is_empty() {
+        args.names.push("world".to_string());
+    }
+    args
+}
+
+fn main() {
+    let args = parse_args();
+    for name in &args.names {
+        for _ in 0..args.count {
+            println!("Hello, {}!", name);
+        }
+    }
+    if args.verbose {
+        eprintln!("Greeted {} name(s)", args.names.len());
+    }
+}
@@ -0,0 +1,8 @@
+#!/usr/bin/env singleload
+// {{name}}
+
+function main(): void {
+  console.log("Hello from {{name}}!");
+}
+
+main();
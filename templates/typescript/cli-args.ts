@@ -0,0 +1,31 @@
+#!/usr/bin/env singleload
+// {{name}}
+//
+// Dependencies are installed on first run and pinned in a lockfile next to it:
+// singleload: npm commander@12.1.0
+
+import { program } from "commander";
+
+interface Options {
+  count: number;
+  verbose?: boolean;
+}
+
+program
+  .name("{{name}}")
+  .description("Describe {{name}} here.")
+  .argument("[names...]", "who to greet", ["world"])
+  .option("-n, --count <count>", "times to greet each name", (value: string) => parseInt(value, 10), 1)
+  .option("-v, --verbose", "print more")
+  .action((names: string[], options: Options) => {
+    for (const name of names) {
+      for (let i = 0; i < options.count; i++) {
+        console.log(`Hello, ${name}!`);
+      }
+    }
+    if (options.verbose) {
+      console.error(`Greeted ${names.length} name(s)`);
+    }
+  });
+
+program.parse();